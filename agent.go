@@ -0,0 +1,118 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// Identify the machine backups come from, for buckets shared by many agents
+type AgentConfig struct {
+	// Defaults to an ID generated on the first run and kept in the reports
+	// directory, which stays the same when the machine is renamed
+	ID string `yaml:"id"`
+
+	// Static details recorded with every backup, e.g. {datacenter: "fra1"}
+	Metadata map[string]string `yaml:"metadata"`
+}
+
+// The machine a backup was taken on, as recorded in reports and manifests
+type AgentInfo struct {
+	ID       string            `json:"id"`
+	Hostname string            `json:"hostname,omitempty"`
+	OS       string            `json:"os"`
+	Arch     string            `json:"arch"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// Metadata keys are sent as S3 headers, so are kept to what those allow
+var agentMetadataKey = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+
+// ID generated for this agent, read or created once per process
+var (
+	generatedAgentID string
+	agentIDOnce      sync.Once
+)
+
+// Get the agent's generated ID from the reports directory, creating it on
+// the first run
+func loadAgentID(reportsDir string) string {
+	agentIDOnce.Do(func() {
+		path := filepath.Join(reportsDir, "agent_id")
+
+		if data, err := os.ReadFile(path); err == nil && strings.TrimSpace(string(data)) != "" {
+			generatedAgentID = strings.TrimSpace(string(data))
+			return
+		}
+
+		id := make([]byte, 8)
+		if _, err := rand.Read(id); err != nil {
+			log.Printf("Error generating agent ID: %s\n", err.Error())
+			return
+		}
+		generatedAgentID = hex.EncodeToString(id)
+
+		err := os.MkdirAll(reportsDir, 0755)
+		if err == nil {
+			err = os.WriteFile(path, []byte(generatedAgentID+"\n"), 0644)
+		}
+		if err != nil {
+			log.Printf("Error saving agent ID to %s: %s\n", path, err.Error())
+		}
+	})
+
+	return generatedAgentID
+}
+
+// Describe the machine this runs on
+func (config Config) agentInfo() *AgentInfo {
+	info := &AgentInfo{
+		ID:       config.Agent.ID,
+		OS:       runtime.GOOS,
+		Arch:     runtime.GOARCH,
+		Metadata: config.Agent.Metadata,
+	}
+
+	if info.ID == "" {
+		info.ID = loadAgentID(config.ReportsDir)
+	}
+
+	if hostname, err := os.Hostname(); err == nil {
+		info.Hostname = hostname
+	}
+
+	return info
+}
+
+// Get the S3 object metadata recording the agent on uploaded backups
+func (info *AgentInfo) objectMetadata() map[string]string {
+	metadata := map[string]string{
+		"dbbackup-agent-id": info.ID,
+		"dbbackup-hostname": info.Hostname,
+		"dbbackup-os":       info.OS + "/" + info.Arch,
+	}
+
+	for key, value := range info.Metadata {
+		metadata[key] = value
+	}
+
+	return metadata
+}
+
+// Check the agent's settings
+func validateAgent(errs *validationErrors, agent AgentConfig) {
+	for key := range agent.Metadata {
+		if !agentMetadataKey.MatchString(key) {
+			errs.add("agent.metadata: key %q may only contain letters, digits and hyphens", key)
+		}
+		if strings.HasPrefix(strings.ToLower(key), "dbbackup-") {
+			errs.add("agent.metadata: key %q is reserved", key)
+		}
+	}
+}
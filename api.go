@@ -0,0 +1,416 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Most finished jobs kept for polling, the oldest being forgotten first
+const maxFinishedJobs = 100
+
+// Most output kept for a job, the start of longer output being dropped
+const maxJobOutput = 64 * 1024
+
+// Hold the state of a job started through the API
+type Job struct {
+	ID         string     `json:"id"`
+	Command    string     `json:"command"`
+	Args       []string   `json:"args,omitempty"`
+	Status     string     `json:"status"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	ExitCode   *int       `json:"exit_code,omitempty"`
+	Output     string     `json:"output,omitempty"`
+	Report     *RunReport `json:"report,omitempty"`
+
+	// Bytes of output written, including any dropped
+	written int64
+
+	// Closed and replaced whenever the job changes
+	changed chan struct{}
+}
+
+var (
+	jobs      = map[string]*Job{}
+	jobOrder  = []string{}
+	jobsMutex sync.Mutex
+	jobSerial = 0
+)
+
+// Subcommands the API won't run: ones that prompt, run servers, or replace
+// the binary
+var apiExcludedCommands = map[string]bool{
+	"init":        true,
+	"serve":       true,
+	"monitor":     true,
+	"self-update": true,
+	"completion":  true,
+	"gen-docs":    true,
+}
+
+// Get the subcommands the API can run
+func apiCommands() []string {
+	names := []string{}
+	for _, c := range commands {
+		if !apiExcludedCommands[c.Name] {
+			names = append(names, c.Name)
+		}
+	}
+	return names
+}
+
+// Record a new running job, forgetting the oldest finished ones over the limit
+func addJob(command string, args []string) *Job {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	jobSerial++
+	job := &Job{
+		ID:        fmt.Sprintf("%s-%d", time.Now().Format("20060102150405"), jobSerial),
+		Command:   command,
+		Args:      args,
+		Status:    "running",
+		StartedAt: time.Now(),
+		changed:   make(chan struct{}),
+	}
+	jobs[job.ID] = job
+	jobOrder = append(jobOrder, job.ID)
+
+	finished := 0
+	for _, id := range jobOrder {
+		if jobs[id].FinishedAt != nil {
+			finished++
+		}
+	}
+
+	kept := []string{}
+	for _, id := range jobOrder {
+		if finished > maxFinishedJobs && jobs[id].FinishedAt != nil {
+			delete(jobs, id)
+			finished--
+			continue
+		}
+		kept = append(kept, id)
+	}
+	jobOrder = kept
+
+	return job
+}
+
+// Wake anything waiting on the job. Called with jobsMutex held.
+func (job *Job) notify() {
+	close(job.changed)
+	job.changed = make(chan struct{})
+}
+
+// Record a job finishing. Called with jobsMutex held.
+func (job *Job) finish(status string) {
+	now := time.Now()
+	job.FinishedAt = &now
+	job.Status = status
+	job.notify()
+}
+
+// Appends a command's output to its job, keeping only the end of long output
+type jobOutput struct {
+	job *Job
+}
+
+func (o jobOutput) Write(p []byte) (int, error) {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	o.job.Output += string(p)
+	if len(o.job.Output) > maxJobOutput {
+		o.job.Output = o.job.Output[len(o.job.Output)-maxJobOutput:]
+	}
+	o.job.written += int64(len(p))
+	o.job.notify()
+
+	return len(p), nil
+}
+
+// Start a backup job in the background, returning nil if one is already running
+func startJob(ctx context.Context, config Config, trigger string) *Job {
+	if backupRunning(config) {
+		return nil
+	}
+
+	job := addJob("backup", nil)
+
+	go func() {
+		defer redactPanic()
+		report := runBackups(ctx, config, trigger)
+
+		jobsMutex.Lock()
+		defer jobsMutex.Unlock()
+
+		job.Report = report
+
+		if report == nil {
+			job.finish("skipped")
+		} else if report.Success {
+			job.finish("succeeded")
+		} else {
+			job.finish("failed")
+		}
+	}()
+
+	return job
+}
+
+// Start a subcommand in the background, run as its own process of this binary
+// acting on the config's profile, so it behaves exactly as on the command line.
+// The trigger is recorded in the audit log as what started it.
+func startCommandJob(ctx context.Context, config Config, name string, args []string, trigger string) (*Job, error) {
+	known := false
+	for _, command := range apiCommands() {
+		known = known || command == name
+	}
+	if !known {
+		return nil, fmt.Errorf("unknown command %q", name)
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	job := addJob(name, args)
+
+	cmd := exec.Command(executable, append([]string{name}, args...)...)
+	cmd.Env = append(os.Environ(), triggerEnv+"="+trigger)
+	if config.profile != "" {
+		cmd.Env = append(cmd.Env, "DBBACKUP_PROFILE="+config.profile)
+	}
+	cmd.Stdout = jobOutput{job}
+	cmd.Stderr = jobOutput{job}
+
+	go func() {
+		defer redactPanic()
+		err := runProcessGroup(ctx, cmd)
+
+		jobsMutex.Lock()
+		defer jobsMutex.Unlock()
+
+		code := 0
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) {
+			code = exitErr.ExitCode()
+		} else if err != nil {
+			code = exitFailure
+			job.Output += err.Error() + "\n"
+		}
+		job.ExitCode = &code
+
+		if code == 0 {
+			job.finish("succeeded")
+		} else {
+			job.finish("failed")
+		}
+	}()
+
+	return job, nil
+}
+
+// Get a copy of a job so it can be encoded without holding the lock
+func getJob(id string) (Job, bool) {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	job, ok := jobs[id]
+	if !ok {
+		return Job{}, false
+	}
+
+	return *job, true
+}
+
+// Wait for a job to change after the copy given was taken, returning the new
+// state
+func waitJob(ctx context.Context, seen Job) (Job, error) {
+	select {
+	case <-seen.changed:
+	case <-ctx.Done():
+		return seen, ctx.Err()
+	}
+
+	job, ok := getJob(seen.ID)
+	if !ok {
+		return seen, fmt.Errorf("job %s was forgotten", seen.ID)
+	}
+	return job, nil
+}
+
+// Get the output written since an earlier copy of the job was taken
+func (job Job) outputSince(seen Job) string {
+	unseen := job.written - seen.written
+	if unseen > int64(len(job.Output)) {
+		return job.Output
+	}
+	return job.Output[int64(len(job.Output))-unseen:]
+}
+
+// Write a value as a JSON response
+func writeJSON(w http.ResponseWriter, status int, value interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(value)
+}
+
+// Write an error as a JSON response
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+// Get the trigger recorded for an authorised API request: api: and the user it
+// logged in as, or api:token when it used the token
+func apiTrigger(auth HTTPAuth, r *http.Request) string {
+	if username, _, ok := r.BasicAuth(); ok && auth.Username != "" && username == auth.Username {
+		return "api:" + username
+	}
+	return "api:token"
+}
+
+// Register the REST API handlers on the given mux
+func registerAPI(ctx context.Context, config Config, mux *http.ServeMux) {
+	auth := config.API.HTTPAuth
+
+	// POST starts a backup, GET lists jobs started since this process began
+	mux.HandleFunc("/api/v1/backups", requireAuth(auth, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			job := startJob(ctx, config, apiTrigger(auth, r))
+			if job == nil {
+				writeJSONError(w, http.StatusConflict, "a backup is already running")
+				return
+			}
+
+			w.Header().Set("Location", "/api/v1/jobs/"+job.ID)
+			writeJSON(w, http.StatusAccepted, job)
+		case http.MethodGet:
+			jobsMutex.Lock()
+			list := []Job{}
+			for _, id := range jobOrder {
+				list = append(list, *jobs[id])
+			}
+			jobsMutex.Unlock()
+
+			writeJSON(w, http.StatusOK, list)
+		default:
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	}))
+
+	// GET lists the subcommands that can be run, POST to /api/v1/commands/<name>
+	// with {"args": [...]} runs one as a job, as on the command line
+	mux.HandleFunc("/api/v1/commands", requireAuth(auth, func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, apiCommands())
+	}))
+
+	mux.HandleFunc("/api/v1/commands/", requireAuth(auth, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+			return
+		}
+
+		body := struct {
+			Args []string `json:"args"`
+		}{}
+		if r.ContentLength != 0 {
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "invalid body: "+err.Error())
+				return
+			}
+		}
+
+		job, err := startCommandJob(ctx, config, strings.TrimPrefix(r.URL.Path, "/api/v1/commands/"), body.Args, apiTrigger(auth, r))
+		if err != nil {
+			writeJSONError(w, http.StatusNotFound, err.Error())
+			return
+		}
+
+		w.Header().Set("Location", "/api/v1/jobs/"+job.ID)
+		writeJSON(w, http.StatusAccepted, job)
+	}))
+
+	// Poll the status of a single job
+	mux.HandleFunc("/api/v1/jobs/", requireAuth(auth, func(w http.ResponseWriter, r *http.Request) {
+		id := strings.TrimPrefix(r.URL.Path, "/api/v1/jobs/")
+
+		job, ok := getJob(id)
+		if !ok {
+			writeJSONError(w, http.StatusNotFound, "job not found")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, job)
+	}))
+
+	// Run history from the reports directory
+	mux.HandleFunc("/api/v1/reports", requireAuth(auth, func(w http.ResponseWriter, r *http.Request) {
+		reports, err := loadReports(config.ReportsDir)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		writeJSON(w, http.StatusOK, reports)
+	}))
+
+	// Overall agent status
+	mux.HandleFunc("/api/v1/status", requireAuth(auth, func(w http.ResponseWriter, r *http.Request) {
+		reports, err := loadReports(config.ReportsDir)
+		if err != nil {
+			writeJSONError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		// Restores run from the command line, so their progress is read from the file they write
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"running":   backupRunning(config),
+			"next_runs": nextRuns(config.CronInterval, 5),
+			"databases": databaseStatuses(reports),
+			"restore":   loadRestoreProgress(config.ReportsDir),
+			"pause":     config.activePause(),
+			"jobs":      loadSchedulerState(config),
+		})
+	}))
+
+	// Pause scheduled backups for maintenance, or resume them
+	mux.HandleFunc("/api/v1/pause", requireAuth(auth, pauseHandler(config)))
+}
+
+// Run the REST API server. Blocks until the server stops.
+func serveAPI(ctx context.Context, config Config) {
+	defer redactPanic()
+
+	if config.API.Listen == "" {
+		log.Println("No API listen address configured")
+		return
+	}
+
+	if config.API.Token == "" && config.API.Username == "" {
+		log.Println("Refusing to start API without a token or username configured")
+		return
+	}
+
+	mux := http.NewServeMux()
+	registerAPI(ctx, config, mux)
+
+	log.Printf("Starting API server on %s\n", config.API.Listen)
+
+	err := http.ListenAndServe(config.API.Listen, mux)
+	if err != nil {
+		log.Printf("Error running API server: %s\n", err.Error())
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Wait for a job to finish, failing the test if it takes too long
+func waitForJob(t *testing.T, job *Job) Job {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	current, _ := getJob(job.ID)
+	for current.FinishedAt == nil {
+		var err error
+		current, err = waitJob(ctx, current)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return current
+}
+
+func TestCommandJob(t *testing.T) {
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake := newFakeCommands()
+	fake.outputs[filepath.Base(executable)] = "3 backups\n"
+	runner = fake
+	defer func() { runner = systemCommands{} }()
+
+	job, err := startCommandJob(context.Background(), Config{}, "history", []string{"--json"}, "api:token")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	finished := waitForJob(t, job)
+	if finished.Status != "succeeded" || finished.ExitCode == nil || *finished.ExitCode != 0 {
+		t.Errorf("job finished %s with exit code %v", finished.Status, finished.ExitCode)
+	}
+	if finished.Output != "3 backups\n" {
+		t.Errorf("job output %q", finished.Output)
+	}
+
+	want := [][]string{{executable, "history", "--json"}}
+	if got := fake.commandsRun(); !reflect.DeepEqual(got, want) {
+		t.Errorf("ran %v, want %v", got, want)
+	}
+}
+
+func TestCommandJobTrigger(t *testing.T) {
+	fake := newFakeCommands()
+	runner = fake
+	defer func() { runner = systemCommands{} }()
+
+	config := Config{}
+	config.API.Token = "secret"
+	config.API.Username = "ops"
+	config.API.Password = "hunter2"
+	mux := http.NewServeMux()
+	registerAPI(context.Background(), config, mux)
+
+	for _, login := range []func(*http.Request){
+		func(r *http.Request) { r.Header.Set("Authorization", "Bearer secret") },
+		func(r *http.Request) { r.SetBasicAuth("ops", "hunter2") },
+	} {
+		recorder := httptest.NewRecorder()
+		request := httptest.NewRequest(http.MethodPost, "/api/v1/commands/history", nil)
+		login(request)
+		mux.ServeHTTP(recorder, request)
+		if recorder.Code != http.StatusAccepted {
+			t.Fatalf("running history returned %d", recorder.Code)
+		}
+
+		id := strings.TrimPrefix(recorder.Header().Get("Location"), "/api/v1/jobs/")
+		waitForJob(t, &Job{ID: id})
+	}
+
+	envs := fake.commandEnvs()
+	for i, want := range []string{"api:token", "api:ops"} {
+		if i >= len(envs) || !contains(envs[i], triggerEnv+"="+want) {
+			t.Errorf("command %d wasn't told its trigger is %s", i, want)
+		}
+	}
+
+	t.Setenv(triggerEnv, "api:ops")
+	if trigger := commandTrigger(); trigger != "api:ops" {
+		t.Errorf("command's trigger is %q", trigger)
+	}
+	os.Unsetenv(triggerEnv)
+	if trigger := commandTrigger(); trigger != "manual" {
+		t.Errorf("command line trigger is %q", trigger)
+	}
+}
+
+func TestCommandJobRejectsExcludedCommands(t *testing.T) {
+	for _, name := range []string{"serve", "self-update", "init", "no-such-command"} {
+		if _, err := startCommandJob(context.Background(), Config{}, name, nil, "api:token"); err == nil {
+			t.Errorf("%s was started", name)
+		}
+	}
+
+	config := Config{}
+	config.API.Token = "secret"
+	mux := http.NewServeMux()
+	registerAPI(context.Background(), config, mux)
+
+	recorder := httptest.NewRecorder()
+	request := httptest.NewRequest(http.MethodPost, "/api/v1/commands/serve", nil)
+	request.Header.Set("Authorization", "Bearer secret")
+	mux.ServeHTTP(recorder, request)
+	if recorder.Code != http.StatusNotFound {
+		t.Errorf("running serve returned %d, want %d", recorder.Code, http.StatusNotFound)
+	}
+
+	recorder = httptest.NewRecorder()
+	request = httptest.NewRequest(http.MethodGet, "/api/v1/commands", nil)
+	request.Header.Set("Authorization", "Bearer secret")
+	mux.ServeHTTP(recorder, request)
+	if !strings.Contains(recorder.Body.String(), `"restore"`) || strings.Contains(recorder.Body.String(), `"serve"`) {
+		t.Errorf("listed commands %s", recorder.Body.String())
+	}
+}
+
+func TestFinishedJobsAreForgotten(t *testing.T) {
+	running := addJob("backup", nil)
+
+	for i := 0; i < maxFinishedJobs+20; i++ {
+		job := addJob("history", nil)
+		jobsMutex.Lock()
+		job.finish("succeeded")
+		jobsMutex.Unlock()
+	}
+	addJob("history", nil)
+
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	finished := 0
+	for _, id := range jobOrder {
+		if jobs[id].FinishedAt != nil {
+			finished++
+		}
+	}
+	if finished > maxFinishedJobs {
+		t.Errorf("%d finished jobs kept, want at most %d", finished, maxFinishedJobs)
+	}
+	if len(jobs) != len(jobOrder) {
+		t.Errorf("%d jobs but %d in order", len(jobs), len(jobOrder))
+	}
+	if _, ok := jobs[running.ID]; !ok {
+		t.Error("running job was forgotten")
+	}
+}
+
+func TestJobOutputKeepsTheEnd(t *testing.T) {
+	job := addJob("history", nil)
+	seen, _ := getJob(job.ID)
+
+	output := jobOutput{job}
+	output.Write([]byte(strings.Repeat("a", maxJobOutput)))
+	output.Write([]byte("end"))
+
+	current, _ := getJob(job.ID)
+	if len(current.Output) != maxJobOutput || !strings.HasSuffix(current.Output, "end") {
+		t.Errorf("kept %d bytes ending %q", len(current.Output), current.Output[len(current.Output)-3:])
+	}
+
+	if since := current.outputSince(seen); since != current.Output {
+		t.Errorf("output since the start is %d bytes, want everything kept", len(since))
+	}
+
+	output.Write([]byte("more"))
+	latest, _ := getJob(job.ID)
+	if since := latest.outputSince(current); since != "more" {
+		t.Errorf("new output %q, want %q", since, "more")
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"archive/zip"
+	"compress/flate"
+	"context"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Get the file extension of archives in the configured format
+func (config Config) archiveExtension() string {
+	extension := ".tar.gz"
+	if config.ArchiveFormat == "zip" {
+		extension = ".zip"
+	}
+
+	if config.encryptArchives() {
+		extension += encryptedExtension
+	}
+
+	return extension
+}
+
+// Write the files into an archive in the configured format, encrypted when
+// a passphrase is configured
+func writeArchive(ctx context.Context, config Config, files []string, out io.Writer) error {
+	if config.encryptArchives() {
+		encrypted, err := newEncryptingWriter(out, config.Encryption.Passphrase.reveal(), config.Encryption.KeyID)
+		if err != nil {
+			return err
+		}
+
+		err = writeArchive(ctx, config.withoutEncryption(), files, encrypted)
+		if err != nil {
+			return err
+		}
+
+		return encrypted.Close()
+	}
+
+	if config.ArchiveFormat == "zip" {
+		return createZipArchive(ctx, files, out, config.CompressionLevel)
+	}
+
+	return createArchive(ctx, files, out, config.CompressionLevel)
+}
+
+// Write the files into a zip archive, deflated at the given level
+func createZipArchive(ctx context.Context, files []string, buf io.Writer, level int) error {
+	zw := zip.NewWriter(buf)
+	zw.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+		return flate.NewWriter(out, level)
+	})
+
+	for _, entry := range archiveEntries(files) {
+		err := addToZip(ctx, zw, entry.path, entry.name)
+		if err != nil {
+			zw.Close()
+			return err
+		}
+	}
+
+	return zw.Close()
+}
+
+func addToZip(ctx context.Context, zw *zip.Writer, filename string, name string) error {
+	file, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	header, err := zip.FileInfoHeader(info)
+	if err != nil {
+		return err
+	}
+	header.Name = name
+	header.Method = zip.Deflate
+
+	w, err := zw.CreateHeader(header)
+	if err != nil {
+		return err
+	}
+
+	adviseSequential(file)
+	_, err = copyBuffered(w, &contextReader{ctx: ctx, reader: file})
+	if err != nil {
+		return err
+	}
+	dropPageCache(file)
+
+	return nil
+}
+
+// Extract a single file, or a directory of files, from a zip archive
+func extractFromZip(archive string, name string, dest string) error {
+	zr, err := zip.OpenReader(archive)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	found := false
+
+	for _, entry := range zr.File {
+		path, err := extractPath(entry.Name, name, dest)
+		if err != nil {
+			return err
+		}
+		if path == "" {
+			continue
+		}
+
+		err = extractZipEntry(entry, path)
+		if err != nil {
+			return err
+		}
+
+		found = true
+	}
+
+	if !found {
+		return fmt.Errorf("%s not found in archive", name)
+	}
+
+	return nil
+}
+
+func extractZipEntry(entry *zip.File, path string) error {
+	in, err := entry.Open()
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := createExtracted(path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	return err
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"sync"
+	"time"
+)
+
+// Hold a single entry in the audit log
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"`
+	Target   string    `json:"target"`
+	Trigger  string    `json:"trigger"`
+	User     string    `json:"user,omitempty"`
+	Hostname string    `json:"hostname,omitempty"`
+	Success  bool      `json:"success"`
+	Error    string    `json:"error,omitempty"`
+}
+
+var auditMutex sync.Mutex
+
+// Set for a command started as a job to what started it, e.g. "grpc"
+const triggerEnv = "DBBACKUP_TRIGGER"
+
+// Get what started this command, for the audit log: the trigger of the job
+// running it, or manual when run from the command line
+func commandTrigger() string {
+	if trigger := os.Getenv(triggerEnv); trigger != "" {
+		return trigger
+	}
+	return "manual"
+}
+
+// Append an entry to the audit log. The file is only ever opened for appending,
+// so existing entries are never rewritten.
+func auditLog(config Config, action string, target string, trigger string, actionErr error) {
+	if config.AuditLog == "" {
+		return
+	}
+
+	entry := AuditEntry{
+		Time:    time.Now(),
+		Action:  action,
+		Target:  target,
+		Trigger: trigger,
+		Success: actionErr == nil,
+	}
+
+	if actionErr != nil {
+		entry.Error = actionErr.Error()
+	}
+
+	if u, err := user.Current(); err == nil {
+		entry.User = u.Username
+	}
+
+	if hostname, err := os.Hostname(); err == nil {
+		entry.Hostname = hostname
+	}
+
+	data, err := json.Marshal(entry)
+	if err != nil {
+		log.Printf("Error encoding audit log entry: %s\n", err.Error())
+		return
+	}
+
+	auditMutex.Lock()
+	defer auditMutex.Unlock()
+
+	file, err := openAuditLog(config)
+	if err != nil {
+		log.Printf("Error writing audit log: %s\n", err.Error())
+		return
+	}
+	defer file.Close()
+
+	_, err = file.Write(append(data, '\n'))
+	if err != nil {
+		log.Printf("Error writing audit log: %s\n", err.Error())
+	}
+}
+
+// Open the audit log for appending, creating it if needed
+func openAuditLog(config Config) (*os.File, error) {
+	return os.OpenFile(config.AuditLog, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+}
+
+// Check the audit log can be written, so nothing destructive runs unaudited
+func checkAuditLog(config Config) error {
+	if config.AuditLog == "" {
+		return nil
+	}
+
+	file, err := openAuditLog(config)
+	if err != nil {
+		return fmt.Errorf("audit log %s is not writable: %w", config.AuditLog, err)
+	}
+
+	return file.Close()
+}
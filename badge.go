@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Names the badge and status object are uploaded under on each target
+const (
+	badgeSVGName  = "badge.svg"
+	badgeJSONName = "status.json"
+)
+
+// Hold the freshness of a single database's backups, as shown on its badge
+type BackupBadge struct {
+	Engine      string     `json:"engine"`
+	Host        string     `json:"host"`
+	Database    string     `json:"database"`
+	Status      string     `json:"status"` // ok, failing, stale or never
+	LastSuccess *time.Time `json:"last_success,omitempty"`
+	Message     string     `json:"message"`
+}
+
+// Hold the freshness of a set of databases. The top-level fields follow
+// shields.io's endpoint format, so the JSON can be used as a badge there too.
+type BadgeStatus struct {
+	SchemaVersion int           `json:"schemaVersion"`
+	Label         string        `json:"label"`
+	Message       string        `json:"message"`
+	Color         string        `json:"color"`
+	UpdatedAt     time.Time     `json:"updated_at"`
+	Databases     []BackupBadge `json:"databases"`
+}
+
+// Badge statuses from best to worst, with their shields.io color
+var badgeStatuses = []struct {
+	status string
+	color  string
+}{
+	{"ok", "brightgreen"},
+	{"failing", "orange"},
+	{"stale", "red"},
+	{"never", "red"},
+}
+
+// Hex colors the SVG badge is drawn with
+var badgeColors = map[string]string{
+	"brightgreen": "#4c1",
+	"orange":      "#fe7d37",
+	"red":         "#e05d44",
+	"lightgrey":   "#9f9f9f",
+}
+
+// Get how bad a badge status is, 0 being ok
+func badgeRank(status string) int {
+	for i, s := range badgeStatuses {
+		if s.status == status {
+			return i
+		}
+	}
+
+	return 0
+}
+
+// Format how long ago something happened in a few characters, e.g. "3h"
+func formatAge(age time.Duration) string {
+	switch {
+	case age < time.Hour:
+		return fmt.Sprintf("%dm", int(age/time.Minute))
+	case age < 48*time.Hour:
+		return fmt.Sprintf("%dh", int(age/time.Hour))
+	default:
+		return fmt.Sprintf("%dd", int(age/(24*time.Hour)))
+	}
+}
+
+// Work out the badge of every configured database from the run history.
+// Databases are stale once past their max_backup_age, or since when history
+// began for those never backed up.
+func backupBadges(config Config, reports []RunReport, now time.Time, since time.Time) []BackupBadge {
+	lastFailed := map[string]bool{}
+	for _, status := range databaseStatuses(reports) {
+		lastFailed[status.Engine+"/"+status.Host+"/"+status.Name] = !status.Success
+	}
+
+	badges := []BackupBadge{}
+
+	for _, f := range databaseFreshness(config, reports) {
+		badge := BackupBadge{Engine: f.Engine, Host: f.Host, Database: f.Name}
+
+		switch {
+		case f.LastSuccess.IsZero():
+			badge.Status = "never"
+			badge.Message = "never backed up"
+		case f.stale(now, since):
+			badge.Status = "stale"
+		case lastFailed[f.Engine+"/"+f.Host+"/"+f.Name]:
+			badge.Status = "failing"
+		default:
+			badge.Status = "ok"
+		}
+
+		if !f.LastSuccess.IsZero() {
+			lastSuccess := f.LastSuccess
+			badge.LastSuccess = &lastSuccess
+			badge.Message = formatAge(now.Sub(f.LastSuccess)) + " ago"
+			if badge.Status != "ok" {
+				badge.Message = badge.Status + ", " + badge.Message
+			}
+		}
+
+		badges = append(badges, badge)
+	}
+
+	return badges
+}
+
+// Sum up badges into one status, shown as the worst of them
+func badgeStatus(badges []BackupBadge, now time.Time) BadgeStatus {
+	status := BadgeStatus{
+		SchemaVersion: 1,
+		Label:         "backup",
+		UpdatedAt:     now,
+		Databases:     badges,
+	}
+
+	if len(badges) == 0 {
+		status.Message = "no databases"
+		status.Color = "lightgrey"
+		return status
+	}
+
+	worst := 0
+	for _, badge := range badges {
+		if rank := badgeRank(badge.Status); rank > worst {
+			worst = rank
+		}
+	}
+	status.Color = badgeStatuses[worst].color
+
+	if len(badges) == 1 {
+		status.Message = badges[0].Message
+		return status
+	}
+
+	count := 0
+	for _, badge := range badges {
+		if badgeRank(badge.Status) == worst {
+			count++
+		}
+	}
+
+	if worst == 0 {
+		status.Message = fmt.Sprintf("%d ok", count)
+	} else {
+		status.Message = fmt.Sprintf("%d of %d %s", count, len(badges), badgeStatuses[worst].status)
+	}
+
+	return status
+}
+
+// Draw a status as a flat SVG badge. Text widths are estimated, as the font
+// isn't available to measure.
+func renderBadgeSVG(status BadgeStatus) string {
+	labelWidth := 10 + 7*len(status.Label)
+	messageWidth := 10 + 7*len(status.Message)
+	width := labelWidth + messageWidth
+
+	color, ok := badgeColors[status.Color]
+	if !ok {
+		color = badgeColors["lightgrey"]
+	}
+
+	label := html.EscapeString(status.Label)
+	message := html.EscapeString(status.Message)
+
+	return fmt.Sprintf(`<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="20" role="img" aria-label="%s: %s">
+<title>%s: %s</title>
+<linearGradient id="s" x2="0" y2="100%%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>
+<clipPath id="r"><rect width="%d" height="20" rx="3" fill="#fff"/></clipPath>
+<g clip-path="url(#r)"><rect width="%d" height="20" fill="#555"/><rect x="%d" width="%d" height="20" fill="%s"/><rect width="%d" height="20" fill="url(#s)"/></g>
+<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">
+<text x="%d" y="15" fill="#010101" fill-opacity=".3">%s</text><text x="%d" y="14">%s</text>
+<text x="%d" y="15" fill="#010101" fill-opacity=".3">%s</text><text x="%d" y="14">%s</text>
+</g>
+</svg>
+`, width, label, message, label, message,
+		width,
+		labelWidth, labelWidth, messageWidth, color, width,
+		labelWidth/2, label, labelWidth/2, label,
+		labelWidth+messageWidth/2, message, labelWidth+messageWidth/2, message)
+}
+
+// Serve a badge of the databases matching the db, host and engine query
+// parameters, or all of them, as SVG or with ?format=json as JSON
+func badgeHandler(config Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		reports, err := loadReports(config.ReportsDir)
+		if err != nil && !os.IsNotExist(err) {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		query := r.URL.Query()
+		now := clk.Now()
+
+		badges := []BackupBadge{}
+		for _, badge := range backupBadges(config, reports, now, processStarted) {
+			if (query.Get("db") != "" && badge.Database != query.Get("db")) ||
+				(query.Get("host") != "" && badge.Host != query.Get("host")) ||
+				(query.Get("engine") != "" && badge.Engine != query.Get("engine")) {
+				continue
+			}
+			badges = append(badges, badge)
+		}
+
+		status := badgeStatus(badges, now)
+		if query.Get("db") != "" {
+			status.Label = query.Get("db") + " backup"
+		}
+
+		// Keep image proxies from showing an old status
+		w.Header().Set("Cache-Control", "no-cache, max-age=0")
+
+		if query.Get("format") == "json" {
+			writeJSON(w, http.StatusOK, status)
+			return
+		}
+
+		w.Header().Set("Content-Type", "image/svg+xml")
+		fmt.Fprint(w, renderBadgeSVG(status))
+	}
+}
+
+// Upload the badge of all databases and the status of each to every target,
+// replacing those from the last run
+func uploadBadges(ctx context.Context, config Config) {
+	reports, err := loadReports(config.ReportsDir)
+	if err != nil {
+		log.Printf("Error loading reports: %s\n", err.Error())
+		return
+	}
+
+	now := clk.Now()
+	status := badgeStatus(backupBadges(config, reports, now, processStarted), now)
+
+	data, err := json.MarshalIndent(status, "", "  ")
+	if err != nil {
+		log.Printf("Error encoding backup status: %s\n", err.Error())
+		return
+	}
+
+	files := []struct {
+		name        string
+		contentType string
+		data        []byte
+	}{
+		{badgeJSONName, "application/json", data},
+		{badgeSVGName, "image/svg+xml", []byte(renderBadgeSVG(status))},
+	}
+
+	for _, file := range files {
+		localPath := filepath.Join(config.TempDir, file.name)
+
+		err := os.WriteFile(localPath, file.data, 0644)
+		if err != nil {
+			log.Printf("Error writing %s: %s\n", localPath, err.Error())
+			continue
+		}
+
+		for _, target := range config.targets() {
+			target.contentType = file.contentType
+			target.cacheControl = "no-cache, max-age=0"
+
+			err := target.upload(ctx, config, localPath, file.name, false)
+			if err != nil {
+				log.Printf("Error uploading %s to %s: %s\n", file.name, target.Name, err.Error())
+			}
+		}
+
+		os.Remove(localPath)
+	}
+}
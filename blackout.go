@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Hold a period during which scheduled backups don't run. Every field that is
+// set must match for the blackout to be active.
+type BlackoutConfig struct {
+	Name string `yaml:"name"`
+
+	// Days of the month, e.g. "28-31", "1,15" or "last"
+	Days string `yaml:"days"`
+
+	// Days of the week, e.g. "sat,sun" or "mon-fri"
+	Weekdays string `yaml:"weekdays"`
+
+	// Time of day as "HH:MM-HH:MM", which may wrap past midnight
+	Hours string `yaml:"hours"`
+
+	// "skip" (the default) drops the run, "defer" runs it once the blackout ends
+	Action string `yaml:"action"`
+}
+
+var weekdayNames = map[string]int{"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6}
+
+// Parse a list of numbers and ranges like "1,15" or "28-31" into a set. Ranges
+// may wrap around when a cycle length is given, e.g. "sat-sun" for weekdays.
+func parseNumberSet(spec string, names map[string]int, cycle int) (map[int]bool, error) {
+	set := map[int]bool{}
+
+	parse := func(s string) (int, error) {
+		s = strings.ToLower(strings.TrimSpace(s))
+		if n, ok := names[s]; ok {
+			return n, nil
+		}
+		return strconv.Atoi(s)
+	}
+
+	for _, part := range strings.Split(spec, ",") {
+		bounds := strings.SplitN(part, "-", 2)
+
+		start, err := parse(bounds[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid value %q", part)
+		}
+
+		end := start
+		if len(bounds) == 2 {
+			end, err = parse(bounds[1])
+			if err != nil || (end < start && cycle == 0) {
+				return nil, fmt.Errorf("invalid range %q", part)
+			}
+			if end < start {
+				end += cycle
+			}
+		}
+
+		for n := start; n <= end; n++ {
+			if cycle > 0 {
+				set[n%cycle] = true
+			} else {
+				set[n] = true
+			}
+		}
+	}
+
+	return set, nil
+}
+
+// Check every field of the blackout parses
+func (blackout BlackoutConfig) validate() error {
+	if blackout.Days == "" && blackout.Weekdays == "" && blackout.Hours == "" {
+		return fmt.Errorf("needs days, weekdays or hours")
+	}
+
+	if blackout.Days != "" {
+		if _, err := parseNumberSet(blackout.Days, map[string]int{"last": 31}, 0); err != nil {
+			return fmt.Errorf("invalid days: %w", err)
+		}
+	}
+
+	if blackout.Weekdays != "" {
+		if _, err := parseNumberSet(blackout.Weekdays, weekdayNames, 7); err != nil {
+			return fmt.Errorf("invalid weekdays: %w", err)
+		}
+	}
+
+	if blackout.Hours != "" {
+		if _, err := inQuietHours(blackout.Hours, time.Now()); err != nil {
+			return err
+		}
+	}
+
+	if blackout.Action != "" && blackout.Action != "skip" && blackout.Action != "defer" {
+		return fmt.Errorf("unknown action %q", blackout.Action)
+	}
+
+	return nil
+}
+
+// Check whether the blackout covers the given time
+func (blackout BlackoutConfig) active(now time.Time) (bool, error) {
+	if err := blackout.validate(); err != nil {
+		return false, fmt.Errorf("invalid blackout %q: %w", blackout.Name, err)
+	}
+
+	if blackout.Days != "" {
+		lastDay := time.Date(now.Year(), now.Month()+1, 0, 0, 0, 0, 0, now.Location()).Day()
+
+		days, err := parseNumberSet(blackout.Days, map[string]int{"last": lastDay}, 0)
+		if err != nil {
+			return false, err
+		}
+		if !days[now.Day()] {
+			return false, nil
+		}
+	}
+
+	if blackout.Weekdays != "" {
+		weekdays, err := parseNumberSet(blackout.Weekdays, weekdayNames, 7)
+		if err != nil {
+			return false, err
+		}
+		if !weekdays[int(now.Weekday())] {
+			return false, nil
+		}
+	}
+
+	if blackout.Hours != "" {
+		inside, err := inQuietHours(blackout.Hours, now)
+		if err != nil {
+			return false, err
+		}
+		if !inside {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// Find the first blackout covering the given time, in blackout_timezone
+func (config Config) activeBlackout(now time.Time) (BlackoutConfig, bool) {
+	if config.BlackoutTimezone != "" {
+		if location, err := time.LoadLocation(config.BlackoutTimezone); err == nil {
+			now = now.In(location)
+		}
+	}
+
+	for _, blackout := range config.Blackouts {
+		active, err := blackout.active(now)
+		if err != nil {
+			log.Printf("%s\n", err.Error())
+			continue
+		}
+		if active {
+			return blackout, true
+		}
+	}
+
+	return BlackoutConfig{}, false
+}
+
+var (
+	deferredRunMutex sync.Mutex
+
+	// Profiles with a run waiting for a blackout to end
+	deferredRunPending = map[string]bool{}
+)
+
+// Record a run skipped by a blackout or pause in the history and notify about it
+func recordSkippedRun(ctx context.Context, config Config, reason string) {
+	now := clk.Now()
+
+	log.Printf("Scheduled backup %s\n", reason)
+
+	report := &RunReport{
+		StartedAt:  now,
+		FinishedAt: now,
+		Version:    version,
+		Profile:    config.profile,
+		Agent:      config.agentInfo(),
+		Skipped:    true,
+		SkipReason: reason,
+		Databases:  []DatabaseReport{},
+	}
+
+	reportPath := filepath.Join(config.ReportsDir, fmt.Sprintf("report_%s.json", config.timestamp(now)))
+	err := writeReport(report, reportPath)
+	if err == nil {
+		err = signFile(config, reportPath)
+	}
+	if err != nil {
+		log.Printf("Error writing report %s: %s\n", reportPath, err.Error())
+	} else {
+		mirrorReport(ctx, config, reportPath)
+	}
+
+	sendNotification(ctx, config, Notification{
+		Event:   "backup.skipped",
+		Subject: "Backup skipped",
+		Message: "Scheduled backup " + reason,
+		Time:    now,
+	})
+}
+
+// Run the backup once no blackout is active, unless one is already waiting
+func deferRun(ctx context.Context, config Config) {
+	deferredRunMutex.Lock()
+	defer deferredRunMutex.Unlock()
+
+	if deferredRunPending[config.profile] {
+		return
+	}
+	deferredRunPending[config.profile] = true
+
+	go func() {
+		defer func() {
+			deferredRunMutex.Lock()
+			delete(deferredRunPending, config.profile)
+			deferredRunMutex.Unlock()
+		}()
+
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			if _, active := config.activeBlackout(clk.Now()); !active && config.activePause() == nil {
+				log.Println("Blackout ended, running deferred backup")
+				runBackups(ctx, config, "deferred")
+				return
+			}
+		}
+	}()
+}
+
+// Run a scheduled backup, unless backups are paused or a blackout is active
+func runScheduled(ctx context.Context, config Config) {
+	if pause := config.activePause(); pause != nil {
+		recordSkippedRun(ctx, config, fmt.Sprintf("skipped while paused until %s: %s", pause.Until.Format(time.RFC3339), pause.Reason))
+		return
+	}
+
+	blackout, active := config.activeBlackout(clk.Now())
+	if !active {
+		runBackups(ctx, config, "schedule")
+		return
+	}
+
+	if blackout.Action == "defer" {
+		recordSkippedRun(ctx, config, fmt.Sprintf("deferred until blackout %q ends", blackout.Name))
+		deferRun(ctx, config)
+	} else {
+		recordSkippedRun(ctx, config, fmt.Sprintf("skipped during blackout %q", blackout.Name))
+	}
+}
+
+// Get the most recent run that wasn't skipped, from reports sorted newest first
+func latestRun(reports []RunReport) *RunReport {
+	for i := range reports {
+		if !reports[i].Skipped {
+			return &reports[i]
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Hold the limit on the total size of a run's dumps
+type BudgetConfig struct {
+	// Total size of all dumps in a run, e.g. "200G". Empty for no limit.
+	MaxTotalSize string `yaml:"max_total_size"`
+
+	// "warn" (the default) to send an alert, or "abort" to stop dumps that go
+	// over max_size and fail the run when the total goes over max_total_size
+	Action string `yaml:"action"`
+}
+
+var sizePattern = regexp.MustCompile(`^([0-9]+)\s*([KMGTkmgt]?)[Bb]?$`)
+
+// Parse a size such as "500M", "50G" or "1TB" into bytes
+func parseSize(value string) (int64, error) {
+	match := sizePattern.FindStringSubmatch(strings.TrimSpace(value))
+	if match == nil {
+		return 0, fmt.Errorf("invalid size %q", value)
+	}
+
+	size, err := strconv.ParseInt(match[1], 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	shift := strings.Index("KMGT", strings.ToUpper(match[2])) + 1
+	if match[2] == "" {
+		shift = 0
+	}
+
+	return size << (10 * shift), nil
+}
+
+// Get a size limit in bytes, or 0 for none
+func sizeLimit(value string) int64 {
+	if value == "" {
+		return 0
+	}
+
+	limit, err := parseSize(value)
+	if err != nil {
+		return 0
+	}
+
+	return limit
+}
+
+// Check whether going over a budget stops the dump or run rather than only alerting
+func (budget BudgetConfig) aborts() bool {
+	return budget.Action == "abort"
+}
+
+// Cancel a dump once its file grows past limit, so an unexpectedly huge table
+// doesn't fill the disk. Returns a function stopping the watch and reporting
+// whether the dump was cancelled.
+func watchBudget(path string, limit int64, cancel context.CancelFunc) func() bool {
+	var exceeded int32
+	done := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				if fileSize(path) > limit {
+					atomic.StoreInt32(&exceeded, 1)
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	return func() bool {
+		close(done)
+		return atomic.LoadInt32(&exceeded) == 1
+	}
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Hold the retention of the local run history in the reports directory
+type HistoryConfig struct {
+	// Keep at most this many run reports, and none older than max_age, e.g.
+	// "90d". Reports still needed to restore a kept backup are always kept.
+	MaxEntries int    `yaml:"max_entries"`
+	MaxAge     string `yaml:"max_age"`
+
+	// Drop table summaries, schemas and table fingerprints from reports older
+	// than this, e.g. "7d", apart from those schema drift and differential
+	// dumps still compare against
+	CompactAfter string `yaml:"compact_after"`
+
+	// Copy each report to the first storage target, and download them all again
+	// when the reports directory is empty, e.g. after the host is rebuilt
+	Mirror bool `yaml:"mirror"`
+}
+
+// Start of the names reports are mirrored under on the first storage target
+const catalogNamePrefix = "catalog_"
+
+// Check whether any history retention is configured
+func (history HistoryConfig) enabled() bool {
+	return history.MaxEntries > 0 || history.MaxAge != "" || history.CompactAfter != ""
+}
+
+// Get the archive keys a run's databases were written to
+func (r *RunReport) archiveKeys() []string {
+	keys := []string{}
+	if r.ArchiveKey != "" {
+		keys = append(keys, r.ArchiveKey)
+	}
+	for _, db := range r.Databases {
+		if db.ArchiveKey != "" {
+			keys = append(keys, db.ArchiveKey)
+		}
+	}
+
+	return keys
+}
+
+// Work out which reports to keep: those within max_entries and max_age, the
+// newest one, and any holding a backup that a kept report refers to
+func keptReports(history HistoryConfig, files []ReportFile, now time.Time) []bool {
+	keep := make([]bool, len(files))
+
+	var cutoff time.Time
+	if age, err := parseDuration(history.MaxAge); err == nil && history.MaxAge != "" {
+		cutoff = now.Add(-age)
+	}
+
+	for i, file := range files {
+		keep[i] = i == 0 ||
+			((history.MaxEntries == 0 || i < history.MaxEntries) && !file.Report.StartedAt.Before(cutoff))
+	}
+
+	// Differentials and unchanged databases point at older archives, which in
+	// turn may point further back
+	for changed := true; changed; {
+		changed = false
+
+		referenced := map[string]bool{}
+		for i, file := range files {
+			if !keep[i] {
+				continue
+			}
+			for _, db := range file.Report.Databases {
+				if db.Base != nil {
+					referenced[db.Base.ArchiveKey] = true
+				}
+				if db.Reference != nil {
+					referenced[db.Reference.ArchiveKey] = true
+				}
+			}
+		}
+
+		for i, file := range files {
+			if keep[i] {
+				continue
+			}
+			for _, key := range file.Report.archiveKeys() {
+				if referenced[key] {
+					keep[i] = true
+					changed = true
+				}
+			}
+		}
+	}
+
+	return keep
+}
+
+// Drop the bulky per-table details from a report, apart from the databases
+// listed in needed. Returns whether anything was removed.
+func compactReport(report *RunReport, needed map[int]bool) bool {
+	changed := false
+
+	for i := range report.Databases {
+		db := &report.Databases[i]
+		if needed[i] || (db.Tables == nil && db.Schema == nil && db.TableFingerprints == nil) {
+			continue
+		}
+
+		db.Tables = nil
+		db.Schema = nil
+		db.TableFingerprints = nil
+		changed = true
+	}
+
+	return changed
+}
+
+// Apply the history retention to the reports directory, deleting old reports
+// (and their mirrored copies) and compacting the ones kept
+func pruneHistory(ctx context.Context, config Config, trigger string) {
+	history := config.History
+	if !history.enabled() {
+		return
+	}
+
+	files, err := loadReportFiles(config.ReportsDir)
+	if err != nil {
+		log.Printf("Error loading reports: %s\n", err.Error())
+		return
+	}
+
+	now := time.Now()
+	keep := keptReports(history, files, now)
+
+	var compactBefore time.Time
+	if age, err := parseDuration(history.CompactAfter); err == nil && history.CompactAfter != "" {
+		compactBefore = now.Add(-age)
+	}
+
+	// The newest successful schema and full dump fingerprints of each
+	// database are still compared against
+	seenSchema := map[string]bool{}
+	seenFull := map[string]bool{}
+
+	for i, file := range files {
+		if !keep[i] {
+			log.Printf("Deleting report %s\n", file.Path)
+
+			err := os.Remove(file.Path)
+			if err != nil {
+				log.Printf("Error deleting report %s: %s\n", file.Path, err.Error())
+			}
+			auditLog(config, "delete_report", file.Path, trigger, err)
+			os.Remove(file.Path + signatureExtension)
+
+			if history.Mirror {
+				target := config.targets()[0]
+				for _, name := range []string{filepath.Base(file.Path), filepath.Base(file.Path) + signatureExtension} {
+					err := target.delete(ctx, target.key(catalogNamePrefix+name))
+					if err != nil && !os.IsNotExist(err) {
+						log.Printf("Error deleting mirrored report %s: %s\n", name, err.Error())
+					}
+				}
+			}
+			continue
+		}
+
+		needed := map[int]bool{}
+		for j, db := range file.Report.Databases {
+			key := dumpKey(db.Engine, db.Host, db.Name)
+			if db.Success && db.Schema != nil && !seenSchema[key] {
+				seenSchema[key] = true
+				needed[j] = true
+			}
+			if db.Kind == "full" && db.TableFingerprints != nil && !seenFull[key] {
+				seenFull[key] = true
+				needed[j] = true
+			}
+		}
+
+		if compactBefore.IsZero() || !file.Report.StartedAt.Before(compactBefore) {
+			continue
+		}
+
+		if compactReport(&file.Report, needed) {
+			err := writeReport(&file.Report, file.Path)
+			if err == nil {
+				err = signFile(config, file.Path)
+			}
+			if err != nil {
+				log.Printf("Error compacting report %s: %s\n", file.Path, err.Error())
+			}
+		}
+	}
+}
+
+// Copy a report or restore record to the first storage target when mirroring
+// is enabled
+func mirrorReport(ctx context.Context, config Config, reportPath string) {
+	if !config.History.Mirror {
+		return
+	}
+
+	files := []string{reportPath}
+	if _, err := os.Stat(reportPath + signatureExtension); err == nil {
+		files = append(files, reportPath+signatureExtension)
+	}
+
+	target := config.targets()[0]
+	for _, file := range files {
+		err := target.upload(ctx, config, file, catalogNamePrefix+filepath.Base(file), false)
+		if err != nil {
+			log.Printf("Error mirroring report %s to %s: %s\n", file, target.Name, err.Error())
+		}
+	}
+}
+
+// Download the mirrored reports into an empty reports directory, so the
+// history survives the host being rebuilt
+func restoreHistory(ctx context.Context, config Config) {
+	if !config.History.Mirror {
+		return
+	}
+
+	files, err := loadReportFiles(config.ReportsDir)
+	if err != nil || len(files) > 0 {
+		return
+	}
+
+	target := config.targets()[0]
+	objects, err := target.listPrefix(ctx, catalogNamePrefix+"report_")
+	if err != nil {
+		log.Printf("Error listing mirrored reports on %s: %s\n", target.Name, err.Error())
+		return
+	}
+
+	records, err := target.listPrefix(ctx, catalogNamePrefix+restoreRecordPrefix)
+	if err != nil {
+		log.Printf("Error listing mirrored restore records on %s: %s\n", target.Name, err.Error())
+	}
+	objects = append(objects, records...)
+
+	if len(objects) > 0 {
+		log.Printf("Reports directory is empty, downloading %d mirrored reports and signatures from %s\n", len(objects), target.Name)
+	}
+
+	for _, object := range objects {
+		name := strings.TrimPrefix(path.Base(object.Key), catalogNamePrefix)
+
+		err := downloadObject(ctx, target, object.Key, filepath.Join(config.ReportsDir, name))
+		if err != nil {
+			log.Printf("Error downloading mirrored report %s: %s\n", object.Key, err.Error())
+		}
+	}
+}
+
+// Download a single file from a target
+func downloadObject(ctx context.Context, target TargetConfig, key string, dest string) error {
+	body, err := target.open(ctx, key)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, body)
+	if err != nil {
+		out.Close()
+		os.Remove(dest)
+		return err
+	}
+
+	return out.Close()
+}
@@ -0,0 +1,222 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// Hold a pointer from a skipped database to the archive holding its last real dump
+type BackupReference struct {
+	Engine     string `json:"engine"`
+	Host       string `json:"host"`
+	Name       string `json:"name"`
+	ArchiveKey string `json:"archive_key"`
+	File       string `json:"file"`
+
+	// Sizes of the dump and the archive holding it, when restoring
+	size        int64
+	archiveSize int64
+
+	// Checksums of the dump and the archive holding it, when restoring
+	sha256        string
+	archiveSHA256 string
+}
+
+// Build the connection arguments shared by the mysql client tools
+func mysqlConnectionArgs(db DatabaseConfig) []string {
+	args := []string{
+		fmt.Sprintf("--host=%s", db.connectHost()),
+		fmt.Sprintf("--port=%d", db.Port),
+		fmt.Sprintf("--user=%s", db.Username),
+	}
+	args = append(args, db.iamAuthArgs()...)
+	if db.DefaultCharacterSet != "" {
+		args = append(args, fmt.Sprintf("--default-character-set=%s", db.DefaultCharacterSet))
+	}
+
+	return args
+}
+
+// Get the environment for a mysql client tool connecting to a database. The
+// password goes in MYSQL_PWD rather than the arguments, where other users on
+// the host could read it from the process list.
+func mysqlEnv(db DatabaseConfig) []string {
+	return append(os.Environ(), "MYSQL_PWD="+db.mysqlPassword())
+}
+
+// Build the mysqldump arguments for dumping large BLOBs
+func mysqlBlobArgs(db DatabaseConfig) []string {
+	args := []string{}
+	if db.HexBlob {
+		args = append(args, "--hex-blob")
+	}
+	if db.MaxAllowedPacket != "" {
+		args = append(args, "--max-allowed-packet="+db.MaxAllowedPacket)
+	}
+	if db.NetBufferLength != 0 {
+		args = append(args, fmt.Sprintf("--net-buffer-length=%d", db.NetBufferLength))
+	}
+
+	return args
+}
+
+// Run a query with the mysql client and return its tab separated output
+func mysqlQuery(db DatabaseConfig, database string, query string) (string, error) {
+	args := append(mysqlConnectionArgs(db), "--batch", "--skip-column-names", "--execute="+query)
+	if database != "" {
+		args = append(args, database)
+	}
+
+	cmd := exec.Command("mysql", args...)
+	cmd.Env = mysqlEnv(db)
+
+	output, err := commandOutput(cmd)
+	if err != nil {
+		return "", err
+	}
+
+	return string(output), nil
+}
+
+// Quote an identifier for use in a MySQL statement
+func quoteIdentifier(name string) string {
+	return "`" + strings.ReplaceAll(name, "`", "``") + "`"
+}
+
+// Quote a string literal for use in a MySQL statement
+func quoteString(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// Compute a fingerprint for each table in a database using the configured change
+// detection mode, defaulting to checksums. Update times are only a hint: InnoDB
+// estimates the row counts and data lengths, and before MySQL 8.0 doesn't keep
+// update times across restarts, so a changed table can look unchanged.
+func tableFingerprints(db DatabaseConfig, dbName string) (map[string]string, error) {
+	var output string
+	var err error
+
+	switch db.ChangeDetection {
+	case "update_time":
+		output, err = mysqlQuery(db, "", fmt.Sprintf(
+			"SELECT TABLE_NAME, IFNULL(UPDATE_TIME, ''), IFNULL(TABLE_ROWS, ''), IFNULL(DATA_LENGTH, ''), IFNULL(CREATE_TIME, '') "+
+				"FROM information_schema.TABLES WHERE TABLE_SCHEMA = %s ORDER BY TABLE_NAME", quoteString(dbName)))
+	case "", "checksum":
+		var tables string
+		tables, err = mysqlQuery(db, "", fmt.Sprintf(
+			"SELECT TABLE_NAME FROM information_schema.TABLES WHERE TABLE_SCHEMA = %s AND TABLE_TYPE = 'BASE TABLE' ORDER BY TABLE_NAME", quoteString(dbName)))
+		if err != nil {
+			return nil, err
+		}
+
+		quoted := []string{}
+		for _, table := range strings.Split(strings.TrimSpace(tables), "\n") {
+			if table != "" {
+				quoted = append(quoted, quoteIdentifier(dbName)+"."+quoteIdentifier(table))
+			}
+		}
+
+		if len(quoted) > 0 {
+			output, err = mysqlQuery(db, "", "CHECKSUM TABLE "+strings.Join(quoted, ", "))
+		}
+	default:
+		return nil, fmt.Errorf("unknown change detection mode %q", db.ChangeDetection)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	fingerprints := map[string]string{}
+
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		if line == "" {
+			continue
+		}
+
+		// CHECKSUM TABLE returns "db.table", information_schema returns just the table
+		table := strings.SplitN(line, "\t", 2)[0]
+		table = strings.TrimPrefix(table, dbName+".")
+
+		sum := sha256.Sum256([]byte(line))
+		fingerprints[table] = hex.EncodeToString(sum[:])
+	}
+
+	return fingerprints, nil
+}
+
+// Compute a fingerprint of a database's contents using the configured change
+// detection mode. Databases with the same fingerprint are considered unchanged.
+func databaseFingerprint(db DatabaseConfig, dbName string) (string, error) {
+	fingerprints, err := tableFingerprints(db, dbName)
+	if err != nil {
+		return "", err
+	}
+
+	tables := []string{}
+	for table := range fingerprints {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+
+	hash := sha256.New()
+	for _, table := range tables {
+		fmt.Fprintf(hash, "%s\t%s\n", table, fingerprints[table])
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Find the most recent successful backup of a database with a fingerprint, and
+// the archive that holds its actual dump
+func previousFingerprint(reports []RunReport, engine string, host string, name string) (string, BackupReference, bool) {
+	for _, report := range reports {
+		if !report.Uploaded {
+			continue
+		}
+
+		for _, db := range report.Databases {
+			if db.Engine != engine || db.Host != host || db.Name != name || !db.Success {
+				continue
+			}
+
+			if db.Fingerprint == "" {
+				return "", BackupReference{}, false
+			}
+
+			ref := BackupReference{
+				Engine:     engine,
+				Host:       host,
+				Name:       name,
+				ArchiveKey: report.archiveFor(db),
+				File:       db.File,
+			}
+
+			if db.Reference != nil {
+				ref.ArchiveKey = db.Reference.ArchiveKey
+				ref.File = db.Reference.File
+			}
+
+			return db.Fingerprint, ref, true
+		}
+	}
+
+	return "", BackupReference{}, false
+}
+
+// Write a reference file pointing at the prior backup of an unchanged database
+func writeReference(path string, ref BackupReference) error {
+	data, err := json.MarshalIndent(ref, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0644)
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// Answer mysql queries with the table list and checksums given, recording the
+// CHECKSUM TABLE statements
+func fakeChecksums(tables string, checksums *string, statements *[]string) func(args []string) (string, error) {
+	return func(args []string) (string, error) {
+		query := ""
+		for _, arg := range args {
+			if strings.HasPrefix(arg, "--execute=") {
+				query = strings.TrimPrefix(arg, "--execute=")
+			}
+		}
+
+		if strings.HasPrefix(query, "CHECKSUM TABLE") {
+			*statements = append(*statements, query)
+			return *checksums, nil
+		}
+		return tables, nil
+	}
+}
+
+func TestFingerprintsDefaultToChecksums(t *testing.T) {
+	checksums := "shop.orders\t1111\nshop.order items\t2222\n"
+	statements := []string{}
+
+	fake := newFakeCommands()
+	fake.answer = fakeChecksums("orders\norder items\n", &checksums, &statements)
+	runner = fake
+	defer func() { runner = systemCommands{} }()
+
+	db := DatabaseConfig{Engine: "mysql", Host: "db1"}
+
+	before, err := databaseFingerprint(db, "shop")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "CHECKSUM TABLE `shop`.`orders`, `shop`.`order items`"
+	if len(statements) != 1 || statements[0] != want {
+		t.Fatalf("ran %q, want %q", statements, want)
+	}
+
+	// A write that leaves the information_schema estimates alone still shows
+	checksums = "shop.orders\t1112\nshop.order items\t2222\n"
+	after, err := databaseFingerprint(db, "shop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after == before {
+		t.Error("changed table gave the same fingerprint")
+	}
+
+	fingerprints, err := tableFingerprints(db, "shop")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fingerprints["order items"]; !ok || len(fingerprints) != 2 {
+		t.Errorf("fingerprinted tables %v", fingerprints)
+	}
+}
+
+func TestFingerprintsByUpdateTimeOnlyWhenAskedFor(t *testing.T) {
+	queries := []string{}
+
+	fake := newFakeCommands()
+	fake.answer = func(args []string) (string, error) {
+		queries = append(queries, args[len(args)-1])
+		return "orders\t2026-01-01 00:00:00\t10\t16384\t2025-01-01 00:00:00\n", nil
+	}
+	runner = fake
+	defer func() { runner = systemCommands{} }()
+
+	_, err := tableFingerprints(DatabaseConfig{Engine: "mysql", ChangeDetection: "update_time"}, "shop")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(queries) != 1 || !strings.Contains(queries[0], "UPDATE_TIME") {
+		t.Errorf("ran %q, want one information_schema query", queries)
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Normalise a character set name, as newer servers report utf8 as utf8mb3
+func normaliseCharset(charset string) string {
+	charset = strings.ToLower(strings.TrimSpace(charset))
+	if charset == "utf8mb3" {
+		return "utf8"
+	}
+
+	return charset
+}
+
+// Warn when a database's default character set differs from the one it's
+// dumped with. Dumping utf8mb4 data as utf8 mangles anything outside the
+// basic multilingual plane, like emoji, with no error until it's restored.
+func checkCharset(db DatabaseConfig, dbName string) {
+	query := "SELECT @@character_set_server"
+	if dbName != "*" {
+		query = fmt.Sprintf("SELECT DEFAULT_CHARACTER_SET_NAME FROM information_schema.SCHEMATA WHERE SCHEMA_NAME = %s", quoteString(dbName))
+	}
+
+	output, err := mysqlQuery(db, "", query)
+	if err != nil {
+		log.Printf("Error checking character set of %s on %s: %s\n", dbName, db.Host, err.Error())
+		return
+	}
+
+	server := normaliseCharset(output)
+	if server != "" && server != normaliseCharset(db.DefaultCharacterSet) {
+		log.Printf("Warning: %s on %s uses %s but is dumped as %s, restore with --default-character-set=%s to avoid mangling\n", dbName, db.Host, server, db.DefaultCharacterSet, db.DefaultCharacterSet)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Get how old a leftover file must be to be swept, or 0 when sweeping is disabled
+func (config Config) staleFileAge() time.Duration {
+	if config.StaleFileAge == "" {
+		return 0
+	}
+
+	age, err := parseDuration(config.StaleFileAge)
+	if err != nil {
+		return 0
+	}
+
+	return age
+}
+
+// Check whether a file in the temp directory is one this tool creates, as the
+// temp directory may be shared with other programs
+func isStagingFile(name string) bool {
+	name = strings.TrimSuffix(name, encryptedExtension)
+	return strings.HasPrefix(name, "restore_") || strings.HasSuffix(name, ".tar.gz") || strings.HasSuffix(name, ".zip")
+}
+
+// Delete dumps and archives left behind by crashed or killed runs, once they're
+// older than stale_file_age
+func sweepStaleFiles(config Config, trigger string) {
+	age := config.staleFileAge()
+	if age == 0 {
+		return
+	}
+	cutoff := time.Now().Add(-age)
+
+	sweep := func(dir string, match func(string) bool) {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("Error reading %s: %s\n", dir, err.Error())
+			}
+			return
+		}
+
+		for _, entry := range entries {
+			if !match(entry.Name()) {
+				continue
+			}
+
+			info, err := entry.Info()
+			if err != nil || !info.ModTime().Before(cutoff) {
+				continue
+			}
+
+			path := filepath.Join(dir, entry.Name())
+			log.Printf("Deleting stale file %s from %s\n", path, info.ModTime().Format(time.RFC3339))
+
+			err = os.RemoveAll(path)
+			if err != nil {
+				log.Printf("Error deleting file %s: %s\n", path, err.Error())
+			}
+			auditLog(config, "delete_local", path, trigger, err)
+		}
+	}
+
+	sweep(config.DumpDir, func(string) bool { return true })
+	sweep(config.TempDir, isStagingFile)
+}
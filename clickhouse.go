@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/xml"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Run a query with clickhouse-client and return its raw tab separated output
+func clickhouseQuery(ctx context.Context, db DatabaseConfig, query string) (string, error) {
+	var password bytes.Buffer
+	password.WriteString("<config><password>")
+	xml.EscapeText(&password, []byte(db.Password.reveal()))
+	password.WriteString("</password></config>\n")
+
+	configFile, err := writeCredentialsFile("", "clickhouse_*.xml", password.Bytes())
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(configFile)
+
+	args := []string{
+		"--config-file=" + configFile,
+		fmt.Sprintf("--host=%s", db.connectHost()),
+		fmt.Sprintf("--port=%d", db.Port),
+		fmt.Sprintf("--user=%s", db.Username),
+		"--query=" + query,
+	}
+
+	output, err := commandOutput(dumpCommand(ctx, "clickhouse-client", args...))
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			return "", fmt.Errorf("%w: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", err
+	}
+
+	return string(output), nil
+}
+
+// Split tab separated query output into rows of fields
+func splitRows(output string) [][]string {
+	rows := [][]string{}
+
+	for _, line := range strings.Split(strings.TrimRight(output, "\n"), "\n") {
+		if line != "" {
+			rows = append(rows, strings.Split(line, "\t"))
+		}
+	}
+
+	return rows
+}
+
+// Dump a ClickHouse database into a directory containing schema.sql and a
+// Native format data file per table. A name of "*" dumps every user database
+// into its own subdirectory.
+func clickhouseDump(ctx context.Context, db DatabaseConfig, dbName string, dir string) error {
+	if dbName == "*" {
+		output, err := clickhouseQuery(ctx, db, "SELECT name FROM system.databases WHERE name NOT IN ('system', 'INFORMATION_SCHEMA', 'information_schema') ORDER BY name FORMAT TSVRaw")
+		if err != nil {
+			return err
+		}
+
+		for _, row := range splitRows(output) {
+			err = clickhouseDump(ctx, db, row[0], filepath.Join(dir, row[0]))
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	output, err := clickhouseQuery(ctx, db, fmt.Sprintf("SELECT name, engine FROM system.tables WHERE database = %s ORDER BY name FORMAT TSVRaw", quoteString(dbName)))
+	if err != nil {
+		return err
+	}
+
+	schema, err := os.Create(filepath.Join(dir, "schema.sql"))
+	if err != nil {
+		return err
+	}
+	defer schema.Close()
+
+	fmt.Fprintf(schema, "CREATE DATABASE IF NOT EXISTS %s;\n\n", quoteIdentifier(dbName))
+
+	for _, row := range splitRows(output) {
+		table, engine := row[0], row[1]
+		qualified := quoteIdentifier(dbName) + "." + quoteIdentifier(table)
+
+		create, err := clickhouseQuery(ctx, db, fmt.Sprintf("SHOW CREATE TABLE %s FORMAT TSVRaw", qualified))
+		if err != nil {
+			return err
+		}
+
+		_, err = fmt.Fprintf(schema, "%s;\n\n", strings.TrimSpace(create))
+		if err != nil {
+			return err
+		}
+
+		// Views and dictionaries have no data of their own
+		if strings.Contains(engine, "View") || engine == "Dictionary" {
+			continue
+		}
+
+		dataFile, err := filepath.Abs(filepath.Join(dir, table+".native"))
+		if err != nil {
+			return err
+		}
+
+		_, err = clickhouseQuery(ctx, db, fmt.Sprintf("SELECT * FROM %s INTO OUTFILE %s FORMAT Native", qualified, quoteString(dataFile)))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,25 @@
+package main
+
+import "time"
+
+// Tells the time and waits, so scheduling, retention and retries can be
+// driven by a fake clock
+type clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// Clock behind every decision that depends on the time, replaced in tests.
+// Timing measurements like durations and rates use the time package directly.
+var clk clock = systemClock{}
+
+// The real time
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// A clock that only moves when it's advanced, for tests
+type fakeClock struct {
+	mutex   sync.Mutex
+	now     time.Time
+	waiters []fakeWaiter
+}
+
+// A channel waiting for a fake clock to reach a time
+type fakeWaiter struct {
+	at time.Time
+	ch chan time.Time
+}
+
+// Create a fake clock stopped at now
+func newFakeClock(now time.Time) *fakeClock {
+	return &fakeClock{now: now}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	ch := make(chan time.Time, 1)
+	if d <= 0 {
+		ch <- c.now
+		return ch
+	}
+
+	c.waiters = append(c.waiters, fakeWaiter{at: c.now.Add(d), ch: ch})
+	return ch
+}
+
+// Move the clock forward, firing every After it reaches
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.now = c.now.Add(d)
+
+	waiting := []fakeWaiter{}
+	for _, waiter := range c.waiters {
+		if waiter.at.After(c.now) {
+			waiting = append(waiting, waiter)
+			continue
+		}
+		waiter.ch <- c.now
+	}
+	c.waiters = waiting
+}
+
+func TestFakeClock(t *testing.T) {
+	start := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	fake := newFakeClock(start)
+
+	now := fake.After(0)
+	soon := fake.After(time.Minute)
+	later := fake.After(time.Hour)
+
+	if at := <-now; !at.Equal(start) {
+		t.Errorf("After(0) fired at %s", at)
+	}
+
+	fake.Advance(2 * time.Minute)
+	if !fake.Now().Equal(start.Add(2 * time.Minute)) {
+		t.Errorf("advanced to %s", fake.Now())
+	}
+
+	select {
+	case at := <-soon:
+		if !at.Equal(start.Add(2 * time.Minute)) {
+			t.Errorf("After(1m) fired at %s", at)
+		}
+	default:
+		t.Error("After(1m) didn't fire")
+	}
+
+	select {
+	case <-later:
+		t.Error("After(1h) fired early")
+	default:
+	}
+
+	fake.Advance(time.Hour)
+	select {
+	case <-later:
+	default:
+		t.Error("After(1h) didn't fire")
+	}
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Hold the settings for the cloudsql_export engine, which has Cloud SQL
+// export a database to Cloud Storage through the Admin API instead of dumping
+// it over the network. Each name is a database on the instance, or "*" for all.
+type CloudSQLConfig struct {
+	Project  string `yaml:"project"`
+	Instance string `yaml:"instance"`
+
+	// Where exports are written, e.g. "gs://bucket/exports". The instance's
+	// service account needs write access to it.
+	Bucket string `yaml:"bucket"`
+
+	// Command printing an OAuth access token, e.g. "gcloud auth
+	// print-access-token". Defaults to the GCE/GKE metadata server.
+	TokenCommand string `yaml:"token_command"`
+
+	// How long to wait for an export to finish, defaults to "2h"
+	Timeout string `yaml:"timeout"`
+}
+
+const (
+	cloudSQLAPI      = "https://sqladmin.googleapis.com/v1"
+	gceTokenEndpoint = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+)
+
+// Record of an export, written in place of a dump so the archive and report
+// say where the backup is
+type CloudSQLExportRecord struct {
+	Project   string    `json:"project"`
+	Instance  string    `json:"instance"`
+	Database  string    `json:"database"`
+	URI       string    `json:"uri"`
+	Operation string    `json:"operation"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// A Cloud SQL Admin API operation, as far as it's needed to wait for one
+type cloudSQLOperation struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Error  *struct {
+		Errors []struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"errors"`
+	} `json:"error"`
+}
+
+// Start an export of a database to Cloud Storage, wait for it to finish and
+// write its record to file. The export is named like a dump would be.
+func cloudSQLExport(ctx context.Context, db DatabaseConfig, dbName string, exportName string, file string) error {
+	timeout := 2 * time.Hour
+	if db.CloudSQL.Timeout != "" {
+		var err error
+		timeout, err = parseDuration(db.CloudSQL.Timeout)
+		if err != nil {
+			return err
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	record := CloudSQLExportRecord{
+		Project:  db.CloudSQL.Project,
+		Instance: db.CloudSQL.Instance,
+		Database: dbName,
+		URI:      strings.TrimSuffix(db.CloudSQL.Bucket, "/") + "/" + exportName + ".sql.gz",
+	}
+
+	exportContext := map[string]interface{}{
+		"fileType": "SQL",
+		"uri":      record.URI,
+	}
+	if dbName != "*" {
+		exportContext["databases"] = []string{dbName}
+	}
+
+	log.Printf("Exporting %s on Cloud SQL instance %s to %s\n", dbName, db.CloudSQL.Instance, record.URI)
+
+	operation := cloudSQLOperation{}
+	path := fmt.Sprintf("/projects/%s/instances/%s/export", url.PathEscape(db.CloudSQL.Project), url.PathEscape(db.CloudSQL.Instance))
+	err := cloudSQLRequest(ctx, db, http.MethodPost, path, map[string]interface{}{"exportContext": exportContext}, &operation)
+	if err != nil {
+		return fmt.Errorf("error starting export: %w", err)
+	}
+	record.Operation = operation.Name
+
+	// Only one operation runs on an instance at a time, so exports take turns
+	for operation.Status != "DONE" {
+		select {
+		case <-time.After(15 * time.Second):
+		case <-ctx.Done():
+			return fmt.Errorf("error waiting for export %s: %w", operation.Name, ctx.Err())
+		}
+
+		path = fmt.Sprintf("/projects/%s/operations/%s", url.PathEscape(db.CloudSQL.Project), url.PathEscape(record.Operation))
+		err = cloudSQLRequest(ctx, db, http.MethodGet, path, nil, &operation)
+		if err != nil {
+			return fmt.Errorf("error checking export %s: %w", record.Operation, err)
+		}
+	}
+
+	if operation.Error != nil && len(operation.Error.Errors) > 0 {
+		messages := []string{}
+		for _, e := range operation.Error.Errors {
+			messages = append(messages, fmt.Sprintf("%s: %s", e.Code, e.Message))
+		}
+		return fmt.Errorf("export %s failed: %s", record.Operation, strings.Join(messages, "; "))
+	}
+	record.CreatedAt = time.Now()
+
+	log.Printf("Cloud SQL export of %s finished\n", dbName)
+
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(file, data, 0644)
+}
+
+// Make a request to the Cloud SQL Admin API, decoding the JSON response
+func cloudSQLRequest(ctx context.Context, db DatabaseConfig, method string, path string, body interface{}, result interface{}) error {
+	token, err := googleAccessToken(ctx, db.CloudSQL.TokenCommand)
+	if err != nil {
+		return fmt.Errorf("error getting access token: %w", err)
+	}
+
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, cloudSQLAPI+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(data)))
+	}
+
+	return json.Unmarshal(data, result)
+}
+
+// Tokens last an hour, so they're reused for less than that
+const googleTokenLifetime = 30 * time.Minute
+
+var (
+	googleTokens      = map[string]cachedToken{}
+	googleTokensMutex sync.Mutex
+)
+
+// Get a Google OAuth access token from a command, or the metadata server of
+// the GCE instance or GKE pod this runs on. The token replaces the previous
+// one in the secrets redacted from the logs.
+func googleAccessToken(ctx context.Context, command string) (string, error) {
+	googleTokensMutex.Lock()
+	defer googleTokensMutex.Unlock()
+
+	cached, ok := googleTokens[command]
+	if ok && clk.Now().Before(cached.expires) {
+		return cached.value, nil
+	}
+
+	var token string
+	var err error
+	if command != "" {
+		var output []byte
+		output, err = commandOutput(exec.CommandContext(ctx, "sh", "-c", command))
+		token = strings.TrimSpace(string(output))
+	} else {
+		token, err = metadataAccessToken(ctx)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	replaceSecret(cached.value, token)
+	googleTokens[command] = cachedToken{value: token, expires: clk.Now().Add(googleTokenLifetime)}
+
+	return token, nil
+}
+
+// Request an access token for the default service account from the metadata server
+func metadataAccessToken(ctx context.Context) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, gceTokenEndpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s from metadata server", resp.Status)
+	}
+
+	token := struct {
+		AccessToken string `json:"access_token"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&token)
+	if err != nil {
+		return "", err
+	}
+
+	return token.AccessToken, nil
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Databases never expected in a dump of every database
+var systemSchemas = []string{"mysql", "information_schema", "performance_schema", "sys"}
+
+// Object types that can appear in a MySQL dump, by the keyword creating them
+var dumpObjectKinds = map[string]string{
+	"TABLE":     "table",
+	"VIEW":      "view",
+	"PROCEDURE": "procedure",
+	"FUNCTION":  "function",
+	"TRIGGER":   "trigger",
+	"EVENT":     "event",
+}
+
+// Matches the version comments mysqldump wraps statements in, e.g. "/*!50003 "
+var versionComment = regexp.MustCompile(`/\*!\d*\s?|\*/`)
+
+// List the tables, views, routines, triggers and events information_schema
+// has for a database, or every non-system database for "*", as
+// "kind<TAB>schema<TAB>name"
+func schemaObjects(db DatabaseConfig, dbName string) (map[string]bool, error) {
+	where := func(column string) string {
+		if dbName != "*" {
+			return fmt.Sprintf("%s = %s", column, quoteString(dbName))
+		}
+
+		excluded := []string{}
+		for _, name := range append(append([]string{}, systemSchemas...), db.ExcludeDatabases...) {
+			excluded = append(excluded, quoteString(name))
+		}
+		return fmt.Sprintf("%s NOT IN (%s)", column, strings.Join(excluded, ", "))
+	}
+
+	query := strings.Join([]string{
+		"SELECT 'table', TABLE_SCHEMA, TABLE_NAME FROM information_schema.TABLES WHERE TABLE_TYPE IN ('BASE TABLE', 'SYSTEM VERSIONED') AND " + where("TABLE_SCHEMA"),
+		"SELECT 'view', TABLE_SCHEMA, TABLE_NAME FROM information_schema.TABLES WHERE TABLE_TYPE = 'VIEW' AND " + where("TABLE_SCHEMA"),
+		"SELECT LOWER(ROUTINE_TYPE), ROUTINE_SCHEMA, ROUTINE_NAME FROM information_schema.ROUTINES WHERE " + where("ROUTINE_SCHEMA"),
+		"SELECT 'trigger', TRIGGER_SCHEMA, TRIGGER_NAME FROM information_schema.TRIGGERS WHERE " + where("TRIGGER_SCHEMA"),
+		"SELECT 'event', EVENT_SCHEMA, EVENT_NAME FROM information_schema.EVENTS WHERE " + where("EVENT_SCHEMA"),
+	}, " UNION ALL ")
+
+	output, err := mysqlQuery(db, "", query)
+	if err != nil {
+		return nil, err
+	}
+
+	objects := map[string]bool{}
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		if strings.Count(line, "\t") == 2 {
+			objects[line] = true
+		}
+	}
+
+	return objects, nil
+}
+
+// List the objects a dump creates, in the same form as schemaObjects. Objects
+// without a database in their name belong to the last USE, or dbName.
+func dumpObjects(dumpFile string, dbName string) (map[string]bool, error) {
+	files := []string{dumpFile}
+	if info, err := os.Stat(dumpFile); err == nil && info.IsDir() {
+		var err error
+		files, err = parallelDumpFiles(dumpFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	objects := map[string]bool{}
+	for _, file := range files {
+		err := scanDumpObjects(file, dbName, objects)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return objects, nil
+}
+
+// Add the objects created in one dump file
+func scanDumpObjects(dumpFile string, dbName string, objects map[string]bool) error {
+	file, err := os.Open(dumpFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var dump io.Reader = file
+	if strings.HasSuffix(dumpFile, ".gz") {
+		gr, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		dump = gr
+	}
+
+	reader := bufio.NewReaderSize(dump, 64*1024)
+	current := dbName
+	lineStart := true
+
+	for {
+		// Object names are at the start of their statement, and extended
+		// inserts can be far longer than the buffer
+		line, err := reader.ReadSlice('\n')
+		if lineStart && len(line) > 0 {
+			text := strings.TrimSpace(versionComment.ReplaceAllString(string(line), ""))
+
+			if strings.HasPrefix(text, "USE ") {
+				if name, _ := parseIdentifier(strings.TrimPrefix(text, "USE ")); name != "" {
+					current = name
+				}
+			} else if kind, schema, name, ok := createdObject(text); ok {
+				if schema == "" {
+					schema = current
+				}
+				objects[kind+"\t"+schema+"\t"+name] = true
+			}
+		}
+
+		lineStart = err != bufio.ErrBufferFull
+
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return err
+		}
+	}
+}
+
+// Get the kind, database and name of the object a CREATE statement creates,
+// skipping clauses such as DEFINER and ALGORITHM before the object keyword
+func createdObject(text string) (string, string, string, bool) {
+	if !strings.HasPrefix(text, "CREATE ") {
+		return "", "", "", false
+	}
+
+	rest := text[len("CREATE "):]
+	for rest != "" {
+		word := rest
+		if i := strings.IndexAny(rest, " \t"); i >= 0 {
+			word, rest = rest[:i], strings.TrimLeft(rest[i:], " \t")
+		} else {
+			rest = ""
+		}
+
+		kind, ok := dumpObjectKinds[strings.ToUpper(word)]
+		if !ok {
+			continue
+		}
+
+		rest = strings.TrimPrefix(rest, "IF NOT EXISTS ")
+		schema, rest := parseIdentifier(rest)
+		if strings.HasPrefix(rest, ".") {
+			name, _ := parseIdentifier(rest[1:])
+			return kind, schema, name, name != ""
+		}
+		return kind, "", schema, schema != ""
+	}
+
+	return "", "", "", false
+}
+
+// Read a backquoted or bare identifier from the start of some text
+func parseIdentifier(text string) (string, string) {
+	if !strings.HasPrefix(text, "`") {
+		end := strings.IndexAny(text, " \t.(;")
+		if end < 0 {
+			end = len(text)
+		}
+		return text[:end], text[end:]
+	}
+
+	name := strings.Builder{}
+	for i := 1; i < len(text); i++ {
+		if text[i] != '`' {
+			name.WriteByte(text[i])
+			continue
+		}
+		if i+1 < len(text) && text[i+1] == '`' {
+			name.WriteByte('`')
+			i++
+			continue
+		}
+		return name.String(), text[i+1:]
+	}
+
+	return "", ""
+}
+
+// Compare a dump against information_schema and list the objects missing from
+// it, e.g. routines left out because they weren't asked for
+func missingObjects(db DatabaseConfig, dbName string, dumpFile string) ([]string, error) {
+	expected, err := schemaObjects(db, dbName)
+	if err != nil {
+		return nil, fmt.Errorf("error listing objects: %w", err)
+	}
+
+	dumped, err := dumpObjects(dumpFile, dbName)
+	if err != nil {
+		return nil, fmt.Errorf("error reading %s: %w", filepath.Base(dumpFile), err)
+	}
+
+	missing := []string{}
+	for object := range expected {
+		if !dumped[object] {
+			fields := strings.Split(object, "\t")
+			missing = append(missing, fmt.Sprintf("%s %s.%s", fields[0], fields[1], fields[2]))
+		}
+	}
+	sort.Strings(missing)
+
+	return missing, nil
+}
+
+// Summarise missing objects by kind, e.g. "3 procedures, 1 event"
+func summariseMissing(missing []string) string {
+	counts := map[string]int{}
+	kinds := []string{}
+	for _, object := range missing {
+		kind, _, _ := strings.Cut(object, " ")
+		if counts[kind] == 0 {
+			kinds = append(kinds, kind)
+		}
+		counts[kind]++
+	}
+
+	parts := []string{}
+	for _, kind := range kinds {
+		if counts[kind] == 1 {
+			parts = append(parts, "1 "+kind)
+		} else {
+			parts = append(parts, fmt.Sprintf("%d %ss", counts[kind], kind))
+		}
+	}
+
+	return strings.Join(parts, ", ")
+}
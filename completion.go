@@ -0,0 +1,481 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Describe a flag for completion and documentation
+type commandFlag struct {
+	Name        string
+	Description string
+}
+
+// Describe a subcommand for completion and documentation
+type command struct {
+	Name        string
+	Usage       string
+	Description string
+	Flags       []commandFlag
+}
+
+// Every subcommand, in the order they're documented
+var commands = []command{
+	{
+		Name:        "init",
+		Usage:       "init [flags]",
+		Description: "Generate a configuration file, prompting for anything not given as a flag, and test it.",
+		Flags: []commandFlag{
+			{"cron", "backup schedule"},
+			{"engine", "database engine"},
+			{"host", "database host"},
+			{"port", "database port (defaults to the engine's port)"},
+			{"username", "database username"},
+			{"password", "database password"},
+			{"databases", "comma separated database names, or * for all"},
+			{"access-key", "S3 access key"},
+			{"access-secret", "S3 access secret"},
+			{"region", "S3 region"},
+			{"bucket", "S3 bucket"},
+			{"output", "file to write"},
+			{"non-interactive", "don't prompt for missing values"},
+			{"skip-tests", "don't test the database and S3 credentials"},
+			{"force", "overwrite an existing file"},
+		},
+	},
+	{
+		Name:        "backup",
+		Usage:       "backup [flags]",
+		Description: "Run a single backup now, optionally of only some databases, e.g. to re-run one that failed.",
+		Flags: []commandFlag{
+			{"only", "comma separated database names to back up"},
+			{"host", "comma separated hosts to back up"},
+			{"label", "only back up databases with this label, e.g. team=payments"},
+			{"stdout", "write the archive to stdout instead of uploading it, e.g. to pipe through gpg"},
+			{"profile", "write CPU, heap and blocking profiles of the run to this directory"},
+			{"simulate-failure", "make the run fail at dump, upload or notify, to test alerting"},
+		},
+	},
+	{
+		Name:        "--once",
+		Usage:       "--once [flags]",
+		Description: "Run a single backup with a hard deadline, logging to stdout, for schedulers like Kubernetes CronJobs or ECS scheduled tasks.",
+		Flags: []commandFlag{
+			{"timeout", "abort the run after this long, defaults to max_run_duration or 24h"},
+			{"grace", "how long an aborted run may clean up before exiting"},
+			{"profile", "write CPU, heap and blocking profiles of the run to this directory"},
+			{"simulate-failure", "make the run fail at dump, upload or notify, to test alerting"},
+		},
+	},
+	{
+		Name:        "serve",
+		Usage:       "serve",
+		Description: "Run the HTTP and gRPC APIs without the backup schedule.",
+	},
+	{
+		Name:        "history",
+		Usage:       "history export [flags]",
+		Description: "Export the run history as CSV or JSON.",
+		Flags: []commandFlag{
+			{"format", "output format, csv or json"},
+			{"since", "only include runs newer than this, e.g. 30d"},
+			{"label", "only include databases with this label, e.g. team=payments"},
+			{"output", "file to write to instead of stdout"},
+		},
+	},
+	{
+		Name:        "search",
+		Usage:       "search [flags]",
+		Description: "Find backups in the run history to restore from, newest first, with their archive keys, sizes and checksums.",
+		Flags: []commandFlag{
+			{"db", "only backups of this database, or databases matching a glob such as \"orders_*\""},
+			{"host", "only backups of databases on this host"},
+			{"engine", "only backups of this engine, e.g. mysql"},
+			{"before", "only backups started before this date or RFC 3339 time, e.g. 2024-06-01"},
+			{"after", "only backups started at or after this date or RFC 3339 time"},
+			{"label", "only backups of databases with this label, e.g. team=payments"},
+			{"failed", "include failed dumps"},
+			{"remote", "also search the reports mirrored to each storage target's catalog"},
+			{"limit", "show at most this many backups, newest first"},
+			{"json", "output JSON instead of a table"},
+		},
+	},
+	{
+		Name:        "decrypt",
+		Usage:       "decrypt <archive.enc> [output]",
+		Description: "Decrypt an archive encrypted with encryption.passphrase, e.g. to use the restore script inside. Prompts for the passphrase when none is configured.",
+	},
+	{
+		Name:        "restore",
+		Usage:       "restore [flags] <archive-key> <database> [host]",
+		Description: "Restore a database from a backup, following references and differentials. Refuses to restore into a database that isn't empty, onto an older or different server, or without enough temp space.",
+		Flags: []commandFlag{
+			{"plan", "list what would be applied and where, without changing anything"},
+			{"json", "output the --plan as JSON"},
+			{"force", "restore into a database that isn't empty or a server of a different version"},
+			{"max-download-rate", "limit downloads to this many bytes a second, e.g. 10M, overriding max_download_rate"},
+			{"snapshot", "dump the database to pre-restore/ on the first storage target before restoring over it"},
+			{"canary", "mark this as a scheduled verification restore in its record and metrics, and write a signed rehearsal report"},
+			{"tables", "comma-separated tables to restore from a split or parallel dump, leaving the rest of the database alone (needs --force if it has other tables)"},
+			{"insecure", "restore even when the archive or dump has no recorded checksum or doesn't match it"},
+			{"parallel", "apply this many tables of a parallel dump at once, defaults to parallel_tables"},
+			{"max-statements-per-second", "apply at most this many statements a second, to spare replication and IO on a live server"},
+			{"sleep-per-chunk", "pause for this long after each statement, i.e. each insert chunk, e.g. 10ms"},
+		},
+	},
+	{
+		Name:        "audit",
+		Usage:       "audit [flags]",
+		Description: "Check every storage target against the run reports, flagging missing, extra, resized or (with --checksums) altered archives and badly signed reports, and write an audit report.",
+		Flags: []commandFlag{
+			{"checksums", "download every archive and compare its SHA-256 with the report"},
+			{"output", "file to write the JSON audit report to, defaults to reports_dir"},
+		},
+	},
+	{
+		Name:        "prune",
+		Usage:       "prune [flags]",
+		Description: "Delete the backups that have outlived their storage target's retention now, instead of after the next backup.",
+		Flags: []commandFlag{
+			{"target", "only prune this storage target"},
+			{"dry-run", "list what would be deleted without deleting anything"},
+		},
+	},
+	{
+		Name:        "gc",
+		Usage:       "gc [flags]",
+		Description: "Delete objects on the storage targets and in the dedup repository that no retained run report refers to, such as leftovers of failed runs, and abort stale multipart uploads. Run it while no backup is running.",
+		Flags: []commandFlag{
+			{"dry-run", "list what would be deleted without deleting anything"},
+			{"min-age", "keep objects younger than this, which a running backup may not have reported yet"},
+			{"prefix", "scan this prefix on each target instead of its configured one, e.g. one backups used to be stored under"},
+		},
+	},
+	{
+		Name:        "pause",
+		Usage:       "pause --for <duration> --reason <reason>",
+		Description: "Skip scheduled backups and stale backup alerts for a while, e.g. during planned database maintenance. The reason is kept in the audit log and the skipped run reports.",
+		Flags: []commandFlag{
+			{"for", "how long to pause scheduled backups, e.g. \"4h\""},
+			{"reason", "why backups are paused, recorded in the audit log and skipped run reports"},
+		},
+	},
+	{
+		Name:        "resume",
+		Usage:       "resume",
+		Description: "End a pause of scheduled backups early.",
+	},
+	{
+		Name:        "seed",
+		Usage:       "seed [flags] --replication-user <user> <source-host> <replica-host>",
+		Description: "Provision a replica: dump a configured MySQL or MariaDB source with its binlog coordinates, stream the dump straight into the replica and print (or with --apply, run) the statement starting replication. Passwords are read from DBBACKUP_REPLICA_PASSWORD and DBBACKUP_REPLICATION_PASSWORD.",
+		Flags: []commandFlag{
+			{"replica-port", "port of the replica"},
+			{"replica-user", "user to load the dump into the replica as, defaults to the source's username"},
+			{"replication-user", "user the replica replicates from the source as"},
+			{"source-address", "host[:port] the replica reaches the source at, defaults to the source's host and port"},
+			{"apply", "run the CHANGE REPLICATION SOURCE statement and start replication instead of only printing it"},
+			{"force", "seed a replica that already has databases"},
+		},
+	},
+	{
+		Name:        "rekey",
+		Usage:       "rekey [flags]",
+		Description: "Re-encrypt stored backups whose encryption doesn't match the configured server_side_encryption and kms_key_id, or the database's own, e.g. after rotating a KMS key, and archives encrypted under an old encryption.key_id with the current passphrase.",
+		Flags: []commandFlag{
+			{"dry-run", "only list the objects that would be re-encrypted"},
+		},
+	},
+	{
+		Name:        "monitor",
+		Usage:       "monitor",
+		Description: "Watch the reports uploaded to the storage targets by every agent and alert when a database's latest backup is older than its max_backup_age. Needs report.upload on the agents.",
+	},
+	{
+		Name:        "schedule",
+		Usage:       "schedule [flags]",
+		Description: "List each scheduled job with its cron expression, time zone and next run times, noting runs a blackout will skip or defer.",
+		Flags: []commandFlag{
+			{"count", "how many upcoming runs to list for each job"},
+			{"json", "output JSON instead of a list"},
+		},
+	},
+	{
+		Name:        "tier",
+		Usage:       "tier [flags]",
+		Description: "Move archives older than tiering.after to cold storage now, instead of waiting for the schedule.",
+		Flags: []commandFlag{
+			{"dry-run", "only list the archives that would be moved"},
+		},
+	},
+	{
+		Name:        "usage",
+		Usage:       "usage [flags]",
+		Description: "Show the storage used by each database's backups on each target. Archives of several databases are split by dump size.",
+		Flags: []commandFlag{
+			{"json", "output JSON instead of a table"},
+		},
+	},
+	{
+		Name:        "version",
+		Usage:       "version",
+		Description: "Print the version, commit, build date and Go version.",
+	},
+	{
+		Name:        "self-update",
+		Usage:       "self-update [flags]",
+		Description: "Replace the binary with the latest release after verifying its checksum.",
+		Flags: []commandFlag{
+			{"check", "only report whether an update is available"},
+			{"force", "reinstall even if already on the latest version"},
+		},
+	},
+	{
+		Name:        "completion",
+		Usage:       "completion bash|zsh|fish",
+		Description: "Print a shell completion script.",
+	},
+	{
+		Name:        "gen-docs",
+		Usage:       "gen-docs [directory]",
+		Description: "Write man pages for the command and its subcommands.",
+	},
+}
+
+// Names of every subcommand, plus the test flag
+func commandNames() []string {
+	names := []string{"--test"}
+	for _, c := range commands {
+		names = append(names, c.Name)
+	}
+	return names
+}
+
+// Flags of a subcommand, with their leading dashes
+func (c command) flagNames() []string {
+	names := []string{}
+	for _, f := range c.Flags {
+		names = append(names, "--"+f.Name)
+	}
+	return names
+}
+
+// Write a bash completion script
+func bashCompletion(w io.Writer) {
+	fmt.Fprintln(w, "# bash completion for dbbackup")
+	fmt.Fprintln(w, "_dbbackup() {")
+	fmt.Fprintln(w, "    local cur=${COMP_WORDS[COMP_CWORD]}")
+	fmt.Fprintln(w, "    if [ \"$COMP_CWORD\" -eq 1 ]; then")
+	fmt.Fprintf(w, "        COMPREPLY=($(compgen -W %q -- \"$cur\"))\n", strings.Join(commandNames(), " "))
+	fmt.Fprintln(w, "        return")
+	fmt.Fprintln(w, "    fi")
+	fmt.Fprintln(w, "    case ${COMP_WORDS[1]} in")
+	for _, c := range commands {
+		words := c.flagNames()
+		switch c.Name {
+		case "history":
+			words = append(words, "export")
+		case "completion":
+			words = []string{"bash", "zsh", "fish"}
+		}
+		if len(words) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "        %s) COMPREPLY=($(compgen -W %q -- \"$cur\")) ;;\n", c.Name, strings.Join(words, " "))
+	}
+	fmt.Fprintln(w, "    esac")
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w, "complete -F _dbbackup dbbackup go-dbbackup")
+}
+
+// Write a zsh completion script
+func zshCompletion(w io.Writer) {
+	fmt.Fprintln(w, "#compdef dbbackup go-dbbackup")
+	fmt.Fprintln(w, "_dbbackup() {")
+	fmt.Fprintln(w, "    local -a commands")
+	fmt.Fprintln(w, "    commands=(")
+	fmt.Fprintln(w, "        '--test:run a backup once to test the configuration'")
+	for _, c := range commands {
+		fmt.Fprintf(w, "        '%s:%s'\n", c.Name, strings.ReplaceAll(c.Description, "'", "'\\''"))
+	}
+	fmt.Fprintln(w, "    )")
+	fmt.Fprintln(w, "    if (( CURRENT == 2 )); then")
+	fmt.Fprintln(w, "        _describe 'command' commands")
+	fmt.Fprintln(w, "        return")
+	fmt.Fprintln(w, "    fi")
+	fmt.Fprintln(w, "    case $words[2] in")
+	for _, c := range commands {
+		if c.Name == "completion" {
+			fmt.Fprintln(w, "        completion) _values 'shell' bash zsh fish ;;")
+			continue
+		}
+		if len(c.Flags) == 0 {
+			continue
+		}
+		args := []string{}
+		for _, f := range c.Flags {
+			args = append(args, fmt.Sprintf("'--%s[%s]'", f.Name, strings.ReplaceAll(f.Description, "'", "'\\''")))
+		}
+		fmt.Fprintf(w, "        %s) _arguments %s ;;\n", c.Name, strings.Join(args, " "))
+	}
+	fmt.Fprintln(w, "    esac")
+	fmt.Fprintln(w, "}")
+	fmt.Fprintln(w, "compdef _dbbackup dbbackup go-dbbackup")
+}
+
+// Write a fish completion script
+func fishCompletion(w io.Writer) {
+	fmt.Fprintln(w, "# fish completion for dbbackup")
+	for _, program := range []string{"dbbackup", "go-dbbackup"} {
+		fmt.Fprintf(w, "complete -c %s -f -n __fish_use_subcommand -l test -d 'Run a backup once to test the configuration'\n", program)
+		for _, c := range commands {
+			if strings.HasPrefix(c.Name, "--") {
+				fmt.Fprintf(w, "complete -c %s -f -n __fish_use_subcommand -l %s -d %q\n", program, strings.TrimPrefix(c.Name, "--"), c.Description)
+			} else {
+				fmt.Fprintf(w, "complete -c %s -f -n __fish_use_subcommand -a %s -d %q\n", program, c.Name, c.Description)
+			}
+			for _, f := range c.Flags {
+				fmt.Fprintf(w, "complete -c %s -f -n '__fish_seen_subcommand_from %s' -l %s -d %q\n", program, c.Name, f.Name, f.Description)
+			}
+		}
+		fmt.Fprintf(w, "complete -c %s -f -n '__fish_seen_subcommand_from completion' -a 'bash zsh fish'\n", program)
+	}
+}
+
+// Handle the completion subcommand. Usage: completion bash|zsh|fish
+func runCompletion(args []string) error {
+	if len(args) != 1 {
+		return fmt.Errorf("usage: dbbackup completion bash|zsh|fish")
+	}
+
+	switch args[0] {
+	case "bash":
+		bashCompletion(os.Stdout)
+	case "zsh":
+		zshCompletion(os.Stdout)
+	case "fish":
+		fishCompletion(os.Stdout)
+	default:
+		return fmt.Errorf("unknown shell %q", args[0])
+	}
+
+	return nil
+}
+
+// Escape text for roff
+func escapeRoff(text string) string {
+	text = strings.ReplaceAll(text, `\`, `\e`)
+	return strings.ReplaceAll(text, "-", `\-`)
+}
+
+// Write the man page for the command itself, or for a subcommand if c is set
+func writeManPage(w io.Writer, c *command) {
+	date := time.Now().Format("January 2006")
+
+	if c == nil {
+		fmt.Fprintf(w, ".TH DBBACKUP 1 %q %q\n", date, "dbbackup "+version)
+		fmt.Fprintln(w, ".SH NAME")
+		fmt.Fprintln(w, `dbbackup \- back up databases to S3 on a schedule`)
+		fmt.Fprintln(w, ".SH SYNOPSIS")
+		fmt.Fprintln(w, `\fBdbbackup\fR [\fB\-\-test\fR | \fB\-\-once\fR [\fIflags\fR] | \fIcommand\fR [\fIargs\fR]]`)
+		fmt.Fprintln(w, ".SH DESCRIPTION")
+		fmt.Fprintln(w, "Without a command, runs backups on the schedule in the configuration file until stopped.")
+		fmt.Fprintln(w, `With \fB\-\-test\fR, runs a single backup and exits.`)
+		fmt.Fprintln(w, "The configuration is read from $DBBACKUP_CONFIG or config.yaml, or taken whole from $DBBACKUP_CONFIG_JSON.")
+		fmt.Fprintln(w, "Single options can be set with variables like $DBBACKUP_CRON_INTERVAL or $DBBACKUP_S3_CONFIG__BUCKET.")
+		fmt.Fprintln(w, "With profiles configured, $DBBACKUP_PROFILE picks the one a command acts on.")
+		fmt.Fprintln(w, ".SH COMMANDS")
+		for _, c := range commands {
+			fmt.Fprintln(w, ".TP")
+			fmt.Fprintf(w, `\fB%s\fR`+"\n", escapeRoff(c.Usage))
+			fmt.Fprintln(w, escapeRoff(c.Description))
+		}
+		fmt.Fprintln(w, ".SH EXIT STATUS")
+		for _, status := range []struct {
+			Code        int
+			Description string
+		}{
+			{exitOK, "Success."},
+			{exitFailure, "An error not covered below."},
+			{exitConfig, "The configuration couldn't be loaded or is invalid."},
+			{exitDump, "No database could be dumped."},
+			{exitUpload, "The backup couldn't be uploaded or replicated."},
+			{exitPartial, "The backup was uploaded, but some databases failed."},
+			{exitLocked, "Another backup run was already in progress."},
+			{exitTimeout, "The run was aborted after exceeding max_run_duration or the --once timeout."},
+			{exitCancelled, "The run was interrupted by SIGINT or SIGTERM."},
+		} {
+			fmt.Fprintln(w, ".TP")
+			fmt.Fprintf(w, "\\fB%d\\fR\n", status.Code)
+			fmt.Fprintln(w, status.Description)
+		}
+		fmt.Fprintln(w, ".SH SEE ALSO")
+		names := []string{}
+		for _, c := range commands {
+			names = append(names, fmt.Sprintf(`\fBdbbackup\-%s\fR(1)`, escapeRoff(c.Name)))
+		}
+		fmt.Fprintln(w, strings.Join(names, ", "))
+		return
+	}
+
+	fmt.Fprintf(w, ".TH DBBACKUP-%s 1 %q %q\n", strings.ToUpper(c.Name), date, "dbbackup "+version)
+	fmt.Fprintln(w, ".SH NAME")
+	fmt.Fprintf(w, `dbbackup\-%s \- %s`+"\n", escapeRoff(c.Name), escapeRoff(c.Description))
+	fmt.Fprintln(w, ".SH SYNOPSIS")
+	fmt.Fprintf(w, `\fBdbbackup\fR %s`+"\n", escapeRoff(c.Usage))
+	if len(c.Flags) > 0 {
+		fmt.Fprintln(w, ".SH OPTIONS")
+		for _, f := range c.Flags {
+			fmt.Fprintln(w, ".TP")
+			fmt.Fprintf(w, `\fB\-\-%s\fR`+"\n", escapeRoff(f.Name))
+			fmt.Fprintln(w, escapeRoff(f.Description))
+		}
+	}
+	fmt.Fprintln(w, ".SH SEE ALSO")
+	fmt.Fprintln(w, `\fBdbbackup\fR(1)`)
+}
+
+// Handle the gen-docs subcommand, writing man pages into a directory
+func runGenDocs(args []string) error {
+	dir := "man"
+	if len(args) > 0 {
+		dir = args[0]
+	}
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	pages := []*command{nil}
+	for i := range commands {
+		pages = append(pages, &commands[i])
+	}
+
+	for _, c := range pages {
+		name := "dbbackup.1"
+		if c != nil {
+			name = fmt.Sprintf("dbbackup-%s.1", c.Name)
+		}
+
+		file, err := os.Create(filepath.Join(dir, name))
+		if err != nil {
+			return err
+		}
+
+		writeManPage(file, c)
+
+		err = file.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Wrote %d man pages to %s\n", len(pages), dir)
+
+	return nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Run a dump command that writes SQL to stdout, gzipping it straight into the
+// export file so the uncompressed dump never touches the disk. Masking rules
+// are applied on the way through.
+func compressedDump(cmd *exec.Cmd, exportFile string, level int, rules []MaskingRule) error {
+	out, err := os.Create(exportFile)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	gw, err := gzip.NewWriterLevel(out, level)
+	if err != nil {
+		return err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	if len(rules) > 0 {
+		err = maskStream(stdout, gw, rules)
+	} else {
+		_, err = copyBuffered(gw, stdout)
+	}
+
+	// Nothing is reading the output any more, so the dump can't finish by itself
+	if err != nil {
+		cmd.Process.Kill()
+	}
+
+	waitErr := cmd.Wait()
+	if waitErr != nil {
+		return fmt.Errorf("%w: %s", waitErr, strings.TrimSpace(stderr.String()))
+	}
+	if err != nil {
+		return err
+	}
+
+	err = gw.Close()
+	if err != nil {
+		return err
+	}
+
+	return out.Close()
+}
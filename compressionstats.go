@@ -0,0 +1,125 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"os"
+	"strings"
+)
+
+// Dumps up to this size are compressed whole to measure them, larger ones are
+// sampled in compressionSamples chunks spread across the file
+const (
+	compressionSampleLimit = 64 << 20
+	compressionSamples     = 64
+	compressionSampleSize  = 1 << 20
+)
+
+// Measure a dump's raw (uncompressed) size and compressed size, walking
+// directories. Gzipped files are decompressed to count them; plain ones are
+// compressed at the given level, or a spread of samples is for large files.
+func measureCompression(path string, level int) (int64, int64, error) {
+	var raw, compressed int64
+
+	for _, file := range expandFiles([]string{path}) {
+		var fileRaw, fileCompressed int64
+		var err error
+
+		if strings.HasSuffix(file, ".gz") {
+			fileCompressed = fileSize(file)
+			fileRaw, err = gunzippedSize(file)
+		} else {
+			fileRaw = fileSize(file)
+			fileCompressed, err = estimateCompressedSize(file, fileRaw, level)
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+
+		raw += fileRaw
+		compressed += fileCompressed
+	}
+
+	return raw, compressed, nil
+}
+
+// Count the bytes in a gzipped file once decompressed
+func gunzippedSize(path string) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	gr, err := gzip.NewReader(file)
+	if err != nil {
+		return 0, err
+	}
+	defer gr.Close()
+
+	return io.Copy(io.Discard, gr)
+}
+
+// Estimate how big a plain file would be once gzipped
+func estimateCompressedSize(path string, size int64, level int) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	counter := &countingWriter{writer: io.Discard}
+	gw, err := gzip.NewWriterLevel(counter, level)
+	if err != nil {
+		return 0, err
+	}
+
+	if size <= compressionSampleLimit {
+		_, err = io.Copy(gw, file)
+		if err == nil {
+			err = gw.Close()
+		}
+		return counter.written, err
+	}
+
+	// Samples are compressed as one stream, so the ratio isn't skewed by
+	// every sample starting with an empty dictionary
+	stride := size / compressionSamples
+	var sampled int64
+	for i := int64(0); i < compressionSamples; i++ {
+		n, err := io.Copy(gw, io.NewSectionReader(file, i*stride, compressionSampleSize))
+		if err != nil {
+			return 0, err
+		}
+		sampled += n
+	}
+	err = gw.Close()
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(float64(counter.written) / float64(sampled) * float64(size)), nil
+}
+
+// Total the raw sizes of a run's dumps, falling back to their sizes on disk
+func rawSize(report *RunReport) int64 {
+	var total int64
+	for _, db := range report.Databases {
+		if db.RawSizeBytes > 0 {
+			total += db.RawSizeBytes
+		} else {
+			total += db.SizeBytes
+		}
+	}
+
+	return total
+}
+
+// Get how many times smaller data got when compressed, 0 when unknown
+func compressionRatio(raw int64, compressed int64) float64 {
+	if raw <= 0 || compressed <= 0 {
+		return 0
+	}
+
+	return float64(raw) / float64(compressed)
+}
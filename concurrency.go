@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+)
+
+// Hold a database waiting to be dumped
+type queuedDump struct {
+	db     DatabaseConfig
+	dbName string
+}
+
+// Dump every queued database, running up to concurrency dumps at once but no
+// more than max_concurrent_per_host against any one host. Dumps start in queue
+// order, skipping over hosts that are already busy, and their reports and
+// files are returned in queue order. Nothing new starts once ctx is cancelled.
+//
+// Databases archived on their own are uploaded one at a time in the
+// background, so the next database is dumped and compressed while the last
+// one uploads. A dump holds its slot while waiting for the uploader if an
+// archive is already queued, so archives don't pile up on disk.
+func runDumps(ctx context.Context, config Config, queue []queuedDump, previousReports []RunReport, trigger string) ([]DatabaseReport, []string) {
+	concurrency := config.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	perHost := config.MaxConcurrentPerHost
+	if perHost < 1 || perHost > concurrency {
+		perHost = concurrency
+	}
+
+	results := make([]DatabaseReport, len(queue))
+	resultFiles := make([]string, len(queue))
+	done := make([]bool, len(queue))
+
+	pending := []int{}
+	for i := range queue {
+		pending = append(pending, i)
+	}
+
+	running := map[string]int{}
+	active := 0
+	finished := make(chan int)
+
+	uploads := make(chan int, 1)
+	var uploading sync.WaitGroup
+	uploading.Add(1)
+	go func() {
+		defer uploading.Done()
+		for i := range uploads {
+			upload := results[i].upload
+			results[i].upload = nil
+
+			err := upload.run(ctx, config, &results[i])
+			if err != nil {
+				log.Printf("Error uploading %s separately: %s\n", results[i].Name, err.Error())
+				results[i].Success = false
+				results[i].Error = err.Error()
+			}
+		}
+	}()
+
+	for {
+		if ctx.Err() != nil {
+			pending = nil
+		}
+
+		for j := 0; j < len(pending) && active < concurrency; {
+			i := pending[j]
+			host := queue[i].db.Host
+
+			if running[host] >= perHost {
+				j++
+				continue
+			}
+
+			pending = append(pending[:j], pending[j+1:]...)
+			running[host]++
+			active++
+
+			go func(i int) {
+				results[i], resultFiles[i] = backupDatabase(ctx, config, queue[i].db, queue[i].dbName, previousReports, trigger)
+				if results[i].upload != nil {
+					uploads <- i
+				}
+				finished <- i
+			}(i)
+		}
+
+		if active == 0 {
+			break
+		}
+
+		i := <-finished
+		active--
+		running[queue[i].db.Host]--
+		done[i] = true
+	}
+
+	close(uploads)
+	uploading.Wait()
+
+	reports := []DatabaseReport{}
+	files := []string{}
+	for i := range queue {
+		if !done[i] {
+			continue
+		}
+
+		reports = append(reports, results[i])
+		if resultFiles[i] != "" {
+			files = append(files, resultFiles[i])
+		}
+		if resultFiles[i] != "" && results[i].TableExport != "" {
+			files = append(files, results[i].TableExport)
+		}
+	}
+
+	return reports, files
+}
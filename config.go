@@ -0,0 +1,552 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Config file names tried, in order, when none is given
+var defaultConfigFiles = []string{"config.yaml", "config.yml", "config.json", "config.toml"}
+
+// Find the configuration file to load, from DBBACKUP_CONFIG or the defaults
+func findConfigFile() string {
+	if path := os.Getenv("DBBACKUP_CONFIG"); path != "" {
+		return path
+	}
+
+	for _, path := range defaultConfigFiles {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+
+	return defaultConfigFiles[0]
+}
+
+// Convert JSON or TOML into YAML, so every format is decoded with the same
+// yaml struct tags
+func toYAML(data []byte, format string) ([]byte, error) {
+	var value interface{}
+
+	switch format {
+	case ".json":
+		err := json.Unmarshal(data, &value)
+		if err != nil {
+			return nil, err
+		}
+	case ".toml":
+		table := map[string]interface{}{}
+		err := toml.Unmarshal(data, &table)
+		if err != nil {
+			return nil, err
+		}
+		value = table
+	default:
+		return data, nil
+	}
+
+	return yaml.Marshal(value)
+}
+
+// Check whether a YAML or JSON file has been encrypted with SOPS
+func isSOPSEncrypted(data []byte) bool {
+	var document struct {
+		SOPS map[string]interface{} `yaml:"sops"`
+	}
+
+	// JSON is valid YAML, so this covers both
+	if yaml.Unmarshal(data, &document) != nil {
+		return false
+	}
+
+	_, ok := document.SOPS["mac"]
+	return ok
+}
+
+// Decrypt a SOPS-encrypted file with the sops binary, which takes care of the
+// age, KMS and PGP key lookups
+func decryptSOPS(path string, format string) ([]byte, error) {
+	inputType := "yaml"
+	if format == ".json" {
+		inputType = "json"
+	}
+
+	cmd := exec.Command("sops", "--decrypt", "--input-type", inputType, "--output-type", inputType, path)
+
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+
+	output, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("error decrypting with sops: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return output, nil
+}
+
+// Read a configuration file in YAML, JSON or TOML, detected by its extension,
+// and return it as YAML. SOPS-encrypted files are decrypted first.
+func readConfigFile(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading configuration file %s: %w", path, err)
+	}
+
+	format := strings.ToLower(filepath.Ext(path))
+
+	if format != ".toml" && isSOPSEncrypted(data) {
+		data, err = decryptSOPS(path, format)
+		if err != nil {
+			return nil, fmt.Errorf("error reading configuration file %s: %w", path, err)
+		}
+	}
+
+	data, err = toYAML(data, format)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing configuration file %s: %w", path, err)
+	}
+
+	return data, nil
+}
+
+// Decode YAML strictly, rejecting keys that don't match a config field
+func decodeStrict(data []byte, out interface{}) error {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	err := decoder.Decode(out)
+	if err == io.EOF {
+		return nil
+	}
+
+	return err
+}
+
+// Find the line each database entry is defined on
+func databaseLines(data []byte) []int {
+	var root yaml.Node
+	if yaml.Unmarshal(data, &root) != nil || len(root.Content) == 0 {
+		return nil
+	}
+
+	mapping := root.Content[0]
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value != "databases" {
+			continue
+		}
+
+		lines := []int{}
+		for _, item := range mapping.Content[i+1].Content {
+			lines = append(lines, item.Line)
+		}
+		return lines
+	}
+
+	return nil
+}
+
+// Merge a configuration file into the config. Lists are appended to, while any
+// other settings present in the file replace the existing ones.
+func mergeConfig(config *Config, data []byte, path string) error {
+	part := Config{}
+	err := decodeStrict(data, &part)
+	if err != nil {
+		return err
+	}
+
+	lines := databaseLines(data)
+	for i := range part.Databases {
+		part.Databases[i].source = path
+		if i < len(lines) {
+			part.Databases[i].source = fmt.Sprintf("%s:%d", path, lines[i])
+		}
+	}
+
+	databases := append(config.Databases, part.Databases...)
+	notifications := append(config.Notifications, part.Notifications...)
+	targets := append(config.Targets, part.Targets...)
+	replicas := append(config.Replicas, part.Replicas...)
+
+	err = decodeStrict(data, config)
+	if err != nil {
+		return err
+	}
+
+	config.Databases = databases
+	config.Notifications = notifications
+	config.Targets = targets
+	config.Replicas = replicas
+
+	return nil
+}
+
+// List the configuration files in the conf.d directory next to the main file
+func confDFiles(path string) ([]string, error) {
+	dir := filepath.Join(filepath.Dir(path), "conf.d")
+
+	entries, err := os.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	files := []string{}
+	for _, entry := range entries {
+		switch strings.ToLower(filepath.Ext(entry.Name())) {
+		case ".yaml", ".yml", ".json", ".toml":
+			if !entry.IsDir() {
+				files = append(files, filepath.Join(dir, entry.Name()))
+			}
+		}
+	}
+
+	// ReadDir returns entries sorted by name, so files are merged in that order
+	return files, nil
+}
+
+// Read a configuration file after the files it includes, and theirs before
+// them, so its own settings override the shared ones. including holds the
+// files already being read, to catch includes that loop.
+func readWithIncludes(path string, including []string) ([]string, [][]byte, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		abs = path
+	}
+	for _, parent := range including {
+		if parent == abs {
+			return nil, nil, fmt.Errorf("configuration file %s includes itself", path)
+		}
+	}
+
+	data, err := readConfigFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var document struct {
+		Include []string `yaml:"include"`
+	}
+	err = yaml.Unmarshal(data, &document)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error parsing configuration file %s: %w", path, err)
+	}
+
+	files := []string{}
+	documents := [][]byte{}
+
+	for _, pattern := range document.Include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(path), pattern)
+		}
+
+		matches, err := filepath.Glob(pattern)
+		if err == nil && len(matches) == 0 {
+			err = fmt.Errorf("no files match")
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("error including %s in %s: %w", pattern, path, err)
+		}
+
+		for _, match := range matches {
+			included, includedDocuments, err := readWithIncludes(match, append(including, abs))
+			if err != nil {
+				return nil, nil, err
+			}
+			files = append(files, included...)
+			documents = append(documents, includedDocuments...)
+		}
+	}
+
+	return append(files, path), append(documents, data), nil
+}
+
+// Matches a reference to a configuration variable, e.g. ${vars.site}
+var variablePattern = regexp.MustCompile(`\$\{vars\.([A-Za-z0-9_-]+)\}`)
+
+// Replace ${vars.name} references in the documents with the values from
+// their variables sections. Later documents' values win, so a site's file
+// can set the values used in the shared files it includes. Values are only
+// substituted into the documents' strings, not their comments, and go in
+// quoted unless they're a number or boolean, so a value can't add YAML of its
+// own.
+func expandVariables(files []string, documents [][]byte) ([][]byte, error) {
+	variables := map[string]string{}
+	for _, data := range documents {
+		var document struct {
+			Variables map[string]string `yaml:"variables"`
+		}
+		// Errors are reported when the document is merged
+		if yaml.Unmarshal(data, &document) == nil {
+			for name, value := range document.Variables {
+				variables[name] = value
+			}
+		}
+	}
+
+	expanded := [][]byte{}
+	for i, data := range documents {
+		var root yaml.Node
+		if !variablePattern.Match(data) || yaml.Unmarshal(data, &root) != nil {
+			expanded = append(expanded, data)
+			continue
+		}
+
+		data, err := expandDocument(data, &root, variables)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing configuration file %s: %w", files[i], err)
+		}
+		expanded = append(expanded, data)
+	}
+
+	return expanded, nil
+}
+
+// A scalar holding variable references, with its value once they're replaced
+type variableScalar struct {
+	node  *yaml.Node
+	value string
+}
+
+// Find the scalars under a node that hold variable references
+func variableScalars(node *yaml.Node, variables map[string]string) ([]variableScalar, error) {
+	if node.Kind == yaml.AliasNode {
+		return nil, nil
+	}
+
+	if node.Kind == yaml.ScalarNode {
+		if !variablePattern.MatchString(node.Value) {
+			return nil, nil
+		}
+
+		var err error
+		value := variablePattern.ReplaceAllStringFunc(node.Value, func(reference string) string {
+			name := variablePattern.FindStringSubmatch(reference)[1]
+			value, ok := variables[name]
+			if !ok && err == nil {
+				err = fmt.Errorf("undefined variable %s", name)
+			}
+			return value
+		})
+
+		return []variableScalar{{node: node, value: value}}, err
+	}
+
+	scalars := []variableScalar{}
+	for _, child := range node.Content {
+		found, err := variableScalars(child, variables)
+		if err != nil {
+			return nil, err
+		}
+		scalars = append(scalars, found...)
+	}
+
+	return scalars, nil
+}
+
+// Substitute the variables into a document's scalars. Each is rewritten where
+// it stands, so errors still give the lines in the file, unless it's a block
+// or spans lines; then the whole document is encoded again.
+func expandDocument(data []byte, root *yaml.Node, variables map[string]string) ([]byte, error) {
+	scalars, err := variableScalars(root, variables)
+	if err != nil {
+		return nil, err
+	}
+
+	lines := strings.SplitAfter(string(data), "\n")
+
+	// From the end of each line backwards, so earlier columns stay put
+	sort.Slice(scalars, func(i, j int) bool {
+		a, b := scalars[i].node, scalars[j].node
+		return a.Line > b.Line || (a.Line == b.Line && a.Column > b.Column)
+	})
+
+	for _, scalar := range scalars {
+		start, end, ok := scalarSpan(lines, scalar.node)
+		if !ok {
+			for _, scalar := range scalars {
+				scalar.node.Value = scalar.value
+				if scalar.node.Style&(yaml.DoubleQuotedStyle|yaml.SingleQuotedStyle|yaml.LiteralStyle|yaml.FoldedStyle) == 0 {
+					scalar.node.Tag = ""
+				}
+			}
+			return yaml.Marshal(root)
+		}
+
+		line := lines[scalar.node.Line-1]
+		lines[scalar.node.Line-1] = line[:start] + scalarText(scalar.node, scalar.value) + line[end:]
+	}
+
+	return []byte(strings.Join(lines, "")), nil
+}
+
+// Find the bytes of its line a scalar on a single line takes up
+func scalarSpan(lines []string, node *yaml.Node) (int, int, bool) {
+	if node.Line < 1 || node.Line > len(lines) {
+		return 0, 0, false
+	}
+	line := lines[node.Line-1]
+
+	// Columns count characters, not bytes
+	start := len(line)
+	column := 1
+	for i := range line {
+		if column == node.Column {
+			start = i
+			break
+		}
+		column++
+	}
+	rest := line[start:]
+
+	switch node.Style {
+	case 0, yaml.FlowStyle:
+		if strings.HasPrefix(rest, node.Value) {
+			return start, start + len(node.Value), true
+		}
+	case yaml.SingleQuotedStyle:
+		quoted := "'" + strings.ReplaceAll(node.Value, "'", "''") + "'"
+		if strings.HasPrefix(rest, quoted) {
+			return start, start + len(quoted), true
+		}
+	case yaml.DoubleQuotedStyle:
+		for i := 1; strings.HasPrefix(rest, `"`) && i < len(rest); i++ {
+			if rest[i] == '\\' {
+				i++
+			} else if rest[i] == '"' {
+				return start, start + i + 1, true
+			}
+		}
+	}
+
+	return 0, 0, false
+}
+
+// Write a scalar's new value. A plain scalar keeps a number or boolean's
+// type, so "port: ${vars.port}" is still a number; anything else is quoted.
+func scalarText(node *yaml.Node, value string) string {
+	if node.Style == 0 || node.Style == yaml.FlowStyle {
+		var parsed yaml.Node
+		if yaml.Unmarshal([]byte(value), &parsed) == nil && len(parsed.Content) == 1 {
+			switch parsed.Content[0].Tag {
+			case "!!int", "!!float", "!!bool":
+				if !strings.ContainsAny(value, "\n#") {
+					return value
+				}
+			}
+		}
+	}
+
+	quoted, _ := json.Marshal(value)
+	return string(quoted)
+}
+
+// Merge the already read configuration files, in order, into a new config
+func mergeFiles(files []string, documents [][]byte) (Config, error) {
+	config := Config{}
+
+	for i, file := range files {
+		err := mergeConfig(&config, documents[i], file)
+		if err != nil {
+			return config, fmt.Errorf("error parsing configuration file %s: %w", file, err)
+		}
+	}
+
+	return config, nil
+}
+
+// Read a configuration file and every file from conf.d alongside it, each
+// after the files it includes
+func readConfigFiles(path string) ([]string, [][]byte, error) {
+	extra, err := confDFiles(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading conf.d: %w", err)
+	}
+
+	files := []string{}
+	documents := [][]byte{}
+
+	for _, file := range append([]string{path}, extra...) {
+		included, data, err := readWithIncludes(file, nil)
+		if err != nil {
+			return nil, nil, err
+		}
+		files = append(files, included...)
+		documents = append(documents, data...)
+	}
+
+	return files, documents, nil
+}
+
+// Load a configuration file, then merge in every file from conf.d alongside
+// it. The whole configuration can instead come from DBBACKUP_CONFIG_JSON or a
+// central server at DBBACKUP_CONFIG_URL, and DBBACKUP_ variables override
+// single options either way.
+func loadConfig(path string) (Config, error) {
+	files := []string{configDataVariable}
+	documents := [][]byte{[]byte(os.Getenv(configDataVariable))}
+
+	if len(documents[0]) == 0 && os.Getenv(remoteConfigURLVariable) != "" {
+		data, err := readRemoteConfig(path)
+		if err != nil {
+			return Config{}, err
+		}
+		files = []string{os.Getenv(remoteConfigURLVariable)}
+		documents = [][]byte{data}
+	} else if len(documents[0]) == 0 {
+		var err error
+		files, documents, err = readConfigFiles(path)
+		if err != nil {
+			return Config{}, err
+		}
+	}
+
+	data, err := envConfig(os.Environ())
+	if err != nil {
+		return Config{}, err
+	}
+	if data != nil {
+		files = append(files, "environment")
+		documents = append(documents, data)
+	}
+
+	documents, err = expandVariables(files, documents)
+	if err != nil {
+		return Config{}, err
+	}
+
+	config, err := mergeFiles(files, documents)
+	if err != nil {
+		return config, err
+	}
+
+	applyDefaults(&config, filepath.Dir(path))
+
+	// The top level only holds the settings profiles share, so only the
+	// profiles themselves need to be complete
+	if len(config.Profiles) > 0 {
+		config.profiles, err = loadProfiles(config, files, documents, filepath.Dir(path))
+		return config, err
+	}
+
+	err = validateConfig(config)
+	if err != nil {
+		return config, err
+	}
+
+	config.bindNotifiers()
+
+	return config, nil
+}
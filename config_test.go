@@ -0,0 +1,117 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestExampleConfigLoads(t *testing.T) {
+	// The example leaves the bucket for each deployment to fill in
+	t.Setenv("DBBACKUP_S3_CONFIG__BUCKET", "backups")
+
+	if _, err := loadConfig("config.example.yaml"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConfigVariables(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+
+	config := `# Every site sets ${vars.site}, which comments can mention
+variables:
+  site: "fra1"
+  port: "3307"
+  injected: "x\ncron_interval: never"
+  nested: "[a, b]"
+cron_interval: "0 0 * * * *"
+s3_config:
+  bucket: backups-${vars.site}
+  region: "${vars.injected}"
+databases:
+  - engine: mysql
+    host: db.${vars.site}.example.com
+    port: ${vars.port}
+    username: ${vars.nested}
+    name: shop
+`
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if loaded.S3Config.Bucket != "backups-fra1" {
+		t.Errorf("bucket is %q", loaded.S3Config.Bucket)
+	}
+	if loaded.CronInterval != "0 0 * * * *" || loaded.S3Config.Region != "x\ncron_interval: never" {
+		t.Errorf("a variable's value was parsed as YAML: cron_interval %q, region %q", loaded.CronInterval, loaded.S3Config.Region)
+	}
+
+	db := loaded.Databases[0]
+	if db.Host != "db.fra1.example.com" || db.Port != 3307 || db.Username != "[a, b]" {
+		t.Errorf("database is %s:%d as %q", db.Host, db.Port, db.Username)
+	}
+}
+
+func TestConfigUndefinedVariable(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte("cron_interval: \"${vars.missing}\"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := loadConfig(path); err == nil {
+		t.Error("loading a config with an undefined variable succeeded")
+	}
+}
+
+func TestConfigVariablesKeepLines(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	config := `variables:
+  site: "fra1"
+cron_interval: "0 0 * * * *"
+s3_config:
+  bucket: 'backups-${vars.site}' # per site
+
+databases:
+  - engine: mysql
+    host: "db.${vars.site}.example.com"
+    name: shop
+  - engine: mysql
+    host: db2.${vars.site}.example.com
+`
+	if err := os.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := loadConfig(path)
+	if err == nil || !strings.Contains(err.Error(), "config.yaml:11: name or names is required") {
+		t.Errorf("loading returned %v, want the line of the second database", err)
+	}
+}
+
+func TestConfigVariablesInBlockScalars(t *testing.T) {
+	document := "variables:\n  site: \"fra1\"\nnote: |\n  backups of ${vars.site}\n  and more\n"
+
+	expanded, err := expandVariables([]string{"config.yaml"}, [][]byte{[]byte(document)})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var decoded struct {
+		Note string `yaml:"note"`
+	}
+	if err := yaml.Unmarshal(expanded[0], &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.Note != "backups of fra1\nand more\n" {
+		t.Errorf("note is %q", decoded.Note)
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+)
+
+// Hold the unit prices runs are costed with, in the currency of the bill.
+// Nothing is costed until one is set.
+type CostConfig struct {
+	// e.g. 0.023 for S3 Standard in us-east-1
+	StoragePerGBMonth float64 `yaml:"storage_per_gb_month"`
+
+	// PUT, COPY and multipart upload requests, e.g. 0.005
+	RequestsPer1000 float64 `yaml:"requests_per_1000"`
+
+	// Data sent to targets and replicas, e.g. 0.02 for cross-region
+	// replication. Uploads into S3 are free, so this defaults to 0.
+	TransferPerGB float64 `yaml:"transfer_per_gb"`
+
+	// Shown with the amounts, defaulting to "USD"
+	Currency string `yaml:"currency"`
+}
+
+// Check whether any prices are configured
+func (cost CostConfig) enabled() bool {
+	return cost.StoragePerGBMonth > 0 || cost.RequestsPer1000 > 0 || cost.TransferPerGB > 0
+}
+
+// Hold what a run is estimated to cost, and what a month of such runs would
+type CostReport struct {
+	Currency string `json:"currency"`
+
+	// What the run itself did
+	Requests      int64 `json:"requests"`
+	TransferBytes int64 `json:"transfer_bytes"`
+	StoredBytes   int64 `json:"stored_bytes"`
+
+	// The requests and transfer, paid once
+	RequestCost  float64 `json:"request_cost"`
+	TransferCost float64 `json:"transfer_cost"`
+
+	// Keeping what the run stored, for a month and for as long as retention
+	// keeps it. The latter is unset when backups are kept forever.
+	StorageCostPerMonth float64 `json:"storage_cost_per_month"`
+	RetentionCost       float64 `json:"retention_cost,omitempty"`
+
+	// A month of runs like this one on the schedule, once retention has
+	// reached a steady state. When backups are kept forever the storage
+	// cost grows by MonthlyStorageCost every month instead.
+	RunsPerMonth       int     `json:"runs_per_month"`
+	MonthlyStorageCost float64 `json:"monthly_storage_cost"`
+	MonthlyCost        float64 `json:"monthly_cost"`
+}
+
+// Average days in a month, for converting retention to months
+const daysPerMonth = 30.44
+
+// Count the requests an upload of this size takes: one PUT, or creating,
+// completing and a PUT for each part of a multipart upload
+func uploadRequests(size int64) int64 {
+	if size <= uploadPartSize {
+		return 1
+	}
+
+	return (size+uploadPartSize-1)/uploadPartSize + 2
+}
+
+// Count how many times the schedule fires in a month from now
+func runsPerMonth(spec string) int {
+	end := clk.Now().Add(time.Duration(daysPerMonth * 24 * float64(time.Hour)))
+
+	count := 0
+	for _, run := range nextRuns(spec, 50000) {
+		if run.After(end) {
+			break
+		}
+		count++
+	}
+
+	return count
+}
+
+// Get how many months a target keeps backups, or 0 when it keeps them forever
+func (target TargetConfig) retentionMonths() float64 {
+	if target.Retention == "" {
+		return 0
+	}
+
+	retention, err := parseDuration(target.Retention)
+	if err != nil || retention <= 0 {
+		return 0
+	}
+
+	return retention.Hours() / 24 / daysPerMonth
+}
+
+// Estimate what a run cost from what it uploaded, and project a month of
+// runs on the schedule. Archives uploaded separately are counted at their
+// dump's size, as their own size isn't recorded.
+func estimateCost(config Config, report *RunReport) *CostReport {
+	prices := config.Cost
+	if !prices.enabled() {
+		return nil
+	}
+
+	cost := &CostReport{Currency: prices.Currency}
+	if cost.Currency == "" {
+		cost.Currency = "USD"
+	}
+
+	// Sizes of the objects the run uploaded to every target
+	uploads := []int64{}
+	targets := config.targets()
+	if report.ArchiveKey != "" && report.Dedup == nil {
+		uploads = append(uploads, report.ArchiveSizeBytes)
+	}
+	for _, db := range report.Databases {
+		if db.ArchiveKey != "" && db.Success {
+			uploads = append(uploads, db.SizeBytes)
+		}
+	}
+
+	// New chunks go to the repository on the first target, and are kept for
+	// as long as any backup uses them
+	retainForever := false
+	if report.Dedup != nil {
+		cost.Requests += int64(report.Dedup.ChunksUploaded) + 1
+		cost.TransferBytes += report.Dedup.BytesUploaded
+		cost.StoredBytes += report.Dedup.BytesUploaded
+		retainForever = true
+		targets = targets[:1]
+	}
+
+	// Each target keeps a copy for as long as its retention
+	var retention float64
+	for _, target := range targets {
+		for _, size := range uploads {
+			cost.Requests += uploadRequests(size)
+			cost.TransferBytes += size
+			cost.StoredBytes += size
+
+			months := target.retentionMonths()
+			if months == 0 {
+				retainForever = true
+			}
+			retention += float64(size) / 1e9 * months
+		}
+	}
+
+	// Replicas are server-side copies of the run's archive
+	for range report.Replicas {
+		cost.Requests++
+		cost.TransferBytes += report.ArchiveSizeBytes
+		cost.StoredBytes += report.ArchiveSizeBytes
+		retainForever = true
+	}
+
+	storedGB := float64(cost.StoredBytes) / 1e9
+	cost.RequestCost = float64(cost.Requests) / 1000 * prices.RequestsPer1000
+	cost.TransferCost = float64(cost.TransferBytes) / 1e9 * prices.TransferPerGB
+	cost.StorageCostPerMonth = storedGB * prices.StoragePerGBMonth
+	if !retainForever {
+		cost.RetentionCost = retention * prices.StoragePerGBMonth
+	}
+
+	// In a steady state each run is stored for its retention, so a month of
+	// runs pays for every retention-month they're kept. Kept forever, a
+	// month of runs adds their storage to the bill every month instead.
+	cost.RunsPerMonth = runsPerMonth(config.CronInterval)
+	perRunStorage := cost.StorageCostPerMonth
+	if !retainForever {
+		perRunStorage = cost.RetentionCost
+	}
+	cost.MonthlyStorageCost = float64(cost.RunsPerMonth) * perRunStorage
+	cost.MonthlyCost = float64(cost.RunsPerMonth)*(cost.RequestCost+cost.TransferCost) + cost.MonthlyStorageCost
+
+	return cost
+}
+
+// Format an amount of money with its currency, e.g. "12.34 USD"
+func formatCost(amount float64, currency string) string {
+	if amount > 0 && amount < 0.01 {
+		return fmt.Sprintf("%.4f %s", amount, currency)
+	}
+
+	return fmt.Sprintf("%.2f %s", amount, currency)
+}
+
+// Log a run's estimated cost
+func logCost(cost *CostReport) {
+	if cost == nil {
+		return
+	}
+
+	log.Printf("Estimated cost of this run: %s in requests and transfer, %s a month to store (%d requests, %s stored)\n",
+		formatCost(cost.RequestCost+cost.TransferCost, cost.Currency), formatCost(cost.StorageCostPerMonth, cost.Currency), cost.Requests, formatBytes(cost.StoredBytes))
+
+	if cost.RetentionCost > 0 {
+		log.Printf("Storing it for its retention will cost %s\n", formatCost(cost.RetentionCost, cost.Currency))
+		log.Printf("Projected cost of %d runs a month: %s a month once retention is steady, %s of it storage\n",
+			cost.RunsPerMonth, formatCost(cost.MonthlyCost, cost.Currency), formatCost(cost.MonthlyStorageCost, cost.Currency))
+	} else {
+		log.Printf("Projected cost of %d runs a month: %s, with storage growing by %s a month as backups are kept forever\n",
+			cost.RunsPerMonth, formatCost(cost.MonthlyCost, cost.Currency), formatCost(cost.MonthlyStorageCost, cost.Currency))
+	}
+}
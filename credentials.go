@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/service/sts"
+)
+
+// Refresh assumed role credentials this long before they expire, so a request
+// signed just before expiry doesn't fail partway through an upload
+const credentialExpiryWindow = 5 * time.Minute
+
+// Assumed role credentials shared between sessions, so each upload doesn't
+// assume the role again
+var (
+	roleCredentials      = map[string]*credentials.Credentials{}
+	roleCredentialsMutex sync.Mutex
+)
+
+// Get the target's base credentials. Without an access key the SDK's default
+// chain is used (environment, shared config, then instance or task role).
+func (target TargetConfig) credentials() *credentials.Credentials {
+	if target.AccessKey == "" {
+		return nil
+	}
+
+	return credentials.NewStaticCredentials(target.AccessKey, target.AccessSecret.reveal(), target.SessionToken.reveal())
+}
+
+// Get credentials for the target's role, refreshed automatically as they
+// expire. With web_identity set the role is assumed with the workload's own
+// identity token rather than AWS credentials.
+func assumeRoleCredentials(sess client.ConfigProvider, target TargetConfig) *credentials.Credentials {
+	key := target.AccessKey + "|" + target.RoleARN + "|" + target.ExternalID + "|" + target.WebIdentity
+
+	roleCredentialsMutex.Lock()
+	defer roleCredentialsMutex.Unlock()
+
+	if creds, ok := roleCredentials[key]; ok {
+		return creds
+	}
+
+	if target.WebIdentity != "" {
+		provider := stscreds.NewWebIdentityRoleProviderWithOptions(sts.New(sess), target.RoleARN, "dbbackup", webIdentityToken{target: target}, func(p *stscreds.WebIdentityRoleProvider) {
+			p.ExpiryWindow = credentialExpiryWindow
+		})
+		creds := credentials.NewCredentials(provider)
+		roleCredentials[key] = creds
+
+		return creds
+	}
+
+	creds := stscreds.NewCredentials(sess, target.RoleARN, func(p *stscreds.AssumeRoleProvider) {
+		p.RoleSessionName = "dbbackup"
+		p.ExpiryWindow = credentialExpiryWindow
+		if target.ExternalID != "" {
+			p.ExternalID = aws.String(target.ExternalID)
+		}
+	})
+	roleCredentials[key] = creds
+
+	return creds
+}
+
+// Check the credentials of every S3 target and replica work before starting a
+// run, refreshing any that would expire within the expected run time. Fails
+// with the first target whose credentials can't be used.
+func checkCredentials(ctx context.Context, config Config, expected time.Duration) error {
+	targets := config.targets()
+	for i, replica := range config.Replicas {
+		if replica.Name == "" {
+			replica.Name = fmt.Sprintf("replica-%d", i+1)
+		}
+		targets = append(targets, replica)
+	}
+
+	for _, target := range targets {
+		if target.Type != "s3" {
+			continue
+		}
+
+		sess, err := target.session()
+		if err != nil {
+			return err
+		}
+
+		creds := sess.Config.Credentials
+
+		// Static credentials can't say when they expire, refreshing ones can
+		if expiresAt, err := creds.ExpiresAt(); err == nil && time.Until(expiresAt) < expected {
+			log.Printf("Credentials for %s expire at %s, refreshing before the run\n", target.Name, expiresAt.Format(time.RFC3339))
+			creds.Expire()
+		}
+
+		// Temporary credentials may already have expired, which only shows up
+		// when they're used
+		_, err = sts.New(sess).GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
+		if err != nil {
+			return fmt.Errorf("credentials for %s can't be used: %w", target.Name, err)
+		}
+
+		if expiresAt, err := creds.ExpiresAt(); err == nil && time.Until(expiresAt) < expected {
+			log.Printf("Credentials for %s expire at %s, before the run is expected to finish. They'll be refreshed as needed.\n", target.Name, expiresAt.Format(time.RFC3339))
+		}
+	}
+
+	return nil
+}
+
+// Guess how long a run will take from the limit on it or the previous run
+func expectedRunDuration(config Config, previous *RunReport) time.Duration {
+	if limit := config.maxRunDuration(); limit > 0 {
+		return limit
+	}
+
+	if previous != nil {
+		return time.Duration(previous.DurationSeconds * float64(time.Second))
+	}
+
+	return 0
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron"
+)
+
+// Hold the most recent result for a single database, as shown on the dashboard
+type DatabaseStatus struct {
+	Engine      string
+	Host        string
+	Name        string
+	LastRun     time.Time
+	LastSuccess time.Time
+	Success     bool
+	Error       string
+	Sizes       []int64
+}
+
+const dashboardTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>dbbackup</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; }
+.ok { color: #080; }
+.fail { color: #b00; }
+</style>
+</head>
+<body>
+<h1>dbbackup</h1>
+
+<form method="post" action="trigger/backup{{if .Token}}?token={{.Token}}{{end}}">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<button type="submit">Run backup now</button>
+{{if .Running}}<em>A backup is currently running</em>{{end}}
+</form>
+
+<h2>Restore</h2>
+<form method="post" action="trigger/restore{{if .Token}}?token={{.Token}}{{end}}" onsubmit="return confirm('Restore over ' + this.database.value + '?')">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<select name="archive">{{range .Reports}}{{if .ArchiveKey}}<option>{{.ArchiveKey}}</option>{{end}}{{end}}</select>
+<input name="database" placeholder="Database" required>
+<input name="host" placeholder="Host, if not the original">
+<label><input type="checkbox" name="snapshot"> Snapshot first</label>
+<label><input type="checkbox" name="force"> Force</label>
+<button type="submit">Restore</button>
+</form>
+
+<h2>Prune</h2>
+<form method="post" action="trigger/prune{{if .Token}}?token={{.Token}}{{end}}">
+<input type="hidden" name="csrf" value="{{.CSRF}}">
+<select name="target"><option value="">All targets</option>{{range .Targets}}<option>{{.}}</option>{{end}}</select>
+<label><input type="checkbox" name="dry_run" checked> Dry run</label>
+<button type="submit">Prune</button>
+</form>
+
+{{if .Jobs}}
+<h2>Jobs</h2>
+<table>
+<tr><th>Started</th><th>Command</th><th>Status</th><th>Output</th></tr>
+{{range .Jobs}}
+<tr>
+<td>{{.StartedAt.Format "2006-01-02 15:04:05"}}</td>
+<td>{{.Command}} {{range .Args}}{{.}} {{end}}</td>
+<td>{{if eq .Status "succeeded"}}<span class="ok">{{.Status}}</span>{{else if eq .Status "failed"}}<span class="fail">{{.Status}}</span>{{else}}{{.Status}}{{end}}</td>
+<td>{{if .Output}}<details><summary>Output</summary><pre>{{.Output}}</pre></details>{{end}}</td>
+</tr>
+{{end}}
+</table>
+{{end}}
+
+<h2>Next scheduled runs</h2>
+<ul>
+{{range .NextRuns}}<li>{{.Format "2006-01-02 15:04:05 MST"}}</li>{{else}}<li>No schedule configured</li>{{end}}
+</ul>
+
+<h2>Databases</h2>
+<table>
+<tr><th>Engine</th><th>Host</th><th>Database</th><th>Last run</th><th>Last success</th><th>Status</th><th>Sizes (oldest to newest)</th></tr>
+{{range .Databases}}
+<tr>
+<td>{{.Engine}}</td><td>{{.Host}}</td><td>{{.Name}}</td>
+<td>{{.LastRun.Format "2006-01-02 15:04:05"}}</td>
+<td>{{if not .LastSuccess.IsZero}}{{.LastSuccess.Format "2006-01-02 15:04:05"}}{{end}}</td>
+<td>{{if .Success}}<span class="ok">OK</span>{{else}}<span class="fail">FAILED</span> {{.Error}}{{end}}</td>
+<td>{{range .Sizes}}{{.}} {{end}}</td>
+</tr>
+{{end}}
+</table>
+
+<h2>History</h2>
+<table>
+<tr><th>Started</th><th>Duration (s)</th><th>Status</th><th>Archive</th><th>Size</th></tr>
+{{range .Reports}}
+<tr>
+<td>{{.StartedAt.Format "2006-01-02 15:04:05"}}</td>
+<td>{{printf "%.1f" .DurationSeconds}}</td>
+<td>{{if .Success}}<span class="ok">OK</span>{{else}}<span class="fail">FAILED</span> {{.Error}}{{end}}</td>
+<td>{{.ArchiveKey}}</td>
+<td>{{.ArchiveSizeBytes}}</td>
+</tr>
+{{end}}
+</table>
+</body>
+</html>
+`
+
+// A run report along with the file it was read from
+type ReportFile struct {
+	Path   string
+	Report RunReport
+}
+
+// Load all run reports from the reports directory with their paths, newest first
+func loadReportFiles(dir string) ([]ReportFile, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "report_*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	files := []ReportFile{}
+
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+
+		report := RunReport{}
+		if err := json.Unmarshal(data, &report); err != nil {
+			continue
+		}
+
+		files = append(files, ReportFile{Path: path, Report: report})
+	}
+
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Report.StartedAt.After(files[j].Report.StartedAt)
+	})
+
+	return files, nil
+}
+
+// Load all run reports from the reports directory, newest first
+func loadReports(dir string) ([]RunReport, error) {
+	files, err := loadReportFiles(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	reports := []RunReport{}
+	for _, file := range files {
+		reports = append(reports, file.Report)
+	}
+
+	return reports, nil
+}
+
+// Work out the latest status of each database from the run history (newest first)
+func databaseStatuses(reports []RunReport) []DatabaseStatus {
+	statuses := []DatabaseStatus{}
+	index := map[string]int{}
+
+	for _, report := range reports {
+		for _, db := range report.Databases {
+			key := db.Engine + "/" + db.Host + "/" + db.Name
+
+			i, ok := index[key]
+			if !ok {
+				statuses = append(statuses, DatabaseStatus{
+					Engine:  db.Engine,
+					Host:    db.Host,
+					Name:    db.Name,
+					LastRun: db.StartedAt,
+					Success: db.Success,
+					Error:   db.Error,
+				})
+				i = len(statuses) - 1
+				index[key] = i
+			}
+
+			if db.Success {
+				if statuses[i].LastSuccess.IsZero() {
+					statuses[i].LastSuccess = db.StartedAt
+				}
+				statuses[i].Sizes = append([]int64{db.SizeBytes}, statuses[i].Sizes...)
+			}
+		}
+	}
+
+	return statuses
+}
+
+// Get the next few times the cron schedule will fire
+func nextRuns(spec string, count int) []time.Time {
+	runs := []time.Time{}
+
+	schedule, err := cron.Parse(spec)
+	if err != nil {
+		return runs
+	}
+
+	next := clk.Now()
+	for i := 0; i < count; i++ {
+		next = schedule.Next(next)
+		if next.IsZero() {
+			break
+		}
+		runs = append(runs, next)
+	}
+
+	return runs
+}
+
+// Check the request against the configured basic auth credentials or token
+func authorised(auth HTTPAuth, r *http.Request) bool {
+	if auth.Token != "" {
+		token := r.URL.Query().Get("token")
+		if header := r.Header.Get("Authorization"); len(header) > 7 && header[:7] == "Bearer " {
+			token = header[7:]
+		}
+
+		if subtle.ConstantTimeCompare([]byte(token), []byte(auth.Token)) == 1 {
+			return true
+		}
+	}
+
+	if auth.Username != "" {
+		username, password, ok := r.BasicAuth()
+		if ok &&
+			subtle.ConstantTimeCompare([]byte(username), []byte(auth.Username)) == 1 &&
+			subtle.ConstantTimeCompare([]byte(password), []byte(auth.Password)) == 1 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Wrap a handler so it requires authentication
+func requireAuth(auth HTTPAuth, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !authorised(auth, r) {
+			if auth.Username != "" {
+				w.Header().Set("WWW-Authenticate", `Basic realm="dbbackup"`)
+			}
+			http.Error(w, "Unauthorised", http.StatusUnauthorized)
+			return
+		}
+
+		next(w, r)
+	}
+}
+
+// Start the web dashboard. Blocks until the server stops.
+func serveDashboard(ctx context.Context, config Config) {
+	defer redactPanic()
+
+	if config.Dashboard.Token == "" && config.Dashboard.Username == "" {
+		log.Println("Refusing to start dashboard without a token or username configured")
+		return
+	}
+
+	mux, err := dashboardHandler(config, func() { runBackups(ctx, config, "dashboard") }, func(name string, args []string) (*Job, error) {
+		return startCommandJob(ctx, config, name, args, "dashboard")
+	})
+	if err != nil {
+		log.Printf("Error starting dashboard: %s\n", err.Error())
+		return
+	}
+
+	log.Printf("Starting dashboard on %s\n", config.Dashboard.Listen)
+
+	err = http.ListenAndServe(config.Dashboard.Listen, mux)
+	if err != nil {
+		log.Printf("Error running dashboard: %s\n", err.Error())
+	}
+}
+
+// Get the jobs started since this process began, newest first
+func recentJobs() []Job {
+	jobsMutex.Lock()
+	defer jobsMutex.Unlock()
+
+	list := []Job{}
+	for i := len(jobOrder) - 1; i >= 0; i-- {
+		list = append(list, *jobs[jobOrder[i]])
+	}
+
+	return list
+}
+
+// Get the arguments the dashboard's restore form runs restore with, refusing
+// values that would be taken as flags
+func dashboardRestoreArgs(form url.Values) ([]string, error) {
+	archive, database, host := form.Get("archive"), form.Get("database"), form.Get("host")
+	if archive == "" || database == "" {
+		return nil, fmt.Errorf("an archive and database are required")
+	}
+	for _, value := range []string{archive, database, host} {
+		if strings.HasPrefix(value, "-") {
+			return nil, fmt.Errorf("%q can't start with -", value)
+		}
+	}
+
+	args := []string{}
+	if form.Get("snapshot") != "" {
+		args = append(args, "--snapshot")
+	}
+	if form.Get("force") != "" {
+		args = append(args, "--force")
+	}
+
+	// Anything after -- is an argument, never a flag
+	args = append(args, "--", archive, database)
+	if host != "" {
+		args = append(args, host)
+	}
+
+	return args, nil
+}
+
+// Get the arguments the dashboard's prune form runs prune with
+func dashboardPruneArgs(form url.Values) []string {
+	args := []string{}
+	if target := form.Get("target"); target != "" {
+		args = append(args, "--target", target)
+	}
+	if form.Get("dry_run") != "" {
+		args = append(args, "--dry-run")
+	}
+
+	return args
+}
+
+// Build the dashboard's pages, with backup starting a backup run and command
+// starting a subcommand as a job
+func dashboardHandler(config Config, backup func(), command func(name string, args []string) (*Job, error)) (http.Handler, error) {
+	tmpl := template.Must(template.New("dashboard").Parse(dashboardTemplate))
+
+	// Sent with the forms, so other sites can't post them with the browser's
+	// cached credentials
+	csrf := make([]byte, 16)
+	if _, err := rand.Read(csrf); err != nil {
+		return nil, err
+	}
+	csrfToken := hex.EncodeToString(csrf)
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/", requireAuth(config.Dashboard.HTTPAuth, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+
+		reports, err := loadReports(config.ReportsDir)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		targets := []string{}
+		for _, target := range config.targets() {
+			targets = append(targets, target.Name)
+		}
+
+		err = tmpl.Execute(w, map[string]interface{}{
+			"Token":     r.URL.Query().Get("token"),
+			"CSRF":      csrfToken,
+			"Running":   backupRunning(config),
+			"NextRuns":  nextRuns(config.CronInterval, 5),
+			"Databases": databaseStatuses(reports),
+			"Reports":   reports,
+			"Targets":   targets,
+			"Jobs":      recentJobs(),
+		})
+		if err != nil {
+			log.Printf("Error rendering dashboard: %s\n", err.Error())
+		}
+	}))
+
+	// Wrap a form's handler so it requires authentication, a post and the CSRF
+	// token, going back to the dashboard after it
+	action := func(handle func(w http.ResponseWriter, r *http.Request) bool) http.HandlerFunc {
+		return requireAuth(config.Dashboard.HTTPAuth, func(w http.ResponseWriter, r *http.Request) {
+			if r.Method != http.MethodPost {
+				http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+
+			if subtle.ConstantTimeCompare([]byte(r.PostFormValue("csrf")), []byte(csrfToken)) != 1 {
+				http.Error(w, "Invalid form token", http.StatusForbidden)
+				return
+			}
+
+			if !handle(w, r) {
+				return
+			}
+
+			// Keep the token, so the page still works without basic auth
+			redirect := "/"
+			if token := r.URL.Query().Get("token"); token != "" {
+				redirect += "?" + url.Values{"token": {token}}.Encode()
+			}
+			http.Redirect(w, r, redirect, http.StatusSeeOther)
+		})
+	}
+
+	// Start a subcommand as a job, reporting why it couldn't be
+	start := func(w http.ResponseWriter, name string, args []string) bool {
+		log.Printf("Starting %s from dashboard\n", name)
+
+		_, err := command(name, args)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return false
+		}
+
+		return true
+	}
+
+	mux.HandleFunc("/trigger/backup", action(func(w http.ResponseWriter, r *http.Request) bool {
+		log.Println("Backup triggered from dashboard")
+		go func() {
+			defer redactPanic()
+			backup()
+		}()
+		return true
+	}))
+
+	mux.HandleFunc("/trigger/restore", action(func(w http.ResponseWriter, r *http.Request) bool {
+		args, err := dashboardRestoreArgs(r.PostForm)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return false
+		}
+
+		return start(w, "restore", args)
+	}))
+
+	mux.HandleFunc("/trigger/prune", action(func(w http.ResponseWriter, r *http.Request) bool {
+		return start(w, "prune", dashboardPruneArgs(r.PostForm))
+	}))
+
+	return mux, nil
+}
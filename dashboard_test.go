@@ -0,0 +1,145 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// Get the CSRF token from the rendered dashboard
+func dashboardCSRF(t *testing.T, handler http.Handler, query string) string {
+	t.Helper()
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/"+query, nil))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("dashboard returned %d: %s", recorder.Code, recorder.Body.String())
+	}
+
+	match := regexp.MustCompile(`name="csrf" value="([0-9a-f]+)"`).FindStringSubmatch(recorder.Body.String())
+	if match == nil {
+		t.Fatalf("no CSRF token in dashboard:\n%s", recorder.Body.String())
+	}
+
+	if query != "" && !strings.Contains(recorder.Body.String(), `action="trigger/backup`+query+`"`) {
+		t.Errorf("trigger form doesn't carry %s", query)
+	}
+
+	return match[1]
+}
+
+func TestDashboardTrigger(t *testing.T) {
+	config := Config{ReportsDir: t.TempDir()}
+	config.Dashboard.Token = "secret"
+
+	triggered := make(chan struct{}, 2)
+	handler, err := dashboardHandler(config, func() { triggered <- struct{}{} }, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	csrf := dashboardCSRF(t, handler, "?token=secret")
+
+	post := func(csrf string) *httptest.ResponseRecorder {
+		body := url.Values{"csrf": {csrf}}.Encode()
+		request := httptest.NewRequest(http.MethodPost, "/trigger/backup?token=secret", strings.NewReader(body))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder
+	}
+
+	if recorder := post("forged"); recorder.Code != http.StatusForbidden {
+		t.Errorf("post with a forged token returned %d, want %d", recorder.Code, http.StatusForbidden)
+	}
+	if recorder := post(""); recorder.Code != http.StatusForbidden {
+		t.Errorf("post without a token returned %d, want %d", recorder.Code, http.StatusForbidden)
+	}
+
+	recorder := post(csrf)
+	if recorder.Code != http.StatusSeeOther {
+		t.Fatalf("post returned %d, want %d", recorder.Code, http.StatusSeeOther)
+	}
+	if location := recorder.Header().Get("Location"); location != "/?token=secret" {
+		t.Errorf("redirected to %q, want the token carried through", location)
+	}
+
+	<-triggered
+	if len(triggered) != 0 {
+		t.Error("backup triggered by a rejected post")
+	}
+}
+
+func TestDashboardCommands(t *testing.T) {
+	config := Config{ReportsDir: t.TempDir()}
+	config.Dashboard.Token = "secret"
+
+	started := [][]string{}
+	handler, err := dashboardHandler(config, func() {}, func(name string, args []string) (*Job, error) {
+		started = append(started, append([]string{name}, args...))
+		return &Job{}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	csrf := dashboardCSRF(t, handler, "?token=secret")
+
+	post := func(action string, form url.Values) int {
+		request := httptest.NewRequest(http.MethodPost, "/trigger/"+action+"?token=secret", strings.NewReader(form.Encode()))
+		request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, request)
+		return recorder.Code
+	}
+
+	restore := url.Values{"archive": {"backup_20260101T000000Z.tar.gz"}, "database": {"shop"}, "snapshot": {"on"}}
+	if code := post("restore", restore); code != http.StatusForbidden {
+		t.Errorf("restore without a token returned %d, want %d", code, http.StatusForbidden)
+	}
+	if code := post("prune", url.Values{"csrf": {"forged"}}); code != http.StatusForbidden {
+		t.Errorf("prune with a forged token returned %d, want %d", code, http.StatusForbidden)
+	}
+
+	restore.Set("csrf", csrf)
+	if code := post("restore", restore); code != http.StatusSeeOther {
+		t.Errorf("restore returned %d, want %d", code, http.StatusSeeOther)
+	}
+	restore.Set("database", "--init-command=DROP DATABASE shop")
+	if code := post("restore", restore); code != http.StatusBadRequest {
+		t.Errorf("restore of a flag returned %d, want %d", code, http.StatusBadRequest)
+	}
+	if code := post("prune", url.Values{"csrf": {csrf}, "target": {"offsite"}, "dry_run": {"on"}}); code != http.StatusSeeOther {
+		t.Errorf("prune returned %d, want %d", code, http.StatusSeeOther)
+	}
+
+	want := [][]string{
+		{"restore", "--snapshot", "--", "backup_20260101T000000Z.tar.gz", "shop"},
+		{"prune", "--target", "offsite", "--dry-run"},
+	}
+	if !reflect.DeepEqual(started, want) {
+		t.Errorf("started %q, want %q", started, want)
+	}
+}
+
+func TestDashboardRequiresAuth(t *testing.T) {
+	config := Config{ReportsDir: t.TempDir()}
+	config.Dashboard.Token = "secret"
+
+	handler, err := dashboardHandler(config, func() {}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/?token=wrong", nil))
+	if recorder.Code != http.StatusUnauthorized {
+		t.Errorf("wrong token returned %d, want %d", recorder.Code, http.StatusUnauthorized)
+	}
+}
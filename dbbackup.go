@@ -3,20 +3,18 @@ package main
 import (
 	"archive/tar"
 	"compress/gzip"
+	"context"
 	"fmt"
 	"io"
 	"log"
-	"net/http"
 	"time"
 
 	"os"
 	"os/exec"
 	"os/signal"
-
-	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
-	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"path/filepath"
+	"strings"
+	"syscall"
 
 	"github.com/robfig/cron"
 	"gopkg.in/yaml.v3"
@@ -28,40 +26,393 @@ type DatabaseConfig struct {
 	Host     string   `yaml:"host"`
 	Port     int      `yaml:"port"`
 	Username string   `yaml:"username"`
-	Password string   `yaml:"password"`
+	Password Secret   `yaml:"password"`
 	DBName   string   `yaml:"name"`
 	DBNames  []string `yaml:"names"`
+
+	// Connect to RDS or Aurora with an IAM token instead of the password (MySQL/MariaDB only)
+	IAMAuth IAMAuthConfig `yaml:"iam_auth"`
+
+	// Where the entry was defined, for error messages
+	source string
+
+	// Try each address the host resolves to in turn until a dump succeeds.
+	// Dump tools then connect by IP, so TLS hostname verification won't match.
+	TryAllAddresses bool `yaml:"try_all_addresses"`
+
+	// The address being tried, when trying every address
+	address string
+
+	// Free-form labels, e.g. team: payments, added to the run's labels
+	Labels map[string]string `yaml:"labels"`
+
+	// Names of the notifiers to send this database's notifications to, e.g. a
+	// pager for production and a low-priority channel for staging. Without
+	// it they go to every notifier not set to routed_only.
+	Notify []string `yaml:"notify"`
+
+	// Look up the address at run time instead of connecting to the host
+	Discovery DiscoveryConfig `yaml:"discovery"`
+
+	// Skip dumping unchanged databases, detected with "update_time" or "checksum" (MySQL/MariaDB only)
+	ChangeDetection string `yaml:"change_detection"`
+
+	// Take a full dump this often and differential dumps of changed tables in between, e.g. "168h" (MySQL/MariaDB only)
+	FullBackupInterval string `yaml:"full_backup_interval"`
+
+	// Character set used to dump and restore, defaults to utf8mb4 (MySQL/MariaDB only)
+	DefaultCharacterSet string `yaml:"default_character_set"`
+
+	// Options for tables with large BLOBs (MySQL/MariaDB only). max_allowed_packet
+	// is also used when restoring, e.g. "512M".
+	HexBlob          bool   `yaml:"hex_blob"`
+	MaxAllowedPacket string `yaml:"max_allowed_packet"`
+	NetBufferLength  int    `yaml:"net_buffer_length"`
+
+	// Dump this many tables at once, each with its own mysqldump, for databases
+	// too big to dump in one go (MySQL/MariaDB only). Tables aren't dumped in
+	// the same transaction, so only use this when writes can be paused.
+	ParallelTables int `yaml:"parallel_tables"`
+
+	// Split the dump into a file per table as it's written, in the same
+	// layout as parallel_tables but consistent as a whole, so single tables
+	// can be restored and compared (MySQL/MariaDB only)
+	SplitTables bool `yaml:"split_tables"`
+
+	// Tables to apply from per-table dumps, when restoring only some
+	restoreTables []string
+
+	// Export tables as compressed CSV or TSV too, or instead of dumping, for
+	// feeding analytics from the same schedule (MySQL/MariaDB only)
+	TableExport TableExportConfig `yaml:"table_export"`
+
+	// Dump with "mysqlpump" instead of mysqldump, which dumps tables in parallel
+	// within one transaction (MySQL 5.7/8.0 only). pump_parallelism sets its
+	// thread count, and exclude_databases skips databases when name is "*".
+	DumpTool         string   `yaml:"dump_tool"`
+	PumpParallelism  int      `yaml:"pump_parallelism"`
+	ExcludeDatabases []string `yaml:"exclude_databases"`
+
+	// Record each table's row count ("rows") or row count and CHECKSUM TABLE
+	// ("checksum") in the report, checked after restoring (MySQL/MariaDB only)
+	TableSummary string `yaml:"table_summary"`
+
+	// Record the schema and report changes since the previous backup (MySQL/MariaDB only)
+	SchemaDrift bool `yaml:"schema_drift"`
+
+	// Also dump stored procedures, functions and events, which mysqldump leaves
+	// out unless asked (MySQL/MariaDB only)
+	StoredPrograms bool `yaml:"stored_programs"`
+
+	// Compare the tables, views, routines, triggers and events in
+	// information_schema against the dump and fail it if any are missing
+	// (MySQL/MariaDB only)
+	CheckCompleteness bool `yaml:"check_completeness"`
+
+	// Lock taken in a separate session for the whole dump: "flush" for FLUSH
+	// TABLES WITH READ LOCK, consistent even for MyISAM tables and parallel_tables,
+	// or "instance" for LOCK INSTANCE FOR BACKUP (MySQL 8), which only blocks DDL
+	Lock string `yaml:"lock"`
+
+	// Release the lock after this long even if the dump hasn't finished, failing
+	// it. Defaults to "15m".
+	MaxLockTime string `yaml:"max_lock_time"`
+
+	// Server version to adjust mysqldump flags for: "auto" (the default) to
+	// detect it, "5.6", "5.7", "8.0", "mariadb", or "none" to add no flags
+	Compat string `yaml:"compat"`
+
+	// Named bundle of dump settings to start from: "safe-innodb",
+	// "myisam-locking", "fast-large-db" or "rds-compatible" (MySQL/MariaDB only)
+	Preset string `yaml:"preset"`
+
+	// Dump before databases with a lower priority, e.g. 10 for the ones that
+	// matter most. Defaults to 0, with equal priorities in config order.
+	Priority int `yaml:"priority"`
+
+	// Mask columns in the dump before it is archived (MySQL/MariaDB only)
+	Masking []MaskingRule `yaml:"masking"`
+
+	// Transform the dump before it's archived, each step reading the last's
+	// output, e.g. mask, then gzip, then encrypt. Masking rules are applied
+	// by the mask step when these are set.
+	Processors []ProcessorConfig `yaml:"processors"`
+
+	// Capture SHOW GLOBAL VARIABLES/STATUS and the local my.cnf into the archive (MySQL/MariaDB only)
+	CaptureServerConfig bool   `yaml:"capture_server_config"`
+	MyCnfPath           string `yaml:"mycnf_path"`
+
+	// Client certificates for engines that support TLS
+	TLS struct {
+		CA   string `yaml:"ca"`
+		Cert string `yaml:"cert"`
+		Key  string `yaml:"key"`
+	} `yaml:"tls"`
+
+	// Shell command whose stdout is the dump, and the extension to save it with (command engine only)
+	Command   string `yaml:"command"`
+	Extension string `yaml:"extension"`
+
+	// Back up with the other members of this group, one after another in
+	// the order they're listed, between the group's pause and resume hooks
+	Group string `yaml:"group"`
+
+	// Paths and snapshot settings for the files engine
+	Files FilesConfig `yaml:"files"`
+
+	// Snapshot settings for the rds_snapshot engine
+	RDS RDSSnapshotConfig `yaml:"rds"`
+
+	// Export settings for the cloudsql_export engine
+	CloudSQL CloudSQLConfig `yaml:"cloudsql"`
+
+	// InfluxDB major version, 1 or 2 (default)
+	InfluxVersion int `yaml:"influx_version"`
+
+	// S3 object settings for this entry's dumps, which are then uploaded as their own archive
+	S3 S3Overrides `yaml:"s3"`
+
+	// Overrides the global max_backup_age for this entry
+	MaxBackupAge string `yaml:"max_backup_age"`
+
+	// Alert when a dump is bigger than this, e.g. "50G", or stop it with size_budget.action "abort"
+	MaxSize string `yaml:"max_size"`
+}
+
+// Hold the credentials accepted by the HTTP servers
+type HTTPAuth struct {
+	Username string `yaml:"username"`
+	Password Secret `yaml:"password"`
+	Token    Secret `yaml:"token"`
 }
 
 // Hold the configuration for the entire application
 type Config struct {
 	CronInterval string `yaml:"cron_interval"`
 	HeartbeatUri string `yaml:"heartbeat_uri"`
+	AuditLog     string `yaml:"audit_log"`
+
+	// How heartbeats are sent, and where when a run fails
+	Heartbeat HeartbeatConfig `yaml:"heartbeat"`
+
+	// Time zone used for timestamps in file names and object keys, e.g. "UTC" or
+	// "Europe/London". When set, names include the UTC offset.
+	Timezone string `yaml:"timezone"`
+
+	// Alert when a database has had no successful backup for this long, e.g. "26h"
+	MaxBackupAge string `yaml:"max_backup_age"`
+
+	// How many databases to dump at once. Defaults to 1, one after another.
+	Concurrency int `yaml:"concurrency"`
+
+	// Limit on simultaneous dumps from the same host when concurrency is above 1
+	MaxConcurrentPerHost int `yaml:"max_concurrent_per_host"`
+
+	// CPU and IO priority of dumps and compression
+	Resources ResourceLimits `yaml:"resources"`
+
+	// Buffer sizes and the memory uploads may use
+	Memory MemoryConfig `yaml:"memory"`
+
+	// Abort a backup run that takes longer than this, e.g. "4h"
+	MaxRunDuration string `yaml:"max_run_duration"`
+
+	// Abort a dump or upload that writes nothing for this long, e.g. "15m",
+	// so a frozen dump or stalled connection fails instead of hanging the run
+	StallTimeout string `yaml:"stall_timeout"`
+
+	// Dump databases that failed again at the end of the run, before archiving
+	RetryFailed RetryConfig `yaml:"retry_failed"`
+
+	// Limit on the total size of a run's dumps
+	SizeBudget BudgetConfig `yaml:"size_budget"`
+
+	// Unit prices to estimate each run's storage, request and transfer cost with
+	Cost CostConfig `yaml:"cost"`
+
+	// Move old archives in the primary bucket to a colder storage class
+	Tiering TieringConfig `yaml:"tiering"`
+
+	// How often to log progress of dumps and uploads, e.g. "30s". Set to "0" to disable.
+	ProgressInterval string `yaml:"progress_interval"`
+
+	// Limit restore downloads to this many bytes a second, e.g. "10M", for
+	// constrained links. Downloads resume after interruptions either way.
+	MaxDownloadRate string `yaml:"max_download_rate"`
+
+	// Where archives are built before upload. Defaults to a directory under the system temp dir.
+	TempDir string `yaml:"temp_dir"`
+
+	// Where dumps are written before they're archived, e.g. on a different
+	// volume to temp_dir. Defaults to "backups" in the working directory.
+	DumpDir string `yaml:"dump_dir"`
+
+	// Where run reports are kept. Defaults to "reports" in the working directory.
+	ReportsDir string `yaml:"reports_dir"`
+
+	// Delete files older than this from dump_dir and temp_dir on startup and
+	// after each run, e.g. "48h", as they were left by a run that crashed
+	StaleFileAge string `yaml:"stale_file_age"`
+
+	// Gzip MySQL dumps as they're written instead of writing raw SQL to disk first
+	CompressDumps bool `yaml:"compress_dumps"`
+
+	// Format of uploaded archives, "tar.gz" (the default) or "zip"
+	ArchiveFormat string `yaml:"archive_format"`
+
+	// Gzip level for archives and chunks, from 1 (fastest) to 9 (smallest). Defaults to 6.
+	CompressionLevel int `yaml:"compression_level"`
+
+	// Encrypt archives with a passphrase before they're uploaded
+	Encryption EncryptionConfig `yaml:"encryption"`
 
 	S3Config struct {
 		AccessKey    string `yaml:"access_key"`
-		AccessSecret string `yaml:"access_secret"`
+		AccessSecret Secret `yaml:"access_secret"`
+		SessionToken Secret `yaml:"session_token"`
 		Region       string `yaml:"region"`
 		Bucket       string `yaml:"bucket"`
+		Retention    string `yaml:"retention"`
+		RoleARN      string `yaml:"role_arn"`
+		ExternalID   string `yaml:"external_id"`
+		S3Overrides  `yaml:",inline"`
+		Endpoint     string `yaml:"endpoint"`
+
+		WebIdentity         string `yaml:"web_identity"`
+		WebIdentityAudience string `yaml:"web_identity_audience"`
+		WebIdentityClientID string `yaml:"web_identity_client_id"`
 	} `yaml:"s3_config"`
 
+	// Free-form labels, e.g. env: prod, added to reports, notifications, metrics and object tags
+	Labels map[string]string `yaml:"labels"`
+
+	// Identifies this machine in reports, manifests and object metadata
+	Agent AgentConfig `yaml:"agent"`
+
+	// Periods during which scheduled runs are skipped or deferred
+	Blackouts []BlackoutConfig `yaml:"blackouts"`
+
+	// Time zone blackouts are in, e.g. "Europe/London". Defaults to local time.
+	BlackoutTimezone string `yaml:"blackout_timezone"`
+
+	// Additional places to store each archive, alongside s3_config
+	Targets []TargetConfig `yaml:"targets"`
+
+	// Times a failed upload to a target is retried on its own, after the
+	// archive is streamed to every target at once. Defaults to 2, -1 for none.
+	UploadRetries int `yaml:"upload_retries"`
+
+	// Buckets the archive is copied to server-side from s3_config after upload
+	Replicas []TargetConfig `yaml:"replicas"`
+
+	Dedup struct {
+		Enabled bool   `yaml:"enabled"`
+		Prefix  string `yaml:"prefix"`
+	} `yaml:"dedup"`
+
+	Metrics struct {
+		Listen string `yaml:"listen"`
+
+		// Also export the storage used per database on each target, listed hourly
+		StorageUsage bool `yaml:"storage_usage"`
+	} `yaml:"metrics"`
+
+	// Backup freshness badges, served on /badge by the metrics server
+	Badge struct {
+		// Also upload badge.svg and status.json to every target after each
+		// run, for dashboards that can't reach the metrics server
+		Upload bool `yaml:"upload"`
+	} `yaml:"badge"`
+
+	Dashboard struct {
+		Listen   string `yaml:"listen"`
+		HTTPAuth `yaml:",inline"`
+	} `yaml:"dashboard"`
+
+	API struct {
+		Listen   string `yaml:"listen"`
+		HTTPAuth `yaml:",inline"`
+	} `yaml:"api"`
+
+	GRPC struct {
+		Listen   string `yaml:"listen"`
+		HTTPAuth `yaml:",inline"`
+	} `yaml:"grpc"`
+
+	// Go pprof endpoints for diagnosing performance, served only when listen is set
+	Debug struct {
+		Listen   string `yaml:"listen"`
+		HTTPAuth `yaml:",inline"`
+	} `yaml:"debug"`
+
+	Maintenance struct {
+		// How long SIGUSR1 pauses scheduled backups for, defaults to "4h"
+		SignalPause string `yaml:"signal_pause"`
+	} `yaml:"maintenance"`
+
+	Report struct {
+		Upload bool `yaml:"upload"`
+	} `yaml:"report"`
+
+	// Retention of the run reports kept in reports_dir
+	History HistoryConfig `yaml:"history"`
+
+	// Keys to sign run reports and manifests with, and check them on restore and audit
+	Signing SigningConfig `yaml:"signing"`
+
+	Notifications []NotifierConfig `yaml:"notifications"`
+
+	// Cron monitoring services told when runs start, complete and fail
+	Monitors []MonitorConfig `yaml:"monitors"`
+
 	Databases []DatabaseConfig `yaml:"databases"`
+
+	// Databases and files backed up together with the application paused
+	Groups []GroupConfig `yaml:"groups"`
+
+	// Where to fetch more databases from at the start of each run
+	Inventory InventoryConfig `yaml:"inventory"`
+
+	// Named sets of settings run side by side, each over a copy of the
+	// settings above, e.g. one per customer with its own bucket and schedule
+	Profiles map[string]yaml.Node `yaml:"profiles"`
+
+	// Files merged in before the one listing them, relative to it, so blocks
+	// shared by many sites are defined once, e.g. ["shared/*.yaml"]
+	Include []string `yaml:"include"`
+
+	// Values substituted for ${vars.name} in the values of the configuration files
+	Variables map[string]string `yaml:"variables"`
+
+	// The profile this config was loaded for, and every profile when loaded
+	// from a file that has them
+	profile  string
+	profiles []Config
+
+	// The stage of the run made to fail with --simulate-failure
+	simulateFailure string
+
+	// Restore archives whose integrity can't be verified, set by --insecure
+	insecureRestore bool
 }
 
 // File compression functions (https://www.arthurkoziel.com/writing-tar-gz-files-in-go/)
-func createArchive(files []string, buf io.Writer) error {
+func createArchive(ctx context.Context, files []string, buf io.Writer, level int) error {
 	// Create new Writers for gzip and tar
 	// These writers are chained. Writing to the tar writer will
 	// write to the gzip writer which in turn will write to
 	// the "buf" writer
-	gw := gzip.NewWriter(buf)
+	gw, err := gzip.NewWriterLevel(buf, level)
+	if err != nil {
+		return err
+	}
 	defer gw.Close()
 	tw := tar.NewWriter(gw)
 	defer tw.Close()
 
 	// Iterate over files and add them to the tar archive
-	for _, file := range files {
-		err := addToArchive(tw, file)
+	for _, entry := range archiveEntries(files) {
+		err := addToArchive(ctx, tw, entry.path, entry.name)
 		if err != nil {
 			return err
 		}
@@ -70,7 +421,52 @@ func createArchive(files []string, buf io.Writer) error {
 	return nil
 }
 
-func addToArchive(tw *tar.Writer, filename string) error {
+// Expand any directories in the list into the files they contain
+func expandFiles(files []string) []string {
+	expanded := []string{}
+
+	for _, file := range files {
+		filepath.Walk(file, func(path string, info os.FileInfo, err error) error {
+			if err != nil || !info.IsDir() {
+				// Errors are reported when the file is opened
+				expanded = append(expanded, path)
+			}
+			return nil
+		})
+	}
+
+	return expanded
+}
+
+// A file to add to an archive
+type archiveEntry struct {
+	path string
+
+	// Name inside the archive, relative to the directory holding the dump so
+	// extracting doesn't recreate it
+	name string
+}
+
+// Expand any directories in the list into the files they contain, along with
+// their names inside an archive
+func archiveEntries(files []string) []archiveEntry {
+	entries := []archiveEntry{}
+
+	for _, file := range files {
+		dir := filepath.Dir(file)
+		for _, path := range expandFiles([]string{file}) {
+			name, err := filepath.Rel(dir, path)
+			if err != nil {
+				name = filepath.Base(path)
+			}
+			entries = append(entries, archiveEntry{path: path, name: filepath.ToSlash(name)})
+		}
+	}
+
+	return entries
+}
+
+func addToArchive(ctx context.Context, tw *tar.Writer, filename string, name string) error {
 	// Open the file which will be written into the archive
 	file, err := os.Open(filename)
 	if err != nil {
@@ -84,243 +480,1412 @@ func addToArchive(tw *tar.Writer, filename string) error {
 		return err
 	}
 
-	// Create a tar Header from the FileInfo data
-	header, err := tar.FileInfoHeader(info, info.Name())
-	if err != nil {
-		return err
+	// Build the header by hand rather than with FileInfoHeader so nothing about
+	// the local machine (owner names, uid/gid) ends up in the archive. PAX
+	// handles names over 100 characters and keeps sub-second mod times.
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Size:     info.Size(),
+		Mode:     int64(info.Mode().Perm()),
+		ModTime:  info.ModTime(),
+		Format:   tar.FormatPAX,
 	}
 
-	// Use full path as name (FileInfoHeader only takes the basename)
-	// If we don't do this the directory strucuture would
-	// not be preserved
-	// https://golang.org/src/archive/tar/common.go?#L626
-	header.Name = filename
-
 	// Write file header to the tar archive
 	err = tw.WriteHeader(header)
 	if err != nil {
 		return err
 	}
 
-	// Copy file content to tar archive
-	_, err = io.Copy(tw, file)
+	// Copy file content to tar archive, stopping if the run is cancelled
+	adviseSequential(file)
+	_, err = copyBuffered(tw, &contextReader{ctx: ctx, reader: file})
 	if err != nil {
 		return err
 	}
+	dropPageCache(file)
 
 	return nil
 }
 
-// Entrypoint
-func main() {
-	// Check if mysqldump is installed
-	cmd := exec.Command("mysqldump", "--help")
-	_, err := cmd.Output()
+// Get the progress logging interval, defaulting to 30 seconds
+func (config Config) progressInterval() time.Duration {
+	if config.ProgressInterval == "" {
+		return 30 * time.Second
+	}
 
+	interval, err := time.ParseDuration(config.ProgressInterval)
 	if err != nil {
-		log.Fatalf("Error running mysqldump: %s\n", err.Error())
-		return
+		return 30 * time.Second
 	}
 
-	// Load the configuration file
-	log.Println("Loading configuration file...")
-	config := Config{}
+	return interval
+}
 
-	configFile, err := os.ReadFile("config.yaml")
-	if err != nil {
-		log.Fatalf("Error reading configuration file: %s\n", err.Error())
-		return
+// Get the longest a backup run may take, or 0 for no limit
+func (config Config) maxRunDuration() time.Duration {
+	if config.MaxRunDuration == "" {
+		return 0
 	}
 
-	// Parse the configuration file
-	err = yaml.Unmarshal(configFile, &config)
+	limit, err := parseDuration(config.MaxRunDuration)
 	if err != nil {
-		log.Fatalf("Error parsing configuration file: %s\n", err.Error())
-		return
+		return 0
 	}
 
-	// Create the backup directory if it doesn't exist
-	if _, err := os.Stat("backups"); os.IsNotExist(err) {
-		log.Printf("Backup directory not found! Creating backup directory.\n")
-		os.Mkdir("backups", 0755)
+	return limit
+}
+
+// Format a time for use in file names and object keys. With a timezone set
+// names are in that zone and carry its offset.
+func (config Config) timestamp(t time.Time) string {
+	if config.Timezone == "" {
+		return t.Format("2006-01-02_15-04-05")
 	}
 
-	// Create the temp directory if it doesn't exist
-	if _, err := os.Stat("temp"); os.IsNotExist(err) {
-		log.Printf("Temp directory not found! Creating temp directory.\n")
-		os.Mkdir("temp", 0755)
+	location, err := time.LoadLocation(config.Timezone)
+	if err != nil {
+		log.Printf("Invalid timezone %q, using UTC: %s\n", config.Timezone, err.Error())
+		location = time.UTC
 	}
 
-	if len(os.Args) > 1 {
-		if (os.Args[1] == "--test") || (os.Args[1] == "-t") {
-			log.Println("Running backup job to test configuration")
-			runBackups(config)
-			return
-		} else {
-			log.Println("Unrecognised argument(s)")
-			return
-		}
+	return t.In(location).Format("20060102T150405-0700")
+}
+
+// Check whether the command line runs backups, scheduled or otherwise
+func backupCommand(args []string) bool {
+	if len(args) == 0 {
+		return true
 	}
-	// Create the cron job to run backups at the specified interval
-	log.Println("Starting cronjob to run backups")
 
-	c := cron.New()
-	c.AddFunc(config.CronInterval, func() {
-		runBackups(config)
-	})
-	go c.Start()
+	switch args[0] {
+	case "--test", "-t", "--once", "backup", "serve":
+		return true
+	}
 
-	// Wait for signal to exit
-	sig := make(chan os.Signal)
-	signal.Notify(sig, os.Interrupt, os.Kill)
-	<-sig
+	return false
 }
 
-func runBackups(config Config) {
-	log.Println("Starting backup jobs")
+// Check whether the command line runs the dump tools, as backups and seeding do
+func dumpingCommand(args []string) bool {
+	return backupCommand(args) || args[0] == "seed"
+}
 
-	backupStartTimestamp := time.Now().Format("2006-01-02_15-04-05")
+// Entrypoint
+func main() {
+	if onceMode() {
+		log.SetOutput(os.Stdout)
+	}
 
-	// Delete the files in the temp directory
-	log.Println("Deleting temp files")
+	// Passwords and tokens are kept out of logs, errors and crash output
+	redactLogs()
+	defer redactPanic()
 
-	err := os.Remove("./temp/backup.tar.gz")
-	if err != nil {
-		log.Printf("Error deleting file %s: %s\n", "./temp/backup.tar.gz", err.Error())
+	if len(os.Args) > 1 && os.Args[1] == "version" {
+		fmt.Println(versionString())
+		return
 	}
 
-	// Loop through each database and run a backup
-	files := []string{}
+	if len(os.Args) > 1 && os.Args[1] == "self-update" {
+		err := runSelfUpdate(os.Args[2:])
+		if err != nil {
+			fatal(exitCode(err), "Error updating: %s\n", err.Error())
+		}
+		return
+	}
 
-	for _, db := range config.Databases {
-		if db.DBName != "" {
-			db.DBNames = append(db.DBNames, db.DBName)
+	if len(os.Args) > 1 && os.Args[1] == "completion" {
+		err := runCompletion(os.Args[2:])
+		if err != nil {
+			fatal(exitCode(err), "%s\n", err.Error())
 		}
+		return
+	}
 
-		for _, dbName := range db.DBNames {
-			log.Printf("Backing up %s database %s on host %s\n", db.Engine, dbName, db.Host)
+	if len(os.Args) > 1 && os.Args[1] == "gen-docs" {
+		err := runGenDocs(os.Args[2:])
+		if err != nil {
+			fatal(exitCode(err), "Error generating docs: %s\n", err.Error())
+		}
+		return
+	}
 
-			backupTime := time.Now().Format("2006-01-02_15-04-05")
+	// Generating a config doesn't need an existing one
+	if len(os.Args) > 1 && os.Args[1] == "init" {
+		err := runInit(os.Args[2:])
+		if err != nil {
+			fatal(exitCode(err), "Error creating configuration: %s\n", err.Error())
+		}
+		return
+	}
 
-			exportName := fmt.Sprintf("%s_%s_on_%s_%s", backupTime, db.Engine, db.Host, dbName)
+	// Load the configuration file
+	configPath := findConfigFile()
+	if os.Getenv(configDataVariable) != "" {
+		log.Printf("Loading configuration from %s...\n", configDataVariable)
+	} else if url := os.Getenv(remoteConfigURLVariable); url != "" {
+		replaceSecret("", os.Getenv(remoteConfigTokenVariable))
+		log.Printf("Loading configuration from %s...\n", url)
+	} else {
+		log.Printf("Loading configuration file %s...\n", configPath)
+	}
 
-			if (db.Engine == "mariadb") || (db.Engine == "mysql") {
-				if dbName == "*" {
-					dbName = "--all-databases"
-					exportName = fmt.Sprintf("%s_%s_all-databases", backupTime, db.Host)
-				}
+	config, err := loadConfig(configPath)
+	if err != nil {
+		fatal(exitConfig, "%s\n", err.Error())
+	}
+	registerSecrets(config)
+	for _, profile := range config.profiles {
+		registerSecrets(profile)
+	}
+
+	// Resource limits apply to the whole process, so come from the top level
+	err = applyResourceLimits(config.Resources)
+	if err != nil {
+		fatal(exitConfig, "Error applying resource limits: %s\n", err.Error())
+	}
+	err = applyMemoryLimits(config.Memory)
+	if err != nil {
+		fatal(exitConfig, "Error applying memory limits: %s\n", err.Error())
+	}
 
-				hostArg := fmt.Sprintf("--host=%s", db.Host)
-				portArg := fmt.Sprintf("--port=%d", db.Port)
-				usernameArg := fmt.Sprintf("--user=%s", db.Username)
-				passwordArg := fmt.Sprintf("--password=%s", db.Password)
-				outputArg := fmt.Sprintf("--result-file=./backups/%s.sql", exportName)
+	// Every profile is scheduled, unless DBBACKUP_PROFILE picks one
+	profiles, err := config.selectProfiles(os.Getenv("DBBACKUP_PROFILE"))
+	if err != nil {
+		fatal(exitConfig, "%s\n", err.Error())
+	}
 
-				files = append(files, fmt.Sprintf("backups/%s.sql", exportName))
+	// Only the commands that dump need the engines' client tools installed
+	if dumpingCommand(os.Args[1:]) {
+		err := checkClientTools(profiles)
+		if err != nil {
+			fatal(exitConfig, "%s\n", err.Error())
+		}
+	}
 
-				// TODO: Check if --column-statistics=0 is needed (Needed on MySQL 8.0.17+, flag not available in MariaDB mysqldump)
-				cmd := exec.Command("mysqldump", hostArg, portArg, usernameArg, passwordArg, outputArg, "--extended-insert", "--single-transaction=TRUE", dbName)
-				_, err := cmd.Output()
+	for _, profile := range profiles {
+		createDirectories(profile)
+		restoreHistory(context.Background(), profile)
 
-				if err != nil {
-					log.Printf("Error running backup: %s\n", err.Error())
-					continue
-				}
-			} else if db.Engine == "mongodb" {
-				dbArg := fmt.Sprintf("--db=%s", dbName)
-				if dbName == "*" {
-					dbArg = ""
-					exportName = fmt.Sprintf("%s_%s_all-databases", backupTime, db.Host)
-				}
+		// Deletions and restores must not run without being audited
+		if err := checkAuditLog(profile); err != nil {
+			fatal(exitConfig, "%s\n", err.Error())
+		}
 
-				hostArg := fmt.Sprintf("--host=%s", db.Host)
-				portArg := fmt.Sprintf("--port=%d", db.Port)
-				usernameArg := fmt.Sprintf("--user=%s", db.Username)
-				passwordArg := fmt.Sprintf("--password=%s", db.Password)
-				outputArg := fmt.Sprintf("--out=./backups/%s", exportName)
+		// Remove anything left behind by runs that crashed or were killed,
+		// before starting new ones. Other commands leave it to those.
+		if backupCommand(os.Args[1:]) {
+			recoverCrashedRun(context.Background(), profile)
+			sweepStaleFiles(profile, "cleanup")
+		}
+	}
 
-				files = append(files, fmt.Sprintf("backups/%s.gz", exportName))
+	// Cancelled on Ctrl-C or SIGTERM, stopping any running dumps and transfers
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Schedules of every profile are listed together
+	if len(os.Args) > 1 && os.Args[1] == "schedule" {
+		err := runSchedule(profiles, os.Args[2:])
+		if err != nil {
+			fatal(exitCode(err), "Error listing schedules: %s\n", err.Error())
+		}
+		return
+	}
 
-				cmd := exec.Command("mongodump", hostArg, portArg, usernameArg, passwordArg, dbArg, outputArg, "--gzip")
-				_, err := cmd.Output()
+	if len(os.Args) > 1 {
+		// Commands act on a single profile
+		if len(profiles) > 1 {
+			names := []string{}
+			for _, profile := range profiles {
+				names = append(names, profile.profile)
+			}
+			fatal(exitConfig, "Set DBBACKUP_PROFILE to one of %s\n", strings.Join(names, ", "))
+		}
+		config = profiles[0]
 
-				if err != nil {
-					log.Printf("Error running backup: %s\n", err.Error())
-					continue
+		if (os.Args[1] == "--test") || (os.Args[1] == "-t") {
+			log.Println("Running backup job to test configuration")
+			report := runBackups(ctx, config, commandTrigger())
+			if report == nil {
+				os.Exit(exitLocked)
+			}
+			os.Exit(report.exitCode())
+		} else if os.Args[1] == "--once" {
+			report, err := runOnce(ctx, config, os.Args[2:])
+			if err != nil {
+				fatal(exitCode(err), "Error starting backup: %s\n", err.Error())
+			}
+			if report == nil {
+				os.Exit(exitLocked)
+			}
+			os.Exit(report.exitCode())
+		} else if os.Args[1] == "backup" {
+			report, err := runBackupCommand(ctx, config, os.Args[2:])
+			if err != nil {
+				fatal(exitCode(err), "Error starting backup: %s\n", err.Error())
+			}
+			if report == nil {
+				os.Exit(exitLocked)
+			}
+			os.Exit(report.exitCode())
+		} else if os.Args[1] == "serve" {
+			if config.Debug.Listen != "" {
+				go serveDebug(config)
+			}
+			if config.GRPC.Listen != "" {
+				if config.API.Listen == "" {
+					serveGRPC(ctx, config)
+					return
 				}
+				go serveGRPC(ctx, config)
+			}
+			serveAPI(ctx, config)
+			return
+		} else if os.Args[1] == "history" {
+			err := runHistory(config, os.Args[2:])
+			if err != nil {
+				fatal(exitCode(err), "Error exporting history: %s\n", err.Error())
+			}
+			return
+		} else if os.Args[1] == "decrypt" {
+			err := runDecrypt(config, os.Args[2:])
+			if err != nil {
+				fatal(exitCode(err), "Error decrypting archive: %s\n", err.Error())
+			}
+			return
+		} else if os.Args[1] == "search" {
+			err := runSearch(ctx, config, os.Args[2:])
+			if err != nil {
+				fatal(exitCode(err), "Error searching backups: %s\n", err.Error())
+			}
+			return
+		} else if os.Args[1] == "restore" {
+			err := runRestore(ctx, config, os.Args[2:])
+			if err != nil {
+				fatal(exitCode(err), "Error restoring backup: %s\n", err.Error())
+			}
+			return
+		} else if os.Args[1] == "monitor" {
+			err := runMonitor(ctx, config)
+			if err != nil {
+				fatal(exitCode(err), "Error monitoring backups: %s\n", err.Error())
+			}
+			return
+		} else if os.Args[1] == "tier" {
+			err := runTier(ctx, config, os.Args[2:])
+			if err != nil {
+				fatal(exitCode(err), "Error tiering archives: %s\n", err.Error())
+			}
+			return
+		} else if os.Args[1] == "usage" {
+			err := runUsage(ctx, config, os.Args[2:])
+			if err != nil {
+				fatal(exitCode(err), "Error collecting storage usage: %s\n", err.Error())
 			}
+			return
+		} else if os.Args[1] == "audit" {
+			err := runStorageAudit(ctx, config, os.Args[2:])
+			if err != nil {
+				fatal(exitCode(err), "Error auditing storage: %s\n", err.Error())
+			}
+			return
+		} else if os.Args[1] == "prune" {
+			err := runPrune(ctx, config, os.Args[2:])
+			if err != nil {
+				fatal(exitCode(err), "Error pruning: %s\n", err.Error())
+			}
+			return
+		} else if os.Args[1] == "gc" {
+			err := runGC(ctx, config, os.Args[2:])
+			if err != nil {
+				fatal(exitCode(err), "Error collecting garbage: %s\n", err.Error())
+			}
+			return
+		} else if os.Args[1] == "pause" {
+			err := runPause(config, os.Args[2:])
+			if err != nil {
+				fatal(exitCode(err), "Error pausing backups: %s\n", err.Error())
+			}
+			return
+		} else if os.Args[1] == "resume" {
+			err := runResume(config)
+			if err != nil {
+				fatal(exitCode(err), "Error resuming backups: %s\n", err.Error())
+			}
+			return
+		} else if os.Args[1] == "seed" {
+			err := runSeed(ctx, config, os.Args[2:])
+			if err != nil {
+				fatal(exitCode(err), "Error seeding replica: %s\n", err.Error())
+			}
+			return
+		} else if os.Args[1] == "rekey" {
+			err := runRekey(ctx, config, os.Args[2:])
+			if err != nil {
+				fatal(exitCode(err), "Error re-encrypting backups: %s\n", err.Error())
+			}
+			return
+		} else {
+			fatal(exitFailure, "Unrecognised argument(s)\n")
 		}
 	}
+	log.Println(versionString())
 
-	// Tar and gzip the backup directory
-	log.Println("Compressing backup files")
-
-	// Create output file
-	out, err := os.Create("./temp/backup.tar.gz")
-	if err != nil {
-		log.Fatalln("Error writing archive:", err)
+	// Profiling covers the whole process, so comes from the top level
+	if config.Debug.Listen != "" {
+		go serveDebug(config)
 	}
-	defer out.Close()
 
-	// Create the archive and write the output to the "out" Writer
-	err = createArchive(files, out)
-	if err != nil {
-		log.Fatalln("Error creating archive:", err)
+	crons := []*cron.Cron{}
+	for _, profile := range profiles {
+		checkLifecycles(ctx, profile)
+		crons = append(crons, schedule(ctx, profile))
 	}
+	go watchPauseSignals(ctx, profiles)
 
-	log.Println("Compressed backup files")
+	// Wait for signal to exit, or for the central configuration to change
+	restart := false
+	select {
+	case <-ctx.Done():
+		log.Println("Shutting down")
+	case <-watchRemoteConfig(ctx, configPath):
+		log.Println("Restarting to load the new configuration once running backups finish")
+		restart = true
+	}
+	for _, c := range crons {
+		c.Stop()
+	}
 
-	// Upload to S3
-	log.Println("Uploading to S3")
+	// Wait for running backups to stop their dumps and uploads and clean up
+	for _, profile := range profiles {
+		profile.runMutex().Lock()
+	}
 
-	// Create S3 client
-	sess, err := session.NewSession(&aws.Config{
-		Credentials: credentials.NewStaticCredentials(config.S3Config.AccessKey, config.S3Config.AccessSecret, ""),
-		Region:      aws.String(config.S3Config.Region),
-	})
+	if restart {
+		err := restartProcess()
+		fatal(exitFailure, "Error restarting: %s\n", err.Error())
+	}
+}
 
-	if err != nil {
-		log.Fatalf("Error creating S3 session: %s\n", err.Error())
-		return
+// Create the dump, reports and temp directories if they don't exist
+func createDirectories(config Config) {
+	if _, err := os.Stat(config.DumpDir); os.IsNotExist(err) {
+		log.Printf("Backup directory not found! Creating backup directory.\n")
+		os.MkdirAll(config.DumpDir, 0755)
 	}
 
-	uploader := s3manager.NewUploader(sess)
+	if _, err := os.Stat(config.ReportsDir); os.IsNotExist(err) {
+		log.Printf("Reports directory not found! Creating reports directory.\n")
+		os.MkdirAll(config.ReportsDir, 0755)
+	}
 
-	// Open the file for use
-	file, err := os.Open("./temp/backup.tar.gz")
-	if err != nil {
-		log.Fatalf("Error opening file %s: %s\n", "./temp/backup.tar.gz", err.Error())
-		return
+	if _, err := os.Stat(config.TempDir); os.IsNotExist(err) {
+		log.Printf("Temp directory not found! Creating temp directory.\n")
+		os.MkdirAll(config.TempDir, 0755)
 	}
-	defer file.Close()
+}
 
-	// Upload the file to S3
-	_, err = uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(config.S3Config.Bucket),
-		Key:    aws.String(fmt.Sprintf("sql_backup_at_%s.tar.gz", backupStartTimestamp)),
-		Body:   file,
+// Start the cron jobs and servers for a config. The returned cron is stopped
+// on shutdown.
+func schedule(ctx context.Context, config Config) *cron.Cron {
+	// Create the cron job to run backups at the specified interval
+	if config.profile != "" {
+		log.Printf("Starting cronjob to run backups for profile %s\n", config.profile)
+	} else {
+		log.Println("Starting cronjob to run backups")
+	}
+
+	c := cron.New()
+	addPersistentJob(c, config, "backup", config.CronInterval, func() {
+		runScheduled(ctx, config)
 	})
+	scheduleDigests(ctx, c, config)
+	if config.Tiering.enabled() {
+		addPersistentJob(c, config, "tiering", config.Tiering.Schedule, func() {
+			moved, err := tierArchives(ctx, config, false, "scheduled")
+			if err != nil {
+				log.Printf("Error tiering archives: %s\n", err.Error())
+			} else if moved > 0 {
+				log.Printf("Moved %d archives to %s\n", moved, config.Tiering.StorageClass)
+			}
+		})
+	}
+	go c.Start()
+
+	for _, notifier := range config.Notifications {
+		if notifier.QuietHours != "" {
+			go flushDeferredNotifications(ctx, config)
+			break
+		}
+	}
+
+	if config.Dashboard.Listen != "" {
+		go serveDashboard(ctx, config)
+	}
 
+	if config.GRPC.Listen != "" {
+		go serveGRPC(ctx, config)
+	}
+
+	if config.Metrics.Listen != "" {
+		go serveMetrics(config)
+	}
+
+	if config.MaxBackupAge != "" {
+		go watchFreshness(ctx, config, loadLocalReports(config))
+	} else {
+		for _, db := range config.Databases {
+			if db.MaxBackupAge != "" {
+				go watchFreshness(ctx, config, loadLocalReports(config))
+				break
+			}
+		}
+	}
+
+	return c
+}
+
+// Check whether a backup run is currently in progress for the config's profile
+func backupRunning(config Config) bool {
+	mutex := config.runMutex()
+	if mutex.TryLock() {
+		mutex.Unlock()
+		return runLocked(config)
+	}
+
+	return true
+}
+
+// Run a backup of every configured database. Returns nil if another run is
+// already in progress. Cancelling the context stops the run.
+func runBackups(parent context.Context, config Config, trigger string) *RunReport {
+	// Only allow one backup run at a time
+	mutex := config.runMutex()
+	if !mutex.TryLock() {
+		log.Println("Backup already running, skipping")
+		return nil
+	}
+	defer mutex.Unlock()
+
+	// Runs started by other processes write to the same directories
+	unlock, ok := lockRun(config)
+	if !ok {
+		return nil
+	}
+	defer unlock()
+
+	// Recorded until the run finishes, for cleaning up after it if it doesn't
+	beginRunState(config)
+	defer endRunState(config)
+
+	// Abort the run, killing dumps and uploads, if it goes past max_run_duration
+	ctx := parent
+	if limit := config.maxRunDuration(); limit > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(parent, limit)
+		defer cancel()
+	}
+
+	if config.profile != "" {
+		log.Printf("Starting backup jobs for profile %s\n", config.profile)
+	} else {
+		log.Println("Starting backup jobs")
+	}
+
+	report := &RunReport{
+		StartedAt: time.Now(),
+		Version:   version,
+		Profile:   config.profile,
+		Labels:    config.Labels,
+		Agent:     config.agentInfo(),
+		Bucket:    config.S3Config.Bucket,
+		Databases: []DatabaseReport{},
+		Simulated: config.simulateFailure,
+	}
+	backupStartTimestamp := config.timestamp(report.StartedAt)
+
+	sendNotification(ctx, config, Notification{
+		Event:   "backup.started",
+		Subject: "Backup started",
+		Time:    report.StartedAt,
+		Report:  report,
+	})
+	pingMonitors(ctx, config, "run", report)
+
+	// Always write the run report and notify, whichever way the run ends
+	defer func() {
+		report.Cancelled = parent.Err() != nil
+		if !report.Cancelled && ctx.Err() == context.DeadlineExceeded {
+			log.Printf("Backup run exceeded max_run_duration of %s\n", config.MaxRunDuration)
+			report.TimedOut = true
+			report.Error = fmt.Sprintf("exceeded max_run_duration of %s", config.MaxRunDuration)
+		}
+		report.finish()
+		report.Cost = estimateCost(config, report)
+		logCost(report.Cost)
+		sweepStaleFiles(config, "cleanup")
+
+		var previous *RunReport
+		if reports, err := loadReports(config.ReportsDir); err == nil {
+			previous = latestRun(reports)
+		}
+		// The run's context may already be cancelled, but the result still needs sending
+		sendNotification(context.Background(), config, runNotification(report, previous))
+		sendHeartbeat(context.Background(), config, report)
+		finishMonitors(context.Background(), config, report)
+
+		reportPath := filepath.Join(config.ReportsDir, fmt.Sprintf("report_%s.json", backupStartTimestamp))
+		err := writeReport(report, reportPath)
+		if err != nil {
+			log.Printf("Error writing report %s: %s\n", reportPath, err.Error())
+			return
+		}
+
+		err = signFile(config, reportPath)
+		if err != nil {
+			log.Printf("Error signing report %s: %s\n", reportPath, err.Error())
+		}
+
+		if config.Report.Upload && report.ArchiveKey != "" {
+			uploadToTargets(parent, config, reportPath, fmt.Sprintf("sql_backup_at_%s.report.json", backupStartTimestamp), false)
+			if config.Signing.PrivateKey != "" {
+				uploadToTargets(parent, config, reportPath+signatureExtension, fmt.Sprintf("sql_backup_at_%s.report.json%s", backupStartTimestamp, signatureExtension), false)
+			}
+		}
+
+		mirrorReport(parent, config, reportPath)
+		pruneHistory(parent, config, trigger)
+
+		if config.Badge.Upload {
+			uploadBadges(parent, config)
+		}
+	}()
+
+	// Databases from an inventory are looked up again for every run
+	config, err := withInventory(ctx, config)
 	if err != nil {
-		log.Fatalf("Error uploading file to S3: %s\n", err.Error())
-		return
+		log.Printf("%s\n", err.Error())
+		report.Error = err.Error()
+		report.preDumpExit = exitConfig
+		return report
+	}
+
+	// Fail now rather than after hours of dumping if the credentials are
+	// invalid, expired or would expire before the upload
+	var previous *RunReport
+	if reports, err := loadReports(config.ReportsDir); err == nil {
+		previous = latestRun(reports)
+	}
+	err = checkCredentials(ctx, config, expectedRunDuration(config, previous))
+	if err != nil {
+		log.Printf("Error checking credentials: %s\n", err.Error())
+		report.Error = err.Error()
+		report.preDumpExit = exitConfig
+		return report
+	}
+
+	// Fail now rather than part way through if the dumps or archive won't fit
+	err = checkStagingSpace(config, previous)
+	if err != nil {
+		log.Printf("Error checking free space: %s\n", err.Error())
+		report.Error = err.Error()
+		report.preDumpExit = exitDump
+		return report
 	}
 
-	log.Println("Successfully uploaded backup to S3")
+	// Previous runs are needed to detect unchanged databases, plan differentials and report schema drift
+	previousReports := []RunReport{}
+	for _, db := range config.Databases {
+		if db.ChangeDetection != "" || db.FullBackupInterval != "" || db.SchemaDrift {
+			previousReports, err = loadReports(config.ReportsDir)
+			if err != nil {
+				log.Printf("Error loading previous reports: %s\n", err.Error())
+			}
+			break
+		}
+	}
+
+	// Queue every database to back up, keeping groups' members apart
+	files := []string{}
+	queue := []queuedDump{}
+	grouped := map[string][]queuedDump{}
+	dumpStarted := time.Now()
+
+	for _, db := range config.Databases {
+		if db.DBName != "" {
+			db.DBNames = append(db.DBNames, db.DBName)
+		}
+
+		if db.CaptureServerConfig && (db.Engine == "mariadb" || db.Engine == "mysql") {
+			log.Printf("Capturing server configuration of %s\n", db.Host)
+			files = append(files, captureServerConfig(db, config.DumpDir, config.timestamp(time.Now()))...)
+		}
+
+		for _, dbName := range db.DBNames {
+			if db.Group != "" {
+				grouped[db.Group] = append(grouped[db.Group], queuedDump{db: db, dbName: dbName})
+			} else {
+				queue = append(queue, queuedDump{db: db, dbName: dbName})
+			}
+		}
+	}
+
+	// Databases are dumped in priority order, so the most important are
+	// backed up if the run is cut short. Ungrouped databases more important
+	// than a group's members go before it.
+	sortByPriority(queue)
+	ungrouped, ungroupedFiles := []DatabaseReport{}, []string{}
+	next := 0
+
+	// Groups aren't retried, as a retry wouldn't run between their hooks
+	for _, group := range groupsByPriority(config.Groups, grouped) {
+		if ctx.Err() != nil {
+			break
+		}
+
+		end := next
+		for end < len(queue) && queue[end].db.Priority > grouped[group.Name][0].db.Priority {
+			end++
+		}
+		if end > next {
+			dbReports, dumpFiles := runDumps(ctx, config, queue[next:end], previousReports, trigger)
+			ungrouped = append(ungrouped, dbReports...)
+			ungroupedFiles = append(ungroupedFiles, dumpFiles...)
+			next = end
+		}
+
+		dbReports, dumpFiles := runGroup(ctx, config, group, grouped[group.Name], previousReports, trigger)
+		report.Databases = append(report.Databases, dbReports...)
+		files = append(files, dumpFiles...)
+	}
+
+	dbReports, dumpFiles := runDumps(ctx, config, queue[next:], previousReports, trigger)
+	ungrouped = append(ungrouped, dbReports...)
+	ungroupedFiles = append(ungroupedFiles, dumpFiles...)
+	ungrouped, ungroupedFiles = retryFailedDumps(ctx, config, queue, ungrouped, ungroupedFiles, previousReports, trigger)
+	report.Databases = append(report.Databases, ungrouped...)
+	files = append(files, ungroupedFiles...)
+
+	var dumpedBytes int64
+	for _, db := range report.Databases {
+		dumpedBytes += db.SizeBytes
+	}
+	report.recordPhase("dump", dumpStarted, dumpedBytes)
+
+	if limit := sizeLimit(config.SizeBudget.MaxTotalSize); limit > 0 && dumpedBytes > limit {
+		report.OverBudget = fmt.Sprintf("dumps total %s, over max_total_size of %s", formatBytes(dumpedBytes), config.SizeBudget.MaxTotalSize)
+		log.Printf("Backup run %s\n", report.OverBudget)
+
+		if config.SizeBudget.aborts() {
+			report.Error = report.OverBudget
+			for _, file := range files {
+				os.RemoveAll(file)
+			}
+			return report
+		}
+	}
+
+	if ctx.Err() != nil {
+		log.Printf("Backup run stopped: %s\n", ctx.Err().Error())
+		report.Error = fmt.Sprintf("stopped: %s", ctx.Err().Error())
+		for _, file := range files {
+			os.RemoveAll(file)
+		}
+		return report
+	}
+
+	if err = config.simulatedFailure("upload"); err != nil {
+		log.Printf("Error uploading backup: %s\n", err.Error())
+	} else if config.Dedup.Enabled {
+		err = uploadDeduplicated(ctx, config, files, report, backupStartTimestamp)
+	} else {
+		err = archiveAndUpload(ctx, config, files, report, backupStartTimestamp, dumpedBytes, trigger)
+	}
+
+	if err != nil {
+		report.Error = err.Error()
+		return report
+	}
+
+	report.Uploaded = true
+
+	log.Println("Successfully uploaded backup")
+
+	if len(config.Replicas) > 0 && !config.Dedup.Enabled {
+		replicateStarted := time.Now()
+		report.Replicas = replicateArchive(ctx, config, report.ArchiveKey, report.ArchiveSizeBytes)
+		report.recordPhase("replicate", replicateStarted, report.ArchiveSizeBytes*int64(len(report.Replicas)))
+	}
+
+	// Remove backups that have outlived each target's retention
+	pruneStarted := time.Now()
+	for _, target := range config.targets() {
+		if target.Retention != "" {
+			err := pruneTarget(ctx, config, target, trigger, false)
+			if err != nil {
+				log.Printf("%s\n", err.Error())
+			}
+		}
+	}
+	report.recordPhase("prune", pruneStarted, 0)
 
 	// Delete the files in the backup directory
 	log.Println("Deleting backup files")
 
 	for _, file := range files {
-		err := os.Remove(file)
+		err := os.RemoveAll(file)
 		if err != nil {
 			log.Printf("Error deleting file %s: %s\n", file, err.Error())
 		}
+		auditLog(config, "delete_local", file, trigger, err)
+	}
+
+	return report
+}
+
+// Dump a single database, returning its report and the file to add to the
+// archive, or "" if there's nothing to add. When the database is discovered or
+// has try_all_addresses set, each instance is tried until one succeeds.
+func backupDatabase(ctx context.Context, config Config, db DatabaseConfig, dbName string, previousReports []RunReport, trigger string) (DatabaseReport, string) {
+	instances, err := db.candidates(ctx)
+	if err == nil {
+		err = config.simulatedFailure("dump")
+	}
+	if err != nil {
+		log.Printf("Error finding %s: %s\n", db.Host, err.Error())
+		return DatabaseReport{Engine: db.Engine, Host: db.Host, Name: dbName, Labels: mergeLabels(config.Labels, db.Labels), Notify: db.Notify, Group: db.Group, StartedAt: time.Now(), Error: err.Error()}, ""
+	}
+
+	var dbReport DatabaseReport
+	var file string
+
+	for i, instance := range instances {
+		dbReport, file = backupDatabaseAt(ctx, config, instance, dbName, previousReports, trigger)
+
+		if dbReport.Success || ctx.Err() != nil || i == len(instances)-1 {
+			break
+		}
+
+		log.Printf("Backup of %s on %s failed using %s, trying %s\n", dbName, db.Host, instance.hostPort(), instances[i+1].hostPort())
 	}
 
-	// Make a HTTP request to the heartbeat URI to let the server know we're still alive
-	if config.HeartbeatUri != "" {
-		log.Println("Sending heartbeat")
-		http.Get(config.HeartbeatUri)
+	return dbReport, file
+}
+
+// Dump a single database using the address set on the config, if any
+func backupDatabaseAt(ctx context.Context, config Config, db DatabaseConfig, dbName string, previousReports []RunReport, trigger string) (DatabaseReport, string) {
+	log.Printf("Backing up %s database %s on host %s\n", db.Engine, dbName, db.Host)
+
+	// Cancelled to stop a dump that goes over its max_size
+	ctx, cancelDump := context.WithCancel(ctx)
+	defer cancelDump()
+
+	dbReport := DatabaseReport{
+		Engine:    db.Engine,
+		Host:      db.Host,
+		Name:      dbName,
+		Labels:    mergeLabels(config.Labels, db.Labels),
+		Notify:    db.Notify,
+		Group:     db.Group,
+		StartedAt: time.Now(),
 	}
+
+	backupTime := config.timestamp(dbReport.StartedAt)
+
+	exportName := fmt.Sprintf("%s_%s_on_%s_%s", backupTime, db.Engine, db.Host, dbName)
+
+	var exportFile string
+	var cmd *exec.Cmd
+
+	// Engines that need more than a single command set dump instead of cmd
+	var dump func() error
+
+	if db.TableExport.Only && (db.Engine == "mariadb" || db.Engine == "mysql") {
+		// Only the tables are exported, there's no dump to restore from
+		dbReport.Kind = "table_export"
+		exportFile = filepath.Join(config.DumpDir, exportName+"."+db.TableExport.Format)
+		name := dbName
+		dump = func() error {
+			return exportTables(ctx, config, db, name, exportFile)
+		}
+	} else if (db.Engine == "mariadb") || (db.Engine == "mysql") {
+		// Skip the dump if nothing has changed since the previous backup
+		if db.ChangeDetection != "" && dbName != "*" {
+			fingerprint, err := databaseFingerprint(db, dbName)
+			if err != nil {
+				log.Printf("Error detecting changes, running full dump: %s\n", err.Error())
+			} else {
+				dbReport.Fingerprint = fingerprint
+
+				previous, ref, ok := previousFingerprint(previousReports, db.Engine, db.Host, dbName)
+				if ok && previous == fingerprint {
+					log.Printf("Database %s on host %s is unchanged, referencing %s\n", dbName, db.Host, ref.ArchiveKey)
+
+					refFile := filepath.Join(config.DumpDir, exportName+".ref.json")
+					err = writeReference(refFile, ref)
+					if err == nil {
+						dbReport.File = refFile
+						dbReport.Skipped = true
+						dbReport.Reference = &ref
+						dbReport.Success = true
+						dbReport.DurationSeconds = time.Since(dbReport.StartedAt).Seconds()
+						return dbReport, refFile
+					}
+
+					log.Printf("Error writing reference, running full dump: %s\n", err.Error())
+				}
+			}
+		}
+
+		// Only dump the tables changed since the last full dump when differentials are enabled
+		tables := []string{}
+		if db.FullBackupInterval != "" && dbName != "*" {
+			plan, err := planDifferential(db, dbName, previousReports, dbReport.StartedAt)
+			if err != nil {
+				log.Printf("Error planning differential, running full dump: %s\n", err.Error())
+			} else {
+				dbReport.Kind = plan.kind()
+				dbReport.TableFingerprints = plan.Fingerprints
+				dbReport.Base = plan.Base
+				dbReport.DroppedTables = plan.Dropped
+				tables = plan.Tables
+			}
+		}
+
+		if dbName == "*" {
+			dbName = "--all-databases"
+			exportName = fmt.Sprintf("%s_%s_all-databases", backupTime, db.Host)
+		}
+
+		exportFile = filepath.Join(config.DumpDir, exportName+".sql")
+		outputArg := "--result-file=" + exportFile
+
+		// Nothing to dump when no tables changed, the differential only needs the dropped tables
+		if dbReport.Kind == "differential" && len(tables) == 0 {
+			log.Printf("No tables changed in %s on host %s since the last full dump\n", dbName, db.Host)
+
+			err := os.WriteFile(exportFile, []byte("-- No tables changed since the base full dump\n"), 0644)
+			if err == nil {
+				err = appendDropStatements(exportFile, dbReport.DroppedTables)
+			}
+
+			dbReport.DurationSeconds = time.Since(dbReport.StartedAt).Seconds()
+
+			if err != nil {
+				log.Printf("Error writing differential: %s\n", err.Error())
+				dbReport.Error = err.Error()
+				return dbReport, ""
+			}
+
+			dbReport.File = exportFile
+			dbReport.SizeBytes = fileSize(exportFile)
+			dbReport.SHA256, err = dumpSHA256(exportFile)
+			if err != nil {
+				log.Printf("Error computing checksum of %s: %s\n", exportFile, err.Error())
+			}
+			dbReport.Success = true
+			return dbReport, exportFile
+		}
+
+		// A masking rule that matches nothing would leave the data it was meant to mask in the dump
+		if len(db.Masking) > 0 {
+			err := checkMaskingRules(db, dbName)
+			if err != nil {
+				log.Printf("Error checking masking rules for %s on host %s: %s\n", dbName, db.Host, err.Error())
+				dbReport.Error = err.Error()
+				dbReport.DurationSeconds = time.Since(dbReport.StartedAt).Seconds()
+				return dbReport, ""
+			}
+		}
+
+		version, err := mysqlServerVersion(db)
+		if err != nil {
+			log.Printf("Error detecting server version of %s: %s\n", db.Host, err.Error())
+		}
+		dbReport.ServerVersion = version
+
+		tool := "mysqldump"
+		args := append(mysqlConnectionArgs(db), mysqlCompatArgs(db, version)...)
+		args = append(args, mysqlBlobArgs(db)...)
+		args = append(args, "--extended-insert", "--single-transaction=TRUE")
+		args = append(args, db.presetArgs()...)
+		if db.StoredPrograms && len(tables) == 0 && db.ParallelTables <= 1 {
+			// Parallel dumps get a file of their own for these
+			args = append(args, "--routines", "--events")
+		}
+		args = append(args, dbName)
+		if db.DumpTool == "mysqlpump" {
+			tool = "mysqlpump"
+			args = mysqlPumpArgs(db, version, dbName)
+		}
+
+		if dbName == "--all-databases" {
+			checkCharset(db, "*")
+		} else {
+			checkCharset(db, dbName)
+		}
+
+		if db.ParallelTables > 1 && dbName != "--all-databases" {
+			// A directory with a dump per table
+			exportFile = filepath.Join(config.DumpDir, exportName)
+			name := dbName
+			dump = func() error {
+				return parallelMySQLDump(ctx, config, db, name, args, tables, exportFile)
+			}
+		} else if db.SplitTables && dbName != "--all-databases" {
+			// The same directory, split from a single dump
+			exportFile = filepath.Join(config.DumpDir, exportName)
+			splitArgs := append(args, tables...)
+			dump = func() error {
+				return splitMySQLDump(ctx, config, db, tool, splitArgs, exportFile)
+			}
+		} else if config.CompressDumps {
+			// Compress the output as it's written, masking on the way through
+			exportFile += ".gz"
+			cmd = dumpCommand(ctx, tool, append(args, tables...)...)
+			cmd.Env = mysqlEnv(db)
+			dump = func() error {
+				return compressedDump(cmd, exportFile, config.CompressionLevel, db.Masking)
+			}
+		} else {
+			args = append([]string{outputArg}, args...)
+			cmd = dumpCommand(ctx, tool, append(args, tables...)...)
+			cmd.Env = mysqlEnv(db)
+		}
+
+		if db.Lock != "" {
+			run := dump
+			if run == nil {
+				locked := cmd
+				run = func() error {
+					_, err := commandOutput(locked)
+					return err
+				}
+			}
+			dump = func() error {
+				return withMySQLLock(ctx, db, run)
+			}
+		}
+	} else if db.Engine == "mongodb" {
+		dbArg := fmt.Sprintf("--db=%s", dbName)
+		if dbName == "*" {
+			dbArg = ""
+			exportName = fmt.Sprintf("%s_%s_all-databases", backupTime, db.Host)
+		}
+
+		hostArg := fmt.Sprintf("--host=%s", db.connectHost())
+		portArg := fmt.Sprintf("--port=%d", db.Port)
+		usernameArg := fmt.Sprintf("--user=%s", db.Username)
+		outputArg := "--out=" + filepath.Join(config.DumpDir, exportName)
+
+		exportFile = filepath.Join(config.DumpDir, exportName+".gz")
+
+		passwordFile, err := mongoPasswordFile(config, db)
+		if err != nil {
+			dbReport.Error = err.Error()
+			log.Printf("Error running backup: %s\n", dbReport.Error)
+			return dbReport, ""
+		}
+
+		mongodump := dumpCommand(ctx, "mongodump", hostArg, portArg, usernameArg, "--config="+passwordFile, dbArg, outputArg, "--gzip")
+		dump = func() error {
+			defer os.Remove(passwordFile)
+			_, err := commandOutput(mongodump)
+			return err
+		}
+	} else if db.Engine == "redis" {
+		// Redis snapshots always contain every logical database
+		exportName = fmt.Sprintf("%s_%s_on_%s", backupTime, db.Engine, db.Host)
+		exportFile, cmd = redisDumpCommand(ctx, db, filepath.Join(config.DumpDir, exportName))
+	} else if db.Engine == "sqlite" {
+		// SQLite names are paths to the database files
+		exportName = fmt.Sprintf("%s_%s_%s", backupTime, db.Engine, filepath.Base(dbName))
+		exportFile, cmd = sqliteDumpCommand(ctx, dbName, filepath.Join(config.DumpDir, exportName))
+	} else if db.Engine == "mssql" {
+		var err error
+		exportFile, cmd, err = mssqlDumpCommand(ctx, db, dbName, filepath.Join(config.DumpDir, exportName))
+		if err != nil {
+			dbReport.Error = err.Error()
+			log.Printf("Error running backup: %s\n", dbReport.Error)
+			return dbReport, ""
+		}
+	} else if db.Engine == "etcd" {
+		// Snapshots always contain the whole keyspace
+		exportName = fmt.Sprintf("%s_%s_on_%s", backupTime, db.Engine, db.Host)
+		exportFile, cmd = etcdDumpCommand(ctx, db, filepath.Join(config.DumpDir, exportName))
+	} else if db.Engine == "command" {
+		if dbName == "*" {
+			exportName = fmt.Sprintf("%s_%s_all-databases", backupTime, db.Host)
+		}
+
+		extension := db.Extension
+		if extension == "" {
+			extension = "dump"
+		}
+
+		exportFile = filepath.Join(config.DumpDir, exportName+"."+extension)
+		name := dbName
+		dump = func() error {
+			return commandDump(ctx, db, name, exportFile)
+		}
+	} else if db.Engine == "ldap" {
+		if dbName == "*" {
+			exportName = fmt.Sprintf("%s_%s_all-databases", backupTime, db.Host)
+		}
+
+		exportFile = filepath.Join(config.DumpDir, exportName+".ldif")
+		name := dbName
+		dump = func() error {
+			return ldapDump(ctx, db, name, exportFile)
+		}
+	} else if db.Engine == "influxdb" {
+		if dbName == "*" {
+			exportName = fmt.Sprintf("%s_%s_all-databases", backupTime, db.Host)
+		}
+
+		exportFile, cmd = influxdbDumpCommand(ctx, db, dbName, filepath.Join(config.DumpDir, exportName))
+	} else if db.Engine == "clickhouse" {
+		if dbName == "*" {
+			exportName = fmt.Sprintf("%s_%s_all-databases", backupTime, db.Host)
+		}
+
+		// ClickHouse dumps are a directory of schema and per-table data files
+		exportFile = filepath.Join(config.DumpDir, exportName)
+		name := dbName
+		dump = func() error {
+			return clickhouseDump(ctx, db, name, exportFile)
+		}
+	} else if db.Engine == "files" {
+		// Names label the set of files, e.g. "uploads"
+		exportName = fmt.Sprintf("%s_%s_%s", backupTime, db.Engine, dbName)
+		exportFile = filepath.Join(config.DumpDir, exportName+".tar.gz")
+		dump = func() error {
+			return filesDump(ctx, config, db.Files, exportFile)
+		}
+	} else if db.Engine == "rds_snapshot" {
+		// The snapshot stays in RDS, the archive only holds its record
+		exportName = fmt.Sprintf("%s_%s_%s", backupTime, db.Engine, dbName)
+		exportFile = filepath.Join(config.DumpDir, exportName+".json")
+		name := dbName
+		dump = func() error {
+			return rdsSnapshot(ctx, config, db, name, exportFile, trigger)
+		}
+	} else if db.Engine == "cloudsql_export" {
+		// The export stays in Cloud Storage, the archive only holds its record
+		exportName = fmt.Sprintf("%s_%s_%s_%s", backupTime, db.Engine, db.CloudSQL.Instance, dbName)
+		if dbName == "*" {
+			exportName = fmt.Sprintf("%s_%s_%s_all-databases", backupTime, db.Engine, db.CloudSQL.Instance)
+		}
+
+		exportFile = filepath.Join(config.DumpDir, exportName+".json")
+		name, export := dbName, exportName
+		dump = func() error {
+			return cloudSQLExport(ctx, db, name, export, exportFile)
+		}
+	} else {
+		dbReport.Error = fmt.Sprintf("unsupported engine %q", db.Engine)
+		log.Printf("Error running backup: %s\n", dbReport.Error)
+		return dbReport, ""
+	}
+
+	if dump == nil {
+		dump = func() error {
+			_, err := commandOutput(cmd)
+			return err
+		}
+	}
+
+	stopProgress := watchProgress(fmt.Sprintf("Dumping %s on %s", dbName, db.Host), config.progressInterval(), 0, func() int64 {
+		return fileSize(exportFile)
+	})
+	stopBudget := func() bool { return false }
+	maxSize := sizeLimit(db.MaxSize)
+	if maxSize > 0 && config.SizeBudget.aborts() {
+		stopBudget = watchBudget(exportFile, maxSize, cancelDump)
+	}
+	// Snapshots and exports run on the server, with nothing written to watch
+	stopWatchdog := func() bool { return false }
+	if db.Engine != "rds_snapshot" && db.Engine != "cloudsql_export" {
+		stopWatchdog = watchStall(fmt.Sprintf("Dump of %s on %s", dbName, db.Host), config.stallTimeout(), func() int64 {
+			return fileSize(exportFile)
+		}, cancelDump)
+	}
+	err := dump()
+	stopProgress()
+	if stopBudget() {
+		os.RemoveAll(exportFile)
+		err = fmt.Errorf("dump went over max_size of %s and was stopped", db.MaxSize)
+	}
+	if stopWatchdog() {
+		os.RemoveAll(exportFile)
+		err = stallError("dump", config.stallTimeout())
+	}
+	dbReport.DurationSeconds = time.Since(dbReport.StartedAt).Seconds()
+
+	if err == nil && len(dbReport.DroppedTables) > 0 {
+		err = appendDropStatements(exportFile, dbReport.DroppedTables)
+	}
+
+	if err == nil && len(db.Masking) > 0 && len(db.Processors) == 0 && strings.HasSuffix(exportFile, ".sql") {
+		log.Printf("Masking %s\n", exportFile)
+
+		err = maskDump(exportFile, exportFile+".masked", db.Masking)
+		if err == nil {
+			err = os.Rename(exportFile+".masked", exportFile)
+		} else {
+			os.Remove(exportFile + ".masked")
+			os.Remove(exportFile)
+		}
+	}
+
+	if err == nil && db.CheckCompleteness && dbReport.Kind != "differential" && dbReport.Kind != "table_export" && (db.Engine == "mysql" || db.Engine == "mariadb") {
+		dbReport.MissingObjects, err = missingObjects(db, dbReport.Name, exportFile)
+		if err == nil && len(dbReport.MissingObjects) > 0 {
+			log.Printf("Dump of %s on %s is missing:\n%s\n", dbReport.Name, db.Host, strings.Join(dbReport.MissingObjects, "\n"))
+			err = fmt.Errorf("dump is missing %s", summariseMissing(dbReport.MissingObjects))
+		}
+		if err != nil {
+			os.RemoveAll(exportFile)
+		}
+	}
+
+	// Processed last, as the checks above need to read the dump
+	if err == nil && len(db.Processors) > 0 {
+		var processed string
+		processed, err = processDump(ctx, config, db, exportFile)
+		if err != nil {
+			os.RemoveAll(exportFile)
+		} else {
+			exportFile = processed
+		}
+	}
+
+	if err != nil {
+		log.Printf("Error running backup: %s\n", err.Error())
+		dbReport.Error = err.Error()
+		return dbReport, ""
+	}
+
+	dbReport.File = exportFile
+	dbReport.SizeBytes = fileSize(exportFile)
+
+	dbReport.SHA256, err = dumpSHA256(exportFile)
+	if err != nil {
+		log.Printf("Error computing checksum of %s: %s\n", exportFile, err.Error())
+	}
+
+	raw, compressed, err := measureCompression(exportFile, config.CompressionLevel)
+	if err != nil {
+		log.Printf("Error measuring compression of %s: %s\n", exportFile, err.Error())
+	} else {
+		dbReport.RawSizeBytes = raw
+		dbReport.CompressionRatio = compressionRatio(raw, compressed)
+	}
+
+	if maxSize > 0 && dbReport.SizeBytes > maxSize {
+		dbReport.OverBudget = fmt.Sprintf("%s is over max_size of %s", formatBytes(dbReport.SizeBytes), db.MaxSize)
+		log.Printf("Dump of %s on %s: %s\n", dbName, db.Host, dbReport.OverBudget)
+
+		if config.SizeBudget.aborts() {
+			os.RemoveAll(exportFile)
+			dbReport.Error = dbReport.OverBudget
+			dbReport.File = ""
+			return dbReport, ""
+		}
+	}
+
+	if db.TableSummary != "" && dbReport.Name != "*" && (db.Engine == "mysql" || db.Engine == "mariadb") {
+		dbReport.Tables, err = tableSummaries(db, dbReport.Name, db.TableSummary)
+		if err != nil {
+			log.Printf("Error summarising tables of %s: %s\n", dbReport.Name, err.Error())
+		}
+	}
+
+	if db.SchemaDrift && dbReport.Name != "*" && (db.Engine == "mysql" || db.Engine == "mariadb") {
+		dbReport.Schema, err = tableSchemas(db, dbReport.Name)
+		if err != nil {
+			log.Printf("Error reading schema of %s: %s\n", dbReport.Name, err.Error())
+		} else if previous, ok := previousSchema(previousReports, db.Engine, db.Host, dbReport.Name); ok {
+			dbReport.SchemaDrift = schemaDrift(previous, dbReport.Schema)
+			if len(dbReport.SchemaDrift) > 0 {
+				log.Printf("Schema of %s on %s changed since the last backup:\n%s\n", dbReport.Name, db.Host, strings.Join(dbReport.SchemaDrift, "\n"))
+			}
+		}
+	}
+
+	if db.TableExport.enabled() && dbReport.Kind != "table_export" && dbReport.Name != "*" && (db.Engine == "mysql" || db.Engine == "mariadb") {
+		dir := filepath.Join(config.DumpDir, exportName+"."+db.TableExport.Format)
+		err = exportTables(ctx, config, db, dbReport.Name, dir)
+		if err != nil {
+			// The dump is still good, so it's archived without the export
+			log.Printf("Error exporting tables of %s: %s\n", dbReport.Name, err.Error())
+			dbReport.TableExportError = err.Error()
+			os.RemoveAll(dir)
+		} else {
+			dbReport.TableExport = dir
+		}
+	}
+
+	// Databases with their own S3 settings are uploaded as a separate archive.
+	// It's compressed here, but uploaded by runDumps once the dump's slot is
+	// free for the next database.
+	if db.S3.set() && !config.Dedup.Enabled {
+		dbReport.upload, err = archiveSeparately(ctx, config, db, &dbReport, exportName, trigger)
+		if err != nil {
+			log.Printf("Error archiving %s separately: %s\n", exportFile, err.Error())
+			dbReport.Error = err.Error()
+		} else {
+			dbReport.Success = true
+		}
+
+		return dbReport, ""
+	}
+
+	dbReport.Success = true
+	return dbReport, exportFile
+}
+
+// A database's own archive, compressed and waiting to be uploaded
+type separateUpload struct {
+	db      DatabaseConfig
+	archive string
+	files   []string
+	trigger string
+}
+
+// Archive a single database's dump to be uploaded with the database's own S3
+// settings. The local files are deleted here if archiving fails, otherwise
+// once the archive is uploaded.
+func archiveSeparately(ctx context.Context, config Config, db DatabaseConfig, dbReport *DatabaseReport, exportName string, trigger string) (*separateUpload, error) {
+	upload := &separateUpload{
+		db:      db,
+		archive: filepath.Join(config.TempDir, exportName+config.archiveExtension()),
+		trigger: trigger,
+	}
+
+	files := []string{dbReport.File}
+	if dbReport.TableExport != "" {
+		files = append(files, dbReport.TableExport)
+	}
+	upload.files = append([]string{upload.archive}, files...)
+
+	out, err := os.Create(upload.archive)
+	if err == nil {
+		err = writeArchive(ctx, config, files, out)
+		out.Close()
+	}
+	if err == nil {
+		dbReport.ArchiveKey = backupNamePrefix + exportName + config.archiveExtension()
+		dbReport.ArchiveSHA256, err = fileSHA256(upload.archive)
+		if db.S3.set() {
+			overrides := db.S3
+			dbReport.S3 = &overrides
+		}
+	}
+	if err != nil {
+		upload.cleanUp(config)
+		return nil, err
+	}
+
+	return upload, nil
+}
+
+// Upload a database's own archive, then delete the local files
+func (upload *separateUpload) run(ctx context.Context, config Config, dbReport *DatabaseReport) error {
+	defer upload.cleanUp(config)
+
+	for _, target := range uploadToTargetsWithOverrides(ctx, config, upload.archive, dbReport.ArchiveKey, true, upload.db.S3, dbReport.Labels) {
+		if target.Error != "" {
+			return fmt.Errorf("error uploading to %s: %s", target.Name, target.Error)
+		}
+	}
+
+	return nil
+}
+
+// Delete the archive and the files in it
+func (upload *separateUpload) cleanUp(config Config) {
+	for _, file := range upload.files {
+		if file == "" {
+			continue
+		}
+		err := os.RemoveAll(file)
+		auditLog(config, "delete_local", file, upload.trigger, err)
+	}
+}
+
+// Archive the dumped files and upload the archive to every storage target
+func archiveAndUpload(ctx context.Context, config Config, files []string, report *RunReport, backupStartTimestamp string, dumpedBytes int64, trigger string) error {
+	// Add a manifest and a script to restore without dbbackup
+	extra, err := writeRestoreFiles(config, report)
+	if err != nil {
+		log.Printf("Error writing restore script: %s\n", err.Error())
+	}
+	defer func() {
+		for _, file := range extra {
+			os.Remove(file)
+		}
+	}()
+	files = append(files, extra...)
+
+	// Archive the backup directory
+	log.Println("Compressing backup files")
+	compressStarted := time.Now()
+
+	// Create output file, named for the run so runs never share one
+	out, err := os.CreateTemp(config.TempDir, "backup_*"+config.archiveExtension())
+	if err != nil {
+		log.Println("Error writing archive:", err)
+		return err
+	}
+	archivePath := out.Name()
+	defer func() {
+		out.Close()
+		err := os.Remove(archivePath)
+		if err != nil {
+			log.Printf("Error deleting file %s: %s\n", archivePath, err.Error())
+		}
+		auditLog(config, "delete_local", archivePath, trigger, err)
+	}()
+
+	// Create the archive and write the output to the "out" Writer
+	err = writeArchive(ctx, config, files, out)
+	if err != nil {
+		log.Println("Error creating archive:", err)
+		return err
+	}
+
+	// Flush the archive so its pages can be dropped from the page cache
+	err = out.Sync()
+	if err != nil {
+		return err
+	}
+	dropPageCache(out)
+
+	report.ArchiveSizeBytes = fileSize(archivePath)
+	report.CompressionRatio = compressionRatio(rawSize(report), report.ArchiveSizeBytes)
+	report.ArchiveSHA256, err = fileSHA256(archivePath)
+	if err != nil {
+		return err
+	}
+	report.recordPhase("compress", compressStarted, dumpedBytes)
+
+	log.Println("Compressed backup files")
+
+	// Upload to every storage target
+	report.ArchiveKey = fmt.Sprintf("sql_backup_at_%s%s", backupStartTimestamp, config.archiveExtension())
+	uploadStarted := time.Now()
+
+	report.Targets = uploadToTargets(ctx, config, archivePath, report.ArchiveKey, true)
+	report.recordPhase("upload", uploadStarted, report.ArchiveSizeBytes*int64(len(report.Targets)))
+
+	for _, target := range report.Targets {
+		if target.Error != "" {
+			return fmt.Errorf("error uploading to %s: %s", target.Name, target.Error)
+		}
+	}
+
+	return nil
 }
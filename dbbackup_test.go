@@ -0,0 +1,46 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTimestamp(t *testing.T) {
+	at := time.Date(2026, 3, 1, 2, 3, 4, 0, time.FixedZone("CET", 3600))
+
+	if got := (Config{}).timestamp(at); got != "2026-03-01_02-03-04" {
+		t.Errorf("timestamp without a timezone is %s", got)
+	}
+
+	for zone, want := range map[string]string{
+		"UTC":              "20260301T010304+0000",
+		"America/New_York": "20260228T200304-0500",
+		"Europe/London":    "20260301T010304+0000",
+	} {
+		if got := (Config{Timezone: zone}).timestamp(at); got != want {
+			t.Errorf("timestamp in %s is %s, want %s", zone, got, want)
+		}
+	}
+
+	if got := copySource("bucket", "backup_20260301T010304+0000.tar.gz"); got != "bucket/backup_20260301T010304%2B0000.tar.gz" {
+		t.Errorf("copy source is %s", got)
+	}
+}
+
+func TestBlackoutTimezone(t *testing.T) {
+	// 01:30 in UTC is 20:30 the day before in New York
+	at := time.Date(2026, 3, 1, 1, 30, 0, 0, time.UTC)
+	config := Config{
+		Timezone:  "UTC",
+		Blackouts: []BlackoutConfig{{Name: "evening", Hours: "20:00-21:00"}},
+	}
+
+	if _, active := config.activeBlackout(at); active {
+		t.Error("blackout checked in the naming timezone")
+	}
+
+	config.BlackoutTimezone = "America/New_York"
+	if _, active := config.activeBlackout(at); !active {
+		t.Error("blackout not checked in blackout_timezone")
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Chunk size bounds for content-defined chunking. Changing these (or the gear
+// table seed) changes where chunk boundaries fall and defeats deduplication
+// against existing repositories.
+const (
+	minChunkSize = 512 * 1024
+	avgChunkSize = 1024 * 1024
+	maxChunkSize = 4 * 1024 * 1024
+	chunkMask    = avgChunkSize - 1
+)
+
+// Random values used by the gear rolling hash, generated from a fixed seed
+var gearTable = func() [256]uint64 {
+	var table [256]uint64
+
+	// splitmix64
+	state := uint64(0x64626261636b7570)
+	for i := range table {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+
+	return table
+}()
+
+// Hold the chunks making up a single file in a deduplicated backup
+type IndexFile struct {
+	Name   string   `json:"name"`
+	Size   int64    `json:"size"`
+	Chunks []string `json:"chunks"`
+}
+
+// Hold the index of a single deduplicated backup
+type BackupIndex struct {
+	CreatedAt time.Time   `json:"created_at"`
+	Version   string      `json:"version,omitempty"`
+	Files     []IndexFile `json:"files"`
+}
+
+// Hold statistics about a deduplicated upload
+type DedupReport struct {
+	ChunksTotal    int   `json:"chunks_total"`
+	ChunksUploaded int   `json:"chunks_uploaded"`
+	BytesTotal     int64 `json:"bytes_total"`
+	BytesUploaded  int64 `json:"bytes_uploaded"`
+}
+
+// Read the next content-defined chunk from the reader into buf. Returns io.EOF
+// once no data is left.
+func nextChunk(reader *bufio.Reader, buf []byte) ([]byte, error) {
+	buf = buf[:0]
+	var hash uint64
+
+	for len(buf) < maxChunkSize {
+		b, err := reader.ReadByte()
+		if err == io.EOF {
+			if len(buf) == 0 {
+				return nil, io.EOF
+			}
+			return buf, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		buf = append(buf, b)
+		hash = (hash << 1) + gearTable[b]
+
+		if len(buf) >= minChunkSize && hash&chunkMask == 0 {
+			break
+		}
+	}
+
+	return buf, nil
+}
+
+// Get the object key of a chunk in the repository
+func chunkKey(prefix string, hash string) string {
+	return path.Join(prefix, "chunks", hash[:2], hash)
+}
+
+// Check whether an object already exists in the bucket
+func objectExists(ctx context.Context, client *s3.S3, bucket string, key string) (bool, error) {
+	_, err := client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+
+	if err == nil {
+		return true, nil
+	}
+
+	if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == 404 {
+		return false, nil
+	}
+
+	return false, err
+}
+
+// Split each file into content-defined chunks, upload the chunks not already in
+// the repository, and upload an index referencing them
+func uploadDeduplicated(ctx context.Context, config Config, files []string, report *RunReport, backupStartTimestamp string) error {
+	log.Println("Uploading to deduplicated repository")
+	uploadStarted := time.Now()
+
+	sess, err := newS3Session(config)
+	if err != nil {
+		return err
+	}
+
+	client := s3.New(sess)
+	bucket := config.S3Config.Bucket
+	prefix := config.Dedup.Prefix
+
+	index := BackupIndex{CreatedAt: report.StartedAt, Version: version, Files: []IndexFile{}}
+	stats := &DedupReport{}
+	report.Dedup = stats
+
+	known := map[string]bool{}
+	buf := make([]byte, 0, maxChunkSize)
+
+	for _, name := range expandFiles(files) {
+		file, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+
+		indexFile := IndexFile{Name: name, Chunks: []string{}}
+		reader := bufio.NewReaderSize(file, 1024*1024)
+
+		for {
+			chunk, err := nextChunk(reader, buf)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				file.Close()
+				return err
+			}
+
+			sum := sha256.Sum256(chunk)
+			hash := hex.EncodeToString(sum[:])
+
+			indexFile.Chunks = append(indexFile.Chunks, hash)
+			indexFile.Size += int64(len(chunk))
+			stats.ChunksTotal++
+			stats.BytesTotal += int64(len(chunk))
+
+			if known[hash] {
+				continue
+			}
+
+			key := chunkKey(prefix, hash)
+
+			exists, err := objectExists(ctx, client, bucket, key)
+			if err != nil {
+				file.Close()
+				return fmt.Errorf("error checking chunk %s: %w", hash, err)
+			}
+
+			if !exists {
+				var compressed bytes.Buffer
+				gw, _ := gzip.NewWriterLevel(&compressed, config.CompressionLevel)
+				gw.Write(chunk)
+				gw.Close()
+
+				_, err = client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+					Bucket: aws.String(bucket),
+					Key:    aws.String(key),
+					Body:   bytes.NewReader(compressed.Bytes()),
+				})
+				if err != nil {
+					file.Close()
+					return fmt.Errorf("error uploading chunk %s: %w", hash, err)
+				}
+
+				stats.ChunksUploaded++
+				stats.BytesUploaded += int64(compressed.Len())
+			}
+
+			known[hash] = true
+		}
+
+		file.Close()
+		index.Files = append(index.Files, indexFile)
+	}
+
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	report.ArchiveKey = path.Join(prefix, "indexes", fmt.Sprintf("sql_backup_at_%s.json", backupStartTimestamp))
+	report.ArchiveSizeBytes = stats.BytesUploaded
+
+	_, err = client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(report.ArchiveKey),
+		Body:   bytes.NewReader(data),
+	})
+	if err != nil {
+		return fmt.Errorf("error uploading index: %w", err)
+	}
+
+	report.recordPhase("upload", uploadStarted, stats.BytesUploaded)
+
+	log.Printf("Uploaded %d of %d chunks (%s of %s)\n", stats.ChunksUploaded, stats.ChunksTotal, formatBytes(stats.BytesUploaded), formatBytes(stats.BytesTotal))
+
+	return nil
+}
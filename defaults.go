@@ -0,0 +1,141 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Expand a leading "~" to the home directory and resolve relative paths
+// against base, so paths don't depend on the working directory
+func expandPath(path string, base string) string {
+	if path == "" {
+		return path
+	}
+
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		home, err := os.UserHomeDir()
+		if err == nil {
+			path = filepath.Join(home, path[1:])
+		}
+	}
+
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(base, path)
+	}
+
+	return filepath.Clean(path)
+}
+
+// Region to use when none is configured, taken from the usual AWS variables
+func defaultRegion() string {
+	if region := os.Getenv("AWS_REGION"); region != "" {
+		return region
+	}
+
+	return os.Getenv("AWS_DEFAULT_REGION")
+}
+
+// Fill in unset options and normalise paths relative to the directory
+// containing the main configuration file
+func applyDefaults(config *Config, base string) {
+	if config.TempDir == "" {
+		config.TempDir = filepath.Join(os.TempDir(), "dbbackup")
+	}
+	config.TempDir = expandPath(config.TempDir, base)
+
+	// Dumps and reports stay relative to the working directory by default
+	if config.DumpDir == "" {
+		config.DumpDir = "backups"
+	} else {
+		config.DumpDir = expandPath(config.DumpDir, base)
+	}
+	if config.ReportsDir == "" {
+		config.ReportsDir = "reports"
+	} else {
+		config.ReportsDir = expandPath(config.ReportsDir, base)
+	}
+
+	if config.CompressionLevel == 0 {
+		config.CompressionLevel = 6
+	}
+
+	if config.AuditLog != "" {
+		config.AuditLog = expandPath(config.AuditLog, base)
+	}
+
+	if config.Signing.PrivateKey != "" {
+		config.Signing.PrivateKey = expandPath(config.Signing.PrivateKey, base)
+	}
+	if config.Signing.PublicKey != "" {
+		config.Signing.PublicKey = expandPath(config.Signing.PublicKey, base)
+	}
+
+	if config.Tiering.Prefix == "" {
+		config.Tiering.Prefix = "archive"
+	}
+	if config.Tiering.StorageClass == "" {
+		config.Tiering.StorageClass = "DEEP_ARCHIVE"
+	}
+	if config.Tiering.Schedule == "" {
+		config.Tiering.Schedule = "0 0 3 * * *"
+	}
+	if config.Tiering.RestoreDays == 0 {
+		config.Tiering.RestoreDays = 7
+	}
+	if config.Tiering.RestoreTier == "" {
+		config.Tiering.RestoreTier = "Standard"
+	}
+
+	if config.S3Config.Region == "" {
+		config.S3Config.Region = defaultRegion()
+	}
+	config.S3Config.WebIdentity = expandIdentityPath(config.S3Config.WebIdentity, base)
+
+	for i := range config.Targets {
+		target := &config.Targets[i]
+
+		if target.Type == "local" {
+			target.Path = expandPath(target.Path, base)
+		}
+		if target.Type == "s3" && target.Region == "" {
+			target.Region = config.S3Config.Region
+		}
+		target.WebIdentity = expandIdentityPath(target.WebIdentity, base)
+	}
+
+	for i := range config.Replicas {
+		if config.Replicas[i].Region == "" {
+			config.Replicas[i].Region = config.S3Config.Region
+		}
+	}
+
+	if config.Inventory.enabled() {
+		config.Inventory.File = expandPath(config.Inventory.File, base)
+		config.Inventory.base = base
+		applyDatabaseDefaults(&config.Inventory.Database, base)
+	}
+
+	for i := range config.Databases {
+		applyDatabaseDefaults(&config.Databases[i], base)
+	}
+}
+
+// Fill in a database entry's unset options and normalise its paths
+func applyDatabaseDefaults(db *DatabaseConfig, base string) {
+	if db.Port == 0 {
+		db.Port = defaultPorts[db.Engine]
+	}
+	if db.DefaultCharacterSet == "" && (db.Engine == "mysql" || db.Engine == "mariadb") {
+		db.DefaultCharacterSet = "utf8mb4"
+	}
+	if db.Host == "" && db.Discovery.enabled() {
+		db.Host = db.Discovery.name()
+	}
+	applyDumpPreset(db)
+
+	db.MyCnfPath = expandPath(db.MyCnfPath, base)
+	db.TLS.CA = expandPath(db.TLS.CA, base)
+	db.TLS.Cert = expandPath(db.TLS.Cert, base)
+	db.TLS.Key = expandPath(db.TLS.Key, base)
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Hold the decision of whether to take a full or differential dump of a database
+type differentialPlan struct {
+	Full         bool
+	Base         *BackupReference
+	Tables       []string
+	Dropped      []string
+	Fingerprints map[string]string
+}
+
+// Get the kind of dump the plan will produce
+func (plan differentialPlan) kind() string {
+	if plan.Full {
+		return "full"
+	}
+
+	return "differential"
+}
+
+// Find the most recent full dump of a database that can be used as a base
+func lastFullBackup(reports []RunReport, engine string, host string, name string) (*DatabaseReport, string, bool) {
+	for _, report := range reports {
+		if !report.Uploaded {
+			continue
+		}
+
+		for i, db := range report.Databases {
+			if db.Engine == engine && db.Host == host && db.Name == name && db.Success && !db.Skipped &&
+				db.Kind == "full" && db.TableFingerprints != nil {
+				return &report.Databases[i], report.archiveFor(db), true
+			}
+		}
+	}
+
+	return nil, "", false
+}
+
+// Decide whether a database needs a full dump or just the tables changed since
+// the last full dump
+func planDifferential(db DatabaseConfig, dbName string, reports []RunReport, now time.Time) (differentialPlan, error) {
+	interval, err := parseDuration(db.FullBackupInterval)
+	if err != nil {
+		return differentialPlan{}, fmt.Errorf("invalid full backup interval: %w", err)
+	}
+
+	fingerprints, err := tableFingerprints(db, dbName)
+	if err != nil {
+		return differentialPlan{}, err
+	}
+
+	plan := differentialPlan{Full: true, Fingerprints: fingerprints}
+
+	full, archiveKey, ok := lastFullBackup(reports, db.Engine, db.Host, dbName)
+	if !ok || now.Sub(full.StartedAt) >= interval {
+		return plan, nil
+	}
+
+	plan.Full = false
+	plan.Base = &BackupReference{
+		Engine:     db.Engine,
+		Host:       db.Host,
+		Name:       dbName,
+		ArchiveKey: archiveKey,
+		File:       full.File,
+	}
+
+	for table, fingerprint := range fingerprints {
+		if full.TableFingerprints[table] != fingerprint {
+			plan.Tables = append(plan.Tables, table)
+		}
+	}
+
+	for table := range full.TableFingerprints {
+		if _, ok := fingerprints[table]; !ok {
+			plan.Dropped = append(plan.Dropped, table)
+		}
+	}
+
+	sort.Strings(plan.Tables)
+	sort.Strings(plan.Dropped)
+
+	return plan, nil
+}
+
+// Append statements dropping tables removed since the last full dump
+func appendDropStatements(path string, tables []string) error {
+	// Parallel dumps keep them in their own file, applied last
+	if info, err := os.Stat(path); err == nil && info.IsDir() {
+		path = filepath.Join(path, "dropped.sql")
+	}
+
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	// Compressed dumps get another gzip member, which readers treat as a continuation
+	var w io.Writer = file
+	var gw *gzip.Writer
+	if strings.HasSuffix(path, ".gz") {
+		gw = gzip.NewWriter(file)
+		w = gw
+	}
+
+	for _, table := range tables {
+		_, err = fmt.Fprintf(w, "DROP TABLE IF EXISTS %s;\n", quoteIdentifier(table))
+		if err != nil {
+			return err
+		}
+	}
+
+	if gw != nil {
+		return gw.Close()
+	}
+
+	return nil
+}
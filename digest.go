@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron"
+)
+
+// Cron schedules for each digest period, and how far back they look
+var digestSchedules = map[string]struct {
+	Spec   string
+	Period time.Duration
+}{
+	"daily":  {"0 0 0 * * *", 24 * time.Hour},
+	"weekly": {"0 0 0 * * 1", 7 * 24 * time.Hour},
+}
+
+// Build a digest summarising every run since the given time
+func digestNotification(reports []RunReport, since time.Time, period string) Notification {
+	succeeded, failed, skipped := 0, 0, 0
+	var totalSize int64
+	failures := map[string]int{}
+
+	for _, report := range reports {
+		if report.StartedAt.Before(since) {
+			continue
+		}
+
+		if report.Skipped {
+			skipped++
+		} else if report.Success {
+			succeeded++
+		} else {
+			failed++
+		}
+		totalSize += report.ArchiveSizeBytes
+
+		for _, db := range report.Databases {
+			if !db.Success {
+				failures[fmt.Sprintf("%s on %s", db.Name, db.Host)]++
+			}
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d runs succeeded, %d failed, %s uploaded since %s\n", succeeded, failed, formatBytes(totalSize), since.Format(time.RFC1123))
+	if skipped > 0 {
+		fmt.Fprintf(&b, "%d scheduled runs skipped during blackouts\n", skipped)
+	}
+
+	for name, count := range failures {
+		fmt.Fprintf(&b, "%s failed %d times\n", name, count)
+	}
+
+	subject := fmt.Sprintf("Backup %s digest: all %d runs succeeded", period, succeeded)
+	if failed > 0 {
+		subject = fmt.Sprintf("Backup %s digest: %d of %d runs failed", period, failed, succeeded+failed)
+	}
+
+	return Notification{
+		Event:   "digest",
+		Subject: subject,
+		Message: strings.TrimSpace(b.String()),
+		Time:    time.Now(),
+	}
+}
+
+// Add a cron job for every notifier with a digest configured
+func scheduleDigests(ctx context.Context, c *cron.Cron, config Config) {
+	for _, notifier := range config.Notifications {
+		if notifier.Digest == "" {
+			continue
+		}
+
+		schedule, ok := digestSchedules[notifier.Digest]
+		if !ok {
+			log.Printf("Unknown digest period %q for %s notifier\n", notifier.Digest, notifier.Type)
+			continue
+		}
+
+		notifier := notifier
+		addPersistentJob(c, config, fmt.Sprintf("%s %s digest", notifier.Digest, notifier.Type), schedule.Spec, func() {
+			reports, err := loadReports(config.ReportsDir)
+			if err != nil {
+				log.Printf("Error loading reports for digest: %s\n", err.Error())
+				return
+			}
+
+			notification := digestNotification(reports, clk.Now().Add(-schedule.Period), notifier.Digest)
+
+			err = notifier.send(ctx, notification)
+			if err != nil {
+				log.Printf("Error sending %s digest: %s\n", notifier.Type, err.Error())
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// Hold where to look up a database's current address at run time, so backups
+// follow failovers. The host is then only used to name the backups.
+type DiscoveryConfig struct {
+	// DNS SRV name, e.g. "_mysql._tcp.db.example.com"
+	SRV string `yaml:"srv"`
+
+	// Consul service, optionally filtered by tag, e.g. "primary". Only passing instances are used.
+	ConsulService string `yaml:"consul_service"`
+	ConsulTag     string `yaml:"consul_tag"`
+
+	// Consul HTTP API address. Defaults to $CONSUL_HTTP_ADDR, then http://127.0.0.1:8500.
+	// The token is read from $CONSUL_HTTP_TOKEN.
+	ConsulAddress string `yaml:"consul_address"`
+}
+
+// Check whether discovery is configured
+func (d DiscoveryConfig) enabled() bool {
+	return d.SRV != "" || d.ConsulService != ""
+}
+
+// Get the name discovery looks up
+func (d DiscoveryConfig) name() string {
+	if d.SRV != "" {
+		return d.SRV
+	}
+
+	return d.ConsulService
+}
+
+// Get the instances to try, in order of preference, each with its address and port set
+func (db DatabaseConfig) discover(ctx context.Context) ([]DatabaseConfig, error) {
+	if db.Discovery.SRV != "" {
+		return db.discoverSRV(ctx)
+	}
+
+	return db.discoverConsul(ctx)
+}
+
+// Look up the instances in DNS. Records come back sorted by priority and
+// shuffled by weight.
+func (db DatabaseConfig) discoverSRV(ctx context.Context) ([]DatabaseConfig, error) {
+	_, records, err := net.DefaultResolver.LookupSRV(ctx, "", "", db.Discovery.SRV)
+	if err != nil {
+		return nil, fmt.Errorf("error looking up %s: %w", db.Discovery.SRV, err)
+	}
+
+	instances := []DatabaseConfig{}
+	for _, record := range records {
+		instance := db
+		instance.address = strings.TrimSuffix(record.Target, ".")
+		instance.Port = int(record.Port)
+		instances = append(instances, instance)
+	}
+
+	if len(instances) == 0 {
+		return nil, fmt.Errorf("no records found for %s", db.Discovery.SRV)
+	}
+
+	return instances, nil
+}
+
+// Hold the parts of a Consul health API entry needed to connect
+type consulEntry struct {
+	Node struct {
+		Address string
+	}
+	Service struct {
+		Address string
+		Port    int
+	}
+}
+
+// Look up the passing instances in Consul's health API
+func (db DatabaseConfig) discoverConsul(ctx context.Context) ([]DatabaseConfig, error) {
+	address := db.Discovery.ConsulAddress
+	if address == "" {
+		address = os.Getenv("CONSUL_HTTP_ADDR")
+	}
+	if address == "" {
+		address = "http://127.0.0.1:8500"
+	}
+	if !strings.Contains(address, "://") {
+		address = "http://" + address
+	}
+
+	query := url.Values{"passing": {"1"}}
+	if db.Discovery.ConsulTag != "" {
+		query.Set("tag", db.Discovery.ConsulTag)
+	}
+
+	endpoint := fmt.Sprintf("%s/v1/health/service/%s?%s", strings.TrimSuffix(address, "/"), url.PathEscape(db.Discovery.ConsulService), query.Encode())
+
+	req, err := http.NewRequestWithContext(ctx, "GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token := os.Getenv("CONSUL_HTTP_TOKEN"); token != "" {
+		req.Header.Set("X-Consul-Token", token)
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error querying consul for %s: %w", db.Discovery.ConsulService, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error querying consul for %s: %s", db.Discovery.ConsulService, resp.Status)
+	}
+
+	entries := []consulEntry{}
+	err = json.NewDecoder(resp.Body).Decode(&entries)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing consul response for %s: %w", db.Discovery.ConsulService, err)
+	}
+
+	instances := []DatabaseConfig{}
+	for _, entry := range entries {
+		instance := db
+		instance.address = entry.Service.Address
+		if instance.address == "" {
+			instance.address = entry.Node.Address
+		}
+		if entry.Service.Port != 0 {
+			instance.Port = entry.Service.Port
+		}
+		instances = append(instances, instance)
+	}
+
+	if len(instances) == 0 {
+		return nil, fmt.Errorf("no passing instances of %s found in consul", db.Discovery.ConsulService)
+	}
+
+	return instances, nil
+}
@@ -0,0 +1,28 @@
+//go:build !windows
+
+package main
+
+import "syscall"
+
+// Get the free space available to this user on the filesystem holding path
+func freeSpace(path string) (int64, error) {
+	var stat syscall.Statfs_t
+
+	err := syscall.Statfs(path, &stat)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+// Check whether two paths are on the same filesystem
+func sameVolume(a string, b string) bool {
+	var statA, statB syscall.Stat_t
+
+	if syscall.Stat(a, &statA) != nil || syscall.Stat(b, &statB) != nil {
+		return false
+	}
+
+	return statA.Dev == statB.Dev
+}
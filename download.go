@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// How many times a download is resumed after failing before giving up
+const downloadAttempts = 10
+
+// Appended to a download's destination until it's complete
+const partialExtension = ".part"
+
+// Download an object in ranged requests, resuming from where it stopped after
+// a failure and across runs from a .part file left next to dest. The object's
+// ETag is pinned so a resumed download can't splice two versions together.
+// When rate is above 0, it's limited to that many bytes a second.
+func resumableDownload(ctx context.Context, config Config, client *s3.S3, bucket string, key string, dest string, rate int64) error {
+	head, err := client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return err
+	}
+	size := aws.Int64Value(head.ContentLength)
+
+	partial := dest + partialExtension
+	file, err := os.OpenFile(partial, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		return err
+	}
+	if offset > size {
+		// Left from a different object under the same name
+		offset = 0
+		err = file.Truncate(0)
+		if err != nil {
+			return err
+		}
+	}
+	if offset > 0 {
+		log.Printf("Resuming download of %s at %s of %s\n", key, formatBytes(offset), formatBytes(size))
+	}
+
+	progress := &progressReader{}
+	stopProgress := watchProgress(fmt.Sprintf("Downloading %s", key), config.progressInterval(), size-offset, progress.bytesRead)
+	defer stopProgress()
+
+	limiter := newRateLimiter(rate)
+
+	for attempt := 1; offset < size; attempt++ {
+		err = downloadRange(ctx, client, bucket, key, aws.StringValue(head.ETag), offset, file, progress, limiter)
+		if err == nil {
+			break
+		}
+		if ctx.Err() != nil || attempt == downloadAttempts {
+			return err
+		}
+
+		offset, _ = file.Seek(0, io.SeekCurrent)
+		delay := time.Duration(attempt) * 5 * time.Second
+		log.Printf("Error downloading %s at %s, resuming in %s: %s\n", key, formatBytes(offset), delay, err.Error())
+
+		select {
+		case <-clk.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(partial, dest)
+}
+
+// Download the rest of an object from offset, appending it to file
+func downloadRange(ctx context.Context, client *s3.S3, bucket string, key string, etag string, offset int64, file *os.File, progress *progressReader, limiter *rateLimiter) error {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-", offset)),
+	}
+	if etag != "" {
+		input.IfMatch = aws.String(etag)
+	}
+
+	output, err := client.GetObjectWithContext(ctx, input)
+	if err != nil {
+		return err
+	}
+	defer output.Body.Close()
+
+	limiter.reset()
+	progress.reader = limiter.reader(ctx, output.Body)
+	_, err = io.Copy(file, progress)
+
+	return err
+}
+
+// Keep reads under a number of bytes a second on average
+type rateLimiter struct {
+	rate    int64
+	started time.Time
+	read    int64
+}
+
+// Create a limiter, or nil for no limit
+func newRateLimiter(rate int64) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+
+	return &rateLimiter{rate: rate, started: time.Now()}
+}
+
+// Start measuring the rate again, so time spent waiting to resume isn't made
+// up for with a burst
+func (l *rateLimiter) reset() {
+	if l == nil {
+		return
+	}
+
+	l.started = time.Now()
+	l.read = 0
+}
+
+// Wrap a reader so it's limited
+func (l *rateLimiter) reader(ctx context.Context, r io.Reader) io.Reader {
+	if l == nil {
+		return r
+	}
+
+	return &limitedReader{ctx: ctx, reader: r, limiter: l}
+}
+
+type limitedReader struct {
+	ctx     context.Context
+	reader  io.Reader
+	limiter *rateLimiter
+}
+
+func (r *limitedReader) Read(b []byte) (int, error) {
+	// Small reads keep the rate smooth
+	if int64(len(b)) > r.limiter.rate/10+1 {
+		b = b[:r.limiter.rate/10+1]
+	}
+
+	n, err := r.reader.Read(b)
+	r.limiter.read += int64(n)
+
+	due := r.limiter.started.Add(time.Duration(float64(r.limiter.read) / float64(r.limiter.rate) * float64(time.Second)))
+	if wait := time.Until(due); wait > 0 {
+		select {
+		case <-time.After(wait):
+		case <-r.ctx.Done():
+			return n, r.ctx.Err()
+		}
+	}
+
+	return n, err
+}
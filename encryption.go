@@ -0,0 +1,493 @@
+package main
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/term"
+)
+
+// Hold the passphrase archives are encrypted with before they're uploaded,
+// for deployments without a key management system
+type EncryptionConfig struct {
+	// Archives can't be restored without it, so keep a copy somewhere other
+	// than the backups. Restores prompt for it when it isn't set.
+	Passphrase Secret `yaml:"passphrase"`
+
+	// Name of the passphrase, recorded in every archive it encrypts so restores
+	// know which passphrase to use once it's rotated
+	KeyID string `yaml:"key_id"`
+
+	// Passphrases used before the current one, only for decrypting
+	OldPassphrases []EncryptionKey `yaml:"old_passphrases"`
+}
+
+// A passphrase and the name archives record it by
+type EncryptionKey struct {
+	KeyID      string `yaml:"key_id"`
+	Passphrase Secret `yaml:"passphrase"`
+}
+
+// Added to the extension of encrypted archives, e.g. ".tar.gz.enc"
+const encryptedExtension = ".enc"
+
+// Start of every encrypted archive, followed by the key derivation
+// parameters, the salt and the base nonce
+const encryptionMagic = "DBBKENC1"
+
+// Start of encrypted archives recording their key ID, which follows the key
+// derivation parameters as a length byte and the ID
+const encryptionMagicKeyID = "DBBKENC2"
+
+// Bytes GCM adds to each sealed chunk
+const encryptionOverhead = 16
+
+// Argon2id parameters for new archives, as recommended by RFC 9106 for
+// memory-constrained environments. Archives record their own, so these can
+// change without breaking restores.
+const (
+	argon2Time    = 3
+	argon2Memory  = 64 * 1024 // KiB
+	argon2Threads = 4
+)
+
+// Limits on the Argon2id parameters read from an archive, well above the ones
+// written, so a corrupt or crafted header can't make a restore exhaust the
+// host's memory or spin for hours before the passphrase is even checked
+const (
+	argon2MaxTime    = 16
+	argon2MaxMemory  = 1024 * 1024 // KiB
+	argon2MaxThreads = 64
+)
+
+// Plaintext bytes in each sealed chunk of an encrypted archive
+const encryptionChunkSize = 64 * 1024
+
+// Check whether archives are encrypted with a passphrase
+func (config Config) encryptArchives() bool {
+	return config.Encryption.Passphrase != ""
+}
+
+// Get the passphrases archives can be decrypted with, the current one first
+func (config Config) encryptionKeys() []EncryptionKey {
+	keys := []EncryptionKey{}
+	if config.encryptArchives() {
+		keys = append(keys, EncryptionKey{KeyID: config.Encryption.KeyID, Passphrase: config.Encryption.Passphrase})
+	}
+
+	return append(keys, config.Encryption.OldPassphrases...)
+}
+
+// Get the config with archive encryption turned off
+func (config Config) withoutEncryption() Config {
+	config.Encryption = EncryptionConfig{}
+	return config
+}
+
+// Check Argon2id parameters read from an archive are within the limits
+func checkArgon2Params(time uint32, memory uint32, threads uint8) error {
+	if time < 1 || time > argon2MaxTime {
+		return fmt.Errorf("key derivation time of %d is outside 1 to %d", time, argon2MaxTime)
+	}
+	if threads < 1 || threads > argon2MaxThreads {
+		return fmt.Errorf("key derivation threads of %d is outside 1 to %d", threads, argon2MaxThreads)
+	}
+	if memory < 8*uint32(threads) || memory > argon2MaxMemory {
+		return fmt.Errorf("key derivation memory of %d KiB is outside %d to %d KiB", memory, 8*uint32(threads), argon2MaxMemory)
+	}
+
+	return nil
+}
+
+// Derive the AES-256-GCM cipher for a passphrase and salt
+func encryptionCipher(passphrase string, salt []byte, time uint32, memory uint32, threads uint8) (cipher.AEAD, error) {
+	key := argon2.IDKey([]byte(passphrase), salt, time, memory, threads, 32)
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
+
+// Get the nonce of a chunk, the base nonce with the chunk's number XORed into
+// its last 8 bytes
+func chunkNonce(base []byte, chunk uint64) []byte {
+	nonce := append([]byte{}, base...)
+	counter := binary.BigEndian.Uint64(nonce[len(nonce)-8:]) ^ chunk
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], counter)
+	return nonce
+}
+
+// Additional data of a chunk, marking the last one so a truncated archive
+// fails to decrypt rather than restoring part of a dump
+func chunkAdditionalData(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// Encrypts everything written to it in sealed chunks
+type encryptingWriter struct {
+	out   io.Writer
+	aead  cipher.AEAD
+	nonce []byte
+	chunk uint64
+	buf   []byte
+}
+
+// Start an encrypted archive on out, recording the key ID when there is one.
+// Close must be called to write the last chunk, but doesn't close out.
+func newEncryptingWriter(out io.Writer, passphrase string, keyID string) (io.WriteCloser, error) {
+	if len(keyID) > 255 {
+		return nil, fmt.Errorf("key ID %q is longer than 255 bytes", keyID)
+	}
+
+	salt := make([]byte, 16)
+	nonce := make([]byte, 12)
+	for _, b := range [][]byte{salt, nonce} {
+		if _, err := io.ReadFull(rand.Reader, b); err != nil {
+			return nil, err
+		}
+	}
+
+	aead, err := encryptionCipher(passphrase, salt, argon2Time, argon2Memory, argon2Threads)
+	if err != nil {
+		return nil, err
+	}
+
+	header := []byte(encryptionMagic)
+	if keyID != "" {
+		header = []byte(encryptionMagicKeyID)
+	}
+	header = appendUint32(header, argon2Time)
+	header = appendUint32(header, argon2Memory)
+	header = append(header, argon2Threads)
+	if keyID != "" {
+		header = append(header, byte(len(keyID)))
+		header = append(header, keyID...)
+	}
+	header = append(header, salt...)
+	header = append(header, nonce...)
+
+	_, err = out.Write(header)
+	if err != nil {
+		return nil, err
+	}
+
+	return &encryptingWriter{out: out, aead: aead, nonce: nonce, buf: make([]byte, 0, encryptionChunkSize)}, nil
+}
+
+func (w *encryptingWriter) Write(p []byte) (int, error) {
+	written := 0
+
+	for len(p) > 0 {
+		// A full chunk is only sealed once more follows, as the last is marked
+		if len(w.buf) == encryptionChunkSize {
+			if err := w.seal(false); err != nil {
+				return written, err
+			}
+		}
+
+		n := encryptionChunkSize - len(w.buf)
+		if n > len(p) {
+			n = len(p)
+		}
+		w.buf = append(w.buf, p[:n]...)
+		p = p[n:]
+		written += n
+	}
+
+	return written, nil
+}
+
+func (w *encryptingWriter) seal(last bool) error {
+	sealed := w.aead.Seal(nil, chunkNonce(w.nonce, w.chunk), w.buf, chunkAdditionalData(last))
+	w.chunk++
+	w.buf = w.buf[:0]
+
+	_, err := w.out.Write(sealed)
+	return err
+}
+
+func (w *encryptingWriter) Close() error {
+	return w.seal(true)
+}
+
+// Decrypts an encrypted archive as it's read
+type decryptingReader struct {
+	in    *bufio.Reader
+	aead  cipher.AEAD
+	nonce []byte
+	chunk uint64
+	buf   []byte
+	plain []byte
+	done  bool
+}
+
+// The header of an encrypted archive
+type encryptionHeader struct {
+	keyID   string
+	time    uint32
+	memory  uint32
+	threads uint8
+	salt    []byte
+	nonce   []byte
+}
+
+// Read the header from the start of an encrypted archive
+func readEncryptionHeader(reader io.Reader) (encryptionHeader, error) {
+	header := encryptionHeader{}
+
+	magic := make([]byte, len(encryptionMagic))
+	_, err := io.ReadFull(reader, magic)
+	if err != nil || (string(magic) != encryptionMagic && string(magic) != encryptionMagicKeyID) {
+		return header, fmt.Errorf("not an encrypted archive")
+	}
+
+	params := make([]byte, 4+4+1)
+	if _, err := io.ReadFull(reader, params); err != nil {
+		return header, fmt.Errorf("corrupt archive header: %w", err)
+	}
+	header.time = binary.LittleEndian.Uint32(params[0:4])
+	header.memory = binary.LittleEndian.Uint32(params[4:8])
+	header.threads = params[8]
+
+	if string(magic) == encryptionMagicKeyID {
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(reader, length); err != nil {
+			return header, fmt.Errorf("corrupt archive header: %w", err)
+		}
+		id := make([]byte, length[0])
+		if _, err := io.ReadFull(reader, id); err != nil {
+			return header, fmt.Errorf("corrupt archive header: %w", err)
+		}
+		header.keyID = string(id)
+	}
+
+	rest := make([]byte, 16+12)
+	if _, err := io.ReadFull(reader, rest); err != nil {
+		return header, fmt.Errorf("corrupt archive header: %w", err)
+	}
+	header.salt = rest[:16]
+	header.nonce = rest[16:]
+
+	err = checkArgon2Params(header.time, header.memory, header.threads)
+	if err != nil {
+		return header, fmt.Errorf("corrupt archive header: %w", err)
+	}
+
+	return header, nil
+}
+
+// Get the passphrases that may have encrypted an archive: those with its key
+// ID, or when none has it, those without an ID
+func (header encryptionHeader) candidates(keys []EncryptionKey) []EncryptionKey {
+	named, unnamed := []EncryptionKey{}, []EncryptionKey{}
+	for _, key := range keys {
+		if header.keyID != "" && key.KeyID == header.keyID {
+			named = append(named, key)
+		} else if header.keyID == "" || key.KeyID == "" {
+			unnamed = append(unnamed, key)
+		}
+	}
+
+	if len(named) > 0 {
+		return named
+	}
+
+	return unnamed
+}
+
+// Read an encrypted archive's header and derive its key from whichever of the
+// passphrases decrypts its first chunk
+func newDecryptingReader(in io.Reader, keys []EncryptionKey) (io.Reader, error) {
+	reader := bufio.NewReader(in)
+
+	header, err := readEncryptionHeader(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	candidates := header.candidates(keys)
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("the archive is encrypted with key %q, add its passphrase to encryption.old_passphrases", header.keyID)
+	}
+
+	r := &decryptingReader{in: reader, nonce: header.nonce, buf: make([]byte, encryptionChunkSize+encryptionOverhead)}
+
+	sealed, last, err := r.next()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range candidates {
+		aead, err := encryptionCipher(key.Passphrase.reveal(), header.salt, header.time, header.memory, header.threads)
+		if err != nil {
+			return nil, err
+		}
+
+		plain, err := aead.Open(nil, chunkNonce(r.nonce, 0), sealed, chunkAdditionalData(last))
+		if err == nil {
+			r.aead, r.plain, r.chunk, r.done = aead, plain, 1, last
+			return r, nil
+		}
+	}
+
+	return nil, fmt.Errorf("wrong passphrase, or the archive is corrupt or truncated")
+}
+
+// Read the next sealed chunk and whether it's the last
+func (r *decryptingReader) next() ([]byte, bool, error) {
+	n, err := io.ReadFull(r.in, r.buf)
+	if err != nil && err != io.ErrUnexpectedEOF {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, false, err
+	}
+
+	// A chunk is the last when nothing follows it
+	last := err == io.ErrUnexpectedEOF
+	if !last {
+		if _, err := r.in.Peek(1); err == io.EOF {
+			last = true
+		}
+	}
+
+	return r.buf[:n], last, nil
+}
+
+func (r *decryptingReader) Read(p []byte) (int, error) {
+	for len(r.plain) == 0 {
+		if r.done {
+			return 0, io.EOF
+		}
+
+		sealed, last, err := r.next()
+		if err != nil {
+			return 0, err
+		}
+
+		r.plain, err = r.aead.Open(r.buf[:0], chunkNonce(r.nonce, r.chunk), sealed, chunkAdditionalData(last))
+		if err != nil {
+			return 0, fmt.Errorf("wrong passphrase, or the archive is corrupt or truncated")
+		}
+		r.chunk++
+		r.done = last
+	}
+
+	n := copy(p, r.plain)
+	r.plain = r.plain[n:]
+	return n, nil
+}
+
+// Passphrase entered at the prompt, so it's only asked for once per restore
+var (
+	promptedPassphrase string
+	passphraseMutex    sync.Mutex
+)
+
+// Get the passphrases to decrypt archives with, prompting for one on the
+// terminal without echoing it when none is configured
+func decryptionKeys(config Config) ([]EncryptionKey, error) {
+	if keys := config.encryptionKeys(); len(keys) > 0 {
+		return keys, nil
+	}
+
+	passphraseMutex.Lock()
+	defer passphraseMutex.Unlock()
+
+	if promptedPassphrase != "" {
+		return []EncryptionKey{{Passphrase: Secret(promptedPassphrase)}}, nil
+	}
+
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return nil, errors.New("the archive is encrypted, set encryption.passphrase or run from a terminal to enter it")
+	}
+
+	fmt.Fprint(os.Stderr, "Archive passphrase: ")
+	passphrase, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	if len(passphrase) == 0 {
+		return nil, errors.New("no passphrase entered")
+	}
+
+	promptedPassphrase = string(passphrase)
+	return []EncryptionKey{{Passphrase: Secret(promptedPassphrase)}}, nil
+}
+
+// Decrypt an encrypted archive into a new file
+func decryptFile(config Config, encrypted string, dest string) error {
+	keys, err := decryptionKeys(config)
+	if err != nil {
+		return err
+	}
+
+	in, err := os.Open(encrypted)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	reader, err := newDecryptingReader(in, keys)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(out, reader)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dest)
+	}
+
+	return err
+}
+
+// Handle the decrypt subcommand, for archives downloaded by hand, e.g. to
+// use the restore script inside. Usage: decrypt <archive.enc> [output]
+func runDecrypt(config Config, args []string) error {
+	flags := flag.NewFlagSet("decrypt", flag.ContinueOnError)
+
+	err := flags.Parse(args)
+	if err != nil {
+		return withExitCode(exitConfig, err)
+	}
+	if flags.NArg() < 1 || flags.NArg() > 2 {
+		return withExitCode(exitConfig, errors.New("usage: decrypt <archive.enc> [output]"))
+	}
+
+	encrypted := flags.Arg(0)
+	dest := strings.TrimSuffix(encrypted, encryptedExtension)
+	if flags.NArg() == 2 {
+		dest = flags.Arg(1)
+	}
+	if dest == encrypted {
+		return withExitCode(exitConfig, fmt.Errorf("the output would overwrite %s, give an output path", encrypted))
+	}
+
+	return decryptFile(config, encrypted, dest)
+}
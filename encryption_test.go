@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+)
+
+// Encrypt data with a passphrase, returning the archive
+func encryptTestData(t *testing.T, data []byte, passphrase string) []byte {
+	t.Helper()
+
+	return encryptTestDataWithKeyID(t, data, passphrase, "")
+}
+
+// Encrypt data with a passphrase, recording its key ID
+func encryptTestDataWithKeyID(t *testing.T, data []byte, passphrase string, keyID string) []byte {
+	t.Helper()
+
+	var out bytes.Buffer
+	w, err := newEncryptingWriter(&out, passphrase, keyID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return out.Bytes()
+}
+
+// Get unnamed keys for passphrases
+func testKeys(passphrases ...string) []EncryptionKey {
+	keys := []EncryptionKey{}
+	for _, passphrase := range passphrases {
+		keys = append(keys, EncryptionKey{Passphrase: Secret(passphrase)})
+	}
+	return keys
+}
+
+// Decrypt an archive, failing the test if it can't be
+func decryptTestData(t *testing.T, archive []byte, keys []EncryptionKey) []byte {
+	t.Helper()
+
+	r, err := newDecryptingReader(bytes.NewReader(archive), keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return plain
+}
+
+func TestEncryptionRoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("dump "), encryptionChunkSize/2)
+	archive := encryptTestData(t, data, "secret")
+
+	r, err := newDecryptingReader(bytes.NewReader(archive), testKeys("secret"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := io.ReadAll(r)
+	if err != nil || !bytes.Equal(plain, data) {
+		t.Fatalf("decrypted %d bytes, want %d: %v", len(plain), len(data), err)
+	}
+
+	r, err = newDecryptingReader(bytes.NewReader(archive), testKeys("wrong"))
+	if err == nil {
+		_, err = io.ReadAll(r)
+	}
+	if err == nil {
+		t.Error("decrypting with the wrong passphrase succeeded")
+	}
+}
+
+func TestDecryptionRejectsExcessiveKeyParameters(t *testing.T) {
+	archive := encryptTestData(t, []byte("dump"), "secret")
+
+	tests := map[string]func(header []byte){
+		"time":    func(header []byte) { binary.LittleEndian.PutUint32(header[0:4], 1<<31) },
+		"memory":  func(header []byte) { binary.LittleEndian.PutUint32(header[4:8], 1<<31) },
+		"threads": func(header []byte) { header[8] = 0 },
+	}
+
+	for name, corrupt := range tests {
+		tampered := append([]byte{}, archive...)
+		corrupt(tampered[len(encryptionMagic):])
+
+		_, err := newDecryptingReader(bytes.NewReader(tampered), testKeys("secret"))
+		if err == nil || !strings.Contains(err.Error(), name) {
+			t.Errorf("excessive %s returned %v", name, err)
+		}
+	}
+}
+
+func TestDecryptionWithRotatedPassphrases(t *testing.T) {
+	config := Config{Encryption: EncryptionConfig{
+		Passphrase: "current",
+		KeyID:      "2026",
+		OldPassphrases: []EncryptionKey{
+			{KeyID: "2025", Passphrase: "previous"},
+			{Passphrase: "original"},
+		},
+	}}
+	keys := config.encryptionKeys()
+
+	tests := map[string][]byte{
+		"current":  encryptTestDataWithKeyID(t, []byte("current dump"), "current", "2026"),
+		"previous": encryptTestDataWithKeyID(t, []byte("previous dump"), "previous", "2025"),
+		// Archives from before key IDs are tried with every passphrase
+		"original": encryptTestData(t, []byte("original dump"), "original"),
+	}
+
+	for name, archive := range tests {
+		if plain := decryptTestData(t, archive, keys); string(plain) != name+" dump" {
+			t.Errorf("%s archive decrypted to %q", name, plain)
+		}
+	}
+
+	header, err := readEncryptionHeader(bytes.NewReader(tests["previous"]))
+	if err != nil || header.keyID != "2025" {
+		t.Errorf("read key ID %q, %v", header.keyID, err)
+	}
+
+	unknown := encryptTestDataWithKeyID(t, []byte("dump"), "lost", "2024")
+	_, err = newDecryptingReader(bytes.NewReader(unknown), keys[:2])
+	if err == nil || !strings.Contains(err.Error(), `key "2024"`) {
+		t.Errorf("decrypting with an unknown key ID returned %v", err)
+	}
+}
+
+func TestValidateEncryption(t *testing.T) {
+	errs := validationErrors{}
+	validateEncryption(&errs, EncryptionConfig{
+		KeyID: "2026",
+		OldPassphrases: []EncryptionKey{
+			{KeyID: "2026", Passphrase: "previous"},
+			{KeyID: "2025"},
+		},
+	})
+
+	got := fmt.Sprint(errs)
+	for _, want := range []string{"key_id is set without a passphrase", `"2026" is used more than once`, "old_passphrases[1] has no passphrase"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("validation errors %s, want %q", got, want)
+		}
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Get the client tool an engine dumps with, or "" for engines that pick one
+// per database or don't run one
+func (db DatabaseConfig) clientTool() string {
+	switch db.Engine {
+	case "mysql", "mariadb":
+		if db.DumpTool != "" {
+			return db.DumpTool
+		}
+		return "mysqldump"
+	case "mongodb":
+		return "mongodump"
+	case "redis":
+		return "redis-cli"
+	case "sqlite":
+		return "sqlite3"
+	case "mssql":
+		return "sqlcmd"
+	case "etcd":
+		return "etcdctl"
+	case "clickhouse":
+		return "clickhouse-client"
+	}
+
+	return ""
+}
+
+// Check the client tool of every configured engine is installed, so a missing
+// one fails at startup rather than at the first scheduled backup
+func checkClientTools(profiles []Config) error {
+	checked := map[string]bool{}
+
+	for _, profile := range profiles {
+		for _, db := range profile.Databases {
+			tool := db.clientTool()
+			if tool == "" || checked[tool] {
+				continue
+			}
+			checked[tool] = true
+
+			_, err := exec.LookPath(tool)
+			if err != nil {
+				return fmt.Errorf("%s is needed to back up %s databases: %w", tool, db.Engine, err)
+			}
+
+			if tool == "mysqldump" {
+				log.Printf("Using mysqldump %s\n", clientVersion())
+			}
+		}
+	}
+
+	return nil
+}
+
+// Write the password for mongodump to a --config file. The caller removes it.
+func mongoPasswordFile(config Config, db DatabaseConfig) (string, error) {
+	data, err := yaml.Marshal(map[string]string{"password": db.Password.reveal()})
+	if err != nil {
+		return "", err
+	}
+
+	return writeCredentialsFile(config.TempDir, "mongodump_*.yaml", data)
+}
+
+// Build the command to snapshot a Redis server. The RDB is streamed from the
+// server over the replication protocol, so this also works for remote hosts.
+func redisDumpCommand(ctx context.Context, db DatabaseConfig, dumpPath string) (string, *exec.Cmd) {
+	exportFile := dumpPath + ".rdb"
+
+	args := []string{"-h", db.connectHost(), "-p", fmt.Sprintf("%d", db.Port)}
+	if db.Username != "" {
+		args = append(args, "--user", db.Username)
+	}
+	args = append(args, "--rdb", exportFile)
+
+	// The password goes in the environment, out of the process list
+	cmd := dumpCommand(ctx, "redis-cli", args...)
+	if db.Password.reveal() != "" {
+		cmd.Env = append(os.Environ(), "REDISCLI_AUTH="+db.Password.reveal())
+	}
+
+	return exportFile, cmd
+}
+
+// Build the command to snapshot a SQLite database file using the online backup
+// API, which is safe while the application is still writing to it
+func sqliteDumpCommand(ctx context.Context, path string, dumpPath string) (string, *exec.Cmd) {
+	exportFile := dumpPath + ".sqlite"
+
+	return exportFile, dumpCommand(ctx, "sqlite3", "-bail", path, fmt.Sprintf(".backup '%s'", strings.ReplaceAll(exportFile, "'", "''")))
+}
+
+// Build the command to take a copy-only SQL Server backup. The .bak file is
+// written by the server itself, so the backups directory must be local to (or
+// shared with) the SQL Server host.
+func mssqlDumpCommand(ctx context.Context, db DatabaseConfig, dbName string, dumpPath string) (string, *exec.Cmd, error) {
+	if dbName == "*" {
+		return "", nil, fmt.Errorf("mssql does not support backing up all databases, list them by name")
+	}
+
+	exportFile := dumpPath + ".bak"
+
+	absolute, err := filepath.Abs(exportFile)
+	if err != nil {
+		return "", nil, err
+	}
+
+	query := fmt.Sprintf("BACKUP DATABASE [%s] TO DISK = N'%s' WITH COPY_ONLY, INIT",
+		strings.ReplaceAll(dbName, "]", "]]"), strings.ReplaceAll(absolute, "'", "''"))
+
+	cmd := dumpCommand(ctx, "sqlcmd", "-S", fmt.Sprintf("%s,%d", db.connectHost(), db.Port), "-U", db.Username, "-b", "-Q", query)
+	cmd.Env = append(os.Environ(), "SQLCMDPASSWORD="+db.Password.reveal())
+
+	return exportFile, cmd, nil
+}
+
+// Build the command to back up an InfluxDB database (v1) or bucket (v2) into a
+// directory. v2 authenticates with the password as an API token.
+func influxdbDumpCommand(ctx context.Context, db DatabaseConfig, dbName string, dumpPath string) (string, *exec.Cmd) {
+	exportFile := dumpPath
+
+	if db.InfluxVersion == 1 {
+		args := []string{"backup", "-portable", "-host", db.hostPort()}
+		if dbName != "*" {
+			args = append(args, "-database", dbName)
+		}
+
+		return exportFile, dumpCommand(ctx, "influxd", append(args, exportFile)...)
+	}
+
+	args := []string{"backup", exportFile, "--host", "http://" + db.hostPort()}
+	if dbName != "*" {
+		args = append(args, "--bucket", dbName)
+	}
+
+	cmd := dumpCommand(ctx, "influx", args...)
+	cmd.Env = append(os.Environ(), "INFLUX_TOKEN="+db.Password.reveal())
+
+	return exportFile, cmd
+}
+
+// Build the command to take an etcd snapshot, authenticating with TLS client
+// certificates and/or a username and password
+func etcdDumpCommand(ctx context.Context, db DatabaseConfig, dumpPath string) (string, *exec.Cmd) {
+	exportFile := dumpPath + ".db"
+
+	scheme := "http"
+	args := []string{}
+
+	if db.TLS.CA != "" || db.TLS.Cert != "" {
+		scheme = "https"
+	}
+	if db.TLS.CA != "" {
+		args = append(args, "--cacert="+db.TLS.CA)
+	}
+	if db.TLS.Cert != "" {
+		args = append(args, "--cert="+db.TLS.Cert, "--key="+db.TLS.Key)
+	}
+	args = append(args, fmt.Sprintf("--endpoints=%s://%s", scheme, db.hostPort()), "snapshot", "save", exportFile)
+
+	// Credentials go in the environment, out of the process list
+	cmd := dumpCommand(ctx, "etcdctl", args...)
+	cmd.Env = append(os.Environ(), "ETCDCTL_API=3")
+	if db.Username != "" {
+		cmd.Env = append(cmd.Env, "ETCDCTL_USER="+db.Username, "ETCDCTL_PASSWORD="+db.Password.reveal())
+	}
+
+	return exportFile, cmd
+}
+
+// Export an LDAP directory to LDIF. Local servers are exported with slapcat,
+// remote ones with ldapsearch including operational attributes. The name is
+// the suffix (base DN) to export, or "*" for slapcat's default database.
+func ldapDump(ctx context.Context, db DatabaseConfig, dbName string, exportFile string) error {
+	if isLocalHost(db.Host) {
+		args := []string{"-l", exportFile}
+		if dbName != "*" {
+			args = append(args, "-b", dbName)
+		}
+
+		_, err := commandOutput(dumpCommand(ctx, "slapcat", args...))
+		return err
+	}
+
+	if dbName == "*" {
+		return fmt.Errorf("remote ldap exports need the base DN as the name")
+	}
+
+	out, err := os.Create(exportFile)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	cmd := dumpCommand(ctx, "ldapsearch", "-LLL", "-x",
+		"-H", "ldap://"+db.hostPort(),
+		"-D", db.Username, "-y", "/dev/stdin",
+		"-b", dbName, "(objectClass=*)", "*", "+")
+	cmd.Stdin = strings.NewReader(db.Password.reveal())
+	cmd.Stdout = out
+
+	return cmd.Run()
+}
+
+// Run a user supplied shell command and capture its stdout as the dump. The
+// connection details are passed in the environment so they needn't be repeated
+// in the command.
+func commandDump(ctx context.Context, db DatabaseConfig, dbName string, exportFile string) error {
+	if db.Command == "" {
+		return fmt.Errorf("no command configured")
+	}
+
+	out, err := os.Create(exportFile)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	var stderr strings.Builder
+
+	cmd := dumpCommand(ctx, "sh", "-c", db.Command)
+	cmd.Stdout = out
+	cmd.Stderr = &stderr
+	cmd.Env = append(os.Environ(),
+		"DBBACKUP_HOST="+db.connectHost(),
+		fmt.Sprintf("DBBACKUP_PORT=%d", db.Port),
+		"DBBACKUP_USERNAME="+db.Username,
+		"DBBACKUP_PASSWORD="+db.Password.reveal(),
+		"DBBACKUP_NAME="+dbName,
+	)
+
+	err = runProcessGroup(ctx, cmd)
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+
+	return nil
+}
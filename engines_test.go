@@ -0,0 +1,146 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestDumpingCommand(t *testing.T) {
+	for _, args := range [][]string{nil, {"backup", "--only", "shop"}, {"--once"}, {"serve"}} {
+		if !dumpingCommand(args) {
+			t.Errorf("%v doesn't dump", args)
+		}
+	}
+
+	for _, args := range [][]string{{"restore", "key", "shop"}, {"history"}, {"monitor"}, {"schedule"}, {"prune"}} {
+		if dumpingCommand(args) {
+			t.Errorf("%v dumps", args)
+		}
+	}
+
+	// Seeding dumps, but isn't a backup to recover crashed runs before
+	if !dumpingCommand([]string{"seed"}) || backupCommand([]string{"seed"}) {
+		t.Error("seed is treated as a backup or doesn't dump")
+	}
+	if backupCommand([]string{"restore"}) || !backupCommand(nil) {
+		t.Error("backup commands misidentified")
+	}
+}
+
+func TestCheckClientTools(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("fake tools are shell scripts")
+	}
+
+	dir := t.TempDir()
+	t.Setenv("PATH", dir)
+	if err := os.WriteFile(filepath.Join(dir, "redis-cli"), []byte("#!/bin/sh\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	// Engines without a client tool, or with one installed, pass
+	profiles := []Config{{Databases: []DatabaseConfig{{Engine: "redis"}, {Engine: "files"}}}}
+	if err := checkClientTools(profiles); err != nil {
+		t.Errorf("checking installed tools returned %v", err)
+	}
+
+	profiles = append(profiles, Config{Databases: []DatabaseConfig{{Engine: "mysql", DumpTool: "mysqlpump"}}})
+	err := checkClientTools(profiles)
+	if err == nil || !strings.Contains(err.Error(), "mysqlpump") {
+		t.Errorf("checking a missing tool returned %v", err)
+	}
+}
+
+// Check no argument of a command holds the secret, and its environment does
+func checkSecretInEnv(t *testing.T, args []string, env []string, variable string, secret string) {
+	t.Helper()
+
+	for _, arg := range args {
+		if strings.Contains(arg, secret) {
+			t.Errorf("secret in argument %q", arg)
+		}
+	}
+
+	for _, value := range env {
+		if value == variable+"="+secret {
+			return
+		}
+	}
+	t.Errorf("%s not set to the secret", variable)
+}
+
+func TestPasswordsStayOutOfArguments(t *testing.T) {
+	db := DatabaseConfig{Host: "db", Port: 6379, Username: "backup", Password: "hunter2"}
+
+	_, redis := redisDumpCommand(context.Background(), db, "dump")
+	checkSecretInEnv(t, redis.Args, redis.Env, "REDISCLI_AUTH", "hunter2")
+
+	_, etcd := etcdDumpCommand(context.Background(), db, "dump")
+	checkSecretInEnv(t, etcd.Args, etcd.Env, "ETCDCTL_PASSWORD", "hunter2")
+
+	checkSecretInEnv(t, mysqlConnectionArgs(db), mysqlEnv(db), "MYSQL_PWD", "hunter2")
+}
+
+// Get the value of a --name= argument
+func argValue(args []string, name string) string {
+	for _, arg := range args {
+		if strings.HasPrefix(arg, name+"=") {
+			return strings.TrimPrefix(arg, name+"=")
+		}
+	}
+	return ""
+}
+
+func TestPasswordsInCredentialsFiles(t *testing.T) {
+	db := DatabaseConfig{Engine: "mongodb", Host: "db", Port: 27017, Username: "backup", Password: `hun"ter<2>`}
+	config := Config{TempDir: t.TempDir(), DumpDir: t.TempDir()}
+
+	// Read each tool's credentials file while it runs
+	fake := newFakeCommands()
+	files := map[string]string{}
+	fake.answer = func(args []string) (string, error) {
+		for _, arg := range args {
+			if strings.Contains(arg, "hun") {
+				t.Errorf("secret in argument %q", arg)
+			}
+		}
+
+		path := argValue(args, "--config")
+		if path == "" {
+			path = argValue(args, "--config-file")
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Errorf("%s has no credentials file: %s", args[0], err)
+			return "", nil
+		}
+		if info, err := os.Stat(path); err == nil && runtime.GOOS != "windows" && info.Mode().Perm() != 0600 {
+			t.Errorf("%s is readable by others: %s", path, info.Mode())
+		}
+		files[filepath.Base(args[0])] = string(data)
+		return "", nil
+	}
+	runner = fake
+	defer func() { runner = systemCommands{} }()
+
+	backupDatabaseAt(context.Background(), config, db, "shop", nil, "manual")
+	if want := "password: hun\"ter<2>\n"; files["mongodump"] != want {
+		t.Errorf("mongodump config is %q, want %q", files["mongodump"], want)
+	}
+
+	db.Engine = "clickhouse"
+	clickhouseQuery(context.Background(), db, "SELECT 1")
+	if want := "<config><password>hun&#34;ter&lt;2&gt;</password></config>\n"; files["clickhouse-client"] != want {
+		t.Errorf("clickhouse-client config is %q, want %q", files["clickhouse-client"], want)
+	}
+
+	// Removed once the tools are done
+	left, _ := filepath.Glob(filepath.Join(config.TempDir, "mongodump_*"))
+	if len(left) != 0 {
+		t.Errorf("credentials files left: %v", left)
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Holds the whole configuration as JSON (or YAML), used instead of a file
+const configDataVariable = "DBBACKUP_CONFIG_JSON"
+
+// Prefix of variables setting a single option, e.g. DBBACKUP_CRON_INTERVAL or
+// DBBACKUP_S3_CONFIG__BUCKET, with "__" between nested keys
+const configVariablePrefix = "DBBACKUP_"
+
+// Get the top-level configuration keys, so variables the tool sets for
+// command engines or reads for other reasons aren't taken as options
+func configKeys() map[string]bool {
+	keys := map[string]bool{}
+
+	t := reflect.TypeOf(Config{})
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if name != "" && name != "-" {
+			keys[name] = true
+		}
+	}
+
+	return keys
+}
+
+// Parse a variable's value as YAML, so numbers, booleans and JSON lists and
+// objects work, falling back to the plain string
+func envValue(value string) *yaml.Node {
+	var document yaml.Node
+	if yaml.Unmarshal([]byte(value), &document) == nil && len(document.Content) > 0 {
+		return document.Content[0]
+	}
+
+	return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: value}
+}
+
+// Build a configuration document from the DBBACKUP_ variables, or nil if
+// none are set. Lists given this way are added to those from the file.
+func envConfig(environ []string) ([]byte, error) {
+	keys := configKeys()
+	settings := map[string]interface{}{}
+
+	sort.Strings(environ)
+	for _, variable := range environ {
+		name, value, ok := strings.Cut(variable, "=")
+		if !ok || !strings.HasPrefix(name, configVariablePrefix) {
+			continue
+		}
+
+		path := strings.Split(strings.ToLower(strings.TrimPrefix(name, configVariablePrefix)), "__")
+		if !keys[path[0]] {
+			continue
+		}
+
+		parent := settings
+		for _, key := range path[:len(path)-1] {
+			child, ok := parent[key].(map[string]interface{})
+			if !ok {
+				if _, set := parent[key]; set {
+					return nil, fmt.Errorf("%s conflicts with another variable setting %s", name, key)
+				}
+				child = map[string]interface{}{}
+				parent[key] = child
+			}
+			parent = child
+		}
+
+		last := path[len(path)-1]
+		if _, set := parent[last]; set {
+			return nil, fmt.Errorf("%s conflicts with another variable setting %s", name, last)
+		}
+		parent[last] = envValue(value)
+	}
+
+	if len(settings) == 0 {
+		return nil, nil
+	}
+
+	return yaml.Marshal(settings)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"log"
+	"os"
+)
+
+// Exit codes, so wrapper scripts and monitoring can tell failures apart
+const (
+	exitOK      = 0
+	exitFailure = 1 // Anything not covered below
+	exitConfig  = 2 // The configuration couldn't be loaded or is invalid
+	exitDump    = 3 // No database could be dumped
+	exitUpload  = 4 // The dumps couldn't be uploaded or replicated
+	exitPartial = 5 // Uploaded, but some databases failed
+	exitLocked  = 6 // Another backup run was already in progress
+	exitTimeout = 7 // The run was aborted after exceeding max_run_duration or the --once timeout
+
+	exitCancelled = 130 // Interrupted by a signal, as shells report for Ctrl-C
+)
+
+// An error carrying the exit code it should end the process with
+type ExitError struct {
+	Code int
+	Err  error
+}
+
+func (e *ExitError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ExitError) Unwrap() error {
+	return e.Err
+}
+
+// Attach an exit code to an error
+func withExitCode(code int, err error) error {
+	if err == nil {
+		return nil
+	}
+
+	return &ExitError{Code: code, Err: err}
+}
+
+// Get the exit code for an error, defaulting to a generic failure. Asking a
+// command for --help isn't a failure.
+func exitCode(err error) int {
+	if err == nil || errors.Is(err, flag.ErrHelp) {
+		return exitOK
+	}
+
+	var exitErr *ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.Code
+	}
+
+	return exitFailure
+}
+
+// Log a message and exit with the given code. Nothing is logged for exitOK,
+// which comes from --help, the flag package having printed the usage already.
+func fatal(code int, format string, args ...interface{}) {
+	if code != exitOK {
+		log.Printf(format, args...)
+	}
+	os.Exit(code)
+}
+
+// Get the exit code describing how a run went
+func (r *RunReport) exitCode() int {
+	if r.Success {
+		return exitOK
+	}
+
+	if r.Cancelled {
+		return exitCancelled
+	}
+
+	if r.TimedOut {
+		return exitTimeout
+	}
+
+	if r.preDumpExit != 0 {
+		return r.preDumpExit
+	}
+
+	failed := 0
+	for _, db := range r.Databases {
+		if !db.Success {
+			failed++
+		}
+	}
+
+	if len(r.Databases) > 0 && failed == len(r.Databases) {
+		return exitDump
+	}
+
+	if !r.Uploaded {
+		return exitUpload
+	}
+	for _, replica := range r.Replicas {
+		if replica.Error != "" {
+			return exitUpload
+		}
+	}
+
+	if failed > 0 {
+		return exitPartial
+	}
+
+	return exitFailure
+}
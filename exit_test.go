@@ -0,0 +1,42 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"testing"
+)
+
+func TestRunExitCode(t *testing.T) {
+	tests := []struct {
+		name   string
+		report RunReport
+		want   int
+	}{
+		{"success", RunReport{Success: true}, exitOK},
+		{"credentials", RunReport{Error: "expired token", preDumpExit: exitConfig}, exitConfig},
+		{"free space", RunReport{Error: "not enough space", preDumpExit: exitDump}, exitDump},
+		{"every dump failed", RunReport{Databases: []DatabaseReport{{}}}, exitDump},
+		{"upload", RunReport{Databases: []DatabaseReport{{Success: true}}}, exitUpload},
+		{"partial", RunReport{Uploaded: true, Databases: []DatabaseReport{{Success: true}, {}}}, exitPartial},
+		{"timed out", RunReport{TimedOut: true, preDumpExit: exitConfig}, exitTimeout},
+	}
+
+	for _, test := range tests {
+		if got := test.report.exitCode(); got != test.want {
+			t.Errorf("%s: exit code %d, want %d", test.name, got, test.want)
+		}
+	}
+}
+
+func TestErrorExitCode(t *testing.T) {
+	if code := exitCode(fmt.Errorf("parsing: %w", flag.ErrHelp)); code != exitOK {
+		t.Errorf("--help exits %d", code)
+	}
+	if code := exitCode(withExitCode(exitConfig, errors.New("bad flag"))); code != exitConfig {
+		t.Errorf("config error exits %d", code)
+	}
+	if code := exitCode(errors.New("unknown")); code != exitFailure {
+		t.Errorf("plain error exits %d", code)
+	}
+}
@@ -0,0 +1,24 @@
+//go:build linux && (amd64 || arm64)
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	fadvSequential = 2
+	fadvDontNeed   = 4
+)
+
+// Tell the kernel a file is about to be read from start to end
+func adviseSequential(file *os.File) {
+	syscall.Syscall6(syscall.SYS_FADVISE64, file.Fd(), 0, 0, fadvSequential, 0, 0)
+}
+
+// Drop a file's pages from the page cache, so staging backups doesn't evict
+// the database's own pages. Only pages already written to disk are dropped.
+func dropPageCache(file *os.File) {
+	syscall.Syscall6(syscall.SYS_FADVISE64, file.Fd(), 0, 0, fadvDontNeed, 0, 0)
+}
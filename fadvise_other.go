@@ -0,0 +1,10 @@
+//go:build !linux || !(amd64 || arm64)
+
+package main
+
+import "os"
+
+// Page cache hints are only given on Linux
+func adviseSequential(file *os.File) {}
+
+func dropPageCache(file *os.File) {}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Hold what the files engine archives, such as an application's uploads, so
+// they're backed up in the same run as its database
+type FilesConfig struct {
+	// Files, directories or globs to archive, e.g. "/srv/app/uploads" or
+	// "C:\inetpub\app\uploads"
+	Paths []string `yaml:"paths"`
+
+	// Globs matched against each path and name to leave out, e.g. "*.tmp"
+	Exclude []string `yaml:"exclude"`
+
+	// Archive from a snapshot so files changed during the backup are still
+	// consistent with each other: "vss" on Windows or "lvm" on Linux
+	Snapshot string `yaml:"snapshot"`
+
+	// The logical volume snapshotted with "lvm"
+	LVM LVMConfig `yaml:"lvm"`
+}
+
+// Hold the logical volume the paths are on, for LVM snapshots
+type LVMConfig struct {
+	// Logical volume and where it's mounted, e.g. "/dev/vg0/data" on "/srv"
+	Volume     string `yaml:"volume"`
+	MountPoint string `yaml:"mount_point"`
+
+	// Space for changes made while the snapshot exists, e.g. "2G". Defaults to 1G.
+	Size string `yaml:"size"`
+}
+
+// A read-only copy of a volume at a point in time
+type fileSnapshot struct {
+	// Where the volume normally is, and where its snapshot can be read
+	source string
+	root   string
+
+	// Delete the snapshot
+	remove func() error
+}
+
+// Delete snapshots, logging any that can't be. Left behind, they use up
+// space as the volume changes.
+func removeSnapshots(snapshots []fileSnapshot) {
+	for _, snapshot := range snapshots {
+		if err := snapshot.remove(); err != nil {
+			log.Printf("Error removing snapshot of %s: %s\n", snapshot.source, err.Error())
+		}
+	}
+}
+
+// Find where a path can be read in the snapshots, if it's in one of them
+func snapshotPath(snapshots []fileSnapshot, path string) string {
+	for _, snapshot := range snapshots {
+		rel, err := filepath.Rel(snapshot.source, path)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return filepath.Join(snapshot.root, rel)
+		}
+	}
+
+	return path
+}
+
+// Find where a path read from the snapshots normally is
+func originalPath(snapshots []fileSnapshot, path string) string {
+	for _, snapshot := range snapshots {
+		rel, err := filepath.Rel(snapshot.root, path)
+		if err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			return filepath.Join(snapshot.source, rel)
+		}
+	}
+
+	return path
+}
+
+// Name a file in the archive by its absolute path, without the leading slash
+// and with a Windows drive as its first directory, e.g. "C/inetpub/app", so
+// extracting it at the root puts it back
+func filesArchiveName(path string) string {
+	volume := filepath.VolumeName(path)
+	name := strings.TrimSuffix(volume, ":") + path[len(volume):]
+
+	return strings.TrimPrefix(filepath.ToSlash(name), "/")
+}
+
+// Check whether a path matches one of the exclude globs, by its full path
+// or its name
+func excludedFile(exclude []string, path string) bool {
+	for _, pattern := range exclude {
+		if ok, _ := filepath.Match(pattern, path); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(pattern, filepath.Base(path)); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Run a snapshot command, including its output in the error
+func runSnapshotCommand(cmd *exec.Cmd) (string, error) {
+	output, err := commandCombinedOutput(cmd)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w: %s", filepath.Base(cmd.Path), err, strings.TrimSpace(string(output)))
+	}
+
+	return string(output), nil
+}
+
+// Snapshot an LVM logical volume and mount it read-only
+func lvmSnapshot(ctx context.Context, lvm LVMConfig) ([]fileSnapshot, error) {
+	size := lvm.Size
+	if size == "" {
+		size = "1G"
+	}
+
+	name := filepath.Base(lvm.Volume) + "_dbbackup"
+	device := filepath.Join(filepath.Dir(lvm.Volume), name)
+
+	_, err := runSnapshotCommand(exec.CommandContext(ctx, "lvcreate", "--snapshot", "--size", size, "--name", name, lvm.Volume))
+	if err != nil {
+		return nil, err
+	}
+
+	removeVolume := func() error {
+		_, err := runSnapshotCommand(exec.Command("lvremove", "--force", device))
+		return err
+	}
+
+	root, err := os.MkdirTemp("", "dbbackup-lvm-")
+	if err == nil {
+		_, err = runSnapshotCommand(exec.CommandContext(ctx, "mount", "-o", "ro", device, root))
+		if err != nil {
+			// XFS refuses to mount a second filesystem with the same UUID
+			_, err = runSnapshotCommand(exec.CommandContext(ctx, "mount", "-o", "ro,nouuid", device, root))
+		}
+		if err != nil {
+			os.Remove(root)
+		}
+	}
+	if err != nil {
+		if removeErr := removeVolume(); removeErr != nil {
+			log.Printf("Error removing snapshot %s: %s\n", device, removeErr.Error())
+		}
+		return nil, err
+	}
+
+	return []fileSnapshot{{
+		source: lvm.MountPoint,
+		root:   root,
+		remove: func() error {
+			_, err := runSnapshotCommand(exec.Command("umount", root))
+			if err != nil {
+				return err
+			}
+			os.Remove(root)
+			return removeVolume()
+		},
+	}}, nil
+}
+
+// Archive the configured paths into a tar.gz, from a snapshot when one is
+// configured. Directories are archived with everything in them, and
+// symlinks as links.
+func filesDump(ctx context.Context, config Config, files FilesConfig, exportFile string) error {
+	var snapshots []fileSnapshot
+	var err error
+
+	switch files.Snapshot {
+	case "vss":
+		snapshots, err = vssSnapshots(ctx, files.Paths)
+	case "lvm":
+		snapshots, err = lvmSnapshot(ctx, files.LVM)
+	}
+	if err != nil {
+		return fmt.Errorf("error taking snapshot: %w", err)
+	}
+	defer removeSnapshots(snapshots)
+
+	out, err := os.Create(exportFile)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	gw, err := gzip.NewWriterLevel(out, config.CompressionLevel)
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(gw)
+
+	for _, pattern := range files.Paths {
+		matches, err := filepath.Glob(snapshotPath(snapshots, pattern))
+		if err == nil && len(matches) == 0 {
+			err = fmt.Errorf("no files match")
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", pattern, err)
+		}
+
+		for _, match := range matches {
+			err = filepath.Walk(match, func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+
+				original := originalPath(snapshots, path)
+				if excludedFile(files.Exclude, original) {
+					if info.IsDir() {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+
+				return addFileToArchive(ctx, tw, path, info, filesArchiveName(original))
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	err = tw.Close()
+	if err == nil {
+		err = gw.Close()
+	}
+	if err == nil {
+		err = out.Close()
+	}
+
+	return err
+}
+
+// Add a file, directory or symlink to an archive of files. Anything else,
+// such as sockets, is left out.
+func addFileToArchive(ctx context.Context, tw *tar.Writer, path string, info os.FileInfo, name string) error {
+	header := &tar.Header{
+		Name:    name,
+		Mode:    int64(info.Mode().Perm()),
+		ModTime: info.ModTime(),
+		Format:  tar.FormatPAX,
+	}
+
+	switch {
+	case info.Mode().IsRegular():
+		return addToArchive(ctx, tw, path, name)
+	case info.IsDir():
+		header.Typeflag = tar.TypeDir
+		header.Name += "/"
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(path)
+		if err != nil {
+			return err
+		}
+		header.Typeflag = tar.TypeSymlink
+		header.Linkname = target
+	default:
+		log.Printf("Skipping %s, it isn't a regular file\n", path)
+		return nil
+	}
+
+	return tw.WriteHeader(header)
+}
+
+// Check the files engine's settings
+func validateFiles(errs *validationErrors, where string, files FilesConfig) {
+	if len(files.Paths) == 0 {
+		errs.add("%s: files.paths is required for the files engine", where)
+	}
+	for _, path := range files.Paths {
+		if !filepath.IsAbs(path) {
+			errs.add("%s: files.paths must be absolute, got %q", where, path)
+		}
+	}
+
+	switch files.Snapshot {
+	case "":
+	case "vss":
+		if runtime.GOOS != "windows" {
+			errs.add("%s: files.snapshot vss is only available on Windows", where)
+		}
+	case "lvm":
+		if runtime.GOOS != "linux" {
+			errs.add("%s: files.snapshot lvm is only available on Linux", where)
+		}
+		if files.LVM.Volume == "" || files.LVM.MountPoint == "" {
+			errs.add("%s: files.lvm.volume and files.lvm.mount_point are required for lvm snapshots", where)
+		}
+		for _, path := range files.Paths {
+			rel, err := filepath.Rel(files.LVM.MountPoint, path)
+			if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				errs.add("%s: %q isn't under files.lvm.mount_point %q", where, path, files.LVM.MountPoint)
+			}
+		}
+	default:
+		errs.add("%s: unknown files.snapshot %q, expected vss or lvm", where, files.Snapshot)
+	}
+}
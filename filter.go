@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// Narrows a one-shot run to some of the configured databases
+type RunFilter struct {
+	Only       []string
+	Hosts      []string
+	LabelKey   string
+	LabelValue string
+}
+
+// Split a comma separated flag value, dropping empty entries
+func splitList(value string) []string {
+	list := []string{}
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+
+	return list
+}
+
+// Check whether a list contains a value
+func contains(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Return a copy of the config with only the databases the filter matches,
+// or an error if it matches none
+func (filter RunFilter) apply(config Config) (Config, error) {
+	databases := []DatabaseConfig{}
+
+	for _, db := range config.Databases {
+		if len(filter.Hosts) > 0 && !contains(filter.Hosts, db.Host) {
+			continue
+		}
+		if filter.LabelKey != "" && mergeLabels(config.Labels, db.Labels)[filter.LabelKey] != filter.LabelValue {
+			continue
+		}
+
+		names := db.DBNames
+		if db.DBName != "" {
+			names = append(names, db.DBName)
+		}
+
+		if len(filter.Only) > 0 {
+			matched := []string{}
+			for _, name := range names {
+				if contains(filter.Only, name) {
+					matched = append(matched, name)
+				}
+			}
+			names = matched
+		}
+
+		if len(names) == 0 {
+			continue
+		}
+
+		db.DBName = ""
+		db.DBNames = names
+		databases = append(databases, db)
+	}
+
+	if len(databases) == 0 {
+		return config, fmt.Errorf("no configured databases match the filter")
+	}
+
+	config.Databases = databases
+	return config, nil
+}
+
+// Handle the backup subcommand, running a single backup of the databases
+// matching the flags. Usage: backup [--only db1,db2] [--host hostA] [--label key=value] [--stdout]
+func runBackupCommand(ctx context.Context, config Config, args []string) (*RunReport, error) {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	only := flags.String("only", "", "comma separated database names to back up")
+	hosts := flags.String("host", "", "comma separated hosts to back up")
+	label := flags.String("label", "", "only back up databases with this label, e.g. team=payments")
+	stdout := flags.Bool("stdout", false, "write the archive to stdout instead of uploading it")
+	profileDir := flags.String("profile", "", "write CPU, heap and blocking profiles of the run to this directory")
+	simulate := flags.String("simulate-failure", "", "make the run fail at dump, upload or notify, to test alerting")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return nil, withExitCode(exitConfig, err)
+	}
+
+	filter := RunFilter{Only: splitList(*only), Hosts: splitList(*hosts)}
+	if *label != "" {
+		filter.LabelKey, filter.LabelValue, err = parseLabel(*label)
+		if err != nil {
+			return nil, withExitCode(exitConfig, err)
+		}
+	}
+
+	config, err = simulateFailure(config, *simulate)
+	if err != nil {
+		return nil, withExitCode(exitConfig, err)
+	}
+
+	config, err = withInventory(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	config, err = filter.apply(config)
+	if err != nil {
+		return nil, withExitCode(exitConfig, err)
+	}
+
+	for _, db := range config.Databases {
+		log.Printf("Backing up %s on %s\n", strings.Join(db.DBNames, ", "), db.Host)
+	}
+
+	if *profileDir != "" {
+		stop, err := startProfiling(*profileDir)
+		if err != nil {
+			return nil, err
+		}
+		defer stop()
+	}
+
+	if *stdout {
+		return runBackupToWriter(ctx, config, os.Stdout), nil
+	}
+
+	return runBackups(ctx, config, commandTrigger()), nil
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Hold the freshness of a single configured database
+type DatabaseFreshness struct {
+	Engine      string
+	Host        string
+	Name        string
+	LastSuccess time.Time
+	MaxAge      time.Duration
+	Notify      []string
+}
+
+// Work out whether the database has gone too long without a successful backup
+func (f DatabaseFreshness) stale(now time.Time, since time.Time) bool {
+	if f.MaxAge <= 0 {
+		return false
+	}
+
+	last := f.LastSuccess
+	if last.IsZero() {
+		last = since
+	}
+
+	return now.Sub(last) > f.MaxAge
+}
+
+// Get the maximum allowed age for a database's latest successful backup
+func (config Config) maxBackupAge(db DatabaseConfig) time.Duration {
+	spec := config.MaxBackupAge
+	if db.MaxBackupAge != "" {
+		spec = db.MaxBackupAge
+	}
+
+	if spec == "" {
+		return 0
+	}
+
+	age, err := parseDuration(spec)
+	if err != nil {
+		log.Printf("Invalid max backup age %q: %s\n", spec, err.Error())
+		return 0
+	}
+
+	return age
+}
+
+// List the freshness of every configured database using the run history
+func databaseFreshness(config Config, reports []RunReport) []DatabaseFreshness {
+	lastSuccess := map[string]time.Time{}
+	for _, status := range databaseStatuses(reports) {
+		lastSuccess[status.Engine+"/"+status.Host+"/"+status.Name] = status.LastSuccess
+	}
+
+	freshness := []DatabaseFreshness{}
+
+	for _, db := range config.Databases {
+		names := db.DBNames
+		if db.DBName != "" {
+			names = append(names, db.DBName)
+		}
+
+		for _, name := range names {
+			freshness = append(freshness, DatabaseFreshness{
+				Engine:      db.Engine,
+				Host:        db.Host,
+				Name:        name,
+				LastSuccess: lastSuccess[db.Engine+"/"+db.Host+"/"+name],
+				MaxAge:      config.maxBackupAge(db),
+				Notify:      db.Notify,
+			})
+		}
+	}
+
+	return freshness
+}
+
+// Get a loader for the run history written by this machine
+func loadLocalReports(config Config) func(context.Context) ([]RunReport, error) {
+	return func(context.Context) ([]RunReport, error) {
+		return loadReports(config.ReportsDir)
+	}
+}
+
+// Periodically check every database's latest successful backup and send an alert
+// when it is older than the configured maximum age. Runs independently of the
+// backup schedule so a schedule that never fires is still caught. load gets the
+// run history, newest first. Blocks until the context is cancelled.
+func watchFreshness(ctx context.Context, config Config, load func(context.Context) ([]RunReport, error)) {
+	started := clk.Now()
+	alerted := map[string]bool{}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-clk.After(time.Minute):
+		}
+
+		// Backups are expected to go stale during planned maintenance
+		if config.activePause() != nil {
+			continue
+		}
+
+		reports, err := load(ctx)
+		if err != nil {
+			log.Printf("Error loading reports: %s\n", err.Error())
+			continue
+		}
+
+		now := clk.Now()
+
+		for _, f := range databaseFreshness(config, reports) {
+			key := f.Engine + "/" + f.Host + "/" + f.Name
+
+			if !f.stale(now, started) {
+				alerted[key] = false
+				continue
+			}
+
+			if alerted[key] {
+				continue
+			}
+			alerted[key] = true
+
+			last := "never"
+			if !f.LastSuccess.IsZero() {
+				last = f.LastSuccess.Format(time.RFC3339)
+			}
+
+			log.Printf("No successful backup of %s database %s on host %s within %s (last success: %s)\n", f.Engine, f.Name, f.Host, f.MaxAge, last)
+
+			sendNotification(ctx, config, Notification{
+				Event:   "backup.stale",
+				Subject: fmt.Sprintf("Backup of %s on %s is stale", f.Name, f.Host),
+				Message: fmt.Sprintf("No successful backup of %s database %s on host %s within %s (last success: %s)", f.Engine, f.Name, f.Host, f.MaxAge, last),
+				routes:  f.Notify,
+			})
+		}
+	}
+}
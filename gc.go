@@ -0,0 +1,419 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// What the retained run reports and restore records refer to, which garbage
+// collection must leave alone
+type gcReferences struct {
+	// Keys recorded against a particular target
+	targetKeys map[string]map[string]bool
+
+	// Keys referenced wherever they are, e.g. tiered archives and dedup indexes
+	keys map[string]bool
+
+	// Names referenced under each target's configured prefix
+	names map[string]bool
+
+	// Dedup indexes of the retained runs
+	indexes []string
+}
+
+// Collect everything the reports in reports_dir refer to. A report failing its
+// signature check stops garbage collection, as its backups would otherwise
+// look unreferenced.
+func collectReferences(config Config) (gcReferences, error) {
+	files, err := loadReportFiles(config.ReportsDir)
+	if err != nil {
+		return gcReferences{}, err
+	}
+
+	refs, err := reportReferences(config, files)
+	if err != nil {
+		return refs, err
+	}
+
+	records, err := filepath.Glob(filepath.Join(config.ReportsDir, restoreRecordPrefix+"*.json"))
+	if err != nil {
+		return refs, err
+	}
+	for _, record := range records {
+		refs.names[catalogNamePrefix+filepath.Base(record)] = true
+		refs.names[catalogNamePrefix+filepath.Base(record)+signatureExtension] = true
+	}
+
+	return refs, nil
+}
+
+// Collect everything the given reports refer to, including the older archives
+// their differentials and unchanged databases point at
+func reportReferences(config Config, files []ReportFile) (gcReferences, error) {
+	refs := gcReferences{targetKeys: map[string]map[string]bool{}, keys: map[string]bool{}, names: map[string]bool{}}
+
+	addTargetKeys := func(targets []TargetReport) {
+		for _, target := range targets {
+			if refs.targetKeys[target.Name] == nil {
+				refs.targetKeys[target.Name] = map[string]bool{}
+			}
+			refs.targetKeys[target.Name][target.Key] = true
+		}
+	}
+
+	for _, file := range files {
+		if config.Signing.enabled() {
+			if err := verifyFile(config, file.Path); err != nil {
+				return refs, fmt.Errorf("report %s failed its signature check: %w", file.Path, err)
+			}
+		}
+		report := file.Report
+
+		for _, key := range report.archiveKeys() {
+			refs.keys[key] = true
+			refs.names[path.Base(key)] = true
+		}
+		for _, moved := range report.Tiered {
+			refs.keys[moved] = true
+		}
+		for _, db := range report.Databases {
+			for _, ref := range []*BackupReference{db.Base, db.Reference} {
+				if ref != nil && ref.ArchiveKey != "" {
+					refs.keys[ref.ArchiveKey] = true
+					refs.names[path.Base(ref.ArchiveKey)] = true
+				}
+			}
+		}
+		addTargetKeys(report.Targets)
+		addTargetKeys(report.Replicas)
+
+		if report.Dedup != nil && report.ArchiveKey != "" {
+			refs.indexes = append(refs.indexes, report.ArchiveKey)
+		}
+
+		// The uploaded and mirrored copies of the report itself
+		timestamp := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(file.Path), "report_"), ".json")
+		for _, name := range []string{backupNamePrefix + timestamp + ".report.json", catalogNamePrefix + filepath.Base(file.Path)} {
+			refs.names[name] = true
+			refs.names[name+signatureExtension] = true
+		}
+	}
+
+	return refs, nil
+}
+
+// Check whether an object on a target is referenced. Names only count under
+// the target's configured prefix, so copies left under an old prefix are
+// collected.
+func (refs gcReferences) referenced(target TargetConfig, key string) bool {
+	if refs.keys[key] || refs.targetKeys[target.Name][key] {
+		return true
+	}
+
+	return path.Dir(key) == path.Clean(target.Prefix) && refs.names[path.Base(key)]
+}
+
+// Check whether an object was written by this tool, the only ones collected
+func gcCandidate(key string) bool {
+	name := path.Base(key)
+	return strings.HasPrefix(name, backupNamePrefix) || strings.HasPrefix(name, catalogNamePrefix)
+}
+
+// List every object under a target's prefix, including those in
+// subdirectories of a local target
+func (target TargetConfig) listAll(ctx context.Context) ([]StoredObject, error) {
+	if target.Type != "local" {
+		objects, err := target.listPrefix(ctx, "")
+		if err != nil || target.Prefix == "" {
+			return objects, err
+		}
+
+		// Skip the neighbours of the prefix, e.g. "backups-old" beside "backups"
+		inside := []StoredObject{}
+		for _, object := range objects {
+			if strings.HasPrefix(object.Key, strings.TrimSuffix(target.Prefix, "/")+"/") {
+				inside = append(inside, object)
+			}
+		}
+		return inside, nil
+	}
+
+	objects := []StoredObject{}
+	root := filepath.Join(target.Path, target.Prefix)
+
+	err := filepath.WalkDir(root, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && file == root {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if entry.IsDir() {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(root, file)
+		if err != nil {
+			return err
+		}
+
+		objects = append(objects, StoredObject{
+			Key:          target.key(filepath.ToSlash(rel)),
+			Size:         info.Size(),
+			LastModified: info.ModTime(),
+		})
+		return nil
+	})
+
+	return objects, err
+}
+
+// Totals of a garbage collection
+type gcResult struct {
+	objects int
+	bytes   int64
+	uploads int
+}
+
+// Delete the tool's objects on each target that no retained report refers
+// to, and abort multipart uploads left behind by failed runs. Objects younger
+// than minAge are kept, as a running backup may not have written its report
+// yet. prefix, when set, is scanned instead of each target's own, e.g. to
+// clear out a prefix backups used to be stored under.
+func collectGarbage(ctx context.Context, config Config, prefix string, minAge time.Duration, dryRun bool, trigger string) (gcResult, error) {
+	result := gcResult{}
+
+	refs, err := collectReferences(config)
+	if err != nil {
+		return result, err
+	}
+
+	cutoff := clk.Now().Add(-minAge)
+	verb := "Deleting"
+	if dryRun {
+		verb = "Would delete"
+	}
+
+	for _, target := range config.targets() {
+		scanned := target
+		if prefix != "" {
+			scanned.Prefix = prefix
+		}
+
+		objects, err := scanned.listAll(ctx)
+		if err != nil {
+			return result, fmt.Errorf("error listing %s: %w", target.Name, err)
+		}
+
+		for _, object := range objects {
+			if !gcCandidate(object.Key) || !object.LastModified.Before(cutoff) || refs.referenced(target, object.Key) {
+				continue
+			}
+
+			log.Printf("%s unreferenced %s from %s (%s)\n", verb, object.Key, target.Name, formatBytes(object.Size))
+			result.objects++
+			result.bytes += object.Size
+			if dryRun {
+				continue
+			}
+
+			err := target.delete(ctx, object.Key)
+			if err != nil {
+				log.Printf("Error deleting %s from %s: %s\n", object.Key, target.Name, err.Error())
+			}
+			auditLog(config, "gc_delete", target.Name+":"+object.Key, trigger, err)
+		}
+
+		if target.Type == "s3" {
+			aborted, err := abortStaleUploads(ctx, config, scanned, cutoff, dryRun, trigger)
+			if err != nil {
+				log.Printf("Error listing multipart uploads on %s: %s\n", target.Name, err.Error())
+			}
+			result.uploads += aborted
+		}
+	}
+
+	if config.Dedup.Enabled {
+		deduped, err := collectChunks(ctx, config, refs, cutoff, dryRun, trigger)
+		result.objects += deduped.objects
+		result.bytes += deduped.bytes
+		if err != nil {
+			return result, fmt.Errorf("error collecting dedup repository: %w", err)
+		}
+	}
+
+	return result, nil
+}
+
+// Abort the multipart uploads under a target's prefix started before the cutoff
+func abortStaleUploads(ctx context.Context, config Config, target TargetConfig, cutoff time.Time, dryRun bool, trigger string) (int, error) {
+	sess, err := target.session()
+	if err != nil {
+		return 0, err
+	}
+	client := s3.New(sess)
+
+	prefix := ""
+	if target.Prefix != "" {
+		prefix = strings.TrimSuffix(target.Prefix, "/") + "/"
+	}
+
+	stale := []*s3.MultipartUpload{}
+	err = client.ListMultipartUploadsPagesWithContext(ctx, &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(target.Bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListMultipartUploadsOutput, last bool) bool {
+		for _, upload := range page.Uploads {
+			if aws.TimeValue(upload.Initiated).Before(cutoff) {
+				stale = append(stale, upload)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	for _, upload := range stale {
+		key := aws.StringValue(upload.Key)
+		if dryRun {
+			log.Printf("Would abort multipart upload of %s on %s started %s\n", key, target.Name, aws.TimeValue(upload.Initiated).Format(time.RFC3339))
+			continue
+		}
+
+		log.Printf("Aborting multipart upload of %s on %s started %s\n", key, target.Name, aws.TimeValue(upload.Initiated).Format(time.RFC3339))
+		_, err := client.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(target.Bucket),
+			Key:      upload.Key,
+			UploadId: upload.UploadId,
+		})
+		if err != nil {
+			log.Printf("Error aborting multipart upload of %s: %s\n", key, err.Error())
+		}
+		auditLog(config, "gc_abort_upload", target.Name+":"+key, trigger, err)
+	}
+
+	return len(stale), nil
+}
+
+// Delete the dedup indexes no retained report refers to and the chunks no
+// retained index uses. Chunks are left alone if any retained index can't be
+// read, as its chunks would otherwise look unused.
+func collectChunks(ctx context.Context, config Config, refs gcReferences, cutoff time.Time, dryRun bool, trigger string) (gcResult, error) {
+	result := gcResult{}
+
+	primary := config.primaryTarget()
+	repository := primary
+	repository.Prefix = config.Dedup.Prefix
+
+	used := map[string]bool{}
+	for _, key := range refs.indexes {
+		index, err := readIndex(ctx, primary, key)
+		if err != nil {
+			return result, fmt.Errorf("error reading index %s: %w", key, err)
+		}
+		for _, file := range index.Files {
+			for _, hash := range file.Chunks {
+				used[chunkKey(config.Dedup.Prefix, hash)] = true
+			}
+		}
+	}
+
+	objects, err := repository.listAll(ctx)
+	if err != nil {
+		return result, err
+	}
+
+	verb := "Deleting"
+	if dryRun {
+		verb = "Would delete"
+	}
+
+	for _, object := range objects {
+		if !object.LastModified.Before(cutoff) || refs.keys[object.Key] || used[object.Key] {
+			continue
+		}
+		if !strings.HasPrefix(object.Key, path.Join(config.Dedup.Prefix, "chunks")+"/") && !strings.HasPrefix(object.Key, path.Join(config.Dedup.Prefix, "indexes")+"/") {
+			continue
+		}
+
+		log.Printf("%s unreferenced %s from the dedup repository (%s)\n", verb, object.Key, formatBytes(object.Size))
+		result.objects++
+		result.bytes += object.Size
+		if dryRun {
+			continue
+		}
+
+		err := primary.delete(ctx, object.Key)
+		if err != nil {
+			log.Printf("Error deleting %s: %s\n", object.Key, err.Error())
+		}
+		auditLog(config, "gc_delete", primary.Name+":"+object.Key, trigger, err)
+	}
+
+	return result, nil
+}
+
+// Download and decode a dedup index
+func readIndex(ctx context.Context, target TargetConfig, key string) (BackupIndex, error) {
+	index := BackupIndex{}
+
+	body, err := target.open(ctx, key)
+	if err != nil {
+		return index, err
+	}
+	defer body.Close()
+
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return index, err
+	}
+
+	return index, json.Unmarshal(data, &index)
+}
+
+// Handle the gc subcommand.
+// Usage: gc [--dry-run] [--min-age 24h] [--prefix old/]
+func runGC(ctx context.Context, config Config, args []string) error {
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "list what would be deleted without deleting anything")
+	minAge := flags.String("min-age", "24h", "keep objects younger than this, which a running backup may not have reported yet")
+	prefix := flags.String("prefix", "", "scan this prefix on each target instead of its configured one, e.g. one backups used to be stored under")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return withExitCode(exitConfig, err)
+	}
+
+	age, err := parseDuration(*minAge)
+	if err != nil {
+		return withExitCode(exitConfig, fmt.Errorf("invalid --min-age: %w", err))
+	}
+
+	result, err := collectGarbage(ctx, config, *prefix, age, *dryRun, commandTrigger())
+
+	if *dryRun {
+		log.Printf("Would delete %d unreferenced objects (%s) and abort %d multipart uploads\n", result.objects, formatBytes(result.bytes), result.uploads)
+	} else {
+		log.Printf("Deleted %d unreferenced objects (%s) and aborted %d multipart uploads\n", result.objects, formatBytes(result.bytes), result.uploads)
+	}
+
+	return err
+}
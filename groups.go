@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Hold a set of databases and files backed up as one unit, such as an
+// application's database and its uploads, with the application paused
+// around them so restoring both gives a consistent state
+type GroupConfig struct {
+	Name string `yaml:"name"`
+
+	// Shell commands run before the group's first member is dumped, e.g. to
+	// put the application in maintenance mode, and after its last, even when
+	// a dump or the pause command failed. DBBACKUP_GROUP is set to the name.
+	Pause  string `yaml:"pause"`
+	Resume string `yaml:"resume"`
+
+	// Longest each command may run, defaulting to 5m
+	HookTimeout string `yaml:"hook_timeout"`
+}
+
+// Get how long the group's hooks may run, defaulting to 5 minutes
+func (group GroupConfig) hookTimeout() time.Duration {
+	timeout, err := parseDuration(group.HookTimeout)
+	if err != nil || timeout <= 0 {
+		return 5 * time.Minute
+	}
+
+	return timeout
+}
+
+// Run one of a group's hooks, including its output in the error
+func runGroupHook(ctx context.Context, group GroupConfig, command string) error {
+	if command == "" {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, group.hookTimeout())
+	defer cancel()
+
+	var output strings.Builder
+
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	cmd.Env = append(os.Environ(), "DBBACKUP_GROUP="+group.Name)
+
+	err := runProcessGroup(ctx, cmd)
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(output.String()))
+	}
+
+	return nil
+}
+
+// Dump a group's members one at a time in the order they're configured,
+// between its pause and resume hooks. Members aren't dumped if the pause
+// fails, as they wouldn't be consistent.
+func runGroup(ctx context.Context, config Config, group GroupConfig, members []queuedDump, previousReports []RunReport, trigger string) ([]DatabaseReport, []string) {
+	log.Printf("Pausing group %s\n", group.Name)
+
+	reports := []DatabaseReport{}
+	files := []string{}
+
+	err := runGroupHook(ctx, group, group.Pause)
+	if err != nil {
+		log.Printf("Error pausing group %s: %s\n", group.Name, err.Error())
+
+		for _, member := range members {
+			reports = append(reports, DatabaseReport{
+				Engine:    member.db.Engine,
+				Host:      member.db.Host,
+				Name:      member.dbName,
+				Group:     group.Name,
+				Labels:    mergeLabels(config.Labels, member.db.Labels),
+				Notify:    member.db.Notify,
+				StartedAt: time.Now(),
+				Error:     fmt.Sprintf("pausing group %s failed: %s", group.Name, err.Error()),
+			})
+		}
+	} else {
+		sequential := config
+		sequential.Concurrency = 1
+		reports, files = runDumps(ctx, sequential, members, previousReports, trigger)
+	}
+
+	// Resume even when the run was cancelled, the application mustn't be
+	// left paused
+	log.Printf("Resuming group %s\n", group.Name)
+
+	err = runGroupHook(context.Background(), group, group.Resume)
+	if err != nil {
+		log.Printf("Error resuming group %s: %s\n", group.Name, err.Error())
+
+		routes := []string{}
+		for _, member := range members {
+			routes = append(routes, member.db.Notify...)
+		}
+
+		sendNotification(ctx, config, Notification{
+			Event:   "group.resume_failed",
+			Subject: fmt.Sprintf("Resuming group %s failed", group.Name),
+			Message: fmt.Sprintf("The resume command of group %s failed after its backup, the application may still be paused: %s", group.Name, err.Error()),
+			routes:  routes,
+		})
+	}
+
+	return reports, files
+}
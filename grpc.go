@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/thecakechicken/go-dbbackup/rpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Serves the gRPC control API. Backups, restores and prunes run as API jobs,
+// so they show up in /api/v1/jobs too.
+type grpcServer struct {
+	rpc.UnimplementedDBBackupServer
+
+	ctx    context.Context
+	config Config
+}
+
+// Check the call's authorization metadata against the configured basic auth
+// credentials or token, as the HTTP API does with its headers
+func (s *grpcServer) authorise(ctx context.Context) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+
+	r := &http.Request{Header: http.Header{}, URL: &url.URL{}}
+	for _, value := range md.Get("authorization") {
+		r.Header.Add("Authorization", value)
+	}
+
+	if !authorised(s.config.GRPC.HTTPAuth, r) {
+		return status.Error(codes.Unauthenticated, "unauthorised")
+	}
+
+	return nil
+}
+
+func (s *grpcServer) unaryAuth(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	defer redactPanic()
+
+	if err := s.authorise(ctx); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+func (s *grpcServer) streamAuth(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	defer redactPanic()
+
+	if err := s.authorise(stream.Context()); err != nil {
+		return err
+	}
+	return handler(srv, stream)
+}
+
+// Run a subcommand as a job, streaming its output until it finishes. The job
+// keeps running if the client goes away.
+func (s *grpcServer) streamJob(stream grpc.ServerStream, name string, args []string) error {
+	started, err := startCommandJob(s.ctx, s.config, name, args, "grpc")
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	seen := Job{ID: started.ID}
+	for {
+		job, ok := getJob(seen.ID)
+		if !ok {
+			return status.Errorf(codes.NotFound, "job %s was forgotten", seen.ID)
+		}
+
+		event := &rpc.JobEvent{
+			JobId:    job.ID,
+			Output:   job.outputSince(seen),
+			Finished: job.FinishedAt != nil,
+			Status:   job.Status,
+		}
+		if job.ExitCode != nil {
+			event.ExitCode = int32(*job.ExitCode)
+		}
+
+		if err := stream.SendMsg(event); err != nil {
+			return err
+		}
+		if event.Finished {
+			return nil
+		}
+
+		if _, err := waitJob(stream.Context(), job); err != nil {
+			return status.FromContextError(err).Err()
+		}
+		seen = job
+	}
+}
+
+func (s *grpcServer) TriggerBackup(req *rpc.TriggerBackupRequest, stream rpc.DBBackup_TriggerBackupServer) error {
+	args := []string{}
+	if len(req.Only) > 0 {
+		args = append(args, "--only", strings.Join(req.Only, ","))
+	}
+	if len(req.Hosts) > 0 {
+		args = append(args, "--host", strings.Join(req.Hosts, ","))
+	}
+	if req.Label != "" {
+		args = append(args, "--label", req.Label)
+	}
+
+	return s.streamJob(stream, "backup", args)
+}
+
+func (s *grpcServer) Restore(req *rpc.RestoreRequest, stream rpc.DBBackup_RestoreServer) error {
+	if req.ArchiveKey == "" || req.Database == "" {
+		return status.Error(codes.InvalidArgument, "archive_key and database are required")
+	}
+	for _, value := range []string{req.ArchiveKey, req.Database, req.Host} {
+		if strings.HasPrefix(value, "-") {
+			return status.Errorf(codes.InvalidArgument, "%q can't start with -", value)
+		}
+	}
+
+	args := []string{}
+	if req.Force {
+		args = append(args, "--force")
+	}
+	if req.Plan {
+		args = append(args, "--plan")
+	}
+	if req.Snapshot {
+		args = append(args, "--snapshot")
+	}
+	if len(req.Tables) > 0 {
+		args = append(args, "--tables", strings.Join(req.Tables, ","))
+	}
+
+	// Anything after -- is an argument, never a flag
+	args = append(args, "--", req.ArchiveKey, req.Database)
+	if req.Host != "" {
+		args = append(args, req.Host)
+	}
+
+	return s.streamJob(stream, "restore", args)
+}
+
+func (s *grpcServer) Prune(req *rpc.PruneRequest, stream rpc.DBBackup_PruneServer) error {
+	args := []string{}
+	if req.Target != "" {
+		args = append(args, "--target", req.Target)
+	}
+	if req.DryRun {
+		args = append(args, "--dry-run")
+	}
+
+	return s.streamJob(stream, "prune", args)
+}
+
+// Convert a time to a timestamp, leaving unset times unset
+func timestamp(t time.Time) *timestamppb.Timestamp {
+	if t.IsZero() {
+		return nil
+	}
+	return timestamppb.New(t)
+}
+
+func (s *grpcServer) GetStatus(ctx context.Context, req *rpc.GetStatusRequest) (*rpc.Status, error) {
+	reports, err := loadReports(s.config.ReportsDir)
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	response := &rpc.Status{Running: backupRunning(s.config)}
+
+	for _, run := range nextRuns(s.config.CronInterval, 5) {
+		response.NextRuns = append(response.NextRuns, timestamp(run))
+	}
+
+	for _, db := range databaseStatuses(reports) {
+		response.Databases = append(response.Databases, &rpc.DatabaseStatus{
+			Engine:      db.Engine,
+			Host:        db.Host,
+			Name:        db.Name,
+			LastRun:     timestamp(db.LastRun),
+			LastSuccess: timestamp(db.LastSuccess),
+			Success:     db.Success,
+			Error:       db.Error,
+		})
+	}
+
+	if pause := s.config.activePause(); pause != nil {
+		response.PausedReason = pause.Reason
+		response.PausedUntil = timestamp(pause.Until)
+	}
+
+	return response, nil
+}
+
+func (s *grpcServer) ListBackups(ctx context.Context, req *rpc.ListBackupsRequest) (*rpc.ListBackupsResponse, error) {
+	response := &rpc.ListBackupsResponse{}
+
+	found := false
+	for _, target := range s.config.targets() {
+		if req.Target != "" && target.Name != req.Target {
+			continue
+		}
+		found = true
+
+		objects, err := storeFor(target).list(ctx)
+		if err != nil {
+			return nil, status.Errorf(codes.Unavailable, "error listing %s: %s", target.Name, err.Error())
+		}
+
+		for _, object := range objects {
+			response.Backups = append(response.Backups, &rpc.Backup{
+				Target:       target.Name,
+				Key:          object.Key,
+				SizeBytes:    object.Size,
+				LastModified: timestamp(object.LastModified),
+			})
+		}
+	}
+
+	if req.Target != "" && !found {
+		return nil, status.Errorf(codes.NotFound, "no storage target named %q", req.Target)
+	}
+
+	return response, nil
+}
+
+// Build the gRPC server for a config
+func newGRPCServer(ctx context.Context, config Config) *grpc.Server {
+	service := &grpcServer{ctx: ctx, config: config}
+
+	server := grpc.NewServer(
+		grpc.UnaryInterceptor(service.unaryAuth),
+		grpc.StreamInterceptor(service.streamAuth),
+	)
+	rpc.RegisterDBBackupServer(server, service)
+
+	return server
+}
+
+// Run the gRPC control API. Blocks until the server stops or the context is
+// cancelled.
+func serveGRPC(ctx context.Context, config Config) {
+	defer redactPanic()
+
+	if config.GRPC.Token == "" && config.GRPC.Username == "" {
+		log.Println("Refusing to start gRPC server without a token or username configured")
+		return
+	}
+
+	listener, err := net.Listen("tcp", config.GRPC.Listen)
+	if err != nil {
+		log.Printf("Error running gRPC server: %s\n", err.Error())
+		return
+	}
+
+	server := newGRPCServer(ctx, config)
+	go func() {
+		<-ctx.Done()
+		server.Stop()
+	}()
+
+	log.Printf("Starting gRPC server on %s\n", config.GRPC.Listen)
+
+	err = server.Serve(listener)
+	if err != nil {
+		log.Printf("Error running gRPC server: %s\n", err.Error())
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/thecakechicken/go-dbbackup/rpc"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+// Start a gRPC server for the config in memory, returning a client of it
+func grpcTestClient(t *testing.T, config Config) rpc.DBBackupClient {
+	t.Helper()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	listener := bufconn.Listen(1024 * 1024)
+	server := newGRPCServer(ctx, config)
+	go server.Serve(listener)
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.DialContext(ctx, "bufnet",
+		grpc.WithContextDialer(func(context.Context, string) (net.Conn, error) { return listener.Dial() }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return rpc.NewDBBackupClient(conn)
+}
+
+// Get a context carrying the token
+func withToken(t *testing.T, token string) context.Context {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	t.Cleanup(cancel)
+	return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+}
+
+func grpcTestConfig(t *testing.T) Config {
+	config := Config{ReportsDir: t.TempDir()}
+	config.GRPC.Token = "secret"
+	return config
+}
+
+func TestGRPCRequiresAuth(t *testing.T) {
+	client := grpcTestClient(t, grpcTestConfig(t))
+
+	_, err := client.GetStatus(withToken(t, "wrong"), &rpc.GetStatusRequest{})
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("GetStatus with a wrong token returned %v", err)
+	}
+
+	stream, err := client.Prune(withToken(t, "wrong"), &rpc.PruneRequest{})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if status.Code(err) != codes.Unauthenticated {
+		t.Errorf("Prune with a wrong token returned %v", err)
+	}
+
+	if _, err := client.GetStatus(withToken(t, "secret"), &rpc.GetStatusRequest{}); err != nil {
+		t.Errorf("GetStatus with the token returned %v", err)
+	}
+}
+
+func TestGRPCPruneStreamsOutput(t *testing.T) {
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake := newFakeCommands()
+	fake.outputs[filepath.Base(executable)] = "Would prune sql_backup_at_old from s3\n"
+	runner = fake
+	defer func() { runner = systemCommands{} }()
+
+	client := grpcTestClient(t, grpcTestConfig(t))
+
+	stream, err := client.Prune(withToken(t, "secret"), &rpc.PruneRequest{Target: "s3", DryRun: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output := ""
+	var last *rpc.JobEvent
+	for {
+		event, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		output += event.Output
+		last = event
+	}
+
+	if last == nil || !last.Finished || last.Status != "succeeded" || last.ExitCode != 0 {
+		t.Errorf("last event %v, want a successful finish", last)
+	}
+	if output != "Would prune sql_backup_at_old from s3\n" {
+		t.Errorf("streamed output %q", output)
+	}
+
+	want := [][]string{{executable, "prune", "--target", "s3", "--dry-run"}}
+	if got := fake.commandsRun(); !reflect.DeepEqual(got, want) {
+		t.Errorf("ran %v, want %v", got, want)
+	}
+}
+
+func TestGRPCListBackups(t *testing.T) {
+	modified := time.Date(2026, 3, 1, 2, 0, 0, 0, time.UTC)
+
+	store := newMemoryStore()
+	store.put(backupNamePrefix+"2026-03-01", []byte("archive"), modified)
+	store.put("dedup/index", []byte("not a backup"), modified)
+	storeFor = func(TargetConfig) objectStore { return store }
+	defer func() { storeFor = func(target TargetConfig) objectStore { return target } }()
+
+	config := grpcTestConfig(t)
+	config.Targets = []TargetConfig{{Name: "primary", Type: "local"}}
+	client := grpcTestClient(t, config)
+
+	response, err := client.ListBackups(withToken(t, "secret"), &rpc.ListBackupsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(response.Backups) != 1 {
+		t.Fatalf("listed %d backups, want 1", len(response.Backups))
+	}
+
+	backup := response.Backups[0]
+	if backup.Target != "primary" || backup.Key != backupNamePrefix+"2026-03-01" || backup.SizeBytes != 7 || !backup.LastModified.AsTime().Equal(modified) {
+		t.Errorf("listed %v", backup)
+	}
+
+	_, err = client.ListBackups(withToken(t, "secret"), &rpc.ListBackupsRequest{Target: "missing"})
+	if status.Code(err) != codes.NotFound {
+		t.Errorf("listing a missing target returned %v", err)
+	}
+}
+
+func TestGRPCRestoreArgumentsAreNotFlags(t *testing.T) {
+	executable, err := os.Executable()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fake := newFakeCommands()
+	runner = fake
+	defer func() { runner = systemCommands{} }()
+
+	client := grpcTestClient(t, grpcTestConfig(t))
+
+	stream, err := client.Restore(withToken(t, "secret"), &rpc.RestoreRequest{ArchiveKey: "--force", Database: "shop"})
+	if err == nil {
+		_, err = stream.Recv()
+	}
+	if status.Code(err) != codes.InvalidArgument {
+		t.Errorf("restoring a flag as the archive returned %v", err)
+	}
+
+	stream, err = client.Restore(withToken(t, "secret"), &rpc.RestoreRequest{ArchiveKey: "sql_backup_at_x.tar.gz", Database: "shop", Plan: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		if _, err := stream.Recv(); err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	want := [][]string{{executable, "restore", "--plan", "--", "sql_backup_at_x.tar.gz", "shop"}}
+	if got := fake.commandsRun(); !reflect.DeepEqual(got, want) {
+		t.Errorf("ran %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Hold how heartbeats are sent to a monitoring service such as Healthchecks
+// or Cronitor
+type HeartbeatConfig struct {
+	// "GET" (the default) or "POST", which sends the run report as JSON so
+	// the service can show which databases failed and why
+	Method string `yaml:"method"`
+
+	// Pinged instead of heartbeat_uri when a run fails, e.g.
+	// "https://hc-ping.com/<uuid>/fail". Without it, runs that didn't upload
+	// send no heartbeat, and the service alerts when it's overdue.
+	FailureURI string `yaml:"failure_uri"`
+}
+
+// Let the monitoring service know how the run went
+func sendHeartbeat(ctx context.Context, config Config, report *RunReport) {
+	uri := config.HeartbeatUri
+	if !report.Success && config.Heartbeat.FailureURI != "" {
+		uri = config.Heartbeat.FailureURI
+	} else if !report.Uploaded {
+		return
+	}
+	if uri == "" || report.Cancelled {
+		return
+	}
+
+	log.Println("Sending heartbeat")
+
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	var req *http.Request
+	var err error
+	if strings.EqualFold(config.Heartbeat.Method, http.MethodPost) {
+		var body []byte
+		body, err = json.Marshal(report)
+		if err != nil {
+			log.Printf("Error sending heartbeat: %s\n", err.Error())
+			return
+		}
+
+		req, err = http.NewRequestWithContext(ctx, http.MethodPost, uri, bytes.NewReader(body))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/json")
+		}
+	} else {
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, uri, nil)
+	}
+	if err != nil {
+		log.Printf("Error sending heartbeat: %s\n", err.Error())
+		return
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			err = fmt.Errorf("unexpected status %s", resp.Status)
+		}
+	}
+	if err != nil {
+		log.Printf("Error sending heartbeat: %s\n", err.Error())
+	}
+}
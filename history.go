@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Write the runs as JSON
+func exportHistoryJSON(w io.Writer, reports []RunReport) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(reports)
+}
+
+// Write the runs as CSV, one row per database per run
+func exportHistoryCSV(w io.Writer, reports []RunReport) error {
+	writer := csv.NewWriter(w)
+
+	writer.Write([]string{
+		"run_started_at", "run_duration_seconds", "run_success", "archive_key", "archive_sha256", "archive_size_bytes", "destinations",
+		"engine", "host", "database", "success", "size_bytes", "duration_seconds", "error", "labels",
+	})
+
+	for _, report := range reports {
+		destinations := []string{}
+		for _, target := range append(report.Targets, report.Replicas...) {
+			destinations = append(destinations, target.Name+":"+target.Key)
+		}
+
+		// Skipped runs have no databases, so get a single row with the reason
+		if report.Skipped {
+			writer.Write([]string{
+				report.StartedAt.Format(time.RFC3339),
+				"0", "false", "", "", "0", "",
+				"", "", "", "false", "0", "0",
+				report.SkipReason,
+				formatLabels(report.Labels, ";"),
+			})
+			continue
+		}
+
+		for _, db := range report.Databases {
+			writer.Write([]string{
+				report.StartedAt.Format(time.RFC3339),
+				strconv.FormatFloat(report.DurationSeconds, 'f', 1, 64),
+				strconv.FormatBool(report.Success),
+				report.archiveFor(db),
+				report.ArchiveSHA256,
+				strconv.FormatInt(report.ArchiveSizeBytes, 10),
+				strings.Join(destinations, ";"),
+				db.Engine,
+				db.Host,
+				db.Name,
+				strconv.FormatBool(db.Success),
+				strconv.FormatInt(db.SizeBytes, 10),
+				strconv.FormatFloat(db.DurationSeconds, 'f', 1, 64),
+				db.Error,
+				formatLabels(db.Labels, ";"),
+			})
+		}
+	}
+
+	writer.Flush()
+	return writer.Error()
+}
+
+// Handle the history subcommand. Usage: history export [--format csv|json] [--since 30d] [--label key=value] [--output file]
+func runHistory(config Config, args []string) error {
+	if len(args) == 0 || args[0] != "export" {
+		return fmt.Errorf("usage: dbbackup history export [--format csv|json] [--since 30d] [--label key=value] [--output file]")
+	}
+
+	flags := flag.NewFlagSet("history export", flag.ContinueOnError)
+	format := flags.String("format", "json", "output format, csv or json")
+	since := flags.String("since", "", "only include runs newer than this, e.g. 30d")
+	label := flags.String("label", "", "only include databases with this label, e.g. team=payments")
+	output := flags.String("output", "", "file to write to instead of stdout")
+
+	err := flags.Parse(args[1:])
+	if err != nil {
+		return err
+	}
+
+	reports, err := loadReports(config.ReportsDir)
+	if err != nil {
+		return err
+	}
+
+	if *since != "" {
+		age, err := parseDuration(*since)
+		if err != nil {
+			return err
+		}
+
+		cutoff := clk.Now().Add(-age)
+		filtered := []RunReport{}
+		for _, report := range reports {
+			if !report.StartedAt.Before(cutoff) {
+				filtered = append(filtered, report)
+			}
+		}
+		reports = filtered
+	}
+
+	if *label != "" {
+		key, value, err := parseLabel(*label)
+		if err != nil {
+			return err
+		}
+		reports = filterByLabel(reports, key, value)
+	}
+
+	var w io.Writer = os.Stdout
+	if *output != "" {
+		file, err := os.Create(*output)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		w = file
+	}
+
+	switch *format {
+	case "json":
+		return exportHistoryJSON(w, reports)
+	case "csv":
+		return exportHistoryCSV(w, reports)
+	}
+
+	return fmt.Errorf("unknown format %q", *format)
+}
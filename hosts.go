@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Strip the brackets from an IPv6 literal, as the dump tools that take the
+// host on its own expect the bare address
+func bareHost(host string) string {
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		return host[1 : len(host)-1]
+	}
+
+	return host
+}
+
+// Get the host to connect to, which is the address being tried when the
+// database's addresses are tried one at a time
+func (db DatabaseConfig) connectHost() string {
+	if db.address != "" {
+		return db.address
+	}
+
+	return bareHost(db.Host)
+}
+
+// Get the host and port as a single address for tools that take them together,
+// bracketing IPv6 literals
+func (db DatabaseConfig) hostPort() string {
+	return net.JoinHostPort(db.connectHost(), strconv.Itoa(db.Port))
+}
+
+// Get the instances to try a dump against in turn, each with the address to
+// connect to set. Discovered instances come first. Otherwise only hostnames
+// with try_all_addresses set are resolved, and the dump tool resolves the host
+// itself.
+func (db DatabaseConfig) candidates(ctx context.Context) ([]DatabaseConfig, error) {
+	if db.Discovery.enabled() {
+		return db.discover(ctx)
+	}
+
+	host := bareHost(db.Host)
+
+	if !db.TryAllAddresses || !networkEngines[db.Engine] || net.ParseIP(host) != nil {
+		return []DatabaseConfig{db}, nil
+	}
+
+	addresses, err := net.DefaultResolver.LookupHost(ctx, host)
+	if err != nil || len(addresses) < 2 {
+		// Let the dump tool report the resolution error
+		return []DatabaseConfig{db}, nil
+	}
+
+	instances := []DatabaseConfig{}
+	for _, address := range addresses {
+		instance := db
+		instance.address = address
+		instances = append(instances, instance)
+	}
+
+	return instances, nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Hold the answers collected by the init wizard
+type initAnswers struct {
+	CronInterval string
+	Engine       string
+	Host         string
+	Port         int
+	Username     string
+	Password     string
+	Databases    []string
+	AccessKey    string
+	AccessSecret string
+	Region       string
+	Bucket       string
+}
+
+const initTemplate = `# How often to run backups, in cron format with seconds
+cron_interval: {{printf "%q" .CronInterval}}
+
+# URL to request after every successful run, e.g. a healthchecks.io ping URL
+heartbeat_uri: ""
+
+s3_config:
+  access_key: {{printf "%q" .AccessKey}}
+  access_secret: {{printf "%q" .AccessSecret}}
+  region: {{printf "%q" .Region}}
+  bucket: {{printf "%q" .Bucket}}
+
+databases:
+  -
+    engine: {{printf "%q" .Engine}}
+    host: {{printf "%q" .Host}}
+    port: {{.Port}}
+    username: {{printf "%q" .Username}}
+    password: {{printf "%q" .Password}}
+    names: # Use "*" to back up every database on the server
+{{- range .Databases}}
+      - {{printf "%q" .}}
+{{- end}}
+`
+
+// Default ports for each engine
+var defaultPorts = map[string]int{
+	"mysql":      3306,
+	"mariadb":    3306,
+	"mongodb":    27017,
+	"redis":      6379,
+	"mssql":      1433,
+	"clickhouse": 9000,
+	"influxdb":   8086,
+	"etcd":       2379,
+	"ldap":       389,
+}
+
+// Ask a question on the terminal, returning the default if nothing is entered
+func prompt(reader *bufio.Reader, question string, current string) string {
+	if current != "" {
+		fmt.Fprintf(os.Stderr, "%s [%s]: ", question, current)
+	} else {
+		fmt.Fprintf(os.Stderr, "%s: ", question)
+	}
+
+	answer, _ := reader.ReadString('\n')
+	answer = strings.TrimSpace(answer)
+
+	if answer == "" {
+		return current
+	}
+
+	return answer
+}
+
+// Check the database credentials work where the engine supports it
+func testDatabase(answers initAnswers) error {
+	db := DatabaseConfig{
+		Engine:   answers.Engine,
+		Host:     answers.Host,
+		Port:     answers.Port,
+		Username: answers.Username,
+		Password: Secret(answers.Password),
+	}
+
+	switch answers.Engine {
+	case "mysql", "mariadb":
+		_, err := mysqlQuery(db, "", "SELECT 1")
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Skipping connection test for %s\n", answers.Engine)
+	return nil
+}
+
+// Check the S3 credentials can see the bucket
+func testBucket(answers initAnswers) error {
+	target := TargetConfig{
+		Type:         "s3",
+		AccessKey:    answers.AccessKey,
+		AccessSecret: Secret(answers.AccessSecret),
+		Region:       answers.Region,
+		Bucket:       answers.Bucket,
+	}
+
+	sess, err := target.session()
+	if err != nil {
+		return err
+	}
+
+	_, err = s3.New(sess).HeadBucket(&s3.HeadBucketInput{Bucket: aws.String(answers.Bucket)})
+	return err
+}
+
+// Generate a commented configuration file, asking for anything not given as a
+// flag and testing the credentials before writing it
+func runInit(args []string) error {
+	flags := flag.NewFlagSet("init", flag.ContinueOnError)
+
+	answers := initAnswers{}
+	databases := ""
+
+	flags.StringVar(&answers.CronInterval, "cron", "0 0 * * * *", "backup schedule")
+	flags.StringVar(&answers.Engine, "engine", "mysql", "database engine")
+	flags.StringVar(&answers.Host, "host", "127.0.0.1", "database host")
+	flags.IntVar(&answers.Port, "port", 0, "database port (defaults to the engine's port)")
+	flags.StringVar(&answers.Username, "username", "", "database username")
+	flags.StringVar(&answers.Password, "password", "", "database password")
+	flags.StringVar(&databases, "databases", "", "comma separated database names, or * for all")
+	flags.StringVar(&answers.AccessKey, "access-key", "", "S3 access key")
+	flags.StringVar(&answers.AccessSecret, "access-secret", "", "S3 access secret")
+	flags.StringVar(&answers.Region, "region", "eu-west-2", "S3 region")
+	flags.StringVar(&answers.Bucket, "bucket", "", "S3 bucket")
+	output := flags.String("output", "config.yaml", "file to write")
+	nonInteractive := flags.Bool("non-interactive", false, "don't prompt for missing values")
+	skipTests := flags.Bool("skip-tests", false, "don't test the database and S3 credentials")
+	force := flags.Bool("force", false, "overwrite an existing file")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if _, err := os.Stat(*output); err == nil && !*force {
+		return fmt.Errorf("%s already exists, use --force to overwrite it", *output)
+	}
+
+	if !*nonInteractive {
+		reader := bufio.NewReader(os.Stdin)
+
+		answers.CronInterval = prompt(reader, "Backup schedule (cron with seconds)", answers.CronInterval)
+		answers.Engine = prompt(reader, "Database engine", answers.Engine)
+		answers.Host = prompt(reader, "Database host", answers.Host)
+
+		if answers.Port == 0 {
+			answers.Port = defaultPorts[answers.Engine]
+		}
+		port, err := strconv.Atoi(prompt(reader, "Database port", strconv.Itoa(answers.Port)))
+		if err != nil {
+			return fmt.Errorf("invalid port: %w", err)
+		}
+		answers.Port = port
+
+		answers.Username = prompt(reader, "Database username", answers.Username)
+		answers.Password = prompt(reader, "Database password", answers.Password)
+		databases = prompt(reader, "Databases (comma separated, * for all)", databases)
+		answers.AccessKey = prompt(reader, "S3 access key", answers.AccessKey)
+		answers.AccessSecret = prompt(reader, "S3 access secret", answers.AccessSecret)
+		answers.Region = prompt(reader, "S3 region", answers.Region)
+		answers.Bucket = prompt(reader, "S3 bucket", answers.Bucket)
+	}
+
+	if answers.Port == 0 {
+		answers.Port = defaultPorts[answers.Engine]
+	}
+
+	for _, name := range strings.Split(databases, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			answers.Databases = append(answers.Databases, name)
+		}
+	}
+
+	if len(answers.Databases) == 0 {
+		return fmt.Errorf("at least one database is required")
+	}
+
+	if answers.Bucket == "" {
+		return fmt.Errorf("an S3 bucket is required")
+	}
+
+	if !*skipTests {
+		fmt.Fprintln(os.Stderr, "Testing database connection...")
+		if err := testDatabase(answers); err != nil {
+			return fmt.Errorf("database connection failed: %w", err)
+		}
+
+		fmt.Fprintln(os.Stderr, "Testing S3 bucket access...")
+		if err := testBucket(answers); err != nil {
+			return fmt.Errorf("S3 bucket access failed: %w", err)
+		}
+	}
+
+	file, err := os.OpenFile(*output, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	err = template.Must(template.New("config").Parse(initTemplate)).Execute(file, answers)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "Wrote %s\n", *output)
+
+	return nil
+}
@@ -0,0 +1,337 @@
+//go:build integration
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/ory/dockertest/v3"
+	"github.com/ory/dockertest/v3/docker"
+)
+
+// The integration tests back up and restore against a real MySQL server and
+// S3-compatible store, by default ones TestMain starts in containers. Set
+// DBBACKUP_IT_MYSQL and DBBACKUP_IT_S3_ENDPOINT, with the rest as needed, to
+// run them against others instead.
+var integrationSettings = map[string]string{
+	"DBBACKUP_IT_MYSQL":          "",
+	"DBBACKUP_IT_MYSQL_USER":     "root",
+	"DBBACKUP_IT_MYSQL_PASSWORD": "dbbackup",
+	"DBBACKUP_IT_S3_ENDPOINT":    "",
+	"DBBACKUP_IT_S3_ACCESS_KEY":  "dbbackup",
+	"DBBACKUP_IT_S3_SECRET_KEY":  "dbbackup-secret",
+	"DBBACKUP_IT_S3_BUCKET":      "dbbackup-integration",
+}
+
+// Longest to wait for a container to start and its service to accept connections
+const integrationStartTimeout = 2 * time.Minute
+
+func TestMain(m *testing.M) {
+	os.Exit(runIntegrationTests(m))
+}
+
+// Start MySQL and MinIO in containers, unless settings point the tests at
+// running servers, and run the tests, removing the containers after
+func runIntegrationTests(m *testing.M) int {
+	// The backup runs the client tools on this machine, not in the containers
+	if err := checkClientTools([]Config{{Databases: []DatabaseConfig{{Engine: "mysql"}}}}); err != nil {
+		log.Println(err)
+		return 1
+	}
+
+	if os.Getenv("DBBACKUP_IT_MYSQL") != "" && os.Getenv("DBBACKUP_IT_S3_ENDPOINT") != "" {
+		return m.Run()
+	}
+
+	pool, err := dockertest.NewPool("")
+	if err != nil {
+		log.Printf("Error connecting to docker: %s\n", err.Error())
+		return 1
+	}
+	pool.MaxWait = integrationStartTimeout
+
+	mysql, err := startIntegrationContainer(pool, &dockertest.RunOptions{
+		Repository: "mysql",
+		Tag:        "8.0",
+		Env:        []string{"MYSQL_ROOT_PASSWORD=" + integrationSetting("DBBACKUP_IT_MYSQL_PASSWORD")},
+	})
+	if err != nil {
+		log.Printf("Error starting MySQL: %s\n", err.Error())
+		return 1
+	}
+	defer pool.Purge(mysql)
+
+	minio, err := startIntegrationContainer(pool, &dockertest.RunOptions{
+		Repository: "minio/minio",
+		Tag:        "latest",
+		Cmd:        []string{"server", "/data"},
+		Env: []string{
+			"MINIO_ROOT_USER=" + integrationSetting("DBBACKUP_IT_S3_ACCESS_KEY"),
+			"MINIO_ROOT_PASSWORD=" + integrationSetting("DBBACKUP_IT_S3_SECRET_KEY"),
+		},
+	})
+	if err != nil {
+		log.Printf("Error starting MinIO: %s\n", err.Error())
+		return 1
+	}
+	defer pool.Purge(minio)
+
+	// The ports are published on every interface, and the mysql client would
+	// take localhost to mean its socket
+	integrationSettings["DBBACKUP_IT_MYSQL"] = net.JoinHostPort("127.0.0.1", mysql.GetPort("3306/tcp"))
+	integrationSettings["DBBACKUP_IT_S3_ENDPOINT"] = "http://" + net.JoinHostPort("127.0.0.1", minio.GetPort("9000/tcp"))
+
+	// MySQL restarts once while initialising, so wait until queries work
+	err = pool.Retry(func() error {
+		_, err := mysqlQuery(integrationMySQL(), "", "SELECT 1")
+		return err
+	})
+	if err != nil {
+		log.Printf("MySQL at %s isn't up: %s\n", integrationSetting("DBBACKUP_IT_MYSQL"), err.Error())
+		return 1
+	}
+
+	err = pool.Retry(func() error {
+		response, err := http.Get(integrationSetting("DBBACKUP_IT_S3_ENDPOINT") + "/minio/health/ready")
+		if err != nil {
+			return err
+		}
+		response.Body.Close()
+		if response.StatusCode != http.StatusOK {
+			return fmt.Errorf("health check returned %s", response.Status)
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("MinIO at %s isn't up: %s\n", integrationSetting("DBBACKUP_IT_S3_ENDPOINT"), err.Error())
+		return 1
+	}
+
+	return m.Run()
+}
+
+// Start a container that's removed when it stops, and stopped after half an
+// hour in case the tests are killed before removing it
+func startIntegrationContainer(pool *dockertest.Pool, options *dockertest.RunOptions) (*dockertest.Resource, error) {
+	resource, err := pool.RunWithOptions(options, func(host *docker.HostConfig) {
+		host.AutoRemove = true
+		host.RestartPolicy = docker.RestartPolicy{Name: "no"}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := resource.Expire(30 * 60); err != nil {
+		pool.Purge(resource)
+		return nil, err
+	}
+
+	return resource, nil
+}
+
+func integrationSetting(name string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return integrationSettings[name]
+}
+
+// The database the tests create, back up, drop and restore
+const integrationDatabase = "dbbackup_integration"
+
+// Get the connection settings of the MySQL server
+func integrationMySQL() DatabaseConfig {
+	host, port, _ := net.SplitHostPort(integrationSetting("DBBACKUP_IT_MYSQL"))
+	number, _ := strconv.Atoi(port)
+
+	return DatabaseConfig{
+		Engine:   "mysql",
+		Host:     host,
+		Port:     number,
+		Username: integrationSetting("DBBACKUP_IT_MYSQL_USER"),
+		Password: Secret(integrationSetting("DBBACKUP_IT_MYSQL_PASSWORD")),
+	}
+}
+
+// Load a config backing up the integration database to the store
+func integrationConfig(t *testing.T, extra string) Config {
+	t.Helper()
+
+	host, port, err := net.SplitHostPort(integrationSetting("DBBACKUP_IT_MYSQL"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "config.yaml")
+	config := fmt.Sprintf(`cron_interval: "0 0 * * * *"
+temp_dir: tmp
+dump_dir: dumps
+reports_dir: reports
+audit_log: ""
+s3_config:
+  region: us-east-1
+  bucket: %q
+  endpoint: %q
+  access_key: %q
+  access_secret: %q
+databases:
+  - engine: mysql
+    host: %q
+    port: %s
+    username: %q
+    password: %q
+    name: %q
+%s`, integrationSetting("DBBACKUP_IT_S3_BUCKET"), integrationSetting("DBBACKUP_IT_S3_ENDPOINT"),
+		integrationSetting("DBBACKUP_IT_S3_ACCESS_KEY"), integrationSetting("DBBACKUP_IT_S3_SECRET_KEY"),
+		host, port, integrationSetting("DBBACKUP_IT_MYSQL_USER"), integrationSetting("DBBACKUP_IT_MYSQL_PASSWORD"),
+		integrationDatabase, extra)
+
+	if err := os.WriteFile(path, []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := loadConfig(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	createDirectories(loaded)
+
+	return loaded
+}
+
+// Create the bucket unless it's already there
+func createIntegrationBucket(t *testing.T, config Config) {
+	t.Helper()
+
+	sess, err := newS3Session(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = s3.New(sess).CreateBucket(&s3.CreateBucketInput{Bucket: aws.String(config.S3Config.Bucket)})
+	var awsErr awserr.Error
+	if err != nil && !(errors.As(err, &awsErr) && (awsErr.Code() == s3.ErrCodeBucketAlreadyOwnedByYou || awsErr.Code() == s3.ErrCodeBucketAlreadyExists)) {
+		t.Fatalf("error creating bucket %s: %s", config.S3Config.Bucket, err)
+	}
+}
+
+// Run statements against the server, failing the test if they do
+func integrationExec(t *testing.T, db DatabaseConfig, database string, statements ...string) string {
+	t.Helper()
+
+	output, err := mysqlQuery(db, database, strings.Join(statements, ";\n"))
+	if err != nil {
+		t.Fatalf("error running %q: %s", statements, err)
+	}
+
+	return output
+}
+
+// Get the checksum and rows of every table, which a restore must reproduce
+func integrationSnapshot(t *testing.T, db DatabaseConfig) string {
+	t.Helper()
+
+	return integrationExec(t, db, integrationDatabase,
+		"CHECKSUM TABLE users, orders EXTENDED",
+		"SELECT * FROM users ORDER BY id",
+		"SELECT * FROM orders ORDER BY id",
+	)
+}
+
+// Back up the database, drop it and restore it, checking it comes back the same
+func TestIntegrationBackupAndRestore(t *testing.T) {
+	config := integrationConfig(t, "")
+	db := config.Databases[0]
+
+	createIntegrationBucket(t, config)
+
+	integrationExec(t, db, "",
+		"DROP DATABASE IF EXISTS "+quoteIdentifier(integrationDatabase),
+		"CREATE DATABASE "+quoteIdentifier(integrationDatabase),
+		"USE "+quoteIdentifier(integrationDatabase),
+		"CREATE TABLE users (id INT PRIMARY KEY, email VARCHAR(255), note TEXT, photo BLOB)",
+		"CREATE TABLE orders (id INT PRIMARY KEY, user_id INT, total DECIMAL(10,2), placed_at DATETIME(6))",
+		`INSERT INTO users VALUES (1, 'a@example.org', 'it''s "quoted", (parenthesised); and\nmultiline', 0x00FF10),
+			(2, 'b@example.org', NULL, NULL),
+			(3, 'ü@example.org', 'ünïcödé ☃', '')`,
+		"INSERT INTO orders VALUES (1, 1, 19.99, '2026-03-01 02:03:04.500000'), (2, 3, 0.01, NULL)",
+	)
+	before := integrationSnapshot(t, db)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	report := runBackups(ctx, config, "manual")
+	if report == nil || !report.Success {
+		t.Fatalf("backup failed: %+v", report)
+	}
+	if report.ArchiveKey == "" || !report.Uploaded {
+		t.Fatalf("backup wasn't uploaded: %+v", report)
+	}
+
+	// Restoring onto a server without the database has to create it
+	integrationExec(t, db, "", "DROP DATABASE "+quoteIdentifier(integrationDatabase))
+
+	err := runRestore(ctx, config, []string{report.ArchiveKey, integrationDatabase})
+	if err != nil {
+		t.Fatalf("restore failed: %s", err)
+	}
+
+	if after := integrationSnapshot(t, db); after != before {
+		t.Errorf("restored database differs\nbefore:\n%s\nafter:\n%s", before, after)
+	}
+}
+
+// Back up with masking and check the masked column never reaches the archive
+func TestIntegrationMaskedBackup(t *testing.T) {
+	config := integrationConfig(t, `    masking:
+      - table: users
+        column: email
+        method: faker
+        faker: email
+`)
+	db := config.Databases[0]
+
+	createIntegrationBucket(t, config)
+
+	integrationExec(t, db, "",
+		"DROP DATABASE IF EXISTS "+quoteIdentifier(integrationDatabase),
+		"CREATE DATABASE "+quoteIdentifier(integrationDatabase),
+		"USE "+quoteIdentifier(integrationDatabase),
+		"CREATE TABLE users (id INT PRIMARY KEY, email VARCHAR(255))",
+		"INSERT INTO users VALUES (1, 'secret@example.org')",
+	)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+
+	report := runBackups(ctx, config, "manual")
+	if report == nil || !report.Success {
+		t.Fatalf("backup failed: %+v", report)
+	}
+
+	integrationExec(t, db, "", "DROP DATABASE "+quoteIdentifier(integrationDatabase))
+	if err := runRestore(ctx, config, []string{report.ArchiveKey, integrationDatabase}); err != nil {
+		t.Fatalf("restore failed: %s", err)
+	}
+
+	email := strings.TrimSpace(integrationExec(t, db, integrationDatabase, "SELECT email FROM users"))
+	if email == "secret@example.org" || !strings.HasSuffix(email, "@example.com") {
+		t.Errorf("restored email is %q, want it masked", email)
+	}
+}
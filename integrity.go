@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Get the SHA-256 of a dump. Split and parallel dumps are directories, so
+// theirs is of each file's path and SHA-256, in order.
+func dumpSHA256(path string) (string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if !info.IsDir() {
+		return fileSHA256(path)
+	}
+
+	hash := sha256.New()
+	err = filepath.Walk(path, func(file string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		rel, err := filepath.Rel(path, file)
+		if err != nil {
+			return err
+		}
+		checksum, err := fileSHA256(file)
+		if err != nil {
+			return err
+		}
+
+		fmt.Fprintf(hash, "%s\x00%s\n", filepath.ToSlash(rel), checksum)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Report a failed integrity check, which only stops a restore without --insecure
+func integrityError(config Config, err error) error {
+	if config.insecureRestore {
+		log.Printf("Warning: %s, restoring anyway as --insecure is set\n", err.Error())
+		return nil
+	}
+
+	return fmt.Errorf("%w, use --insecure to restore it anyway", err)
+}
+
+// Check a downloaded archive or an extracted dump against the SHA-256 the
+// signed report recorded for it
+func verifyChecksum(config Config, what string, path string, expected string, checksum func(string) (string, error)) error {
+	if expected == "" {
+		return integrityError(config, fmt.Errorf("no checksum is recorded for %s", what))
+	}
+
+	actual, err := checksum(path)
+	if err != nil {
+		return err
+	}
+	if actual != expected {
+		return integrityError(config, fmt.Errorf("%s has SHA-256 %s, but %s was recorded", what, actual, expected))
+	}
+
+	return nil
+}
+
+// Check the manifest in a downloaded archive against the report: its
+// signature when signing is configured, and the dump's SHA-256. Archives of a
+// single database have no manifest, the report alone vouches for those.
+func verifyManifest(config Config, archive string, isZip bool, ref BackupReference) error {
+	manifestFile := archive + ".manifest.json"
+	defer os.Remove(manifestFile)
+	defer os.Remove(manifestFile + signatureExtension)
+
+	extract := extractFromArchive
+	if isZip {
+		extract = extractFromZip
+	}
+
+	if extract(archive, "manifest.json", manifestFile) != nil {
+		return nil
+	}
+
+	if config.Signing.enabled() {
+		err := extract(archive, "manifest.json"+signatureExtension, manifestFile+signatureExtension)
+		if err == nil {
+			err = verifyFile(config, manifestFile)
+		}
+		if err != nil {
+			return integrityError(config, fmt.Errorf("manifest of %s failed verification: %s", ref.ArchiveKey, err.Error()))
+		}
+	}
+
+	data, err := os.ReadFile(manifestFile)
+	if err != nil {
+		return err
+	}
+
+	manifest := Manifest{}
+	err = json.Unmarshal(data, &manifest)
+	if err != nil {
+		return integrityError(config, fmt.Errorf("manifest of %s can't be read: %s", ref.ArchiveKey, err.Error()))
+	}
+
+	for _, db := range manifest.Databases {
+		if db.Engine != ref.Engine || db.Host != ref.Host || db.Name != ref.Name || db.File != filepath.Base(ref.File) {
+			continue
+		}
+
+		if db.SHA256 != ref.sha256 {
+			return integrityError(config, fmt.Errorf("manifest of %s records SHA-256 %s for %s, but the report records %s", ref.ArchiveKey, db.SHA256, db.File, ref.sha256))
+		}
+		return nil
+	}
+
+	return integrityError(config, fmt.Errorf("manifest of %s doesn't list %s", ref.ArchiveKey, filepath.Base(ref.File)))
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Hold where to fetch a list of databases from at run time, for platforms
+// where databases come and go too often to keep in the configuration file.
+// Entries take the same settings as the databases list.
+type InventoryConfig struct {
+	// HTTP endpoint returning a JSON list of database entries, requested with
+	// the token as a bearer token if set
+	URL   string `yaml:"url"`
+	Token Secret `yaml:"token"`
+
+	// File holding a YAML or JSON list of database entries, read on every run
+	File string `yaml:"file"`
+
+	// Query run against an inventory database (MySQL/MariaDB only), returning
+	// one row per database with the columns engine, host, port, username,
+	// password and name
+	Query    string         `yaml:"query"`
+	Database DatabaseConfig `yaml:"database"`
+
+	// The directory of the main configuration file, to resolve paths in entries
+	base string
+}
+
+// Check whether an inventory is configured
+func (inventory InventoryConfig) enabled() bool {
+	return inventory.URL != "" || inventory.File != "" || inventory.Query != ""
+}
+
+// Get where the inventory comes from, for log and error messages
+func (inventory InventoryConfig) source() string {
+	if inventory.URL != "" {
+		return inventory.URL
+	}
+	if inventory.File != "" {
+		return inventory.File
+	}
+
+	return "inventory query"
+}
+
+// Check the inventory settings
+func (inventory InventoryConfig) validate(errs *validationErrors) {
+	sources := 0
+	for _, value := range []string{inventory.URL, inventory.File, inventory.Query} {
+		if value != "" {
+			sources++
+		}
+	}
+	if sources > 1 {
+		errs.add("inventory: takes one of url, file or query")
+	}
+
+	if inventory.Query != "" {
+		db := inventory.Database
+		if db.Engine != "mysql" && db.Engine != "mariadb" {
+			errs.add("inventory: database.engine must be mysql or mariadb, got %q", db.Engine)
+		}
+		if db.Host == "" {
+			errs.add("inventory: database.host is required")
+		}
+	}
+}
+
+// Fetch the inventory's database entries
+func (inventory InventoryConfig) fetch(ctx context.Context) ([]DatabaseConfig, error) {
+	var data []byte
+	var err error
+
+	switch {
+	case inventory.URL != "":
+		data, err = inventory.get(ctx)
+	case inventory.File != "":
+		data, err = os.ReadFile(inventory.File)
+	default:
+		return inventory.query()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// JSON is valid YAML, so both are decoded the same way as the config
+	databases := []DatabaseConfig{}
+	err = decodeStrict(data, &databases)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", inventory.source(), err)
+	}
+
+	return databases, nil
+}
+
+// Request the inventory from its HTTP endpoint
+func (inventory InventoryConfig) get(ctx context.Context) ([]byte, error) {
+	client := http.Client{Timeout: 30 * time.Second}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, inventory.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	if inventory.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+inventory.Token.reveal())
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error fetching %s: unexpected status %s", inventory.URL, resp.Status)
+	}
+
+	return io.ReadAll(resp.Body)
+}
+
+// Run the inventory query and build an entry from each row
+func (inventory InventoryConfig) query() ([]DatabaseConfig, error) {
+	output, err := mysqlQuery(inventory.Database, inventory.Database.DBName, inventory.Query)
+	if err != nil {
+		return nil, fmt.Errorf("error running inventory query: %w", err)
+	}
+
+	databases := []DatabaseConfig{}
+
+	for i, line := range strings.Split(strings.TrimRight(output, "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+
+		columns := strings.Split(line, "\t")
+		if len(columns) != 6 {
+			return nil, fmt.Errorf("inventory query row %d has %d columns, expected engine, host, port, username, password and name", i+1, len(columns))
+		}
+
+		// The mysql client prints NULL for missing values
+		for j := range columns {
+			if columns[j] == "NULL" {
+				columns[j] = ""
+			}
+		}
+
+		db := DatabaseConfig{
+			Engine:   columns[0],
+			Host:     columns[1],
+			Username: columns[3],
+			Password: Secret(columns[4]),
+			DBName:   columns[5],
+		}
+
+		if columns[2] != "" {
+			db.Port, err = strconv.Atoi(columns[2])
+			if err != nil {
+				return nil, fmt.Errorf("inventory query row %d has invalid port %q", i+1, columns[2])
+			}
+		}
+
+		databases = append(databases, db)
+	}
+
+	return databases, nil
+}
+
+// Return a copy of the config with the inventory's databases added. Invalid
+// entries are logged and left out so one bad entry doesn't stop every backup.
+// The inventory is cleared from the copy so it's only fetched once.
+func withInventory(ctx context.Context, config Config) (Config, error) {
+	inventory := config.Inventory
+	if !inventory.enabled() {
+		return config, nil
+	}
+
+	fetched, err := inventory.fetch(ctx)
+	if err != nil {
+		return config, fmt.Errorf("error fetching inventory: %w", err)
+	}
+	registerSecrets(Config{Databases: fetched})
+
+	databases := append([]DatabaseConfig{}, config.Databases...)
+
+	for i, db := range fetched {
+		db.source = fmt.Sprintf("%s[%d]", inventory.source(), i)
+		applyDatabaseDefaults(&db, inventory.base)
+
+		errs := validationErrors{}
+		validateDatabase(&errs, config, db.source, db)
+		if len(errs) > 0 {
+			log.Printf("Skipping invalid inventory entry: %s\n", strings.Join(errs, "; "))
+			continue
+		}
+
+		databases = append(databases, db)
+	}
+
+	if len(databases) == 0 {
+		return config, fmt.Errorf("no valid databases in %s", inventory.source())
+	}
+
+	log.Printf("Fetched %d databases from %s\n", len(databases)-len(config.Databases), inventory.source())
+
+	config.Databases = databases
+	config.Inventory = InventoryConfig{}
+
+	return config, nil
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// S3 allows at most this many tags per object
+const maxObjectTags = 10
+
+// Merge the run's labels with a database's, the database's taking precedence
+func mergeLabels(run map[string]string, db map[string]string) map[string]string {
+	if len(run) == 0 && len(db) == 0 {
+		return nil
+	}
+
+	merged := map[string]string{}
+	for key, value := range run {
+		merged[key] = value
+	}
+	for key, value := range db {
+		merged[key] = value
+	}
+
+	return merged
+}
+
+// Format labels as sorted key=value pairs joined by sep
+func formatLabels(labels map[string]string, sep string) string {
+	pairs := []string{}
+	for key, value := range labels {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+
+	return strings.Join(pairs, sep)
+}
+
+// Encode labels as the tagging header of an S3 upload
+func objectTagging(labels map[string]string) string {
+	values := url.Values{}
+	for key, value := range labels {
+		values.Set(key, value)
+	}
+
+	return values.Encode()
+}
+
+// Parse a key=value label filter
+func parseLabel(filter string) (string, string, error) {
+	parts := strings.SplitN(filter, "=", 2)
+	if len(parts) != 2 || parts[0] == "" {
+		return "", "", fmt.Errorf("invalid label %q, expected key=value", filter)
+	}
+
+	return parts[0], parts[1], nil
+}
+
+// Keep only the databases with the label, dropping runs left with none
+func filterByLabel(reports []RunReport, key string, value string) []RunReport {
+	filtered := []RunReport{}
+
+	for _, report := range reports {
+		databases := []DatabaseReport{}
+		for _, db := range report.Databases {
+			if db.Labels[key] == value {
+				databases = append(databases, db)
+			}
+		}
+
+		if len(databases) > 0 {
+			report.Databases = databases
+			filtered = append(filtered, report)
+		}
+	}
+
+	return filtered
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Read a target's bucket lifecycle, versioning and object lock settings and
+// describe any that conflict with its retention: rules expiring backups
+// before the retention is up, versioning keeping pruned backups around, or
+// object lock stopping them being pruned at all. Nothing is changed.
+func lifecycleConflicts(ctx context.Context, target TargetConfig) ([]string, error) {
+	if target.Type != "s3" {
+		return nil, nil
+	}
+
+	var retention time.Duration
+	if target.Retention != "" {
+		var err error
+		retention, err = parseDuration(target.Retention)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	sess, err := target.session()
+	if err != nil {
+		return nil, err
+	}
+	client := s3.New(sess)
+	prefix := target.key(backupNamePrefix)
+
+	conflicts := []string{}
+
+	lifecycle, err := client.GetBucketLifecycleConfigurationWithContext(ctx, &s3.GetBucketLifecycleConfigurationInput{
+		Bucket: aws.String(target.Bucket),
+	})
+	if err != nil && !isAWSError(err, "NoSuchLifecycleConfiguration") {
+		return nil, fmt.Errorf("error reading lifecycle rules: %w", err)
+	}
+	if lifecycle != nil {
+		for _, rule := range lifecycle.Rules {
+			if aws.StringValue(rule.Status) != "Enabled" || !ruleMatches(rule, prefix) || rule.Expiration == nil {
+				continue
+			}
+
+			name := aws.StringValue(rule.ID)
+			days := aws.Int64Value(rule.Expiration.Days)
+			if days > 0 && (retention == 0 || time.Duration(days)*24*time.Hour < retention) {
+				kept := "forever"
+				if retention > 0 {
+					kept = "for " + target.Retention
+				}
+				conflicts = append(conflicts, fmt.Sprintf("lifecycle rule %q expires backups after %d days, but retention keeps them %s", name, days, kept))
+			}
+			if rule.Expiration.Date != nil {
+				conflicts = append(conflicts, fmt.Sprintf("lifecycle rule %q expires backups on %s regardless of retention", name, rule.Expiration.Date.Format("2006-01-02")))
+			}
+		}
+	}
+
+	versioning, err := client.GetBucketVersioningWithContext(ctx, &s3.GetBucketVersioningInput{
+		Bucket: aws.String(target.Bucket),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error reading versioning: %w", err)
+	}
+	if aws.StringValue(versioning.Status) == "Enabled" && retention > 0 && !expiresNoncurrent(lifecycle, prefix) {
+		conflicts = append(conflicts, "versioning is enabled with no lifecycle rule expiring noncurrent versions, so pruned backups are kept as old versions indefinitely")
+	}
+
+	lock, err := client.GetObjectLockConfigurationWithContext(ctx, &s3.GetObjectLockConfigurationInput{
+		Bucket: aws.String(target.Bucket),
+	})
+	if err != nil && !isAWSError(err, "ObjectLockConfigurationNotFoundError") {
+		return nil, fmt.Errorf("error reading object lock: %w", err)
+	}
+	if lock != nil && lock.ObjectLockConfiguration != nil && lock.ObjectLockConfiguration.Rule != nil && lock.ObjectLockConfiguration.Rule.DefaultRetention != nil {
+		defaults := lock.ObjectLockConfiguration.Rule.DefaultRetention
+		locked := time.Duration(aws.Int64Value(defaults.Days))*24*time.Hour + time.Duration(aws.Int64Value(defaults.Years))*365*24*time.Hour
+		if retention > 0 && locked > retention {
+			conflicts = append(conflicts, fmt.Sprintf("object lock keeps backups for %s, longer than the retention of %s, so pruning them will fail", locked, target.Retention))
+		}
+	}
+
+	return conflicts, nil
+}
+
+// Check whether a lifecycle rule applies to keys starting with prefix. Rules
+// filtered by tag are assumed to, as backups may carry the tag.
+func ruleMatches(rule *s3.LifecycleRule, prefix string) bool {
+	rulePrefix := aws.StringValue(rule.Prefix)
+	if rule.Filter != nil {
+		rulePrefix = aws.StringValue(rule.Filter.Prefix)
+		if rule.Filter.And != nil {
+			rulePrefix = aws.StringValue(rule.Filter.And.Prefix)
+		}
+	}
+
+	return strings.HasPrefix(prefix, rulePrefix) || strings.HasPrefix(rulePrefix, prefix)
+}
+
+// Check whether any enabled lifecycle rule expires old versions of backups
+func expiresNoncurrent(lifecycle *s3.GetBucketLifecycleConfigurationOutput, prefix string) bool {
+	if lifecycle == nil {
+		return false
+	}
+
+	for _, rule := range lifecycle.Rules {
+		if aws.StringValue(rule.Status) == "Enabled" && ruleMatches(rule, prefix) && rule.NoncurrentVersionExpiration != nil {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Check whether an error is an AWS error with the given code
+func isAWSError(err error, code string) bool {
+	awsErr, ok := err.(awserr.Error)
+	return ok && awsErr.Code() == code
+}
+
+// Warn about bucket settings that conflict with each target's retention
+func checkLifecycles(ctx context.Context, config Config) {
+	for _, target := range config.targets() {
+		conflicts, err := lifecycleConflicts(ctx, target)
+		if err != nil {
+			log.Printf("Error checking bucket settings of %s: %s\n", target.Name, err.Error())
+			continue
+		}
+
+		for _, conflict := range conflicts {
+			log.Printf("Warning: on %s, %s\n", target.Name, conflict)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Statements taking and releasing each lock mode
+var mysqlLocks = map[string]struct{ lock, unlock string }{
+	"flush":    {"FLUSH TABLES WITH READ LOCK", "UNLOCK TABLES"},
+	"instance": {"LOCK INSTANCE FOR BACKUP", "UNLOCK INSTANCE"},
+}
+
+// How long a lock is held for at most when max_lock_time isn't set
+const defaultMaxLockTime = 15 * time.Minute
+
+// Get the longest a lock may be held for
+func (db DatabaseConfig) maxLockTime() time.Duration {
+	if db.MaxLockTime == "" {
+		return defaultMaxLockTime
+	}
+
+	limit, err := parseDuration(db.MaxLockTime)
+	if err != nil {
+		return defaultMaxLockTime
+	}
+
+	return limit
+}
+
+// Run a dump while holding the database's lock in a separate session. The
+// session is killed, releasing the lock, if the dump takes longer than
+// max_lock_time, and the dump then fails as it may be inconsistent.
+func withMySQLLock(ctx context.Context, db DatabaseConfig, dump func() error) error {
+	statements := mysqlLocks[db.Lock]
+	limit := db.maxLockTime()
+
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "mysql", append(mysqlConnectionArgs(db), "--batch", "--skip-column-names", "--unbuffered")...)
+	cmd.Env = mysqlEnv(db)
+	cmd.Stderr = &stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	// Give up waiting for the lock, e.g. behind a long running query, rather than
+	// leave every other query queued up behind it
+	fmt.Fprintf(stdin, "SET SESSION lock_wait_timeout = %d;\n", int(limit.Seconds()))
+	fmt.Fprintf(stdin, "%s;\nSELECT 'locked';\n", statements.lock)
+
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil || strings.TrimSpace(line) != "locked" {
+		stdin.Close()
+		cmd.Process.Kill()
+		cmd.Wait()
+		return fmt.Errorf("error running %s: %s", statements.lock, strings.TrimSpace(stderr.String()))
+	}
+
+	log.Printf("Holding %s on %s for at most %s\n", statements.lock, db.Host, limit)
+	locked := time.Now()
+
+	var released int32
+	timer := time.AfterFunc(limit, func() {
+		log.Printf("Releasing lock on %s after max_lock_time of %s\n", db.Host, limit)
+		atomic.StoreInt32(&released, 1)
+		cmd.Process.Kill()
+	})
+
+	err = dump()
+	timer.Stop()
+
+	fmt.Fprintf(stdin, "%s;\n", statements.unlock)
+	stdin.Close()
+	cmd.Wait()
+
+	if atomic.LoadInt32(&released) == 1 {
+		if err == nil {
+			err = fmt.Errorf("lock released after max_lock_time of %s before the dump finished, it may be inconsistent", limit)
+		}
+		return err
+	}
+
+	log.Printf("Released lock on %s after %s\n", db.Host, time.Since(locked).Round(time.Second))
+
+	return err
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"time"
+)
+
+// A pause of scheduled runs for planned maintenance, kept in the reports
+// directory so the command line, the API and the daemon all see it
+type MaintenancePause struct {
+	Until   time.Time `json:"until"`
+	Reason  string    `json:"reason"`
+	Since   time.Time `json:"since"`
+	Trigger string    `json:"trigger"`
+}
+
+// File the pause is kept in
+func pauseFile(config Config) string {
+	return filepath.Join(config.ReportsDir, "pause.json")
+}
+
+// Get the pause in effect, if any
+func (config Config) activePause() *MaintenancePause {
+	data, err := os.ReadFile(pauseFile(config))
+	if err != nil {
+		return nil
+	}
+
+	pause := MaintenancePause{}
+	if err := json.Unmarshal(data, &pause); err != nil {
+		log.Printf("Error reading %s: %s\n", pauseFile(config), err.Error())
+		return nil
+	}
+	if !clk.Now().Before(pause.Until) {
+		return nil
+	}
+
+	return &pause
+}
+
+// Pause scheduled runs for a while, recording why in the audit log
+func pauseRuns(config Config, duration time.Duration, reason string, trigger string) (MaintenancePause, error) {
+	now := clk.Now()
+	pause := MaintenancePause{Until: now.Add(duration), Reason: reason, Since: now, Trigger: trigger}
+
+	data, err := json.MarshalIndent(pause, "", "  ")
+	if err == nil {
+		err = os.WriteFile(pauseFile(config), data, 0644)
+	}
+	auditLog(config, "pause", fmt.Sprintf("until %s: %s", pause.Until.Format(time.RFC3339), reason), trigger, err)
+	if err != nil {
+		return pause, err
+	}
+
+	log.Printf("Scheduled backups paused until %s: %s\n", pause.Until.Format(time.RFC3339), reason)
+	return pause, nil
+}
+
+// End a pause early
+func resumeRuns(config Config, trigger string) error {
+	err := os.Remove(pauseFile(config))
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	auditLog(config, "resume", "scheduled backups", trigger, err)
+	if err != nil {
+		return err
+	}
+
+	log.Println("Scheduled backups resumed")
+	return nil
+}
+
+// Handle the pause subcommand.
+// Usage: pause --for 4h --reason "..."
+func runPause(config Config, args []string) error {
+	flags := flag.NewFlagSet("pause", flag.ContinueOnError)
+	duration := flags.String("for", "", "how long to pause scheduled backups, e.g. \"4h\"")
+	reason := flags.String("reason", "", "why backups are paused, recorded in the audit log and skipped run reports")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return withExitCode(exitConfig, err)
+	}
+
+	if *duration == "" || *reason == "" {
+		return withExitCode(exitConfig, fmt.Errorf("--for and --reason are required"))
+	}
+	length, err := parseDuration(*duration)
+	if err != nil || length <= 0 {
+		return withExitCode(exitConfig, fmt.Errorf("invalid --for %q", *duration))
+	}
+
+	_, err = pauseRuns(config, length, *reason, commandTrigger())
+	return err
+}
+
+// Handle the resume subcommand
+func runResume(config Config) error {
+	if config.activePause() == nil {
+		log.Println("Scheduled backups aren't paused")
+		return nil
+	}
+
+	return resumeRuns(config, commandTrigger())
+}
+
+// Serve the current pause on GET, pause with a JSON body of "for" and
+// "reason" on POST and resume on DELETE
+func pauseHandler(config Config) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			writeJSON(w, http.StatusOK, map[string]interface{}{"pause": config.activePause()})
+		case http.MethodPost:
+			request := struct {
+				For    string `json:"for"`
+				Reason string `json:"reason"`
+			}{}
+			if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+				writeJSONError(w, http.StatusBadRequest, "invalid JSON body")
+				return
+			}
+
+			length, err := parseDuration(request.For)
+			if err != nil || length <= 0 || request.Reason == "" {
+				writeJSONError(w, http.StatusBadRequest, "for must be a duration and reason must be set")
+				return
+			}
+
+			pause, err := pauseRuns(config, length, request.Reason, "api")
+			if err != nil {
+				writeJSONError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{"pause": pause})
+		case http.MethodDelete:
+			if err := resumeRuns(config, "api"); err != nil {
+				writeJSONError(w, http.StatusInternalServerError, err.Error())
+				return
+			}
+			writeJSON(w, http.StatusOK, map[string]interface{}{"pause": nil})
+		default:
+			writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+		}
+	}
+}
+
+// Pause every profile for maintenance.signal_pause on the pause signal and
+// resume them on the resume signal. Does nothing where there are no such
+// signals, e.g. on Windows.
+func watchPauseSignals(ctx context.Context, profiles []Config) {
+	if pauseSignal == nil {
+		return
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, pauseSignal, resumeSignal)
+	defer signal.Stop(signals)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case received := <-signals:
+			for _, config := range profiles {
+				var err error
+				if received == resumeSignal {
+					err = resumeRuns(config, "signal")
+				} else {
+					_, err = pauseRuns(config, config.signalPause(), "paused by signal", "signal")
+				}
+				if err != nil {
+					log.Printf("Error handling %s: %s\n", received, err.Error())
+				}
+			}
+		}
+	}
+}
+
+// Get how long the pause signal pauses for, defaulting to 4 hours
+func (config Config) signalPause() time.Duration {
+	if config.Maintenance.SignalPause != "" {
+		if length, err := parseDuration(config.Maintenance.SignalPause); err == nil {
+			return length
+		}
+	}
+
+	return 4 * time.Hour
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Hold a single masking rule applied to a column of a dumped table
+type MaskingRule struct {
+	Table  string `yaml:"table"`
+	Column string `yaml:"column"`
+	Method string `yaml:"method"` // "hash", "nullify" or "faker"
+	Faker  string `yaml:"faker"`  // "email", "name" or "phone" when method is "faker"
+}
+
+// Unescape a quoted MySQL string literal, or return the raw value unchanged
+func unquoteSQLValue(value string) string {
+	if len(value) < 2 || value[0] != '\'' {
+		return value
+	}
+
+	var b strings.Builder
+	inner := value[1 : len(value)-1]
+
+	for i := 0; i < len(inner); i++ {
+		if inner[i] == '\\' && i+1 < len(inner) {
+			i++
+		}
+		b.WriteByte(inner[i])
+	}
+
+	return b.String()
+}
+
+// Apply a masking rule to a single SQL value
+func maskValue(rule MaskingRule, value string) string {
+	if value == "NULL" || rule.Method == "nullify" {
+		return "NULL"
+	}
+
+	sum := sha256.Sum256([]byte(unquoteSQLValue(value)))
+	hash := hex.EncodeToString(sum[:])
+
+	switch rule.Method {
+	case "hash":
+		return "'" + hash + "'"
+	case "faker":
+		switch rule.Faker {
+		case "email":
+			return fmt.Sprintf("'user_%s@example.com'", hash[:12])
+		case "name":
+			return fmt.Sprintf("'Person %s'", strings.ToUpper(hash[:6]))
+		case "phone":
+			digits := ""
+			for _, b := range sum[:7] {
+				digits += fmt.Sprintf("%d", b%10)
+			}
+			return fmt.Sprintf("'+1555%s'", digits)
+		default:
+			return fmt.Sprintf("'masked_%s'", hash[:12])
+		}
+	}
+
+	return "NULL"
+}
+
+// Rewrite the values of an extended INSERT statement, masking the given column positions
+func maskInsertValues(values string, masks map[int]MaskingRule) string {
+	var out strings.Builder
+	var current strings.Builder
+
+	column := 0
+	depth := 0
+	inString := false
+
+	flush := func() {
+		value := current.String()
+		if rule, ok := masks[column]; ok {
+			value = maskValue(rule, strings.TrimSpace(value))
+		}
+		out.WriteString(value)
+		current.Reset()
+	}
+
+	for i := 0; i < len(values); i++ {
+		c := values[i]
+
+		if inString {
+			current.WriteByte(c)
+			if c == '\\' && i+1 < len(values) {
+				i++
+				current.WriteByte(values[i])
+			} else if c == '\'' {
+				inString = false
+			}
+			continue
+		}
+
+		switch {
+		case c == '\'':
+			inString = true
+			current.WriteByte(c)
+		case c == '(' && depth == 0:
+			depth++
+			column = 0
+			out.WriteByte(c)
+		case c == '(':
+			depth++
+			current.WriteByte(c)
+		case c == ')' && depth == 1:
+			flush()
+			depth--
+			out.WriteByte(c)
+		case c == ')':
+			depth--
+			current.WriteByte(c)
+		case c == ',' && depth == 1:
+			flush()
+			column++
+			out.WriteByte(c)
+		case depth == 0:
+			out.WriteByte(c)
+		default:
+			current.WriteByte(c)
+		}
+	}
+
+	return out.String()
+}
+
+// Copy a mysqldump file, masking the configured columns in every INSERT statement.
+// Column positions are taken from the CREATE TABLE statement preceding the data.
+func maskDump(inPath string, outPath string, rules []MaskingRule) error {
+	in, err := os.Open(inPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(outPath)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	return maskStream(in, out, rules)
+}
+
+// Check every masking rule names a table and column that exist in the
+// database, or any database for "*", since a rule that matches nothing would
+// leave the data it was meant to mask in the clear
+func checkMaskingRules(db DatabaseConfig, dbName string) error {
+	tables := []string{}
+	for _, rule := range db.Masking {
+		tables = append(tables, quoteString(rule.Table))
+	}
+
+	query := "SELECT TABLE_NAME, COLUMN_NAME FROM information_schema.COLUMNS WHERE TABLE_NAME IN (" + strings.Join(tables, ", ") + ")"
+	if dbName != "*" && dbName != "--all-databases" {
+		query += " AND TABLE_SCHEMA = " + quoteString(dbName)
+	}
+
+	output, err := mysqlQuery(db, "", query)
+	if err != nil {
+		return fmt.Errorf("error checking masking rules: %w", err)
+	}
+
+	existing := map[string]bool{}
+	for _, line := range strings.Split(output, "\n") {
+		existing[line] = true
+	}
+
+	missing := []string{}
+	for _, rule := range db.Masking {
+		if !existing[rule.Table+"\t"+rule.Column] {
+			missing = append(missing, rule.Table+"."+rule.Column)
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("masking rules match no column in %s: %s", dbName, strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// Get the table named at the start of a statement's text, after CREATE TABLE
+// or INSERT INTO. mysqlpump qualifies it with the database, `db`.`table`,
+// where mysqldump only gives the table.
+func statementTable(text string) (string, bool) {
+	name, rest, ok := cutIdentifier(text)
+	if !ok {
+		return "", false
+	}
+
+	if strings.HasPrefix(rest, ".`") {
+		table, _, ok := cutIdentifier(rest[1:])
+		return table, ok
+	}
+
+	return name, true
+}
+
+// Split a backtick quoted identifier off the start of text, returning it
+// unquoted and the text after it
+func cutIdentifier(text string) (string, string, bool) {
+	if !strings.HasPrefix(text, "`") {
+		return "", text, false
+	}
+
+	var name strings.Builder
+	for i := 1; i < len(text); i++ {
+		if text[i] != '`' {
+			name.WriteByte(text[i])
+			continue
+		}
+		if i+1 < len(text) && text[i+1] == '`' {
+			name.WriteByte('`')
+			i++
+			continue
+		}
+		return name.String(), text[i+1:], true
+	}
+
+	return "", text, false
+}
+
+// Mask a SQL dump as it is copied from in to out. A rule for a table in the
+// dump naming a column the table doesn't have fails it, as does data for a
+// masked table without its CREATE TABLE.
+func maskStream(in io.Reader, out io.Writer, rules []MaskingRule) error {
+	reader := bufio.NewReaderSize(in, 1024*1024)
+	writer := bufio.NewWriterSize(out, 1024*1024)
+
+	rulesByTable := map[string]map[string]MaskingRule{}
+	for _, rule := range rules {
+		if rulesByTable[rule.Table] == nil {
+			rulesByTable[rule.Table] = map[string]MaskingRule{}
+		}
+		rulesByTable[rule.Table][rule.Column] = rule
+	}
+
+	columns := map[string][]string{}
+	createTable := ""
+
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		if createTable != "" {
+			trimmed := strings.TrimSpace(line)
+			if strings.HasPrefix(trimmed, "`") {
+				end := strings.Index(trimmed[1:], "`")
+				if end >= 0 {
+					columns[createTable] = append(columns[createTable], trimmed[1:end+1])
+				}
+			} else if strings.HasPrefix(trimmed, ")") {
+				for column := range rulesByTable[createTable] {
+					if !contains(columns[createTable], column) {
+						return fmt.Errorf("masking rule for %s.%s matches no column of %s", createTable, column, createTable)
+					}
+				}
+				createTable = ""
+			}
+		} else if strings.HasPrefix(line, "CREATE TABLE `") {
+			if table, ok := statementTable(strings.TrimPrefix(line, "CREATE TABLE ")); ok {
+				createTable = table
+				columns[createTable] = []string{}
+			}
+		} else if strings.HasPrefix(line, "INSERT INTO `") {
+			table, ok := statementTable(strings.TrimPrefix(line, "INSERT INTO "))
+
+			if ok && rulesByTable[table] != nil {
+				if _, ok := columns[table]; !ok {
+					return fmt.Errorf("no CREATE TABLE for %s before its data, so its columns can't be masked", table)
+				}
+
+				masks := map[int]MaskingRule{}
+				for i, column := range columns[table] {
+					if rule, ok := rulesByTable[table][column]; ok {
+						masks[i] = rule
+					}
+				}
+
+				if split := strings.Index(line, " VALUES "); split >= 0 && len(masks) > 0 {
+					line = line[:split+8] + maskInsertValues(line[split+8:], masks)
+				}
+			}
+		}
+
+		if _, werr := writer.WriteString(line); werr != nil {
+			return werr
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	return writer.Flush()
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+const maskingTestDump = "CREATE TABLE `users` (\n" +
+	"  `id` int NOT NULL,\n" +
+	"  `email` varchar(255) DEFAULT NULL,\n" +
+	"  `note` text,\n" +
+	"  PRIMARY KEY (`id`)\n" +
+	") ENGINE=InnoDB;\n" +
+	"INSERT INTO `users` VALUES (1,'a@example.org','it''s (fine), really'),(2,'b\\'c@example.org',NULL);\n" +
+	"CREATE TABLE `orders` (\n" +
+	"  `id` int NOT NULL,\n" +
+	"  `email` varchar(255) DEFAULT NULL\n" +
+	") ENGINE=InnoDB;\n" +
+	"INSERT INTO `orders` VALUES (1,'a@example.org');\n"
+
+func maskTestDump(t *testing.T, dump string, rules []MaskingRule) (string, error) {
+	t.Helper()
+
+	var out bytes.Buffer
+	err := maskStream(strings.NewReader(dump), &out, rules)
+	return out.String(), err
+}
+
+func TestMaskStream(t *testing.T) {
+	rules := []MaskingRule{
+		{Table: "users", Column: "email", Method: "faker", Faker: "email"},
+		{Table: "users", Column: "note", Method: "nullify"},
+	}
+
+	masked, err := maskTestDump(t, maskingTestDump, rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	first := maskValue(rules[0], "'a@example.org'")
+	second := maskValue(rules[0], `'b\'c@example.org'`)
+	want := "INSERT INTO `users` VALUES (1," + first + ",NULL),(2," + second + ",NULL);\n"
+	if !strings.Contains(masked, want) {
+		t.Errorf("users masked as:\n%s\nwant:\n%s", masked, want)
+	}
+
+	// Other tables pass through untouched, even with a column of the same name
+	if !strings.Contains(masked, "INSERT INTO `orders` VALUES (1,'a@example.org');\n") {
+		t.Errorf("orders was changed:\n%s", masked)
+	}
+
+	if strings.Contains(masked, "b\\'c@example.org") || strings.Count(masked, "a@example.org") != 1 {
+		t.Errorf("unmasked email left in the dump:\n%s", masked)
+	}
+}
+
+func TestMaskValue(t *testing.T) {
+	hash := maskValue(MaskingRule{Method: "hash"}, "'secret'")
+	if hash != maskValue(MaskingRule{Method: "hash"}, "'secret'") || len(hash) != 66 {
+		t.Errorf("hash masked as %s", hash)
+	}
+
+	if masked := maskValue(MaskingRule{Method: "hash"}, "NULL"); masked != "NULL" {
+		t.Errorf("NULL masked as %s", masked)
+	}
+
+	if masked := maskValue(MaskingRule{Method: "faker", Faker: "phone"}, "'555 0100'"); !strings.HasPrefix(masked, "'+1555") || len(masked) != 14 {
+		t.Errorf("phone masked as %s", masked)
+	}
+}
+
+func TestMaskStreamRejectsUnknownColumns(t *testing.T) {
+	rules := []MaskingRule{{Table: "users", Column: "emial", Method: "hash"}}
+
+	_, err := maskTestDump(t, maskingTestDump, rules)
+	if err == nil || !strings.Contains(err.Error(), "users.emial") {
+		t.Errorf("masking a missing column returned %v", err)
+	}
+}
+
+func TestMaskStreamRejectsDataWithoutSchema(t *testing.T) {
+	rules := []MaskingRule{{Table: "users", Column: "email", Method: "hash"}}
+
+	_, err := maskTestDump(t, "INSERT INTO `users` VALUES (1,'a@example.org','');\n", rules)
+	if err == nil {
+		t.Error("masking data without its CREATE TABLE succeeded")
+	}
+}
+
+func TestCheckMaskingRules(t *testing.T) {
+	fake := newFakeCommands()
+	fake.answer = func(args []string) (string, error) {
+		return "users\tid\nusers\temail\n", nil
+	}
+	runner = fake
+	defer func() { runner = systemCommands{} }()
+
+	db := DatabaseConfig{Masking: []MaskingRule{
+		{Table: "users", Column: "email", Method: "hash"},
+		{Table: "users", Column: "phone", Method: "hash"},
+		{Table: "accounts", Column: "email", Method: "hash"},
+	}}
+
+	err := checkMaskingRules(db, "shop")
+	if err == nil || !strings.Contains(err.Error(), "users.phone, accounts.email") {
+		t.Errorf("checking rules returned %v", err)
+	}
+
+	query := fake.commandsRun()[0]
+	if !strings.Contains(strings.Join(query, " "), "TABLE_SCHEMA = 'shop'") {
+		t.Errorf("checked with %v", query)
+	}
+
+	db.Masking = db.Masking[:1]
+	if err := checkMaskingRules(db, "shop"); err != nil {
+		t.Errorf("checking matching rules returned %v", err)
+	}
+}
+
+func TestMaskStreamMysqlpump(t *testing.T) {
+	// mysqlpump qualifies every table with its database
+	dump := "CREATE TABLE `shop`.`users` (\n" +
+		"`id` int NOT NULL,\n" +
+		"`email` varchar(255) DEFAULT NULL\n" +
+		") ENGINE=InnoDB;\n" +
+		"INSERT INTO `shop`.`users` VALUES (1,'a@example.org'),(2,'b@example.org');\n" +
+		"INSERT INTO `shop`.`orders` VALUES (1,'a@example.org');\n"
+
+	rule := MaskingRule{Table: "users", Column: "email", Method: "hash"}
+	masked, err := maskTestDump(t, dump, []MaskingRule{rule})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "INSERT INTO `shop`.`users` VALUES (1," + maskValue(rule, "'a@example.org'") + "),(2," + maskValue(rule, "'b@example.org'") + ");\n"
+	if !strings.Contains(masked, want) {
+		t.Errorf("mysqlpump dump masked as:\n%s\nwant:\n%s", masked, want)
+	}
+	if strings.Count(masked, "a@example.org") != 1 {
+		t.Errorf("orders was changed or users left unmasked:\n%s", masked)
+	}
+}
+
+func TestStatementTable(t *testing.T) {
+	tests := map[string]string{
+		"`users` VALUES (1);":           "users",
+		"`shop`.`users` VALUES (1);":    "users",
+		"`odd``name` (":                 "odd`name",
+		"`shop`.`odd``name` VALUES ();": "odd`name",
+	}
+
+	for text, want := range tests {
+		if got, ok := statementTable(text); !ok || got != want {
+			t.Errorf("statementTable(%q) = %q, %v, want %q", text, got, ok, want)
+		}
+	}
+
+	if _, ok := statementTable("users VALUES (1);"); ok {
+		t.Error("unquoted name was parsed")
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// Hold the limits on memory compression and uploads use, for running beside
+// the database on small machines
+type MemoryConfig struct {
+	// Size of the buffers dumps and files are copied through while they're
+	// compressed and archived, e.g. "256K". Defaults to 32K.
+	BufferSize string `yaml:"buffer_size"`
+
+	// Size of each part of S3 uploads, which is held in memory while it's
+	// sent, e.g. "16M". Defaults to 5M, the smallest S3 allows, and is raised
+	// for files too big to upload in 10,000 parts.
+	UploadPartSize string `yaml:"upload_part_size"`
+
+	// How many parts of an upload are sent at once. Defaults to 5.
+	UploadConcurrency int `yaml:"upload_concurrency"`
+
+	// Memory all uploads together may hold in parts, e.g. "64M". Uploads
+	// send fewer parts at once to fit, and wait for others to finish rather
+	// than go over it.
+	MaxMemory string `yaml:"max_memory"`
+}
+
+// Size of copy buffers by default, the same as io.Copy's
+const defaultBufferSize = 32 * 1024
+
+// The memory settings in effect, set from the top-level config at startup
+var (
+	copyBufferSize          = defaultBufferSize
+	uploadPartSize    int64 = s3manager.DefaultUploadPartSize
+	uploadConcurrency       = s3manager.DefaultUploadConcurrency
+	uploadMemory      *memoryBudget
+)
+
+// The memory settings parsed from a MemoryConfig
+type memorySettings struct {
+	bufferSize  int
+	partSize    int64
+	concurrency int
+	maxMemory   int64
+}
+
+// Parse the configured limits, filling in the defaults
+func (limits MemoryConfig) settings() (memorySettings, error) {
+	settings := memorySettings{bufferSize: defaultBufferSize, partSize: s3manager.DefaultUploadPartSize, concurrency: s3manager.DefaultUploadConcurrency}
+
+	if limits.BufferSize != "" {
+		size, err := parseSize(limits.BufferSize)
+		if err != nil || size <= 0 {
+			return settings, fmt.Errorf("invalid buffer_size %q", limits.BufferSize)
+		}
+		settings.bufferSize = int(size)
+	}
+
+	if limits.UploadPartSize != "" {
+		size, err := parseSize(limits.UploadPartSize)
+		if err != nil || size < s3manager.MinUploadPartSize {
+			return settings, fmt.Errorf("invalid upload_part_size %q, it must be at least 5M", limits.UploadPartSize)
+		}
+		settings.partSize = size
+	}
+
+	if limits.UploadConcurrency > 0 {
+		settings.concurrency = limits.UploadConcurrency
+	}
+
+	if limits.MaxMemory != "" {
+		size, err := parseSize(limits.MaxMemory)
+		if err != nil || size < settings.partSize {
+			return settings, fmt.Errorf("invalid max_memory %q, it must be at least the upload part size", limits.MaxMemory)
+		}
+		settings.maxMemory = size
+	}
+
+	return settings, nil
+}
+
+// Apply the configured memory limits to the whole process
+func applyMemoryLimits(limits MemoryConfig) error {
+	settings, err := limits.settings()
+	if err != nil {
+		return err
+	}
+
+	copyBufferSize = settings.bufferSize
+	uploadPartSize = settings.partSize
+	uploadConcurrency = settings.concurrency
+	if settings.maxMemory > 0 {
+		uploadMemory = &memoryBudget{limit: settings.maxMemory, released: make(chan struct{})}
+	}
+
+	return nil
+}
+
+// Copy through a buffer of the configured size
+func copyBuffered(dst io.Writer, src io.Reader) (int64, error) {
+	return io.CopyBuffer(dst, src, make([]byte, copyBufferSize))
+}
+
+// Memory shared out between uploads, which wait for each other's to be
+// released when there isn't enough left
+type memoryBudget struct {
+	mutex sync.Mutex
+	limit int64
+	used  int64
+
+	// Closed and replaced whenever memory is released
+	released chan struct{}
+}
+
+func (b *memoryBudget) acquire(ctx context.Context, n int64) error {
+	for {
+		b.mutex.Lock()
+		if b.used+n <= b.limit {
+			b.used += n
+			b.mutex.Unlock()
+			return nil
+		}
+		released := b.released
+		b.mutex.Unlock()
+
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (b *memoryBudget) release(n int64) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.used -= n
+	close(b.released)
+	b.released = make(chan struct{})
+}
+
+// Set uploaders' part size and concurrency for a file of the given size,
+// waiting until max_memory has room for their parts. Uploaders streaming the
+// same file at once share the budget, as none can finish without the others.
+// The returned function gives the memory back once the uploads are done.
+func reserveUploadMemory(ctx context.Context, uploaders []*s3manager.Uploader, size int64) (func(), error) {
+	var n int64
+	for _, u := range uploaders {
+		u.PartSize = uploadPartSize
+		u.Concurrency = uploadConcurrency
+
+		// Uploads of unknown length, as ours are, fail after MaxUploadParts
+		if size/u.PartSize >= s3manager.MaxUploadParts {
+			u.PartSize = size/(s3manager.MaxUploadParts-1) + 1
+		}
+
+		if uploadMemory == nil {
+			continue
+		}
+
+		if fit := int(uploadMemory.limit / int64(len(uploaders)) / u.PartSize); fit < u.Concurrency {
+			u.Concurrency = fit
+			if u.Concurrency < 1 {
+				// A part bigger than the budget, raised for a very big file, is
+				// still sent, alone
+				u.Concurrency = 1
+			}
+		}
+
+		n += u.PartSize * int64(u.Concurrency)
+	}
+
+	if uploadMemory == nil {
+		return func() {}, nil
+	}
+
+	if n > uploadMemory.limit {
+		n = uploadMemory.limit
+	}
+
+	err := uploadMemory.acquire(ctx, n)
+	if err != nil {
+		return nil, err
+	}
+
+	return func() { uploadMemory.release(n) }, nil
+}
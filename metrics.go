@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"runtime"
+	"sort"
+	"strings"
+)
+
+// Escape a Prometheus label value
+func escapeLabel(value string) string {
+	value = strings.ReplaceAll(value, `\`, `\\`)
+	value = strings.ReplaceAll(value, `"`, `\"`)
+	return strings.ReplaceAll(value, "\n", `\n`)
+}
+
+// Replace the characters Prometheus doesn't allow in label names with underscores
+func metricLabelName(name string) string {
+	return strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+}
+
+// Render metrics in the Prometheus text exposition format
+func renderMetrics(config Config, reports []RunReport) string {
+	var b strings.Builder
+
+	fmt.Fprintln(&b, "# HELP dbbackup_build_info Version of the running build.")
+	fmt.Fprintln(&b, "# TYPE dbbackup_build_info gauge")
+	fmt.Fprintf(&b, "dbbackup_build_info{version=\"%s\",commit=\"%s\",goversion=\"%s\"} 1\n", escapeLabel(version), escapeLabel(commit), escapeLabel(runtime.Version()))
+
+	fmt.Fprintln(&b, "# HELP dbbackup_database_last_success_timestamp_seconds Time of the latest successful backup of each database, 0 if never.")
+	fmt.Fprintln(&b, "# TYPE dbbackup_database_last_success_timestamp_seconds gauge")
+	for _, f := range databaseFreshness(config, reports) {
+		var last int64
+		if !f.LastSuccess.IsZero() {
+			last = f.LastSuccess.Unix()
+		}
+		fmt.Fprintf(&b, "dbbackup_database_last_success_timestamp_seconds{engine=\"%s\",host=\"%s\",database=\"%s\"} %d\n", escapeLabel(f.Engine), escapeLabel(f.Host), escapeLabel(f.Name), last)
+	}
+
+	fmt.Fprintln(&b, "# HELP dbbackup_database_max_age_seconds Configured maximum age of the latest successful backup of each database, 0 if unset.")
+	fmt.Fprintln(&b, "# TYPE dbbackup_database_max_age_seconds gauge")
+	for _, f := range databaseFreshness(config, reports) {
+		fmt.Fprintf(&b, "dbbackup_database_max_age_seconds{engine=\"%s\",host=\"%s\",database=\"%s\"} %f\n", escapeLabel(f.Engine), escapeLabel(f.Host), escapeLabel(f.Name), f.MaxAge.Seconds())
+	}
+
+	latest := latestRun(reports)
+	if latest == nil {
+		return b.String()
+	}
+
+	fmt.Fprintln(&b, "# HELP dbbackup_database_labels Labels of each database in the most recent backup run, as label_<key>.")
+	fmt.Fprintln(&b, "# TYPE dbbackup_database_labels gauge")
+	for _, db := range latest.Databases {
+		if len(db.Labels) == 0 {
+			continue
+		}
+
+		keys := []string{}
+		for key := range db.Labels {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		labels := ""
+		for _, key := range keys {
+			labels += fmt.Sprintf(",label_%s=\"%s\"", metricLabelName(key), escapeLabel(db.Labels[key]))
+		}
+		fmt.Fprintf(&b, "dbbackup_database_labels{engine=\"%s\",host=\"%s\",database=\"%s\"%s} 1\n", escapeLabel(db.Engine), escapeLabel(db.Host), escapeLabel(db.Name), labels)
+	}
+
+	success := 0
+	if latest.Success {
+		success = 1
+	}
+
+	fmt.Fprintln(&b, "# HELP dbbackup_last_run_success Whether the most recent backup run succeeded.")
+	fmt.Fprintln(&b, "# TYPE dbbackup_last_run_success gauge")
+	fmt.Fprintf(&b, "dbbackup_last_run_success %d\n", success)
+
+	fmt.Fprintln(&b, "# HELP dbbackup_last_run_timestamp_seconds Start time of the most recent backup run.")
+	fmt.Fprintln(&b, "# TYPE dbbackup_last_run_timestamp_seconds gauge")
+	fmt.Fprintf(&b, "dbbackup_last_run_timestamp_seconds %d\n", latest.StartedAt.Unix())
+
+	fmt.Fprintln(&b, "# HELP dbbackup_last_run_duration_seconds Duration of the most recent backup run.")
+	fmt.Fprintln(&b, "# TYPE dbbackup_last_run_duration_seconds gauge")
+	fmt.Fprintf(&b, "dbbackup_last_run_duration_seconds %f\n", latest.DurationSeconds)
+
+	fmt.Fprintln(&b, "# HELP dbbackup_last_archive_size_bytes Size of the most recent archive.")
+	fmt.Fprintln(&b, "# TYPE dbbackup_last_archive_size_bytes gauge")
+	fmt.Fprintf(&b, "dbbackup_last_archive_size_bytes %d\n", latest.ArchiveSizeBytes)
+
+	fmt.Fprintln(&b, "# HELP dbbackup_last_compression_ratio Raw size of the dumps over the size of the most recent archive, 0 if unknown.")
+	fmt.Fprintln(&b, "# TYPE dbbackup_last_compression_ratio gauge")
+	fmt.Fprintf(&b, "dbbackup_last_compression_ratio %f\n", latest.CompressionRatio)
+
+	if latest.Dedup != nil {
+		fmt.Fprintln(&b, "# HELP dbbackup_last_dedup_uploaded_bytes Bytes of new chunks uploaded by the most recent deduplicated run.")
+		fmt.Fprintln(&b, "# TYPE dbbackup_last_dedup_uploaded_bytes gauge")
+		fmt.Fprintf(&b, "dbbackup_last_dedup_uploaded_bytes %d\n", latest.Dedup.BytesUploaded)
+
+		fmt.Fprintln(&b, "# HELP dbbackup_last_dedup_total_bytes Bytes of chunks in the most recent deduplicated run, uploaded or not.")
+		fmt.Fprintln(&b, "# TYPE dbbackup_last_dedup_total_bytes gauge")
+		fmt.Fprintf(&b, "dbbackup_last_dedup_total_bytes %d\n", latest.Dedup.BytesTotal)
+	}
+
+	phases := []string{}
+	for name := range latest.Phases {
+		phases = append(phases, name)
+	}
+	sort.Strings(phases)
+
+	fmt.Fprintln(&b, "# HELP dbbackup_phase_duration_seconds Duration of each phase of the most recent backup run.")
+	fmt.Fprintln(&b, "# TYPE dbbackup_phase_duration_seconds gauge")
+	for _, name := range phases {
+		fmt.Fprintf(&b, "dbbackup_phase_duration_seconds{phase=\"%s\"} %f\n", name, latest.Phases[name].DurationSeconds)
+	}
+
+	fmt.Fprintln(&b, "# HELP dbbackup_phase_throughput_bytes_per_second Effective throughput of each phase of the most recent backup run.")
+	fmt.Fprintln(&b, "# TYPE dbbackup_phase_throughput_bytes_per_second gauge")
+	for _, name := range phases {
+		fmt.Fprintf(&b, "dbbackup_phase_throughput_bytes_per_second{phase=\"%s\"} %f\n", name, latest.Phases[name].bytesPerSecond())
+	}
+
+	fmt.Fprintln(&b, "# HELP dbbackup_database_size_bytes Size of the most recent dump of each database.")
+	fmt.Fprintln(&b, "# TYPE dbbackup_database_size_bytes gauge")
+	for _, db := range latest.Databases {
+		fmt.Fprintf(&b, "dbbackup_database_size_bytes{engine=\"%s\",host=\"%s\",database=\"%s\"} %d\n", escapeLabel(db.Engine), escapeLabel(db.Host), escapeLabel(db.Name), db.SizeBytes)
+	}
+
+	fmt.Fprintln(&b, "# HELP dbbackup_database_raw_size_bytes Uncompressed size of the most recent dump of each database.")
+	fmt.Fprintln(&b, "# TYPE dbbackup_database_raw_size_bytes gauge")
+	for _, db := range latest.Databases {
+		fmt.Fprintf(&b, "dbbackup_database_raw_size_bytes{engine=\"%s\",host=\"%s\",database=\"%s\"} %d\n", escapeLabel(db.Engine), escapeLabel(db.Host), escapeLabel(db.Name), db.RawSizeBytes)
+	}
+
+	fmt.Fprintln(&b, "# HELP dbbackup_database_compression_ratio Raw size over compressed size of the most recent dump of each database, 0 if unknown.")
+	fmt.Fprintln(&b, "# TYPE dbbackup_database_compression_ratio gauge")
+	for _, db := range latest.Databases {
+		fmt.Fprintf(&b, "dbbackup_database_compression_ratio{engine=\"%s\",host=\"%s\",database=\"%s\"} %f\n", escapeLabel(db.Engine), escapeLabel(db.Host), escapeLabel(db.Name), db.CompressionRatio)
+	}
+
+	fmt.Fprintln(&b, "# HELP dbbackup_database_dump_duration_seconds Duration of the most recent dump of each database.")
+	fmt.Fprintln(&b, "# TYPE dbbackup_database_dump_duration_seconds gauge")
+	for _, db := range latest.Databases {
+		fmt.Fprintf(&b, "dbbackup_database_dump_duration_seconds{engine=\"%s\",host=\"%s\",database=\"%s\"} %f\n", escapeLabel(db.Engine), escapeLabel(db.Host), escapeLabel(db.Name), db.DurationSeconds)
+	}
+
+	return b.String()
+}
+
+// Render the storage used per database in the Prometheus text exposition format
+func renderUsageMetrics(entries []UsageEntry) string {
+	var b strings.Builder
+
+	fmt.Fprintln(&b, "# HELP dbbackup_storage_bytes Bytes stored on each target for each database.")
+	fmt.Fprintln(&b, "# TYPE dbbackup_storage_bytes gauge")
+	for _, entry := range entries {
+		fmt.Fprintf(&b, "dbbackup_storage_bytes{target=\"%s\",engine=\"%s\",host=\"%s\",database=\"%s\"} %d\n", escapeLabel(entry.Target), escapeLabel(entry.Engine), escapeLabel(entry.Host), escapeLabel(entry.Database), entry.Bytes)
+	}
+
+	fmt.Fprintln(&b, "# HELP dbbackup_storage_objects Objects stored on each target holding each database.")
+	fmt.Fprintln(&b, "# TYPE dbbackup_storage_objects gauge")
+	for _, entry := range entries {
+		fmt.Fprintf(&b, "dbbackup_storage_objects{target=\"%s\",engine=\"%s\",host=\"%s\",database=\"%s\"} %d\n", escapeLabel(entry.Target), escapeLabel(entry.Engine), escapeLabel(entry.Host), escapeLabel(entry.Database), entry.Objects)
+	}
+
+	return b.String()
+}
+
+// Serve Prometheus metrics and backup badges. Blocks until the server stops.
+func serveMetrics(config Config) {
+	defer redactPanic()
+
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		reports, err := loadReports(config.ReportsDir)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		fmt.Fprint(w, renderMetrics(config, reports))
+
+		if records, err := loadRestoreRecords(config.ReportsDir); err == nil && len(records) > 0 {
+			fmt.Fprint(w, renderRestoreMetrics(records))
+		}
+
+		if config.Metrics.StorageUsage {
+			entries, err := cachedUsage(r.Context(), config)
+			if err != nil {
+				log.Printf("Error collecting storage usage: %s\n", err.Error())
+				return
+			}
+			fmt.Fprint(w, renderUsageMetrics(entries))
+		}
+	})
+
+	mux.HandleFunc("/badge", badgeHandler(config))
+
+	log.Printf("Starting metrics server on %s\n", config.Metrics.Listen)
+
+	err := http.ListenAndServe(config.Metrics.Listen, mux)
+	if err != nil {
+		log.Printf("Error running metrics server: %s\n", err.Error())
+	}
+}
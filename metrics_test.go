@@ -0,0 +1,29 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPhaseThroughputInBaseUnits(t *testing.T) {
+	report := RunReport{
+		StartedAt: time.Now(),
+		Phases: map[string]*PhaseReport{
+			"upload": {DurationSeconds: 2, Bytes: 4 * 1024 * 1024, MBPerSecond: 2},
+			"prune":  {DurationSeconds: 0, Bytes: 0},
+		},
+	}
+
+	metrics := renderMetrics(Config{}, []RunReport{report})
+
+	if !strings.Contains(metrics, `dbbackup_phase_throughput_bytes_per_second{phase="upload"} 2097152.000000`) {
+		t.Errorf("upload throughput missing or not in bytes a second:\n%s", metrics)
+	}
+	if !strings.Contains(metrics, `dbbackup_phase_throughput_bytes_per_second{phase="prune"} 0.000000`) {
+		t.Errorf("throughput of a phase that took no time isn't 0:\n%s", metrics)
+	}
+	if strings.Contains(metrics, "mb_per_second") {
+		t.Error("throughput still exported in MB a second")
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Run reports read from the storage targets. Reports don't change once
+// uploaded, so each is only downloaded once.
+type remoteReports struct {
+	mutex   sync.Mutex
+	reports map[string]RunReport
+}
+
+// Load every run report uploaded to the storage targets, newest first
+func (r *remoteReports) load(ctx context.Context, config Config) ([]RunReport, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if r.reports == nil {
+		r.reports = map[string]RunReport{}
+	}
+
+	for _, target := range config.targets() {
+		objects, err := target.list(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error listing %s: %s", target.Name, err.Error())
+		}
+
+		for _, object := range objects {
+			if !strings.HasSuffix(object.Key, ".report.json") {
+				continue
+			}
+
+			id := target.Name + ":" + object.Key
+			if _, ok := r.reports[id]; ok {
+				continue
+			}
+
+			body, err := target.open(ctx, object.Key)
+			if err != nil {
+				log.Printf("Error reading %s from %s: %s\n", object.Key, target.Name, err.Error())
+				continue
+			}
+
+			report := RunReport{}
+			err = json.NewDecoder(body).Decode(&report)
+			body.Close()
+			if err != nil {
+				log.Printf("Error parsing %s from %s: %s\n", object.Key, target.Name, err.Error())
+				continue
+			}
+
+			r.reports[id] = report
+		}
+	}
+
+	reports := []RunReport{}
+	for _, report := range r.reports {
+		reports = append(reports, report)
+	}
+	sort.Slice(reports, func(i, j int) bool {
+		return reports[i].StartedAt.After(reports[j].StartedAt)
+	})
+
+	return reports, nil
+}
+
+// Handle the monitor subcommand, watching the reports every agent uploads to
+// the shared storage and alerting when a configured database's latest backup
+// is older than its max_backup_age. Blocks until the context is cancelled.
+func runMonitor(ctx context.Context, config Config) error {
+	watched := 0
+	for _, db := range config.Databases {
+		if config.maxBackupAge(db) > 0 {
+			watched++
+		}
+	}
+	if watched == 0 {
+		return withExitCode(exitConfig, fmt.Errorf("max_backup_age must be set to monitor backups"))
+	}
+
+	log.Printf("Monitoring backups of %d database entries from %d storage targets\n", watched, len(config.targets()))
+
+	remote := &remoteReports{}
+	watchFreshness(ctx, config, func(ctx context.Context) ([]RunReport, error) {
+		return remote.load(ctx, config)
+	})
+
+	return nil
+}
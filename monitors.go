@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// Hold a cron monitoring service told when each run starts and how it ended
+type MonitorConfig struct {
+	// "cronitor" or "betteruptime"
+	Type string `yaml:"type"`
+
+	// Cronitor monitor key and telemetry API key
+	Key    string `yaml:"key"`
+	APIKey Secret `yaml:"api_key"`
+
+	// Environment the run is reported under in Cronitor, e.g. "production"
+	Environment string `yaml:"environment"`
+
+	// Better Uptime heartbeat token, the last part of its heartbeat URL
+	Token Secret `yaml:"token"`
+}
+
+// Where the services receive pings
+const (
+	cronitorURL     = "https://cronitor.link/p"
+	betterUptimeURL = "https://uptime.betterstack.com/api/v1/heartbeat"
+)
+
+// Summarise a finished run in a line for the monitor's event log
+func monitorMessage(report *RunReport) string {
+	if report.Error != "" {
+		return report.Error
+	}
+
+	failed := 0
+	var size int64
+	for _, db := range report.Databases {
+		if !db.Success {
+			failed++
+		}
+		size += db.SizeBytes
+	}
+
+	message := fmt.Sprintf("%d databases, %s", len(report.Databases), formatBytes(size))
+	if failed > 0 {
+		message = fmt.Sprintf("%d of %d databases failed", failed, len(report.Databases))
+	}
+
+	return message
+}
+
+// Tell Cronitor the run's state, "run", "complete" or "fail", with its
+// duration and database counts as metrics
+func (monitor MonitorConfig) pingCronitor(ctx context.Context, state string, report *RunReport) error {
+	query := url.Values{}
+	query.Set("state", state)
+	query.Set("series", report.StartedAt.UTC().Format(time.RFC3339))
+	if monitor.Environment != "" {
+		query.Set("env", monitor.Environment)
+	}
+
+	if state != "run" {
+		failed := 0
+		for _, db := range report.Databases {
+			if !db.Success {
+				failed++
+			}
+		}
+
+		query.Add("metric", "duration:"+strconv.FormatFloat(report.DurationSeconds, 'f', 1, 64))
+		query.Add("metric", "count:"+strconv.Itoa(len(report.Databases)))
+		query.Add("metric", "error_count:"+strconv.Itoa(failed))
+
+		message := monitorMessage(report)
+		if len(message) > 2000 {
+			message = message[:2000]
+		}
+		query.Set("message", message)
+	}
+
+	endpoint := fmt.Sprintf("%s/%s/%s?%s", cronitorURL, url.PathEscape(monitor.APIKey.reveal()), url.PathEscape(monitor.Key), query.Encode())
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+
+	return sendMonitorRequest(req)
+}
+
+// Send Better Uptime a heartbeat when the run completes, or a failure, with
+// a summary of the run as the body. It has no start event.
+func (monitor MonitorConfig) pingBetterUptime(ctx context.Context, state string, report *RunReport) error {
+	if state == "run" {
+		return nil
+	}
+
+	endpoint := betterUptimeURL + "/" + url.PathEscape(monitor.Token.reveal())
+	if state == "fail" {
+		endpoint += "/fail"
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"message":          monitorMessage(report),
+		"duration_seconds": report.DurationSeconds,
+		"databases":        len(report.Databases),
+		"archive_key":      report.ArchiveKey,
+		"archive_bytes":    report.ArchiveSizeBytes,
+	})
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	return sendMonitorRequest(req)
+}
+
+func sendMonitorRequest(req *http.Request) error {
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
+
+// Tell every monitor about the run: "run" when it starts, then "complete" or
+// "fail"
+func pingMonitors(ctx context.Context, config Config, state string, report *RunReport) {
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	for _, monitor := range config.Monitors {
+		var err error
+		switch monitor.Type {
+		case "cronitor":
+			err = monitor.pingCronitor(ctx, state, report)
+		case "betteruptime":
+			err = monitor.pingBetterUptime(ctx, state, report)
+		}
+		if err != nil {
+			log.Printf("Error sending %s %s ping: %s\n", monitor.Type, state, err.Error())
+		}
+	}
+}
+
+// Tell every monitor how a finished run went. Cancelled runs are left for
+// the services to notice as missed.
+func finishMonitors(ctx context.Context, config Config, report *RunReport) {
+	if report.Cancelled {
+		return
+	}
+
+	state := "complete"
+	if !report.Success {
+		state = "fail"
+	}
+	pingMonitors(ctx, config, state, report)
+}
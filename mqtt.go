@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// Append a length prefixed MQTT string
+func mqttString(packet []byte, value string) []byte {
+	packet = append(packet, byte(len(value)>>8), byte(len(value)))
+	return append(packet, value...)
+}
+
+// Build an MQTT packet from its type and flags byte and its body
+func mqttPacket(header byte, body []byte) []byte {
+	packet := []byte{header}
+
+	// Remaining length, 7 bits at a time
+	length := len(body)
+	for {
+		b := byte(length % 128)
+		length /= 128
+		if length > 0 {
+			b |= 0x80
+		}
+		packet = append(packet, b)
+		if length == 0 {
+			break
+		}
+	}
+
+	return append(packet, body...)
+}
+
+// A retained message to publish over MQTT
+type mqttMessage struct {
+	topic   string
+	payload []byte
+}
+
+// Publish retained messages to an MQTT 3.1.1 broker at QoS 0. The URL is
+// mqtt://host:1883, or mqtts://host:8883 for TLS, with credentials as its user info.
+func publishMQTT(ctx context.Context, rawURL string, messages []mqttMessage) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		port := "1883"
+		if u.Scheme == "mqtts" {
+			port = "8883"
+		}
+		host = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	dialer := net.Dialer{Timeout: 30 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "mqtts" {
+		conn = tls.Client(conn, &tls.Config{ServerName: u.Hostname()})
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	// Clean session, with a username and password when given
+	flags := byte(0x02)
+	body := mqttString(nil, "MQTT")
+	if u.User != nil {
+		flags |= 0x80
+		if _, ok := u.User.Password(); ok {
+			flags |= 0x40
+		}
+	}
+	body = append(body, 4, flags, 0, 60)
+	body = mqttString(body, fmt.Sprintf("dbbackup-%d", time.Now().UnixNano()%1000000))
+	if u.User != nil {
+		body = mqttString(body, u.User.Username())
+		if password, ok := u.User.Password(); ok {
+			body = mqttString(body, password)
+		}
+	}
+
+	_, err = conn.Write(mqttPacket(0x10, body))
+	if err != nil {
+		return err
+	}
+
+	connack := make([]byte, 4)
+	_, err = io.ReadFull(bufio.NewReader(conn), connack)
+	if err != nil {
+		return err
+	}
+	if connack[0] != 0x20 || connack[3] != 0 {
+		return fmt.Errorf("MQTT broker refused the connection with code %d", connack[3])
+	}
+
+	for _, message := range messages {
+		// PUBLISH at QoS 0 with the retain flag, so dashboards get the last
+		// state as soon as they subscribe
+		_, err = conn.Write(mqttPacket(0x31, append(mqttString(nil, message.topic), message.payload...)))
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = conn.Write(mqttPacket(0xE0, nil))
+	return err
+}
+
+var topicUnsafe = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// Make a name safe to use as an MQTT topic level and Home Assistant object ID
+func topicName(name string) string {
+	return strings.Trim(topicUnsafe.ReplaceAllString(name, "_"), "_")
+}
+
+// Build the retained status messages for a run: the run's state under
+// <topic>/status and each database's under <topic>/databases/<host>_<name>,
+// with Home Assistant discovery configs when enabled
+func mqttMessages(notifier NotifierConfig, notification Notification) ([]mqttMessage, error) {
+	report := notification.Report
+	topic := strings.TrimSuffix(notifier.Topic, "/")
+	messages := []mqttMessage{}
+
+	// Only runs have a status to publish
+	if report == nil {
+		return messages, nil
+	}
+
+	add := func(topic string, value interface{}) error {
+		payload, err := json.Marshal(value)
+		if err != nil {
+			return err
+		}
+		messages = append(messages, mqttMessage{topic: topic, payload: payload})
+		return nil
+	}
+
+	state := "failed"
+	switch {
+	case notification.Event == "backup.started":
+		state = "running"
+	case report.Success:
+		state = "success"
+	}
+
+	statusTopic := topic + "/status"
+	err := add(statusTopic, map[string]interface{}{
+		"state":              state,
+		"event":              notification.Event,
+		"last_run":           report.StartedAt.Format(time.RFC3339),
+		"duration_seconds":   report.DurationSeconds,
+		"archive_size_bytes": report.ArchiveSizeBytes,
+		"error":              report.Error,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if notifier.HomeAssistant {
+		err = add("homeassistant/sensor/dbbackup/status/config", map[string]interface{}{
+			"name":                  "Backup status",
+			"unique_id":             "dbbackup_status",
+			"state_topic":           statusTopic,
+			"value_template":        "{{ value_json.state }}",
+			"json_attributes_topic": statusTopic,
+			"device":                map[string]string{"identifiers": "dbbackup", "name": "dbbackup"},
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if notification.Event == "backup.started" {
+		return messages, nil
+	}
+
+	// The current run's report hasn't been written yet, so goes first
+	reports, err := loadReports(notifier.reportsDir)
+	if err != nil {
+		reports = nil
+	}
+	reports = append([]RunReport{*report}, reports...)
+
+	for _, status := range databaseStatuses(reports) {
+		id := topicName(status.Host + "_" + status.Name)
+		dbTopic := topic + "/databases/" + id
+
+		lastSuccess := ""
+		if !status.LastSuccess.IsZero() {
+			lastSuccess = status.LastSuccess.Format(time.RFC3339)
+		}
+
+		err = add(dbTopic, map[string]interface{}{
+			"engine":       status.Engine,
+			"host":         status.Host,
+			"database":     status.Name,
+			"success":      status.Success,
+			"last_run":     status.LastRun.Format(time.RFC3339),
+			"last_success": lastSuccess,
+			"error":        status.Error,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if notifier.HomeAssistant {
+			err = add("homeassistant/sensor/dbbackup/"+id+"/config", map[string]interface{}{
+				"name":                  fmt.Sprintf("%s on %s last backup", status.Name, status.Host),
+				"unique_id":             "dbbackup_" + id,
+				"state_topic":           dbTopic,
+				"value_template":        "{{ value_json.last_success or None }}",
+				"device_class":          "timestamp",
+				"json_attributes_topic": dbTopic,
+				"device":                map[string]string{"identifiers": "dbbackup", "name": "dbbackup"},
+			})
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return messages, nil
+}
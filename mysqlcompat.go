@@ -0,0 +1,145 @@
+package main
+
+import (
+	"log"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Compatibility profiles a database's compat setting can force instead of
+// detecting the server version
+var mysqlProfiles = map[string]bool{
+	"auto":    true,
+	"5.6":     true,
+	"5.7":     true,
+	"8.0":     true,
+	"mariadb": true,
+	"none":    true,
+}
+
+// Version of the installed mysqldump, read once
+var (
+	mysqldumpVersion     string
+	mysqldumpVersionOnce sync.Once
+)
+
+var versionPattern = regexp.MustCompile(`(\d+)\.(\d+)`)
+
+// Get the major and minor version from a version string, or 0, 0
+func parseVersion(version string) (int, int) {
+	match := versionPattern.FindStringSubmatch(version)
+	if match == nil {
+		return 0, 0
+	}
+
+	major, _ := strconv.Atoi(match[1])
+	minor, _ := strconv.Atoi(match[2])
+
+	return major, minor
+}
+
+// Get the version of the installed mysqldump, e.g. "8.0.33" or "10.11.6-MariaDB"
+func clientVersion() string {
+	mysqldumpVersionOnce.Do(func() {
+		output, err := commandOutput(exec.Command("mysqldump", "--version"))
+		if err != nil {
+			return
+		}
+
+		// MySQL: "mysqldump  Ver 8.0.33 for Linux on x86_64"
+		// MariaDB: "mysqldump  Ver 10.19 Distrib 10.11.6-MariaDB, for debian-linux-gnu"
+		// MariaDB 11: "mysqldump from 11.2.2-MariaDB, client 10.19 for Linux"
+		fields := strings.Fields(string(output))
+		for i, field := range fields {
+			if (field == "Distrib" || field == "from") && i+1 < len(fields) {
+				mysqldumpVersion = strings.TrimSuffix(fields[i+1], ",")
+				return
+			}
+		}
+		for i, field := range fields {
+			if field == "Ver" && i+1 < len(fields) {
+				mysqldumpVersion = fields[i+1]
+				return
+			}
+		}
+	})
+
+	return mysqldumpVersion
+}
+
+// Work out the profile for a server from its version string
+func profileForVersion(version string) string {
+	if strings.Contains(strings.ToLower(version), "mariadb") {
+		return "mariadb"
+	}
+
+	major, minor := parseVersion(version)
+	switch {
+	case major >= 8:
+		return "8.0"
+	case major == 5 && minor >= 7:
+		return "5.7"
+	case major == 5 && minor == 6:
+		return "5.6"
+	}
+
+	return "none"
+}
+
+// Get the version of a MySQL or MariaDB server, e.g. "8.0.33" or "10.11.6-MariaDB-log"
+func mysqlServerVersion(db DatabaseConfig) (string, error) {
+	output, err := mysqlQuery(db, "", "SELECT VERSION()")
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimSpace(output), nil
+}
+
+// Get the compatibility profile of a database from its server version, unless
+// it's forced with compat
+func (db DatabaseConfig) mysqlProfile(version string) string {
+	if db.Compat != "" && db.Compat != "auto" {
+		return db.Compat
+	}
+
+	if version == "" {
+		log.Printf("Server version of %s unknown, using no compatibility flags\n", db.Host)
+		return "none"
+	}
+
+	return profileForVersion(version)
+}
+
+// Get the mysqldump flags needed to dump the database with the installed
+// mysqldump, so one config works across server versions
+func mysqlCompatArgs(db DatabaseConfig, version string) []string {
+	profile := db.mysqlProfile(version)
+	if profile == "none" {
+		return nil
+	}
+
+	client := clientVersion()
+	clientMajor, clientMinor := parseVersion(client)
+
+	// These flags only exist in MySQL's own mysqldump from 5.6
+	if strings.Contains(client, "MariaDB") || clientMajor < 5 || (clientMajor == 5 && clientMinor < 6) {
+		return nil
+	}
+
+	args := []string{}
+
+	// Don't write the source's GTIDs into the dump, which fails to restore
+	// onto a server that already has GTIDs of its own
+	args = append(args, "--set-gtid-purged=OFF")
+
+	// MySQL 8 clients read column statistics that older servers and MariaDB don't have
+	if clientMajor >= 8 && profile != "8.0" {
+		args = append(args, "--column-statistics=0")
+	}
+
+	return args
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Build the mysqlpump arguments for dumping a database, or every database when
+// dbName is "--all-databases". mysqlpump shares mysqldump's connection and BLOB
+// options but not all of its compatibility ones.
+func mysqlPumpArgs(db DatabaseConfig, version string, dbName string) []string {
+	args := mysqlConnectionArgs(db)
+
+	for _, arg := range mysqlCompatArgs(db, version) {
+		if strings.HasPrefix(arg, "--set-gtid-purged") {
+			args = append(args, arg)
+		}
+	}
+
+	args = append(args, mysqlBlobArgs(db)...)
+	args = append(args, "--single-transaction")
+
+	if db.PumpParallelism > 0 {
+		args = append(args, fmt.Sprintf("--default-parallelism=%d", db.PumpParallelism))
+	}
+	if dbName == "--all-databases" && len(db.ExcludeDatabases) > 0 {
+		args = append(args, "--exclude-databases="+strings.Join(db.ExcludeDatabases, ","))
+	}
+
+	return append(args, dbName)
+}
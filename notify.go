@@ -0,0 +1,401 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// Hold the configuration for a single notification channel
+type NotifierConfig struct {
+	Type string `yaml:"type"` // "slack", "webhook", "nats", "kafka", "mqtt", "zabbix", "snmp" or "plugin"
+	URL  string `yaml:"url"`
+
+	// Plugin notifiers: the command run for each notification, speaking the
+	// JSON protocol in plugins.go, and settings passed through to it
+	Command string            `yaml:"command"`
+	Options map[string]string `yaml:"options"`
+
+	// Name databases route their notifications here by with notify
+	Name string `yaml:"name"`
+
+	// Only send notifications about databases routed here by name, leaving
+	// out databases without notify and notifications about no database
+	RoutedOnly bool `yaml:"routed_only"`
+
+	// NATS subject or Kafka topic events are published to, or the MQTT topic
+	// prefix statuses are published under
+	Topic string `yaml:"topic"`
+
+	// Also publish Home Assistant MQTT discovery configs for each status
+	HomeAssistant bool `yaml:"home_assistant"`
+
+	// Zabbix host the items are sent for, as named in Zabbix
+	ZabbixHost string `yaml:"zabbix_host"`
+
+	// SNMP community traps are sent with, defaulting to "public", and the
+	// OID the trap and its variables are under
+	SNMPCommunity Secret `yaml:"snmp_community"`
+	SNMPOID       string `yaml:"snmp_oid"`
+
+	// When to send run notifications: "always", "failure", "recovery" (failures
+	// and the first success after one) or "never". Defaults to "always", or
+	// "never" when a digest is configured.
+	When string `yaml:"when"`
+
+	// Send a summary of all runs "daily" or "weekly"
+	Digest string `yaml:"digest"`
+
+	// Send at most one notification per database in this period, e.g. "1h"
+	RateLimit string `yaml:"rate_limit"`
+
+	// Hold notifications during these hours, e.g. "22:00-07:00", and send a
+	// summary once they end
+	QuietHours string `yaml:"quiet_hours"`
+
+	// Go templates over the notification overriding the default subject and message
+	SubjectTemplate string `yaml:"subject_template"`
+	MessageTemplate string `yaml:"message_template"`
+
+	// Identifies the notifier across profiles for rate limits and quiet hours
+	id string
+
+	// Where the run history is kept, for MQTT statuses
+	reportsDir string
+}
+
+// Hold a notification to be sent to every configured notifier
+type Notification struct {
+	Event   string     `json:"event"`
+	Subject string     `json:"subject"`
+	Message string     `json:"message"`
+	Time    time.Time  `json:"time"`
+	Report  *RunReport `json:"report,omitempty"`
+	Version string     `json:"version"`
+
+	// Set on a successful run following a failed one
+	Recovered bool `json:"recovered,omitempty"`
+
+	// The run before, for rebuilding the notification for a subset of its databases
+	previous *RunReport
+
+	// Notifiers a notification about a single database is routed to
+	routes []string
+}
+
+// Send a notification to every configured notifier, logging any failures
+func sendNotification(ctx context.Context, config Config, notification Notification) {
+	if notification.Time.IsZero() {
+		notification.Time = clk.Now()
+	}
+	notification.Version = version
+
+	for _, notifier := range config.Notifications {
+		notification, ok := notifier.route(notification)
+		if !ok || !notifier.wants(notification) || !notifier.allow(notification) {
+			continue
+		}
+
+		if notifier.deferIfQuiet(notification) {
+			continue
+		}
+
+		err := config.simulatedFailure("notify")
+		if err == nil {
+			err = notifier.send(ctx, notification)
+		}
+		if err != nil {
+			log.Printf("Error sending %s notification: %s\n", notifier.Type, err.Error())
+		}
+	}
+}
+
+// Functions available in notification templates
+var templateFuncs = template.FuncMap{
+	"bytes": formatBytes,
+	"seconds": func(seconds float64) string {
+		return (time.Duration(seconds) * time.Second).String()
+	},
+}
+
+// Render a notification template
+func renderTemplate(text string, notification Notification) (string, error) {
+	tmpl, err := template.New("notification").Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	err = tmpl.Execute(&b, notification)
+	if err != nil {
+		return "", err
+	}
+
+	return b.String(), nil
+}
+
+// Check whether the notifier gets notifications routed to the given names
+func (notifier NotifierConfig) receives(routes []string) bool {
+	if len(routes) == 0 {
+		return !notifier.RoutedOnly
+	}
+
+	for _, name := range routes {
+		if name == notifier.Name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Keep only the databases routed to the notifier in a run's report
+func (notifier NotifierConfig) routedReport(report *RunReport) *RunReport {
+	routed := *report
+	routed.Databases = []DatabaseReport{}
+	for _, db := range report.Databases {
+		if notifier.receives(db.Notify) {
+			routed.Databases = append(routed.Databases, db)
+		}
+	}
+	routed.Success = routed.succeeded()
+
+	return &routed
+}
+
+// Narrow a notification down to what is routed to the notifier. A run
+// notification is rebuilt from just the routed databases, so a failure
+// elsewhere doesn't reach it. Returns false if nothing is routed to it.
+func (notifier NotifierConfig) route(notification Notification) (Notification, bool) {
+	if notification.Report == nil || len(notification.Report.Databases) == 0 {
+		return notification, notifier.receives(notification.routes)
+	}
+
+	routed := notifier.routedReport(notification.Report)
+	if len(routed.Databases) == 0 {
+		return notification, false
+	}
+	if len(routed.Databases) == len(notification.Report.Databases) {
+		return notification, true
+	}
+
+	var previous *RunReport
+	if notification.previous != nil {
+		previous = notifier.routedReport(notification.previous)
+	}
+
+	return runNotification(routed, previous), true
+}
+
+// Get when the notifier sends run notifications, applying the default
+func (notifier NotifierConfig) when() string {
+	if notifier.When != "" {
+		return notifier.When
+	}
+
+	if notifier.Digest != "" {
+		return "never"
+	}
+
+	// Traps are for alerting, not a log of every run
+	if notifier.Type == "snmp" {
+		return "failure"
+	}
+
+	return "always"
+}
+
+// Check whether the notifier should send a notification
+func (notifier NotifierConfig) wants(notification Notification) bool {
+	switch notification.Event {
+	case "backup.started":
+		// Only useful to systems tracking runs, not people
+		return notifier.publishesEvents() && notifier.when() == "always"
+	case "backup.completed":
+		return notifier.when() == "always" || (notifier.when() == "recovery" && notification.Recovered)
+	case "backup.skipped":
+		return notifier.when() == "always"
+	case "digest":
+		return false
+	}
+
+	// Failures and alerts go to everything that isn't silenced
+	return notifier.when() != "never"
+}
+
+// Build the notification sent at the end of a backup run. previous is the
+// report of the run before, if any.
+func runNotification(report *RunReport, previous *RunReport) Notification {
+	notification := Notification{
+		Event:     "backup.completed",
+		Time:      report.FinishedAt,
+		Report:    report,
+		Recovered: report.Success && previous != nil && !previous.Success,
+		previous:  previous,
+	}
+
+	drifted := false
+	overBudget := report.OverBudget != ""
+	for _, db := range report.Databases {
+		if len(db.SchemaDrift) > 0 {
+			drifted = true
+		}
+		if db.OverBudget != "" {
+			overBudget = true
+		}
+	}
+
+	if report.Success && overBudget {
+		// A sudden jump in size costs money and disk, so alert like a failure
+		notification.Event = "size.budget"
+		notification.Subject = "Backup succeeded over its size budget"
+	} else if report.Success && drifted {
+		// Unexpected DDL is worth alerting on even when the run succeeded
+		notification.Event = "schema.drift"
+		notification.Subject = "Backup succeeded with schema changes"
+	} else if report.Success {
+		notification.Subject = "Backup succeeded"
+	} else {
+		notification.Event = "backup.failed"
+		notification.Subject = "Backup failed"
+	}
+
+	var b strings.Builder
+
+	if report.Profile != "" {
+		fmt.Fprintf(&b, "Profile: %s\n", report.Profile)
+	}
+	fmt.Fprintf(&b, "Archive %s (%s) in %.0fs\n", report.ArchiveKey, formatBytes(report.ArchiveSizeBytes), report.DurationSeconds)
+	if report.CompressionRatio > 0 {
+		fmt.Fprintf(&b, "Compression: %.1fx\n", report.CompressionRatio)
+	}
+	if report.Dedup != nil && report.Dedup.BytesTotal > 0 {
+		fmt.Fprintf(&b, "Dedup: uploaded %s of %s (%d of %d chunks)\n", formatBytes(report.Dedup.BytesUploaded), formatBytes(report.Dedup.BytesTotal), report.Dedup.ChunksUploaded, report.Dedup.ChunksTotal)
+	}
+	if report.Error != "" {
+		fmt.Fprintf(&b, "Error: %s\n", report.Error)
+	}
+	if report.OverBudget != "" {
+		fmt.Fprintf(&b, "Over budget: %s\n", report.OverBudget)
+	}
+	if len(report.Labels) > 0 {
+		fmt.Fprintf(&b, "Labels: %s\n", formatLabels(report.Labels, ", "))
+	}
+
+	for _, db := range report.Databases {
+		if db.Success {
+			if db.CompressionRatio > 0 {
+				fmt.Fprintf(&b, "OK %s on %s (%s, %.1fx compression, %.0fs)\n", db.Name, db.Host, formatBytes(db.SizeBytes), db.CompressionRatio, db.DurationSeconds)
+			} else {
+				fmt.Fprintf(&b, "OK %s on %s (%s, %.0fs)\n", db.Name, db.Host, formatBytes(db.SizeBytes), db.DurationSeconds)
+			}
+		} else {
+			fmt.Fprintf(&b, "FAILED %s on %s: %s\n", db.Name, db.Host, db.Error)
+		}
+
+		if db.OverBudget != "" {
+			fmt.Fprintf(&b, "Over budget %s on %s: %s\n", db.Name, db.Host, db.OverBudget)
+		}
+
+		if len(db.SchemaDrift) > 0 {
+			fmt.Fprintf(&b, "Schema changes in %s on %s:\n%s\n", db.Name, db.Host, strings.Join(db.SchemaDrift, "\n"))
+		}
+	}
+
+	notification.Message = strings.TrimSpace(b.String())
+
+	return notification
+}
+
+// Send a notification through a single notifier
+func (notifier NotifierConfig) send(ctx context.Context, notification Notification) error {
+	var payload interface{}
+	var err error
+
+	if notifier.SubjectTemplate != "" {
+		notification.Subject, err = renderTemplate(notifier.SubjectTemplate, notification)
+		if err != nil {
+			return fmt.Errorf("error rendering subject template: %w", err)
+		}
+	}
+
+	if notifier.MessageTemplate != "" {
+		notification.Message, err = renderTemplate(notifier.MessageTemplate, notification)
+		if err != nil {
+			return fmt.Errorf("error rendering message template: %w", err)
+		}
+	}
+
+	switch notifier.Type {
+	case "slack":
+		payload = map[string]string{
+			"text": fmt.Sprintf("*%s*\n%s\n_dbbackup %s_", notification.Subject, notification.Message, notification.Version),
+		}
+	case "webhook", "nats", "kafka":
+		payload = notification
+	case "mqtt":
+		messages, err := mqttMessages(notifier, notification)
+		if err != nil || len(messages) == 0 {
+			return err
+		}
+		return publishMQTT(ctx, notifier.URL, messages)
+	case "zabbix":
+		items, err := zabbixItems(notifier, notification)
+		if err != nil || len(items) == 0 {
+			return err
+		}
+		return sendZabbix(ctx, notifier.URL, items)
+	case "snmp":
+		packet, err := snmpTrap(notifier, notification)
+		if err != nil {
+			return err
+		}
+		return sendSNMPTrap(ctx, notifier.URL, packet)
+	case "plugin":
+		return notifier.pluginNotify(ctx, notification)
+	default:
+		return fmt.Errorf("unknown notifier type %q", notifier.Type)
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	switch notifier.Type {
+	case "nats":
+		return publishNATS(ctx, notifier.URL, notifier.Topic, body)
+	case "kafka":
+		key := notification.Event
+		if notification.Report != nil {
+			key = notification.Report.StartedAt.Format(time.RFC3339)
+		}
+		return publishKafka(ctx, notifier.URL, notifier.Topic, key, body)
+	}
+
+	client := http.Client{Timeout: 30 * time.Second}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, notifier.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	return nil
+}
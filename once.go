@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// How long a one-shot run may take when neither --timeout nor
+// max_run_duration is set, so a hung job can't hold its schedule slot forever
+const defaultOnceTimeout = 24 * time.Hour
+
+// Handle --once, running a single backup for an external scheduler such as a
+// Kubernetes CronJob or ECS scheduled task. The run is aborted at the deadline,
+// and the process exits regardless if the run then takes longer than the grace
+// period to stop. Usage: --once [--timeout 2h] [--grace 1m] [--profile dir]
+// [--simulate-failure dump|upload|notify]
+func runOnce(ctx context.Context, config Config, args []string) (*RunReport, error) {
+	flags := flag.NewFlagSet("--once", flag.ContinueOnError)
+	timeout := flags.String("timeout", "", "abort the run after this long, defaults to max_run_duration or 24h")
+	grace := flags.String("grace", "1m", "how long an aborted run may clean up before exiting")
+	profileDir := flags.String("profile", "", "write CPU, heap and blocking profiles of the run to this directory")
+	simulate := flags.String("simulate-failure", "", "make the run fail at dump, upload or notify, to test alerting")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return nil, withExitCode(exitConfig, err)
+	}
+
+	config, err = simulateFailure(config, *simulate)
+	if err != nil {
+		return nil, withExitCode(exitConfig, err)
+	}
+
+	if *timeout != "" {
+		config.MaxRunDuration = *timeout
+	}
+	limit := defaultOnceTimeout
+	if config.MaxRunDuration != "" {
+		limit, err = parseDuration(config.MaxRunDuration)
+		if err != nil || limit <= 0 {
+			return nil, withExitCode(exitConfig, fmt.Errorf("invalid timeout %q", config.MaxRunDuration))
+		}
+	} else {
+		config.MaxRunDuration = limit.String()
+	}
+
+	graceTime, err := parseDuration(*grace)
+	if err != nil {
+		return nil, withExitCode(exitConfig, fmt.Errorf("invalid grace period %q", *grace))
+	}
+
+	// Backstop for a run stuck somewhere that doesn't notice cancellation
+	deadline := time.AfterFunc(limit+graceTime, func() {
+		fatal(exitTimeout, "Run did not stop within %s of its %s timeout, exiting\n", graceTime, limit)
+	})
+	defer deadline.Stop()
+
+	go func() {
+		<-ctx.Done()
+		time.Sleep(graceTime)
+		fatal(exitCancelled, "Run did not stop within %s of being cancelled, exiting\n", graceTime)
+	}()
+
+	if *profileDir != "" {
+		stop, err := startProfiling(*profileDir)
+		if err != nil {
+			return nil, err
+		}
+		defer stop()
+	}
+
+	log.Printf("Running backup once with a timeout of %s\n", limit)
+	checkLifecycles(ctx, config)
+
+	return runBackups(ctx, config, "once"), nil
+}
+
+// Check whether the process was started in one-shot mode, which logs to
+// stdout as container platforms expect
+func onceMode() bool {
+	return len(os.Args) > 1 && os.Args[1] == "--once"
+}
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Hold a single mysqldump of one or more tables in a parallel dump
+type tableDump struct {
+	tables []string
+	file   string
+}
+
+// List the tables and views of a database
+func listTablesAndViews(db DatabaseConfig, dbName string) ([]string, []string, error) {
+	output, err := mysqlQuery(db, "", fmt.Sprintf(
+		"SELECT TABLE_NAME, TABLE_TYPE FROM information_schema.TABLES WHERE TABLE_SCHEMA = %s ORDER BY TABLE_NAME", quoteString(dbName)))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	tables := []string{}
+	views := []string{}
+
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 2 {
+			continue
+		}
+
+		if fields[1] == "VIEW" {
+			views = append(views, fields[0])
+		} else {
+			tables = append(tables, fields[0])
+		}
+	}
+
+	return tables, views, nil
+}
+
+// Dump a database with a mysqldump per table, running up to parallel_tables at
+// once, into a directory of tables/<table>.sql, views.sql and programs.sql.
+// Each table is dumped in its own transaction, so the dump is only consistent
+// per table.
+// Only the given tables are dumped if any are given, as for differentials.
+func parallelMySQLDump(ctx context.Context, config Config, db DatabaseConfig, dbName string, args []string, tables []string, dir string) error {
+	views := []string{}
+	full := len(tables) == 0
+	if full {
+		var err error
+		tables, views, err = listTablesAndViews(db, dbName)
+		if err != nil {
+			return fmt.Errorf("error listing tables: %w", err)
+		}
+	}
+
+	err := os.MkdirAll(filepath.Join(dir, "tables"), 0755)
+	if err != nil {
+		return err
+	}
+
+	extension := ".sql"
+	if config.CompressDumps {
+		extension = ".sql.gz"
+	}
+
+	dumps := []tableDump{}
+	for _, table := range tables {
+		dumps = append(dumps, tableDump{
+			tables: []string{table},
+			file:   filepath.Join(dir, "tables", url.PathEscape(table)+extension),
+		})
+	}
+	if len(views) > 0 {
+		dumps = append(dumps, tableDump{tables: views, file: filepath.Join(dir, "views"+extension)})
+	}
+	if full && db.StoredPrograms {
+		// The database's routines and events on their own, without its tables
+		dumps = append(dumps, tableDump{
+			tables: []string{"--no-create-info", "--no-data", "--skip-triggers", "--routines", "--events"},
+			file:   filepath.Join(dir, "programs"+extension),
+		})
+	}
+
+	log.Printf("Dumping %d tables of %s on %s with %d workers\n", len(tables), dbName, db.Host, db.ParallelTables)
+
+	// Stop the other workers as soon as one dump fails
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	queue := make(chan tableDump)
+	var wg sync.WaitGroup
+	var errMutex sync.Mutex
+	var firstErr error
+
+	for i := 0; i < db.ParallelTables; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for dump := range queue {
+				err := dumpTables(ctx, config, db, append(append([]string{}, args...), dump.tables...), dump.file)
+				if err != nil {
+					errMutex.Lock()
+					if firstErr == nil {
+						firstErr = fmt.Errorf("error dumping %s: %w", strings.Join(dump.tables, ", "), err)
+						cancel()
+					}
+					errMutex.Unlock()
+				}
+			}
+		}()
+	}
+
+	for _, dump := range dumps {
+		select {
+		case queue <- dump:
+		case <-ctx.Done():
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+
+	return ctx.Err()
+}
+
+// Run a single mysqldump of some tables into a file, masking and compressing
+// it as configured
+func dumpTables(ctx context.Context, config Config, db DatabaseConfig, args []string, file string) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	if config.CompressDumps {
+		cmd := dumpCommand(ctx, "mysqldump", args...)
+		cmd.Env = mysqlEnv(db)
+		return compressedDump(cmd, file, config.CompressionLevel, db.Masking)
+	}
+
+	cmd := dumpCommand(ctx, "mysqldump", append([]string{"--result-file=" + file}, args...)...)
+	cmd.Env = mysqlEnv(db)
+	_, err := commandOutput(cmd)
+	if err != nil || len(db.Masking) == 0 {
+		return err
+	}
+
+	err = maskDump(file, file+".masked", db.Masking)
+	if err != nil {
+		os.Remove(file + ".masked")
+		return err
+	}
+
+	return os.Rename(file+".masked", file)
+}
+
+// Get the files of a parallel dump in the order they're applied: tables, then
+// views, then stored programs, then dropped tables
+func parallelDumpFiles(dir string) ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(dir, "tables"))
+	if err != nil {
+		return nil, err
+	}
+
+	files := []string{}
+	for _, entry := range entries {
+		files = append(files, filepath.Join(dir, "tables", entry.Name()))
+	}
+	sort.Strings(files)
+
+	for _, name := range []string{"views.sql", "views.sql.gz", "programs.sql", "programs.sql.gz", "dropped.sql"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			files = append(files, filepath.Join(dir, name))
+		}
+	}
+
+	return files, nil
+}
+
+// Apply a parallel dump, loading up to parallel_tables of its tables at once
+// and then its views and dropped tables in order
+func applyParallelDump(ctx context.Context, db DatabaseConfig, name string, dir string, tracker *restoreTracker, throttle *restoreThrottle) error {
+	files, err := parallelDumpFiles(dir)
+	if err != nil {
+		return err
+	}
+
+	tables := []string{}
+	rest := []string{}
+	for _, file := range files {
+		if filepath.Dir(file) == filepath.Join(dir, "tables") {
+			tables = append(tables, file)
+		} else {
+			rest = append(rest, file)
+		}
+	}
+
+	// Only the chosen tables, without views, programs or dropped tables
+	if len(db.restoreTables) > 0 {
+		tables = filterTableFiles(files, dir, db.restoreTables)
+		rest = nil
+	}
+
+	workers := db.ParallelTables
+	if workers < 1 {
+		workers = 1
+	}
+	if workers > 1 {
+		log.Printf("Applying %d tables to %s on %s with %d workers\n", len(tables), name, db.Host, workers)
+	}
+
+	// Stop the other workers as soon as one apply fails
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	queue := make(chan string)
+	var wg sync.WaitGroup
+	var errMutex sync.Mutex
+	var firstErr error
+
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for file := range queue {
+				err := applyMySQLDump(ctx, db, name, file, tracker, throttle)
+				if err != nil {
+					errMutex.Lock()
+					if firstErr == nil {
+						firstErr = fmt.Errorf("error applying %s: %w", filepath.Base(file), err)
+						cancel()
+					}
+					errMutex.Unlock()
+				}
+			}
+		}()
+	}
+
+	for _, file := range tables {
+		select {
+		case queue <- file:
+		case <-ctx.Done():
+		}
+	}
+	close(queue)
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	// Views may select from any table, so they go last
+	for _, file := range rest {
+		err = applyMySQLDump(ctx, db, name, file, tracker, throttle)
+		if err != nil {
+			return fmt.Errorf("error applying %s: %w", filepath.Base(file), err)
+		}
+	}
+
+	return nil
+}
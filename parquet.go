@@ -0,0 +1,421 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Thrift compact protocol types used by Parquet's metadata
+const (
+	thriftI32    = 5
+	thriftI64    = 6
+	thriftBinary = 8
+	thriftList   = 9
+	thriftStruct = 12
+)
+
+// Encode Thrift structs with the compact protocol, as the Parquet page
+// headers and footer are written
+type thriftEncoder struct {
+	buf []byte
+
+	// The last field id written in each open struct
+	fields []int16
+}
+
+func (e *thriftEncoder) varint(v uint64) {
+	e.buf = appendUvarint(e.buf, v)
+}
+
+func (e *thriftEncoder) zigzag(v int64) {
+	e.varint(uint64((v << 1) ^ (v >> 63)))
+}
+
+func (e *thriftEncoder) field(id int16, kind byte) {
+	last := e.fields[len(e.fields)-1]
+	if delta := id - last; delta > 0 && delta <= 15 {
+		e.buf = append(e.buf, byte(delta)<<4|kind)
+	} else {
+		e.buf = append(e.buf, kind)
+		e.zigzag(int64(id))
+	}
+	e.fields[len(e.fields)-1] = id
+}
+
+// Start a struct, either a list element or after structField
+func (e *thriftEncoder) begin() {
+	e.fields = append(e.fields, 0)
+}
+
+func (e *thriftEncoder) end() {
+	e.buf = append(e.buf, 0)
+	e.fields = e.fields[:len(e.fields)-1]
+}
+
+func (e *thriftEncoder) i32(id int16, v int32) {
+	e.field(id, thriftI32)
+	e.zigzag(int64(v))
+}
+
+func (e *thriftEncoder) i64(id int16, v int64) {
+	e.field(id, thriftI64)
+	e.zigzag(v)
+}
+
+func (e *thriftEncoder) str(id int16, v string) {
+	e.field(id, thriftBinary)
+	e.rawString(v)
+}
+
+// Write a string without a field header, as a list element
+func (e *thriftEncoder) rawString(v string) {
+	e.varint(uint64(len(v)))
+	e.buf = append(e.buf, v...)
+}
+
+func (e *thriftEncoder) structField(id int16) {
+	e.field(id, thriftStruct)
+	e.begin()
+}
+
+// Start a list field of n elements of the given type, which follow
+func (e *thriftEncoder) list(id int16, kind byte, n int) {
+	e.field(id, thriftList)
+	if n < 15 {
+		e.buf = append(e.buf, byte(n)<<4|kind)
+	} else {
+		e.buf = append(e.buf, 0xf0|kind)
+		e.varint(uint64(n))
+	}
+}
+
+func appendUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+// Append little-endian integers, as Parquet stores them
+func appendUint32(b []byte, v uint32) []byte {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+func appendUint64(b []byte, v uint64) []byte {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], v)
+	return append(b, buf[:]...)
+}
+
+// Parquet physical types, converted types and enums
+const (
+	parquetBoolean   = 0
+	parquetInt32     = 1
+	parquetInt64     = 2
+	parquetDouble    = 5
+	parquetByteArray = 6
+
+	parquetUTF8            = 0
+	parquetDate            = 6
+	parquetTimestampMicros = 10
+
+	parquetOptional = 1
+	parquetPlain    = 0
+	parquetRLE      = 3
+	parquetGzip     = 2
+	parquetDataPage = 0
+)
+
+// Column types tables can be exported to Parquet as, with the physical and
+// converted types each is stored as (-1 for none)
+var parquetTypes = map[string][2]int32{
+	"string":    {parquetByteArray, parquetUTF8},
+	"binary":    {parquetByteArray, -1},
+	"int64":     {parquetInt64, -1},
+	"double":    {parquetDouble, -1},
+	"boolean":   {parquetBoolean, -1},
+	"timestamp": {parquetInt64, parquetTimestampMicros},
+	"date":      {parquetInt32, parquetDate},
+}
+
+// Row groups are kept in memory until their values are this big
+const parquetRowGroupSize = 64 * 1024 * 1024
+
+// A column of a Parquet file being written, holding the current row group
+type parquetColumn struct {
+	name string
+	kind string
+
+	// PLAIN encoded values, booleans, which are bit-packed, and whether each
+	// row has a value or is NULL
+	values  []byte
+	bools   []bool
+	defined []bool
+}
+
+// A column chunk written to the file
+type parquetChunk struct {
+	offset       int64
+	compressed   int64
+	uncompressed int64
+	values       int64
+}
+
+type parquetRowGroup struct {
+	rows   int64
+	chunks []parquetChunk
+}
+
+// Write rows as a Parquet file of optional columns, PLAIN encoded and gzip
+// compressed, with a row group whenever parquetRowGroupSize is reached
+type parquetWriter struct {
+	out     *countingWriter
+	level   int
+	columns []*parquetColumn
+	rows    int64
+	total   int64
+	groups  []parquetRowGroup
+}
+
+// Start a Parquet file with columns of the given names and types
+func newParquetWriter(out io.Writer, names []string, kinds []string, level int) (*parquetWriter, error) {
+	w := &parquetWriter{out: &countingWriter{writer: out}, level: level}
+	for i, name := range names {
+		if _, ok := parquetTypes[kinds[i]]; !ok {
+			return nil, fmt.Errorf("column %s: unknown type %q", name, kinds[i])
+		}
+		w.columns = append(w.columns, &parquetColumn{name: name, kind: kinds[i]})
+	}
+
+	_, err := io.WriteString(w.out, "PAR1")
+	return w, err
+}
+
+// Convert a value from MySQL's text form and add it to a column
+func (c *parquetColumn) add(value string) error {
+	switch c.kind {
+	case "string", "binary":
+		c.values = appendUint32(c.values, uint32(len(value)))
+		c.values = append(c.values, value...)
+	case "int64":
+		n, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return err
+		}
+		c.values = appendUint64(c.values, uint64(n))
+	case "double":
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return err
+		}
+		c.values = appendUint64(c.values, math.Float64bits(f))
+	case "boolean":
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		c.bools = append(c.bools, b)
+	case "timestamp":
+		t, err := time.ParseInLocation("2006-01-02 15:04:05.999999", value, time.UTC)
+		if err != nil {
+			return err
+		}
+		c.values = appendUint64(c.values, uint64(t.UnixMicro()))
+	case "date":
+		t, err := time.ParseInLocation("2006-01-02", value, time.UTC)
+		if err != nil {
+			return err
+		}
+		c.values = appendUint32(c.values, uint32(int32(t.Unix()/86400)))
+	}
+
+	return nil
+}
+
+// Add a row. MySQL's zero dates have no equivalent, so they're written as NULL.
+func (w *parquetWriter) write(values []string, nulls []bool) error {
+	for i, c := range w.columns {
+		null := nulls[i] || ((c.kind == "date" || c.kind == "timestamp") && strings.HasPrefix(values[i], "0000-00-00"))
+		c.defined = append(c.defined, !null)
+		if null {
+			continue
+		}
+
+		err := c.add(values[i])
+		if err != nil {
+			return fmt.Errorf("column %s as %s: %w", c.name, c.kind, err)
+		}
+	}
+	w.rows++
+
+	var size int
+	for _, c := range w.columns {
+		size += len(c.values) + len(c.bools)/8
+	}
+	if size >= parquetRowGroupSize {
+		return w.flush()
+	}
+
+	return nil
+}
+
+// Bit-pack booleans, least significant bit first
+func packBits(bits []bool) []byte {
+	packed := make([]byte, (len(bits)+7)/8)
+	for i, bit := range bits {
+		if bit {
+			packed[i/8] |= 1 << (i % 8)
+		}
+	}
+
+	return packed
+}
+
+// Write the current row group, a single page per column
+func (w *parquetWriter) flush() error {
+	if w.rows == 0 {
+		return nil
+	}
+
+	group := parquetRowGroup{rows: w.rows}
+	for _, c := range w.columns {
+		// Definition levels as a single bit-packed run of the RLE hybrid
+		// encoding, prefixed by their length
+		packed := packBits(c.defined)
+		levels := appendUvarint(nil, uint64(len(packed))<<1|1)
+		levels = append(levels, packed...)
+
+		page := appendUint32(nil, uint32(len(levels)))
+		page = append(page, levels...)
+		if c.kind == "boolean" {
+			page = append(page, packBits(c.bools)...)
+		} else {
+			page = append(page, c.values...)
+		}
+
+		var compressed bytes.Buffer
+		gz, err := gzip.NewWriterLevel(&compressed, w.level)
+		if err != nil {
+			return err
+		}
+		gz.Write(page)
+		err = gz.Close()
+		if err != nil {
+			return err
+		}
+
+		header := thriftEncoder{}
+		header.begin()
+		header.i32(1, parquetDataPage)
+		header.i32(2, int32(len(page)))
+		header.i32(3, int32(compressed.Len()))
+		header.structField(5)
+		header.i32(1, int32(w.rows))
+		header.i32(2, parquetPlain)
+		header.i32(3, parquetRLE)
+		header.i32(4, parquetRLE)
+		header.end()
+		header.end()
+
+		chunk := parquetChunk{
+			offset:       w.out.written,
+			compressed:   int64(len(header.buf) + compressed.Len()),
+			uncompressed: int64(len(header.buf) + len(page)),
+			values:       w.rows,
+		}
+		_, err = w.out.Write(header.buf)
+		if err == nil {
+			_, err = w.out.Write(compressed.Bytes())
+		}
+		if err != nil {
+			return err
+		}
+		group.chunks = append(group.chunks, chunk)
+
+		c.values = c.values[:0]
+		c.bools = c.bools[:0]
+		c.defined = c.defined[:0]
+	}
+
+	w.groups = append(w.groups, group)
+	w.total += w.rows
+	w.rows = 0
+	return nil
+}
+
+// Write the last row group and the footer describing the file
+func (w *parquetWriter) close() error {
+	err := w.flush()
+	if err != nil {
+		return err
+	}
+
+	meta := thriftEncoder{}
+	meta.begin()
+	meta.i32(1, 1)
+
+	meta.list(2, thriftStruct, len(w.columns)+1)
+	meta.begin()
+	meta.str(4, "schema")
+	meta.i32(5, int32(len(w.columns)))
+	meta.end()
+	for _, c := range w.columns {
+		types := parquetTypes[c.kind]
+		meta.begin()
+		meta.i32(1, types[0])
+		meta.i32(3, parquetOptional)
+		meta.str(4, c.name)
+		if types[1] >= 0 {
+			meta.i32(6, types[1])
+		}
+		meta.end()
+	}
+
+	meta.i64(3, w.total)
+
+	meta.list(4, thriftStruct, len(w.groups))
+	for _, group := range w.groups {
+		var size int64
+		meta.begin()
+		meta.list(1, thriftStruct, len(group.chunks))
+		for i, chunk := range group.chunks {
+			c := w.columns[i]
+			size += chunk.uncompressed
+
+			meta.begin()
+			meta.i64(2, chunk.offset)
+			meta.structField(3)
+			meta.i32(1, parquetTypes[c.kind][0])
+			meta.list(2, thriftI32, 2)
+			meta.zigzag(parquetPlain)
+			meta.zigzag(parquetRLE)
+			meta.list(3, thriftBinary, 1)
+			meta.rawString(c.name)
+			meta.i32(4, parquetGzip)
+			meta.i64(5, chunk.values)
+			meta.i64(6, chunk.uncompressed)
+			meta.i64(7, chunk.compressed)
+			meta.i64(9, chunk.offset)
+			meta.end()
+			meta.end()
+		}
+		meta.i64(2, size)
+		meta.i64(3, group.rows)
+		meta.end()
+	}
+
+	meta.str(6, "dbbackup "+version)
+	meta.end()
+
+	footer := appendUint32(meta.buf, uint32(len(meta.buf)))
+	footer = append(footer, "PAR1"...)
+	_, err = w.out.Write(footer)
+	return err
+}
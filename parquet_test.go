@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/xitongsys/parquet-go-source/buffer"
+	"github.com/xitongsys/parquet-go/parquet"
+	"github.com/xitongsys/parquet-go/reader"
+)
+
+func TestParquetRoundTrip(t *testing.T) {
+	names := []string{"id", "email", "photo", "score", "active", "created_at", "born"}
+	kinds := []string{"int64", "string", "binary", "double", "boolean", "timestamp", "date"}
+	rows := [][]string{
+		{"1", "a@example.org", "\x00\xff", "1.5", "1", "2026-03-01 02:03:04.5", "1990-07-14"},
+		{"-2", "", "", "-0.25", "0", "0000-00-00 00:00:00", "0000-00-00"},
+		{"3", "c@example.org", "x", "1e10", "true", "1970-01-01 00:00:00", "1970-01-02"},
+	}
+	nulls := [][]bool{
+		make([]bool, len(names)),
+		{false, true, true, false, false, false, false},
+		make([]bool, len(names)),
+	}
+
+	var out bytes.Buffer
+	w, err := newParquetWriter(&out, names, kinds, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, row := range rows {
+		if err := w.write(row, nulls[i]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Read the file back with an independent Parquet implementation
+	file, err := buffer.NewBufferFile(out.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr, err := reader.NewParquetColumnReader(file, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rows := pr.GetNumRows(); rows != 3 {
+		t.Fatalf("read %d rows, want 3", rows)
+	}
+
+	created := time.Date(2026, 3, 1, 2, 3, 4, 500000000, time.UTC).UnixMicro()
+	want := [][]interface{}{
+		{int64(1), int64(-2), int64(3)},
+		{"a@example.org", nil, "c@example.org"},
+		{"\x00\xff", nil, "x"},
+		{1.5, -0.25, 1e10},
+		{true, false, true},
+		{created, nil, int64(0)},
+		{int32(7499), nil, int32(1)},
+	}
+
+	for i, path := range pr.SchemaHandler.ValueColumns {
+		values, _, _, err := pr.ReadColumnByPath(path, 3)
+		if err != nil {
+			t.Fatalf("reading %s: %s", names[i], err)
+		}
+		if !reflect.DeepEqual(values, want[i]) {
+			t.Errorf("%s read back as %#v, want %#v", names[i], values, want[i])
+		}
+	}
+
+	// Timestamps and dates carry their logical types. The reader capitalises
+	// the names it reads.
+	converted := map[string]parquet.ConvertedType{}
+	for _, element := range pr.SchemaHandler.SchemaElements[1:] {
+		if element.ConvertedType != nil {
+			converted[strings.ToLower(element.Name)] = *element.ConvertedType
+		}
+	}
+	wantConverted := map[string]parquet.ConvertedType{
+		"email":      parquet.ConvertedType_UTF8,
+		"created_at": parquet.ConvertedType_TIMESTAMP_MICROS,
+		"born":       parquet.ConvertedType_DATE,
+	}
+	if !reflect.DeepEqual(converted, wantConverted) {
+		t.Errorf("converted types %v, want %v", converted, wantConverted)
+	}
+}
+
+func TestParquetRejectsBadValues(t *testing.T) {
+	w, err := newParquetWriter(&bytes.Buffer{}, []string{"id"}, []string{"int64"}, 6)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.write([]string{"one"}, []bool{false}); err == nil {
+		t.Error("writing a word as int64 succeeded")
+	}
+
+	if _, err := newParquetWriter(&bytes.Buffer{}, []string{"id"}, []string{"uuid"}, 6); err == nil {
+		t.Error("unknown column type accepted")
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"time"
+)
+
+// Check whether the process was started to write a backup to stdout, which
+// needs no storage target
+func stdoutMode() bool {
+	if len(os.Args) < 2 || os.Args[1] != "backup" {
+		return false
+	}
+
+	for _, arg := range os.Args[2:] {
+		if arg == "--stdout" || arg == "-stdout" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Dump every database and write the archive to out instead of uploading it,
+// e.g. to pipe it through gpg or carry it across an air gap. Every dump is a
+// full one, since the archives earlier dumps would refer to may not be at hand,
+// and nothing is written to reports_dir or the storage targets.
+func runBackupToWriter(ctx context.Context, config Config, out io.Writer) *RunReport {
+	mutex := config.runMutex()
+	if !mutex.TryLock() {
+		log.Println("Backup already running, skipping")
+		return nil
+	}
+	defer mutex.Unlock()
+
+	unlock, ok := lockRun(config)
+	if !ok {
+		return nil
+	}
+	defer unlock()
+
+	if limit := config.maxRunDuration(); limit > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, limit)
+		defer cancel()
+	}
+
+	report := &RunReport{
+		StartedAt: time.Now(),
+		Version:   version,
+		Profile:   config.profile,
+		Labels:    config.Labels,
+		Agent:     config.agentInfo(),
+		Databases: []DatabaseReport{},
+	}
+	defer report.finish()
+
+	files := []string{}
+	defer func() {
+		for _, file := range files {
+			os.RemoveAll(file)
+		}
+	}()
+
+	queue := []queuedDump{}
+	for _, db := range config.Databases {
+		if db.DBName != "" {
+			db.DBNames = append(db.DBNames, db.DBName)
+		}
+
+		// Everything goes in the one archive, as full dumps
+		db.ChangeDetection = ""
+		db.FullBackupInterval = ""
+		db.S3 = S3Overrides{}
+
+		for _, dbName := range db.DBNames {
+			queue = append(queue, queuedDump{db: db, dbName: dbName})
+		}
+	}
+
+	sortByPriority(queue)
+	dbReports, dumpFiles := runDumps(ctx, config, queue, nil, commandTrigger())
+	dbReports, dumpFiles = retryFailedDumps(ctx, config, queue, dbReports, dumpFiles, nil, commandTrigger())
+	report.Databases = dbReports
+	files = append(files, dumpFiles...)
+
+	if ctx.Err() != nil {
+		report.Error = fmt.Sprintf("stopped: %s", ctx.Err().Error())
+		return report
+	}
+
+	extra, err := writeRestoreFiles(config, report)
+	if err != nil {
+		log.Printf("Error writing restore script: %s\n", err.Error())
+	}
+	files = append(files, extra...)
+
+	log.Println("Writing archive to stdout")
+
+	counter := &countingWriter{writer: out}
+	err = writeArchive(ctx, config, files, counter)
+	if err != nil {
+		log.Printf("Error writing archive: %s\n", err.Error())
+		report.Error = err.Error()
+		return report
+	}
+
+	report.ArchiveSizeBytes = counter.written
+	report.Uploaded = true
+	log.Printf("Wrote %s archive to stdout\n", formatBytes(report.ArchiveSizeBytes))
+
+	return report
+}
+
+// Count the bytes written through to another writer
+type countingWriter struct {
+	writer  io.Writer
+	written int64
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	n, err := w.writer.Write(b)
+	w.written += int64(n)
+	return n, err
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Version of the protocol plugins are spoken to with, sent in every request
+// so plugins can refuse ones they don't understand
+const pluginProtocolVersion = 1
+
+// Sent to a plugin as the first line of its stdin. Plugins are run once per
+// operation with sh -c, and fail it by exiting non-zero with the reason on
+// stderr. The operations are:
+//
+//   - "upload": store the bytes following the request line under key
+//   - "list": write {"objects": [...]} of the objects whose keys start with prefix
+//   - "open": write the object stored under key to stdout
+//   - "delete": delete the object stored under key
+//   - "notify": send notification
+type pluginRequest struct {
+	Protocol int               `json:"protocol"`
+	Op       string            `json:"op"`
+	Name     string            `json:"name"`
+	Options  map[string]string `json:"options,omitempty"`
+
+	// Storage operations
+	Key      string            `json:"key,omitempty"`
+	Prefix   string            `json:"prefix,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Tags     map[string]string `json:"tags,omitempty"`
+
+	Notification *Notification `json:"notification,omitempty"`
+}
+
+// Written by a plugin in response to "list"
+type pluginListing struct {
+	Objects []struct {
+		Key          string    `json:"key"`
+		Size         int64     `json:"size"`
+		LastModified time.Time `json:"last_modified"`
+	} `json:"objects"`
+}
+
+// Start a plugin with the request, followed by body when given, on its stdin
+func startPlugin(ctx context.Context, command string, request pluginRequest, body io.Reader) (*exec.Cmd, *strings.Builder, error) {
+	request.Protocol = pluginProtocolVersion
+
+	line, err := json.Marshal(request)
+	if err != nil {
+		return nil, nil, err
+	}
+	line = append(line, '\n')
+
+	var stdin io.Reader = bytes.NewReader(line)
+	if body != nil {
+		stdin = io.MultiReader(stdin, body)
+	}
+
+	var stderr strings.Builder
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Stdin = stdin
+	cmd.Stderr = &stderr
+
+	return cmd, &stderr, nil
+}
+
+// Report a failed plugin with what it wrote to stderr
+func pluginError(request pluginRequest, err error, stderr *strings.Builder) error {
+	return fmt.Errorf("plugin %s %s: %w: %s", request.Name, request.Op, err, strings.TrimSpace(stderr.String()))
+}
+
+// Run a plugin to completion, returning what it wrote to stdout
+func runPlugin(ctx context.Context, command string, request pluginRequest, body io.Reader) ([]byte, error) {
+	cmd, stderr, err := startPlugin(ctx, command, request, body)
+	if err != nil {
+		return nil, err
+	}
+
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+
+	err = runProcessGroup(ctx, cmd)
+	if err != nil {
+		return nil, pluginError(request, err, stderr)
+	}
+
+	return stdout.Bytes(), nil
+}
+
+// Streams an object from a plugin's stdout, failing at the end of it if the
+// plugin didn't exit cleanly
+type pluginReader struct {
+	io.ReadCloser
+	cmd     *exec.Cmd
+	request pluginRequest
+	stderr  *strings.Builder
+	waited  bool
+}
+
+func (r *pluginReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if err == io.EOF && !r.waited {
+		r.waited = true
+		if waitErr := r.cmd.Wait(); waitErr != nil {
+			return n, pluginError(r.request, waitErr, r.stderr)
+		}
+	}
+	return n, err
+}
+
+func (r *pluginReader) Close() error {
+	r.ReadCloser.Close()
+	if !r.waited {
+		r.waited = true
+		r.cmd.Process.Kill()
+		r.cmd.Wait()
+	}
+	return nil
+}
+
+// Build a storage request to the target's plugin
+func (target TargetConfig) pluginRequest(op string) pluginRequest {
+	return pluginRequest{Op: op, Name: target.Name, Options: target.Options}
+}
+
+// Upload everything read from body to a plugin target
+func (target TargetConfig) pluginUpload(ctx context.Context, body io.Reader, name string) error {
+	request := target.pluginRequest("upload")
+	request.Key = target.key(name)
+	request.Metadata = target.metadata
+	request.Tags = target.tags
+
+	_, err := runPlugin(ctx, target.Command, request, body)
+	return err
+}
+
+// List the objects on a plugin target whose keys start with prefix
+func (target TargetConfig) pluginList(ctx context.Context, prefix string) ([]StoredObject, error) {
+	request := target.pluginRequest("list")
+	request.Prefix = target.key(prefix)
+
+	output, err := runPlugin(ctx, target.Command, request, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	listing := pluginListing{}
+	err = json.Unmarshal(output, &listing)
+	if err != nil {
+		return nil, fmt.Errorf("plugin %s list: invalid response: %w", target.Name, err)
+	}
+
+	objects := []StoredObject{}
+	for _, object := range listing.Objects {
+		objects = append(objects, StoredObject{Key: object.Key, Size: object.Size, LastModified: object.LastModified})
+	}
+
+	return objects, nil
+}
+
+// Delete an object from a plugin target
+func (target TargetConfig) pluginDelete(ctx context.Context, key string) error {
+	request := target.pluginRequest("delete")
+	request.Key = key
+
+	_, err := runPlugin(ctx, target.Command, request, nil)
+	return err
+}
+
+// Open an object on a plugin target, streamed from the plugin as it's read
+func (target TargetConfig) pluginOpen(ctx context.Context, key string) (io.ReadCloser, error) {
+	request := target.pluginRequest("open")
+	request.Key = key
+
+	cmd, stderr, err := startPlugin(ctx, target.Command, request, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return nil, pluginError(request, err, stderr)
+	}
+
+	return &pluginReader{ReadCloser: stdout, cmd: cmd, request: request, stderr: stderr}, nil
+}
+
+// Send a notification through a plugin notifier
+func (notifier NotifierConfig) pluginNotify(ctx context.Context, notification Notification) error {
+	request := pluginRequest{Op: "notify", Name: notifier.Name, Options: notifier.Options, Notification: &notification}
+
+	_, err := runPlugin(ctx, notifier.Command, request, nil)
+	return err
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Prefix of the safety snapshots taken before restoring over a database
+const preRestorePrefix = "pre-restore/"
+
+// Dump a database as it is before a restore replaces it, uploading the dump
+// to pre-restore/ on the first storage target so a restore of the wrong
+// backup can be undone. Nothing is taken when the database has no tables.
+// Returns the key of the snapshot, if one was taken.
+func takeSafetySnapshot(ctx context.Context, config Config, db DatabaseConfig, name string) (string, error) {
+	dbArg := name
+	exportName := fmt.Sprintf("%s_%s_on_%s_%s", config.timestamp(time.Now()), db.Engine, db.Host, name)
+
+	if name == "*" {
+		dbArg = "--all-databases"
+		exportName = fmt.Sprintf("%s_%s_all-databases", config.timestamp(time.Now()), db.Host)
+	} else {
+		count, err := countTables(db, name)
+		if err != nil {
+			return "", fmt.Errorf("error checking %s for tables: %w", name, err)
+		}
+		if count == 0 {
+			log.Printf("Database %s on host %s has no tables, skipping the safety snapshot\n", name, db.Host)
+			return "", nil
+		}
+	}
+
+	// Not masked, so the snapshot puts back exactly what was there
+	file := filepath.Join(config.TempDir, exportName+".sql.gz")
+	defer os.Remove(file)
+
+	log.Printf("Taking a safety snapshot of %s on host %s before restoring\n", name, db.Host)
+
+	args := append(mysqlConnectionArgs(db), "--extended-insert", "--single-transaction=TRUE", dbArg)
+	cmd := dumpCommand(ctx, "mysqldump", args...)
+	cmd.Env = mysqlEnv(db)
+	err := compressedDump(cmd, file, config.CompressionLevel, nil)
+	if err != nil {
+		return "", fmt.Errorf("error dumping %s: %w", name, err)
+	}
+
+	target := config.targets()[0]
+	key := preRestorePrefix + filepath.Base(file)
+
+	err = target.upload(ctx, config, file, key, true)
+	auditLog(config, "pre_restore_snapshot", target.key(key), commandTrigger(), err)
+	if err != nil {
+		return "", fmt.Errorf("error uploading to %s: %w", target.Name, err)
+	}
+
+	return target.key(key), nil
+}
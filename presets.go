@@ -0,0 +1,126 @@
+package main
+
+import (
+	"sort"
+	"strings"
+)
+
+// A named bundle of dump settings for a kind of MySQL or MariaDB database,
+// so entries don't need to get each flag right themselves
+type dumpPreset struct {
+	// Applied where the database leaves the setting unset
+	lock             string
+	parallelTables   int
+	maxAllowedPacket string
+	netBufferLength  int
+
+	// Turned on, as an unset bool can't be told from false
+	storedPrograms    bool
+	hexBlob           bool
+	checkCompleteness bool
+
+	// Extra mysqldump flags, added after the defaults
+	args []string
+
+	// Locks the preset rules out, e.g. those needing SUPER on managed servers
+	forbiddenLocks []string
+}
+
+// Presets a database's preset setting can name
+var dumpPresets = map[string]dumpPreset{
+	// InnoDB-only databases: a consistent snapshot without locking, with
+	// everything needed to rebuild the schema, checked against the server
+	"safe-innodb": {
+		storedPrograms:    true,
+		hexBlob:           true,
+		checkCompleteness: true,
+	},
+	// Databases with MyISAM tables, which single-transaction doesn't make
+	// consistent, so writes are blocked for the length of the dump
+	"myisam-locking": {
+		lock:           "flush",
+		storedPrograms: true,
+	},
+	// Big databases: a dump per table in parallel, with larger packets and
+	// fewer, longer INSERTs
+	"fast-large-db": {
+		parallelTables:   4,
+		maxAllowedPacket: "1G",
+		netBufferLength:  1048576,
+		hexBlob:          true,
+	},
+	// Amazon RDS and Aurora, where the admin user has no SUPER or RELOAD
+	// privilege, so FLUSH TABLES WITH READ LOCK isn't allowed, nor PROCESS,
+	// which MySQL 8 needs to dump tablespaces
+	"rds-compatible": {
+		storedPrograms: true,
+		hexBlob:        true,
+		args:           []string{"--no-tablespaces"},
+		forbiddenLocks: []string{"flush"},
+	},
+}
+
+// List the preset names, for error messages
+func dumpPresetNames() string {
+	names := []string{}
+	for name := range dumpPresets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return strings.Join(names, ", ")
+}
+
+// Fill in a database's settings from its preset. Settings given on the
+// database itself win.
+func applyDumpPreset(db *DatabaseConfig) {
+	preset, ok := dumpPresets[db.Preset]
+	if !ok {
+		return
+	}
+
+	if db.Lock == "" {
+		db.Lock = preset.lock
+	}
+	if db.ParallelTables == 0 {
+		db.ParallelTables = preset.parallelTables
+	}
+	if db.MaxAllowedPacket == "" {
+		db.MaxAllowedPacket = preset.maxAllowedPacket
+	}
+	if db.NetBufferLength == 0 {
+		db.NetBufferLength = preset.netBufferLength
+	}
+
+	db.StoredPrograms = db.StoredPrograms || preset.storedPrograms
+	db.HexBlob = db.HexBlob || preset.hexBlob
+	db.CheckCompleteness = db.CheckCompleteness || preset.checkCompleteness
+}
+
+// Get the extra mysqldump flags from a database's preset
+func (db DatabaseConfig) presetArgs() []string {
+	return dumpPresets[db.Preset].args
+}
+
+// Check a database's preset and the settings it rules out
+func validateDumpPreset(errs *validationErrors, where string, db DatabaseConfig) {
+	if db.Preset == "" {
+		return
+	}
+
+	preset, ok := dumpPresets[db.Preset]
+	if !ok {
+		errs.add("%s: unknown preset %q, expected one of %s", where, db.Preset, dumpPresetNames())
+		return
+	}
+
+	if db.Engine != "mysql" && db.Engine != "mariadb" {
+		errs.add("%s: preset is only supported for mysql and mariadb", where)
+	}
+
+	for _, lock := range preset.forbiddenLocks {
+		if db.Lock == lock {
+			errs.add("%s: lock %q can't be used with preset %s", where, lock, db.Preset)
+		}
+	}
+}
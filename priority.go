@@ -0,0 +1,29 @@
+package main
+
+import "sort"
+
+// Order dumps by their database's priority, highest first, keeping the
+// config's order among equals
+func sortByPriority(queue []queuedDump) {
+	sort.SliceStable(queue, func(i, j int) bool {
+		return queue[i].db.Priority > queue[j].db.Priority
+	})
+}
+
+// Order the groups with members queued by their most important member,
+// sorting each group's members too
+func groupsByPriority(groups []GroupConfig, grouped map[string][]queuedDump) []GroupConfig {
+	ordered := []GroupConfig{}
+	for _, group := range groups {
+		if len(grouped[group.Name]) > 0 {
+			sortByPriority(grouped[group.Name])
+			ordered = append(ordered, group)
+		}
+	}
+
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return grouped[ordered[i].Name][0].db.Priority > grouped[ordered[j].Name][0].db.Priority
+	})
+
+	return ordered
+}
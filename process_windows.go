@@ -0,0 +1,31 @@
+//go:build windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+)
+
+// Windows has no user signals, so backups are paused from the command line or API
+var pauseSignal, resumeSignal os.Signal
+
+// Process groups aren't used on Windows
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// Check whether a process is still running
+func processAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	process.Release()
+	return true
+}
+
+// Kill the command. Anything it started is left running.
+func killProcessGroup(cmd *exec.Cmd) {
+	if cmd.Process != nil {
+		cmd.Process.Kill()
+	}
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+// A step in a database's dump processing chain
+type ProcessorConfig struct {
+	// "mask", "gzip", "encrypt" or "command"
+	Type string `yaml:"type"`
+
+	// For command: run with sh -c, reading the dump on stdin and writing the
+	// processed dump to stdout, e.g. "xz -T0"
+	Command string `yaml:"command"`
+
+	// For command: added to the dump's file name, e.g. ".xz"
+	Extension string `yaml:"extension"`
+}
+
+// Transforms a dump as it streams through the chain
+type dumpProcessor interface {
+	// Wrap the stream, returning the processed one. Errors while processing
+	// are returned from its Read.
+	wrap(ctx context.Context, in io.Reader) io.ReadCloser
+
+	// Added to the dump's file name, e.g. ".gz", or "" when it's unchanged
+	extension() string
+}
+
+// Build each kind of processor from its config
+var dumpProcessorTypes = map[string]func(config Config, db DatabaseConfig, processor ProcessorConfig) dumpProcessor{
+	"mask": func(config Config, db DatabaseConfig, processor ProcessorConfig) dumpProcessor {
+		return maskProcessor{rules: db.Masking}
+	},
+	"gzip": func(config Config, db DatabaseConfig, processor ProcessorConfig) dumpProcessor {
+		return gzipProcessor{level: config.CompressionLevel}
+	},
+	"encrypt": func(config Config, db DatabaseConfig, processor ProcessorConfig) dumpProcessor {
+		return encryptProcessor{passphrase: config.Encryption.Passphrase.reveal(), keyID: config.Encryption.KeyID}
+	},
+	"command": func(config Config, db DatabaseConfig, processor ProcessorConfig) dumpProcessor {
+		return commandProcessor{command: processor.Command, ext: processor.Extension}
+	},
+}
+
+// Stream what write writes to the returned reader, failing reads with its error
+func pipeThrough(write func(out io.Writer) error) io.ReadCloser {
+	reader, writer := io.Pipe()
+
+	go func() {
+		writer.CloseWithError(write(writer))
+	}()
+
+	return reader
+}
+
+// Masks the configured columns, as masking does without a chain
+type maskProcessor struct {
+	rules []MaskingRule
+}
+
+func (p maskProcessor) wrap(ctx context.Context, in io.Reader) io.ReadCloser {
+	return pipeThrough(func(out io.Writer) error {
+		return maskStream(in, out, p.rules)
+	})
+}
+
+func (p maskProcessor) extension() string {
+	return ""
+}
+
+// Compresses the dump, which restores read as they do compress_dumps' dumps
+type gzipProcessor struct {
+	level int
+}
+
+func (p gzipProcessor) wrap(ctx context.Context, in io.Reader) io.ReadCloser {
+	return pipeThrough(func(out io.Writer) error {
+		gw, err := gzip.NewWriterLevel(out, p.level)
+		if err != nil {
+			return err
+		}
+
+		_, err = copyBuffered(gw, in)
+		if err != nil {
+			return err
+		}
+
+		return gw.Close()
+	})
+}
+
+func (p gzipProcessor) extension() string {
+	return ".gz"
+}
+
+// Encrypts the dump with encryption.passphrase, which restores decrypt
+type encryptProcessor struct {
+	passphrase string
+	keyID      string
+}
+
+func (p encryptProcessor) wrap(ctx context.Context, in io.Reader) io.ReadCloser {
+	return pipeThrough(func(out io.Writer) error {
+		encrypted, err := newEncryptingWriter(out, p.passphrase, p.keyID)
+		if err != nil {
+			return err
+		}
+
+		_, err = copyBuffered(encrypted, in)
+		if err != nil {
+			return err
+		}
+
+		return encrypted.Close()
+	})
+}
+
+func (p encryptProcessor) extension() string {
+	return encryptedExtension
+}
+
+// Runs a custom command over the dump. Restores can't undo it, so its output
+// has to be restored by hand unless it leaves the dump as SQL.
+type commandProcessor struct {
+	command string
+	ext     string
+}
+
+func (p commandProcessor) wrap(ctx context.Context, in io.Reader) io.ReadCloser {
+	return pipeThrough(func(out io.Writer) error {
+		var stderr strings.Builder
+
+		cmd := dumpCommand(ctx, "sh", "-c", p.command)
+		cmd.Stdin = in
+		cmd.Stdout = out
+		cmd.Stderr = &stderr
+
+		err := runProcessGroup(ctx, cmd)
+		if err != nil {
+			return fmt.Errorf("processor %q: %w: %s", p.command, err, strings.TrimSpace(stderr.String()))
+		}
+
+		return nil
+	})
+}
+
+func (p commandProcessor) extension() string {
+	return p.ext
+}
+
+// Run a dump through the database's processors in order, replacing it with
+// the processed file. Returns the new file's path, which has each
+// processor's extension added.
+func processDump(ctx context.Context, config Config, db DatabaseConfig, exportFile string) (string, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	in, err := os.Open(exportFile)
+	if err != nil {
+		return "", err
+	}
+	defer in.Close()
+
+	// Closing every stage stops the ones before a failed one
+	var stream io.Reader = in
+	processed := exportFile
+	names := []string{}
+	for _, processor := range db.Processors {
+		p := dumpProcessorTypes[processor.Type](config, db, processor)
+
+		reader := p.wrap(ctx, stream)
+		defer reader.Close()
+
+		stream = reader
+		processed += p.extension()
+		names = append(names, processor.Type)
+	}
+
+	log.Printf("Processing %s with %s\n", exportFile, strings.Join(names, ", "))
+
+	out, err := os.Create(processed + ".processing")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = copyBuffered(out, stream)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(processed+".processing", processed)
+	}
+	if err != nil {
+		os.Remove(processed + ".processing")
+		return "", err
+	}
+
+	if processed != exportFile {
+		os.Remove(exportFile)
+	}
+
+	return processed, nil
+}
+
+// Decrypt a restored dump that an encrypt processor encrypted, returning the
+// path of the decrypted dump
+func decryptDump(config Config, dumpFile string) (string, error) {
+	if !strings.HasSuffix(dumpFile, encryptedExtension) {
+		return dumpFile, nil
+	}
+
+	decrypted := strings.TrimSuffix(dumpFile, encryptedExtension)
+	err := decryptFile(config, dumpFile, decrypted)
+	os.Remove(dumpFile)
+
+	return decrypted, err
+}
+
+// Check a database's processors and the settings they rely on
+func validateProcessors(errs *validationErrors, config Config, where string, db DatabaseConfig) {
+	if len(db.Processors) == 0 {
+		return
+	}
+
+	if db.ParallelTables > 1 || db.SplitTables {
+		errs.add("%s: processors can't be used with parallel_tables or split_tables, which dump a directory", where)
+	}
+
+	types := map[string]bool{}
+	for i, processor := range db.Processors {
+		step := fmt.Sprintf("%s: processors[%d]", where, i)
+
+		if _, ok := dumpProcessorTypes[processor.Type]; !ok {
+			errs.add("%s: unknown type %q, expected mask, gzip, encrypt or command", step, processor.Type)
+			continue
+		}
+		types[processor.Type] = true
+
+		switch processor.Type {
+		case "mask":
+			if len(db.Masking) == 0 {
+				errs.add("%s: mask needs masking rules on the database", step)
+			}
+		case "encrypt":
+			if !config.encryptArchives() {
+				errs.add("%s: encrypt needs encryption.passphrase", step)
+			}
+		case "command":
+			if processor.Command == "" {
+				errs.add("%s: command is required", step)
+			}
+		}
+		if processor.Type != "command" && (processor.Command != "" || processor.Extension != "") {
+			errs.add("%s: command and extension only apply to type command", step)
+		}
+	}
+
+	// compress_dumps masks as it dumps, leaving the file compressed, so it's
+	// only without it that the rules need a step to be applied by
+	if config.CompressDumps && types["mask"] {
+		errs.add("%s: compress_dumps already masks dumps as they're written, drop the mask step", where)
+	}
+	if !config.CompressDumps && len(db.Masking) > 0 && !types["mask"] {
+		errs.add("%s: masking rules need a mask step in processors", where)
+	}
+	if types["gzip"] && config.CompressDumps {
+		errs.add("%s: processors can't gzip dumps that compress_dumps already compresses", where)
+	}
+}
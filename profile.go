@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Profile names end up in directory names, so are kept simple
+var profileNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// Check whether a profile's settings include a key
+func nodeSets(node *yaml.Node, key string) bool {
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Find the line each of a profile's database entries is defined on
+func profileDatabaseLines(node *yaml.Node) []int {
+	lines := []int{}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == "databases" {
+			for _, item := range node.Content[i+1].Content {
+				lines = append(lines, item.Line)
+			}
+		}
+	}
+
+	return lines
+}
+
+// Build the config for each profile: the configuration files merged again,
+// so profiles share nothing, with the profile's settings on top. Lists set in
+// a profile replace the shared ones. Dumps, reports and temp files go in a
+// directory per profile unless the profile sets its own.
+func loadProfiles(base Config, files []string, documents [][]byte, dir string) ([]Config, error) {
+	names := []string{}
+	for name := range base.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	errs := validationErrors{}
+	profiles := []Config{}
+
+	for _, name := range names {
+		where := "profiles." + name
+		node := base.Profiles[name]
+
+		if !profileNamePattern.MatchString(name) {
+			errs.add("%s: profile names may only contain letters, digits, \"-\" and \"_\"", where)
+			continue
+		}
+		if node.Kind != yaml.MappingNode {
+			errs.add("%s: expected a mapping of settings", where)
+			continue
+		}
+
+		data, err := yaml.Marshal(&node)
+		if err != nil {
+			return nil, err
+		}
+
+		config, err := mergeFiles(files, documents)
+		if err != nil {
+			return nil, err
+		}
+
+		err = decodeStrict(data, &config)
+		if err != nil {
+			errs.add("%s: %s", where, err.Error())
+			continue
+		}
+
+		for i, line := range profileDatabaseLines(&node) {
+			if i < len(config.Databases) {
+				config.Databases[i].source = fmt.Sprintf("profile %s, line %d", name, line)
+			}
+		}
+
+		config.Profiles = nil
+		config.profile = name
+		applyDefaults(&config, dir)
+
+		if !nodeSets(&node, "dump_dir") {
+			config.DumpDir = filepath.Join(base.DumpDir, name)
+		}
+		if !nodeSets(&node, "reports_dir") {
+			config.ReportsDir = filepath.Join(base.ReportsDir, name)
+		}
+		if !nodeSets(&node, "temp_dir") {
+			config.TempDir = filepath.Join(base.TempDir, name)
+		}
+
+		err = validateConfig(config)
+		if problems, ok := err.(validationErrors); ok {
+			for _, problem := range problems {
+				errs.add("%s: %s", where, problem)
+			}
+		} else if err != nil {
+			errs.add("%s: %s", where, err.Error())
+		}
+
+		config.bindNotifiers()
+		profiles = append(profiles, config)
+	}
+
+	checkProfilesApart(&errs, profiles)
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	return profiles, nil
+}
+
+// Check profiles don't share directories or listen addresses, as they'd
+// overwrite each other's files or fail to start
+func checkProfilesApart(errs *validationErrors, profiles []Config) {
+	settings := map[string]func(Config) string{
+		"dump_dir":         func(config Config) string { return config.DumpDir },
+		"reports_dir":      func(config Config) string { return config.ReportsDir },
+		"temp_dir":         func(config Config) string { return config.TempDir },
+		"dashboard.listen": func(config Config) string { return config.Dashboard.Listen },
+		"metrics.listen":   func(config Config) string { return config.Metrics.Listen },
+		"api.listen":       func(config Config) string { return config.API.Listen },
+	}
+
+	keys := []string{}
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		used := map[string]string{}
+		for _, config := range profiles {
+			value := settings[key](config)
+			if value == "" {
+				continue
+			}
+			if other, ok := used[value]; ok {
+				errs.add("profiles.%s: %s %q is also used by profile %s", config.profile, key, value, other)
+				continue
+			}
+			used[value] = config.profile
+		}
+	}
+}
+
+// Link each notifier to the config it belongs to, for rate limits, quiet
+// hours and MQTT statuses
+func (config *Config) bindNotifiers() {
+	for i := range config.Notifications {
+		config.Notifications[i].id = fmt.Sprintf("%s/%d", config.profile, i)
+		config.Notifications[i].reportsDir = config.ReportsDir
+	}
+}
+
+// Get the configs to run: every profile, only the named one, or the config
+// itself when it has no profiles
+func (config Config) selectProfiles(name string) ([]Config, error) {
+	if len(config.profiles) == 0 {
+		if name != "" {
+			return nil, fmt.Errorf("profile %q selected but no profiles are configured", name)
+		}
+		return []Config{config}, nil
+	}
+
+	if name == "" {
+		return config.profiles, nil
+	}
+
+	names := []string{}
+	for _, profile := range config.profiles {
+		if profile.profile == name {
+			return []Config{profile}, nil
+		}
+		names = append(names, profile.profile)
+	}
+
+	return nil, fmt.Errorf("unknown profile %q, expected one of %s", name, strings.Join(names, ", "))
+}
+
+var (
+	runMutexesLock sync.Mutex
+
+	// Held while a backup run is in progress, one per profile
+	runMutexes = map[string]*sync.Mutex{}
+)
+
+// Get the lock held while the config's profile is running a backup
+func (config Config) runMutex() *sync.Mutex {
+	runMutexesLock.Lock()
+	defer runMutexesLock.Unlock()
+
+	mutex, ok := runMutexes[config.profile]
+	if !ok {
+		mutex = &sync.Mutex{}
+		runMutexes[config.profile] = mutex
+	}
+
+	return mutex
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+	"runtime"
+	runtimepprof "runtime/pprof"
+)
+
+// Serve the Go pprof endpoints under /debug/pprof/ for diagnosing CPU, memory
+// and blocking in a running agent. /debug/pprof/trace?seconds=N shows time
+// spent in syscalls and waiting on the network. Blocks until the server stops.
+func serveDebug(config Config) {
+	defer redactPanic()
+
+	if config.Debug.Token == "" && config.Debug.Username == "" {
+		log.Println("Refusing to start debug server without a token or username configured")
+		return
+	}
+
+	// Sample blocking on channels and locks for /debug/pprof/block, about
+	// once per millisecond spent blocked
+	runtime.SetBlockProfileRate(1000000)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", requireAuth(config.Debug.HTTPAuth, pprof.Index))
+	mux.HandleFunc("/debug/pprof/cmdline", requireAuth(config.Debug.HTTPAuth, pprof.Cmdline))
+	mux.HandleFunc("/debug/pprof/profile", requireAuth(config.Debug.HTTPAuth, pprof.Profile))
+	mux.HandleFunc("/debug/pprof/symbol", requireAuth(config.Debug.HTTPAuth, pprof.Symbol))
+	mux.HandleFunc("/debug/pprof/trace", requireAuth(config.Debug.HTTPAuth, pprof.Trace))
+
+	log.Printf("Starting debug server on %s\n", config.Debug.Listen)
+
+	err := http.ListenAndServe(config.Debug.Listen, mux)
+	if err != nil {
+		log.Printf("Error running debug server: %s\n", err.Error())
+	}
+}
+
+// Profile a one-shot run into dir: cpu.pprof, and heap.pprof and block.pprof
+// written when the returned function is called at the end of the run. An
+// execution trace would grow too big over a whole run.
+func startProfiling(dir string) (func(), error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	cpuFile, err := os.Create(filepath.Join(dir, "cpu.pprof"))
+	if err != nil {
+		return nil, err
+	}
+	err = runtimepprof.StartCPUProfile(cpuFile)
+	if err != nil {
+		cpuFile.Close()
+		return nil, fmt.Errorf("error starting CPU profile: %w", err)
+	}
+
+	runtime.SetBlockProfileRate(1000000)
+	log.Printf("Profiling the run into %s\n", dir)
+
+	return func() {
+		runtimepprof.StopCPUProfile()
+		cpuFile.Close()
+
+		for _, name := range []string{"heap", "block"} {
+			file, err := os.Create(filepath.Join(dir, name+".pprof"))
+			if err == nil {
+				err = runtimepprof.Lookup(name).WriteTo(file, 0)
+				file.Close()
+			}
+			if err != nil {
+				log.Printf("Error writing %s profile: %s\n", name, err.Error())
+			}
+		}
+
+		log.Printf("Wrote profiles to %s, view them with \"go tool pprof\"\n", dir)
+	}, nil
+}
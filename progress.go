@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Wrap a reader and count the bytes read through it
+type progressReader struct {
+	reader io.Reader
+	read   int64
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.reader.Read(b)
+	atomic.AddInt64(&p.read, int64(n))
+	return n, err
+}
+
+func (p *progressReader) bytesRead() int64 {
+	return atomic.LoadInt64(&p.read)
+}
+
+// Wrap a reader so reads fail once the context is cancelled
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (c *contextReader) Read(b []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.reader.Read(b)
+}
+
+// Wrap a file being uploaded and count the bytes read from it, keeping ReadAt
+// and Seek so S3 multipart uploads read their parts straight from the file in
+// parallel rather than buffering each in memory. Bytes the SDK reads more than
+// once, e.g. to checksum a part, are only counted once.
+type progressFile struct {
+	ctx  context.Context
+	file *os.File
+
+	mutex   sync.Mutex
+	offset  int64
+	covered [][2]int64
+	read    int64
+}
+
+func (p *progressFile) Read(b []byte) (int, error) {
+	if err := p.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	n, err := p.file.Read(b)
+
+	p.mutex.Lock()
+	p.cover(p.offset, p.offset+int64(n))
+	p.offset += int64(n)
+	p.mutex.Unlock()
+
+	return n, err
+}
+
+func (p *progressFile) ReadAt(b []byte, off int64) (int, error) {
+	if err := p.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	n, err := p.file.ReadAt(b, off)
+
+	p.mutex.Lock()
+	p.cover(off, off+int64(n))
+	p.mutex.Unlock()
+
+	return n, err
+}
+
+func (p *progressFile) Seek(offset int64, whence int) (int64, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	pos, err := p.file.Seek(offset, whence)
+	if err == nil {
+		p.offset = pos
+	}
+	return pos, err
+}
+
+// Record the range from start to end as read. Called with the mutex held.
+func (p *progressFile) cover(start int64, end int64) {
+	if end <= start {
+		return
+	}
+
+	merged := [][2]int64{}
+	for _, r := range p.covered {
+		if r[1] < start || r[0] > end {
+			merged = append(merged, r)
+			continue
+		}
+		if r[0] < start {
+			start = r[0]
+		}
+		if r[1] > end {
+			end = r[1]
+		}
+	}
+	merged = append(merged, [2]int64{start, end})
+
+	p.covered = merged
+	p.read = 0
+	for _, r := range merged {
+		p.read += r[1] - r[0]
+	}
+}
+
+func (p *progressFile) bytesRead() int64 {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+
+	return p.read
+}
+
+// Format a byte count in a human readable way
+func formatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
+
+// Periodically log progress until the returned stop function is called.
+// current is polled for the number of bytes processed so far, and total is
+// the expected size (or 0 if unknown).
+func watchProgress(label string, interval time.Duration, total int64, current func() int64) func() {
+	if interval <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	started := time.Now()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				bytes := current()
+				rate := float64(bytes) / time.Since(started).Seconds()
+
+				if total > 0 {
+					log.Printf("%s: %s of %s (%.1f%%) at %s/s\n", label, formatBytes(bytes), formatBytes(total), float64(bytes)/float64(total)*100, formatBytes(int64(rate)))
+				} else {
+					log.Printf("%s: %s at %s/s\n", label, formatBytes(bytes), formatBytes(int64(rate)))
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+	}
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProgressFileKeepsReaderAtAndSeeker(t *testing.T) {
+	// s3manager only reads parts straight from the body when it has both
+	var body interface{} = &progressFile{}
+	if _, ok := body.(interface {
+		io.ReaderAt
+		io.ReadSeeker
+	}); !ok {
+		t.Fatal("progressFile hides ReadAt or Seek")
+	}
+}
+
+func TestProgressFileCountsBytesOnce(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 100)
+	path := filepath.Join(t.TempDir(), "archive")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	body := &progressFile{ctx: context.Background(), file: file}
+
+	// Two parts read in parallel, the first read twice as when checksummed
+	first := io.NewSectionReader(body, 0, 500)
+	second := io.NewSectionReader(body, 500, 500)
+
+	io.Copy(io.Discard, io.LimitReader(first, 200))
+	io.Copy(io.Discard, io.LimitReader(second, 100))
+	if read := body.bytesRead(); read != 300 {
+		t.Errorf("counted %d bytes, want 300", read)
+	}
+
+	first.Seek(0, io.SeekStart)
+	io.Copy(io.Discard, first)
+	io.Copy(io.Discard, second)
+	first.Seek(0, io.SeekStart)
+	io.Copy(io.Discard, first)
+	if read := body.bytesRead(); read != int64(len(data)) {
+		t.Errorf("counted %d bytes, want %d", read, len(data))
+	}
+
+	// Reading sequentially after seeking back adds nothing new
+	body.Seek(0, io.SeekStart)
+	read, err := io.ReadAll(body)
+	if err != nil || !bytes.Equal(read, data) {
+		t.Fatalf("read %d bytes, %v", len(read), err)
+	}
+	if count := body.bytesRead(); count != int64(len(data)) {
+		t.Errorf("counted %d bytes, want %d", count, len(data))
+	}
+}
+
+func TestProgressFileStopsWhenCancelled(t *testing.T) {
+	file, err := os.Open(os.Args[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	body := &progressFile{ctx: ctx, file: file}
+	if _, err := body.Read(make([]byte, 10)); err != context.Canceled {
+		t.Errorf("Read returned %v", err)
+	}
+	if _, err := body.ReadAt(make([]byte, 10), 0); err != context.Canceled {
+		t.Errorf("ReadAt returned %v", err)
+	}
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/rds/rdsutils"
+)
+
+// Hold the settings for connecting to RDS or Aurora MySQL with an IAM
+// authentication token in place of a password. Credentials come from the
+// usual AWS chain: environment, shared config or the instance role.
+type IAMAuthConfig struct {
+	Enabled bool   `yaml:"enabled"`
+	Region  string `yaml:"region"`
+}
+
+// Tokens are valid for 15 minutes, so they're reused for less than that
+const iamTokenLifetime = 10 * time.Minute
+
+type cachedToken struct {
+	value   string
+	expires time.Time
+}
+
+var (
+	iamTokens      = map[string]cachedToken{}
+	iamTokensMutex sync.Mutex
+)
+
+// Get an authentication token for the database's user and endpoint. The
+// token is signed for the host name, not the address tried, and replaces the
+// previous one in the secrets redacted from the logs.
+func (db DatabaseConfig) iamToken() (string, error) {
+	endpoint := fmt.Sprintf("%s:%d", db.Host, db.Port)
+	cacheKey := db.Username + "@" + endpoint
+
+	iamTokensMutex.Lock()
+	defer iamTokensMutex.Unlock()
+
+	cached, ok := iamTokens[cacheKey]
+	if ok && time.Now().Before(cached.expires) {
+		return cached.value, nil
+	}
+
+	sess, err := session.NewSession(&aws.Config{Region: aws.String(db.IAMAuth.Region)})
+	if err != nil {
+		return "", fmt.Errorf("error creating AWS session: %w", err)
+	}
+
+	token, err := rdsutils.BuildAuthToken(endpoint, db.IAMAuth.Region, db.Username, sess.Config.Credentials)
+	if err != nil {
+		return "", err
+	}
+
+	replaceSecret(cached.value, token)
+	iamTokens[cacheKey] = cachedToken{value: token, expires: time.Now().Add(iamTokenLifetime)}
+
+	return token, nil
+}
+
+// Get the password to connect with: an IAM token when IAM authentication is
+// enabled, otherwise the configured password
+func (db DatabaseConfig) mysqlPassword() string {
+	if !db.IAMAuth.Enabled {
+		return db.Password.reveal()
+	}
+
+	token, err := db.iamToken()
+	if err != nil {
+		log.Printf("Error generating IAM token for %s: %s\n", db.Host, err.Error())
+	}
+
+	return token
+}
+
+// Build the mysql client arguments IAM authentication needs: the token is
+// sent in clear text, so only over TLS
+func (db DatabaseConfig) iamAuthArgs() []string {
+	if !db.IAMAuth.Enabled {
+		return nil
+	}
+
+	args := []string{"--enable-cleartext-plugin"}
+	if db.TLS.CA != "" {
+		args = append(args, "--ssl-ca="+db.TLS.CA)
+	}
+
+	if strings.Contains(clientVersion(), "MariaDB") {
+		args = append(args, "--ssl")
+	} else if db.TLS.CA != "" {
+		args = append(args, "--ssl-mode=VERIFY_CA")
+	} else {
+		args = append(args, "--ssl-mode=REQUIRED")
+	}
+
+	return args
+}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/rds"
+)
+
+// Hold the settings for the rds_snapshot engine, which takes RDS or Aurora
+// snapshots through the AWS API instead of dumping. Each name is a DB
+// instance identifier, or a cluster identifier when cluster is set.
+type RDSSnapshotConfig struct {
+	Region  string `yaml:"region"`
+	Cluster bool   `yaml:"cluster"`
+
+	// How long to wait for a snapshot to become available, defaults to "2h"
+	Timeout string `yaml:"timeout"`
+
+	// Delete snapshots taken by this tool after this long, e.g. "720h".
+	// Defaults to the primary target's retention.
+	Retention string `yaml:"retention"`
+}
+
+// Tag marking the snapshots taken by this tool, the only ones it prunes
+const rdsManagedTag = "dbbackup:managed"
+
+// Record of a snapshot, written in place of a dump so the archive and report
+// say where the backup is
+type RDSSnapshotRecord struct {
+	Identifier string    `json:"identifier"`
+	ARN        string    `json:"arn"`
+	Source     string    `json:"source"`
+	Cluster    bool      `json:"cluster"`
+	Region     string    `json:"region"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// Take a snapshot of an instance or cluster, wait for it to become available,
+// write its record to file and delete the tool's snapshots of the same source
+// past their retention
+func rdsSnapshot(ctx context.Context, config Config, db DatabaseConfig, source string, file string, trigger string) error {
+	sess, err := session.NewSession(&aws.Config{Region: aws.String(db.RDS.Region)})
+	if err != nil {
+		return fmt.Errorf("error creating AWS session: %w", err)
+	}
+	client := rds.New(sess)
+
+	timeout := 2 * time.Hour
+	if db.RDS.Timeout != "" {
+		timeout, err = parseDuration(db.RDS.Timeout)
+		if err != nil {
+			return err
+		}
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	tags := []*rds.Tag{{Key: aws.String(rdsManagedTag), Value: aws.String("true")}}
+	for key, value := range mergeLabels(config.Labels, db.Labels) {
+		tags = append(tags, &rds.Tag{Key: aws.String(key), Value: aws.String(value)})
+	}
+
+	record := RDSSnapshotRecord{
+		Identifier: fmt.Sprintf("dbbackup-%s-%s", source, clk.Now().UTC().Format("20060102-150405")),
+		Source:     source,
+		Cluster:    db.RDS.Cluster,
+		Region:     db.RDS.Region,
+	}
+
+	log.Printf("Taking RDS snapshot %s of %s\n", record.Identifier, source)
+
+	// The waiter gives up after its attempts run out, so they're left to the timeout
+	waitOptions := []request.WaiterOption{
+		request.WithWaiterMaxAttempts(int(timeout/(30*time.Second)) + 1),
+		request.WithWaiterDelay(request.ConstantWaiterDelay(30 * time.Second)),
+	}
+
+	if db.RDS.Cluster {
+		output, err := client.CreateDBClusterSnapshotWithContext(ctx, &rds.CreateDBClusterSnapshotInput{
+			DBClusterIdentifier:         aws.String(source),
+			DBClusterSnapshotIdentifier: aws.String(record.Identifier),
+			Tags:                        tags,
+		})
+		if err != nil {
+			return fmt.Errorf("error creating snapshot: %w", err)
+		}
+		record.ARN = aws.StringValue(output.DBClusterSnapshot.DBClusterSnapshotArn)
+
+		err = client.WaitUntilDBClusterSnapshotAvailableWithContext(waitCtx, &rds.DescribeDBClusterSnapshotsInput{
+			DBClusterSnapshotIdentifier: aws.String(record.Identifier),
+		}, waitOptions...)
+		if err != nil {
+			return fmt.Errorf("error waiting for snapshot %s: %w", record.Identifier, err)
+		}
+	} else {
+		output, err := client.CreateDBSnapshotWithContext(ctx, &rds.CreateDBSnapshotInput{
+			DBInstanceIdentifier: aws.String(source),
+			DBSnapshotIdentifier: aws.String(record.Identifier),
+			Tags:                 tags,
+		})
+		if err != nil {
+			return fmt.Errorf("error creating snapshot: %w", err)
+		}
+		record.ARN = aws.StringValue(output.DBSnapshot.DBSnapshotArn)
+
+		err = client.WaitUntilDBSnapshotAvailableWithContext(waitCtx, &rds.DescribeDBSnapshotsInput{
+			DBSnapshotIdentifier: aws.String(record.Identifier),
+		}, waitOptions...)
+		if err != nil {
+			return fmt.Errorf("error waiting for snapshot %s: %w", record.Identifier, err)
+		}
+	}
+	record.CreatedAt = clk.Now()
+
+	log.Printf("RDS snapshot %s is available\n", record.Identifier)
+
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.WriteFile(file, data, 0644)
+	if err != nil {
+		return err
+	}
+
+	retention := db.RDS.Retention
+	if retention == "" {
+		retention = config.primaryTarget().Retention
+	}
+	if retention != "" {
+		pruneRDSSnapshots(ctx, config, client, db, source, retention, trigger)
+	}
+
+	return nil
+}
+
+// An RDS snapshot of either kind, for pruning
+type rdsSnapshotInfo struct {
+	identifier string
+	created    time.Time
+	managed    bool
+}
+
+// Delete the snapshots this tool took of a source that are older than the
+// retention, always keeping the newest
+func pruneRDSSnapshots(ctx context.Context, config Config, client *rds.RDS, db DatabaseConfig, source string, retention string, trigger string) {
+	maxAge, err := parseDuration(retention)
+	if err != nil {
+		log.Printf("Error parsing retention: %s\n", err.Error())
+		return
+	}
+
+	snapshots, err := listRDSSnapshots(ctx, client, db.RDS.Cluster, source)
+	if err != nil {
+		log.Printf("Error listing RDS snapshots of %s: %s\n", source, err.Error())
+		return
+	}
+
+	sort.Slice(snapshots, func(i, j int) bool {
+		return snapshots[i].created.After(snapshots[j].created)
+	})
+
+	kept := false
+	for _, snapshot := range snapshots {
+		if !snapshot.managed {
+			continue
+		}
+		if !kept || clk.Now().Sub(snapshot.created) <= maxAge {
+			kept = true
+			continue
+		}
+
+		log.Printf("Deleting RDS snapshot %s\n", snapshot.identifier)
+
+		if db.RDS.Cluster {
+			_, err = client.DeleteDBClusterSnapshotWithContext(ctx, &rds.DeleteDBClusterSnapshotInput{
+				DBClusterSnapshotIdentifier: aws.String(snapshot.identifier),
+			})
+		} else {
+			_, err = client.DeleteDBSnapshotWithContext(ctx, &rds.DeleteDBSnapshotInput{
+				DBSnapshotIdentifier: aws.String(snapshot.identifier),
+			})
+		}
+		if err != nil {
+			log.Printf("Error deleting RDS snapshot %s: %s\n", snapshot.identifier, err.Error())
+		}
+		auditLog(config, "delete_snapshot", snapshot.identifier, trigger, err)
+	}
+}
+
+// List the manual snapshots of an instance or cluster
+func listRDSSnapshots(ctx context.Context, client *rds.RDS, cluster bool, source string) ([]rdsSnapshotInfo, error) {
+	snapshots := []rdsSnapshotInfo{}
+
+	if cluster {
+		err := client.DescribeDBClusterSnapshotsPagesWithContext(ctx, &rds.DescribeDBClusterSnapshotsInput{
+			DBClusterIdentifier: aws.String(source),
+			SnapshotType:        aws.String("manual"),
+		}, func(page *rds.DescribeDBClusterSnapshotsOutput, last bool) bool {
+			for _, snapshot := range page.DBClusterSnapshots {
+				snapshots = append(snapshots, rdsSnapshotInfo{
+					identifier: aws.StringValue(snapshot.DBClusterSnapshotIdentifier),
+					created:    aws.TimeValue(snapshot.SnapshotCreateTime),
+					managed:    hasRDSTag(snapshot.TagList, rdsManagedTag),
+				})
+			}
+			return true
+		})
+		return snapshots, err
+	}
+
+	err := client.DescribeDBSnapshotsPagesWithContext(ctx, &rds.DescribeDBSnapshotsInput{
+		DBInstanceIdentifier: aws.String(source),
+		SnapshotType:         aws.String("manual"),
+	}, func(page *rds.DescribeDBSnapshotsOutput, last bool) bool {
+		for _, snapshot := range page.DBSnapshots {
+			snapshots = append(snapshots, rdsSnapshotInfo{
+				identifier: aws.StringValue(snapshot.DBSnapshotIdentifier),
+				created:    aws.TimeValue(snapshot.SnapshotCreateTime),
+				managed:    hasRDSTag(snapshot.TagList, rdsManagedTag),
+			})
+		}
+		return true
+	})
+	return snapshots, err
+}
+
+// Check whether a snapshot has a tag
+func hasRDSTag(tags []*rds.Tag, key string) bool {
+	for _, tag := range tags {
+		if aws.StringValue(tag.Key) == key {
+			return true
+		}
+	}
+
+	return false
+}
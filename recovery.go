@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Name of the file in reports_dir recording the backup run in progress, left
+// behind when the process crashes or is killed
+const runStateFile = "run_state.json"
+
+// Start of the names recovery reports are saved under in reports_dir
+const recoveryReportPrefix = "recovery_"
+
+// What a backup run in progress has to clean up if it never finishes
+type RunState struct {
+	PID       int       `json:"pid"`
+	Hostname  string    `json:"hostname"`
+	Profile   string    `json:"profile,omitempty"`
+	StartedAt time.Time `json:"started_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+
+	// S3 uploads under way, which leave multipart uploads behind if killed
+	Uploads []StateUpload `json:"uploads,omitempty"`
+}
+
+// An S3 upload under way in a run
+type StateUpload struct {
+	Target    string    `json:"target"`
+	Key       string    `json:"key"`
+	StartedAt time.Time `json:"started_at"`
+}
+
+// What was cleaned up after a crashed run
+type RecoveryReport struct {
+	CrashedRun     RunState  `json:"crashed_run"`
+	RecoveredAt    time.Time `json:"recovered_at"`
+	DeletedFiles   []string  `json:"deleted_files,omitempty"`
+	AbortedUploads []string  `json:"aborted_uploads,omitempty"`
+	Errors         []string  `json:"errors,omitempty"`
+}
+
+// Tracks the state of a run in progress, saving it on every change
+type runStateTracker struct {
+	mutex sync.Mutex
+	state RunState
+	path  string
+}
+
+var (
+	runStatesLock sync.Mutex
+
+	// Runs in progress in this process, by reports_dir
+	runStates = map[string]*runStateTracker{}
+)
+
+// Record that a backup run has started
+func beginRunState(config Config) {
+	hostname, _ := os.Hostname()
+
+	tracker := &runStateTracker{
+		path: filepath.Join(config.ReportsDir, runStateFile),
+		state: RunState{
+			PID:       os.Getpid(),
+			Hostname:  hostname,
+			Profile:   config.profile,
+			StartedAt: clk.Now(),
+		},
+	}
+	tracker.save()
+
+	runStatesLock.Lock()
+	runStates[config.ReportsDir] = tracker
+	runStatesLock.Unlock()
+}
+
+// Record that the backup run has finished, with nothing left to recover
+func endRunState(config Config) {
+	runStatesLock.Lock()
+	tracker := runStates[config.ReportsDir]
+	delete(runStates, config.ReportsDir)
+	runStatesLock.Unlock()
+
+	if tracker != nil {
+		os.Remove(tracker.path)
+	}
+}
+
+// Record an S3 upload starting during the config's run, if one is in
+// progress. The returned function records it finishing.
+func trackUpload(config Config, target TargetConfig, key string) func() {
+	runStatesLock.Lock()
+	tracker := runStates[config.ReportsDir]
+	runStatesLock.Unlock()
+
+	if tracker == nil || target.Type != "s3" {
+		return func() {}
+	}
+
+	upload := StateUpload{Target: target.Name, Key: key, StartedAt: clk.Now()}
+
+	tracker.mutex.Lock()
+	tracker.state.Uploads = append(tracker.state.Uploads, upload)
+	tracker.mutex.Unlock()
+	tracker.save()
+
+	return func() {
+		tracker.mutex.Lock()
+		for i, tracked := range tracker.state.Uploads {
+			if tracked == upload {
+				tracker.state.Uploads = append(tracker.state.Uploads[:i], tracker.state.Uploads[i+1:]...)
+				break
+			}
+		}
+		tracker.mutex.Unlock()
+		tracker.save()
+	}
+}
+
+// Write the state to reports_dir
+func (t *runStateTracker) save() {
+	t.mutex.Lock()
+	t.state.UpdatedAt = clk.Now()
+	data, err := json.MarshalIndent(t.state, "", "  ")
+	t.mutex.Unlock()
+	if err != nil {
+		return
+	}
+
+	// Written whole and renamed, so a crash never leaves it half written
+	err = os.WriteFile(t.path+".tmp", data, 0644)
+	if err == nil {
+		err = os.Rename(t.path+".tmp", t.path)
+	}
+	if err != nil {
+		log.Printf("Error saving run state: %s\n", err.Error())
+	}
+}
+
+// Clean up after a run that crashed or was killed, found from the state it
+// left in reports_dir: delete the dumps and archives it was writing and abort
+// its unfinished multipart uploads. State left by a process that's still
+// running, or on another host, is left alone.
+func recoverCrashedRun(ctx context.Context, config Config) *RecoveryReport {
+	path := filepath.Join(config.ReportsDir, runStateFile)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+
+	state := RunState{}
+	if err := json.Unmarshal(data, &state); err != nil {
+		log.Printf("Removing unreadable run state %s: %s\n", path, err.Error())
+		os.Remove(path)
+		return nil
+	}
+
+	hostname, _ := os.Hostname()
+	if state.Hostname != hostname {
+		log.Printf("Run state in %s is from %s, leaving it for that host to recover\n", path, state.Hostname)
+		return nil
+	}
+	if state.PID != os.Getpid() && processAlive(state.PID) {
+		return nil
+	}
+
+	log.Printf("Recovering from a backup run started %s by process %d that didn't finish\n", state.StartedAt.Format(time.RFC3339), state.PID)
+	report := &RecoveryReport{CrashedRun: state, RecoveredAt: clk.Now()}
+
+	report.DeletedFiles, report.Errors = deleteRunFiles(config, state.StartedAt)
+	for _, file := range report.DeletedFiles {
+		auditLog(config, "recover_delete_local", file, "recovery", nil)
+	}
+
+	for _, upload := range state.Uploads {
+		aborted, err := abortRunUploads(ctx, config, upload)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("error aborting uploads of %s on %s: %s", upload.Key, upload.Target, err.Error()))
+		}
+		report.AbortedUploads = append(report.AbortedUploads, aborted...)
+	}
+
+	log.Printf("Recovered: deleted %d files and aborted %d multipart uploads, with %d errors\n", len(report.DeletedFiles), len(report.AbortedUploads), len(report.Errors))
+	for _, message := range report.Errors {
+		log.Println(message)
+	}
+
+	saveRecoveryReport(ctx, config, report)
+	os.Remove(path)
+
+	return report
+}
+
+// Delete what a run started at started was writing: everything in dump_dir,
+// and the archives in temp_dir, written since
+func deleteRunFiles(config Config, started time.Time) ([]string, []string) {
+	deleted, errs := []string{}, []string{}
+
+	clean := func(dir string, match func(string) bool) {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			return
+		}
+
+		for _, entry := range entries {
+			if !match(entry.Name()) {
+				continue
+			}
+
+			info, err := entry.Info()
+			if err != nil || info.ModTime().Before(started) {
+				continue
+			}
+
+			path := filepath.Join(dir, entry.Name())
+			err = os.RemoveAll(path)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("error deleting %s: %s", path, err.Error()))
+				continue
+			}
+			deleted = append(deleted, path)
+		}
+	}
+
+	clean(config.DumpDir, func(string) bool { return true })
+	clean(config.TempDir, isStagingFile)
+
+	return deleted, errs
+}
+
+// Abort the multipart uploads of a key the crashed run was uploading,
+// returning the keys aborted
+func abortRunUploads(ctx context.Context, config Config, upload StateUpload) ([]string, error) {
+	var target *TargetConfig
+	for _, candidate := range config.targets() {
+		if candidate.Name == upload.Target && candidate.Type == "s3" {
+			target = &candidate
+			break
+		}
+	}
+	if target == nil {
+		return nil, fmt.Errorf("target is no longer configured")
+	}
+
+	sess, err := target.session()
+	if err != nil {
+		return nil, err
+	}
+	client := s3.New(sess)
+
+	// Uploads of the same key started before the run aren't the run's
+	stale := []*s3.MultipartUpload{}
+	err = client.ListMultipartUploadsPagesWithContext(ctx, &s3.ListMultipartUploadsInput{
+		Bucket: aws.String(target.Bucket),
+		Prefix: aws.String(upload.Key),
+	}, func(page *s3.ListMultipartUploadsOutput, last bool) bool {
+		for _, multipart := range page.Uploads {
+			if aws.StringValue(multipart.Key) == upload.Key && !aws.TimeValue(multipart.Initiated).Before(upload.StartedAt.Add(-time.Minute)) {
+				stale = append(stale, multipart)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	aborted := []string{}
+	for _, multipart := range stale {
+		_, err := client.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(target.Bucket),
+			Key:      multipart.Key,
+			UploadId: multipart.UploadId,
+		})
+		auditLog(config, "recover_abort_upload", target.Name+":"+upload.Key, "recovery", err)
+		if err != nil {
+			return aborted, err
+		}
+		aborted = append(aborted, target.Name+":"+upload.Key)
+	}
+
+	return aborted, nil
+}
+
+// Save a recovery report to reports_dir, mirroring it to the catalog
+func saveRecoveryReport(ctx context.Context, config Config, report *RecoveryReport) {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Printf("Error encoding recovery report: %s\n", err.Error())
+		return
+	}
+
+	path := filepath.Join(config.ReportsDir, fmt.Sprintf("%s%s.json", recoveryReportPrefix, report.RecoveredAt.UTC().Format("2006-01-02T15-04-05Z")))
+	err = os.WriteFile(path, data, 0644)
+	if err != nil {
+		log.Printf("Error saving recovery report: %s\n", err.Error())
+		return
+	}
+
+	mirrorReport(ctx, config, path)
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Evidence of a scheduled verification restore, for disaster recovery audits:
+// what was restored, how long it took and which checks it passed. Written as
+// JSON and as HTML, which prints to PDF, and signed when signing is configured.
+type RehearsalReport struct {
+	Database string     `json:"database"`
+	Host     string     `json:"host"`
+	Engine   string     `json:"engine"`
+	Agent    *AgentInfo `json:"agent,omitempty"`
+
+	// The backup restored, and the dumps applied from it in order
+	BackupTakenAt time.Time       `json:"backup_taken_at"`
+	Steps         []RehearsalStep `json:"steps"`
+
+	StartedAt       time.Time `json:"started_at"`
+	FinishedAt      time.Time `json:"finished_at"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	ApplySeconds    float64   `json:"apply_seconds"`
+	VerifySeconds   float64   `json:"verify_seconds"`
+
+	Success bool             `json:"success"`
+	Error   string           `json:"error,omitempty"`
+	Checks  []RehearsalCheck `json:"checks"`
+	Tables  []TableCheck     `json:"tables,omitempty"`
+}
+
+// A dump applied during a rehearsal
+type RehearsalStep struct {
+	ArchiveKey string `json:"archive_key"`
+	File       string `json:"file"`
+	SizeBytes  int64  `json:"size_bytes"`
+}
+
+// A check made during a rehearsal, with Status "passed", "failed" or "skipped"
+type RehearsalCheck struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// Start of the names rehearsal reports are saved under in reports_dir
+const rehearsalReportPrefix = "rehearsal_"
+
+const rehearsalTemplate = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Restore rehearsal of {{.Database}} on {{.Host}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { border: 1px solid #ccc; padding: 0.3em 0.6em; text-align: left; }
+.passed { color: #080; }
+.failed { color: #b00; }
+.skipped { color: #888; }
+@media print { body { margin: 0; } }
+</style>
+</head>
+<body>
+<h1>Restore rehearsal of {{.Database}} on {{.Host}}</h1>
+
+<table>
+<tr><th>Result</th><td>{{if .Success}}<span class="passed">PASSED</span>{{else}}<span class="failed">FAILED</span> {{.Error}}{{end}}</td></tr>
+<tr><th>Engine</th><td>{{.Engine}}</td></tr>
+<tr><th>Backup taken</th><td>{{.BackupTakenAt.UTC.Format "2006-01-02 15:04:05 MST"}}</td></tr>
+<tr><th>Started</th><td>{{.StartedAt.UTC.Format "2006-01-02 15:04:05 MST"}}</td></tr>
+<tr><th>Finished</th><td>{{.FinishedAt.UTC.Format "2006-01-02 15:04:05 MST"}}</td></tr>
+<tr><th>Duration (s)</th><td>{{printf "%.1f" .DurationSeconds}}, of which {{printf "%.1f" .ApplySeconds}} applying and {{printf "%.1f" .VerifySeconds}} verifying</td></tr>
+{{with .Agent}}<tr><th>Restored by</th><td>{{.Hostname}} ({{.ID}}, {{.OS}}/{{.Arch}})</td></tr>{{end}}
+</table>
+
+<h2>Restored</h2>
+<table>
+<tr><th>Archive</th><th>Dump</th><th>Size (bytes)</th></tr>
+{{range .Steps}}<tr><td>{{.ArchiveKey}}</td><td>{{.File}}</td><td>{{.SizeBytes}}</td></tr>
+{{end}}
+</table>
+
+<h2>Checks</h2>
+<table>
+<tr><th>Check</th><th>Result</th><th>Detail</th></tr>
+{{range .Checks}}<tr><td>{{.Name}}</td><td class="{{.Status}}">{{.Status}}</td><td>{{.Detail}}</td></tr>
+{{end}}
+</table>
+
+{{if .Tables}}
+<h2>Tables</h2>
+<table>
+<tr><th>Table</th><th>Rows</th><th>Rows at backup</th><th>Result</th></tr>
+{{range .Tables}}<tr><td>{{.Table}}</td><td>{{.Rows}}</td>
+<td>{{if .Verified}}{{.ExpectedRows}}{{else}}not recorded{{end}}</td>
+<td>{{if .Error}}<span class="failed">{{.Error}}</span>{{else if .Verified}}<span class="passed">matches</span>{{else}}<span class="skipped">counted</span>{{end}}</td></tr>
+{{end}}
+</table>
+{{end}}
+</body>
+</html>
+`
+
+// Count the rows of a restored database's tables for a rehearsal report when
+// no summaries were recorded to verify them against
+func countRestoredTables(db DatabaseConfig, name string) []TableCheck {
+	summaries, err := tableSummaries(db, name, "")
+	if err != nil {
+		log.Printf("Error counting rows of %s: %s\n", name, err.Error())
+		return nil
+	}
+
+	checks := []TableCheck{}
+	for table, summary := range summaries {
+		checks = append(checks, TableCheck{Table: table, Rows: summary.Rows})
+	}
+	sort.Slice(checks, func(i, j int) bool {
+		return checks[i].Table < checks[j].Table
+	})
+
+	return checks
+}
+
+// List the checks a restore went through and how each went
+func rehearsalChecks(config Config, dbReport *DatabaseReport, force bool, applyErr error, verifyErr error, tables []TableCheck) []RehearsalCheck {
+	checks := []RehearsalCheck{}
+
+	check := func(name string, status string, detail string) {
+		checks = append(checks, RehearsalCheck{Name: name, Status: status, Detail: detail})
+	}
+
+	if config.Signing.enabled() {
+		check("Backup report signature", "passed", "")
+	} else {
+		check("Backup report signature", "skipped", "signing isn't configured")
+	}
+
+	if force {
+		check("Target database empty and server version compatible", "skipped", "--force was given")
+	} else {
+		check("Target database empty and server version compatible", "passed", "")
+	}
+
+	switch {
+	case config.insecureRestore:
+		check("Archive and dump checksums", "skipped", "--insecure was given, mismatches only warn")
+	case applyErr != nil:
+		check("Archive and dump checksums", "failed", "the restore failed before it could be confirmed")
+	default:
+		check("Archive and dump checksums", "passed", "")
+	}
+
+	if applyErr != nil {
+		check("Dumps applied", "failed", applyErr.Error())
+	} else {
+		check("Dumps applied", "passed", "")
+	}
+
+	verified := len(tables) > 0 && tables[0].Verified
+	switch {
+	case applyErr != nil:
+		check("Table row counts match the backup", "skipped", "nothing was restored to check")
+	case verifyErr != nil:
+		check("Table row counts match the backup", "failed", verifyErr.Error())
+	case verified:
+		check("Table row counts match the backup", "passed", fmt.Sprintf("%d tables", len(tables)))
+	default:
+		check("Table row counts match the backup", "skipped", fmt.Sprintf("no table summaries were recorded for %s, set table_summary to verify them", dbReport.Name))
+	}
+
+	return checks
+}
+
+// Write a rehearsal report to reports_dir as JSON and HTML, signing and
+// mirroring both
+func saveRehearsalReport(ctx context.Context, config Config, report RehearsalReport) {
+	base := filepath.Join(config.ReportsDir, fmt.Sprintf("%s%s", rehearsalReportPrefix, report.StartedAt.UTC().Format("2006-01-02T15-04-05Z")))
+
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		log.Printf("Error encoding rehearsal report: %s\n", err.Error())
+		return
+	}
+
+	err = os.WriteFile(base+".json", data, 0644)
+	if err != nil {
+		log.Printf("Error saving rehearsal report: %s\n", err.Error())
+		return
+	}
+
+	file, err := os.Create(base + ".html")
+	if err != nil {
+		log.Printf("Error saving rehearsal report: %s\n", err.Error())
+		return
+	}
+	err = template.Must(template.New("rehearsal").Parse(rehearsalTemplate)).Execute(file, report)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		log.Printf("Error writing rehearsal report: %s\n", err.Error())
+		os.Remove(base + ".html")
+		return
+	}
+
+	for _, path := range []string{base + ".json", base + ".html"} {
+		err = signFile(config, path)
+		if err != nil {
+			log.Printf("Error signing %s: %s\n", path, err.Error())
+		}
+		mirrorReport(ctx, config, path)
+	}
+
+	log.Printf("Saved restore rehearsal report to %s.json and %s.html\n", base, base)
+}
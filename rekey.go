@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Check whether an object's encryption matches the target's settings
+func (target TargetConfig) encryptedWith(head *s3.HeadObjectOutput) bool {
+	if aws.StringValue(head.ServerSideEncryption) != target.ServerSideEncryption {
+		return false
+	}
+
+	return target.KMSKeyID == "" || kmsKeyMatches(aws.StringValue(head.SSEKMSKeyId), target.KMSKeyID)
+}
+
+// Check whether the KMS key S3 reports for an object is a configured one. S3
+// reports the key as an ARN, so a configured key ID matches its ARN too.
+func kmsKeyMatches(current string, configured string) bool {
+	return current == configured || strings.HasSuffix(current, "/"+configured)
+}
+
+// Get the name a file is stored under from its full key on the target
+func (target TargetConfig) name(key string) string {
+	if target.Prefix == "" {
+		return key
+	}
+
+	return strings.TrimPrefix(key, strings.TrimSuffix(target.Prefix, "/")+"/")
+}
+
+// Get the per-database S3 settings each database's own archive was uploaded
+// with, from the run reports, by archive name
+func archiveOverrides(config Config) (map[string]S3Overrides, error) {
+	reports, err := loadReports(config.ReportsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	overrides := map[string]S3Overrides{}
+	for _, report := range reports {
+		for _, db := range report.Databases {
+			if db.ArchiveKey != "" && db.S3 != nil {
+				overrides[db.ArchiveKey] = *db.S3
+			}
+		}
+	}
+
+	return overrides, nil
+}
+
+// Get the settings an object on the target should be encrypted with: its
+// database's own when its report recorded them, or nothing when it's under a
+// KMS key a database is configured with but no report says which
+func (target TargetConfig) rekeyTarget(config Config, name string, head *s3.HeadObjectOutput, overrides map[string]S3Overrides) (TargetConfig, bool) {
+	if o, ok := overrides[name]; ok {
+		return target.withOverrides(o), true
+	}
+
+	current := aws.StringValue(head.SSEKMSKeyId)
+	for _, db := range config.Databases {
+		if current != "" && db.S3.KMSKeyID != "" && kmsKeyMatches(current, db.S3.KMSKeyID) {
+			return target, false
+		}
+	}
+
+	return target, true
+}
+
+// Re-encrypt the backups stored on a target with its configured settings by
+// copying each object over itself, keeping the settings of databases uploaded
+// with their own. Returns how many objects failed.
+func (target TargetConfig) rekey(ctx context.Context, config Config, overrides map[string]S3Overrides, trigger string, dryRun bool) (int, error) {
+	objects, err := target.list(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("error listing %s: %w", target.Name, err)
+	}
+
+	sess, err := target.session()
+	if err != nil {
+		return 0, err
+	}
+
+	client := s3.New(sess)
+	failed := 0
+
+	for _, object := range objects {
+		head, err := client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(target.Bucket),
+			Key:    aws.String(object.Key),
+		})
+		if err != nil {
+			log.Printf("Error checking %s on %s: %s\n", object.Key, target.Name, err.Error())
+			failed++
+			continue
+		}
+
+		want, ok := target.rekeyTarget(config, target.name(object.Key), head, overrides)
+		if !ok {
+			log.Printf("Keeping %s on %s, encrypted with a database's own key\n", object.Key, target.Name)
+			continue
+		}
+		if want.encryptedWith(head) {
+			continue
+		}
+
+		log.Printf("Re-encrypting %s on %s (currently %s)\n", object.Key, target.Name, describeEncryption(head))
+		if dryRun {
+			continue
+		}
+
+		input := want.copyInput(copySource(target.Bucket, object.Key), object.Key)
+		if input.StorageClass == nil {
+			// Keep the class the object already has rather than resetting it to STANDARD
+			input.StorageClass = head.StorageClass
+		}
+		input.MetadataDirective = aws.String(s3.MetadataDirectiveCopy)
+
+		err = copyObject(ctx, client, aws.StringValue(input.CopySource), object.Size, input)
+		auditLog(config, "rekey", target.Name+":"+object.Key, trigger, err)
+		if err != nil {
+			log.Printf("Error re-encrypting %s on %s: %s\n", object.Key, target.Name, err.Error())
+			failed++
+		}
+	}
+
+	return failed, nil
+}
+
+// Read the key ID recorded in an encrypted archive's header
+func archiveKeyID(ctx context.Context, target TargetConfig, key string) (string, error) {
+	body, err := storeFor(target).open(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	header, err := readEncryptionHeader(body)
+	if err != nil {
+		return "", err
+	}
+
+	return header.keyID, nil
+}
+
+// Re-encrypt the passphrase-encrypted archives that don't record
+// encryption.key_id with the current passphrase. Each archive is encrypted
+// once and uploaded to every target holding it, so the copies stay identical,
+// and the checksums in the reports are updated. Returns how many failed.
+func rekeyPassphrase(ctx context.Context, config Config, targets []TargetConfig, overrides map[string]S3Overrides, trigger string, dryRun bool) int {
+	failed := 0
+	holders := map[string][]TargetConfig{}
+	stale := map[string]bool{}
+
+	for _, target := range targets {
+		objects, err := storeFor(target).list(ctx)
+		if err != nil {
+			log.Printf("Error listing %s: %s\n", target.Name, err.Error())
+			failed++
+			continue
+		}
+
+		for _, object := range objects {
+			if !strings.HasSuffix(object.Key, encryptedExtension) {
+				continue
+			}
+			name := target.name(object.Key)
+			holders[name] = append(holders[name], target)
+
+			keyID, err := archiveKeyID(ctx, target, object.Key)
+			if err != nil {
+				log.Printf("Error reading %s on %s: %s\n", object.Key, target.Name, err.Error())
+				failed++
+				continue
+			}
+			if keyID != config.Encryption.KeyID {
+				log.Printf("Re-encrypting %s on %s (currently key %q)\n", object.Key, target.Name, keyID)
+				stale[name] = true
+			}
+		}
+	}
+
+	names := []string{}
+	for name := range stale {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if dryRun {
+			continue
+		}
+
+		err := reencryptArchive(ctx, config, holders[name], overrides[name], name, trigger)
+		if err != nil {
+			log.Printf("Error re-encrypting %s: %s\n", name, err.Error())
+			failed++
+		}
+	}
+
+	return failed
+}
+
+// Decrypt an archive from the first target holding it, encrypt it again with
+// the current passphrase and upload it over every copy
+func reencryptArchive(ctx context.Context, config Config, holders []TargetConfig, overrides S3Overrides, name string, trigger string) error {
+	keys, err := decryptionKeys(config)
+	if err != nil {
+		return err
+	}
+
+	out, err := os.CreateTemp(config.TempDir, "rekey_*_"+path.Base(name))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	body, err := storeFor(holders[0]).open(ctx, holders[0].key(name))
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+
+	plain, err := newDecryptingReader(body, keys)
+	if err != nil {
+		return err
+	}
+
+	encrypted, err := newEncryptingWriter(out, config.Encryption.Passphrase.reveal(), config.Encryption.KeyID)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(encrypted, plain); err != nil {
+		return err
+	}
+	if err := encrypted.Close(); err != nil {
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+
+	for _, target := range holders {
+		err := target.withOverrides(overrides).upload(ctx, config, out.Name(), name, false)
+		auditLog(config, "rekey", target.Name+":"+target.key(name), trigger, err)
+		if err != nil {
+			return fmt.Errorf("error uploading to %s: %w", target.Name, err)
+		}
+	}
+
+	checksum, err := fileSHA256(out.Name())
+	if err != nil {
+		return err
+	}
+
+	return recordRekeyedArchive(config, name, checksum, fileSize(out.Name()))
+}
+
+// Update the checksums of a re-encrypted archive in the reports that refer to
+// it, so restores can still verify it
+func recordRekeyedArchive(config Config, name string, checksum string, size int64) error {
+	files, err := loadReportFiles(config.ReportsDir)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		report := file.Report
+		changed := false
+
+		if report.ArchiveKey == name {
+			report.ArchiveSHA256 = checksum
+			report.ArchiveSizeBytes = size
+			for i := range report.Targets {
+				if report.Targets[i].SHA256 != "" {
+					report.Targets[i].SHA256 = checksum
+				}
+			}
+			changed = true
+		}
+		for i, db := range report.Databases {
+			if db.ArchiveKey == name {
+				report.Databases[i].ArchiveSHA256 = checksum
+				changed = true
+			}
+		}
+
+		if !changed {
+			continue
+		}
+
+		err := writeReport(&report, file.Path)
+		if err != nil {
+			return err
+		}
+		err = signFile(config, file.Path)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Describe how an object is encrypted for logging
+func describeEncryption(head *s3.HeadObjectOutput) string {
+	if head.ServerSideEncryption == nil {
+		return "unencrypted"
+	}
+
+	if head.SSEKMSKeyId != nil {
+		return fmt.Sprintf("%s with %s", *head.ServerSideEncryption, *head.SSEKMSKeyId)
+	}
+
+	return *head.ServerSideEncryption
+}
+
+// Re-encrypt existing backups after the KMS key or encryption passphrase is
+// rotated. Usage: rekey [--dry-run]
+func runRekey(ctx context.Context, config Config, args []string) error {
+	flags := flag.NewFlagSet("rekey", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only list the objects that would be re-encrypted")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	overrides, err := archiveOverrides(config)
+	if err != nil {
+		return err
+	}
+
+	failed := 0
+
+	targets := config.targets()
+	for i, replica := range config.Replicas {
+		if replica.Name == "" {
+			replica.Name = fmt.Sprintf("replica-%d", i+1)
+		}
+		replica.Type = "s3"
+		targets = append(targets, replica)
+	}
+
+	for _, target := range targets {
+		if target.Type != "s3" {
+			continue
+		}
+
+		if target.ServerSideEncryption == "" {
+			log.Printf("Skipping %s, no server_side_encryption configured\n", target.Name)
+			continue
+		}
+
+		n, err := target.rekey(ctx, config, overrides, commandTrigger(), *dryRun)
+		if err != nil {
+			return err
+		}
+		failed += n
+	}
+
+	if config.encryptArchives() {
+		if config.Encryption.KeyID == "" {
+			log.Println("Skipping passphrase-encrypted archives, set encryption.key_id to re-encrypt them")
+		} else {
+			failed += rekeyPassphrase(ctx, config, targets, overrides, commandTrigger(), *dryRun)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d objects could not be re-encrypted", failed)
+	}
+
+	return nil
+}
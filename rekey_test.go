@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+func TestRekeyKeepsDatabaseKeys(t *testing.T) {
+	target := TargetConfig{Name: "s3", Type: "s3", S3Overrides: S3Overrides{ServerSideEncryption: "aws:kms", KMSKeyID: "global"}}
+	config := Config{Databases: []DatabaseConfig{{DBName: "billing", S3: S3Overrides{KMSKeyID: "billing"}}}}
+	overrides := map[string]S3Overrides{"sql_backup_at_x_shop.tar.gz": {KMSKeyID: "shop"}}
+
+	head := func(key string) *s3.HeadObjectOutput {
+		return &s3.HeadObjectOutput{ServerSideEncryption: aws.String("aws:kms"), SSEKMSKeyId: aws.String("arn:aws:kms:eu-west-1:1:key/" + key)}
+	}
+
+	// Recorded in the report: rekeyed with the database's key, not the target's
+	want, ok := target.rekeyTarget(config, "sql_backup_at_x_shop.tar.gz", head("old-shop"), overrides)
+	if !ok || want.KMSKeyID != "shop" || want.encryptedWith(head("old-shop")) || !want.encryptedWith(head("shop")) {
+		t.Errorf("shop's archive would be rekeyed with %+v, %v", want, ok)
+	}
+
+	// Under a database's configured key, with no report saying so: left alone
+	if _, ok := target.rekeyTarget(config, "sql_backup_at_y_billing.tar.gz", head("billing"), overrides); ok {
+		t.Error("billing's archive would be rekeyed with the target's key")
+	}
+
+	want, ok = target.rekeyTarget(config, "sql_backup_at_z.tar.gz", head("old-global"), overrides)
+	if !ok || want.KMSKeyID != "global" {
+		t.Errorf("run archive would be rekeyed with %+v, %v", want, ok)
+	}
+}
+
+func TestRekeyPassphrase(t *testing.T) {
+	config := Config{
+		TempDir:    t.TempDir(),
+		ReportsDir: t.TempDir(),
+		Encryption: EncryptionConfig{
+			Passphrase:     "current",
+			KeyID:          "2026",
+			OldPassphrases: []EncryptionKey{{KeyID: "2025", Passphrase: "previous"}},
+		},
+		Targets: []TargetConfig{
+			{Name: "local", Type: "local", Path: t.TempDir()},
+			{Name: "offsite", Type: "local", Path: t.TempDir(), Prefix: "host1"},
+		},
+	}
+
+	old := backupNamePrefix + "old.tar.gz.enc"
+	current := backupNamePrefix + "current.tar.gz.enc"
+	oldArchive := encryptTestDataWithKeyID(t, []byte("old dump"), "previous", "2025")
+	currentArchive := encryptTestDataWithKeyID(t, []byte("current dump"), "current", "2026")
+
+	for _, target := range config.Targets {
+		dir := filepath.Join(target.Path, target.Prefix)
+		os.MkdirAll(dir, 0755)
+		os.WriteFile(filepath.Join(dir, old), oldArchive, 0644)
+		os.WriteFile(filepath.Join(dir, current), currentArchive, 0644)
+	}
+	writeTestReport(t, config.ReportsDir, RunReport{StartedAt: time.Now(), ArchiveKey: old, ArchiveSHA256: "stale"})
+
+	if err := runRekey(context.Background(), config, []string{"--dry-run"}); err != nil {
+		t.Fatal(err)
+	}
+	data, _ := os.ReadFile(filepath.Join(config.Targets[0].Path, old))
+	if !bytes.Equal(data, oldArchive) {
+		t.Fatal("dry run re-encrypted the archive")
+	}
+
+	if err := runRekey(context.Background(), config, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	copies := [][]byte{}
+	for _, target := range config.Targets {
+		dir := filepath.Join(target.Path, target.Prefix)
+
+		data, _ := os.ReadFile(filepath.Join(dir, old))
+		header, err := readEncryptionHeader(bytes.NewReader(data))
+		if err != nil || header.keyID != "2026" {
+			t.Errorf("%s on %s has key %q, %v", old, target.Name, header.keyID, err)
+		}
+		if plain := decryptTestData(t, data, testKeys("current")); string(plain) != "old dump" {
+			t.Errorf("%s on %s decrypted to %q", old, target.Name, plain)
+		}
+		copies = append(copies, data)
+
+		if data, _ := os.ReadFile(filepath.Join(dir, current)); !bytes.Equal(data, currentArchive) {
+			t.Errorf("%s on %s was re-encrypted though it has the current key", current, target.Name)
+		}
+	}
+	if !bytes.Equal(copies[0], copies[1]) {
+		t.Error("the copies on each target differ")
+	}
+
+	reports, err := loadReports(config.ReportsDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checksum, _ := fileSHA256(filepath.Join(config.Targets[0].Path, old))
+	if reports[0].ArchiveSHA256 != checksum || reports[0].ArchiveSizeBytes != int64(len(copies[0])) {
+		t.Errorf("report records %s (%d bytes), want %s", reports[0].ArchiveSHA256, reports[0].ArchiveSizeBytes, checksum)
+	}
+}
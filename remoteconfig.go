@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Environment variables pointing an agent at a central configuration server
+// instead of a local file. The fetched configuration is cached so the agent
+// still starts with the last one it saw while the server is unreachable.
+const (
+	remoteConfigURLVariable     = "DBBACKUP_CONFIG_URL"
+	remoteConfigTokenVariable   = "DBBACKUP_CONFIG_TOKEN"
+	remoteConfigCacheVariable   = "DBBACKUP_CONFIG_CACHE"
+	remoteConfigRefreshVariable = "DBBACKUP_CONFIG_REFRESH"
+)
+
+// Get where the fetched configuration is cached, by default beside where the
+// local configuration file would be
+func remoteConfigCache(configPath string) string {
+	if path := os.Getenv(remoteConfigCacheVariable); path != "" {
+		return path
+	}
+
+	return filepath.Join(filepath.Dir(configPath), ".dbbackup-remote-config.yaml")
+}
+
+// Fetch the configuration from the central server, identifying the agent by
+// its host name and version so the server can register it and pick its
+// configuration. The response may be YAML, JSON or TOML.
+func fetchRemoteConfig(ctx context.Context) ([]byte, error) {
+	url := os.Getenv(remoteConfigURLVariable)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if token := os.Getenv(remoteConfigTokenVariable); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	hostname, _ := os.Hostname()
+	req.Header.Set("X-Dbbackup-Agent", hostname)
+	req.Header.Set("X-Dbbackup-Version", version)
+	if profile := os.Getenv("DBBACKUP_PROFILE"); profile != "" {
+		req.Header.Set("X-Dbbackup-Profile", profile)
+	}
+
+	client := http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %s from %s", resp.Status, url)
+	}
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	format := strings.ToLower(filepath.Ext(req.URL.Path))
+	if mediaType, _, err := mime.ParseMediaType(resp.Header.Get("Content-Type")); err == nil {
+		switch mediaType {
+		case "application/json":
+			format = ".json"
+		case "application/toml":
+			format = ".toml"
+		}
+	}
+
+	data, err = toYAML(data, format)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing configuration from %s: %w", url, err)
+	}
+
+	// A broken configuration mustn't replace the cached one
+	err = decodeStrict(data, &Config{})
+	if err != nil {
+		return nil, fmt.Errorf("error parsing configuration from %s: %w", url, err)
+	}
+
+	return data, nil
+}
+
+// Get the central configuration, caching it on success and falling back to
+// the cached copy when the server can't be reached
+func readRemoteConfig(configPath string) ([]byte, error) {
+	cache := remoteConfigCache(configPath)
+
+	data, err := fetchRemoteConfig(context.Background())
+	if err == nil {
+		// The configuration holds credentials, so only the agent may read it
+		writeErr := os.WriteFile(cache, data, 0600)
+		if writeErr != nil {
+			log.Printf("Error caching configuration: %s\n", writeErr.Error())
+		}
+		return data, nil
+	}
+
+	cached, cacheErr := os.ReadFile(cache)
+	if cacheErr != nil {
+		return nil, fmt.Errorf("error fetching configuration: %w, and no cached copy: %s", err, cacheErr.Error())
+	}
+
+	log.Printf("Error fetching configuration, using the cached copy from %s: %s\n", cache, err.Error())
+	return cached, nil
+}
+
+// Check the central server for a changed configuration every refresh
+// interval, closing the returned channel when it changes. Never closed when
+// no server or interval is set.
+func watchRemoteConfig(ctx context.Context, configPath string) <-chan struct{} {
+	changed := make(chan struct{})
+
+	refresh := os.Getenv(remoteConfigRefreshVariable)
+	if os.Getenv(remoteConfigURLVariable) == "" || refresh == "" {
+		return changed
+	}
+
+	interval, err := parseDuration(refresh)
+	if err != nil || interval <= 0 {
+		log.Printf("Invalid %s %q, not checking for configuration changes\n", remoteConfigRefreshVariable, refresh)
+		return changed
+	}
+
+	current, _ := os.ReadFile(remoteConfigCache(configPath))
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+
+			data, err := fetchRemoteConfig(ctx)
+			if err != nil {
+				log.Printf("Error checking for configuration changes: %s\n", err.Error())
+				continue
+			}
+			if bytes.Equal(data, current) {
+				continue
+			}
+
+			log.Println("Central configuration changed")
+			close(changed)
+			return
+		}
+	}()
+
+	return changed
+}
+
+// Replace the process with a fresh copy of itself, which loads the new
+// configuration from the server
+func restartProcess() error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	return syscall.Exec(executable, os.Args, os.Environ())
+}
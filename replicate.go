@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Objects larger than this must be copied in parts
+const maxSingleCopySize = 5 * 1024 * 1024 * 1024
+
+// Size of each part when copying large objects
+const copyPartSize = 1024 * 1024 * 1024
+
+// Copy an object server-side, in parts if it's too large for a single copy.
+// The destination settings are taken from the copy input.
+func copyObject(ctx context.Context, client *s3.S3, source string, size int64, input *s3.CopyObjectInput) error {
+	if size <= maxSingleCopySize {
+		_, err := client.CopyObjectWithContext(ctx, input)
+		return err
+	}
+
+	upload, err := client.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:               input.Bucket,
+		Key:                  input.Key,
+		StorageClass:         input.StorageClass,
+		ServerSideEncryption: input.ServerSideEncryption,
+		SSEKMSKeyId:          input.SSEKMSKeyId,
+		ACL:                  input.ACL,
+	})
+	if err != nil {
+		return err
+	}
+
+	parts := []*s3.CompletedPart{}
+
+	for offset, number := int64(0), int64(1); offset < size; offset, number = offset+copyPartSize, number+1 {
+		end := offset + copyPartSize - 1
+		if end >= size {
+			end = size - 1
+		}
+
+		part, err := client.UploadPartCopyWithContext(ctx, &s3.UploadPartCopyInput{
+			Bucket:          input.Bucket,
+			Key:             input.Key,
+			UploadId:        upload.UploadId,
+			PartNumber:      aws.Int64(number),
+			CopySource:      aws.String(source),
+			CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", offset, end)),
+		})
+		if err != nil {
+			// Not tied to ctx, so the upload is still cleaned up after cancellation
+			client.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+				Bucket:   input.Bucket,
+				Key:      input.Key,
+				UploadId: upload.UploadId,
+			})
+			return err
+		}
+
+		parts = append(parts, &s3.CompletedPart{
+			ETag:       part.CopyPartResult.ETag,
+			PartNumber: aws.Int64(number),
+		})
+	}
+
+	_, err = client.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          input.Bucket,
+		Key:             input.Key,
+		UploadId:        upload.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+
+	return err
+}
+
+// Get the source of a server-side copy. S3 decodes a "+" in it as a space, so
+// the offsets in timestamped keys are escaped too.
+func copySource(bucket string, key string) string {
+	return bucket + "/" + strings.ReplaceAll((&url.URL{Path: key}).EscapedPath(), "+", "%2B")
+}
+
+// Copy an object from the primary bucket to a replica bucket server-side, using
+// the replica's credentials. Those credentials need read access to the source.
+func replicateObject(ctx context.Context, config Config, replica TargetConfig, key string, size int64) error {
+	sess, err := replica.session()
+	if err != nil {
+		return err
+	}
+
+	source := copySource(config.S3Config.Bucket, key)
+
+	return copyObject(ctx, s3.New(sess), source, size, replica.copyInput(source, replica.key(key)))
+}
+
+// Copy the uploaded archive to every configured replica bucket
+func replicateArchive(ctx context.Context, config Config, key string, size int64) []TargetReport {
+	reports := []TargetReport{}
+
+	for i, replica := range config.Replicas {
+		if replica.Name == "" {
+			replica.Name = fmt.Sprintf("replica-%d", i+1)
+		}
+
+		log.Printf("Replicating %s to %s\n", key, replica.Name)
+
+		report := TargetReport{Name: replica.Name, Key: replica.key(key), KMSKeyID: replica.KMSKeyID}
+
+		err := replicateObject(ctx, config, replica, key, size)
+		if err != nil {
+			log.Printf("Error replicating %s to %s: %s\n", key, replica.Name, err.Error())
+			report.Error = err.Error()
+		}
+
+		reports = append(reports, report)
+	}
+
+	return reports
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Hold the result of backing up a single database
+type DatabaseReport struct {
+	Engine          string    `json:"engine"`
+	Host            string    `json:"host"`
+	Name            string    `json:"name"`
+	File            string    `json:"file,omitempty"`
+	SizeBytes       int64     `json:"size_bytes"`
+	StartedAt       time.Time `json:"started_at"`
+	DurationSeconds float64   `json:"duration_seconds"`
+	Success         bool      `json:"success"`
+	Error           string    `json:"error,omitempty"`
+	ServerVersion   string    `json:"server_version,omitempty"`
+
+	// How many times the database was dumped, set when it was retried
+	Attempts int `json:"attempts,omitempty"`
+
+	// Set when the dump was bigger than the database's max_size
+	OverBudget string `json:"over_budget,omitempty"`
+
+	// Size of the dump uncompressed and how many times smaller it is (or,
+	// for uncompressed dumps, is estimated to be) compressed. A ratio close to
+	// 1 means the data is already compressed, e.g. images in BLOBs.
+	RawSizeBytes     int64   `json:"raw_size_bytes,omitempty"`
+	CompressionRatio float64 `json:"compression_ratio,omitempty"`
+
+	// The run's labels merged with the database's own
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Names of the notifiers the database's notifications are routed to
+	Notify []string `json:"notify,omitempty"`
+
+	// The group the database was backed up in, with the application paused
+	Group string `json:"group,omitempty"`
+
+	// Set when the dump was uploaded in its own archive rather than the run's
+	ArchiveKey    string `json:"archive_key,omitempty"`
+	ArchiveSHA256 string `json:"archive_sha256,omitempty"`
+
+	// The database's own S3 settings its archive was uploaded with, which
+	// rekey keeps rather than applying the target's
+	S3 *S3Overrides `json:"s3,omitempty"`
+
+	// Of the dump, checked against the extracted dump before it's restored
+	SHA256 string `json:"sha256,omitempty"`
+
+	// Set when change detection is enabled for the database
+	Fingerprint string `json:"fingerprint,omitempty"`
+
+	// Set when differential dumps are enabled for the database. Differentials
+	// only contain the tables changed since their base full dump.
+	Kind              string            `json:"kind,omitempty"`
+	TableFingerprints map[string]string `json:"table_fingerprints,omitempty"`
+	Base              *BackupReference  `json:"base,omitempty"`
+	DroppedTables     []string          `json:"dropped_tables,omitempty"`
+
+	// Set when table summaries are enabled for the database
+	Tables map[string]TableSummary `json:"tables,omitempty"`
+
+	// Set when schema drift reporting is enabled for the database
+	Schema      map[string]string `json:"schema,omitempty"`
+	SchemaDrift []string          `json:"schema_drift,omitempty"`
+
+	// Set when the completeness check found objects missing from the dump
+	MissingObjects []string `json:"missing_objects,omitempty"`
+
+	// Set when tables were exported alongside the dump, or why they couldn't be
+	TableExport      string `json:"table_export,omitempty"`
+	TableExportError string `json:"table_export_error,omitempty"`
+
+	// Set when the database was unchanged and not dumped again
+	Skipped   bool             `json:"skipped,omitempty"`
+	Reference *BackupReference `json:"reference,omitempty"`
+
+	// The database's own archive, set until runDumps has uploaded it
+	upload *separateUpload
+}
+
+// Hold the timing of a single phase of a backup run
+type PhaseReport struct {
+	DurationSeconds float64 `json:"duration_seconds"`
+	Bytes           int64   `json:"bytes"`
+	MBPerSecond     float64 `json:"mb_per_second"`
+}
+
+// Get the phase's throughput in bytes a second, or 0 if it took no time
+func (phase PhaseReport) bytesPerSecond() float64 {
+	if phase.DurationSeconds <= 0 {
+		return 0
+	}
+	return float64(phase.Bytes) / phase.DurationSeconds
+}
+
+// Hold the machine-readable summary of a whole backup run
+type RunReport struct {
+	StartedAt        time.Time               `json:"started_at"`
+	FinishedAt       time.Time               `json:"finished_at"`
+	DurationSeconds  float64                 `json:"duration_seconds"`
+	Success          bool                    `json:"success"`
+	Error            string                  `json:"error,omitempty"`
+	Version          string                  `json:"version,omitempty"`
+	Profile          string                  `json:"profile,omitempty"`
+	Labels           map[string]string       `json:"labels,omitempty"`
+	Agent            *AgentInfo              `json:"agent,omitempty"`
+	OverBudget       string                  `json:"over_budget,omitempty"`
+	Cancelled        bool                    `json:"cancelled,omitempty"`
+	TimedOut         bool                    `json:"timed_out,omitempty"`
+	Skipped          bool                    `json:"skipped,omitempty"`
+	SkipReason       string                  `json:"skip_reason,omitempty"`
+	Bucket           string                  `json:"bucket,omitempty"`
+	ArchiveKey       string                  `json:"archive_key,omitempty"`
+	ArchiveSizeBytes int64                   `json:"archive_size_bytes"`
+	ArchiveSHA256    string                  `json:"archive_sha256,omitempty"`
+	CompressionRatio float64                 `json:"compression_ratio,omitempty"`
+	Uploaded         bool                    `json:"uploaded"`
+	Targets          []TargetReport          `json:"targets,omitempty"`
+	Replicas         []TargetReport          `json:"replicas,omitempty"`
+	Phases           map[string]*PhaseReport `json:"phases,omitempty"`
+	Dedup            *DedupReport            `json:"dedup,omitempty"`
+	Databases        []DatabaseReport        `json:"databases"`
+
+	// Where archives from this run were moved to by tiering, by original key
+	Tiered map[string]string `json:"tiered,omitempty"`
+
+	// The stage made to fail with --simulate-failure, to test alerting
+	Simulated string `json:"simulated_failure,omitempty"`
+
+	// What the run is estimated to cost, when prices are configured
+	Cost *CostReport `json:"cost,omitempty"`
+
+	// The exit code for a run that failed before dumping anything
+	preDumpExit int
+}
+
+// Mark the report as finished and work out the overall result
+func (r *RunReport) finish() {
+	r.FinishedAt = time.Now()
+	r.DurationSeconds = r.FinishedAt.Sub(r.StartedAt).Seconds()
+	r.Success = r.succeeded()
+}
+
+// Work out whether the run succeeded: it uploaded without error, every
+// replica copy worked and every database was backed up
+func (r *RunReport) succeeded() bool {
+	if r.Error != "" || !r.Uploaded {
+		return false
+	}
+	for _, replica := range r.Replicas {
+		if replica.Error != "" {
+			return false
+		}
+	}
+	for _, db := range r.Databases {
+		if !db.Success {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Get the key of the archive holding a database's dump
+func (r *RunReport) archiveFor(db DatabaseReport) string {
+	if db.ArchiveKey != "" {
+		return db.ArchiveKey
+	}
+
+	return r.ArchiveKey
+}
+
+// Record how long a phase took and how many bytes it processed
+func (r *RunReport) recordPhase(name string, started time.Time, bytes int64) {
+	if r.Phases == nil {
+		r.Phases = map[string]*PhaseReport{}
+	}
+
+	phase := &PhaseReport{
+		DurationSeconds: time.Since(started).Seconds(),
+		Bytes:           bytes,
+	}
+
+	if phase.DurationSeconds > 0 {
+		phase.MBPerSecond = float64(bytes) / 1024 / 1024 / phase.DurationSeconds
+	}
+
+	r.Phases[name] = phase
+	log.Printf("Phase %s took %.1fs (%.2f MB/s)\n", name, phase.DurationSeconds, phase.MBPerSecond)
+}
+
+// Write the report as indented JSON to the given path
+func writeReport(report *RunReport, path string) error {
+	data, err := json.MarshalIndent(report, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(path, data, 0644)
+}
+
+// Get the hex encoded SHA-256 of a file
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Get the size of a file (or the total size of a directory), or 0 if it can't be read
+func fileSize(path string) int64 {
+	var size int64
+
+	filepath.Walk(path, func(_ string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			size += info.Size()
+		}
+		return nil
+	})
+
+	return size
+}
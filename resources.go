@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"runtime"
+	"strconv"
+)
+
+// Hold limits on the CPU and disk IO backups may use, so they don't slow down
+// applications sharing the host
+type ResourceLimits struct {
+	// Niceness of dump processes, from -20 to 19. Higher is lower priority.
+	Nice int `yaml:"nice"`
+
+	// IO scheduling class of dump processes, "idle" or "best-effort"
+	IOClass string `yaml:"io_class"`
+
+	// Priority within the best-effort class, from 0 (highest) to 7 (lowest)
+	IOPriority int `yaml:"io_priority"`
+
+	// Maximum CPUs used for compression and uploads
+	MaxProcs int `yaml:"max_procs"`
+}
+
+// ionice class numbers
+var ioClasses = map[string]string{
+	"best-effort": "2",
+	"idle":        "3",
+}
+
+// Command and arguments prepended to dump commands to lower their priority
+var dumpPriority []string
+
+// Apply the configured resource limits to this process and to dump commands
+// started from now on
+func applyResourceLimits(limits ResourceLimits) error {
+	if limits.MaxProcs > 0 {
+		runtime.GOMAXPROCS(limits.MaxProcs)
+	}
+
+	prefix := []string{}
+
+	if limits.IOClass != "" {
+		class, ok := ioClasses[limits.IOClass]
+		if !ok {
+			return fmt.Errorf("unknown io_class %q", limits.IOClass)
+		}
+
+		if _, err := exec.LookPath("ionice"); err != nil {
+			return fmt.Errorf("io_class needs ionice: %w", err)
+		}
+
+		prefix = append(prefix, "ionice", "-c", class)
+		if limits.IOClass == "best-effort" {
+			prefix = append(prefix, "-n", strconv.Itoa(limits.IOPriority))
+		}
+	}
+
+	if limits.Nice != 0 {
+		if _, err := exec.LookPath("nice"); err != nil {
+			return fmt.Errorf("nice needs the nice command: %w", err)
+		}
+
+		prefix = append(prefix, "nice", "-n", strconv.Itoa(limits.Nice))
+	}
+
+	dumpPriority = prefix
+
+	return nil
+}
+
+// Build a dump command, run under nice and ionice when configured
+func dumpCommand(ctx context.Context, name string, args ...string) *exec.Cmd {
+	if len(dumpPriority) == 0 {
+		return exec.CommandContext(ctx, name, args...)
+	}
+
+	wrapped := append([]string{}, dumpPriority[1:]...)
+	wrapped = append(wrapped, name)
+	wrapped = append(wrapped, args...)
+
+	return exec.CommandContext(ctx, dumpPriority[0], wrapped...)
+}
@@ -0,0 +1,733 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Get the key of the report uploaded alongside an archive or dedup index
+func reportKeyFor(archiveKey string) string {
+	name := path.Base(archiveKey)
+	name = strings.TrimSuffix(name, encryptedExtension)
+	name = strings.TrimSuffix(name, ".tar.gz")
+	name = strings.TrimSuffix(name, ".zip")
+	name = strings.TrimSuffix(name, ".json")
+
+	return name + ".report.json"
+}
+
+// Find the run report for an archive, first in the local reports directory and
+// then next to the archive in S3. Its signature is checked when signing is
+// configured.
+func findReport(ctx context.Context, config Config, archiveKey string) (*RunReport, error) {
+	files, err := loadReportFiles(config.ReportsDir)
+	if err == nil {
+		for i, file := range files {
+			found := file.Report.ArchiveKey == archiveKey
+			for _, db := range file.Report.Databases {
+				if db.ArchiveKey == archiveKey {
+					found = true
+				}
+			}
+			if !found {
+				continue
+			}
+
+			if config.Signing.enabled() {
+				err = verifyFile(config, file.Path)
+				if err != nil {
+					return nil, fmt.Errorf("report for %s failed verification: %w", archiveKey, err)
+				}
+			}
+
+			return &files[i].Report, nil
+		}
+	}
+
+	sess, err := newS3Session(config)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := readS3Object(ctx, sess, config.S3Config.Bucket, reportKeyFor(archiveKey))
+	if err != nil {
+		return nil, fmt.Errorf("no report found for %s: %w", archiveKey, err)
+	}
+
+	if config.Signing.enabled() {
+		signature, err := readS3Object(ctx, sess, config.S3Config.Bucket, reportKeyFor(archiveKey)+signatureExtension)
+		if err == nil {
+			err = verifySignature(config, data, signature)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("report for %s failed verification: %w", archiveKey, err)
+		}
+	}
+
+	report := &RunReport{}
+	err = json.Unmarshal(data, report)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing report for %s: %w", archiveKey, err)
+	}
+
+	return report, nil
+}
+
+// Read a whole object from S3
+func readS3Object(ctx context.Context, sess *session.Session, bucket string, key string) ([]byte, error) {
+	output, err := s3.New(sess).GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer output.Body.Close()
+
+	return io.ReadAll(output.Body)
+}
+
+// Find a database in a run report by name, and optionally host
+func findDatabaseReport(report *RunReport, name string, host string) (*DatabaseReport, error) {
+	for i, db := range report.Databases {
+		if db.Name == name && (host == "" || db.Host == host) {
+			return &report.Databases[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("database %s not found in backup %s", name, report.ArchiveKey)
+}
+
+// Work out the dumps that need applying, in order, to restore a database from
+// the given archive. Unchanged databases follow their reference to the actual
+// dump, and differentials are preceded by their base full dump.
+func restoreChain(ctx context.Context, config Config, archiveKey string, name string, host string) ([]BackupReference, *DatabaseReport, error) {
+	report, err := findReport(ctx, config, archiveKey)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	db, err := findDatabaseReport(report, name, host)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if !db.Success {
+		return nil, nil, fmt.Errorf("backup of %s in %s did not succeed", name, archiveKey)
+	}
+
+	if db.Kind == "table_export" {
+		return nil, nil, fmt.Errorf("backup of %s in %s only exported tables, there's no dump to restore", name, archiveKey)
+	}
+
+	if db.Skipped && db.Reference != nil {
+		return restoreChain(ctx, config, db.Reference.ArchiveKey, name, db.Host)
+	}
+
+	step := BackupReference{
+		Engine:     db.Engine,
+		Host:       db.Host,
+		Name:       db.Name,
+		ArchiveKey: report.archiveFor(*db),
+		File:       db.File,
+		size:       db.SizeBytes,
+		sha256:     db.SHA256,
+	}
+	if db.ArchiveKey == "" {
+		step.archiveSize = report.ArchiveSizeBytes
+		step.archiveSHA256 = report.ArchiveSHA256
+	} else {
+		step.archiveSHA256 = db.ArchiveSHA256
+	}
+
+	if db.Kind == "differential" && db.Base != nil {
+		chain, _, err := restoreChain(ctx, config, db.Base.ArchiveKey, name, db.Host)
+		if err != nil {
+			return nil, nil, fmt.Errorf("error finding base full dump: %w", err)
+		}
+
+		return append(chain, step), db, nil
+	}
+
+	return []BackupReference{step}, db, nil
+}
+
+// Download an archive from S3 into the temp directory
+func downloadArchive(ctx context.Context, config Config, key string, dest string) error {
+	sess, err := newS3Session(config)
+	if err != nil {
+		return err
+	}
+
+	// Archives moved to cold storage need retrieving before they can be downloaded
+	if tieredKey := tieredLocation(config, key); tieredKey != "" {
+		log.Printf("%s was moved to %s\n", key, tieredKey)
+
+		err = ensureRetrieved(ctx, config, s3.New(sess), tieredKey)
+		if err != nil {
+			return err
+		}
+		key = tieredKey
+	}
+
+	return resumableDownload(ctx, config, s3.New(sess), config.S3Config.Bucket, key, dest, sizeLimit(config.MaxDownloadRate))
+}
+
+// Get where an archive entry goes when extracting the named file or directory,
+// or "" if it isn't part of it. Entries that would land outside dest, like
+// "dir/../../etc/cron.d/x", are an error.
+func extractPath(entry string, name string, dest string) (string, error) {
+	name = strings.TrimSuffix(name, "/")
+
+	for _, prefix := range []string{path.Base(filepath.ToSlash(name)), name} {
+		if entry == prefix {
+			return dest, nil
+		}
+		if strings.HasPrefix(entry, prefix+"/") {
+			out := filepath.Join(dest, filepath.FromSlash(strings.TrimPrefix(entry, prefix+"/")))
+
+			rel, err := filepath.Rel(dest, out)
+			if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) || filepath.IsAbs(rel) {
+				return "", fmt.Errorf("archive entry %s would be extracted outside %s", entry, dest)
+			}
+
+			return out, nil
+		}
+	}
+
+	return "", nil
+}
+
+// Create a file to extract into, along with its directory
+func createExtracted(path string) (*os.File, error) {
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.Create(path)
+}
+
+// Extract a single file, or a directory of files, from a tar.gz archive
+func extractFromArchive(archive string, name string, dest string) error {
+	file, err := os.Open(archive)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	gr, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	defer gr.Close()
+
+	tr := tar.NewReader(gr)
+	found := false
+
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		// Older archives kept the backups/ prefix on entry names
+		path, err := extractPath(header.Name, name, dest)
+		if err != nil {
+			return err
+		}
+		if path == "" {
+			continue
+		}
+
+		out, err := createExtracted(path)
+		if err != nil {
+			return err
+		}
+
+		_, err = io.Copy(out, tr)
+		out.Close()
+		if err != nil {
+			return err
+		}
+
+		found = true
+	}
+
+	if !found {
+		return fmt.Errorf("%s not found in archive", name)
+	}
+
+	return nil
+}
+
+// Reassemble a single file, or a directory of files, from the chunks of a
+// deduplicated backup
+func extractFromRepository(ctx context.Context, config Config, indexKey string, name string, dest string) error {
+	sess, err := newS3Session(config)
+	if err != nil {
+		return err
+	}
+
+	client := s3.New(sess)
+
+	output, err := client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(config.S3Config.Bucket),
+		Key:    aws.String(indexKey),
+	})
+	if err != nil {
+		return err
+	}
+
+	index := BackupIndex{}
+	err = json.NewDecoder(output.Body).Decode(&index)
+	output.Body.Close()
+	if err != nil {
+		return err
+	}
+
+	found := false
+
+	for _, indexFile := range index.Files {
+		path, err := extractPath(indexFile.Name, name, dest)
+		if err != nil {
+			return err
+		}
+		if path == "" {
+			continue
+		}
+
+		err = extractChunks(ctx, client, config, indexFile.Chunks, path)
+		if err != nil {
+			return err
+		}
+
+		found = true
+	}
+
+	if !found {
+		return fmt.Errorf("%s not found in index %s", name, indexKey)
+	}
+
+	return nil
+}
+
+// Write the chunks making up a file in a deduplicated backup to a local path
+func extractChunks(ctx context.Context, client *s3.S3, config Config, chunks []string, path string) error {
+	out, err := createExtracted(path)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	for _, hash := range chunks {
+		chunk, err := client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(config.S3Config.Bucket),
+			Key:    aws.String(chunkKey(config.Dedup.Prefix, hash)),
+		})
+		if err != nil {
+			return fmt.Errorf("error downloading chunk %s: %w", hash, err)
+		}
+
+		gr, err := gzip.NewReader(chunk.Body)
+		if err == nil {
+			_, err = io.Copy(out, gr)
+		}
+		chunk.Body.Close()
+
+		if err != nil {
+			return fmt.Errorf("error reading chunk %s: %w", hash, err)
+		}
+	}
+
+	return nil
+}
+
+// Fetch a single dump file out of a backup into the temp directory
+func fetchBackupFile(ctx context.Context, config Config, ref BackupReference, archives map[string]string) (string, error) {
+	dest := filepath.Join(config.TempDir, "restore_"+path.Base(ref.File))
+
+	encrypted := strings.HasSuffix(ref.ArchiveKey, encryptedExtension)
+	key := strings.TrimSuffix(ref.ArchiveKey, encryptedExtension)
+
+	isZip := strings.HasSuffix(key, ".zip")
+	if !isZip && !strings.HasSuffix(key, ".tar.gz") {
+		err := extractFromRepository(ctx, config, ref.ArchiveKey, ref.File, dest)
+		if err == nil {
+			err = verifyChecksum(config, path.Base(ref.File), dest, ref.sha256, dumpSHA256)
+		}
+		return dest, err
+	}
+
+	archive, ok := archives[ref.ArchiveKey]
+	if !ok {
+		archive = filepath.Join(config.TempDir, "restore_"+path.Base(key))
+
+		download := archive
+		if encrypted {
+			download += encryptedExtension
+		}
+
+		log.Printf("Downloading %s\n", ref.ArchiveKey)
+		err := downloadArchive(ctx, config, ref.ArchiveKey, download)
+		if err == nil {
+			err = verifyChecksum(config, ref.ArchiveKey, download, ref.archiveSHA256, fileSHA256)
+		}
+		if err != nil {
+			os.Remove(download)
+			return "", fmt.Errorf("error downloading %s: %w", ref.ArchiveKey, err)
+		}
+
+		if encrypted {
+			log.Printf("Decrypting %s\n", ref.ArchiveKey)
+			err = decryptFile(config, download, archive)
+			os.Remove(download)
+			if err != nil {
+				return "", fmt.Errorf("error decrypting %s: %w", ref.ArchiveKey, err)
+			}
+		}
+
+		archives[ref.ArchiveKey] = archive
+	}
+
+	err := verifyManifest(config, archive, isZip, ref)
+	if err != nil {
+		return "", err
+	}
+
+	if isZip {
+		err = extractFromZip(archive, ref.File, dest)
+	} else {
+		err = extractFromArchive(archive, ref.File, dest)
+	}
+	if err == nil {
+		err = verifyChecksum(config, path.Base(ref.File), dest, ref.sha256, dumpSHA256)
+	}
+
+	return dest, err
+}
+
+// Find the configured database entry to connect to for a restore
+func findDatabaseConfig(config Config, engine string, host string, name string) (DatabaseConfig, error) {
+	for _, db := range config.Databases {
+		if db.Engine != engine || db.Host != host {
+			continue
+		}
+
+		if db.DBName == name {
+			return db, nil
+		}
+
+		for _, dbName := range db.DBNames {
+			if dbName == name {
+				return db, nil
+			}
+		}
+	}
+
+	return DatabaseConfig{}, fmt.Errorf("no configured %s database %s on host %s", engine, name, host)
+}
+
+// Apply a SQL dump to a database with the mysql client. Parallel dumps are a
+// directory, with up to parallel_tables of its tables applied at once.
+// Progress is recorded in tracker and statements throttled when given.
+func applyMySQLDump(ctx context.Context, db DatabaseConfig, name string, dumpFile string, tracker *restoreTracker, throttle *restoreThrottle) error {
+	if info, err := os.Stat(dumpFile); err == nil && info.IsDir() {
+		return applyParallelDump(ctx, db, name, dumpFile, tracker, throttle)
+	}
+	if len(db.restoreTables) > 0 {
+		return fmt.Errorf("%s isn't split per table, so single tables can't be restored from it", filepath.Base(dumpFile))
+	}
+
+	file, err := os.Open(dumpFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	args := mysqlConnectionArgs(db)
+	if db.MaxAllowedPacket != "" {
+		args = append(args, "--max-allowed-packet="+db.MaxAllowedPacket)
+	}
+	if name != "*" {
+		args = append(args, name)
+	}
+
+	// Bytes are counted before decompression to match the sizes in the report
+	dump := tracker.count(file)
+	if strings.HasSuffix(dumpFile, ".gz") {
+		gr, err := gzip.NewReader(dump)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		dump = gr
+	}
+
+	cmd := exec.CommandContext(ctx, "mysql", args...)
+	cmd.Env = mysqlEnv(db)
+	cmd.Stdin = throttle.reader(ctx, tracker.tables(dump))
+
+	output, err := commandCombinedOutput(cmd)
+	if err != nil {
+		return fmt.Errorf("%w: %s", err, strings.TrimSpace(string(output)))
+	}
+
+	return nil
+}
+
+// Restore a database from a backup. Usage: restore [--plan [--json]] [--force] [--snapshot] [--parallel N]
+// [--max-statements-per-second N] [--sleep-per-chunk 10ms] [--max-download-rate 10M]
+// <archive-key> <database> [host]
+func runRestore(ctx context.Context, config Config, args []string) error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	force := flags.Bool("force", false, "restore into a database that isn't empty or a server of a different version")
+	parallel := flags.Int("parallel", 0, "apply this many tables of a parallel dump at once, defaults to parallel_tables")
+	maxStatements := flags.Int("max-statements-per-second", 0, "apply at most this many statements a second, to spare replication and IO on a live server")
+	chunkSleep := flags.String("sleep-per-chunk", "", "pause for this long after each statement, i.e. each insert chunk, e.g. 10ms")
+	plan := flags.Bool("plan", false, "list what would be applied and where, without changing anything")
+	asJSON := flags.Bool("json", false, "output the --plan as JSON")
+	downloadRate := flags.String("max-download-rate", "", "limit downloads to this many bytes a second, e.g. 10M, overriding max_download_rate")
+	snapshot := flags.Bool("snapshot", false, "dump the database to pre-restore/ on the first storage target before restoring over it")
+	canary := flags.Bool("canary", false, "mark this as a scheduled verification restore in its record and metrics, and write a signed rehearsal report")
+	tables := flags.String("tables", "", "comma-separated tables to restore from a split or parallel dump, leaving the rest of the database alone (needs --force if it has other tables)")
+	insecure := flags.Bool("insecure", false, "restore even when the archive or dump has no recorded checksum or doesn't match it")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	args = flags.Args()
+
+	if len(args) < 2 {
+		return fmt.Errorf("usage: dbbackup restore [flags] <archive-key> <database> [host]")
+	}
+	config.insecureRestore = *insecure
+
+	sleep := time.Duration(0)
+	if *chunkSleep != "" {
+		sleep, err = parseDuration(*chunkSleep)
+		if err != nil || sleep < 0 {
+			return fmt.Errorf("invalid --sleep-per-chunk %q", *chunkSleep)
+		}
+	}
+	throttle := newRestoreThrottle(*maxStatements, sleep)
+
+	if *downloadRate != "" {
+		if _, err := parseSize(*downloadRate); err != nil {
+			return fmt.Errorf("invalid --max-download-rate %q", *downloadRate)
+		}
+		config.MaxDownloadRate = *downloadRate
+	}
+
+	// Recovery time counts from here, including downloads and checks
+	started := time.Now()
+
+	archiveKey, name := args[0], args[1]
+	host := ""
+	if len(args) > 2 {
+		host = args[2]
+	}
+
+	// The database may only be listed in the inventory
+	config, err = withInventory(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	chain, dbReport, err := restoreChain(ctx, config, archiveKey, name, host)
+	if err != nil {
+		return err
+	}
+
+	if dbReport.Engine != "mysql" && dbReport.Engine != "mariadb" {
+		return fmt.Errorf("restoring %s databases is not supported", dbReport.Engine)
+	}
+
+	db, err := findDatabaseConfig(config, dbReport.Engine, dbReport.Host, name)
+	if err != nil {
+		return err
+	}
+
+	// Restore to the current primary when the database is discovered
+	if db.Discovery.enabled() {
+		instances, err := db.discover(ctx)
+		if err != nil {
+			return err
+		}
+		db = instances[0]
+	}
+
+	if *parallel > 0 {
+		db.ParallelTables = *parallel
+	}
+	if *tables != "" {
+		db.restoreTables = strings.Split(*tables, ",")
+	}
+
+	if *plan {
+		restorePlan, err := planRestore(ctx, config, db, name, chain, dbReport)
+		if err != nil {
+			return err
+		}
+
+		if *asJSON {
+			return writeRestorePlanJSON(os.Stdout, restorePlan)
+		}
+		printRestorePlan(os.Stdout, restorePlan)
+		return nil
+	}
+
+	err = checkRestore(config, db, name, chain, dbReport, *force)
+	if err != nil {
+		return err
+	}
+
+	if *snapshot {
+		key, err := takeSafetySnapshot(ctx, config, db, name)
+		if err != nil {
+			return fmt.Errorf("error taking safety snapshot, not restoring: %w", err)
+		}
+		if key != "" {
+			log.Printf("Saved the current %s to %s, apply it with mysql to undo the restore\n", name, key)
+		}
+	}
+
+	tracker := newRestoreTracker(config, name, db.Host, chain)
+	stopProgress := tracker.watch(config.progressInterval())
+	applyStarted := time.Now()
+	applyErr := applyRestoreChain(ctx, config, db, name, chain, tracker, throttle)
+	applied := time.Now()
+	stopProgress()
+	tracker.finish(applyErr)
+
+	var verifyErr error
+	var tableChecks []TableCheck
+	if applyErr == nil {
+		log.Printf("Restored %s on host %s\n", name, db.Host)
+
+		if len(dbReport.Tables) > 0 && name != "*" {
+			expected := dbReport.Tables
+			if len(db.restoreTables) > 0 {
+				expected = map[string]TableSummary{}
+				for _, table := range db.restoreTables {
+					if summary, ok := dbReport.Tables[table]; ok {
+						expected[table] = summary
+					}
+				}
+			}
+			tableChecks, verifyErr = verifyTableSummaries(db, name, expected)
+		} else if *canary && name != "*" {
+			tableChecks = countRestoredTables(db, name)
+		}
+	}
+
+	err = applyErr
+	if err == nil {
+		err = verifyErr
+	}
+
+	progress := tracker.snapshot()
+	record := RestoreRecord{
+		Database:        name,
+		Host:            db.Host,
+		ArchiveKey:      progress.ArchiveKey,
+		Canary:          *canary,
+		Success:         err == nil,
+		StartedAt:       started,
+		Steps:           progress.Steps,
+		Bytes:           progress.BytesApplied,
+		DurationSeconds: time.Since(started).Seconds(),
+	}
+	if err != nil {
+		record.Error = err.Error()
+	}
+	saveRestoreRecord(ctx, config, record)
+
+	// Scheduled verification restores leave evidence for DR audits
+	if *canary {
+		rehearsal := RehearsalReport{
+			Database:        name,
+			Host:            db.Host,
+			Engine:          dbReport.Engine,
+			Agent:           config.agentInfo(),
+			BackupTakenAt:   dbReport.StartedAt,
+			StartedAt:       started,
+			FinishedAt:      time.Now(),
+			DurationSeconds: record.DurationSeconds,
+			ApplySeconds:    applied.Sub(applyStarted).Seconds(),
+			VerifySeconds:   time.Since(applied).Seconds(),
+			Success:         record.Success,
+			Error:           record.Error,
+			Checks:          rehearsalChecks(config, dbReport, *force, applyErr, verifyErr, tableChecks),
+			Tables:          tableChecks,
+		}
+		for _, step := range chain {
+			rehearsal.Steps = append(rehearsal.Steps, RehearsalStep{ArchiveKey: step.ArchiveKey, File: step.File, SizeBytes: step.size})
+		}
+		saveRehearsalReport(ctx, config, rehearsal)
+	}
+
+	return err
+}
+
+// Fetch and apply each dump in a restore chain in turn
+func applyRestoreChain(ctx context.Context, config Config, db DatabaseConfig, name string, chain []BackupReference, tracker *restoreTracker, throttle *restoreThrottle) error {
+	archives := map[string]string{}
+	defer func() {
+		for _, archive := range archives {
+			os.Remove(archive)
+		}
+	}()
+
+	// Dumps of single databases don't create them, so restores to a fresh
+	// server would fail
+	if name != "*" {
+		if err := createDatabase(db, name); err != nil {
+			return err
+		}
+	}
+
+	for i, step := range chain {
+		log.Printf("Applying %s from %s to %s on host %s\n", step.File, step.ArchiveKey, name, db.Host)
+		tracker.startStep(i, step)
+
+		dumpFile, err := fetchBackupFile(ctx, config, step, archives)
+		if err == nil {
+			dumpFile, err = decryptDump(config, dumpFile)
+		}
+		if err != nil {
+			return err
+		}
+
+		err = applyMySQLDump(ctx, db, name, dumpFile, tracker, throttle)
+		os.RemoveAll(dumpFile)
+
+		auditLog(config, "restore", fmt.Sprintf("%s:%s -> %s/%s", step.ArchiveKey, step.File, db.Host, name), commandTrigger(), err)
+
+		if err != nil {
+			return fmt.Errorf("error applying %s: %w", step.File, err)
+		}
+	}
+
+	return nil
+}
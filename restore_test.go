@@ -0,0 +1,107 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"context"
+	"errors"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRestoreCreatesTheDatabase(t *testing.T) {
+	fake := newFakeCommands()
+	runner = fake
+	defer func() { runner = systemCommands{} }()
+
+	if err := createDatabase(DatabaseConfig{Host: "db1", Port: 3306}, "shop`s"); err != nil {
+		t.Fatal(err)
+	}
+
+	ran := fake.commandsRun()
+	if len(ran) != 1 || ran[0][len(ran[0])-1] != "--execute=CREATE DATABASE IF NOT EXISTS `shop``s`" {
+		t.Errorf("ran %q", ran)
+	}
+	for _, arg := range ran[0] {
+		if strings.HasPrefix(arg, "--database") {
+			t.Errorf("connected to a default database with %s, which may not exist", arg)
+		}
+	}
+}
+
+func TestRestoreChainCreatesTheDatabaseFirst(t *testing.T) {
+	fake := newFakeCommands()
+	fake.errs["mysql"] = errors.New("access denied")
+	runner = fake
+	defer func() { runner = systemCommands{} }()
+
+	chain := []BackupReference{{ArchiveKey: "sql_backup_at_x.tar.gz", File: "shop.sql"}}
+	err := applyRestoreChain(context.Background(), Config{}, DatabaseConfig{Host: "db1"}, "shop", chain, nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "error creating shop") {
+		t.Errorf("restore returned %v, want the database creation to fail first", err)
+	}
+}
+
+func TestHelpIsNotAFailure(t *testing.T) {
+	err := runRestore(context.Background(), Config{}, []string{"--help"})
+	if !errors.Is(err, flag.ErrHelp) {
+		t.Fatalf("restore --help returned %v", err)
+	}
+	if code := exitCode(err); code != exitOK {
+		t.Errorf("restore --help exits %d", code)
+	}
+
+	if code := exitCode(withExitCode(exitConfig, flag.ErrHelp)); code != exitOK {
+		t.Errorf("wrapped --help exits %d", code)
+	}
+	if code := exitCode(withExitCode(exitConfig, errors.New("bad flag"))); code != exitConfig {
+		t.Errorf("bad flag exits %d", code)
+	}
+}
+
+// Write a tar.gz archive of the named files
+func writeTestArchive(t *testing.T, path string, files map[string]string) {
+	t.Helper()
+
+	out, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	gw := gzip.NewWriter(out)
+	tw := tar.NewWriter(gw)
+	for name, content := range files {
+		tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content))})
+		tw.Write([]byte(content))
+	}
+	tw.Close()
+	gw.Close()
+}
+
+func TestExtractRejectsEntriesOutsideDest(t *testing.T) {
+	dir := t.TempDir()
+	dest := filepath.Join(dir, "restore", "shop")
+	archive := filepath.Join(dir, "crafted.tar.gz")
+
+	writeTestArchive(t, archive, map[string]string{"shop/../../cron.d/x": "* * * * * root sh -c evil\n"})
+
+	err := extractFromArchive(archive, "shop", dest)
+	if err == nil || !strings.Contains(err.Error(), "outside") {
+		t.Errorf("extracting a crafted archive returned %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "cron.d", "x")); !os.IsNotExist(err) {
+		t.Errorf("crafted entry was written outside the destination: %v", err)
+	}
+
+	writeTestArchive(t, archive, map[string]string{"shop/tables/users.sql": "CREATE TABLE users;\n"})
+	if err := extractFromArchive(archive, "shop", dest); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dest, "tables", "users.sql")); string(data) != "CREATE TABLE users;\n" {
+		t.Errorf("extracted %q", data)
+	}
+}
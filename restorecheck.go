@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// Count the tables in a MySQL or MariaDB database
+func countTables(db DatabaseConfig, name string) (int, error) {
+	output, err := mysqlQuery(db, "", fmt.Sprintf("SELECT COUNT(*) FROM information_schema.TABLES WHERE TABLE_SCHEMA = %s", quoteString(name)))
+	if err != nil {
+		return 0, err
+	}
+
+	return strconv.Atoi(strings.TrimSpace(output))
+}
+
+// Check a MySQL or MariaDB database has no tables, so a restore can't
+// silently merge into or overwrite existing data
+func checkEmpty(db DatabaseConfig, name string) error {
+	count, err := countTables(db, name)
+	if err != nil {
+		return fmt.Errorf("error checking %s is empty: %w", name, err)
+	}
+
+	if count > 0 {
+		return fmt.Errorf("%s on %s already has %d tables, use --force to restore over them", name, db.Host, count)
+	}
+
+	return nil
+}
+
+// Create a MySQL or MariaDB database to restore into if it doesn't exist, as
+// on a freshly built server
+func createDatabase(db DatabaseConfig, name string) error {
+	_, err := mysqlQuery(db, "", "CREATE DATABASE IF NOT EXISTS "+quoteIdentifier(name))
+	if err != nil {
+		return fmt.Errorf("error creating %s: %w", name, err)
+	}
+
+	return nil
+}
+
+// Check a dump taken from one server version can be applied to another. Dumps
+// can't go to an older server (8.0 collations don't exist in 5.7, for
+// instance), or between MySQL and MariaDB.
+func checkServerVersion(source string, target string) error {
+	sourceMariaDB := strings.Contains(strings.ToLower(source), "mariadb")
+	targetMariaDB := strings.Contains(strings.ToLower(target), "mariadb")
+
+	if sourceMariaDB != targetMariaDB {
+		return fmt.Errorf("backup is from %s but the target server is %s, use --force to restore anyway", source, target)
+	}
+
+	sourceMajor, sourceMinor := parseVersion(source)
+	targetMajor, targetMinor := parseVersion(target)
+
+	if targetMajor < sourceMajor || (targetMajor == sourceMajor && targetMinor < sourceMinor) {
+		return fmt.Errorf("backup is from %s but the target server is older (%s), use --force to restore anyway", source, target)
+	}
+
+	return nil
+}
+
+// Estimate the temp disk space a restore needs: every archive downloaded
+// (they're kept until the restore finishes) plus the largest extracted dump
+func restoreSpaceNeeded(chain []BackupReference) int64 {
+	archives := map[string]int64{}
+	var largest int64
+
+	for _, step := range chain {
+		if key := strings.TrimSuffix(step.ArchiveKey, encryptedExtension); strings.HasSuffix(key, ".tar.gz") || strings.HasSuffix(key, ".zip") {
+			size := step.archiveSize
+			if size == 0 {
+				// Archives of a single database are roughly the size of the dump
+				size = step.size
+			}
+			archives[step.ArchiveKey] = size
+		}
+
+		if step.size > largest {
+			largest = step.size
+		}
+	}
+
+	needed := largest
+	for _, size := range archives {
+		needed += size
+	}
+
+	return needed
+}
+
+// Check a restore is safe to start. Without force, the target database must
+// be empty and its server able to take the dump. There must always be room
+// in the temp directory.
+func checkRestore(config Config, db DatabaseConfig, name string, chain []BackupReference, dbReport *DatabaseReport, force bool) error {
+	needed := restoreSpaceNeeded(chain)
+	free, err := freeSpace(config.TempDir)
+	if err != nil {
+		log.Printf("Error checking free space in %s: %s\n", config.TempDir, err.Error())
+	} else if free < needed {
+		return fmt.Errorf("restore needs about %s in %s but only %s is free", formatBytes(needed), config.TempDir, formatBytes(free))
+	}
+
+	if force {
+		return nil
+	}
+
+	if name != "*" {
+		err = checkEmpty(db, name)
+		if err != nil {
+			return err
+		}
+	}
+
+	if dbReport.ServerVersion != "" {
+		target, err := mysqlServerVersion(db)
+		if err != nil {
+			return fmt.Errorf("error checking server version of %s: %w", db.Host, err)
+		}
+
+		err = checkServerVersion(dbReport.ServerVersion, target)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Outcome of a finished restore, kept in reports_dir (and the catalog when
+// mirrored) to track how long recovery actually takes over time
+type RestoreRecord struct {
+	Database   string    `json:"database"`
+	Host       string    `json:"host"`
+	ArchiveKey string    `json:"archive_key"`
+	Canary     bool      `json:"canary,omitempty"`
+	Success    bool      `json:"success"`
+	Error      string    `json:"error,omitempty"`
+	StartedAt  time.Time `json:"started_at"`
+	Steps      int       `json:"steps"`
+	Bytes      int64     `json:"bytes"`
+
+	// From the start of the restore command, including downloads and checks
+	DurationSeconds float64 `json:"duration_seconds"`
+}
+
+// Start of the names restore records are saved under
+const restoreRecordPrefix = "restore_run_"
+
+// Save a restore's record to reports_dir, mirroring it to the catalog
+func saveRestoreRecord(ctx context.Context, config Config, record RestoreRecord) {
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		log.Printf("Error encoding restore record: %s\n", err.Error())
+		return
+	}
+
+	path := filepath.Join(config.ReportsDir, fmt.Sprintf("%s%s.json", restoreRecordPrefix, record.StartedAt.UTC().Format("2006-01-02T15-04-05Z")))
+	err = os.WriteFile(path, data, 0644)
+	if err != nil {
+		log.Printf("Error saving restore record: %s\n", err.Error())
+		return
+	}
+
+	mirrorReport(ctx, config, path)
+}
+
+// Load every restore record from reports_dir, newest first
+func loadRestoreRecords(dir string) ([]RestoreRecord, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, restoreRecordPrefix+"*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	records := []RestoreRecord{}
+	for _, path := range paths {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+
+		record := RestoreRecord{}
+		if json.Unmarshal(data, &record) == nil {
+			records = append(records, record)
+		}
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		return records[i].StartedAt.After(records[j].StartedAt)
+	})
+
+	return records, nil
+}
+
+// Render the latest restore of each database, and of each database's canary
+// restores separately, in the Prometheus text exposition format
+func renderRestoreMetrics(records []RestoreRecord) string {
+	latest := []RestoreRecord{}
+	seen := map[string]bool{}
+	for _, record := range records {
+		key := fmt.Sprintf("%s|%s|%t", record.Host, record.Database, record.Canary)
+		if !seen[key] {
+			seen[key] = true
+			latest = append(latest, record)
+		}
+	}
+
+	var b strings.Builder
+
+	labels := func(record RestoreRecord) string {
+		return fmt.Sprintf("host=\"%s\",database=\"%s\",canary=\"%t\"", escapeLabel(record.Host), escapeLabel(record.Database), record.Canary)
+	}
+
+	fmt.Fprintln(&b, "# HELP dbbackup_restore_duration_seconds Duration of the most recent restore of each database, from start to verified.")
+	fmt.Fprintln(&b, "# TYPE dbbackup_restore_duration_seconds gauge")
+	for _, record := range latest {
+		fmt.Fprintf(&b, "dbbackup_restore_duration_seconds{%s} %f\n", labels(record), record.DurationSeconds)
+	}
+
+	fmt.Fprintln(&b, "# HELP dbbackup_restore_bytes Bytes of dumps applied by the most recent restore of each database.")
+	fmt.Fprintln(&b, "# TYPE dbbackup_restore_bytes gauge")
+	for _, record := range latest {
+		fmt.Fprintf(&b, "dbbackup_restore_bytes{%s} %d\n", labels(record), record.Bytes)
+	}
+
+	fmt.Fprintln(&b, "# HELP dbbackup_restore_success Whether the most recent restore of each database succeeded.")
+	fmt.Fprintln(&b, "# TYPE dbbackup_restore_success gauge")
+	for _, record := range latest {
+		success := 0
+		if record.Success {
+			success = 1
+		}
+		fmt.Fprintf(&b, "dbbackup_restore_success{%s} %d\n", labels(record), success)
+	}
+
+	fmt.Fprintln(&b, "# HELP dbbackup_restore_timestamp_seconds Start time of the most recent restore of each database.")
+	fmt.Fprintln(&b, "# TYPE dbbackup_restore_timestamp_seconds gauge")
+	for _, record := range latest {
+		fmt.Fprintf(&b, "dbbackup_restore_timestamp_seconds{%s} %d\n", labels(record), record.StartedAt.Unix())
+	}
+
+	return b.String()
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// What a restore would do, for sign-off before running it
+type RestorePlan struct {
+	ArchiveKey      string            `json:"archive_key"`
+	Database        string            `json:"database"`
+	SourceHost      string            `json:"source_host"`
+	SourceVersion   string            `json:"source_version,omitempty"`
+	Target          RestorePlanTarget `json:"target"`
+	Steps           []RestorePlanStep `json:"steps"`
+	BytesTotal      int64             `json:"bytes_total"`
+	TempSpaceNeeded int64             `json:"temp_space_needed"`
+
+	// Checks that would stop the restore without --force
+	Problems []string `json:"problems,omitempty"`
+}
+
+// The server a restore would be applied to
+type RestorePlanTarget struct {
+	Host           string `json:"host"`
+	Address        string `json:"address"`
+	ServerVersion  string `json:"server_version,omitempty"`
+	ExistingTables int    `json:"existing_tables"`
+}
+
+// A single dump in the restore chain, with the statements it holds per table
+type RestorePlanStep struct {
+	ArchiveKey string                    `json:"archive_key"`
+	File       string                    `json:"file"`
+	SizeBytes  int64                     `json:"size_bytes"`
+	Tables     map[string]map[string]int `json:"tables"`
+}
+
+// Work out what restoring the chain to db would do. The dumps are downloaded
+// and read, but nothing is applied.
+func planRestore(ctx context.Context, config Config, db DatabaseConfig, name string, chain []BackupReference, dbReport *DatabaseReport) (RestorePlan, error) {
+	plan := RestorePlan{
+		ArchiveKey:      chain[len(chain)-1].ArchiveKey,
+		Database:        name,
+		SourceHost:      dbReport.Host,
+		SourceVersion:   dbReport.ServerVersion,
+		Target:          RestorePlanTarget{Host: db.Host, Address: db.hostPort()},
+		TempSpaceNeeded: restoreSpaceNeeded(chain),
+	}
+
+	version, err := mysqlServerVersion(db)
+	if err != nil {
+		return plan, fmt.Errorf("error checking server version of %s: %w", db.Host, err)
+	}
+	plan.Target.ServerVersion = version
+
+	if name != "*" {
+		plan.Target.ExistingTables, err = countTables(db, name)
+		if err != nil {
+			return plan, fmt.Errorf("error checking %s for tables: %w", name, err)
+		}
+	}
+
+	err = checkRestore(config, db, name, chain, dbReport, false)
+	if err != nil {
+		plan.Problems = append(plan.Problems, err.Error())
+	}
+
+	archives := map[string]string{}
+	defer func() {
+		for _, archive := range archives {
+			os.Remove(archive)
+		}
+	}()
+
+	for _, step := range chain {
+		dumpFile, err := fetchBackupFile(ctx, config, step, archives)
+		if err != nil {
+			return plan, err
+		}
+
+		files := []string{dumpFile}
+		if info, err := os.Stat(dumpFile); err == nil && info.IsDir() {
+			files, err = parallelDumpFiles(dumpFile)
+			if err != nil {
+				os.RemoveAll(dumpFile)
+				return plan, err
+			}
+		}
+
+		tables := map[string]map[string]int{}
+		for _, file := range files {
+			err = countStatements(file, tables)
+			if err != nil {
+				break
+			}
+		}
+		os.RemoveAll(dumpFile)
+		if err != nil {
+			return plan, fmt.Errorf("error reading %s: %w", step.File, err)
+		}
+
+		plan.Steps = append(plan.Steps, RestorePlanStep{ArchiveKey: step.ArchiveKey, File: step.File, SizeBytes: step.size, Tables: tables})
+		plan.BytesTotal += step.size
+	}
+
+	return plan, nil
+}
+
+// Count the statements of each class in a SQL dump, by the table mysqldump
+// notes before them. Statements before any table are listed under "".
+func countStatements(dumpFile string, tables map[string]map[string]int) error {
+	file, err := os.Open(dumpFile)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	var dump io.Reader = file
+	if strings.HasSuffix(dumpFile, ".gz") {
+		gr, err := gzip.NewReader(file)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		dump = gr
+	}
+
+	reader := bufio.NewReaderSize(dump, 64*1024)
+	table := ""
+	lineStart := true
+	inStatement := false
+
+	for {
+		// Only the start and end of each line matter, and extended inserts
+		// can be far longer than the buffer
+		line, err := reader.ReadSlice('\n')
+		if lineStart && len(line) > 0 && !inStatement {
+			if name, ok := dumpObjectName(line); ok {
+				table = name
+			} else if class := statementClass(line); class != "" {
+				if tables[table] == nil {
+					tables[table] = map[string]int{}
+				}
+				tables[table][class]++
+				inStatement = true
+			}
+		}
+
+		lineStart = err != bufio.ErrBufferFull
+		if lineStart && inStatement {
+			inStatement = !bytes.HasSuffix(bytes.TrimSpace(line), []byte(";"))
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil && err != bufio.ErrBufferFull {
+			return err
+		}
+	}
+}
+
+// Get the table or view named by the comment mysqldump writes before its
+// statements, e.g. "-- Dumping data for table `users`"
+func dumpObjectName(line []byte) (string, bool) {
+	if !bytes.HasPrefix(line, []byte("--")) {
+		return "", false
+	}
+
+	for _, marker := range [][]byte{tableMarker, []byte("for view `")} {
+		if i := bytes.Index(line, marker); i >= 0 {
+			name := line[i+len(marker):]
+			if end := bytes.IndexByte(name, '`'); end >= 0 {
+				return string(name[:end]), true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// Get the class of the statement starting a dump line, e.g. "INSERT" or
+// "CREATE TABLE", or "" for comments and continuation lines
+func statementClass(line []byte) string {
+	text := strings.TrimSpace(string(line[:minInt(len(line), 200)]))
+
+	// Version-conditional statements such as /*!50001 CREATE VIEW ... */
+	if strings.HasPrefix(text, "/*!") {
+		text = strings.TrimLeft(text[3:], "0123456789 ")
+		if strings.HasPrefix(text, "SET ") || strings.HasPrefix(text, "SET@") {
+			return ""
+		}
+	} else if text == "" || strings.HasPrefix(text, "--") || strings.HasPrefix(text, "/*") || strings.HasPrefix(text, ")") {
+		return ""
+	}
+
+	words := strings.Fields(strings.ToUpper(text))
+	if len(words) == 0 || !isKeyword(words[0]) {
+		return ""
+	}
+
+	switch words[0] {
+	case "CREATE", "DROP", "ALTER":
+		// Skip modifiers such as ALGORITHM=UNDEFINED and IF EXISTS to reach the object type
+		for _, word := range words[1:] {
+			switch word {
+			case "TABLE", "VIEW", "TRIGGER", "PROCEDURE", "FUNCTION", "EVENT", "DATABASE", "INDEX":
+				return words[0] + " " + word
+			}
+		}
+		return words[0]
+	}
+
+	return words[0]
+}
+
+// Check a word is made of letters only, as statement keywords are
+func isKeyword(word string) bool {
+	for _, c := range word {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+
+	return word != ""
+}
+
+// Get the smaller of two ints
+func minInt(a int, b int) int {
+	if a < b {
+		return a
+	}
+
+	return b
+}
+
+// Write a restore plan as a readable summary
+func printRestorePlan(w io.Writer, plan RestorePlan) {
+	fmt.Fprintf(w, "Restore %s from %s\n", plan.Database, plan.ArchiveKey)
+	if plan.SourceVersion != "" {
+		fmt.Fprintf(w, "  source:  %s (%s)\n", plan.SourceHost, plan.SourceVersion)
+	} else {
+		fmt.Fprintf(w, "  source:  %s\n", plan.SourceHost)
+	}
+	fmt.Fprintf(w, "  target:  %s at %s (%s), %d existing tables\n", plan.Target.Host, plan.Target.Address, plan.Target.ServerVersion, plan.Target.ExistingTables)
+	fmt.Fprintf(w, "  size:    %s to apply, %s of temp space needed\n", formatBytes(plan.BytesTotal), formatBytes(plan.TempSpaceNeeded))
+
+	for _, problem := range plan.Problems {
+		fmt.Fprintf(w, "  problem: %s\n", problem)
+	}
+
+	for i, step := range plan.Steps {
+		fmt.Fprintf(w, "\nStep %d of %d: %s from %s (%s)\n", i+1, len(plan.Steps), step.File, step.ArchiveKey, formatBytes(step.SizeBytes))
+
+		names := []string{}
+		for table := range step.Tables {
+			names = append(names, table)
+		}
+		sort.Strings(names)
+
+		for _, table := range names {
+			classes := []string{}
+			for class, count := range step.Tables[table] {
+				classes = append(classes, fmt.Sprintf("%s x%d", class, count))
+			}
+			sort.Strings(classes)
+
+			label := table
+			if label == "" {
+				label = "(database)"
+			}
+			fmt.Fprintf(w, "  %-30s %s\n", label, strings.Join(classes, ", "))
+		}
+	}
+}
+
+// Write a restore plan as JSON
+func writeRestorePlanJSON(w io.Writer, plan RestorePlan) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(plan)
+}
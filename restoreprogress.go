@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Progress of a restore, logged and written to reports_dir so the API status
+// endpoint can show it
+type RestoreProgress struct {
+	Database     string    `json:"database"`
+	Host         string    `json:"host"`
+	ArchiveKey   string    `json:"archive_key"`
+	Status       string    `json:"status"` // "running", "succeeded" or "failed"
+	Error        string    `json:"error,omitempty"`
+	StartedAt    time.Time `json:"started_at"`
+	UpdatedAt    time.Time `json:"updated_at"`
+	Step         int       `json:"step"`
+	Steps        int       `json:"steps"`
+	File         string    `json:"file"`
+	CurrentTable string    `json:"current_table,omitempty"`
+	BytesApplied int64     `json:"bytes_applied"`
+	BytesTotal   int64     `json:"bytes_total"`
+	ETASeconds   float64   `json:"eta_seconds,omitempty"`
+}
+
+// Name of the file in reports_dir holding the latest restore's progress
+const restoreProgressFile = "restore_progress.json"
+
+// Track the progress of a restore across the dumps in its chain
+type restoreTracker struct {
+	mutex    sync.Mutex
+	progress RestoreProgress
+	path     string
+
+	// Readers of every file applied so far, several at once for parallel dumps
+	readers []*progressReader
+}
+
+// Start tracking a restore of the chain, saving its initial progress
+func newRestoreTracker(config Config, name string, host string, chain []BackupReference) *restoreTracker {
+	tracker := &restoreTracker{
+		path: filepath.Join(config.ReportsDir, restoreProgressFile),
+		progress: RestoreProgress{
+			Database:   name,
+			Host:       host,
+			ArchiveKey: chain[len(chain)-1].ArchiveKey,
+			Status:     "running",
+			StartedAt:  time.Now(),
+			Steps:      len(chain),
+		},
+	}
+
+	for _, step := range chain {
+		tracker.progress.BytesTotal += step.size
+	}
+
+	tracker.save()
+
+	return tracker
+}
+
+// Record that the next dump in the chain is being applied
+func (t *restoreTracker) startStep(index int, step BackupReference) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.progress.Step = index + 1
+	t.progress.File = step.File
+	t.progress.CurrentTable = ""
+}
+
+// Count the bytes read from a dump file as they're applied
+func (t *restoreTracker) count(file io.Reader) io.Reader {
+	if t == nil {
+		return file
+	}
+
+	reader := &progressReader{reader: file}
+
+	t.mutex.Lock()
+	t.readers = append(t.readers, reader)
+	t.mutex.Unlock()
+
+	return reader
+}
+
+// Follow the table being applied from the comments mysqldump writes before each
+func (t *restoreTracker) tables(dump io.Reader) io.Reader {
+	if t == nil {
+		return dump
+	}
+
+	return &tableReader{reader: dump, tracker: t}
+}
+
+// Set the table being applied
+func (t *restoreTracker) setTable(table string) {
+	if t == nil {
+		return
+	}
+
+	t.mutex.Lock()
+	t.progress.CurrentTable = table
+	t.mutex.Unlock()
+}
+
+// Update the byte counts and estimate, returning a copy of the progress
+func (t *restoreTracker) snapshot() RestoreProgress {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	applied := int64(0)
+	for _, reader := range t.readers {
+		applied += reader.bytesRead()
+	}
+
+	t.progress.BytesApplied = applied
+	t.progress.UpdatedAt = time.Now()
+	t.progress.ETASeconds = 0
+
+	elapsed := time.Since(t.progress.StartedAt).Seconds()
+	if applied > 0 && t.progress.BytesTotal > applied && t.progress.Status == "running" {
+		t.progress.ETASeconds = float64(t.progress.BytesTotal-applied) / (float64(applied) / elapsed)
+	}
+
+	return t.progress
+}
+
+// Write the progress to reports_dir
+func (t *restoreTracker) save() RestoreProgress {
+	progress := t.snapshot()
+
+	data, err := json.MarshalIndent(progress, "", "  ")
+	if err == nil {
+		err = os.WriteFile(t.path, data, 0644)
+	}
+	if err != nil {
+		log.Printf("Error writing restore progress %s: %s\n", t.path, err.Error())
+	}
+
+	return progress
+}
+
+// Log and save the progress every interval until the returned stop function is called
+func (t *restoreTracker) watch(interval time.Duration) func() {
+	if interval <= 0 {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				progress := t.save()
+				line := "Restoring " + progress.Database
+				if progress.Steps > 1 {
+					line += " (" + progress.File + ")"
+				}
+				if progress.CurrentTable != "" {
+					line += ", table " + progress.CurrentTable
+				}
+
+				if progress.BytesTotal > 0 {
+					log.Printf("%s: %s of %s (%.1f%%), about %s left\n", line, formatBytes(progress.BytesApplied), formatBytes(progress.BytesTotal),
+						float64(progress.BytesApplied)/float64(progress.BytesTotal)*100, (time.Duration(progress.ETASeconds) * time.Second).String())
+				} else {
+					log.Printf("%s: %s applied\n", line, formatBytes(progress.BytesApplied))
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+	}
+}
+
+// Record how the restore ended
+func (t *restoreTracker) finish(err error) {
+	t.mutex.Lock()
+	t.progress.Status = "succeeded"
+	if err != nil {
+		t.progress.Status = "failed"
+		t.progress.Error = err.Error()
+	}
+	t.mutex.Unlock()
+
+	t.save()
+}
+
+// Read the latest restore's progress from reports_dir, or nil if there is none
+func loadRestoreProgress(dir string) *RestoreProgress {
+	data, err := os.ReadFile(filepath.Join(dir, restoreProgressFile))
+	if err != nil {
+		return nil
+	}
+
+	progress := &RestoreProgress{}
+	if json.Unmarshal(data, progress) != nil {
+		return nil
+	}
+
+	return progress
+}
+
+// Marks mysqldump writes before each table's structure and data
+var tableMarker = []byte("for table `")
+
+// Wrap a SQL dump and report each table as its comment header passes through.
+// Headers split across reads are missed, which only delays the next update.
+type tableReader struct {
+	reader  io.Reader
+	tracker *restoreTracker
+}
+
+func (r *tableReader) Read(b []byte) (int, error) {
+	n, err := r.reader.Read(b)
+
+	chunk := b[:n]
+	if i := bytes.LastIndex(chunk, tableMarker); i >= 0 {
+		name := chunk[i+len(tableMarker):]
+		if end := bytes.IndexByte(name, '`'); end >= 0 {
+			r.tracker.setTable(string(name[:end]))
+		}
+	}
+
+	return n, err
+}
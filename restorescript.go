@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Hold the description of an archive's contents, written into it as manifest.json
+type Manifest struct {
+	Version          string             `json:"dbbackup_version"`
+	CreatedAt        time.Time          `json:"created_at"`
+	MysqldumpVersion string             `json:"mysqldump_version,omitempty"`
+	Labels           map[string]string  `json:"labels,omitempty"`
+	Agent            *AgentInfo         `json:"agent,omitempty"`
+	Databases        []ManifestDatabase `json:"databases"`
+}
+
+// Hold a single database's entry in the manifest
+type ManifestDatabase struct {
+	Engine        string `json:"engine"`
+	Host          string `json:"host"`
+	Name          string `json:"name"`
+	ServerVersion string `json:"server_version,omitempty"`
+
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Path of the dump in the archive. Empty when it's in another archive.
+	File      string `json:"file,omitempty"`
+	SizeBytes int64  `json:"size_bytes"`
+
+	// Of the dump, or for a directory of each file's path and SHA-256
+	SHA256 string `json:"sha256,omitempty"`
+
+	RawSizeBytes     int64   `json:"raw_size_bytes,omitempty"`
+	CompressionRatio float64 `json:"compression_ratio,omitempty"`
+
+	// Set when the dump is a directory of files, such as a dump per table
+	Directory bool `json:"directory,omitempty"`
+
+	// "full" or "differential". Differentials need the full dump in
+	// base_archive restored first.
+	Kind        string `json:"kind,omitempty"`
+	BaseArchive string `json:"base_archive,omitempty"`
+
+	// Set when the dump is in a different archive: the database's own, or
+	// an earlier one when it was unchanged
+	Archive string `json:"archive,omitempty"`
+}
+
+// Hints for restoring engines restore.sh doesn't handle itself
+var restoreHints = map[string]string{
+	"mongodb":    "mongorestore --gzip --dir=FILE",
+	"redis":      "stop redis, copy FILE over its dump.rdb and start it again",
+	"sqlite":     "copy FILE into place while the application is stopped",
+	"mssql":      "RESTORE DATABASE [NAME] FROM DISK = N'FILE' on the SQL Server host",
+	"etcd":       "etcdctl snapshot restore FILE",
+	"ldap":       "slapadd -l FILE with slapd stopped",
+	"influxdb":   "influx restore FILE",
+	"clickhouse": "apply each table's schema in FILE, then insert its data with clickhouse-client",
+	"command":    "restore FILE with the tool that produced it",
+	"files":      "tar -xzf FILE -C / to put the files back where they were",
+}
+
+// Quote a string for a POSIX shell
+func shellQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", `'\''`) + "'"
+}
+
+// Build the manifest of a run's archive
+func buildManifest(report *RunReport) Manifest {
+	manifest := Manifest{
+		Version:          version,
+		CreatedAt:        report.StartedAt,
+		MysqldumpVersion: clientVersion(),
+		Labels:           report.Labels,
+		Agent:            report.Agent,
+		Databases:        []ManifestDatabase{},
+	}
+
+	for _, db := range report.Databases {
+		if !db.Success {
+			continue
+		}
+
+		entry := ManifestDatabase{
+			Engine:        db.Engine,
+			Host:          db.Host,
+			Name:          db.Name,
+			ServerVersion: db.ServerVersion,
+			Labels:        db.Labels,
+			SizeBytes:     db.SizeBytes,
+			SHA256:        db.SHA256,
+			Kind:          db.Kind,
+
+			RawSizeBytes:     db.RawSizeBytes,
+			CompressionRatio: db.CompressionRatio,
+		}
+
+		switch {
+		case db.Skipped && db.Reference != nil:
+			entry.Archive = db.Reference.ArchiveKey
+		case db.ArchiveKey != "":
+			entry.Archive = db.ArchiveKey
+		default:
+			entry.File = filepath.Base(db.File)
+			if info, err := os.Stat(db.File); err == nil && info.IsDir() {
+				entry.Directory = true
+			}
+		}
+
+		if db.Base != nil {
+			entry.BaseArchive = db.Base.ArchiveKey
+		}
+
+		manifest.Databases = append(manifest.Databases, entry)
+	}
+
+	return manifest
+}
+
+// Build a shell script restoring every dump in the archive without dbbackup
+func buildRestoreScript(manifest Manifest) string {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, `#!/bin/sh
+# Generated by dbbackup %s for the backup taken at %s.
+#
+# Restores the dumps in this archive without dbbackup. Extract the archive and
+# run this from the extracted directory, e.g.
+#
+#   MYSQL_HOST=db.example.com MYSQL_USER=root MYSQL_PWD=secret ./restore.sh
+#
+# manifest.json lists every database in the backup with its engine, source
+# host and server version. Dumps were taken with mysqldump %s. Differentials
+# need the full dump in their base archive restored first, and databases kept
+# in other archives are restored from those.
+set -eu
+
+: "${MYSQL_HOST:=127.0.0.1}"
+: "${MYSQL_PORT:=3306}"
+: "${MYSQL_USER:=root}"
+export MYSQL_PWD="${MYSQL_PWD:-}"
+
+# mysql_client [database], connecting with the settings above
+mysql_client() {
+	mysql --host="$MYSQL_HOST" --port="$MYSQL_PORT" --user="$MYSQL_USER" --default-character-set=utf8mb4 ${1:+"$1"}
+}
+
+# create_database <database>, as dumps of a single database don't create it
+create_database() {
+	tick=$(printf '\140')
+	printf 'CREATE DATABASE IF NOT EXISTS %%s%%s%%s;\n' "$tick" "$(printf '%%s' "$1" | sed "s/$tick/$tick$tick/g")" "$tick" | mysql_client
+}
+
+# apply_sql <database> <file>, with an empty database for all-databases dumps
+apply_sql() {
+	echo "Applying $2"
+	case "$2" in
+		*.gz) gunzip -c "$2" ;;
+		*) cat "$2" ;;
+	esac | mysql_client "$1"
+}
+
+# apply_dir <database> <directory>, for dumps taken a table at a time
+apply_dir() {
+	for file in "$2"/tables/*; do
+		apply_sql "$1" "$file"
+	done
+	for file in "$2/views.sql" "$2/views.sql.gz" "$2/programs.sql" "$2/programs.sql.gz" "$2/dropped.sql"; do
+		if [ -f "$file" ]; then
+			apply_sql "$1" "$file"
+		fi
+	done
+}
+`, manifest.Version, manifest.CreatedAt.Format(time.RFC3339), manifest.MysqldumpVersion)
+
+	for _, db := range manifest.Databases {
+		fmt.Fprintf(&b, "\n# %s %s from %s", db.Engine, db.Name, db.Host)
+		if db.ServerVersion != "" {
+			fmt.Fprintf(&b, " (server %s)", db.ServerVersion)
+		}
+		b.WriteString("\n")
+
+		if db.File == "" {
+			fmt.Fprintf(&b, "# In %s, restore it from there\n", db.Archive)
+			continue
+		}
+
+		if db.BaseArchive != "" {
+			fmt.Fprintf(&b, "# Differential: restore the full dump in %s first\n", db.BaseArchive)
+		}
+
+		if db.Engine != "mysql" && db.Engine != "mariadb" {
+			hint := strings.NewReplacer("FILE", db.File, "NAME", db.Name).Replace(restoreHints[db.Engine])
+			fmt.Fprintf(&b, "# Not restored by this script: %s\n", hint)
+			continue
+		}
+
+		if db.Kind == "table_export" {
+			fmt.Fprintf(&b, "# Not restored by this script: %s only holds a table export\n", db.File)
+			continue
+		}
+
+		name := db.Name
+		if name == "*" {
+			name = ""
+		}
+
+		if name != "" {
+			fmt.Fprintf(&b, "create_database %s\n", shellQuote(name))
+		}
+
+		if db.Directory {
+			fmt.Fprintf(&b, "apply_dir %s %s\n", shellQuote(name), shellQuote(db.File))
+		} else {
+			fmt.Fprintf(&b, "apply_sql %s %s\n", shellQuote(name), shellQuote(db.File))
+		}
+	}
+
+	return b.String()
+}
+
+// Write the manifest and restore script into the backups directory, so they
+// sit at the top of the archive. Returns the files written.
+func writeRestoreFiles(config Config, report *RunReport) ([]string, error) {
+	manifest := buildManifest(report)
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	manifestFile := filepath.Join(config.DumpDir, "manifest.json")
+	scriptFile := filepath.Join(config.DumpDir, "restore.sh")
+
+	err = os.WriteFile(manifestFile, data, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.WriteFile(scriptFile, []byte(buildRestoreScript(manifest)), 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Signing.PrivateKey != "" {
+		err = signFile(config, manifestFile)
+		if err != nil {
+			return nil, err
+		}
+		return []string{manifestFile, manifestFile + signatureExtension, scriptFile}, nil
+	}
+
+	return []string{manifestFile, scriptFile}, nil
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestRestoreScriptCreatesDatabases(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("restore.sh needs a POSIX shell")
+	}
+
+	dir := t.TempDir()
+
+	// A fake mysql client logging its arguments and the statements it's given
+	fake := "#!/bin/sh\necho \"mysql $*\" >> \"$MYSQL_LOG\"\ncat >> \"$MYSQL_LOG\"\n"
+	if err := os.WriteFile(filepath.Join(dir, "mysql"), []byte(fake), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "shop.sql"), []byte("INSERT INTO `users` VALUES (1);\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "all.sql"), []byte("CREATE DATABASE `blog`;\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	script := buildRestoreScript(Manifest{Databases: []ManifestDatabase{
+		{Engine: "mysql", Name: "shop`s", File: "shop.sql"},
+		{Engine: "mysql", Name: "*", File: "all.sql"},
+	}})
+	if err := os.WriteFile(filepath.Join(dir, "restore.sh"), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command("sh", "restore.sh")
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), "PATH="+dir+string(os.PathListSeparator)+os.Getenv("PATH"), "MYSQL_LOG="+filepath.Join(dir, "log"))
+	if output, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("restore.sh failed: %s\n%s", err, output)
+	}
+
+	log, err := os.ReadFile(filepath.Join(dir, "log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := "mysql --host=127.0.0.1 --port=3306 --user=root --default-character-set=utf8mb4\n" +
+		"CREATE DATABASE IF NOT EXISTS `shop``s`;\n" +
+		"mysql --host=127.0.0.1 --port=3306 --user=root --default-character-set=utf8mb4 shop`s\n" +
+		"INSERT INTO `users` VALUES (1);\n" +
+		"mysql --host=127.0.0.1 --port=3306 --user=root --default-character-set=utf8mb4\n" +
+		"CREATE DATABASE `blog`;\n"
+	if string(log) != want {
+		t.Errorf("restore.sh ran:\n%s\nwant:\n%s", log, want)
+	}
+
+	if strings.Count(script, "create_database '") != 1 {
+		t.Errorf("restore.sh creates the wrong databases:\n%s", script)
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// Limit how fast a restore applies statements, shared by every file applied
+// at once so the limit holds for the whole restore
+type restoreThrottle struct {
+	// Apply at most this many statements a second on average, 0 for no limit
+	perSecond int
+
+	// Pause for this long after each statement, i.e. each extended insert chunk
+	sleep time.Duration
+
+	mutex   sync.Mutex
+	started time.Time
+	applied int64
+}
+
+// Create a throttle, or nil when neither limit is set
+func newRestoreThrottle(perSecond int, sleep time.Duration) *restoreThrottle {
+	if perSecond <= 0 && sleep <= 0 {
+		return nil
+	}
+
+	return &restoreThrottle{perSecond: perSecond, sleep: sleep, started: time.Now()}
+}
+
+// Wait after statements have been passed to the mysql client, long enough to
+// keep under the limits
+func (t *restoreThrottle) wait(ctx context.Context, statements int) {
+	t.mutex.Lock()
+	t.applied += int64(statements)
+	delay := time.Duration(statements) * t.sleep
+	if t.perSecond > 0 {
+		due := t.started.Add(time.Duration(t.applied) * time.Second / time.Duration(t.perSecond))
+		if wait := time.Until(due); wait > delay {
+			delay = wait
+		}
+	}
+	t.mutex.Unlock()
+
+	if delay <= 0 {
+		return
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// Wrap a SQL dump so reading it is throttled
+func (t *restoreThrottle) reader(ctx context.Context, dump io.Reader) io.Reader {
+	if t == nil {
+		return dump
+	}
+
+	return &throttledReader{ctx: ctx, reader: dump, throttle: t}
+}
+
+// Count the statements in a SQL dump as it's read, by the ";\n" mysqldump
+// ends each with, and wait on the throttle before reading further
+type throttledReader struct {
+	ctx      context.Context
+	reader   io.Reader
+	throttle *restoreThrottle
+	last     byte
+	pending  int
+}
+
+func (r *throttledReader) Read(b []byte) (int, error) {
+	if r.pending > 0 {
+		r.throttle.wait(r.ctx, r.pending)
+		r.pending = 0
+	}
+
+	n, err := r.reader.Read(b)
+
+	for i := 0; i < n; i++ {
+		if b[i] == '\n' && r.last == ';' {
+			r.pending++
+		}
+		r.last = b[i]
+	}
+
+	return n, err
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// Hold the settings for retrying databases that failed during a run
+type RetryConfig struct {
+	// How many more times to dump a failed database, 0 to not retry
+	Attempts int `yaml:"attempts"`
+
+	// How long to wait before each retry, e.g. "5m"
+	Delay string `yaml:"delay"`
+}
+
+// Get the delay before each retry, or 0 if it's unset or invalid
+func (retry RetryConfig) delay() time.Duration {
+	if retry.Delay == "" {
+		return 0
+	}
+
+	delay, err := parseDuration(retry.Delay)
+	if err != nil {
+		return 0
+	}
+
+	return delay
+}
+
+// Identify the queued dump a report is for
+func dumpKey(engine string, host string, name string) string {
+	return engine + "|" + host + "|" + name
+}
+
+// Dump the databases that failed again, up to the configured number of
+// attempts, replacing their reports and adding their files once they succeed
+func retryFailedDumps(ctx context.Context, config Config, queue []queuedDump, reports []DatabaseReport, files []string, previousReports []RunReport, trigger string) ([]DatabaseReport, []string) {
+	for attempt := 1; attempt <= config.RetryFailed.Attempts; attempt++ {
+		failed := map[string]int{}
+		for i, db := range reports {
+			if !db.Success && !db.Skipped {
+				failed[dumpKey(db.Engine, db.Host, db.Name)] = i
+			}
+		}
+		if len(failed) == 0 {
+			break
+		}
+
+		retries := []queuedDump{}
+		for _, dump := range queue {
+			if _, ok := failed[dumpKey(dump.db.Engine, dump.db.Host, dump.dbName)]; ok {
+				retries = append(retries, dump)
+			}
+		}
+
+		log.Printf("Retrying %d failed database(s) in %s, attempt %d of %d\n", len(retries), config.RetryFailed.delay(), attempt, config.RetryFailed.Attempts)
+
+		select {
+		case <-ctx.Done():
+			return reports, files
+		case <-clk.After(config.RetryFailed.delay()):
+		}
+
+		retried, retriedFiles := runDumps(ctx, config, retries, previousReports, trigger)
+		for _, db := range retried {
+			db.Attempts = attempt + 1
+			reports[failed[dumpKey(db.Engine, db.Host, db.Name)]] = db
+		}
+		files = append(files, retriedFiles...)
+	}
+
+	return reports, files
+}
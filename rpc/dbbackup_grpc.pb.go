@@ -0,0 +1,359 @@
+// Control API for orchestrating dbbackup agents, served by "dbbackup serve" and
+// the scheduler when grpc.listen is set. Regenerate the Go code with:
+//
+//   protoc --go_out=. --go_opt=paths=source_relative \
+//     --go-grpc_out=. --go-grpc_opt=paths=source_relative rpc/dbbackup.proto
+
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: rpc/dbbackup.proto
+
+package rpc
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	DBBackup_TriggerBackup_FullMethodName = "/dbbackup.v1.DBBackup/TriggerBackup"
+	DBBackup_GetStatus_FullMethodName     = "/dbbackup.v1.DBBackup/GetStatus"
+	DBBackup_ListBackups_FullMethodName   = "/dbbackup.v1.DBBackup/ListBackups"
+	DBBackup_Restore_FullMethodName       = "/dbbackup.v1.DBBackup/Restore"
+	DBBackup_Prune_FullMethodName         = "/dbbackup.v1.DBBackup/Prune"
+)
+
+// DBBackupClient is the client API for DBBackup service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type DBBackupClient interface {
+	// Run a backup, streaming its output until it finishes
+	TriggerBackup(ctx context.Context, in *TriggerBackupRequest, opts ...grpc.CallOption) (DBBackup_TriggerBackupClient, error)
+	// Get whether a backup is running, when the next runs are, and the latest
+	// result of each database
+	GetStatus(ctx context.Context, in *GetStatusRequest, opts ...grpc.CallOption) (*Status, error)
+	// List the backups stored on the storage targets
+	ListBackups(ctx context.Context, in *ListBackupsRequest, opts ...grpc.CallOption) (*ListBackupsResponse, error)
+	// Restore a database from a backup, streaming its output until it finishes
+	Restore(ctx context.Context, in *RestoreRequest, opts ...grpc.CallOption) (DBBackup_RestoreClient, error)
+	// Delete the backups that have outlived their target's retention, streaming
+	// the output until it finishes
+	Prune(ctx context.Context, in *PruneRequest, opts ...grpc.CallOption) (DBBackup_PruneClient, error)
+}
+
+type dBBackupClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewDBBackupClient(cc grpc.ClientConnInterface) DBBackupClient {
+	return &dBBackupClient{cc}
+}
+
+func (c *dBBackupClient) TriggerBackup(ctx context.Context, in *TriggerBackupRequest, opts ...grpc.CallOption) (DBBackup_TriggerBackupClient, error) {
+	stream, err := c.cc.NewStream(ctx, &DBBackup_ServiceDesc.Streams[0], DBBackup_TriggerBackup_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &dBBackupTriggerBackupClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type DBBackup_TriggerBackupClient interface {
+	Recv() (*JobEvent, error)
+	grpc.ClientStream
+}
+
+type dBBackupTriggerBackupClient struct {
+	grpc.ClientStream
+}
+
+func (x *dBBackupTriggerBackupClient) Recv() (*JobEvent, error) {
+	m := new(JobEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *dBBackupClient) GetStatus(ctx context.Context, in *GetStatusRequest, opts ...grpc.CallOption) (*Status, error) {
+	out := new(Status)
+	err := c.cc.Invoke(ctx, DBBackup_GetStatus_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dBBackupClient) ListBackups(ctx context.Context, in *ListBackupsRequest, opts ...grpc.CallOption) (*ListBackupsResponse, error) {
+	out := new(ListBackupsResponse)
+	err := c.cc.Invoke(ctx, DBBackup_ListBackups_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dBBackupClient) Restore(ctx context.Context, in *RestoreRequest, opts ...grpc.CallOption) (DBBackup_RestoreClient, error) {
+	stream, err := c.cc.NewStream(ctx, &DBBackup_ServiceDesc.Streams[1], DBBackup_Restore_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &dBBackupRestoreClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type DBBackup_RestoreClient interface {
+	Recv() (*JobEvent, error)
+	grpc.ClientStream
+}
+
+type dBBackupRestoreClient struct {
+	grpc.ClientStream
+}
+
+func (x *dBBackupRestoreClient) Recv() (*JobEvent, error) {
+	m := new(JobEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *dBBackupClient) Prune(ctx context.Context, in *PruneRequest, opts ...grpc.CallOption) (DBBackup_PruneClient, error) {
+	stream, err := c.cc.NewStream(ctx, &DBBackup_ServiceDesc.Streams[2], DBBackup_Prune_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &dBBackupPruneClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type DBBackup_PruneClient interface {
+	Recv() (*JobEvent, error)
+	grpc.ClientStream
+}
+
+type dBBackupPruneClient struct {
+	grpc.ClientStream
+}
+
+func (x *dBBackupPruneClient) Recv() (*JobEvent, error) {
+	m := new(JobEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// DBBackupServer is the server API for DBBackup service.
+// All implementations must embed UnimplementedDBBackupServer
+// for forward compatibility
+type DBBackupServer interface {
+	// Run a backup, streaming its output until it finishes
+	TriggerBackup(*TriggerBackupRequest, DBBackup_TriggerBackupServer) error
+	// Get whether a backup is running, when the next runs are, and the latest
+	// result of each database
+	GetStatus(context.Context, *GetStatusRequest) (*Status, error)
+	// List the backups stored on the storage targets
+	ListBackups(context.Context, *ListBackupsRequest) (*ListBackupsResponse, error)
+	// Restore a database from a backup, streaming its output until it finishes
+	Restore(*RestoreRequest, DBBackup_RestoreServer) error
+	// Delete the backups that have outlived their target's retention, streaming
+	// the output until it finishes
+	Prune(*PruneRequest, DBBackup_PruneServer) error
+	mustEmbedUnimplementedDBBackupServer()
+}
+
+// UnimplementedDBBackupServer must be embedded to have forward compatible implementations.
+type UnimplementedDBBackupServer struct {
+}
+
+func (UnimplementedDBBackupServer) TriggerBackup(*TriggerBackupRequest, DBBackup_TriggerBackupServer) error {
+	return status.Errorf(codes.Unimplemented, "method TriggerBackup not implemented")
+}
+func (UnimplementedDBBackupServer) GetStatus(context.Context, *GetStatusRequest) (*Status, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetStatus not implemented")
+}
+func (UnimplementedDBBackupServer) ListBackups(context.Context, *ListBackupsRequest) (*ListBackupsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListBackups not implemented")
+}
+func (UnimplementedDBBackupServer) Restore(*RestoreRequest, DBBackup_RestoreServer) error {
+	return status.Errorf(codes.Unimplemented, "method Restore not implemented")
+}
+func (UnimplementedDBBackupServer) Prune(*PruneRequest, DBBackup_PruneServer) error {
+	return status.Errorf(codes.Unimplemented, "method Prune not implemented")
+}
+func (UnimplementedDBBackupServer) mustEmbedUnimplementedDBBackupServer() {}
+
+// UnsafeDBBackupServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to DBBackupServer will
+// result in compilation errors.
+type UnsafeDBBackupServer interface {
+	mustEmbedUnimplementedDBBackupServer()
+}
+
+func RegisterDBBackupServer(s grpc.ServiceRegistrar, srv DBBackupServer) {
+	s.RegisterService(&DBBackup_ServiceDesc, srv)
+}
+
+func _DBBackup_TriggerBackup_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(TriggerBackupRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(DBBackupServer).TriggerBackup(m, &dBBackupTriggerBackupServer{stream})
+}
+
+type DBBackup_TriggerBackupServer interface {
+	Send(*JobEvent) error
+	grpc.ServerStream
+}
+
+type dBBackupTriggerBackupServer struct {
+	grpc.ServerStream
+}
+
+func (x *dBBackupTriggerBackupServer) Send(m *JobEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _DBBackup_GetStatus_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetStatusRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DBBackupServer).GetStatus(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: DBBackup_GetStatus_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DBBackupServer).GetStatus(ctx, req.(*GetStatusRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DBBackup_ListBackups_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListBackupsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DBBackupServer).ListBackups(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: DBBackup_ListBackups_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DBBackupServer).ListBackups(ctx, req.(*ListBackupsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DBBackup_Restore_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(RestoreRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(DBBackupServer).Restore(m, &dBBackupRestoreServer{stream})
+}
+
+type DBBackup_RestoreServer interface {
+	Send(*JobEvent) error
+	grpc.ServerStream
+}
+
+type dBBackupRestoreServer struct {
+	grpc.ServerStream
+}
+
+func (x *dBBackupRestoreServer) Send(m *JobEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _DBBackup_Prune_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(PruneRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(DBBackupServer).Prune(m, &dBBackupPruneServer{stream})
+}
+
+type DBBackup_PruneServer interface {
+	Send(*JobEvent) error
+	grpc.ServerStream
+}
+
+type dBBackupPruneServer struct {
+	grpc.ServerStream
+}
+
+func (x *dBBackupPruneServer) Send(m *JobEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// DBBackup_ServiceDesc is the grpc.ServiceDesc for DBBackup service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var DBBackup_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "dbbackup.v1.DBBackup",
+	HandlerType: (*DBBackupServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetStatus",
+			Handler:    _DBBackup_GetStatus_Handler,
+		},
+		{
+			MethodName: "ListBackups",
+			Handler:    _DBBackup_ListBackups_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "TriggerBackup",
+			Handler:       _DBBackup_TriggerBackup_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Restore",
+			Handler:       _DBBackup_Restore_Handler,
+			ServerStreams: true,
+		},
+		{
+			StreamName:    "Prune",
+			Handler:       _DBBackup_Prune_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "rpc/dbbackup.proto",
+}
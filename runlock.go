@@ -0,0 +1,85 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Name of the file in reports_dir held by the process running a backup, so
+// runs started by other processes, like API jobs and the daemon, don't overlap
+const runLockFile = "run.lock"
+
+// How long a lock file may stay empty while its process writes it
+const runLockGrace = time.Minute
+
+// Take the lock on the config's reports_dir for a backup run. Returns the
+// function releasing it, or false if another process holds it. A lock left by
+// a process on this host that's no longer running is taken over. If the lock
+// can't be written at all the run goes ahead without it.
+func lockRun(config Config) (func(), bool) {
+	path := filepath.Join(config.ReportsDir, runLockFile)
+	hostname, _ := os.Hostname()
+
+	for attempt := 0; attempt < 2; attempt++ {
+		file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			fmt.Fprintf(file, "%d %s\n", os.Getpid(), hostname)
+			file.Close()
+			return func() { os.Remove(path) }, true
+		}
+		if !os.IsExist(err) {
+			log.Printf("Error taking run lock %s: %s\n", path, err.Error())
+			return func() {}, true
+		}
+
+		pid, host, held := runLockHolder(path, hostname)
+		if held {
+			log.Printf("Backup already running in process %d on %s, skipping\n", pid, host)
+			return nil, false
+		}
+
+		log.Printf("Taking over run lock %s left by process %d\n", path, pid)
+		os.Remove(path)
+	}
+
+	log.Printf("Backup already running, skipping\n")
+	return nil, false
+}
+
+// Get the process holding a run lock and whether it still holds it. Locks
+// from other hosts are always held, as their processes can't be checked.
+func runLockHolder(path string, hostname string) (int, string, bool) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0, "", false
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, "", true
+	}
+
+	pid, host := 0, ""
+	_, err = fmt.Sscanf(string(data), "%d %s", &pid, &host)
+	if err != nil {
+		// Still being written, unless it's been left empty by a crash
+		return 0, "", clk.Now().Sub(info.ModTime()) < runLockGrace
+	}
+
+	if host != hostname {
+		return pid, host, true
+	}
+
+	return pid, host, pid == os.Getpid() || processAlive(pid)
+}
+
+// Check whether another process is running a backup of the config's reports_dir
+func runLocked(config Config) bool {
+	hostname, _ := os.Hostname()
+	pid, _, held := runLockHolder(filepath.Join(config.ReportsDir, runLockFile), hostname)
+
+	return held && pid != os.Getpid()
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Run as a separate process by TestRunLock: "hold" takes the lock until stdin
+// closes, "backup" starts a run, exiting as the main command would
+func TestRunLockHelper(t *testing.T) {
+	dir := os.Getenv("DBBACKUP_TEST_RUN_LOCK")
+	if dir == "" {
+		t.Skip("only run by TestRunLock")
+	}
+	config := Config{ReportsDir: dir}
+
+	switch os.Getenv("DBBACKUP_TEST_RUN_LOCK_MODE") {
+	case "hold":
+		unlock, ok := lockRun(config)
+		if !ok {
+			os.Exit(exitLocked)
+		}
+		os.Stdout.WriteString("locked\n")
+		bufio.NewReader(os.Stdin).ReadString('\n')
+		unlock()
+		os.Exit(exitOK)
+	case "backup":
+		if report := runBackups(context.Background(), config, "manual"); report == nil {
+			os.Exit(exitLocked)
+		}
+		os.Exit(exitOK)
+	}
+}
+
+func runLockHelper(dir string, mode string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestRunLockHelper$")
+	cmd.Env = append(os.Environ(), "DBBACKUP_TEST_RUN_LOCK="+dir, "DBBACKUP_TEST_RUN_LOCK_MODE="+mode)
+	return cmd
+}
+
+func TestRunLock(t *testing.T) {
+	dir := t.TempDir()
+
+	holder := runLockHelper(dir, "hold")
+	stdin, err := holder.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout, err := holder.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := holder.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer holder.Process.Kill()
+
+	line, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil || line != "locked\n" {
+		t.Fatalf("holder printed %q, %v", line, err)
+	}
+
+	// A second process's run is refused while the first holds the lock
+	err = runLockHelper(dir, "backup").Run()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != exitLocked {
+		t.Errorf("backup during another process's run returned %v, want exit %d", err, exitLocked)
+	}
+	if !runLocked(Config{ReportsDir: dir}) {
+		t.Error("lock held by another process isn't reported")
+	}
+
+	stdin.Close()
+	if err := holder.Wait(); err != nil {
+		t.Fatalf("holder returned %v", err)
+	}
+
+	// Once released, the lock can be taken again
+	unlock, ok := lockRun(Config{ReportsDir: dir})
+	if !ok {
+		t.Fatal("released lock couldn't be taken")
+	}
+	unlock()
+
+	if _, err := os.Stat(filepath.Join(dir, runLockFile)); !os.IsNotExist(err) {
+		t.Errorf("lock file left after unlocking: %v", err)
+	}
+}
+
+func TestRunLockTakesOverFromDeadProcess(t *testing.T) {
+	dir := t.TempDir()
+
+	// A process that has exited, whose pid is no longer running
+	exited := exec.Command(os.Args[0], "-test.run=^$")
+	if err := exited.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	hostname, _ := os.Hostname()
+	lock := filepath.Join(dir, runLockFile)
+	err := os.WriteFile(lock, []byte(fmt.Sprintf("%d %s\n", exited.Process.Pid, hostname)), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	unlock, ok := lockRun(Config{ReportsDir: dir})
+	if !ok {
+		t.Fatal("lock left by an exited process wasn't taken over")
+	}
+	defer unlock()
+
+	data, _ := os.ReadFile(lock)
+	if !strings.HasPrefix(string(data), fmt.Sprintf("%d ", os.Getpid())) {
+		t.Errorf("lock holds %q", data)
+	}
+}
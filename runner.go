@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"os/exec"
+)
+
+// Runs the external commands dumps and queries are made with, so failure
+// handling can be driven by a fake
+type commandRunner interface {
+	// Run the command, returning its stdout as exec.Cmd.Output does
+	output(cmd *exec.Cmd) ([]byte, error)
+
+	// Run the command, returning its stdout and stderr together as
+	// exec.Cmd.CombinedOutput does
+	combinedOutput(cmd *exec.Cmd) ([]byte, error)
+
+	// Run the command in its own process group until it exits, killing the
+	// group if ctx is cancelled
+	runGroup(ctx context.Context, cmd *exec.Cmd) error
+}
+
+// Runner behind dumps and database queries, replaced in tests
+var runner commandRunner = systemCommands{}
+
+// Runs commands for real
+type systemCommands struct{}
+
+func (systemCommands) output(cmd *exec.Cmd) ([]byte, error) {
+	return cmd.Output()
+}
+
+func (systemCommands) combinedOutput(cmd *exec.Cmd) ([]byte, error) {
+	return cmd.CombinedOutput()
+}
+
+// Unlike exec.CommandContext this also stops anything a shell started, which
+// would otherwise keep running and hold its output open
+func (systemCommands) runGroup(ctx context.Context, cmd *exec.Cmd) error {
+	setProcessGroup(cmd)
+
+	err := cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			killProcessGroup(cmd)
+		case <-done:
+		}
+	}()
+
+	err = cmd.Wait()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	return err
+}
+
+// Run a command, returning its stdout
+func commandOutput(cmd *exec.Cmd) ([]byte, error) {
+	return runner.output(cmd)
+}
+
+// Run a command, returning its stdout and stderr together
+func commandCombinedOutput(cmd *exec.Cmd) ([]byte, error) {
+	return runner.combinedOutput(cmd)
+}
+
+// Run a command in its own process group, killing the whole group if the
+// context is cancelled
+func runProcessGroup(ctx context.Context, cmd *exec.Cmd) error {
+	return runner.runGroup(ctx, cmd)
+}
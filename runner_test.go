@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Records commands instead of running them, answering each with the output
+// and error set for its program, e.g. "mysqldump", for tests
+type fakeCommands struct {
+	mutex   sync.Mutex
+	ran     [][]string
+	envs    [][]string
+	outputs map[string]string
+	errs    map[string]error
+
+	// Answers commands instead of outputs and errs when set
+	answer func(args []string) (string, error)
+}
+
+// Create a fake runner where every command succeeds with no output
+func newFakeCommands() *fakeCommands {
+	return &fakeCommands{outputs: map[string]string{}, errs: map[string]error{}}
+}
+
+// Record a command, returning the output and error set for its program
+func (f *fakeCommands) record(cmd *exec.Cmd) (string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	f.ran = append(f.ran, cmd.Args)
+	f.envs = append(f.envs, cmd.Env)
+
+	if f.answer != nil {
+		return f.answer(cmd.Args)
+	}
+
+	program := filepath.Base(cmd.Args[0])
+	return f.outputs[program], f.errs[program]
+}
+
+func (f *fakeCommands) output(cmd *exec.Cmd) ([]byte, error) {
+	output, err := f.record(cmd)
+	return []byte(output), err
+}
+
+func (f *fakeCommands) combinedOutput(cmd *exec.Cmd) ([]byte, error) {
+	return f.output(cmd)
+}
+
+func (f *fakeCommands) runGroup(ctx context.Context, cmd *exec.Cmd) error {
+	output, err := f.record(cmd)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+
+	// Read the input as a successful command would, while a failing one
+	// leaves whatever writes it blocked
+	if cmd.Stdin != nil && err == nil {
+		if _, readErr := io.Copy(io.Discard, cmd.Stdin); readErr != nil {
+			return readErr
+		}
+	}
+
+	if cmd.Stdout != nil {
+		if _, writeErr := cmd.Stdout.Write([]byte(output)); writeErr != nil {
+			return writeErr
+		}
+	}
+
+	return err
+}
+
+// Get the arguments of every command run so far, in order
+func (f *fakeCommands) commandsRun() [][]string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return append([][]string{}, f.ran...)
+}
+
+// Get the environment of every command run so far, in order
+func (f *fakeCommands) commandEnvs() [][]string {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	return append([][]string{}, f.envs...)
+}
+
+func TestFakeCommands(t *testing.T) {
+	fake := newFakeCommands()
+	fake.outputs["mysqldump"] = "-- dump\n"
+	fake.errs["mysql"] = errors.New("access denied")
+	runner = fake
+	defer func() { runner = systemCommands{} }()
+
+	output, err := commandCombinedOutput(exec.Command("/usr/bin/mysqldump", "--version"))
+	if err != nil || string(output) != "-- dump\n" {
+		t.Errorf("mysqldump returned %q, %v", output, err)
+	}
+
+	var dump strings.Builder
+	cmd := exec.Command("mysqldump", "shop")
+	cmd.Stdout = &dump
+	if err := runProcessGroup(context.Background(), cmd); err != nil || dump.String() != "-- dump\n" {
+		t.Errorf("mysqldump wrote %q, returned %v", dump.String(), err)
+	}
+
+	cmd = exec.Command("mysql", "shop")
+	cmd.Stdin = strings.NewReader("SELECT 1;")
+	if err := runProcessGroup(context.Background(), cmd); err == nil || !strings.Contains(err.Error(), "access denied") {
+		t.Errorf("mysql returned %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := runProcessGroup(ctx, exec.Command("mysqldump")); !errors.Is(err, context.Canceled) {
+		t.Errorf("cancelled command returned %v", err)
+	}
+
+	ran := fake.commandsRun()
+	if len(ran) != 4 || filepath.Base(ran[0][0]) != "mysqldump" || ran[2][1] != "shop" {
+		t.Errorf("ran %q", ran)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// A job the scheduler runs, with its upcoming run times
+type ScheduledJob struct {
+	Profile  string         `json:"profile,omitempty"`
+	Name     string         `json:"name"`
+	Cron     string         `json:"cron"`
+	Timezone string         `json:"timezone"`
+	NextRuns []ScheduledRun `json:"next_runs"`
+
+	// When the job last fired, as saved by the scheduler
+	LastFired *time.Time `json:"last_fired,omitempty"`
+}
+
+// A single upcoming run, noting any blackout that will skip or defer it
+type ScheduledRun struct {
+	Time     time.Time `json:"time"`
+	Blackout string    `json:"blackout,omitempty"`
+	Action   string    `json:"action,omitempty"`
+
+	// Set when a maintenance pause will skip the run
+	Paused bool `json:"paused,omitempty"`
+}
+
+// List the jobs the scheduler would run for a config, each with its next runs
+func scheduledJobs(config Config, count int) []ScheduledJob {
+	// Cron runs in the process's local time. timezone only affects names, and
+	// blackouts are checked in blackout_timezone.
+	zone := time.Now().Format("MST -07:00")
+	state := loadSchedulerState(config)
+
+	job := func(name string, spec string) ScheduledJob {
+		runs := []ScheduledRun{}
+		for _, next := range nextRuns(spec, count) {
+			runs = append(runs, ScheduledRun{Time: next})
+		}
+		scheduled := ScheduledJob{Profile: config.profile, Name: name, Cron: spec, Timezone: zone, NextRuns: runs}
+		if fired, ok := state[jobKey(config, name)]; ok {
+			scheduled.LastFired = &fired.LastFired
+		}
+		return scheduled
+	}
+
+	backup := job("backup", config.CronInterval)
+	pause := config.activePause()
+	for i, run := range backup.NextRuns {
+		if pause != nil && run.Time.Before(pause.Until) {
+			backup.NextRuns[i].Action = "skip"
+			backup.NextRuns[i].Paused = true
+		} else if blackout, active := config.activeBlackout(run.Time); active {
+			backup.NextRuns[i].Blackout = blackout.Name
+			backup.NextRuns[i].Action = "skip"
+			if blackout.Action == "defer" {
+				backup.NextRuns[i].Action = "defer"
+			}
+		}
+	}
+	jobs := []ScheduledJob{backup}
+
+	for _, notifier := range config.Notifications {
+		if schedule, ok := digestSchedules[notifier.Digest]; ok {
+			jobs = append(jobs, job(fmt.Sprintf("%s %s digest", notifier.Digest, notifier.Type), schedule.Spec))
+		}
+	}
+
+	if config.Tiering.enabled() {
+		jobs = append(jobs, job("tiering", config.Tiering.Schedule))
+	}
+
+	return jobs
+}
+
+// Write the jobs as a readable list
+func printSchedule(w io.Writer, jobs []ScheduledJob) {
+	for i, job := range jobs {
+		if i > 0 {
+			fmt.Fprintln(w)
+		}
+
+		if job.Profile != "" {
+			fmt.Fprintf(w, "%s (profile %s)\n", job.Name, job.Profile)
+		} else {
+			fmt.Fprintln(w, job.Name)
+		}
+		fmt.Fprintf(w, "  cron:     %s\n", job.Cron)
+		fmt.Fprintf(w, "  timezone: %s\n", job.Timezone)
+		if job.LastFired != nil {
+			fmt.Fprintf(w, "  last run: %s\n", job.LastFired.Local().Format("2006-01-02 15:04:05 Mon"))
+		}
+		fmt.Fprintln(w, "  next runs:")
+
+		for _, run := range job.NextRuns {
+			switch {
+			case run.Paused:
+				fmt.Fprintf(w, "    %s  skipped while paused\n", run.Time.Format("2006-01-02 15:04:05 Mon"))
+			case run.Action == "skip":
+				fmt.Fprintf(w, "    %s  skipped by blackout %q\n", run.Time.Format("2006-01-02 15:04:05 Mon"), run.Blackout)
+			case run.Action == "defer":
+				fmt.Fprintf(w, "    %s  deferred by blackout %q\n", run.Time.Format("2006-01-02 15:04:05 Mon"), run.Blackout)
+			default:
+				fmt.Fprintf(w, "    %s\n", run.Time.Format("2006-01-02 15:04:05 Mon"))
+			}
+		}
+	}
+}
+
+// Handle the schedule subcommand, covering every profile. Usage: schedule [--count 5] [--json]
+func runSchedule(configs []Config, args []string) error {
+	flags := flag.NewFlagSet("schedule", flag.ContinueOnError)
+	count := flags.Int("count", 5, "how many upcoming runs to list for each job")
+	asJSON := flags.Bool("json", false, "output JSON instead of a list")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return withExitCode(exitConfig, err)
+	}
+
+	jobs := []ScheduledJob{}
+	for _, config := range configs {
+		jobs = append(jobs, scheduledJobs(config, *count)...)
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(jobs)
+	}
+
+	printSchedule(os.Stdout, jobs)
+	return nil
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/robfig/cron"
+)
+
+// Name of the file in reports_dir holding when each scheduled job last fired
+const schedulerStateFile = "scheduler.json"
+
+// When a scheduled job last fired, kept across restarts
+type JobState struct {
+	LastFired time.Time `json:"last_fired"`
+}
+
+// Jobs of different profiles can fire at once and share a reports_dir
+var schedulerStateMutex sync.Mutex
+
+// Identify a job in the scheduler state, as profiles may share reports_dir
+func jobKey(config Config, name string) string {
+	if config.profile != "" {
+		return config.profile + " " + name
+	}
+
+	return name
+}
+
+// Read when each job last fired, keyed by jobKey
+func loadSchedulerState(config Config) map[string]JobState {
+	state := map[string]JobState{}
+
+	data, err := os.ReadFile(filepath.Join(config.ReportsDir, schedulerStateFile))
+	if err != nil {
+		return state
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		log.Printf("Error reading scheduler state: %s\n", err.Error())
+	}
+
+	return state
+}
+
+// Record that a job fired, replacing the file so it's never left half written
+func recordJobFired(config Config, name string, at time.Time) {
+	schedulerStateMutex.Lock()
+	defer schedulerStateMutex.Unlock()
+
+	state := loadSchedulerState(config)
+	state[jobKey(config, name)] = JobState{LastFired: at}
+
+	path := filepath.Join(config.ReportsDir, schedulerStateFile)
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err == nil {
+		err = os.WriteFile(path+".tmp", data, 0644)
+	}
+	if err == nil {
+		err = os.Rename(path+".tmp", path)
+	}
+	if err != nil {
+		log.Printf("Error saving scheduler state: %s\n", err.Error())
+	}
+}
+
+// A cron schedule that carries on from when its job last fired, so a restart
+// neither resets an "@every" interval nor loses a run missed while stopped
+type persistentSchedule struct {
+	cron.Schedule
+	name    string
+	last    time.Time
+	started bool
+}
+
+func (s *persistentSchedule) Next(t time.Time) time.Time {
+	if s.started || s.last.IsZero() {
+		s.started = true
+		return s.Schedule.Next(t)
+	}
+	s.started = true
+
+	next := s.Schedule.Next(s.last)
+	if next.Before(t) {
+		log.Printf("Running %s now, its run at %s was missed while stopped\n", s.name, next.Format(time.RFC3339))
+		return t
+	}
+
+	return next
+}
+
+// Add a job to the cron, resuming its schedule from the state saved in
+// reports_dir and recording each time it fires
+func addPersistentJob(c *cron.Cron, config Config, name string, spec string, run func()) error {
+	schedule, err := cron.Parse(spec)
+	if err != nil {
+		return err
+	}
+
+	last := loadSchedulerState(config)[jobKey(config, name)].LastFired
+	c.Schedule(&persistentSchedule{Schedule: schedule, name: name, last: last}, cron.FuncJob(func() {
+		// cron would log a panic itself, unredacted
+		defer redactPanic()
+
+		recordJobFired(config, name, clk.Now())
+		run()
+	}))
+
+	return nil
+}
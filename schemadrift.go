@@ -0,0 +1,118 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Counters that change with every insert and aren't schema changes
+var autoIncrementPattern = regexp.MustCompile(` AUTO_INCREMENT=\d+`)
+
+// Undo the escaping of newlines, tabs and backslashes in mysql's batch output
+func unescapeBatch(value string) string {
+	return strings.NewReplacer(`\n`, "\n", `\t`, "\t", `\0`, "\x00", `\\`, `\`).Replace(value)
+}
+
+// Get the CREATE statement of every table and view in a database
+func tableSchemas(db DatabaseConfig, dbName string) (map[string]string, error) {
+	tables, views, err := listTablesAndViews(db, dbName)
+	if err != nil {
+		return nil, err
+	}
+
+	schemas := map[string]string{}
+
+	for _, table := range append(tables, views...) {
+		output, err := mysqlQuery(db, "", fmt.Sprintf("SHOW CREATE TABLE %s.%s", quoteIdentifier(dbName), quoteIdentifier(table)))
+		if err != nil {
+			return nil, fmt.Errorf("error getting schema of %s: %w", table, err)
+		}
+
+		// "name\tCREATE ...", with the character sets after it for views
+		fields := strings.Split(strings.TrimSuffix(output, "\n"), "\t")
+		if len(fields) < 2 {
+			continue
+		}
+
+		schemas[table] = autoIncrementPattern.ReplaceAllString(unescapeBatch(fields[1]), "")
+	}
+
+	return schemas, nil
+}
+
+// Find the schema recorded by the most recent successful backup of a database
+func previousSchema(reports []RunReport, engine string, host string, name string) (map[string]string, bool) {
+	for _, report := range reports {
+		for _, db := range report.Databases {
+			if db.Engine == engine && db.Host == host && db.Name == name && db.Success && db.Schema != nil {
+				return db.Schema, true
+			}
+		}
+	}
+
+	return nil, false
+}
+
+// Describe the differences between two schemas, one line per change
+func schemaDrift(previous map[string]string, current map[string]string) []string {
+	names := []string{}
+	for name := range previous {
+		names = append(names, name)
+	}
+	for name := range current {
+		if _, ok := previous[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	drift := []string{}
+
+	for _, name := range names {
+		before, existed := previous[name]
+		after, exists := current[name]
+
+		switch {
+		case !existed:
+			drift = append(drift, fmt.Sprintf("added %s", name))
+		case !exists:
+			drift = append(drift, fmt.Sprintf("dropped %s", name))
+		case before != after:
+			drift = append(drift, fmt.Sprintf("changed %s:", name))
+			drift = append(drift, lineChanges(before, after)...)
+		}
+	}
+
+	return drift
+}
+
+// List the lines removed from and added to a statement
+func lineChanges(before string, after string) []string {
+	beforeLines := map[string]bool{}
+	for _, line := range strings.Split(before, "\n") {
+		beforeLines[strings.TrimSpace(strings.TrimSuffix(line, ","))] = true
+	}
+
+	afterLines := map[string]bool{}
+	for _, line := range strings.Split(after, "\n") {
+		afterLines[strings.TrimSpace(strings.TrimSuffix(line, ","))] = true
+	}
+
+	changes := []string{}
+	for _, line := range strings.Split(before, "\n") {
+		line = strings.TrimSpace(strings.TrimSuffix(line, ","))
+		if !afterLines[line] {
+			changes = append(changes, "  - "+line)
+		}
+	}
+	for _, line := range strings.Split(after, "\n") {
+		line = strings.TrimSpace(strings.TrimSuffix(line, ","))
+		if !beforeLines[line] {
+			changes = append(changes, "  + "+line)
+		}
+	}
+
+	return changes
+}
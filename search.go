@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"text/tabwriter"
+	"time"
+)
+
+// A backup of a single database found by search, with what's needed to pick
+// it for a restore
+type SearchResult struct {
+	Engine     string    `json:"engine"`
+	Host       string    `json:"host"`
+	Database   string    `json:"database"`
+	StartedAt  time.Time `json:"started_at"`
+	Kind       string    `json:"kind,omitempty"`
+	ArchiveKey string    `json:"archive_key"`
+	SizeBytes  int64     `json:"size_bytes"`
+
+	// Of the whole archive, when the database is in the run's archive
+	ArchiveSizeBytes int64  `json:"archive_size_bytes,omitempty"`
+	ArchiveSHA256    string `json:"archive_sha256,omitempty"`
+
+	// Where the archive was stored, as target:key
+	Locations []string `json:"locations,omitempty"`
+}
+
+// What search results must match. Empty fields match anything.
+type searchQuery struct {
+	database string
+	host     string
+	engine   string
+	before   time.Time
+	after    time.Time
+	label    string
+	failed   bool
+}
+
+// Parse a date such as "2024-06-01" (midnight UTC) or an RFC 3339 time
+func parseSearchTime(value string) (time.Time, error) {
+	if t, err := time.ParseInLocation("2006-01-02", value, time.UTC); err == nil {
+		return t, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, expected a date like 2024-06-01 or an RFC 3339 time", value)
+	}
+
+	return t, nil
+}
+
+// Read the reports mirrored to each storage target's catalog
+func loadRemoteReports(ctx context.Context, config Config) ([]RunReport, error) {
+	reports := []RunReport{}
+
+	for _, target := range config.targets() {
+		objects, err := target.listPrefix(ctx, catalogNamePrefix+"report_")
+		if err != nil {
+			return nil, fmt.Errorf("error listing catalog on %s: %w", target.Name, err)
+		}
+
+		for _, object := range objects {
+			if path.Ext(object.Key) != ".json" {
+				continue
+			}
+
+			body, err := target.open(ctx, object.Key)
+			if err != nil {
+				return nil, fmt.Errorf("error reading %s on %s: %w", object.Key, target.Name, err)
+			}
+
+			report := RunReport{}
+			err = json.NewDecoder(body).Decode(&report)
+			body.Close()
+			if err != nil {
+				return nil, fmt.Errorf("error reading %s on %s: %w", object.Key, target.Name, err)
+			}
+
+			reports = append(reports, report)
+		}
+	}
+
+	return reports, nil
+}
+
+// Find the backups in the reports matching the query, newest first. Each run
+// is only counted once, however many catalogs it was found in.
+func searchReports(reports []RunReport, query searchQuery) ([]SearchResult, error) {
+	if query.label != "" {
+		key, value, err := parseLabel(query.label)
+		if err != nil {
+			return nil, err
+		}
+		reports = filterByLabel(reports, key, value)
+	}
+
+	results := []SearchResult{}
+	seen := map[string]bool{}
+
+	for i := range reports {
+		report := &reports[i]
+
+		if !query.before.IsZero() && !report.StartedAt.Before(query.before) {
+			continue
+		}
+		if !query.after.IsZero() && report.StartedAt.Before(query.after) {
+			continue
+		}
+
+		for _, db := range report.Databases {
+			if !db.Success && !query.failed {
+				continue
+			}
+			if query.database != "" {
+				if ok, _ := path.Match(query.database, db.Name); !ok {
+					continue
+				}
+			}
+			if (query.host != "" && db.Host != query.host) || (query.engine != "" && db.Engine != query.engine) {
+				continue
+			}
+
+			archive := report.archiveFor(db)
+			key := report.StartedAt.String() + "\x00" + archive + "\x00" + dumpKey(db.Engine, db.Host, db.Name)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+
+			result := SearchResult{
+				Engine:     db.Engine,
+				Host:       db.Host,
+				Database:   db.Name,
+				StartedAt:  report.StartedAt,
+				Kind:       db.Kind,
+				ArchiveKey: archive,
+				SizeBytes:  db.SizeBytes,
+			}
+			if archive == report.ArchiveKey {
+				result.ArchiveSizeBytes = report.ArchiveSizeBytes
+				result.ArchiveSHA256 = report.ArchiveSHA256
+				for _, target := range append(report.Targets, report.Replicas...) {
+					result.Locations = append(result.Locations, target.Name+":"+target.Key)
+				}
+			}
+
+			results = append(results, result)
+		}
+	}
+
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].StartedAt.After(results[j].StartedAt)
+	})
+
+	return results, nil
+}
+
+// Write search results as a table
+func printSearchResults(w io.Writer, results []SearchResult) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STARTED\tENGINE\tHOST\tDATABASE\tKIND\tSIZE\tARCHIVE\tSHA256")
+
+	for _, result := range results {
+		kind := result.Kind
+		if kind == "" {
+			kind = "full"
+		}
+		checksum := result.ArchiveSHA256
+		if checksum == "" {
+			checksum = "-"
+		}
+
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n", result.StartedAt.Format(time.RFC3339), result.Engine, result.Host, result.Database, kind, formatBytes(result.SizeBytes), result.ArchiveKey, checksum)
+	}
+
+	return tw.Flush()
+}
+
+// Handle the search subcommand. Usage: search [--db name] [--host host]
+// [--engine engine] [--before date] [--after date] [--label key=value]
+// [--failed] [--remote] [--limit n] [--json]
+func runSearch(ctx context.Context, config Config, args []string) error {
+	flags := flag.NewFlagSet("search", flag.ContinueOnError)
+	database := flags.String("db", "", "only backups of this database, or databases matching a glob such as \"orders_*\"")
+	host := flags.String("host", "", "only backups of databases on this host")
+	engine := flags.String("engine", "", "only backups of this engine, e.g. mysql")
+	before := flags.String("before", "", "only backups started before this date or RFC 3339 time, e.g. 2024-06-01")
+	after := flags.String("after", "", "only backups started at or after this date or RFC 3339 time")
+	label := flags.String("label", "", "only backups of databases with this label, e.g. team=payments")
+	failed := flags.Bool("failed", false, "include failed dumps")
+	remote := flags.Bool("remote", false, "also search the reports mirrored to each storage target's catalog")
+	limit := flags.Int("limit", 0, "show at most this many backups, newest first")
+	asJSON := flags.Bool("json", false, "output JSON instead of a table")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return withExitCode(exitConfig, err)
+	}
+
+	query := searchQuery{database: *database, host: *host, engine: *engine, label: *label, failed: *failed}
+	if *before != "" {
+		query.before, err = parseSearchTime(*before)
+		if err != nil {
+			return withExitCode(exitConfig, err)
+		}
+	}
+	if *after != "" {
+		query.after, err = parseSearchTime(*after)
+		if err != nil {
+			return withExitCode(exitConfig, err)
+		}
+	}
+
+	reports, err := loadReports(config.ReportsDir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	if *remote {
+		remoteReports, err := loadRemoteReports(ctx, config)
+		if err != nil {
+			return err
+		}
+		reports = append(reports, remoteReports...)
+	}
+
+	results, err := searchReports(reports, query)
+	if err != nil {
+		return withExitCode(exitConfig, err)
+	}
+	if *limit > 0 && len(results) > *limit {
+		results = results[:*limit]
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(results)
+	}
+
+	if len(results) == 0 {
+		fmt.Fprintln(os.Stderr, "No backups found")
+		return nil
+	}
+
+	return printSearchResults(os.Stdout, results)
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"reflect"
+	"runtime/debug"
+	"sort"
+	"sync"
+)
+
+// A password, token or key from the configuration. It prints, marshals and
+// formats as "[redacted]", so the value has to be asked for with reveal.
+type Secret string
+
+// Shown in place of a secret
+const redacted = "[redacted]"
+
+// Get the actual value, to pass to a client or command
+func (s Secret) reveal() string {
+	return string(s)
+}
+
+func (s Secret) String() string {
+	if s == "" {
+		return ""
+	}
+	return redacted
+}
+
+func (s Secret) GoString() string {
+	return fmt.Sprintf("%q", s.String())
+}
+
+func (s Secret) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.String())
+}
+
+func (s Secret) MarshalYAML() (interface{}, error) {
+	return s.String(), nil
+}
+
+// Values replaced in everything logged, longest first so one secret
+// containing another is replaced whole
+var (
+	secretValues []string
+	secretsMutex sync.RWMutex
+)
+
+// Shorter values are too likely to match ordinary log text
+const minSecretLength = 4
+
+// Add the secrets in a config to those redacted from the logs: every Secret
+// field, and passwords in URLs such as notifier endpoints
+func registerSecrets(config Config) {
+	found := map[string]bool{}
+	collectSecrets(reflect.ValueOf(config), found)
+
+	secretsMutex.Lock()
+	defer secretsMutex.Unlock()
+
+	for _, value := range secretValues {
+		found[value] = true
+	}
+
+	secretValues = []string{}
+	for value := range found {
+		if len(value) >= minSecretLength {
+			secretValues = append(secretValues, value)
+		}
+	}
+	sort.Slice(secretValues, func(i, j int) bool {
+		return len(secretValues[i]) > len(secretValues[j])
+	})
+}
+
+// Swap a secret generated at run time, such as a short-lived token, for its
+// replacement so expired ones don't pile up
+func replaceSecret(old string, value string) {
+	secretsMutex.Lock()
+	defer secretsMutex.Unlock()
+
+	kept := []string{}
+	for _, existing := range secretValues {
+		if existing != old {
+			kept = append(kept, existing)
+		}
+	}
+	if len(value) >= minSecretLength {
+		kept = append(kept, value)
+	}
+	sort.Slice(kept, func(i, j int) bool {
+		return len(kept[i]) > len(kept[j])
+	})
+
+	secretValues = kept
+}
+
+// Walk a value for secrets
+func collectSecrets(v reflect.Value, found map[string]bool) {
+	switch v.Kind() {
+	case reflect.String:
+		if v.Type() == reflect.TypeOf(Secret("")) {
+			found[v.String()] = true
+		} else if u, err := url.Parse(v.String()); err == nil && u.User != nil {
+			if password, ok := u.User.Password(); ok {
+				found[password] = true
+			}
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			collectSecrets(v.Field(i), found)
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			collectSecrets(v.Index(i), found)
+		}
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			collectSecrets(iter.Value(), found)
+		}
+	case reflect.Ptr, reflect.Interface:
+		if !v.IsNil() {
+			collectSecrets(v.Elem(), found)
+		}
+	}
+}
+
+// Replace every registered secret in some text
+func redact(data []byte) []byte {
+	secretsMutex.RLock()
+	defer secretsMutex.RUnlock()
+
+	for _, value := range secretValues {
+		data = bytes.ReplaceAll(data, []byte(value), []byte(redacted))
+	}
+
+	return data
+}
+
+// Wrap the log output so secrets are redacted from every line, including
+// errors quoting command lines or URLs
+type redactingWriter struct {
+	writer io.Writer
+}
+
+func (w redactingWriter) Write(b []byte) (int, error) {
+	_, err := w.writer.Write(redact(b))
+	return len(b), err
+}
+
+// Redact secrets from everything logged from now on
+func redactLogs() {
+	log.SetOutput(redactingWriter{writer: log.Writer()})
+}
+
+// Write credentials for a client tool to a temporary file in dir that only
+// this user can read, so they aren't passed as arguments, where other users on
+// the host could read them from the process list. The caller removes it.
+func writeCredentialsFile(dir string, pattern string, data []byte) (string, error) {
+	// Created with mode 0600
+	file, err := os.CreateTemp(dir, pattern)
+	if err != nil {
+		return "", fmt.Errorf("error writing credentials file: %w", err)
+	}
+
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("error writing credentials file: %w", err)
+	}
+
+	return file.Name(), nil
+}
+
+// Log a panic with secrets redacted before exiting, instead of letting the
+// runtime print it unfiltered. Only catches panics in its own goroutine, so
+// it's deferred at the top of main and of the server, job and cron goroutines.
+// net/http recovers handler panics itself and logs them through the redacted log.
+func redactPanic() {
+	value := recover()
+	if value == nil {
+		return
+	}
+
+	fatal(exitFailure, "panic: %v\n%s", value, debug.Stack())
+}
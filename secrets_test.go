@@ -0,0 +1,50 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/robfig/cron"
+)
+
+// Run as a separate process by TestCronPanicIsRedacted: a scheduled job
+// panics with a configured password in the message
+func TestCronPanicHelper(t *testing.T) {
+	dir := os.Getenv("DBBACKUP_TEST_CRON_PANIC")
+	if dir == "" {
+		t.Skip("only run by TestCronPanicIsRedacted")
+	}
+
+	config := Config{ReportsDir: dir, Databases: []DatabaseConfig{{Password: "hunter2-secret"}}}
+	registerSecrets(config)
+	redactLogs()
+
+	c := cron.New()
+	if err := addPersistentJob(c, config, "backup", "@every 1s", func() { panic("can't connect with hunter2-secret") }); err != nil {
+		t.Fatal(err)
+	}
+	c.Start()
+
+	time.Sleep(10 * time.Second)
+	os.Exit(exitOK)
+}
+
+func TestCronPanicIsRedacted(t *testing.T) {
+	cmd := exec.Command(os.Args[0], "-test.run=^TestCronPanicHelper$")
+	cmd.Env = append(os.Environ(), "DBBACKUP_TEST_CRON_PANIC="+t.TempDir())
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	err := cmd.Run()
+	if exitErr, ok := err.(*exec.ExitError); !ok || exitErr.ExitCode() != exitFailure {
+		t.Errorf("panicking job exited with %v, want exit %d", err, exitFailure)
+	}
+	if strings.Contains(output.String(), "hunter2-secret") || !strings.Contains(output.String(), "can't connect with "+redacted) {
+		t.Errorf("panic output isn't redacted:\n%s", output.String())
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Environment variables holding the passwords seed needs, kept off the
+// command line
+const (
+	replicaPasswordVariable     = "DBBACKUP_REPLICA_PASSWORD"
+	replicationPasswordVariable = "DBBACKUP_REPLICATION_PASSWORD"
+)
+
+// Matches the binlog coordinates mysqldump writes as a comment with
+// --source-data=2 or --master-data=2
+var binlogCoordinates = regexp.MustCompile(`(?:MASTER|SOURCE)_LOG_FILE='([^']+)',\s*(?:MASTER|SOURCE)_LOG_POS=(\d+)`)
+
+// The coordinates come before any data, near the start of the dump
+const seedHeadSize = 1024 * 1024
+
+// Pass a dump through while reading the binlog coordinates from its start
+type coordinateWatcher struct {
+	reader   io.Reader
+	bytes    int64
+	head     []byte
+	file     string
+	position int64
+}
+
+func (w *coordinateWatcher) Read(p []byte) (int, error) {
+	n, err := w.reader.Read(p)
+	w.bytes += int64(n)
+
+	if w.file == "" && len(w.head) < seedHeadSize {
+		w.head = append(w.head, p[:n]...)
+		if match := binlogCoordinates.FindSubmatch(w.head); match != nil {
+			w.file = string(match[1])
+			w.position, _ = strconv.ParseInt(string(match[2]), 10, 64)
+			w.head = nil
+		}
+	}
+
+	return n, err
+}
+
+var fullVersionPattern = regexp.MustCompile(`(\d+)\.(\d+)\.(\d+)`)
+
+// Check whether a MySQL version string is at least major.minor.patch.
+// MariaDB versions never are, as they don't have MySQL's newer syntax.
+func mysqlVersionAtLeast(version string, major int, minor int, patch int) bool {
+	match := fullVersionPattern.FindStringSubmatch(version)
+	if match == nil || strings.Contains(strings.ToLower(version), "mariadb") {
+		return false
+	}
+
+	have := []int{0, 0, 0}
+	for i := range have {
+		have[i], _ = strconv.Atoi(match[i+1])
+	}
+	want := []int{major, minor, patch}
+
+	for i := range have {
+		if have[i] != want[i] {
+			return have[i] > want[i]
+		}
+	}
+	return true
+}
+
+// Build the statement pointing a replica at its source, in the syntax the
+// replica's version understands
+func changeSourceStatement(replicaVersion string, host string, port int, user string, password string, file string, position int64) string {
+	options := [][2]string{
+		{"HOST", quoteString(host)},
+		{"PORT", strconv.Itoa(port)},
+		{"USER", quoteString(user)},
+		{"PASSWORD", quoteString(password)},
+		{"LOG_FILE", quoteString(file)},
+		{"LOG_POS", strconv.FormatInt(position, 10)},
+	}
+
+	statement, prefix := "CHANGE MASTER TO", "MASTER_"
+	if mysqlVersionAtLeast(replicaVersion, 8, 0, 23) {
+		statement, prefix = "CHANGE REPLICATION SOURCE TO", "SOURCE_"
+	}
+
+	parts := []string{}
+	for _, option := range options {
+		parts = append(parts, prefix+option[0]+"="+option[1])
+	}
+
+	return statement + " " + strings.Join(parts, ", ")
+}
+
+// List the databases to copy to a replica: everything but the system schemas
+// and exclude_databases, whose users and grants the replica keeps its own of
+func seedDatabases(source DatabaseConfig) ([]string, error) {
+	excluded := map[string]bool{}
+	for _, name := range append(append([]string{}, systemSchemas...), source.ExcludeDatabases...) {
+		excluded[name] = true
+	}
+
+	output, err := mysqlQuery(source, "", "SHOW DATABASES")
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{}
+	for _, name := range strings.Split(strings.TrimSpace(output), "\n") {
+		if name != "" && !excluded[name] {
+			names = append(names, name)
+		}
+	}
+
+	return names, nil
+}
+
+// Dump the source's databases with its binlog coordinates and stream the dump
+// straight into the replica. Returns the binlog file and position the replica
+// starts replicating from.
+func seedReplica(ctx context.Context, source DatabaseConfig, replica DatabaseConfig, databases []string) (string, int64, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	version, _ := mysqlServerVersion(source)
+	args := append(mysqlConnectionArgs(source), mysqlCompatArgs(source, version)...)
+
+	// The old flag still works on newer clients, but warns
+	coordinates := "--master-data=2"
+	if mysqlVersionAtLeast(clientVersion(), 8, 0, 26) {
+		coordinates = "--source-data=2"
+	}
+	args = append(args, "--single-transaction", "--routines", "--events", "--triggers", coordinates, "--databases")
+	args = append(args, databases...)
+
+	stdout, dumpOutput := io.Pipe()
+
+	dump := dumpCommand(ctx, "mysqldump", args...)
+	dump.Env = mysqlEnv(source)
+	var dumpErrors bytes.Buffer
+	dump.Stderr = &dumpErrors
+	dump.Stdout = dumpOutput
+
+	watcher := &coordinateWatcher{reader: stdout}
+	apply := exec.Command("mysql", mysqlConnectionArgs(replica)...)
+	apply.Env = mysqlEnv(replica)
+	var applyOutput bytes.Buffer
+	apply.Stdin = watcher
+	apply.Stdout = &applyOutput
+	apply.Stderr = &applyOutput
+
+	dumped := make(chan error, 1)
+	go func() {
+		err := runProcessGroup(ctx, dump)
+		dumpOutput.Close()
+		dumped <- err
+	}()
+
+	applyErr := runProcessGroup(ctx, apply)
+	if applyErr != nil {
+		// Stop the dump, which would otherwise block writing to the pipe
+		cancel()
+	}
+	stdout.Close()
+	dumpErr := <-dumped
+
+	if applyErr != nil {
+		return "", 0, fmt.Errorf("error applying to %s: %w: %s", replica.Host, applyErr, strings.TrimSpace(applyOutput.String()))
+	}
+	if dumpErr != nil {
+		return "", 0, fmt.Errorf("error dumping %s: %w: %s", source.Host, dumpErr, strings.TrimSpace(dumpErrors.String()))
+	}
+	if watcher.file == "" {
+		return "", 0, fmt.Errorf("no binlog coordinates in the dump, is binary logging enabled on %s?", source.Host)
+	}
+
+	log.Printf("Copied %s from %s to %s\n", formatBytes(watcher.bytes), source.Host, replica.Host)
+
+	return watcher.file, watcher.position, nil
+}
+
+// Handle the seed subcommand, provisioning a replica from a fresh dump of a
+// configured MySQL or MariaDB source. The replica's password is read from
+// DBBACKUP_REPLICA_PASSWORD, defaulting to the source's, and the replication
+// user's from DBBACKUP_REPLICATION_PASSWORD.
+// Usage: seed [--apply] [--force] --replication-user repl <source-host> <replica-host>
+func runSeed(ctx context.Context, config Config, args []string) error {
+	flags := flag.NewFlagSet("seed", flag.ContinueOnError)
+	replicaPort := flags.Int("replica-port", 3306, "port of the replica")
+	replicaUser := flags.String("replica-user", "", "user to load the dump into the replica as, defaults to the source's username")
+	replicationUser := flags.String("replication-user", "", "user the replica replicates from the source as")
+	sourceAddress := flags.String("source-address", "", "host[:port] the replica reaches the source at, defaults to the source's host and port")
+	apply := flags.Bool("apply", false, "run the CHANGE REPLICATION SOURCE statement and start replication instead of only printing it")
+	force := flags.Bool("force", false, "seed a replica that already has databases")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return withExitCode(exitConfig, err)
+	}
+	args = flags.Args()
+
+	if len(args) != 2 || *replicationUser == "" {
+		return withExitCode(exitConfig, fmt.Errorf("usage: dbbackup seed [flags] --replication-user <user> <source-host> <replica-host>"))
+	}
+	sourceHost, replicaHost := args[0], args[1]
+
+	// The source may only be listed in the inventory
+	config, err = withInventory(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	var source *DatabaseConfig
+	for i, db := range config.Databases {
+		if db.Host == sourceHost && (db.Engine == "mysql" || db.Engine == "mariadb") {
+			source = &config.Databases[i]
+			break
+		}
+	}
+	if source == nil {
+		return withExitCode(exitConfig, fmt.Errorf("no configured mysql or mariadb database on host %s", sourceHost))
+	}
+
+	if source.Discovery.enabled() {
+		instances, err := source.discover(ctx)
+		if err != nil {
+			return err
+		}
+		source = &instances[0]
+	}
+
+	replica := *source
+	replica.Host = replicaHost
+	replica.Port = *replicaPort
+	replica.IAMAuth = IAMAuthConfig{}
+	replica.Discovery = DiscoveryConfig{}
+	replica.address = ""
+	if *replicaUser != "" {
+		replica.Username = *replicaUser
+	}
+	if password := os.Getenv(replicaPasswordVariable); password != "" {
+		replica.Password = Secret(password)
+		replaceSecret("", password)
+	}
+
+	replicationPassword := os.Getenv(replicationPasswordVariable)
+	replaceSecret("", replicationPassword)
+
+	host, port := source.connectHost(), source.Port
+	if *sourceAddress != "" {
+		host = *sourceAddress
+		if h, p, err := net.SplitHostPort(*sourceAddress); err == nil {
+			host = h
+			port, err = strconv.Atoi(p)
+			if err != nil {
+				return withExitCode(exitConfig, fmt.Errorf("invalid --source-address %q", *sourceAddress))
+			}
+		}
+	}
+
+	replicaVersion, err := mysqlServerVersion(replica)
+	if err != nil {
+		return fmt.Errorf("error connecting to replica %s: %w", replicaHost, err)
+	}
+
+	databases, err := seedDatabases(*source)
+	if err != nil {
+		return fmt.Errorf("error listing databases on %s: %w", sourceHost, err)
+	}
+	if len(databases) == 0 {
+		return fmt.Errorf("no databases to copy from %s", sourceHost)
+	}
+
+	if !*force {
+		existing, err := seedDatabases(replica)
+		if err != nil {
+			return fmt.Errorf("error listing databases on %s: %w", replicaHost, err)
+		}
+		if len(existing) > 0 {
+			return fmt.Errorf("replica %s already has databases (%s), use --force to seed it anyway", replicaHost, strings.Join(existing, ", "))
+		}
+	}
+
+	log.Printf("Seeding %s from %s with %d databases\n", replicaHost, sourceHost, len(databases))
+
+	file, position, err := seedReplica(ctx, *source, replica, databases)
+	auditLog(config, "seed", replicaHost+" from "+sourceHost, commandTrigger(), err)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Replica %s holds %s up to %s:%d\n", replicaHost, sourceHost, file, position)
+
+	if !*apply {
+		fmt.Println(changeSourceStatement(replicaVersion, host, port, *replicationUser, redacted, file, position) + ";")
+		return nil
+	}
+
+	statement := changeSourceStatement(replicaVersion, host, port, *replicationUser, replicationPassword, file, position)
+	start := "START SLAVE"
+	if mysqlVersionAtLeast(replicaVersion, 8, 0, 22) {
+		start = "START REPLICA"
+	}
+
+	_, err = mysqlQuery(replica, "", statement+"; "+start)
+	auditLog(config, "start_replication", replicaHost+" from "+sourceHost, commandTrigger(), err)
+	if err != nil {
+		return fmt.Errorf("error starting replication on %s: %w", replicaHost, err)
+	}
+
+	log.Printf("Replication started on %s from %s:%d\n", replicaHost, file, position)
+	return nil
+}
@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestSeedReplica(t *testing.T) {
+	fake := newFakeCommands()
+	fake.outputs["mysqldump"] = "-- CHANGE MASTER TO MASTER_LOG_FILE='binlog.000042', MASTER_LOG_POS=1234;\nCREATE DATABASE `shop`;\n"
+	runner = fake
+	defer func() { runner = systemCommands{} }()
+
+	source := DatabaseConfig{Host: "db1", Port: 3306}
+	replica := DatabaseConfig{Host: "db2", Port: 3306}
+
+	file, position, err := seedReplica(context.Background(), source, replica, []string{"shop"})
+	if err != nil || file != "binlog.000042" || position != 1234 {
+		t.Errorf("seeded from %s:%d, %v", file, position, err)
+	}
+
+	// A failing replica stops the dump rather than leaving it blocked on the pipe
+	fake.errs["mysql"] = errors.New("access denied")
+	_, _, err = seedReplica(context.Background(), source, replica, []string{"shop"})
+	if err == nil || !strings.Contains(err.Error(), "error applying to db2") {
+		t.Errorf("seeding a failing replica returned %v", err)
+	}
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// Where releases are published
+const releasesURL = "https://api.github.com/repos/TheCakeChicken/go-dbbackup/releases/latest"
+
+// Hold the parts of a GitHub release needed to update
+type Release struct {
+	TagName string `json:"tag_name"`
+	Assets  []struct {
+		Name string `json:"name"`
+		URL  string `json:"browser_download_url"`
+	} `json:"assets"`
+}
+
+// Find the download URL of a release asset by name
+func (release Release) asset(name string) string {
+	for _, asset := range release.Assets {
+		if asset.Name == name {
+			return asset.URL
+		}
+	}
+
+	return ""
+}
+
+// Fetch the latest release from GitHub
+func latestRelease(client *http.Client) (Release, error) {
+	release := Release{}
+
+	resp, err := client.Get(releasesURL)
+	if err != nil {
+		return release, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return release, fmt.Errorf("unexpected status %s from GitHub", resp.Status)
+	}
+
+	err = json.NewDecoder(resp.Body).Decode(&release)
+	return release, err
+}
+
+// Find the expected SHA-256 of a file in a sha256sum-style checksums file
+func expectedChecksum(client *http.Client, url string, name string) (string, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s downloading checksums", resp.Status)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && strings.TrimPrefix(fields[1], "*") == name {
+			return strings.ToLower(fields[0]), nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	return "", fmt.Errorf("no checksum listed for %s", name)
+}
+
+// Download a file next to dest, checking it against the expected SHA-256, and
+// return the path of the downloaded file
+func downloadVerified(client *http.Client, url string, dest string, checksum string) (string, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s downloading release", resp.Status)
+	}
+
+	// Download into the same directory so the final rename can't cross filesystems
+	file, err := os.CreateTemp(filepath.Dir(dest), ".dbbackup-update-*")
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(file, hash), resp.Body)
+	file.Close()
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+
+	actual := hex.EncodeToString(hash.Sum(nil))
+	if actual != checksum {
+		os.Remove(file.Name())
+		return "", fmt.Errorf("checksum mismatch: expected %s, got %s", checksum, actual)
+	}
+
+	return file.Name(), nil
+}
+
+// Handle the self-update subcommand. Usage: self-update [--check] [--force]
+func runSelfUpdate(args []string) error {
+	flags := flag.NewFlagSet("self-update", flag.ContinueOnError)
+	check := flags.Bool("check", false, "only report whether an update is available")
+	force := flags.Bool("force", false, "reinstall even if already on the latest version")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{Timeout: 5 * time.Minute}
+
+	release, err := latestRelease(client)
+	if err != nil {
+		return fmt.Errorf("error checking for updates: %w", err)
+	}
+
+	latest := strings.TrimPrefix(release.TagName, "v")
+	if latest == strings.TrimPrefix(version, "v") && !*force {
+		log.Printf("Already running the latest version (%s)\n", version)
+		return nil
+	}
+
+	if *check {
+		log.Printf("Version %s is available (running %s)\n", latest, version)
+		return nil
+	}
+
+	name := fmt.Sprintf("go-dbbackup_%s_%s", runtime.GOOS, runtime.GOARCH)
+	binaryURL := release.asset(name)
+	checksumsURL := release.asset("checksums.txt")
+	if binaryURL == "" || checksumsURL == "" {
+		return fmt.Errorf("release %s has no %s binary or checksums.txt", release.TagName, name)
+	}
+
+	checksum, err := expectedChecksum(client, checksumsURL, name)
+	if err != nil {
+		return err
+	}
+
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	executable, err = filepath.EvalSymlinks(executable)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Downloading %s %s\n", name, release.TagName)
+	downloaded, err := downloadVerified(client, binaryURL, executable, checksum)
+	if err != nil {
+		return err
+	}
+
+	err = os.Chmod(downloaded, 0755)
+	if err == nil {
+		err = os.Rename(downloaded, executable)
+	}
+	if err != nil {
+		os.Remove(downloaded)
+		return fmt.Errorf("error replacing %s: %w", executable, err)
+	}
+
+	log.Printf("Updated %s from %s to %s\n", executable, version, latest)
+
+	return nil
+}
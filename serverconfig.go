@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// Default locations of the MySQL server configuration file
+var myCnfPaths = []string{"/etc/my.cnf", "/etc/mysql/my.cnf"}
+
+// Check whether a database host refers to this machine
+func isLocalHost(host string) bool {
+	host = bareHost(host)
+	return host == "" || host == "localhost" || host == "127.0.0.1" || host == "::1"
+}
+
+// Copy a file, preserving nothing but its contents
+func copyFile(src string, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	_, err = io.Copy(out, in)
+	return err
+}
+
+// Capture the server's global variables, status and (when local) configuration
+// file into the dump directory. Returns the files written.
+func captureServerConfig(db DatabaseConfig, dir string, backupTime string) []string {
+	files := []string{}
+	prefix := filepath.Join(dir, fmt.Sprintf("%s_%s_on_%s_server", backupTime, db.Engine, db.Host))
+
+	queries := map[string]string{
+		"variables": "SHOW GLOBAL VARIABLES",
+		"status":    "SHOW GLOBAL STATUS",
+	}
+
+	for name, query := range queries {
+		output, err := mysqlQuery(db, "", query)
+		if err != nil {
+			log.Printf("Error capturing %s from %s: %s\n", query, db.Host, err.Error())
+			continue
+		}
+
+		path := fmt.Sprintf("%s-%s.tsv", prefix, name)
+		err = os.WriteFile(path, []byte(output), 0644)
+		if err != nil {
+			log.Printf("Error writing %s: %s\n", path, err.Error())
+			continue
+		}
+
+		files = append(files, path)
+	}
+
+	if !isLocalHost(db.Host) {
+		return files
+	}
+
+	paths := myCnfPaths
+	if db.MyCnfPath != "" {
+		paths = []string{db.MyCnfPath}
+	}
+
+	for _, src := range paths {
+		if _, err := os.Stat(src); err != nil {
+			continue
+		}
+
+		path := prefix + "-my.cnf"
+		err := copyFile(src, path)
+		if err != nil {
+			log.Printf("Error copying %s: %s\n", src, err.Error())
+			break
+		}
+
+		files = append(files, path)
+		break
+	}
+
+	return files
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Hold the Ed25519 keys run reports and archive manifests are signed with, so
+// tampering with backup metadata can be detected
+type SigningConfig struct {
+	// PEM files, e.g. from "openssl genpkey -algorithm ed25519". The public key
+	// is derived from the private key when only that is set. Hosts that only
+	// restore or audit can be given just the public key.
+	PrivateKey string `yaml:"private_key"`
+	PublicKey  string `yaml:"public_key"`
+}
+
+// Appended to a file's name for its detached signature
+const signatureExtension = ".sig"
+
+// Check whether signatures are made or checked
+func (signing SigningConfig) enabled() bool {
+	return signing.PrivateKey != "" || signing.PublicKey != ""
+}
+
+// Read the PEM block from a key file
+func readPEM(path string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM block found in %s", path)
+	}
+
+	return block.Bytes, nil
+}
+
+// Load the private key signatures are made with
+func (signing SigningConfig) privateKey() (ed25519.PrivateKey, error) {
+	der, err := readPEM(signing.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", signing.PrivateKey, err)
+	}
+
+	private, ok := key.(ed25519.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an Ed25519 private key", signing.PrivateKey)
+	}
+
+	return private, nil
+}
+
+// Load the public key signatures are checked with
+func (signing SigningConfig) publicKey() (ed25519.PublicKey, error) {
+	if signing.PublicKey == "" {
+		private, err := signing.privateKey()
+		if err != nil {
+			return nil, err
+		}
+		return private.Public().(ed25519.PublicKey), nil
+	}
+
+	der, err := readPEM(signing.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+
+	key, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing %s: %w", signing.PublicKey, err)
+	}
+
+	public, ok := key.(ed25519.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an Ed25519 public key", signing.PublicKey)
+	}
+
+	return public, nil
+}
+
+// Check both keys can be loaded
+func (signing SigningConfig) validate(errs *validationErrors) {
+	if signing.PrivateKey != "" {
+		if _, err := signing.privateKey(); err != nil {
+			errs.add("signing: invalid private_key: %s", err.Error())
+		}
+	}
+	if signing.PublicKey != "" {
+		if _, err := signing.publicKey(); err != nil {
+			errs.add("signing: invalid public_key: %s", err.Error())
+		}
+	}
+}
+
+// Write a detached signature for a file next to it, when a private key is
+// configured
+func signFile(config Config, path string) error {
+	if config.Signing.PrivateKey == "" {
+		return nil
+	}
+
+	private, err := config.Signing.privateKey()
+	if err != nil {
+		return err
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	signature := base64.StdEncoding.EncodeToString(ed25519.Sign(private, data))
+	return os.WriteFile(path+signatureExtension, []byte(signature+"\n"), 0644)
+}
+
+// Check a detached signature of some data
+func verifySignature(config Config, data []byte, signature []byte) error {
+	public, err := config.Signing.publicKey()
+	if err != nil {
+		return err
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(signature)))
+	if err != nil {
+		return fmt.Errorf("malformed signature: %w", err)
+	}
+
+	if !ed25519.Verify(public, data, decoded) {
+		return fmt.Errorf("signature does not match")
+	}
+
+	return nil
+}
+
+// Check the signature written next to a file
+func verifyFile(config Config, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	signature, err := os.ReadFile(path + signatureExtension)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("%s is not signed", path)
+		}
+		return err
+	}
+
+	err = verifySignature(config, data, signature)
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	return nil
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"fmt"
+	"log"
+)
+
+// Stages of a run --simulate-failure can make fail, so alerting can be tested
+// without breaking a real database:
+//
+//	dump    every dump fails without connecting to its database
+//	upload  the dumps are taken but the upload fails without sending anything
+//	notify  every notifier fails to send
+var simulatedStages = map[string]bool{
+	"dump":   true,
+	"upload": true,
+	"notify": true,
+}
+
+// Apply --simulate-failure to the config
+func simulateFailure(config Config, stage string) (Config, error) {
+	if stage == "" {
+		return config, nil
+	}
+	if !simulatedStages[stage] {
+		return config, fmt.Errorf("unknown --simulate-failure %q, expected dump, upload or notify", stage)
+	}
+
+	log.Printf("Simulating a %s failure\n", stage)
+	config.simulateFailure = stage
+
+	return config, nil
+}
+
+// Get the error a stage fails with when its failure is being simulated, or nil
+func (config Config) simulatedFailure(stage string) error {
+	if config.simulateFailure != stage {
+		return nil
+	}
+
+	return fmt.Errorf("simulated %s failure", stage)
+}
@@ -0,0 +1,13 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"fmt"
+)
+
+// VSS is a Windows service
+func vssSnapshots(ctx context.Context, paths []string) ([]fileSnapshot, error) {
+	return nil, fmt.Errorf("VSS snapshots are only available on Windows")
+}
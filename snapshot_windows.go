@@ -0,0 +1,58 @@
+//go:build windows
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Take a VSS shadow copy of each volume holding the paths, through WMI as
+// vssadmin can only create them on Windows Server. Needs Administrator.
+func vssSnapshots(ctx context.Context, paths []string) ([]fileSnapshot, error) {
+	snapshots := []fileSnapshot{}
+	taken := map[string]bool{}
+
+	for _, path := range paths {
+		absolute, err := filepath.Abs(path)
+		if err != nil {
+			return snapshots, err
+		}
+		volume := strings.ToUpper(filepath.VolumeName(absolute)) + `\`
+		if taken[volume] {
+			continue
+		}
+
+		script := fmt.Sprintf(`$result = (Get-WmiObject -List Win32_ShadowCopy).Create('%s', 'ClientAccessible')
+if ($result.ReturnValue -ne 0) { throw "Win32_ShadowCopy.Create returned $($result.ReturnValue)" }
+$shadow = Get-WmiObject Win32_ShadowCopy | Where-Object { $_.ID -eq $result.ShadowID }
+Write-Output $shadow.ID $shadow.DeviceObject`, strings.ReplaceAll(volume, "'", "''"))
+
+		output, err := runSnapshotCommand(exec.CommandContext(ctx, "powershell", "-NoProfile", "-NonInteractive", "-Command", script))
+		if err == nil && len(strings.Fields(output)) != 2 {
+			err = fmt.Errorf("unexpected output from creating shadow copy: %s", strings.TrimSpace(output))
+		}
+		if err != nil {
+			removeSnapshots(snapshots)
+			return nil, err
+		}
+
+		fields := strings.Fields(output)
+		id := fields[0]
+		snapshots = append(snapshots, fileSnapshot{
+			source: volume,
+			root:   fields[1] + `\`,
+			remove: func() error {
+				script := fmt.Sprintf(`Get-WmiObject Win32_ShadowCopy | Where-Object { $_.ID -eq '%s' } | ForEach-Object { $_.Delete() }`, id)
+				_, err := runSnapshotCommand(exec.Command("powershell", "-NoProfile", "-NonInteractive", "-Command", script))
+				return err
+			},
+		})
+		taken[volume] = true
+	}
+
+	return snapshots, nil
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Base of the trap and variable OIDs when snmp_oid isn't set, under Net-SNMP's
+// experimental playpen. Sites with their own enterprise number should set one.
+const defaultSNMPOID = "1.3.6.1.4.1.8072.9999.9999.1"
+
+// When the process started, for the trap's sysUpTime
+var processStarted = time.Now()
+
+// Append a BER length
+func berLength(packet []byte, length int) []byte {
+	if length < 0x80 {
+		return append(packet, byte(length))
+	}
+
+	var bytes []byte
+	for ; length > 0; length >>= 8 {
+		bytes = append([]byte{byte(length)}, bytes...)
+	}
+	packet = append(packet, 0x80|byte(len(bytes)))
+	return append(packet, bytes...)
+}
+
+// Encode a BER value from its tag and contents
+func berValue(tag byte, contents []byte) []byte {
+	packet := berLength([]byte{tag}, len(contents))
+	return append(packet, contents...)
+}
+
+// Encode a BER integer, or with another tag an application type such as TimeTicks
+func berInteger(tag byte, value int64) []byte {
+	contents := []byte{}
+	for {
+		contents = append([]byte{byte(value)}, contents...)
+		// Stop once the rest is only the sign of what's been encoded
+		if value >= -128 && value < 128 {
+			break
+		}
+		value >>= 8
+	}
+	return berValue(tag, contents)
+}
+
+// Encode a BER object identifier from its dotted form
+func berOID(oid string) ([]byte, error) {
+	parts := strings.Split(strings.TrimPrefix(oid, "."), ".")
+	if len(parts) < 2 {
+		return nil, fmt.Errorf("invalid OID %q", oid)
+	}
+
+	arcs := make([]uint64, len(parts))
+	for i, part := range parts {
+		arc, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid OID %q", oid)
+		}
+		arcs[i] = arc
+	}
+	if arcs[0] > 2 || arcs[1] >= 40 {
+		return nil, fmt.Errorf("invalid OID %q", oid)
+	}
+
+	// The first two arcs share a byte, and the rest take 7 bits a byte
+	contents := []byte{}
+	arcs = append([]uint64{arcs[0]*40 + arcs[1]}, arcs[2:]...)
+	for _, arc := range arcs {
+		encoded := []byte{byte(arc & 0x7f)}
+		for arc >>= 7; arc > 0; arc >>= 7 {
+			encoded = append([]byte{byte(arc&0x7f) | 0x80}, encoded...)
+		}
+		contents = append(contents, encoded...)
+	}
+
+	return berValue(0x06, contents), nil
+}
+
+// Build the SNMPv2c trap for a notification. The trap is <oid>.0.1 for a
+// failed run and <oid>.0.2 for anything else, with the variables:
+//
+//	<oid>.1.1 event, e.g. "backup.failed"
+//	<oid>.1.2 subject
+//	<oid>.1.3 failed databases, as "host/name" separated by commas
+//	<oid>.1.4 number of failed databases
+func snmpTrap(notifier NotifierConfig, notification Notification) ([]byte, error) {
+	base := notifier.SNMPOID
+	if base == "" {
+		base = defaultSNMPOID
+	}
+	base = strings.TrimPrefix(base, ".")
+
+	community := notifier.SNMPCommunity.reveal()
+	if community == "" {
+		community = "public"
+	}
+
+	trap := base + ".0.2"
+	if notification.Event == "backup.failed" {
+		trap = base + ".0.1"
+	}
+
+	failed := []string{}
+	if notification.Report != nil {
+		for _, db := range notification.Report.Databases {
+			if !db.Success {
+				failed = append(failed, db.Host+"/"+db.Name)
+			}
+		}
+	}
+
+	varbinds := []byte{}
+	add := func(oid string, value []byte) error {
+		encoded, err := berOID(oid)
+		if err != nil {
+			return err
+		}
+		varbinds = append(varbinds, berValue(0x30, append(encoded, value...))...)
+		return nil
+	}
+
+	trapOID, err := berOID(trap)
+	if err != nil {
+		return nil, err
+	}
+
+	// sysUpTime.0 and snmpTrapOID.0 come first in every v2 trap
+	uptime := int64(time.Since(processStarted) / (10 * time.Millisecond))
+	err = add("1.3.6.1.2.1.1.3.0", berInteger(0x43, uptime&0xffffffff))
+	if err == nil {
+		err = add("1.3.6.1.6.3.1.1.4.1.0", trapOID)
+	}
+	if err == nil {
+		err = add(base+".1.1", berValue(0x04, []byte(notification.Event)))
+	}
+	if err == nil {
+		err = add(base+".1.2", berValue(0x04, []byte(notification.Subject)))
+	}
+	if err == nil {
+		err = add(base+".1.3", berValue(0x04, []byte(strings.Join(failed, ","))))
+	}
+	if err == nil {
+		err = add(base+".1.4", berInteger(0x02, int64(len(failed))))
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	pdu := berInteger(0x02, time.Now().UnixNano()&0x7fffffff)
+	pdu = append(pdu, berInteger(0x02, 0)...)
+	pdu = append(pdu, berInteger(0x02, 0)...)
+	pdu = append(pdu, berValue(0x30, varbinds)...)
+
+	message := berInteger(0x02, 1) // SNMPv2c
+	message = append(message, berValue(0x04, []byte(community))...)
+	message = append(message, berValue(0xa7, pdu)...)
+
+	return berValue(0x30, message), nil
+}
+
+// Send an SNMPv2c trap over UDP. The URL is snmp://host:port, the port
+// defaulting to 162. Traps aren't acknowledged, so a lost one goes unnoticed.
+func sendSNMPTrap(ctx context.Context, rawURL string, packet []byte) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "162")
+	}
+
+	dialer := net.Dialer{Timeout: 30 * time.Second}
+	conn, err := dialer.DialContext(ctx, "udp", host)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write(packet)
+	return err
+}
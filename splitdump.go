@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Section comments mysqldump starts each part of a dump with, and the file of
+// a split dump each part goes to. Tables go to a file of their own.
+var dumpSections = []struct {
+	prefix string
+	file   string
+}{
+	{"-- Table structure for table ", ""},
+	{"-- Dumping data for table ", ""},
+	{"-- Temporary view structure for view ", "views"},
+	{"-- Temporary table structure for view ", "views"},
+	{"-- Final view structure for view ", "views"},
+	{"-- Dumping events for database ", "programs"},
+	{"-- Dumping routines for database ", "programs"},
+}
+
+// Section comments are short, so longer lines are passed on without looking
+const maxSectionLine = 1024
+
+// A file of a split dump being written
+type splitFile struct {
+	file *os.File
+	gz   *gzip.Writer
+	w    io.Writer
+}
+
+// Split a mysqldump of one database into the same layout as a parallel dump,
+// tables/<table>.sql, views.sql and programs.sql, as it's written. The
+// settings at the start of the dump are repeated at the start of each file.
+type dumpSplitter struct {
+	dir       string
+	extension string
+	level     int
+
+	header  []byte
+	current *splitFile
+	files   map[string]*splitFile
+
+	// The start of a line not finished by the last write, or whether it was
+	// too long to be a section comment and has been passed on already
+	partial []byte
+	long    bool
+}
+
+func (s *dumpSplitter) Write(p []byte) (int, error) {
+	n := len(p)
+
+	for len(p) > 0 {
+		i := bytes.IndexByte(p, '\n')
+		if i < 0 {
+			if s.long {
+				return n, s.emit(p)
+			}
+
+			s.partial = append(s.partial, p...)
+			if len(s.partial) > maxSectionLine {
+				err := s.emit(s.partial)
+				s.partial = s.partial[:0]
+				s.long = true
+				return n, err
+			}
+			return n, nil
+		}
+
+		line := p[:i+1]
+		p = p[i+1:]
+
+		var err error
+		if s.long {
+			err = s.emit(line)
+			s.long = false
+		} else if len(s.partial) > 0 {
+			s.partial = append(s.partial, line...)
+			err = s.line(s.partial)
+			s.partial = s.partial[:0]
+		} else {
+			err = s.line(line)
+		}
+		if err != nil {
+			return n - len(p), err
+		}
+	}
+
+	return n, nil
+}
+
+// Handle a whole line, switching files at section comments
+func (s *dumpSplitter) line(line []byte) error {
+	if bytes.HasPrefix(line, []byte("-- ")) {
+		text := strings.TrimSpace(string(line))
+
+		for _, section := range dumpSections {
+			if !strings.HasPrefix(text, section.prefix) {
+				continue
+			}
+
+			name := section.file
+			if name == "" {
+				table, _ := parseIdentifier(strings.TrimPrefix(text, section.prefix))
+				name = filepath.Join("tables", url.PathEscape(table))
+			}
+
+			file, err := s.open(name)
+			if err != nil {
+				return err
+			}
+			s.current = file
+			break
+		}
+	}
+
+	return s.emit(line)
+}
+
+// Write to the current file, or the header before the first section
+func (s *dumpSplitter) emit(data []byte) error {
+	if s.current == nil {
+		s.header = append(s.header, data...)
+		return nil
+	}
+
+	_, err := s.current.w.Write(data)
+	return err
+}
+
+// Get a file of the split dump, creating it with the header the first time
+func (s *dumpSplitter) open(name string) (*splitFile, error) {
+	if file, ok := s.files[name]; ok {
+		return file, nil
+	}
+
+	out, err := os.Create(filepath.Join(s.dir, name+s.extension))
+	if err != nil {
+		return nil, err
+	}
+
+	file := &splitFile{file: out, w: out}
+	if s.extension == ".sql.gz" {
+		file.gz, err = gzip.NewWriterLevel(out, s.level)
+		if err != nil {
+			out.Close()
+			return nil, err
+		}
+		file.w = file.gz
+	}
+	s.files[name] = file
+
+	_, err = file.w.Write(s.header)
+	return file, err
+}
+
+// Finish every file, handling a last line without a newline
+func (s *dumpSplitter) Close() error {
+	if len(s.partial) > 0 {
+		err := s.line(s.partial)
+		s.partial = nil
+		if err != nil {
+			return err
+		}
+	}
+
+	var firstErr error
+	for _, file := range s.files {
+		if file.gz != nil {
+			if err := file.gz.Close(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+		if err := file.file.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// Dump a database with a single mysqldump, so it's consistent as a whole, and
+// split the output into a file per table in dir as it's written, masking and
+// compressing as configured
+func splitMySQLDump(ctx context.Context, config Config, db DatabaseConfig, tool string, args []string, dir string) error {
+	err := os.MkdirAll(filepath.Join(dir, "tables"), 0755)
+	if err != nil {
+		return err
+	}
+
+	splitter := &dumpSplitter{dir: dir, extension: ".sql", level: config.CompressionLevel, files: map[string]*splitFile{}}
+	if config.CompressDumps {
+		splitter.extension = ".sql.gz"
+	}
+
+	cmd := dumpCommand(ctx, tool, args...)
+	cmd.Env = mysqlEnv(db)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	if len(db.Masking) > 0 {
+		err = maskStream(stdout, splitter, db.Masking)
+	} else {
+		_, err = copyBuffered(splitter, stdout)
+	}
+
+	// Nothing is reading the output any more, so the dump can't finish by itself
+	if err != nil {
+		cmd.Process.Kill()
+	}
+
+	closeErr := splitter.Close()
+	waitErr := cmd.Wait()
+	if waitErr != nil {
+		return fmt.Errorf("%w: %s", waitErr, strings.TrimSpace(stderr.String()))
+	}
+	if err != nil {
+		return err
+	}
+
+	return closeErr
+}
+
+// Keep only the table files of the given tables, for restoring part of a
+// split or parallel dump
+func filterTableFiles(files []string, dir string, tables []string) []string {
+	wanted := map[string]bool{}
+	for _, table := range tables {
+		wanted[url.PathEscape(table)] = true
+	}
+
+	kept := []string{}
+	for _, file := range files {
+		if filepath.Dir(file) != filepath.Join(dir, "tables") {
+			continue
+		}
+
+		name := strings.TrimSuffix(strings.TrimSuffix(filepath.Base(file), ".gz"), ".sql")
+		if wanted[name] {
+			kept = append(kept, file)
+		}
+	}
+
+	return kept
+}
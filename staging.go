@@ -0,0 +1,63 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"path/filepath"
+)
+
+// Resolve symlinks so space is checked on the volume a directory really lives on
+func realDir(dir string) string {
+	real, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return dir
+	}
+
+	return real
+}
+
+// Check there's room for the previous run's dumps in the dump directory and
+// its archive in the temp directory, counting both against the same volume
+// when they share one. Runs with nothing to compare against always pass.
+func checkStagingSpace(config Config, previous *RunReport) error {
+	if previous == nil {
+		return nil
+	}
+
+	var dumpBytes int64
+	for _, db := range previous.Databases {
+		if db.ArchiveKey == "" {
+			dumpBytes += db.SizeBytes
+		}
+	}
+	archiveBytes := previous.ArchiveSizeBytes
+
+	dumps := realDir(config.DumpDir)
+	temp := realDir(config.TempDir)
+
+	if sameVolume(dumps, temp) {
+		return checkFreeSpace("dump_dir and temp_dir", dumps, dumpBytes+archiveBytes)
+	}
+
+	err := checkFreeSpace("dump_dir", dumps, dumpBytes)
+	if err != nil {
+		return err
+	}
+
+	return checkFreeSpace("temp_dir", temp, archiveBytes)
+}
+
+// Check a directory's volume has at least needed bytes free
+func checkFreeSpace(name string, dir string, needed int64) error {
+	free, err := freeSpace(dir)
+	if err != nil {
+		log.Printf("Error checking free space in %s: %s\n", dir, err.Error())
+		return nil
+	}
+
+	if free < needed {
+		return fmt.Errorf("%s (%s) has %s free but the last run needed %s", name, dir, formatBytes(free), formatBytes(needed))
+	}
+
+	return nil
+}
@@ -0,0 +1,675 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// Prefix shared by the names of every file this tool uploads for a run
+const backupNamePrefix = "sql_backup_at_"
+
+// Hold the configuration of a single place archives are stored
+type TargetConfig struct {
+	Name string `yaml:"name"`
+	Type string `yaml:"type"` // "s3", "local" or "plugin"
+
+	// Local targets
+	Path string `yaml:"path"`
+
+	// Plugin targets: the command run for each operation, speaking the JSON
+	// protocol in plugins.go, and settings passed through to it
+	Command string            `yaml:"command"`
+	Options map[string]string `yaml:"options"`
+
+	// S3 targets
+	AccessKey    string `yaml:"access_key"`
+	AccessSecret Secret `yaml:"access_secret"`
+	SessionToken Secret `yaml:"session_token"`
+	Region       string `yaml:"region"`
+	Bucket       string `yaml:"bucket"`
+	Prefix       string `yaml:"prefix"`
+	S3Overrides  `yaml:",inline"`
+
+	// URL of an S3-compatible store such as MinIO, addressed by path
+	Endpoint string `yaml:"endpoint"`
+
+	// Role to assume for S3 access. Its credentials are refreshed as they expire.
+	RoleARN    string `yaml:"role_arn"`
+	ExternalID string `yaml:"external_id"`
+
+	// Assume the role with a federated identity instead of AWS credentials:
+	// "gcp" for the GCP service account, "azure" for the Azure managed identity
+	// (client_id picks a user-assigned one), or a path to an OIDC token file
+	WebIdentity         string `yaml:"web_identity"`
+	WebIdentityAudience string `yaml:"web_identity_audience"`
+	WebIdentityClientID string `yaml:"web_identity_client_id"`
+
+	// How long to keep backups on this target, e.g. "7d", "90d" or "7y". Empty keeps them forever.
+	Retention string `yaml:"retention"`
+
+	// Tags applied to the object being uploaded
+	tags map[string]string
+
+	// Headers S3 serves the object being uploaded with, when set
+	contentType  string
+	cacheControl string
+
+	// User metadata stored with the object being uploaded
+	metadata map[string]string
+}
+
+// Hold the object settings applied to S3 uploads, which can be set per target
+// and overridden per database
+type S3Overrides struct {
+	StorageClass         string `yaml:"storage_class" json:"storage_class,omitempty"`
+	ServerSideEncryption string `yaml:"server_side_encryption" json:"server_side_encryption,omitempty"` // "AES256" or "aws:kms"
+	KMSKeyID             string `yaml:"kms_key_id" json:"kms_key_id,omitempty"`
+	ACL                  string `yaml:"acl" json:"acl,omitempty"`
+}
+
+// Check whether any setting is overridden
+func (o S3Overrides) set() bool {
+	return o != S3Overrides{}
+}
+
+// Get a copy of the target with the given settings taking precedence
+func (target TargetConfig) withOverrides(o S3Overrides) TargetConfig {
+	if o.StorageClass != "" {
+		target.StorageClass = o.StorageClass
+	}
+	if o.ServerSideEncryption != "" {
+		target.ServerSideEncryption = o.ServerSideEncryption
+	}
+	if o.KMSKeyID != "" {
+		target.KMSKeyID = o.KMSKeyID
+	}
+	if o.ACL != "" {
+		target.ACL = o.ACL
+	}
+
+	return target
+}
+
+// Get the input for a server-side copy onto the target, applying its object settings
+func (target TargetConfig) copyInput(source string, key string) *s3.CopyObjectInput {
+	input := &s3.CopyObjectInput{
+		Bucket:     aws.String(target.Bucket),
+		Key:        aws.String(key),
+		CopySource: aws.String(source),
+	}
+	if target.StorageClass != "" {
+		input.StorageClass = aws.String(target.StorageClass)
+	}
+	if target.ServerSideEncryption != "" {
+		input.ServerSideEncryption = aws.String(target.ServerSideEncryption)
+	}
+	if target.KMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(target.KMSKeyID)
+	}
+	if target.ACL != "" {
+		input.ACL = aws.String(target.ACL)
+	}
+
+	return input
+}
+
+// Hold the result of uploading to a single target
+type TargetReport struct {
+	Name  string `json:"name"`
+	Key   string `json:"key"`
+	Error string `json:"error,omitempty"`
+
+	// The KMS key the object was encrypted with, when one is configured
+	KMSKeyID string `json:"kms_key_id,omitempty"`
+
+	// SHA-256 of the data sent to the target, and how many uploads it took
+	// when it had to be retried
+	SHA256   string `json:"sha256,omitempty"`
+	Attempts int    `json:"attempts,omitempty"`
+}
+
+// Get the primary S3 target described by s3_config
+func (config Config) primaryTarget() TargetConfig {
+	return TargetConfig{
+		Name:         "s3",
+		Type:         "s3",
+		AccessKey:    config.S3Config.AccessKey,
+		AccessSecret: config.S3Config.AccessSecret,
+		SessionToken: config.S3Config.SessionToken,
+		Region:       config.S3Config.Region,
+		Bucket:       config.S3Config.Bucket,
+		S3Overrides:  config.S3Config.S3Overrides,
+		Endpoint:     config.S3Config.Endpoint,
+		RoleARN:      config.S3Config.RoleARN,
+		ExternalID:   config.S3Config.ExternalID,
+		Retention:    config.S3Config.Retention,
+
+		WebIdentity:         config.S3Config.WebIdentity,
+		WebIdentityAudience: config.S3Config.WebIdentityAudience,
+		WebIdentityClientID: config.S3Config.WebIdentityClientID,
+	}
+}
+
+// Get every configured storage target, starting with the primary S3 bucket
+func (config Config) targets() []TargetConfig {
+	targets := []TargetConfig{}
+
+	if config.S3Config.Bucket != "" {
+		targets = append(targets, config.primaryTarget())
+	}
+
+	for i, target := range config.Targets {
+		if target.Name == "" {
+			target.Name = fmt.Sprintf("%s-%d", target.Type, i+1)
+		}
+		targets = append(targets, target)
+	}
+
+	return targets
+}
+
+// Parse a duration that may also be given in days, weeks or years
+func parseDuration(value string) (time.Duration, error) {
+	units := map[string]time.Duration{
+		"d": 24 * time.Hour,
+		"w": 7 * 24 * time.Hour,
+		"y": 365 * 24 * time.Hour,
+	}
+
+	for suffix, unit := range units {
+		if strings.HasSuffix(value, suffix) {
+			n, err := strconv.Atoi(strings.TrimSuffix(value, suffix))
+			if err != nil {
+				return 0, fmt.Errorf("invalid duration %q", value)
+			}
+			return time.Duration(n) * unit, nil
+		}
+	}
+
+	return time.ParseDuration(value)
+}
+
+// Get the full key or path of a file on the target
+func (target TargetConfig) key(name string) string {
+	return path.Join(target.Prefix, name)
+}
+
+// Create a session for the target's S3 credentials
+func (target TargetConfig) session() (*session.Session, error) {
+	awsConfig := &aws.Config{
+		Credentials: target.credentials(),
+		Region:      aws.String(target.Region),
+	}
+
+	// Only S3 goes to the endpoint, STS is still AWS's for assuming roles
+	if target.Endpoint != "" {
+		awsConfig.S3ForcePathStyle = aws.Bool(true)
+		awsConfig.EndpointResolver = endpoints.ResolverFunc(func(service string, region string, opts ...func(*endpoints.Options)) (endpoints.ResolvedEndpoint, error) {
+			if service == endpoints.S3ServiceID {
+				return endpoints.ResolvedEndpoint{URL: target.Endpoint, SigningRegion: region}, nil
+			}
+			return endpoints.DefaultResolver().EndpointFor(service, region, opts...)
+		})
+	}
+
+	sess, err := session.NewSession(awsConfig)
+
+	if err != nil {
+		return nil, fmt.Errorf("error creating S3 session: %w", err)
+	}
+
+	if target.RoleARN != "" {
+		sess.Config.Credentials = assumeRoleCredentials(sess, target)
+	}
+
+	return sess, nil
+}
+
+// Create a session for the primary S3 bucket
+func newS3Session(config Config) (*session.Session, error) {
+	return config.primaryTarget().session()
+}
+
+// Upload a local file to the target under the given name
+func (target TargetConfig) upload(ctx context.Context, config Config, localPath string, name string, showProgress bool) error {
+	file, err := os.Open(localPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	body := &progressFile{ctx: ctx, file: file}
+
+	if showProgress {
+		stopProgress := watchProgress(fmt.Sprintf("Uploading %s to %s", name, target.Name), config.progressInterval(), fileSize(localPath), body.bytesRead)
+		defer stopProgress()
+	}
+
+	uploader, err := target.uploader()
+	if err != nil {
+		return err
+	}
+	if uploader != nil {
+		release, err := reserveUploadMemory(ctx, []*s3manager.Uploader{uploader}, fileSize(localPath))
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	defer trackUpload(config, target, target.key(name))()
+	stopWatchdog := watchStall(fmt.Sprintf("Upload of %s to %s", name, target.Name), config.stallTimeout(), body.bytesRead, cancel)
+
+	err = target.uploadFrom(ctx, body, name, uploader)
+	if stopWatchdog() {
+		err = stallError("upload", config.stallTimeout())
+	}
+
+	return err
+}
+
+// Build the uploader for an S3 target, or nil for targets that don't need one
+func (target TargetConfig) uploader() (*s3manager.Uploader, error) {
+	if target.Type != "s3" {
+		return nil, nil
+	}
+
+	sess, err := target.session()
+	if err != nil {
+		return nil, err
+	}
+
+	return s3manager.NewUploader(sess, func(u *s3manager.Uploader) {
+		// The SDK aborts with the request's context, which fails once it's
+		// cancelled, so failed multipart uploads are aborted below instead
+		u.LeavePartsOnError = true
+	}), nil
+}
+
+// Upload everything read from body to the target, with the uploader from
+// uploader() for S3 targets
+func (target TargetConfig) uploadFrom(ctx context.Context, body io.Reader, name string, uploader *s3manager.Uploader) error {
+	switch target.Type {
+	case "local":
+		dest := filepath.Join(target.Path, target.key(name))
+
+		err := os.MkdirAll(filepath.Dir(dest), 0755)
+		if err != nil {
+			return err
+		}
+
+		out, err := os.Create(dest)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+
+		_, err = out.ReadFrom(body)
+		return err
+	case "plugin":
+		return target.pluginUpload(ctx, body, name)
+	case "s3":
+		input := &s3manager.UploadInput{
+			Bucket: aws.String(target.Bucket),
+			Key:    aws.String(target.key(name)),
+			Body:   body,
+		}
+		if target.StorageClass != "" {
+			input.StorageClass = aws.String(target.StorageClass)
+		}
+		if target.ServerSideEncryption != "" {
+			input.ServerSideEncryption = aws.String(target.ServerSideEncryption)
+		}
+		if target.KMSKeyID != "" {
+			input.SSEKMSKeyId = aws.String(target.KMSKeyID)
+		}
+		if target.ACL != "" {
+			input.ACL = aws.String(target.ACL)
+		}
+		if len(target.tags) > 0 {
+			input.Tagging = aws.String(objectTagging(target.tags))
+		}
+		if target.contentType != "" {
+			input.ContentType = aws.String(target.contentType)
+		}
+		if target.cacheControl != "" {
+			input.CacheControl = aws.String(target.cacheControl)
+		}
+		if len(target.metadata) > 0 {
+			input.Metadata = aws.StringMap(target.metadata)
+		}
+
+		_, err := uploader.UploadWithContext(ctx, input)
+		if failure, ok := err.(s3manager.MultiUploadFailure); ok {
+			_, abortErr := uploader.S3.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+				Bucket:   aws.String(target.Bucket),
+				Key:      aws.String(target.key(name)),
+				UploadId: aws.String(failure.UploadID()),
+			})
+			if abortErr != nil {
+				log.Printf("Error aborting upload of %s to %s: %s\n", name, target.Name, abortErr.Error())
+			}
+		}
+		return err
+	}
+
+	return fmt.Errorf("unknown target type %q", target.Type)
+}
+
+// Upload a local file to every target, returning the result for each
+func uploadToTargets(ctx context.Context, config Config, localPath string, name string, showProgress bool) []TargetReport {
+	return uploadToTargetsWithOverrides(ctx, config, localPath, name, showProgress, S3Overrides{}, config.Labels)
+}
+
+// Upload a local file to every target with per-database S3 settings applied
+// and the labels as object tags, returning the result for each. The file is
+// streamed to every target at once, then failed uploads are retried alone.
+func uploadToTargetsWithOverrides(ctx context.Context, config Config, localPath string, name string, showProgress bool, overrides S3Overrides, labels map[string]string) []TargetReport {
+	targets := []TargetConfig{}
+	reports := []TargetReport{}
+	metadata := config.agentInfo().objectMetadata()
+
+	for _, target := range config.targets() {
+		target = target.withOverrides(overrides)
+		target.tags = labels
+		target.metadata = metadata
+		targets = append(targets, target)
+
+		log.Printf("Uploading %s to %s\n", name, target.Name)
+
+		report := TargetReport{Name: target.Name, Key: target.key(name)}
+		if target.Type == "s3" {
+			report.KMSKeyID = target.KMSKeyID
+		}
+		reports = append(reports, report)
+	}
+
+	errs, checksums := teeUpload(ctx, config, targets, localPath, name, showProgress)
+
+	for i, target := range targets {
+		reports[i].SHA256 = checksums[i]
+
+		err := errs[i]
+		if err != nil {
+			log.Printf("Error uploading %s to %s: %s\n", name, target.Name, err.Error())
+
+			if config.uploadRetries() > 0 {
+				reports[i].Attempts, reports[i].SHA256, err = retryUpload(ctx, config, target, localPath, name, showProgress, err)
+			}
+		}
+		if err != nil {
+			reports[i].Error = err.Error()
+		}
+	}
+
+	return reports
+}
+
+// Hold a backup file stored on a target
+type StoredObject struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+}
+
+// List the backup files stored on the target
+func (target TargetConfig) list(ctx context.Context) ([]StoredObject, error) {
+	return target.listPrefix(ctx, backupNamePrefix)
+}
+
+// List the files stored on the target whose names start with the prefix
+func (target TargetConfig) listPrefix(ctx context.Context, prefix string) ([]StoredObject, error) {
+	objects := []StoredObject{}
+
+	switch target.Type {
+	case "local":
+		dir := filepath.Join(target.Path, target.Prefix)
+
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			if os.IsNotExist(err) {
+				return objects, nil
+			}
+			return nil, err
+		}
+
+		for _, entry := range entries {
+			if entry.IsDir() || !strings.HasPrefix(entry.Name(), prefix) {
+				continue
+			}
+
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+
+			objects = append(objects, StoredObject{
+				Key:          target.key(entry.Name()),
+				Size:         info.Size(),
+				LastModified: info.ModTime(),
+			})
+		}
+
+		return objects, nil
+	case "plugin":
+		return target.pluginList(ctx, prefix)
+	case "s3":
+		sess, err := target.session()
+		if err != nil {
+			return nil, err
+		}
+
+		err = s3.New(sess).ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+			Bucket: aws.String(target.Bucket),
+			Prefix: aws.String(target.key(prefix)),
+		}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, object := range page.Contents {
+				objects = append(objects, StoredObject{
+					Key:          aws.StringValue(object.Key),
+					Size:         aws.Int64Value(object.Size),
+					LastModified: aws.TimeValue(object.LastModified),
+				})
+			}
+			return true
+		})
+
+		return objects, err
+	}
+
+	return nil, fmt.Errorf("unknown target type %q", target.Type)
+}
+
+// Delete a single backup file from the target
+func (target TargetConfig) delete(ctx context.Context, key string) error {
+	switch target.Type {
+	case "local":
+		return os.Remove(filepath.Join(target.Path, key))
+	case "plugin":
+		return target.pluginDelete(ctx, key)
+	case "s3":
+		sess, err := target.session()
+		if err != nil {
+			return err
+		}
+
+		_, err = s3.New(sess).DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+			Bucket: aws.String(target.Bucket),
+			Key:    aws.String(key),
+		})
+		return err
+	}
+
+	return fmt.Errorf("unknown target type %q", target.Type)
+}
+
+// Open a single file stored on the target for reading
+func (target TargetConfig) open(ctx context.Context, key string) (io.ReadCloser, error) {
+	switch target.Type {
+	case "local":
+		return os.Open(filepath.Join(target.Path, key))
+	case "plugin":
+		return target.pluginOpen(ctx, key)
+	case "s3":
+		sess, err := target.session()
+		if err != nil {
+			return nil, err
+		}
+
+		output, err := s3.New(sess).GetObjectWithContext(ctx, &s3.GetObjectInput{
+			Bucket: aws.String(target.Bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			return nil, err
+		}
+		return output.Body, nil
+	}
+
+	return nil, fmt.Errorf("unknown target type %q", target.Type)
+}
+
+// Delete backups older than the target's retention period, only listing them
+// when dryRun is set. Returns an error if anything couldn't be deleted.
+func pruneTarget(ctx context.Context, config Config, target TargetConfig, trigger string, dryRun bool) error {
+	retention, err := parseDuration(target.Retention)
+	if err != nil {
+		return fmt.Errorf("invalid retention for %s: %w", target.Name, err)
+	}
+
+	store := storeFor(target)
+
+	objects, err := store.list(ctx)
+	if err != nil {
+		return fmt.Errorf("error listing backups on %s: %w", target.Name, err)
+	}
+
+	cutoff := clk.Now().Add(-retention)
+
+	// Runs within the retention keep the older archives they depend on
+	refs, err := retainedReferences(config, target.Retention)
+	if err != nil {
+		return fmt.Errorf("not pruning %s, error reading the reports of retained runs: %w", target.Name, err)
+	}
+
+	failed := 0
+	for _, object := range objects {
+		if !object.LastModified.Before(cutoff) {
+			continue
+		}
+
+		if refs.referenced(target, object.Key) {
+			log.Printf("Keeping %s on %s, a retained backup depends on it\n", object.Key, target.Name)
+			continue
+		}
+
+		if dryRun {
+			log.Printf("Would prune %s from %s\n", object.Key, target.Name)
+			continue
+		}
+
+		log.Printf("Pruning %s from %s\n", object.Key, target.Name)
+
+		err := store.delete(ctx, object.Key)
+		if err != nil {
+			log.Printf("Error pruning %s from %s: %s\n", object.Key, target.Name, err.Error())
+			failed++
+		}
+
+		auditLog(config, "prune_"+target.Type, target.Name+":"+object.Key, trigger, err)
+	}
+
+	// Chunks are shared between backups, so only go once no retained index uses them
+	if config.Dedup.Enabled && target.Name == config.primaryTarget().Name {
+		_, err := collectChunks(ctx, config, refs, cutoff, dryRun, trigger)
+		if err != nil {
+			return fmt.Errorf("error pruning the dedup repository: %w", err)
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("error pruning %d backups from %s", failed, target.Name)
+	}
+
+	return nil
+}
+
+// Collect what the runs within a retention refer to, as garbage collection
+// does for every reported run. Differentials keep their base full dumps and
+// unchanged databases the archives they reference, however old.
+func retainedReferences(config Config, retention string) (gcReferences, error) {
+	files, err := loadReportFiles(config.ReportsDir)
+	if err != nil {
+		return gcReferences{}, err
+	}
+
+	keep := keptReports(HistoryConfig{MaxAge: retention}, files, clk.Now())
+
+	retained := []ReportFile{}
+	for i, file := range files {
+		if keep[i] {
+			retained = append(retained, file)
+		}
+	}
+
+	return reportReferences(config, retained)
+}
+
+// Delete the backups that have outlived their target's retention now, instead
+// of after the next backup. Usage: prune [--target name] [--dry-run]
+func runPrune(ctx context.Context, config Config, args []string) error {
+	flags := flag.NewFlagSet("prune", flag.ContinueOnError)
+	only := flags.String("target", "", "only prune this storage target")
+	dryRun := flags.Bool("dry-run", false, "list what would be deleted without deleting anything")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return withExitCode(exitConfig, err)
+	}
+
+	found := false
+	failed := []string{}
+	for _, target := range config.targets() {
+		if *only != "" && target.Name != *only {
+			continue
+		}
+		found = true
+
+		if target.Retention == "" {
+			log.Printf("No retention configured for %s, keeping everything\n", target.Name)
+			continue
+		}
+
+		err := pruneTarget(ctx, config, target, commandTrigger(), *dryRun)
+		if err != nil {
+			log.Printf("%s\n", err.Error())
+			failed = append(failed, err.Error())
+		}
+	}
+
+	if *only != "" && !found {
+		return withExitCode(exitConfig, fmt.Errorf("no storage target named %q", *only))
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("%s", strings.Join(failed, "; "))
+	}
+
+	return nil
+}
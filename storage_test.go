@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Write a run report into the reports directory
+func writeTestReport(t *testing.T, dir string, report RunReport) {
+	t.Helper()
+
+	data, err := json.Marshal(report)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	name := "report_" + report.StartedAt.Format("2006-01-02T15-04-05") + ".json"
+	if err := os.WriteFile(filepath.Join(dir, name), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPruneKeepsReferencedArchives(t *testing.T) {
+	now := time.Date(2026, 3, 31, 2, 0, 0, 0, time.UTC)
+	clk = newFakeClock(now)
+	defer func() { clk = systemClock{} }()
+
+	old := now.AddDate(0, 0, -20)
+	full := backupNamePrefix + "full.tar.gz"
+	unchanged := backupNamePrefix + "unchanged.tar.gz"
+	expired := backupNamePrefix + "expired.tar.gz"
+	differential := backupNamePrefix + "differential.tar.gz"
+
+	store := newMemoryStore()
+	for _, key := range []string{full, unchanged, expired} {
+		store.put(key, []byte("archive"), old)
+	}
+	store.put(differential, []byte("archive"), now)
+	storeFor = func(TargetConfig) objectStore { return store }
+	defer func() { storeFor = func(target TargetConfig) objectStore { return target } }()
+
+	config := Config{ReportsDir: t.TempDir()}
+	writeTestReport(t, config.ReportsDir, RunReport{StartedAt: old, ArchiveKey: full})
+	writeTestReport(t, config.ReportsDir, RunReport{StartedAt: old.Add(time.Hour), ArchiveKey: unchanged})
+	writeTestReport(t, config.ReportsDir, RunReport{StartedAt: old.Add(2 * time.Hour), ArchiveKey: expired})
+	writeTestReport(t, config.ReportsDir, RunReport{StartedAt: now, ArchiveKey: differential, Databases: []DatabaseReport{
+		{Name: "shop", Kind: "differential", Base: &BackupReference{ArchiveKey: full}},
+		{Name: "blog", Skipped: true, Reference: &BackupReference{ArchiveKey: unchanged}},
+	}})
+
+	err := pruneTarget(context.Background(), config, TargetConfig{Name: "primary", Type: "local", Retention: "7d"}, "manual", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range []string{full, unchanged, differential} {
+		if !store.has(key) {
+			t.Errorf("%s was pruned", key)
+		}
+	}
+	if store.has(expired) {
+		t.Errorf("%s was kept", expired)
+	}
+}
+
+func TestPruneDryRunDeletesNothing(t *testing.T) {
+	now := time.Date(2026, 3, 31, 2, 0, 0, 0, time.UTC)
+	clk = newFakeClock(now)
+	defer func() { clk = systemClock{} }()
+
+	key := backupNamePrefix + "expired.tar.gz"
+	store := newMemoryStore()
+	store.put(key, []byte("archive"), now.AddDate(0, 0, -20))
+	storeFor = func(TargetConfig) objectStore { return store }
+	defer func() { storeFor = func(target TargetConfig) objectStore { return target } }()
+
+	config := Config{ReportsDir: t.TempDir()}
+	err := pruneTarget(context.Background(), config, TargetConfig{Name: "primary", Type: "local", Retention: "7d"}, "manual", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !store.has(key) {
+		t.Error("dry run deleted the archive")
+	}
+}
+
+func TestPruneFailsWhenDeletesFail(t *testing.T) {
+	now := time.Date(2026, 3, 31, 2, 0, 0, 0, time.UTC)
+	clk = newFakeClock(now)
+	defer func() { clk = systemClock{} }()
+
+	failing := backupNamePrefix + "failing.tar.gz"
+	expired := backupNamePrefix + "expired.tar.gz"
+	store := newMemoryStore()
+	store.put(failing, []byte("archive"), now.AddDate(0, 0, -20))
+	store.put(expired, []byte("archive"), now.AddDate(0, 0, -20))
+	store.errs[failing] = errors.New("access denied")
+	storeFor = func(TargetConfig) objectStore { return store }
+	defer func() { storeFor = func(target TargetConfig) objectStore { return target } }()
+
+	config := Config{
+		ReportsDir: t.TempDir(),
+		Targets:    []TargetConfig{{Name: "backup", Type: "local", Retention: "7d"}},
+	}
+
+	err := runPrune(context.Background(), config, nil)
+	if err == nil || !strings.Contains(err.Error(), "error pruning 1 backups from backup") {
+		t.Errorf("prune with a failing delete returned %v", err)
+	}
+	if exitCode(err) == exitOK {
+		t.Error("prune with a failing delete exits successfully")
+	}
+	if store.has(expired) {
+		t.Error("the failing delete stopped the others")
+	}
+}
+
+func TestPruneRetentionFollowsTheClock(t *testing.T) {
+	start := time.Date(2026, 3, 1, 2, 0, 0, 0, time.UTC)
+	fake := newFakeClock(start)
+	clk = fake
+	defer func() { clk = systemClock{} }()
+
+	full := backupNamePrefix + "full.tar.gz"
+	differential := backupNamePrefix + "differential.tar.gz"
+	store := newMemoryStore()
+	store.put(full, []byte("archive"), start)
+	store.put(differential, []byte("archive"), start.AddDate(0, 0, 5))
+	storeFor = func(TargetConfig) objectStore { return store }
+	defer func() { storeFor = func(target TargetConfig) objectStore { return target } }()
+
+	config := Config{ReportsDir: t.TempDir()}
+	writeTestReport(t, config.ReportsDir, RunReport{StartedAt: start, ArchiveKey: full})
+	writeTestReport(t, config.ReportsDir, RunReport{StartedAt: start.AddDate(0, 0, 5), ArchiveKey: differential, Databases: []DatabaseReport{
+		{Name: "shop", Kind: "differential", Base: &BackupReference{ArchiveKey: full}},
+	}})
+	target := TargetConfig{Name: "primary", Type: "local", Retention: "7d"}
+
+	prune := func() {
+		t.Helper()
+		if err := pruneTarget(context.Background(), config, target, "manual", false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The full backup outlives its retention, but the differential still needs it
+	fake.Advance(8 * 24 * time.Hour)
+	prune()
+	if !store.has(full) || !store.has(differential) {
+		t.Fatal("backups pruned while a retained run depends on them")
+	}
+
+	// Once a newer full backup is taken and the differential has expired too,
+	// both go
+	newer := backupNamePrefix + "newer.tar.gz"
+	store.put(newer, []byte("archive"), start.AddDate(0, 0, 12))
+	writeTestReport(t, config.ReportsDir, RunReport{StartedAt: start.AddDate(0, 0, 12), ArchiveKey: newer})
+
+	fake.Advance(5 * 24 * time.Hour)
+	prune()
+	if store.has(full) || store.has(differential) {
+		t.Error("expired backups were kept")
+	}
+	if !store.has(newer) {
+		t.Error("the newest backup was pruned")
+	}
+}
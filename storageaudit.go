@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// A problem found by the storage audit. Problem is "missing", "extra",
+// "size_mismatch", "checksum_mismatch", "unreadable" or, for run reports
+// when signing is configured, "bad_signature".
+type AuditFinding struct {
+	Target  string `json:"target"`
+	Key     string `json:"key"`
+	Problem string `json:"problem"`
+	Detail  string `json:"detail,omitempty"`
+}
+
+// The result of comparing the storage targets against the run reports
+type StorageAudit struct {
+	StartedAt time.Time      `json:"started_at"`
+	Checked   int            `json:"checked"`
+	Hashed    int            `json:"hashed"`
+	Findings  []AuditFinding `json:"findings"`
+}
+
+// An archive the reports say a target should hold
+type expectedObject struct {
+	size   int64
+	sha256 string
+	run    time.Time
+}
+
+// Compare every storage target with the run reports: archives the reports
+// list must be present at the recorded size (and checksum, when hashing),
+// and no backup may be present that no report explains. Archives past the
+// target's retention are expected to be gone.
+func auditStorage(ctx context.Context, config Config, checksums bool) (StorageAudit, error) {
+	audit := StorageAudit{StartedAt: time.Now(), Findings: []AuditFinding{}}
+
+	files, err := loadReportFiles(config.ReportsDir)
+	if err != nil {
+		return audit, err
+	}
+
+	// The reports are only trusted as far as their signatures
+	reports := []RunReport{}
+	for _, file := range files {
+		if config.Signing.enabled() {
+			if err := verifyFile(config, file.Path); err != nil {
+				audit.Findings = append(audit.Findings, AuditFinding{Target: "reports", Key: file.Path, Problem: "bad_signature", Detail: err.Error()})
+				continue
+			}
+		}
+		reports = append(reports, file.Report)
+	}
+
+	// Every archive a report mentions, including separately uploaded and
+	// tiered ones that aren't checked in place
+	known := map[string]bool{}
+	expected := map[string]map[string]expectedObject{}
+
+	for _, report := range reports {
+		for _, key := range report.archiveKeys() {
+			known[path.Base(key)] = true
+		}
+		for _, moved := range report.Tiered {
+			known[path.Base(moved)] = true
+		}
+
+		// Deduplicated runs store chunks rather than a single archive
+		if report.ArchiveKey == "" || report.Dedup != nil {
+			continue
+		}
+		if _, tiered := report.Tiered[report.ArchiveKey]; tiered {
+			continue
+		}
+
+		for _, target := range report.Targets {
+			if target.Error != "" {
+				continue
+			}
+			if expected[target.Name] == nil {
+				expected[target.Name] = map[string]expectedObject{}
+			}
+			expected[target.Name][target.Key] = expectedObject{size: report.ArchiveSizeBytes, sha256: report.ArchiveSHA256, run: report.StartedAt}
+		}
+	}
+
+	for _, target := range config.targets() {
+		objects, err := target.list(ctx)
+		if err != nil {
+			return audit, fmt.Errorf("error listing backups on %s: %w", target.Name, err)
+		}
+
+		var cutoff time.Time
+		if retention, err := parseDuration(target.Retention); err == nil && target.Retention != "" {
+			cutoff = audit.StartedAt.Add(-retention)
+		}
+
+		want := expected[target.Name]
+		seen := map[string]bool{}
+
+		for _, object := range objects {
+			audit.Checked++
+			seen[object.Key] = true
+
+			expect, ok := want[object.Key]
+			if !ok {
+				if !known[path.Base(object.Key)] {
+					audit.Findings = append(audit.Findings, AuditFinding{Target: target.Name, Key: object.Key, Problem: "extra", Detail: "no run report lists this backup"})
+				}
+				continue
+			}
+
+			if expect.size > 0 && object.Size != expect.size {
+				audit.Findings = append(audit.Findings, AuditFinding{Target: target.Name, Key: object.Key, Problem: "size_mismatch",
+					Detail: fmt.Sprintf("stored %d bytes, report says %d", object.Size, expect.size)})
+				continue
+			}
+
+			if checksums && expect.sha256 != "" {
+				sum, err := objectSHA256(ctx, target, object.Key)
+				if err != nil {
+					audit.Findings = append(audit.Findings, AuditFinding{Target: target.Name, Key: object.Key, Problem: "unreadable", Detail: err.Error()})
+					continue
+				}
+
+				audit.Hashed++
+				if sum != expect.sha256 {
+					audit.Findings = append(audit.Findings, AuditFinding{Target: target.Name, Key: object.Key, Problem: "checksum_mismatch",
+						Detail: fmt.Sprintf("stored SHA-256 %s, report says %s", sum, expect.sha256)})
+				}
+			}
+		}
+
+		for key, expect := range want {
+			if seen[key] || expect.run.Before(cutoff) {
+				continue
+			}
+			audit.Findings = append(audit.Findings, AuditFinding{Target: target.Name, Key: key, Problem: "missing",
+				Detail: fmt.Sprintf("uploaded by the run at %s", expect.run.Format(time.RFC3339))})
+		}
+	}
+
+	return audit, nil
+}
+
+// Download an object and get its hex encoded SHA-256
+func objectSHA256(ctx context.Context, target TargetConfig, key string) (string, error) {
+	body, err := target.open(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	defer body.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, &contextReader{ctx: ctx, reader: body})
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Handle the audit subcommand, exiting with a failure when anything is found.
+// Usage: audit [--checksums] [--output audit.json]
+func runStorageAudit(ctx context.Context, config Config, args []string) error {
+	flags := flag.NewFlagSet("audit", flag.ContinueOnError)
+	checksums := flags.Bool("checksums", false, "download every archive and compare its SHA-256 with the report")
+	output := flags.String("output", "", "file to write the JSON audit report to, defaults to reports_dir")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return withExitCode(exitConfig, err)
+	}
+
+	audit, err := auditStorage(ctx, config, *checksums)
+	if err != nil {
+		return err
+	}
+
+	for _, finding := range audit.Findings {
+		log.Printf("%s: %s %s (%s)\n", finding.Target, finding.Problem, finding.Key, finding.Detail)
+	}
+	log.Printf("Checked %d objects (%d hashed), %d problems found\n", audit.Checked, audit.Hashed, len(audit.Findings))
+
+	reportPath := *output
+	if reportPath == "" {
+		reportPath = filepath.Join(config.ReportsDir, "audit_"+config.timestamp(audit.StartedAt)+".json")
+	}
+
+	data, err := json.MarshalIndent(audit, "", "  ")
+	if err == nil {
+		err = os.WriteFile(reportPath, data, 0644)
+	}
+	if err != nil {
+		return fmt.Errorf("error writing audit report %s: %w", reportPath, err)
+	}
+	log.Printf("Wrote audit report to %s\n", reportPath)
+
+	if len(audit.Findings) > 0 {
+		return withExitCode(exitFailure, fmt.Errorf("%d problems found", len(audit.Findings)))
+	}
+
+	return nil
+}
@@ -0,0 +1,20 @@
+package main
+
+import (
+	"context"
+	"io"
+)
+
+// Reads and deletes the backups on a target, so retention and failure
+// handling can run against a fake
+type objectStore interface {
+	list(ctx context.Context) ([]StoredObject, error)
+	listPrefix(ctx context.Context, prefix string) ([]StoredObject, error)
+	delete(ctx context.Context, key string) error
+	open(ctx context.Context, key string) (io.ReadCloser, error)
+}
+
+// Get the store for a target, replaced in tests
+var storeFor = func(target TargetConfig) objectStore {
+	return target
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Keeps objects in memory, for tests
+type memoryStore struct {
+	mutex   sync.Mutex
+	objects map[string]memoryObject
+
+	// Errors returned by operations on keys, by key
+	errs map[string]error
+}
+
+// An object kept by a memory store
+type memoryObject struct {
+	data         []byte
+	lastModified time.Time
+}
+
+// Create an empty memory store
+func newMemoryStore() *memoryStore {
+	return &memoryStore{objects: map[string]memoryObject{}, errs: map[string]error{}}
+}
+
+// Store data under key, last modified at modified
+func (s *memoryStore) put(key string, data []byte, modified time.Time) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	s.objects[key] = memoryObject{data: data, lastModified: modified}
+}
+
+// Check whether an object is stored under key
+func (s *memoryStore) has(key string) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	_, ok := s.objects[key]
+	return ok
+}
+
+func (s *memoryStore) list(ctx context.Context) ([]StoredObject, error) {
+	return s.listPrefix(ctx, backupNamePrefix)
+}
+
+func (s *memoryStore) listPrefix(ctx context.Context, prefix string) ([]StoredObject, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	objects := []StoredObject{}
+	for key, object := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			objects = append(objects, StoredObject{Key: key, Size: int64(len(object.data)), LastModified: object.lastModified})
+		}
+	}
+
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].Key < objects[j].Key
+	})
+
+	return objects, nil
+}
+
+func (s *memoryStore) delete(ctx context.Context, key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.errs[key]; err != nil {
+		return err
+	}
+
+	delete(s.objects, key)
+	return nil
+}
+
+func (s *memoryStore) open(ctx context.Context, key string) (io.ReadCloser, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.errs[key]; err != nil {
+		return nil, err
+	}
+
+	object, ok := s.objects[key]
+	if !ok {
+		return nil, fmt.Errorf("%s not found", key)
+	}
+
+	return io.NopCloser(bytes.NewReader(object.data)), nil
+}
+
+func TestMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	store := newMemoryStore()
+	modified := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	store.put(backupNamePrefix+"b.tar.gz", []byte("bb"), modified)
+	store.put(backupNamePrefix+"a.tar.gz", []byte("a"), modified)
+	store.put("reports/a.json", []byte("{}"), modified)
+
+	objects, err := store.list(ctx)
+	if err != nil || len(objects) != 2 || objects[0].Key != backupNamePrefix+"a.tar.gz" || objects[1].Size != 2 {
+		t.Errorf("listed %+v, %v", objects, err)
+	}
+
+	file, err := store.open(ctx, "reports/a.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := io.ReadAll(file)
+	if string(data) != "{}" {
+		t.Errorf("read %q", data)
+	}
+
+	if _, err := store.open(ctx, "missing"); err == nil {
+		t.Error("opening a missing object succeeded")
+	}
+
+	store.errs[backupNamePrefix+"b.tar.gz"] = errors.New("access denied")
+	if err := store.delete(ctx, backupNamePrefix+"b.tar.gz"); err == nil || !store.has(backupNamePrefix+"b.tar.gz") {
+		t.Errorf("failing delete returned %v", err)
+	}
+
+	if err := store.delete(ctx, backupNamePrefix+"a.tar.gz"); err != nil || store.has(backupNamePrefix+"a.tar.gz") {
+		t.Errorf("delete returned %v", err)
+	}
+}
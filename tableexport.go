@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Hold the settings for exporting tables as compressed CSV, TSV or Parquet
+// files for analytics, e.g. to load into a data lake, alongside the SQL dump
+// or instead of it (MySQL/MariaDB only). Each table is read in its own
+// transaction.
+type TableExportConfig struct {
+	// "csv", with NULL as an empty field, "tsv", escaped like LOAD DATA with
+	// NULL as \N, or "parquet"
+	Format string `yaml:"format"`
+
+	// Parquet types of columns, keyed by "table.column", overriding the type
+	// picked from the column's MySQL type, e.g. "double" for a DECIMAL
+	Schema map[string]string `yaml:"schema"`
+
+	// Tables to export, defaulting to every table of the database
+	Tables []string `yaml:"tables"`
+
+	// Only export the tables, without a SQL dump to restore from
+	Only bool `yaml:"only"`
+}
+
+func (e TableExportConfig) enabled() bool {
+	return e.Format != ""
+}
+
+// Get the extension of exported table files. Parquet files are compressed
+// within.
+func (e TableExportConfig) extension() string {
+	if e.Format == "parquet" {
+		return ".parquet"
+	}
+
+	return "." + e.Format + ".gz"
+}
+
+// A table's column, with the MySQL type it was declared with
+type exportColumn struct {
+	name       string
+	dataType   string
+	columnType string
+}
+
+// MySQL types exported to Parquet as raw bytes rather than strings
+var binaryColumnTypes = map[string]bool{
+	"binary": true, "varbinary": true, "bit": true,
+	"tinyblob": true, "blob": true, "mediumblob": true, "longblob": true,
+	"geometry": true, "point": true, "linestring": true, "polygon": true,
+	"multipoint": true, "multilinestring": true, "multipolygon": true, "geometrycollection": true, "geomcollection": true,
+}
+
+// Pick the Parquet type a column is exported as. DECIMALs stay strings so
+// no precision is lost, unless the schema maps them to double.
+func parquetColumnType(schema map[string]string, table string, column exportColumn) string {
+	if kind, ok := schema[table+"."+column.name]; ok {
+		return kind
+	}
+
+	switch column.dataType {
+	case "tinyint", "smallint", "mediumint", "int", "integer", "year":
+		return "int64"
+	case "bigint":
+		// Unsigned values can be too big for an int64
+		if strings.Contains(column.columnType, "unsigned") {
+			return "string"
+		}
+		return "int64"
+	case "float", "double", "real":
+		return "double"
+	case "date":
+		return "date"
+	case "datetime", "timestamp":
+		return "timestamp"
+	}
+	if binaryColumnTypes[column.dataType] {
+		return "binary"
+	}
+
+	return "string"
+}
+
+// List a table's columns in order
+func tableColumns(db DatabaseConfig, dbName string, table string) ([]exportColumn, error) {
+	output, err := mysqlQuery(db, "", fmt.Sprintf(
+		"SELECT COLUMN_NAME, DATA_TYPE, COLUMN_TYPE FROM information_schema.COLUMNS WHERE TABLE_SCHEMA = %s AND TABLE_NAME = %s ORDER BY ORDINAL_POSITION",
+		quoteString(dbName), quoteString(table)))
+	if err != nil {
+		return nil, err
+	}
+
+	columns := []exportColumn{}
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) != 3 {
+			continue
+		}
+		columns = append(columns, exportColumn{name: fields[0], dataType: strings.ToLower(fields[1]), columnType: strings.ToLower(fields[2])})
+	}
+	if len(columns) == 0 {
+		return nil, fmt.Errorf("table %s not found in %s", table, dbName)
+	}
+
+	return columns, nil
+}
+
+// Undo the escaping mysql --batch applies to values
+func unescapeBatchValue(value string) string {
+	if !strings.Contains(value, `\`) {
+		return value
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' || i+1 == len(value) {
+			b.WriteByte(value[i])
+			continue
+		}
+
+		i++
+		switch value[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 't':
+			b.WriteByte('\t')
+		case '0':
+			b.WriteByte(0)
+		default:
+			b.WriteByte(value[i])
+		}
+	}
+
+	return b.String()
+}
+
+// Escape a value for a TSV export, as LOAD DATA and mysqlimport read it
+func escapeTSVValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\x00", `\0`).Replace(value)
+}
+
+// Writes the rows of an exported table in one of the formats
+type tableRowWriter interface {
+	write(values []string, nulls []bool) error
+	close() error
+}
+
+type csvRows struct {
+	writer *csv.Writer
+}
+
+// Start a CSV file with a header of the columns
+func newCSVRows(out io.Writer, columns []string) (*csvRows, error) {
+	rows := &csvRows{writer: csv.NewWriter(out)}
+	return rows, rows.writer.Write(columns)
+}
+
+func (r *csvRows) write(values []string, nulls []bool) error {
+	return r.writer.Write(values)
+}
+
+func (r *csvRows) close() error {
+	r.writer.Flush()
+	return r.writer.Error()
+}
+
+type tsvRows struct {
+	out    io.Writer
+	record []string
+}
+
+// Start a TSV file with a header of the columns
+func newTSVRows(out io.Writer, columns []string) (*tsvRows, error) {
+	rows := &tsvRows{out: out, record: make([]string, len(columns))}
+	return rows, rows.write(columns, make([]bool, len(columns)))
+}
+
+func (r *tsvRows) write(values []string, nulls []bool) error {
+	for i, value := range values {
+		if nulls[i] {
+			r.record[i] = `\N`
+		} else {
+			r.record[i] = escapeTSVValue(value)
+		}
+	}
+
+	_, err := io.WriteString(r.out, strings.Join(r.record, "\t")+"\n")
+	return err
+}
+
+func (r *tsvRows) close() error {
+	return nil
+}
+
+// Read rows from mysql --batch output and write them out, masking columns
+// that have masking rules
+func copyTableRows(in io.Reader, rows tableRowWriter, columns int, masks map[int]MaskingRule) error {
+	reader := bufio.NewReader(in)
+	values := make([]string, columns)
+	nulls := make([]bool, columns)
+	for {
+		line, err := reader.ReadString('\n')
+		if err == io.EOF && line == "" {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return err
+		}
+
+		fields := strings.Split(strings.TrimSuffix(line, "\n"), "\t")
+		if len(fields) != columns {
+			return fmt.Errorf("expected %d columns, got %d", columns, len(fields))
+		}
+
+		for i, field := range fields {
+			// Every value but NULL was selected with a leading "=", so NULL
+			// can't be mistaken for the string "NULL"
+			nulls[i] = field == "NULL"
+			values[i] = ""
+			if !nulls[i] {
+				values[i] = strings.TrimPrefix(unescapeBatchValue(field), "=")
+			}
+
+			if rule, ok := masks[i]; ok {
+				sqlValue := "NULL"
+				if !nulls[i] {
+					sqlValue = quoteString(values[i])
+				}
+				masked := maskValue(rule, sqlValue)
+				nulls[i] = masked == "NULL"
+				values[i] = ""
+				if !nulls[i] {
+					values[i] = unquoteSQLValue(masked)
+				}
+			}
+		}
+
+		err = rows.write(values, nulls)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Export a single table to a file, streaming it from the server
+func exportTable(ctx context.Context, config Config, db DatabaseConfig, dbName string, table string, file string) error {
+	columns, err := tableColumns(db, dbName, table)
+	if err != nil {
+		return err
+	}
+
+	masks := map[int]MaskingRule{}
+	names := []string{}
+	kinds := []string{}
+	selected := []string{}
+	for i, column := range columns {
+		for _, rule := range db.Masking {
+			if rule.Table == table && rule.Column == column.name {
+				masks[i] = rule
+			}
+		}
+		names = append(names, column.name)
+		kinds = append(kinds, parquetColumnType(db.TableExport.Schema, table, column))
+		selected = append(selected, fmt.Sprintf("CONCAT('=', %s)", quoteIdentifier(column.name)))
+	}
+
+	query := fmt.Sprintf("SELECT %s FROM %s", strings.Join(selected, ", "), quoteIdentifier(table))
+	args := append(mysqlConnectionArgs(db), "--batch", "--quick", "--skip-column-names", "--execute="+query, dbName)
+
+	out, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+
+	var gz *gzip.Writer
+	var rows tableRowWriter
+	if db.TableExport.Format == "parquet" {
+		rows, err = newParquetWriter(out, names, kinds, config.CompressionLevel)
+	} else {
+		gz, err = gzip.NewWriterLevel(out, config.CompressionLevel)
+		if err == nil && db.TableExport.Format == "csv" {
+			rows, err = newCSVRows(gz, names)
+		} else if err == nil {
+			rows, err = newTSVRows(gz, names)
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	cmd := dumpCommand(ctx, "mysql", args...)
+	cmd.Env = mysqlEnv(db)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	err = copyTableRows(stdout, rows, len(columns), masks)
+	if err == nil {
+		err = rows.close()
+	}
+	if err != nil {
+		// Nothing is reading the output any more, so the query can't finish by itself
+		cmd.Process.Kill()
+	}
+
+	waitErr := cmd.Wait()
+	if waitErr != nil {
+		return fmt.Errorf("%w: %s", waitErr, strings.TrimSpace(stderr.String()))
+	}
+	if err != nil || gz == nil {
+		return err
+	}
+
+	return gz.Close()
+}
+
+// Export a database's configured tables, or all of them, into a directory
+// with a <table>.csv.gz, <table>.tsv.gz or <table>.parquet file each
+func exportTables(ctx context.Context, config Config, db DatabaseConfig, dbName string, dir string) error {
+	tables := db.TableExport.Tables
+	if len(tables) == 0 {
+		var err error
+		tables, _, err = listTablesAndViews(db, dbName)
+		if err != nil {
+			return fmt.Errorf("error listing tables: %w", err)
+		}
+	}
+
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("Exporting %d tables of %s on %s as %s\n", len(tables), dbName, db.Host, db.TableExport.Format)
+
+	for _, table := range tables {
+		file := filepath.Join(dir, url.PathEscape(table)+db.TableExport.extension())
+		err = exportTable(ctx, config, db, dbName, table, file)
+		if err != nil {
+			return fmt.Errorf("error exporting %s: %w", table, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Hold the expected contents of a table at dump time
+type TableSummary struct {
+	Rows     int64  `json:"rows"`
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// Count the rows of every table in a database, and with "checksum" also
+// record CHECKSUM TABLE. These are taken straight after the dump rather than
+// in its transaction, so they only match exactly if nothing was written.
+func tableSummaries(db DatabaseConfig, dbName string, mode string) (map[string]TableSummary, error) {
+	output, err := mysqlQuery(db, "", fmt.Sprintf(
+		"SELECT TABLE_NAME FROM information_schema.TABLES WHERE TABLE_SCHEMA = %s AND TABLE_TYPE = 'BASE TABLE' ORDER BY TABLE_NAME", quoteString(dbName)))
+	if err != nil {
+		return nil, err
+	}
+
+	summaries := map[string]TableSummary{}
+
+	for _, table := range strings.Split(strings.TrimSpace(output), "\n") {
+		if table == "" {
+			continue
+		}
+
+		summary, err := tableSummary(db, dbName, table, mode)
+		if err != nil {
+			return nil, fmt.Errorf("error summarising %s: %w", table, err)
+		}
+
+		summaries[table] = summary
+	}
+
+	return summaries, nil
+}
+
+// Count the rows of a single table, and checksum it with "checksum"
+func tableSummary(db DatabaseConfig, dbName string, table string, mode string) (TableSummary, error) {
+	name := quoteIdentifier(dbName) + "." + quoteIdentifier(table)
+	summary := TableSummary{}
+
+	output, err := mysqlQuery(db, "", "SELECT COUNT(*) FROM "+name)
+	if err != nil {
+		return summary, err
+	}
+
+	summary.Rows, err = strconv.ParseInt(strings.TrimSpace(output), 10, 64)
+	if err != nil {
+		return summary, err
+	}
+
+	if mode == "checksum" {
+		output, err = mysqlQuery(db, "", "CHECKSUM TABLE "+name)
+		if err != nil {
+			return summary, err
+		}
+
+		// "db.table\tchecksum"
+		fields := strings.Split(strings.TrimSpace(output), "\t")
+		summary.Checksum = fields[len(fields)-1]
+	}
+
+	return summary, nil
+}
+
+// Result of checking one restored table against its summary
+type TableCheck struct {
+	Table            string `json:"table"`
+	ExpectedRows     int64  `json:"expected_rows"`
+	Rows             int64  `json:"rows"`
+	ExpectedChecksum string `json:"expected_checksum,omitempty"`
+	Checksum         string `json:"checksum,omitempty"`
+	Error            string `json:"error,omitempty"`
+
+	// Unset when no summary was recorded, so there was nothing to compare
+	Verified bool `json:"verified"`
+}
+
+// Compare a restored database against the summaries recorded when it was
+// dumped, returning each table's result and an error listing every table
+// that doesn't match
+func verifyTableSummaries(db DatabaseConfig, dbName string, expected map[string]TableSummary) ([]TableCheck, error) {
+	tables := []string{}
+	for table := range expected {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+
+	checks := []TableCheck{}
+	mismatches := []string{}
+
+	for _, table := range tables {
+		want := expected[table]
+		check := TableCheck{Table: table, ExpectedRows: want.Rows, ExpectedChecksum: want.Checksum, Verified: true}
+
+		mode := ""
+		if want.Checksum != "" {
+			mode = "checksum"
+		}
+
+		got, err := tableSummary(db, dbName, table, mode)
+		check.Rows, check.Checksum = got.Rows, got.Checksum
+
+		if err != nil {
+			check.Error = err.Error()
+		} else if got.Rows != want.Rows {
+			check.Error = fmt.Sprintf("%d rows, expected %d", got.Rows, want.Rows)
+		} else if got.Checksum != want.Checksum {
+			check.Error = fmt.Sprintf("checksum %s, expected %s", got.Checksum, want.Checksum)
+		}
+		if check.Error != "" {
+			mismatches = append(mismatches, fmt.Sprintf("%s: %s", table, check.Error))
+		}
+
+		checks = append(checks, check)
+	}
+
+	if len(mismatches) > 0 {
+		return checks, fmt.Errorf("restored tables don't match the backup:\n  %s", strings.Join(mismatches, "\n  "))
+	}
+
+	log.Printf("Verified %d tables of %s against the backup\n", len(expected), dbName)
+
+	return checks, nil
+}
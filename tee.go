@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// Times a failed upload to a target is retried by default, alone and
+// reading the file again
+const defaultUploadRetries = 2
+
+// Get how many times a failed upload to a target is retried
+func (config Config) uploadRetries() int {
+	if config.UploadRetries < 0 {
+		return 0
+	}
+	if config.UploadRetries == 0 {
+		return defaultUploadRetries
+	}
+
+	return config.UploadRetries
+}
+
+// One target's end of a streamed upload, hashing what the target read
+type teeBranch struct {
+	reader *io.PipeReader
+	writer *io.PipeWriter
+	hash   hash.Hash
+}
+
+func (b *teeBranch) Read(p []byte) (int, error) {
+	n, err := b.reader.Read(p)
+	b.hash.Write(p[:n])
+	return n, err
+}
+
+// Upload a local file to every target at once, reading it once and passing
+// each chunk to all of them. A target that fails, or reads less than the
+// whole file, is dropped from the stream without holding up the rest.
+// Returns each target's error and the SHA-256 of what it was sent.
+func teeUpload(ctx context.Context, config Config, targets []TargetConfig, localPath string, name string, showProgress bool) ([]error, []string) {
+	errs := make([]error, len(targets))
+	checksums := make([]string, len(targets))
+
+	file, err := os.Open(localPath)
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs, checksums
+	}
+	defer file.Close()
+
+	size := fileSize(localPath)
+
+	uploaders := make([]*s3manager.Uploader, len(targets))
+	s3Uploaders := []*s3manager.Uploader{}
+	for i, target := range targets {
+		uploaders[i], errs[i] = target.uploader()
+		if uploaders[i] != nil {
+			s3Uploaders = append(s3Uploaders, uploaders[i])
+		}
+	}
+
+	// Reserved together, as each target waits on the others to read on
+	release, err := reserveUploadMemory(ctx, s3Uploaders, size)
+	if err != nil {
+		for i := range errs {
+			errs[i] = err
+		}
+		return errs, checksums
+	}
+	defer release()
+
+	// Cancelled by the watchdog to abort every target's upload
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Branches are dropped once their target stops reading
+	branches := make([]*teeBranch, len(targets))
+	hashes := make([]hash.Hash, len(targets))
+	var wg sync.WaitGroup
+	for i, target := range targets {
+		if errs[i] != nil {
+			continue
+		}
+
+		reader, writer := io.Pipe()
+		branches[i] = &teeBranch{reader: reader, writer: writer, hash: sha256.New()}
+		hashes[i] = branches[i].hash
+
+		wg.Add(1)
+		go func(i int, target TargetConfig, branch *teeBranch) {
+			defer wg.Done()
+			defer trackUpload(config, target, target.key(name))()
+
+			errs[i] = target.uploadFrom(ctx, branch, name, uploaders[i])
+			if errs[i] != nil {
+				branch.reader.CloseWithError(errs[i])
+			} else {
+				// Stop the stream to a target that finished without reading it all
+				branch.reader.CloseWithError(fmt.Errorf("upload finished early"))
+			}
+		}(i, target, branches[i])
+	}
+
+	body := &progressReader{reader: &contextReader{ctx: ctx, reader: file}}
+	if showProgress {
+		stopProgress := watchProgress(fmt.Sprintf("Uploading %s to %d targets", name, len(targets)), config.progressInterval(), size, body.bytesRead)
+		defer stopProgress()
+	}
+	stopWatchdog := watchStall(fmt.Sprintf("Upload of %s", name), config.stallTimeout(), body.bytesRead, cancel)
+
+	source := sha256.New()
+	buf := make([]byte, copyBufferSize)
+	for {
+		n, readErr := body.Read(buf)
+		if n > 0 {
+			source.Write(buf[:n])
+
+			// Each target reads the chunk at its own pace, and the next
+			// chunk is read once they all have
+			var writes sync.WaitGroup
+			for i, branch := range branches {
+				if branch == nil {
+					continue
+				}
+
+				writes.Add(1)
+				go func(i int, branch *teeBranch) {
+					defer writes.Done()
+					if _, err := branch.writer.Write(buf[:n]); err != nil {
+						branches[i] = nil
+					}
+				}(i, branch)
+			}
+			writes.Wait()
+		}
+
+		if readErr != nil {
+			if readErr == io.EOF {
+				readErr = nil
+			}
+			for _, branch := range branches {
+				if branch != nil {
+					branch.writer.CloseWithError(readErr)
+				}
+			}
+			break
+		}
+	}
+
+	wg.Wait()
+
+	if stopWatchdog() {
+		for i := range errs {
+			if hashes[i] != nil {
+				errs[i] = stallError("upload", config.stallTimeout())
+			}
+		}
+		return errs, checksums
+	}
+
+	// Each target has to have read exactly what was in the file
+	expected := hex.EncodeToString(source.Sum(nil))
+	for i, branch := range branches {
+		if branch == nil {
+			if errs[i] == nil && hashes[i] != nil {
+				errs[i] = fmt.Errorf("upload stopped reading before the end of the file")
+			}
+			continue
+		}
+		checksums[i] = hex.EncodeToString(hashes[i].Sum(nil))
+		if errs[i] == nil && checksums[i] != expected {
+			errs[i] = fmt.Errorf("sent data with SHA-256 %s, but the file's is %s", checksums[i], expected)
+		}
+	}
+
+	return errs, checksums
+}
+
+// Retry an upload to one target that failed with err, reading the file
+// again, until it succeeds or the retries run out. Returns the number of
+// attempts made and the SHA-256 of the file once it's uploaded.
+func retryUpload(ctx context.Context, config Config, target TargetConfig, localPath string, name string, showProgress bool, err error) (int, string, error) {
+	attempts := 1
+
+	for retry := 1; retry <= config.uploadRetries() && ctx.Err() == nil; retry++ {
+		delay := time.Duration(retry) * 5 * time.Second
+		log.Printf("Retrying upload of %s to %s in %s, attempt %d of %d\n", name, target.Name, delay, retry+1, config.uploadRetries()+1)
+
+		select {
+		case <-ctx.Done():
+			return attempts, "", err
+		case <-clk.After(delay):
+		}
+
+		attempts++
+		err = target.upload(ctx, config, localPath, name, showProgress)
+		if err == nil {
+			checksum, err := fileSHA256(localPath)
+			return attempts, checksum, err
+		}
+
+		log.Printf("Error uploading %s to %s: %s\n", name, target.Name, err.Error())
+	}
+
+	return attempts, "", err
+}
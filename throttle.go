@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	throttleMutex sync.Mutex
+
+	// Last time each notifier sent a notification about each key
+	lastSent = map[string]time.Time{}
+
+	// Notifications held back during each notifier's quiet hours
+	deferred = map[string][]Notification{}
+)
+
+// Parse quiet hours given as "HH:MM-HH:MM" (which may wrap past midnight) and
+// check whether the time falls inside them
+func inQuietHours(spec string, now time.Time) (bool, error) {
+	parts := strings.SplitN(spec, "-", 2)
+	if len(parts) != 2 {
+		return false, fmt.Errorf("invalid quiet hours %q", spec)
+	}
+
+	start, err := time.Parse("15:04", strings.TrimSpace(parts[0]))
+	if err != nil {
+		return false, fmt.Errorf("invalid quiet hours %q", spec)
+	}
+
+	end, err := time.Parse("15:04", strings.TrimSpace(parts[1]))
+	if err != nil {
+		return false, fmt.Errorf("invalid quiet hours %q", spec)
+	}
+
+	minute := now.Hour()*60 + now.Minute()
+	startMinute := start.Hour()*60 + start.Minute()
+	endMinute := end.Hour()*60 + end.Minute()
+
+	if startMinute <= endMinute {
+		return minute >= startMinute && minute < endMinute, nil
+	}
+
+	return minute >= startMinute || minute < endMinute, nil
+}
+
+// Get the keys a notification is rate limited by, one per affected database
+func throttleKeys(notification Notification) []string {
+	if notification.Report != nil {
+		keys := []string{}
+		for _, db := range notification.Report.Databases {
+			if !db.Success || len(db.SchemaDrift) > 0 || db.OverBudget != "" {
+				keys = append(keys, notification.Event+"/"+db.Name+"@"+db.Host)
+			}
+		}
+		if len(keys) > 0 {
+			return keys
+		}
+	}
+
+	return []string{notification.Event + "/" + notification.Subject}
+}
+
+// Check whether the notification is allowed by the notifier's rate limit, and
+// record it as sent if so. Only rate limited if every key was recently sent.
+func (notifier NotifierConfig) allow(notification Notification) bool {
+	if notifier.RateLimit == "" {
+		return true
+	}
+
+	limit, err := parseDuration(notifier.RateLimit)
+	if err != nil {
+		log.Printf("Invalid rate limit for %s notifier: %s\n", notifier.Type, err.Error())
+		return true
+	}
+
+	throttleMutex.Lock()
+	defer throttleMutex.Unlock()
+
+	allowed := false
+	keys := throttleKeys(notification)
+
+	for _, key := range keys {
+		if clk.Now().Sub(lastSent[notifier.id+"|"+key]) >= limit {
+			allowed = true
+		}
+	}
+
+	if allowed {
+		for _, key := range keys {
+			lastSent[notifier.id+"|"+key] = notification.Time
+		}
+	}
+
+	return allowed
+}
+
+// Hold back a notification until the notifier's quiet hours end. Returns false
+// if the notifier is not currently in quiet hours.
+func (notifier NotifierConfig) deferIfQuiet(notification Notification) bool {
+	if notifier.QuietHours == "" {
+		return false
+	}
+
+	quiet, err := inQuietHours(notifier.QuietHours, clk.Now())
+	if err != nil {
+		log.Printf("Error checking quiet hours for %s notifier: %s\n", notifier.Type, err.Error())
+		return false
+	}
+
+	if !quiet {
+		return false
+	}
+
+	throttleMutex.Lock()
+	deferred[notifier.id] = append(deferred[notifier.id], notification)
+	throttleMutex.Unlock()
+
+	return true
+}
+
+// Send a summary of everything held back during quiet hours once they end.
+// Blocks until the context is cancelled.
+func flushDeferredNotifications(ctx context.Context, config Config) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-clk.After(time.Minute):
+		}
+
+		for _, notifier := range config.Notifications {
+			if notifier.QuietHours == "" {
+				continue
+			}
+
+			quiet, err := inQuietHours(notifier.QuietHours, clk.Now())
+			if err != nil || quiet {
+				continue
+			}
+
+			throttleMutex.Lock()
+			held := deferred[notifier.id]
+			delete(deferred, notifier.id)
+			throttleMutex.Unlock()
+
+			if len(held) == 0 {
+				continue
+			}
+
+			var b strings.Builder
+			for _, notification := range held {
+				fmt.Fprintf(&b, "%s %s\n", notification.Time.Format("15:04"), notification.Subject)
+			}
+
+			err = notifier.send(ctx, Notification{
+				Event:   "deferred",
+				Subject: fmt.Sprintf("%d notifications held during quiet hours", len(held)),
+				Message: strings.TrimSpace(b.String()),
+				Time:    clk.Now(),
+			})
+			if err != nil {
+				log.Printf("Error sending deferred %s notifications: %s\n", notifier.Type, err.Error())
+			}
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimit(t *testing.T) {
+	fake := newFakeClock(time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC))
+	clk = fake
+	defer func() { clk = systemClock{} }()
+
+	notifier := NotifierConfig{Type: "webhook", RateLimit: "1h", id: "rate-limit-test"}
+	defer func() {
+		throttleMutex.Lock()
+		delete(lastSent, notifier.id+"|failure/shop")
+		throttleMutex.Unlock()
+	}()
+
+	send := func() bool {
+		return notifier.allow(Notification{Event: "failure", Subject: "shop", Time: clk.Now()})
+	}
+
+	if !send() {
+		t.Fatal("first notification was rate limited")
+	}
+
+	fake.Advance(59 * time.Minute)
+	if send() {
+		t.Error("notification within the rate limit was sent")
+	}
+
+	// Limited notifications don't restart the period
+	fake.Advance(time.Minute)
+	if !send() {
+		t.Error("notification after the rate limit was held back")
+	}
+}
+
+func TestQuietHours(t *testing.T) {
+	fake := newFakeClock(time.Date(2026, 3, 1, 23, 30, 0, 0, time.UTC))
+	clk = fake
+	defer func() { clk = systemClock{} }()
+
+	notifier := NotifierConfig{Type: "webhook", QuietHours: "23:00-07:00", id: "quiet-hours-test"}
+	defer func() {
+		throttleMutex.Lock()
+		delete(deferred, notifier.id)
+		throttleMutex.Unlock()
+	}()
+
+	if !notifier.deferIfQuiet(Notification{Event: "failure", Subject: "shop", Time: clk.Now()}) {
+		t.Error("notification during quiet hours wasn't held back")
+	}
+
+	fake.Advance(7*time.Hour + 30*time.Minute)
+	if notifier.deferIfQuiet(Notification{Event: "failure", Subject: "blog", Time: clk.Now()}) {
+		t.Error("notification after quiet hours was held back")
+	}
+
+	throttleMutex.Lock()
+	held := deferred[notifier.id]
+	throttleMutex.Unlock()
+	if len(held) != 1 || held[0].Subject != "shop" {
+		t.Errorf("held back %+v", held)
+	}
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// Hold the settings for moving old backups in the primary bucket to a colder
+// storage class
+type TieringConfig struct {
+	// Move archives older than this, e.g. "90d". Empty disables tiering.
+	After string `yaml:"after"`
+
+	// Prefix the moved archives are stored under. Defaults to "archive".
+	Prefix string `yaml:"prefix"`
+
+	// Storage class of the moved archives. Defaults to "DEEP_ARCHIVE".
+	StorageClass string `yaml:"storage_class"`
+
+	// When to look for archives to move. Defaults to daily at 03:00.
+	Schedule string `yaml:"schedule"`
+
+	// How long a retrieved copy stays available for restores, in days. Defaults to 7.
+	RestoreDays int `yaml:"restore_days"`
+
+	// Retrieval tier for restores: "Standard" (the default, up to 12 hours for
+	// Deep Archive) or "Bulk" (up to 48 hours, cheaper)
+	RestoreTier string `yaml:"restore_tier"`
+}
+
+// Check whether tiering is configured
+func (tiering TieringConfig) enabled() bool {
+	return tiering.After != ""
+}
+
+// Get the key an archive is moved to
+func (tiering TieringConfig) key(key string) string {
+	return path.Join(tiering.Prefix, key)
+}
+
+// Copy archives older than tiering.after into the cold storage class under the
+// tiering prefix, delete the originals and record where they went in the run
+// reports. Returns how many archives were moved.
+func tierArchives(ctx context.Context, config Config, dryRun bool, trigger string) (int, error) {
+	after, err := parseDuration(config.Tiering.After)
+	if err != nil {
+		return 0, err
+	}
+
+	primary := config.primaryTarget()
+	objects, err := primary.list(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	sess, err := primary.session()
+	if err != nil {
+		return 0, err
+	}
+	client := s3.New(sess)
+
+	cutoff := clk.Now().Add(-after)
+	moved := map[string]string{}
+
+	for _, object := range objects {
+		// Reports stay put so restores can still find them
+		if !object.LastModified.Before(cutoff) || strings.HasSuffix(object.Key, ".report.json") {
+			continue
+		}
+
+		tieredKey := config.Tiering.key(object.Key)
+		log.Printf("Moving %s to %s (%s)\n", object.Key, tieredKey, config.Tiering.StorageClass)
+		if dryRun {
+			continue
+		}
+
+		source := copySource(primary.Bucket, object.Key)
+		input := primary.copyInput(source, tieredKey)
+		input.StorageClass = aws.String(config.Tiering.StorageClass)
+
+		err := copyObject(ctx, client, source, object.Size, input)
+		if err == nil {
+			err = primary.delete(ctx, object.Key)
+		}
+		auditLog(config, "tier_s3", primary.Name+":"+object.Key, trigger, err)
+
+		if err != nil {
+			log.Printf("Error moving %s: %s\n", object.Key, err.Error())
+			continue
+		}
+
+		moved[object.Key] = tieredKey
+	}
+
+	if len(moved) > 0 {
+		err = recordTiered(config, moved)
+		if err != nil {
+			return len(moved), fmt.Errorf("error updating reports: %s", err.Error())
+		}
+	}
+
+	return len(moved), nil
+}
+
+// Record the new locations of moved archives in the run reports that made them
+func recordTiered(config Config, moved map[string]string) error {
+	files, err := loadReportFiles(config.ReportsDir)
+	if err != nil {
+		return err
+	}
+
+	for _, file := range files {
+		report := file.Report
+
+		keys := []string{report.ArchiveKey}
+		for _, db := range report.Databases {
+			keys = append(keys, db.ArchiveKey)
+		}
+
+		changed := false
+		for _, key := range keys {
+			if tieredKey, ok := moved[key]; ok && key != "" {
+				if report.Tiered == nil {
+					report.Tiered = map[string]string{}
+				}
+				report.Tiered[key] = tieredKey
+				changed = true
+			}
+		}
+
+		if changed {
+			err = writeReport(&report, file.Path)
+			if err == nil {
+				err = signFile(config, file.Path)
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// Find where an archive was moved to by tiering, or "" if it wasn't
+func tieredLocation(config Config, key string) string {
+	reports, err := loadReports(config.ReportsDir)
+	if err != nil {
+		return ""
+	}
+
+	for _, report := range reports {
+		if tieredKey, ok := report.Tiered[key]; ok {
+			return tieredKey
+		}
+	}
+
+	return ""
+}
+
+// Check a moved archive can be downloaded, requesting its retrieval from cold
+// storage if it hasn't been yet. Returns an error until the retrieval is done.
+func ensureRetrieved(ctx context.Context, config Config, client *s3.S3, key string) error {
+	head, err := client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(config.S3Config.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return err
+	}
+
+	class := aws.StringValue(head.StorageClass)
+	if class != "GLACIER" && class != "DEEP_ARCHIVE" {
+		return nil
+	}
+
+	restore := aws.StringValue(head.Restore)
+	switch {
+	case strings.Contains(restore, `ongoing-request="false"`):
+		return nil
+	case strings.Contains(restore, `ongoing-request="true"`):
+		return fmt.Errorf("%s is still being retrieved from %s, try again later", key, class)
+	}
+
+	_, err = client.RestoreObjectWithContext(ctx, &s3.RestoreObjectInput{
+		Bucket: aws.String(config.S3Config.Bucket),
+		Key:    aws.String(key),
+		RestoreRequest: &s3.RestoreRequest{
+			Days: aws.Int64(int64(config.Tiering.RestoreDays)),
+			GlacierJobParameters: &s3.GlacierJobParameters{
+				Tier: aws.String(config.Tiering.RestoreTier),
+			},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("error requesting retrieval of %s: %s", key, err.Error())
+	}
+
+	return fmt.Errorf("requested retrieval of %s from %s (%s tier), run the restore again once it's ready", key, class, config.Tiering.RestoreTier)
+}
+
+// Handle the tier subcommand, moving old archives now. Usage: tier [--dry-run]
+func runTier(ctx context.Context, config Config, args []string) error {
+	flags := flag.NewFlagSet("tier", flag.ContinueOnError)
+	dryRun := flags.Bool("dry-run", false, "only list the archives that would be moved")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	if !config.Tiering.enabled() {
+		return withExitCode(exitConfig, fmt.Errorf("tiering.after isn't set"))
+	}
+
+	moved, err := tierArchives(ctx, config, *dryRun, commandTrigger())
+	if err != nil {
+		return err
+	}
+
+	if !*dryRun {
+		log.Printf("Moved %d archives\n", moved)
+	}
+
+	return nil
+}
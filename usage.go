@@ -0,0 +1,203 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// Hold the storage used by one database's backups on a target
+type UsageEntry struct {
+	Target   string `json:"target"`
+	Engine   string `json:"engine,omitempty"`
+	Host     string `json:"host,omitempty"`
+	Database string `json:"database"`
+	Objects  int    `json:"objects"`
+	Bytes    int64  `json:"bytes"`
+}
+
+// Group for objects that can't be matched to a run report, e.g. after the
+// local reports were deleted
+const unattributed = "(unattributed)"
+
+// Sum the storage used on each target per database. Archives holding several
+// databases are split between them in proportion to their dump sizes, and run
+// reports uploaded next to the archives are counted as "(reports)".
+func collectUsage(ctx context.Context, config Config) ([]UsageEntry, error) {
+	reports, err := loadReports(config.ReportsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	runs := map[string]RunReport{}
+	dbArchives := map[string]DatabaseReport{}
+	for _, report := range reports {
+		if report.ArchiveKey != "" {
+			runs[report.ArchiveKey] = report
+		}
+		for _, db := range report.Databases {
+			if db.ArchiveKey != "" {
+				dbArchives[db.ArchiveKey] = db
+			}
+		}
+	}
+
+	entries := []UsageEntry{}
+
+	for _, target := range config.targets() {
+		objects, err := target.list(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error listing %s: %s", target.Name, err.Error())
+		}
+
+		usage := map[string]*UsageEntry{}
+		add := func(engine string, host string, name string, bytes int64) {
+			key := engine + "|" + host + "|" + name
+			if usage[key] == nil {
+				usage[key] = &UsageEntry{Target: target.Name, Engine: engine, Host: host, Database: name}
+			}
+			usage[key].Objects++
+			usage[key].Bytes += bytes
+		}
+
+		for _, object := range objects {
+			name := path.Base(object.Key)
+
+			if strings.HasSuffix(name, ".report.json") {
+				add("", "", "(reports)", object.Size)
+				continue
+			}
+
+			if db, ok := dbArchives[name]; ok {
+				add(db.Engine, db.Host, db.Name, object.Size)
+				continue
+			}
+
+			run, ok := runs[name]
+			if !ok {
+				add("", "", unattributed, object.Size)
+				continue
+			}
+
+			var total int64
+			included := []DatabaseReport{}
+			for _, db := range run.Databases {
+				if db.Success && db.ArchiveKey == "" {
+					total += db.SizeBytes
+					included = append(included, db)
+				}
+			}
+
+			if total == 0 {
+				add("", "", unattributed, object.Size)
+				continue
+			}
+
+			for _, db := range included {
+				add(db.Engine, db.Host, db.Name, object.Size*db.SizeBytes/total)
+			}
+		}
+
+		for _, entry := range usage {
+			entries = append(entries, *entry)
+		}
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].Target != entries[j].Target {
+			return entries[i].Target < entries[j].Target
+		}
+		return entries[i].Bytes > entries[j].Bytes
+	})
+
+	return entries, nil
+}
+
+// Usage is cached for the metrics server, as listing buckets on every scrape
+// would be slow and cost requests
+var (
+	usageMutex sync.Mutex
+
+	// Usage and when it was collected, by profile
+	usageCache    = map[string][]UsageEntry{}
+	usageCachedAt = map[string]time.Time{}
+)
+
+// How long collected usage is reused for metrics
+const usageCacheTime = time.Hour
+
+// Get the storage usage, collecting it again once the cached copy is an hour old
+func cachedUsage(ctx context.Context, config Config) ([]UsageEntry, error) {
+	usageMutex.Lock()
+	defer usageMutex.Unlock()
+
+	if cached, ok := usageCache[config.profile]; ok && time.Since(usageCachedAt[config.profile]) < usageCacheTime {
+		return cached, nil
+	}
+
+	entries, err := collectUsage(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+
+	usageCache[config.profile] = entries
+	usageCachedAt[config.profile] = time.Now()
+
+	return entries, nil
+}
+
+// Write the usage as a table
+func printUsage(w io.Writer, entries []UsageEntry) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TARGET\tENGINE\tHOST\tDATABASE\tOBJECTS\tSIZE")
+
+	totals := map[string]int64{}
+	targets := []string{}
+	for _, entry := range entries {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%d\t%s\n", entry.Target, entry.Engine, entry.Host, entry.Database, entry.Objects, formatBytes(entry.Bytes))
+
+		if _, ok := totals[entry.Target]; !ok {
+			targets = append(targets, entry.Target)
+		}
+		totals[entry.Target] += entry.Bytes
+	}
+
+	for _, target := range targets {
+		fmt.Fprintf(tw, "%s\t\t\ttotal\t\t%s\n", target, formatBytes(totals[target]))
+	}
+
+	return tw.Flush()
+}
+
+// Handle the usage subcommand. Usage: usage [--json]
+func runUsage(ctx context.Context, config Config, args []string) error {
+	flags := flag.NewFlagSet("usage", flag.ContinueOnError)
+	asJSON := flags.Bool("json", false, "output JSON instead of a table")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	entries, err := collectUsage(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(entries)
+	}
+
+	return printUsage(os.Stdout, entries)
+}
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/robfig/cron"
+)
+
+// Engines that connect to a server over the network
+var networkEngines = map[string]bool{
+	"mysql":      true,
+	"mariadb":    true,
+	"mongodb":    true,
+	"redis":      true,
+	"mssql":      true,
+	"clickhouse": true,
+	"influxdb":   true,
+	"etcd":       true,
+	"ldap":       true,
+}
+
+// Engines that don't connect anywhere themselves
+var localEngines = map[string]bool{
+	"sqlite":  true,
+	"command": true,
+	"files":   true,
+}
+
+// Engines that have a cloud provider take the backup through its API
+var managedEngines = map[string]bool{
+	"rds_snapshot":    true,
+	"cloudsql_export": true,
+}
+
+// Sizes accepted by mysqldump's max_allowed_packet, e.g. "1073741824" or "512M"
+var packetSizePattern = regexp.MustCompile(`^[0-9]+[KMGkmg]?$`)
+
+// Collect every problem with the configuration into a single error
+type validationErrors []string
+
+func (v *validationErrors) add(format string, args ...interface{}) {
+	*v = append(*v, fmt.Sprintf(format, args...))
+}
+
+func (v validationErrors) Error() string {
+	return "invalid configuration:\n  " + strings.Join(v, "\n  ")
+}
+
+// Check a duration setting parses, if set
+func (v *validationErrors) checkDuration(where string, name string, value string) {
+	if value == "" {
+		return
+	}
+
+	if _, err := parseDuration(value); err != nil {
+		v.add("%s: invalid %s %q", where, name, value)
+	}
+}
+
+// Check the merged configuration for missing or invalid settings
+func validateConfig(config Config) error {
+	errs := validationErrors{}
+
+	if config.CronInterval == "" {
+		errs.add("cron_interval is required")
+	} else if _, err := cron.Parse(config.CronInterval); err != nil {
+		errs.add("invalid cron_interval %q: %s", config.CronInterval, err.Error())
+	}
+
+	if method := strings.ToUpper(config.Heartbeat.Method); method != "" && method != "GET" && method != "POST" {
+		errs.add("invalid heartbeat.method %q, expected GET or POST", config.Heartbeat.Method)
+	}
+
+	if config.Timezone != "" {
+		if _, err := time.LoadLocation(config.Timezone); err != nil {
+			errs.add("invalid timezone %q: %s", config.Timezone, err.Error())
+		}
+	}
+	if config.BlackoutTimezone != "" {
+		if _, err := time.LoadLocation(config.BlackoutTimezone); err != nil {
+			errs.add("invalid blackout_timezone %q: %s", config.BlackoutTimezone, err.Error())
+		}
+	}
+
+	// Backups written to stdout don't need anywhere to upload to
+	if len(config.targets()) == 0 && !stdoutMode() {
+		errs.add("s3_config.bucket or at least one entry in targets is required")
+	}
+
+	for i, target := range config.Targets {
+		where := fmt.Sprintf("targets[%d]", i)
+
+		switch target.Type {
+		case "local":
+			if target.Path == "" {
+				errs.add("%s: path is required for local targets", where)
+			}
+		case "s3":
+			if target.Bucket == "" {
+				errs.add("%s: bucket is required for s3 targets", where)
+			}
+		case "plugin":
+			if target.Command == "" {
+				errs.add("%s: command is required for plugin targets", where)
+			}
+		default:
+			errs.add("%s: unknown type %q", where, target.Type)
+		}
+
+		errs.checkDuration(where, "retention", target.Retention)
+		validateWebIdentity(&errs, where, target.WebIdentity, target.RoleARN, target.AccessKey)
+	}
+
+	for i, replica := range config.Replicas {
+		if replica.Bucket == "" {
+			errs.add("replicas[%d]: bucket is required", i)
+		}
+	}
+
+	for i, blackout := range config.Blackouts {
+		if err := blackout.validate(); err != nil {
+			errs.add("blackouts[%d]: %s", i, err.Error())
+		}
+	}
+
+	notifierNames := map[string]bool{}
+	for i, monitor := range config.Monitors {
+		where := fmt.Sprintf("monitors[%d]", i)
+
+		switch monitor.Type {
+		case "cronitor":
+			if monitor.Key == "" || monitor.APIKey == "" {
+				errs.add("%s: key and api_key are required for cronitor", where)
+			}
+		case "betteruptime":
+			if monitor.Token == "" {
+				errs.add("%s: token is required for betteruptime", where)
+			}
+		default:
+			errs.add("%s: unknown type %q, expected cronitor or betteruptime", where, monitor.Type)
+		}
+	}
+
+	for i, notifier := range config.Notifications {
+		where := fmt.Sprintf("notifications[%d]", i)
+
+		if notifier.Name != "" && notifierNames[notifier.Name] {
+			errs.add("%s: name %q is used by another notifier", where, notifier.Name)
+		}
+		notifierNames[notifier.Name] = true
+		if notifier.RoutedOnly && notifier.Name == "" {
+			errs.add("%s: routed_only needs a name for databases to route to", where)
+		}
+
+		if notifier.Type != "slack" && notifier.Type != "webhook" && notifier.Type != "zabbix" && notifier.Type != "snmp" && notifier.Type != "plugin" && !notifier.publishesEvents() {
+			errs.add("%s: unknown type %q", where, notifier.Type)
+		}
+		if notifier.Type == "zabbix" && notifier.ZabbixHost == "" {
+			errs.add("%s: zabbix_host is required for zabbix", where)
+		}
+		if notifier.SNMPOID != "" {
+			if _, err := berOID(notifier.SNMPOID); err != nil {
+				errs.add("%s: %s", where, err.Error())
+			}
+		}
+		if notifier.publishesEvents() && notifier.Topic == "" {
+			errs.add("%s: topic is required for %s", where, notifier.Type)
+		}
+		if notifier.Type == "plugin" {
+			if notifier.Command == "" {
+				errs.add("%s: command is required for plugin", where)
+			}
+		} else if notifier.URL == "" {
+			errs.add("%s: url is required", where)
+		}
+
+		errs.checkDuration(where, "rate_limit", notifier.RateLimit)
+	}
+
+	if config.Concurrency < 0 {
+		errs.add("concurrency must not be negative, got %d", config.Concurrency)
+	}
+	if config.MaxConcurrentPerHost < 0 {
+		errs.add("max_concurrent_per_host must not be negative, got %d", config.MaxConcurrentPerHost)
+	}
+
+	if config.Resources.Nice < -20 || config.Resources.Nice > 19 {
+		errs.add("resources.nice must be between -20 and 19, got %d", config.Resources.Nice)
+	}
+	if _, ok := ioClasses[config.Resources.IOClass]; config.Resources.IOClass != "" && !ok {
+		errs.add("unknown resources.io_class %q", config.Resources.IOClass)
+	}
+	if config.Resources.IOPriority < 0 || config.Resources.IOPriority > 7 {
+		errs.add("resources.io_priority must be between 0 and 7, got %d", config.Resources.IOPriority)
+	}
+	if _, err := config.Memory.settings(); err != nil {
+		errs.add("memory: %s", err.Error())
+	}
+	if config.Memory.UploadConcurrency < 0 {
+		errs.add("memory.upload_concurrency must not be negative, got %d", config.Memory.UploadConcurrency)
+	}
+	if config.Resources.MaxProcs < 0 {
+		errs.add("resources.max_procs must not be negative, got %d", config.Resources.MaxProcs)
+	}
+
+	if config.CompressionLevel < 1 || config.CompressionLevel > 9 {
+		errs.add("compression_level must be between 1 and 9, got %d", config.CompressionLevel)
+	}
+
+	if config.ArchiveFormat != "" && config.ArchiveFormat != "tar.gz" && config.ArchiveFormat != "zip" {
+		errs.add("unknown archive_format %q, expected tar.gz or zip", config.ArchiveFormat)
+	}
+
+	if config.encryptArchives() && config.Dedup.Enabled {
+		errs.add("encryption.passphrase can't be used with dedup, only archives are encrypted")
+	}
+	validateEncryption(&errs, config.Encryption)
+
+	validateAgent(&errs, config.Agent)
+
+	errs.checkDuration("s3_config", "retention", config.S3Config.Retention)
+	validateWebIdentity(&errs, "s3_config", config.S3Config.WebIdentity, config.S3Config.RoleARN, config.S3Config.AccessKey)
+	errs.checkDuration("config", "max_backup_age", config.MaxBackupAge)
+	errs.checkDuration("config", "max_run_duration", config.MaxRunDuration)
+	errs.checkDuration("config", "stall_timeout", config.StallTimeout)
+	errs.checkDuration("maintenance", "signal_pause", config.Maintenance.SignalPause)
+	errs.checkDuration("config", "stale_file_age", config.StaleFileAge)
+	errs.checkDuration("retry_failed", "delay", config.RetryFailed.Delay)
+
+	if config.Tiering.enabled() {
+		errs.checkDuration("tiering", "after", config.Tiering.After)
+		if config.S3Config.Bucket == "" {
+			errs.add("tiering: s3_config.bucket is required")
+		}
+		if _, err := cron.Parse(config.Tiering.Schedule); err != nil {
+			errs.add("tiering: invalid schedule %q: %s", config.Tiering.Schedule, err.Error())
+		}
+		if config.Tiering.RestoreTier != "Standard" && config.Tiering.RestoreTier != "Bulk" {
+			errs.add("tiering: unknown restore_tier %q, expected Standard or Bulk", config.Tiering.RestoreTier)
+		}
+	}
+
+	if config.SizeBudget.MaxTotalSize != "" {
+		if _, err := parseSize(config.SizeBudget.MaxTotalSize); err != nil {
+			errs.add("size_budget: invalid max_total_size %q", config.SizeBudget.MaxTotalSize)
+		}
+	}
+	if config.SizeBudget.Action != "" && config.SizeBudget.Action != "warn" && config.SizeBudget.Action != "abort" {
+		errs.add("size_budget: unknown action %q, expected warn or abort", config.SizeBudget.Action)
+	}
+
+	if config.Cost.StoragePerGBMonth < 0 || config.Cost.RequestsPer1000 < 0 || config.Cost.TransferPerGB < 0 {
+		errs.add("cost: prices must not be negative")
+	}
+
+	if config.MaxDownloadRate != "" {
+		if _, err := parseSize(config.MaxDownloadRate); err != nil {
+			errs.add("invalid max_download_rate %q", config.MaxDownloadRate)
+		}
+	}
+
+	if config.History.MaxEntries < 0 {
+		errs.add("history.max_entries must not be negative, got %d", config.History.MaxEntries)
+	}
+	errs.checkDuration("history", "max_age", config.History.MaxAge)
+	errs.checkDuration("history", "compact_after", config.History.CompactAfter)
+
+	config.Signing.validate(&errs)
+
+	if config.RetryFailed.Attempts < 0 {
+		errs.add("retry_failed.attempts must not be negative, got %d", config.RetryFailed.Attempts)
+	}
+
+	if len(config.Databases) == 0 && !config.Inventory.enabled() {
+		errs.add("at least one database or an inventory is required")
+	}
+
+	config.Inventory.validate(&errs)
+
+	groupNames := map[string]bool{}
+	for i, group := range config.Groups {
+		where := fmt.Sprintf("groups[%d]", i)
+
+		if group.Name == "" {
+			errs.add("%s: name is required", where)
+		} else if groupNames[group.Name] {
+			errs.add("%s: name %q is used by another group", where, group.Name)
+		}
+		groupNames[group.Name] = true
+
+		errs.checkDuration(where, "hook_timeout", group.HookTimeout)
+	}
+
+	for i, db := range config.Databases {
+		where := db.source
+		if where == "" {
+			where = fmt.Sprintf("databases[%d]", i)
+		}
+
+		validateDatabase(&errs, config, where, db)
+
+		if db.Group != "" && !groupNames[db.Group] {
+			errs.add("%s: group %q isn't in groups", where, db.Group)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+// Check a target's federated identity settings
+func validateWebIdentity(errs *validationErrors, where string, webIdentity string, roleARN string, accessKey string) {
+	if webIdentity == "" {
+		return
+	}
+	if roleARN == "" {
+		errs.add("%s: role_arn is required with web_identity", where)
+	}
+	if accessKey != "" {
+		errs.add("%s: access_key can't be set with web_identity", where)
+	}
+}
+
+// Check a single database entry, from the configuration or an inventory
+func validateDatabase(errs *validationErrors, config Config, where string, db DatabaseConfig) {
+	if !networkEngines[db.Engine] && !localEngines[db.Engine] && !managedEngines[db.Engine] {
+		errs.add("%s: unknown engine %q", where, db.Engine)
+		return
+	}
+
+	if networkEngines[db.Engine] {
+		if db.Host == "" {
+			errs.add("%s: host is required", where)
+		} else if strings.HasPrefix(db.Host, "[") && bareHost(db.Host) == db.Host {
+			errs.add("%s: invalid host %q, IPv6 addresses need a closing bracket", where, db.Host)
+		}
+		if db.Port < 1 || db.Port > 65535 {
+			errs.add("%s: invalid port %d", where, db.Port)
+		}
+	}
+
+	if db.MaxAllowedPacket != "" && !packetSizePattern.MatchString(db.MaxAllowedPacket) {
+		errs.add("%s: invalid max_allowed_packet %q, expected a size like 512M", where, db.MaxAllowedPacket)
+	}
+	if db.NetBufferLength != 0 && (db.NetBufferLength < 4096 || db.NetBufferLength > 16777216) {
+		errs.add("%s: net_buffer_length must be between 4096 and 16777216, got %d", where, db.NetBufferLength)
+	}
+
+	labels := mergeLabels(config.Labels, db.Labels)
+	if len(labels) > maxObjectTags {
+		errs.add("%s: %d labels including the top-level ones, at most %d are allowed", where, len(labels), maxObjectTags)
+	}
+	if _, ok := labels[""]; ok {
+		errs.add("%s: labels must not have an empty key", where)
+	}
+
+	for _, name := range db.Notify {
+		found := false
+		for _, notifier := range config.Notifications {
+			if notifier.Name == name {
+				found = true
+			}
+		}
+		if !found {
+			errs.add("%s: notify names %q, but no notifier has that name", where, name)
+		}
+	}
+
+	if db.TableSummary != "" && db.TableSummary != "rows" && db.TableSummary != "checksum" {
+		errs.add("%s: invalid table_summary %q, expected rows or checksum", where, db.TableSummary)
+	}
+
+	if db.ParallelTables < 0 {
+		errs.add("%s: parallel_tables must not be negative, got %d", where, db.ParallelTables)
+	}
+	if db.SplitTables {
+		if db.Engine != "mysql" && db.Engine != "mariadb" {
+			errs.add("%s: split_tables is only supported for mysql and mariadb", where)
+		}
+		if db.ParallelTables > 1 {
+			errs.add("%s: split_tables can't be combined with parallel_tables, which already dumps a file per table", where)
+		}
+		if db.DumpTool == "mysqlpump" {
+			errs.add("%s: split_tables needs dump_tool mysqldump", where)
+		}
+	}
+
+	if db.TableExport.enabled() || db.TableExport.Only || len(db.TableExport.Tables) > 0 {
+		if db.Engine != "mysql" && db.Engine != "mariadb" {
+			errs.add("%s: table_export is only supported for mysql and mariadb", where)
+		}
+		if db.TableExport.Format != "csv" && db.TableExport.Format != "tsv" && db.TableExport.Format != "parquet" {
+			errs.add("%s: invalid table_export.format %q, expected csv, tsv or parquet", where, db.TableExport.Format)
+		}
+		if len(db.TableExport.Schema) > 0 && db.TableExport.Format != "parquet" {
+			errs.add("%s: table_export.schema only applies to format parquet", where)
+		}
+		for column, kind := range db.TableExport.Schema {
+			if !strings.Contains(column, ".") {
+				errs.add("%s: table_export.schema key %q should be table.column", where, column)
+			}
+			if _, ok := parquetTypes[kind]; !ok {
+				errs.add("%s: table_export.schema has unknown type %q for %s, expected string, binary, int64, double, boolean, timestamp or date", where, kind, column)
+			}
+		}
+		for _, name := range append([]string{db.DBName}, db.DBNames...) {
+			if name == "*" {
+				errs.add("%s: table_export needs the databases named, not \"*\"", where)
+			}
+		}
+		if db.TableExport.Only && (db.ChangeDetection != "" || db.FullBackupInterval != "") {
+			errs.add("%s: table_export.only can't be combined with change_detection or full_backup_interval, which need SQL dumps", where)
+		}
+	}
+
+	if db.IAMAuth.Enabled {
+		if db.Engine != "mysql" && db.Engine != "mariadb" {
+			errs.add("%s: iam_auth is only supported for mysql and mariadb", where)
+		}
+		if db.IAMAuth.Region == "" {
+			errs.add("%s: iam_auth.region is required", where)
+		}
+		if db.Password != "" {
+			errs.add("%s: password can't be set with iam_auth", where)
+		}
+	}
+
+	if db.DumpTool != "" && db.DumpTool != "mysqldump" && db.DumpTool != "mysqlpump" {
+		errs.add("%s: unknown dump_tool %q, expected mysqldump or mysqlpump", where, db.DumpTool)
+	}
+	if db.DumpTool == "mysqlpump" {
+		if db.Engine != "mysql" {
+			errs.add("%s: dump_tool mysqlpump is only supported for mysql", where)
+		}
+		if db.ParallelTables > 1 {
+			errs.add("%s: dump_tool mysqlpump can't be combined with parallel_tables, use pump_parallelism", where)
+		}
+	}
+	if db.PumpParallelism < 0 {
+		errs.add("%s: pump_parallelism must not be negative, got %d", where, db.PumpParallelism)
+	}
+	if len(db.ExcludeDatabases) > 0 && db.DumpTool != "mysqlpump" {
+		errs.add("%s: exclude_databases needs dump_tool mysqlpump", where)
+	}
+
+	if _, ok := mysqlLocks[db.Lock]; db.Lock != "" && !ok {
+		errs.add("%s: unknown lock %q, expected flush or instance", where, db.Lock)
+	}
+	errs.checkDuration(where, "max_lock_time", db.MaxLockTime)
+
+	if db.MaxSize != "" {
+		if _, err := parseSize(db.MaxSize); err != nil {
+			errs.add("%s: invalid max_size %q", where, db.MaxSize)
+		}
+	}
+
+	if db.Compat != "" && !mysqlProfiles[db.Compat] {
+		errs.add("%s: unknown compat %q", where, db.Compat)
+	}
+	validateDumpPreset(errs, where, db)
+	validateProcessors(errs, config, where, db)
+
+	if db.Discovery.SRV != "" && db.Discovery.ConsulService != "" {
+		errs.add("%s: discovery takes srv or consul_service, not both", where)
+	}
+
+	if db.DBName == "" && len(db.DBNames) == 0 {
+		errs.add("%s: name or names is required", where)
+	}
+
+	if db.Engine == "rds_snapshot" {
+		if db.RDS.Region == "" {
+			errs.add("%s: rds.region is required for the rds_snapshot engine", where)
+		}
+		errs.checkDuration(where, "rds.timeout", db.RDS.Timeout)
+		errs.checkDuration(where, "rds.retention", db.RDS.Retention)
+	}
+
+	if db.Engine == "cloudsql_export" {
+		if db.CloudSQL.Project == "" || db.CloudSQL.Instance == "" {
+			errs.add("%s: cloudsql.project and cloudsql.instance are required for the cloudsql_export engine", where)
+		}
+		if !strings.HasPrefix(db.CloudSQL.Bucket, "gs://") {
+			errs.add("%s: cloudsql.bucket must be a gs:// URI, got %q", where, db.CloudSQL.Bucket)
+		}
+		errs.checkDuration(where, "cloudsql.timeout", db.CloudSQL.Timeout)
+	}
+
+	if db.Engine == "command" && db.Command == "" {
+		errs.add("%s: command is required for the command engine", where)
+	}
+
+	if db.Engine == "files" {
+		validateFiles(errs, where, db.Files)
+	}
+
+	if db.ChangeDetection != "" && db.ChangeDetection != "update_time" && db.ChangeDetection != "checksum" {
+		errs.add("%s: invalid change_detection %q", where, db.ChangeDetection)
+	}
+
+	errs.checkDuration(where, "full_backup_interval", db.FullBackupInterval)
+	errs.checkDuration(where, "max_backup_age", db.MaxBackupAge)
+}
+
+// Check the passphrases, whose key IDs have to tell them apart
+func validateEncryption(errs *validationErrors, encryption EncryptionConfig) {
+	if encryption.KeyID != "" && encryption.Passphrase == "" {
+		errs.add("encryption.key_id is set without a passphrase")
+	}
+
+	seen := map[string]bool{encryption.KeyID: encryption.KeyID != ""}
+	for i, key := range append([]EncryptionKey{{KeyID: encryption.KeyID}}, encryption.OldPassphrases...) {
+		if len(key.KeyID) > 255 {
+			errs.add("encryption key_id %q is longer than 255 bytes", key.KeyID)
+		}
+		if i == 0 {
+			continue
+		}
+
+		if key.Passphrase == "" {
+			errs.add("encryption.old_passphrases[%d] has no passphrase", i-1)
+		}
+		if key.KeyID != "" && seen[key.KeyID] {
+			errs.add("encryption key_id %q is used more than once", key.KeyID)
+		}
+		seen[key.KeyID] = key.KeyID != ""
+	}
+}
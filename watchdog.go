@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// Get how long a dump or upload may go without progress before it's
+// aborted, or 0 to never abort one
+func (config Config) stallTimeout() time.Duration {
+	if config.StallTimeout == "" {
+		return 0
+	}
+
+	timeout, err := parseDuration(config.StallTimeout)
+	if err != nil {
+		return 0
+	}
+
+	return timeout
+}
+
+// Error a phase fails with when the watchdog aborted it
+func stallError(phase string, timeout time.Duration) error {
+	return fmt.Errorf("%s stalled, nothing was written for %s", phase, timeout)
+}
+
+// Call cancel when current, polled for the bytes written so far, stays the
+// same for timeout. The returned stop function reports whether it did.
+func watchStall(label string, timeout time.Duration, current func() int64, cancel context.CancelFunc) func() bool {
+	if timeout <= 0 {
+		return func() bool { return false }
+	}
+
+	var stalled int32
+	done := make(chan struct{})
+
+	// Polled often enough to abort within a tenth of the timeout
+	interval := timeout / 10
+	if interval < time.Second {
+		interval = time.Second
+	}
+
+	go func() {
+		last := current()
+		progressed := clk.Now()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-clk.After(interval):
+				if bytes := current(); bytes != last {
+					last = bytes
+					progressed = clk.Now()
+					continue
+				}
+
+				if clk.Now().Sub(progressed) >= timeout {
+					log.Printf("%s made no progress for %s, aborting it\n", label, timeout)
+					atomic.StoreInt32(&stalled, 1)
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	return func() bool {
+		close(done)
+		return atomic.LoadInt32(&stalled) == 1
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+// Metadata endpoints the workload's own identity token is fetched from
+const (
+	gcpIdentityEndpoint   = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/identity"
+	azureIdentityEndpoint = "http://169.254.169.254/metadata/identity/oauth2/token"
+)
+
+// Audiences requested by default, matching what each platform's federation
+// guides set up on the AWS OIDC provider
+var defaultAudiences = map[string]string{
+	"gcp":   "sts.amazonaws.com",
+	"azure": "api://AzureADTokenExchange",
+}
+
+// Resolve a web_identity token file path, leaving the platform names alone
+func expandIdentityPath(webIdentity string, base string) string {
+	if _, ok := defaultAudiences[webIdentity]; ok {
+		return webIdentity
+	}
+
+	return expandPath(webIdentity, base)
+}
+
+// Fetch the OIDC token a target's role is assumed with: a GCP service
+// account's identity token, an Azure managed identity's token, or the
+// contents of a token file such as a Kubernetes projected service account
+// token. Fetched again on every refresh, so no long-lived secret is stored.
+type webIdentityToken struct {
+	target TargetConfig
+}
+
+func (t webIdentityToken) FetchToken(ctx credentials.Context) ([]byte, error) {
+	audience := t.target.WebIdentityAudience
+	if audience == "" {
+		audience = defaultAudiences[t.target.WebIdentity]
+	}
+
+	var req *http.Request
+	var err error
+
+	switch t.target.WebIdentity {
+	case "gcp":
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, gcpIdentityEndpoint+"?audience="+url.QueryEscape(audience), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Metadata-Flavor", "Google")
+	case "azure":
+		query := url.Values{"api-version": {"2018-02-01"}, "resource": {audience}}
+		if t.target.WebIdentityClientID != "" {
+			query.Set("client_id", t.target.WebIdentityClientID)
+		}
+		req, err = http.NewRequestWithContext(ctx, http.MethodGet, azureIdentityEndpoint+"?"+query.Encode(), nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Metadata", "true")
+	default:
+		token, err := os.ReadFile(t.target.WebIdentity)
+		if err != nil {
+			return nil, fmt.Errorf("error reading web identity token: %w", err)
+		}
+		return []byte(strings.TrimSpace(string(token))), nil
+	}
+
+	client := http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching %s identity token: %w", t.target.WebIdentity, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error fetching %s identity token: unexpected status %s", t.target.WebIdentity, resp.Status)
+	}
+
+	// GCP returns the bare token, Azure wraps it in JSON
+	if t.target.WebIdentity == "azure" {
+		token := struct {
+			AccessToken string `json:"access_token"`
+		}{}
+		err = json.Unmarshal(body, &token)
+		if err != nil {
+			return nil, err
+		}
+		body = []byte(token.AccessToken)
+	}
+
+	return body, nil
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// A value sent to a Zabbix trapper item
+type zabbixItem struct {
+	Host  string `json:"host"`
+	Key   string `json:"key"`
+	Value string `json:"value"`
+	Clock int64  `json:"clock"`
+}
+
+// Items that failed to be processed are reported as "failed: N" in the info
+var zabbixFailedPattern = regexp.MustCompile(`failed: (\d+)`)
+
+// Quote a Zabbix item key parameter, in which only quotes are escaped
+func zabbixParam(value string) string {
+	return `"` + strings.ReplaceAll(value, `"`, `\"`) + `"`
+}
+
+// Build the items for a finished run: dbbackup.status (1 for success, 0 for
+// failure), dbbackup.duration and dbbackup.size for the run and for each
+// database keyed by its host and name, e.g. dbbackup.status["db1","shop"],
+// and dbbackup.databases, a low-level discovery of the databases
+func zabbixItems(notifier NotifierConfig, notification Notification) ([]zabbixItem, error) {
+	report := notification.Report
+
+	// Only finished runs have a status to send
+	if report == nil || notification.Event == "backup.started" {
+		return nil, nil
+	}
+
+	clock := notification.Time.Unix()
+	items := []zabbixItem{}
+	add := func(key string, value string) {
+		items = append(items, zabbixItem{Host: notifier.ZabbixHost, Key: key, Value: value, Clock: clock})
+	}
+	status := func(success bool) string {
+		if success {
+			return "1"
+		}
+		return "0"
+	}
+
+	discovery := []map[string]string{}
+	for _, db := range report.Databases {
+		discovery = append(discovery, map[string]string{"{#DBENGINE}": db.Engine, "{#DBHOST}": db.Host, "{#DBNAME}": db.Name})
+	}
+	data, err := json.Marshal(discovery)
+	if err != nil {
+		return nil, err
+	}
+
+	// Discovery goes first so Zabbix knows the databases' items, though it
+	// only creates them after processing it, so values for a new database
+	// are dropped until its next run
+	add("dbbackup.databases", string(data))
+
+	add("dbbackup.status", status(report.Success))
+	add("dbbackup.duration", strconv.FormatFloat(report.DurationSeconds, 'f', 1, 64))
+	add("dbbackup.size", strconv.FormatInt(report.ArchiveSizeBytes, 10))
+
+	for _, db := range report.Databases {
+		params := "[" + zabbixParam(db.Host) + "," + zabbixParam(db.Name) + "]"
+		add("dbbackup.status"+params, status(db.Success))
+		add("dbbackup.duration"+params, strconv.FormatFloat(db.DurationSeconds, 'f', 1, 64))
+		add("dbbackup.size"+params, strconv.FormatInt(db.SizeBytes, 10))
+	}
+
+	return items, nil
+}
+
+// Send items to a Zabbix server or proxy with the sender protocol, the way
+// zabbix_sender does. The URL is zabbix://host:port, the port defaulting to
+// 10051. The items must be trapper items on the host.
+func sendZabbix(ctx context.Context, rawURL string, items []zabbixItem) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return err
+	}
+
+	host := u.Host
+	if u.Port() == "" {
+		host = net.JoinHostPort(u.Hostname(), "10051")
+	}
+
+	body, err := json.Marshal(map[string]interface{}{
+		"request": "sender data",
+		"data":    items,
+		"clock":   time.Now().Unix(),
+	})
+	if err != nil {
+		return err
+	}
+
+	dialer := net.Dialer{Timeout: 30 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", host)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(30 * time.Second))
+
+	// "ZBXD", the protocol flag and the length as 8 bytes little endian
+	packet := append([]byte("ZBXD\x01"), make([]byte, 8)...)
+	binary.LittleEndian.PutUint64(packet[5:], uint64(len(body)))
+	_, err = conn.Write(append(packet, body...))
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, 13)
+	_, err = io.ReadFull(conn, header)
+	if err != nil {
+		return fmt.Errorf("error reading response: %w", err)
+	}
+	if string(header[:4]) != "ZBXD" || header[4]&0x01 == 0 {
+		return fmt.Errorf("unexpected response from %s, is it a Zabbix server?", host)
+	}
+	if header[4]&0x02 != 0 {
+		return fmt.Errorf("unsupported compressed response from %s", host)
+	}
+
+	length := binary.LittleEndian.Uint32(header[5:9])
+	if length > 1024*1024 {
+		return fmt.Errorf("response too big (%d bytes)", length)
+	}
+	data := make([]byte, length)
+	_, err = io.ReadFull(conn, data)
+	if err != nil {
+		return fmt.Errorf("error reading response: %w", err)
+	}
+
+	var response struct {
+		Response string `json:"response"`
+		Info     string `json:"info"`
+	}
+	err = json.Unmarshal(data, &response)
+	if err != nil {
+		return fmt.Errorf("error parsing response: %w", err)
+	}
+	if response.Response != "success" {
+		return fmt.Errorf("%s: %s", response.Response, response.Info)
+	}
+
+	// Values for items that don't exist or aren't trapper items are dropped
+	if match := zabbixFailedPattern.FindStringSubmatch(response.Info); match != nil && match[1] != "0" {
+		return fmt.Errorf("some items were rejected, check they're trapper items on host %q: %s", items[0].Host, response.Info)
+	}
+
+	return nil
+}